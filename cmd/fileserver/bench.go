@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+)
+
+const benchUsage = `usage: fileserver bench [flags] <url>
+
+Generate upload and download load against a running server and report the
+throughput and latency of each. The files uploaded are written below -dir and
+deleted afterwards. The API key (with upload, download and delete permissions)
+may also be set in the FILESERVER_API_KEY environment variable.
+
+Runs with the same flags and -seed send the same sequence of requests and
+file contents, so a run before and after a configuration change compare fairly.
+
+flags:
+`
+
+// benchBlockSize is the size of the random block the contents of uploaded files repeat.
+const benchBlockSize = 64 << 10
+
+// benchSample is the outcome of one request.
+type benchSample struct {
+	upload  bool
+	latency time.Duration
+	bytes   int64
+	err     error
+}
+
+// runBench implements the "bench" subcommand and returns the process exit code.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, benchUsage)
+		fs.PrintDefaults()
+	}
+	key := fs.String("key", os.Getenv("FILESERVER_API_KEY"), "API key or token to authenticate with")
+	workers := fs.Int("c", 8, "number of requests sent at once")
+	duration := fs.Duration("duration", 30*time.Second, "how long to run, unless -n is given")
+	requests := fs.Int("n", 0, "number of requests to send, instead of running for -duration")
+	mode := fs.String("mode", "mixed", "requests to send: upload, download or mixed")
+	reads := fs.Float64("reads", 0.8, "share of downloads in mixed mode, from 0 to 1")
+	sizeFlag := fs.String("size", "1M", "size of the files uploaded (K, M and G are powers of 1024)")
+	files := fs.Int("files", 16, "number of files uploaded beforehand for downloads to read")
+	dir := fs.String("dir", "bench", "directory on the server below which the files are written")
+	seed := fs.Uint64("seed", 1, "seed of the requests and file contents")
+	keep := fs.Bool("keep", false, "leave the files uploaded on the server")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	size, err := parseSize(*sizeFlag)
+	if fs.NArg() != 1 || err != nil || *workers < 1 || *requests < 0 || *files < 1 ||
+		*reads < 0 || *reads > 1 || (*mode != "upload" && *mode != "download" && *mode != "mixed") {
+		fs.Usage()
+		return 2
+	}
+	client, err := newAPIClient(fs.Arg(0), *key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	// Why a transport of its own? The default keeps only two idle connections per host, so
+	// most workers would open a new connection for every request and measure that instead.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = *workers
+	client.http.Transport = transport
+
+	readShare := *reads
+	switch *mode {
+	case "upload":
+		readShare = 0
+	case "download":
+		readShare = 1
+	}
+	runDir := strings.Trim(*dir, "/") + "/" + time.Now().Format("20060102-150405")
+	block := make([]byte, benchBlockSize)
+	rand.NewChaCha8(seedBytes(*seed)).Read(block)
+
+	// The files downloads read are uploaded first, and not measured.
+	var readable []string
+	if readShare > 0 {
+		fmt.Fprintf(os.Stderr, "uploading %d files of %s to %s for downloads...\n", *files, formatSize(size), runDir)
+		for i := range *files {
+			name := fmt.Sprintf("read-%d.bin", i)
+			if err := client.uploadFrom(newBenchReader(block, size, uint64(i)), name, runDir); err != nil {
+				fmt.Fprintf(os.Stderr, "error uploading %s: %v\n", name, err)
+				cleanUpBench(client, runDir, *keep)
+				return 1
+			}
+			readable = append(readable, runDir+"/"+name)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "running %d workers...\n", *workers)
+	var (
+		sent     atomic.Int64
+		mu       sync.Mutex
+		samples  []benchSample
+		wg       sync.WaitGroup
+		deadline = time.Now().Add(*duration)
+	)
+	start := time.Now()
+	for w := range *workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Each worker draws from a generator of its own, so the sequence of requests
+			// does not depend on how the workers are scheduled.
+			rng := rand.New(rand.NewPCG(*seed, uint64(w)))
+			var own []benchSample
+			for i := 0; ; i++ {
+				if *requests > 0 {
+					if sent.Add(1) > int64(*requests) {
+						break
+					}
+				} else if time.Now().After(deadline) {
+					break
+				}
+				s := benchSample{upload: rng.Float64() >= readShare}
+				t := time.Now()
+				if s.upload {
+					name := fmt.Sprintf("write-%d-%d.bin", w, i)
+					s.err = client.uploadFrom(newBenchReader(block, size, rng.Uint64()), name, runDir)
+					s.bytes = size
+				} else {
+					s.bytes, s.err = client.fetch(readable[rng.IntN(len(readable))], io.Discard, nil)
+					if s.err == nil && s.bytes != size {
+						s.err = fmt.Errorf("downloaded %d bytes of %d", s.bytes, size)
+					}
+				}
+				s.latency = time.Since(t)
+				own = append(own, s)
+			}
+			mu.Lock()
+			samples = append(samples, own...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	reportBench(os.Stdout, fs.Arg(0), *workers, size, elapsed, samples)
+	cleanUpBench(client, runDir, *keep)
+	for _, s := range samples {
+		if s.err != nil {
+			return 1
+		}
+	}
+	return 0
+}
+
+// reportBench writes the throughput and latency percentiles of samples, by kind of request,
+// followed by the first few errors.
+func reportBench(w io.Writer, target string, workers int, size int64, elapsed time.Duration, samples []benchSample) {
+	fmt.Fprintf(w, "target:   %s\n", target)
+	fmt.Fprintf(w, "workers:  %d, files of %s, %.1fs\n\n", workers, formatSize(size), elapsed.Seconds())
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "\trequests\terrors\treq/s\tMiB/s\tp50\tp90\tp99\tmax\t")
+	var errs []error
+	for _, upload := range []bool{true, false} {
+		var latencies []time.Duration
+		var failed int
+		var bytes int64
+		for _, s := range samples {
+			if s.upload != upload {
+				continue
+			}
+			if s.err != nil {
+				failed++
+				if len(errs) < 5 {
+					errs = append(errs, s.err)
+				}
+				continue
+			}
+			latencies = append(latencies, s.latency)
+			bytes += s.bytes
+		}
+		if len(latencies)+failed == 0 {
+			continue
+		}
+		slices.Sort(latencies)
+		op := "download"
+		if upload {
+			op = "upload"
+		}
+		secs := elapsed.Seconds()
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%.1f\t%s\t%s\t%s\t%s\t\n", op, len(latencies)+failed, failed,
+			float64(len(latencies))/secs, float64(bytes)/secs/(1<<20),
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), percentile(latencies, 100))
+	}
+	tw.Flush()
+	if len(errs) > 0 {
+		fmt.Fprintln(w, "\nfirst errors:")
+		for _, err := range errs {
+			fmt.Fprintf(w, "  %v\n", err)
+		}
+	}
+}
+
+// percentile returns the p-th percentile of the sorted latencies, rounded for display.
+func percentile(sorted []time.Duration, p int) string {
+	if len(sorted) == 0 {
+		return "-"
+	}
+	i := min((len(sorted)*p+99)/100, len(sorted)) - 1
+	return sorted[max(i, 0)].Round(100 * time.Microsecond).String()
+}
+
+// cleanUpBench deletes the files of the run, unless they are to be kept.
+func cleanUpBench(client *apiClient, runDir string, keep bool) {
+	if keep {
+		fmt.Fprintf(os.Stderr, "files left in %s\n", runDir)
+		return
+	}
+	if err := client.remove(runDir, true); err != nil {
+		fmt.Fprintf(os.Stderr, "error deleting %s: %v\n", runDir, err)
+	}
+}
+
+// benchReader reads size bytes of a file's contents: the random block, rotated by an offset
+// so that files differ and are not deduplicated or compressed away.
+type benchReader struct {
+	block     []byte
+	offset    int
+	remaining int64
+}
+
+func newBenchReader(block []byte, size int64, offset uint64) *benchReader {
+	return &benchReader{block: block, offset: int(offset % uint64(len(block))), remaining: size}
+}
+
+func (r *benchReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(int64(len(p)), r.remaining)], r.block[r.offset:])
+	r.offset = (r.offset + n) % len(r.block)
+	r.remaining -= int64(n)
+	return n, nil
+}
+
+// parseSize parses a size such as "512", "64K", "1.5M" or "2G".
+func parseSize(s string) (int64, error) {
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	mult := 1.0
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'K':
+			mult = 1 << 10
+		case 'M':
+			mult = 1 << 20
+		case 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return 0, errors.New("invalid size")
+	}
+	return int64(v * mult), nil
+}
+
+// seedBytes returns the 32 bytes that seed a ChaCha8 generator with seed.
+func seedBytes(seed uint64) [32]byte {
+	var b [32]byte
+	binary.LittleEndian.PutUint64(b[:], seed)
+	return b
+}
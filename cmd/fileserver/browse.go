@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"cmp"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const browseUsage = `usage: fileserver browse [-key key] [-dir local-dir] <url>
+
+Browse the files of a running server in the terminal, for when its web pages
+cannot be opened, such as over SSH. The API key may also be set in the
+FILESERVER_API_KEY environment variable.
+
+keys:
+  up, down, pgup, pgdn    move the selection
+  enter, right            open a directory
+  left, backspace         go up to the parent directory
+  /                       search the names of all files; esc clears the search
+  d                       download the selected file to local-dir
+  u                       upload a local file to the directory shown
+  x, delete               delete the selected file or directory, once confirmed
+  r                       reload the listing
+  q                       quit
+`
+
+// progressInterval is how often the status line shows the progress of a transfer.
+const progressInterval = 200 * time.Millisecond
+
+// Escape sequences of the terminal.
+const (
+	altScreenOn  = "\x1b[?1049h"
+	altScreenOff = "\x1b[?1049l"
+	cursorHide   = "\x1b[?25l"
+	cursorShow   = "\x1b[?25h"
+	clearScreen  = "\x1b[H\x1b[2J"
+	reverseOn    = "\x1b[7m"
+	boldOn       = "\x1b[1m"
+	styleOff     = "\x1b[0m"
+	clearLine    = "\r\x1b[2K"
+)
+
+// Keys read from the terminal that are not printable characters.
+const (
+	keyUp = -(iota + 1)
+	keyDown
+	keyLeft
+	keyRight
+	keyPageUp
+	keyPageDown
+	keyHome
+	keyEnd
+	keyDelete
+	keyEnter
+	keyBackspace
+	keyEscape
+	keyInterrupt
+)
+
+// runBrowse implements the "browse" subcommand and returns the process exit code.
+func runBrowse(args []string) int {
+	fs := flag.NewFlagSet("browse", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, browseUsage) }
+	key := fs.String("key", os.Getenv("FILESERVER_API_KEY"), "API key or token to authenticate with")
+	localDir := fs.String("dir", ".", "local directory downloads are saved to")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprint(os.Stderr, browseUsage)
+		return 2
+	}
+	client, err := newAPIClient(fs.Arg(0), *key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 2
+	}
+	files, err := client.list()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error listing files: %v\n", err)
+		return 1
+	}
+
+	restore, err := makeRaw()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: browse needs an interactive terminal: %v\n", err)
+		return 1
+	}
+	b := &browser{
+		client:   client,
+		server:   fs.Arg(0),
+		localDir: *localDir,
+		files:    files,
+		in:       bufio.NewReader(os.Stdin),
+		out:      bufio.NewWriter(os.Stdout),
+	}
+	b.out.WriteString(altScreenOn + cursorHide)
+	b.run()
+	b.out.WriteString(cursorShow + altScreenOff)
+	b.out.Flush()
+	restore()
+	return 0
+}
+
+// entry is a line of the browser: a file, or a directory summarising the files below it.
+type entry struct {
+	label    string // as shown
+	name     string // the stored path
+	dir      bool
+	parent   bool // the ".." entry
+	size     int64
+	files    int // below a directory
+	modified time.Time
+}
+
+// browser is the state of the browse command.
+type browser struct {
+	client   *apiClient
+	server   string
+	localDir string
+	files    []remoteFile
+
+	dir     string // the directory shown, "" for the storage directory
+	query   string // the search, if any, which shows matching files from every directory
+	entries []entry
+	cursor  int
+	top     int // the first entry on screen
+	status  string
+
+	in  *bufio.Reader
+	out *bufio.Writer
+}
+
+// run handles keys until the user quits.
+func (b *browser) run() {
+	b.update("")
+	for {
+		b.draw()
+		key := b.readKey()
+		switch key {
+		case 'q', keyInterrupt:
+			return
+		case keyUp, 'k':
+			b.move(-1)
+		case keyDown, 'j':
+			b.move(1)
+		case keyPageUp:
+			b.move(-b.rows())
+		case keyPageDown:
+			b.move(b.rows())
+		case keyHome, 'g':
+			b.move(-len(b.entries))
+		case keyEnd, 'G':
+			b.move(len(b.entries))
+		case keyEnter, keyRight, 'l':
+			if e, ok := b.selected(); ok && e.parent {
+				b.up()
+			} else if ok && e.dir {
+				b.query = ""
+				b.dir = e.name
+				b.update("")
+			}
+		case keyLeft, keyBackspace, 'h':
+			b.up()
+		case keyEscape:
+			if b.query != "" {
+				b.query = ""
+				b.update("")
+			}
+		case '/':
+			if q, ok := b.prompt("Search: ", b.query); ok {
+				b.query = strings.TrimSpace(q)
+				b.update("")
+				if b.query != "" {
+					b.status = fmt.Sprintf("%d files match %q", len(b.entries), b.query)
+				}
+			}
+		case 'r':
+			b.reload("")
+		case 'd':
+			b.download()
+		case 'u':
+			b.upload()
+		case 'x', keyDelete:
+			b.remove()
+		}
+	}
+}
+
+// move moves the selection by n entries, within the list.
+func (b *browser) move(n int) {
+	b.cursor = max(0, min(b.cursor+n, len(b.entries)-1))
+}
+
+// selected returns the selected entry, if there is one.
+func (b *browser) selected() (entry, bool) {
+	if b.cursor < 0 || b.cursor >= len(b.entries) {
+		return entry{}, false
+	}
+	return b.entries[b.cursor], true
+}
+
+// up shows the parent of the directory shown, with the directory left selected.
+func (b *browser) up() {
+	if b.query != "" || b.dir == "" {
+		return
+	}
+	from := b.dir
+	b.dir = path.Dir(b.dir)
+	if b.dir == "." {
+		b.dir = ""
+	}
+	b.update(from)
+}
+
+// reload lists the files again, keeping the entry named selectName selected if it is still
+// there, or else the one at the same position.
+func (b *browser) reload(selectName string) {
+	files, err := b.client.list()
+	if err != nil {
+		b.status = "Error listing files: " + err.Error()
+		return
+	}
+	b.files = files
+	if selectName == "" {
+		if e, ok := b.selected(); ok {
+			selectName = e.name
+		}
+	}
+	b.update(selectName)
+}
+
+// update rebuilds the entries shown from the files, and selects the one named selectName,
+// or the first.
+func (b *browser) update(selectName string) {
+	cursor := b.cursor
+	b.entries = b.entries[:0]
+	if b.query != "" {
+		q := strings.ToLower(b.query)
+		for _, f := range b.files {
+			if strings.Contains(strings.ToLower(f.Name), q) {
+				b.entries = append(b.entries, entry{label: f.Name, name: f.Name, size: f.Size, modified: f.Modified})
+			}
+		}
+	} else {
+		prefix := ""
+		if b.dir != "" {
+			prefix = b.dir + "/"
+			b.entries = append(b.entries, entry{label: "../", name: path.Dir(b.dir), parent: true})
+		}
+		dirs := make(map[string]*entry)
+		var files []entry
+		for _, f := range b.files {
+			rest, ok := strings.CutPrefix(f.Name, prefix)
+			if !ok {
+				continue
+			}
+			sub, _, isDir := strings.Cut(rest, "/")
+			if !isDir {
+				files = append(files, entry{label: rest, name: f.Name, size: f.Size, modified: f.Modified})
+				continue
+			}
+			d, ok := dirs[sub]
+			if !ok {
+				d = &entry{label: sub + "/", name: prefix + sub, dir: true}
+				dirs[sub] = d
+			}
+			d.size += f.Size
+			d.files++
+			if f.Modified.After(d.modified) {
+				d.modified = f.Modified
+			}
+		}
+		var sorted []entry
+		for _, d := range dirs {
+			sorted = append(sorted, *d)
+		}
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].label < sorted[j].label })
+		sort.Slice(files, func(i, j int) bool { return files[i].label < files[j].label })
+		b.entries = append(append(b.entries, sorted...), files...)
+	}
+
+	b.cursor = 0
+	if selectName != "" {
+		b.cursor = min(cursor, len(b.entries)-1)
+		for i, e := range b.entries {
+			if e.name == selectName && !e.parent {
+				b.cursor = i
+				break
+			}
+		}
+	}
+	b.move(0)
+}
+
+// download saves the selected file in the local directory.
+func (b *browser) download() {
+	e, ok := b.selected()
+	if !ok || e.dir || e.parent {
+		b.status = "Select a file to download"
+		return
+	}
+	dest := filepath.Join(b.localDir, path.Base(e.name))
+	if _, err := os.Stat(dest); err == nil {
+		b.status = dest + " already exists"
+		return
+	}
+	err := b.client.download(e.name, dest, b.progress("Downloading "+e.name, e.size))
+	if err != nil {
+		b.status = "Error downloading " + e.name + ": " + err.Error()
+		return
+	}
+	b.status = fmt.Sprintf("Downloaded %s to %s", e.name, dest)
+}
+
+// upload asks for a local file and stores it in the directory shown.
+func (b *browser) upload() {
+	if b.query != "" {
+		b.status = "Clear the search to choose a directory to upload to"
+		return
+	}
+	src, ok := b.prompt("Upload local file: ", "")
+	if !ok || src == "" {
+		return
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		b.status = "Error: " + err.Error()
+		return
+	}
+	name := path.Join(b.dir, filepath.Base(src))
+	if err := b.client.upload(src, b.dir, b.progress("Uploading "+name, info.Size())); err != nil {
+		b.status = "Error uploading " + name + ": " + err.Error()
+		return
+	}
+	b.reload(name)
+	b.status = "Uploaded " + name
+}
+
+// remove deletes the selected file or directory, once the user has confirmed it.
+func (b *browser) remove() {
+	e, ok := b.selected()
+	if !ok || e.parent {
+		return
+	}
+	question := fmt.Sprintf("Delete %s? [y/N] ", e.name)
+	if e.dir {
+		question = fmt.Sprintf("Delete %s and the %d files in it? [y/N] ", e.name, e.files)
+	}
+	b.drawStatus(question, true)
+	if key := b.readKey(); key != 'y' && key != 'Y' {
+		b.status = "Not deleted"
+		return
+	}
+	if err := b.client.remove(e.name, e.dir); err != nil {
+		b.status = "Error deleting " + e.name + ": " + err.Error()
+		return
+	}
+	b.reload("")
+	b.status = "Deleted " + e.name
+}
+
+// progress returns a function showing the progress of a transfer of size bytes on the
+// status line, at most every progressInterval.
+func (b *browser) progress(what string, size int64) func(n int64) {
+	var last time.Time
+	return func(n int64) {
+		if time.Since(last) < progressInterval {
+			return
+		}
+		last = time.Now()
+		msg := fmt.Sprintf("%s: %s", what, formatSize(n))
+		if size > 0 {
+			msg += fmt.Sprintf(" of %s (%d%%)", formatSize(size), n*100/size)
+		}
+		b.drawStatus(msg, false)
+	}
+}
+
+// prompt asks for a line of text on the status line, starting from initial. It returns
+// false if the user pressed escape.
+func (b *browser) prompt(question, initial string) (string, bool) {
+	text := []rune(initial)
+	b.out.WriteString(cursorShow)
+	defer b.out.WriteString(cursorHide)
+	for {
+		b.drawStatus(question+string(text), true)
+		switch key := b.readKey(); {
+		case key == keyEnter:
+			return string(text), true
+		case key == keyEscape || key == keyInterrupt:
+			return "", false
+		case key == keyBackspace:
+			if len(text) > 0 {
+				text = text[:len(text)-1]
+			}
+		case key == 0x15: // Ctrl+U
+			text = text[:0]
+		case key > 0 && unicode.IsPrint(rune(key)):
+			text = append(text, rune(key))
+		}
+	}
+}
+
+// readKey reads a key press: a printable character, or one of the key constants.
+func (b *browser) readKey() int {
+	r, _, err := b.in.ReadRune()
+	if err != nil {
+		return keyInterrupt
+	}
+	switch r {
+	case '\r', '\n':
+		return keyEnter
+	case 0x7f, 0x08:
+		return keyBackspace
+	case 0x03, 0x04: // Ctrl+C, Ctrl+D
+		return keyInterrupt
+	case 0x1b:
+	default:
+		return int(r)
+	}
+
+	// Why look at what is buffered? The escape key sends the escape character alone, whereas
+	// other keys send it followed at once by the rest of a sequence such as "[A".
+	if b.in.Buffered() == 0 {
+		return keyEscape
+	}
+	next, _ := b.in.ReadByte()
+	if next != '[' && next != 'O' {
+		return keyEscape
+	}
+	var seq []byte
+	for {
+		c, err := b.in.ReadByte()
+		if err != nil {
+			return keyEscape
+		}
+		seq = append(seq, c)
+		if c >= 0x40 && c <= 0x7e {
+			break
+		}
+	}
+	switch string(seq) {
+	case "A":
+		return keyUp
+	case "B":
+		return keyDown
+	case "C":
+		return keyRight
+	case "D":
+		return keyLeft
+	case "H", "1~", "7~":
+		return keyHome
+	case "F", "4~", "8~":
+		return keyEnd
+	case "3~":
+		return keyDelete
+	case "5~":
+		return keyPageUp
+	case "6~":
+		return keyPageDown
+	}
+	return 0
+}
+
+// size returns the size of the terminal, or the classic 80 by 24 if it is unknown.
+func (b *browser) size() (width, height int) {
+	width, height, err := terminalSize()
+	if err != nil || width <= 0 || height <= 0 {
+		return 80, 24
+	}
+	return width, height
+}
+
+// rows returns the number of entries that fit on screen.
+func (b *browser) rows() int {
+	_, height := b.size()
+	return max(height-4, 1)
+}
+
+// draw draws the whole screen: a title, the entries and the status line.
+func (b *browser) draw() {
+	width, _ := b.size()
+	rows := b.rows()
+	if b.cursor < b.top {
+		b.top = b.cursor
+	} else if b.cursor >= b.top+rows {
+		b.top = b.cursor - rows + 1
+	}
+
+	b.out.WriteString(clearScreen)
+	title := b.server + "/" + b.dir
+	if b.query != "" {
+		title = fmt.Sprintf("%s  search: %s", b.server, b.query)
+	}
+	b.out.WriteString(boldOn + fit(title, width) + styleOff + "\r\n\r\n")
+
+	nameWidth := max(width-32, 10)
+	for i := b.top; i < b.top+rows; i++ {
+		if i >= len(b.entries) {
+			b.out.WriteString("\r\n")
+			continue
+		}
+		e := b.entries[i]
+		line := pad(fit(e.label, nameWidth), nameWidth)
+		if !e.parent {
+			line += fmt.Sprintf("  %10s  %s", formatSize(e.size), e.modified.Local().Format("2006-01-02 15:04"))
+		}
+		line = fit(line, width)
+		if i == b.cursor {
+			line = reverseOn + pad(line, width) + styleOff
+		}
+		b.out.WriteString(line + "\r\n")
+	}
+	if len(b.entries) == 0 {
+		b.status = cmp.Or(b.status, "No files")
+	}
+	b.out.WriteString("\r\n")
+	b.drawStatus(cmp.Or(b.status, "q quit  / search  d download  u upload  x delete  r reload"), false)
+	b.status = ""
+}
+
+// drawStatus replaces the status line at the bottom of the screen with msg, leaving the
+// cursor at its end if input follows.
+func (b *browser) drawStatus(msg string, input bool) {
+	width, height := b.size()
+	fmt.Fprintf(b.out, "\x1b[%d;1H%s%s", height, clearLine, fit(msg, width-1))
+	if !input {
+		b.out.WriteString(cursorHide)
+	}
+	b.out.Flush()
+}
+
+// fit cuts s to at most width characters, marking the cut with an ellipsis.
+func fit(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	if width <= 1 {
+		return string([]rune(s)[:max(width, 0)])
+	}
+	return string([]rune(s)[:width-1]) + "…"
+}
+
+// pad pads s with spaces to width characters.
+func pad(s string, width int) string {
+	return s + strings.Repeat(" ", max(width-utf8.RuneCountInString(s), 0))
+}
+
+// formatSize formats n bytes in the largest binary unit it reaches.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
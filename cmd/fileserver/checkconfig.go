@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/server"
+)
+
+const checkConfigUsage = `usage: fileserver check-config [-config file] [-set key=value]... [-quiet]
+
+Load and validate the configuration without starting the server, and print it
+as resolved: the defaults with the file's settings applied, then those of the
+FILESERVER_<SECTION>_<SETTING> environment variables, then those of the -set
+flags, as the server would, with secrets redacted. Exits with status 1 if the
+configuration is invalid, so that CI can check a change before it is deployed.
+
+Relative paths are resolved as the server would, from process.workingDir if
+it is set. Nothing is created or opened for writing, and no other service is
+contacted, so problems found only then (such as an unreachable broker) are
+not reported.
+`
+
+// runCheckConfig implements the "check-config" subcommand and returns the process exit code.
+func runCheckConfig(configPath string, args []string) int {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, checkConfigUsage) }
+	path := fs.String("config", configPath, "configuration file to check")
+	quiet := fs.Bool("quiet", false, "only report problems, without printing the configuration")
+	var settings settingsFlag
+	fs.Var(&settings, "set", "override a setting, as key=value")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		fmt.Fprint(os.Stderr, checkConfigUsage)
+		return 2
+	}
+
+	logger := log.New(os.Stderr, "", 0)
+	cfg, err := config.NewConfig(*path, logger)
+	if err == nil {
+		err = settings.apply(cfg)
+	}
+	if err != nil {
+		logger.Printf("error loading config %s: %v\n", *path, err)
+		return 1
+	}
+	problems := []error{config.CheckKeys(*path)}
+	// The server resolves relative paths from its working directory; so must the check.
+	if dir := cfg.Process.WorkingDir; dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			problems = append(problems, fmt.Errorf("invalid process.workingDir: %w", err))
+		}
+	}
+	problems = append(problems, server.Check(cfg))
+
+	if !*quiet {
+		out, err := cfg.Dump()
+		if err != nil {
+			logger.Printf("error printing config: %v\n", err)
+			return 1
+		}
+		os.Stdout.Write(out)
+	}
+	if err := errors.Join(problems...); err != nil {
+		logger.Printf("%s is invalid:\n  %s\n", *path, strings.ReplaceAll(err.Error(), "\n", "\n  "))
+		return 1
+	}
+	logger.Printf("%s is valid\n", *path)
+	return 0
+}
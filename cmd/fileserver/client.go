@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// remoteFile is a file of the server's listing.
+type remoteFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// apiClient makes the requests of the browse and bench commands to a running server.
+type apiClient struct {
+	base string // without a trailing slash
+	key  string
+	http *http.Client
+}
+
+func newAPIClient(server, key string) (*apiClient, error) {
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q", server)
+	}
+	// Why no timeout? Downloads and uploads of large files take as long as they take; the
+	// user can always quit.
+	return &apiClient{base: strings.TrimSuffix(server, "/"), key: key, http: &http.Client{}}, nil
+}
+
+// send sends req with the credentials, and turns answers other than 2xx into errors.
+func (c *apiClient) send(req *http.Request) (*http.Response, error) {
+	req.Header.Set("Accept", "application/json")
+	if c.key != "" {
+		req.Header.Set("X-API-Key", c.key)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, answerError(resp)
+}
+
+// answerError describes the error answered in resp, from its message and details.
+func answerError(resp *http.Response) error {
+	var e struct {
+		Message string   `json:"message"`
+		Details []string `json:"details"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(b, &e) != nil || e.Message == "" {
+		e.Message = strings.TrimSpace(string(b))
+	}
+	if len(e.Details) > 0 {
+		e.Message += ": " + strings.Join(e.Details, "; ")
+	}
+	return fmt.Errorf("%s (%s)", e.Message, resp.Status)
+}
+
+// list returns every file the server lists for the caller.
+func (c *apiClient) list() ([]remoteFile, error) {
+	req, err := http.NewRequest(http.MethodGet, c.base+"/download/list.txt", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var list struct {
+		Files []remoteFile `json:"files"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("unexpected listing: %w", err)
+	}
+	return list.Files, nil
+}
+
+// download saves the stored file name as the local file dest, which must not exist yet,
+// reporting the bytes received so far to progress.
+func (c *apiClient) download(name, dest string, progress func(n int64)) error {
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = c.fetch(name, f, progress)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// A partial file would pass for the real thing.
+		os.Remove(dest)
+	}
+	return err
+}
+
+// fetch copies the stored file name to w, reporting the bytes received so far to progress,
+// if not nil, and returns the number of bytes copied.
+func (c *apiClient) fetch(name string, w io.Writer, progress func(n int64)) (int64, error) {
+	req, err := http.NewRequest(http.MethodGet, c.base+"/download/"+escapeSegments(name), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return io.Copy(w, &countingReader{r: resp.Body, progress: progress})
+}
+
+// upload stores the local file src in the directory dir, reporting the bytes sent so far
+// to progress.
+func (c *apiClient) upload(src, dir string, progress func(n int64)) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil {
+		return err
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", src)
+	}
+
+	return c.uploadFrom(&countingReader{r: f, progress: progress}, filepath.Base(src), dir)
+}
+
+// uploadFrom stores what is read from r as the file name in the directory dir.
+func (c *apiClient) uploadFrom(r io.Reader, name, dir string) error {
+	// Why a pipe? The file is streamed into the request as it is read, rather than buffered
+	// whole in memory.
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		err := mw.WriteField("dir", dir)
+		if err == nil {
+			var part io.Writer
+			if part, err = mw.CreateFormFile("file", name); err == nil {
+				_, err = io.Copy(part, r)
+			}
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	req, err := http.NewRequest(http.MethodPost, c.base+"/upload", pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// A file that failed is answered with 207 when others were stored, which send lets through.
+	if resp.StatusCode == http.StatusMultiStatus {
+		return answerError(resp)
+	}
+	return nil
+}
+
+// remove deletes the stored file or directory name; directories with their contents.
+func (c *apiClient) remove(name string, dir bool) error {
+	body, err := json.Marshal(map[string]any{
+		"operations": []map[string]any{{"op": "delete", "path": name, "recursive": dir}},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.base+"/api/batch", strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Results []struct {
+			Error string `json:"error"`
+		} `json:"results"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected answer: %w", err)
+	}
+	if len(result.Results) == 1 && result.Results[0].Error != "" {
+		return errors.New(result.Results[0].Error)
+	}
+	return nil
+}
+
+// countingReader reports the bytes read through it.
+type countingReader struct {
+	r        io.Reader
+	n        int64
+	progress func(n int64)
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	if c.progress != nil {
+		c.progress(c.n)
+	}
+	return n, err
+}
+
+// escapeSegments escapes each segment of a stored file's name for use in a URL path.
+func escapeSegments(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -1,45 +1,180 @@
 package main
 
 import (
-	"io"
+	"context"
+	"flag"
+	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/logging"
 	"github.com/mascotmascot1/fileserver/internal/server"
 )
 
+const usage = `usage: fileserver [command] [arguments]
+       fileserver [-config file] [-set key=value]...
+
+Without a command, the server is started. Each -set overrides a setting of the
+configuration file, such as -set server.address=:9090, after the environment's
+FILESERVER_<SECTION>_<SETTING> variables, such as FILESERVER_SERVER_ADDRESS.
+
+commands:
+  users      manage user accounts
+  rebalance  move files to the disks their prefixes are sharded to
+  check-config  validate the configuration and print it as resolved
+  service    install, start, stop or uninstall the Windows service
+  browse     browse the files of a running server in the terminal
+  bench      measure the throughput and latency of a running server
+`
+
+// shutdownTimeout bounds how long a stopping server waits for in-flight requests.
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	const configPath = "fileserver.yaml"
 
-	// Open the log file for appending. The flags ensure the file is created if it
-	// does not exist, and that new log entries are added to the end.
-	logFile, err := os.OpenFile("server.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		log.Fatalf("failed to open log file: %v\n", err)
+	// Why dispatch on the first argument? Administrative subcommands share the
+	// configuration but must not start the server or open its log file.
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "users":
+			os.Exit(runUsers(configPath, os.Args[2:]))
+		case "rebalance":
+			os.Exit(runRebalance(configPath, os.Args[2:]))
+		case "check-config":
+			os.Exit(runCheckConfig(configPath, os.Args[2:]))
+		case "service":
+			os.Exit(runService(configPath, os.Args[2:]))
+		case "browse":
+			os.Exit(runBrowse(os.Args[2:]))
+		case "bench":
+			os.Exit(runBench(os.Args[2:]))
+		default:
+			fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+			os.Exit(2)
+		}
 	}
-	defer logFile.Close()
 
-	// Create a MultiWriter to direct log output to both standard output (the console)
-	// and the log file simultaneously.
-	mw := io.MultiWriter(os.Stdout, logFile)
+	// Why check for the service manager? When Windows starts the executable as a service,
+	// it must report its status to the service manager rather than just serve.
+	if isWindowsService() {
+		os.Exit(runAsService(configPath))
+	}
 
-	// Initialise the application's logger to use the multi-writer. This instance will
-	// be injected as a dependency into other parts of the application.
-	logger := log.New(mw, "[FILE SERVER] ", log.LstdFlags)
+	flags := flag.NewFlagSet("fileserver", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	path := flags.String("config", configPath, "configuration file")
+	var settings settingsFlag
+	flags.Var(&settings, "set", "override a setting, as key=value")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+	if flags.NArg() != 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	// Why handle signals? Init scripts and process supervisors stop the server with
+	// SIGTERM (or Ctrl+C in a console), and in-flight requests should complete first.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	serve(*path, settings, ctx.Done())
+}
+
+// serve loads the configuration, with settings overriding it, and runs the server until it
+// fails or until stop is closed, at which point the server is shut down gracefully.
+func serve(configPath string, settings settingsFlag, stop <-chan struct{}) {
+	// Why a bootstrap logger? Where logs go is itself configured, so messages about
+	// loading the configuration can only be written to the console.
+	bootLogger := log.New(os.Stdout, logging.Prefix, log.LstdFlags)
 
 	// Load application configuration from the specified path.
-	cfg, err := config.NewConfig(configPath, logger)
+	cfg, err := config.NewConfig(configPath, bootLogger)
 	if err != nil {
-		logger.Fatalf("error loading config %s\n", err)
+		bootLogger.Fatalf("error loading config %s\n", err)
+	}
+	if err := settings.apply(cfg); err != nil {
+		bootLogger.Fatalf("error loading config %s\n", err)
+	}
+
+	// Why change directory before anything else? Relative paths in the configuration
+	// (the log file, storage and metadata directories) must resolve against it.
+	if dir := cfg.Process.WorkingDir; dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			bootLogger.Fatalf("error changing working directory: %s\n", err)
+		}
+	}
+
+	// Initialise the application's logger from the logging configuration. This instance
+	// will be injected as a dependency into other parts of the application.
+	logger, logCloser, err := logging.New(&cfg.Logging)
+	if err != nil {
+		bootLogger.Fatalf("error initialising logging: %s\n", err)
+	}
+	defer logCloser.Close()
+
+	if cfg.Process.PIDFile != "" {
+		if err := writePIDFile(cfg.Process.PIDFile); err != nil {
+			logger.Fatalf("error writing PID file: %s\n", err)
+		}
+		defer removePIDFile(cfg.Process.PIDFile, logger)
+	}
+
+	// Why listen before creating the server? Binding a privileged port (below 1024) needs
+	// root, but nothing else does: privileges are dropped as soon as the port is bound,
+	// so that the files and directories the server creates belong to the configured user.
+	addr := cfg.Server.Addr
+	if addr == "" {
+		addr = ":http"
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Fatalf("error starting server: %s\n", err)
+	}
+	if cfg.Process.User != "" || cfg.Process.Group != "" {
+		if err := dropPrivileges(cfg.Process.User, cfg.Process.Group); err != nil {
+			logger.Fatalf("error dropping privileges: %s\n", err)
+		}
+		logger.Printf("running as %s\n", strings.TrimSuffix(cfg.Process.User+":"+cfg.Process.Group, ":"))
 	}
 
 	// Create and configure the new HTTP server.
-	s := server.NewServer(cfg, logger)
-	logger.Printf("starting server on %s\n", s.HTTP.Addr)
+	s, err := server.NewServer(cfg, nil, logger)
+	if err != nil {
+		logger.Fatalf("error creating server: %s\n", err)
+	}
+	logger.Printf("starting server on %s\n", ln.Addr())
+
+	// Why wait for stopped? Serve returns as soon as Shutdown begins, but the
+	// process must stay up until in-flight requests have completed.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-stop
+		logger.Printf("stopping server\n")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			logger.Printf("error stopping server: %v\n", err)
+		}
+	}()
 
-	// Start the server and block until it returns an error.
-	if err := s.HTTP.ListenAndServe(); err != nil {
+	// Start the server and block until it returns an error or is shut down. The
+	// certificates are chosen by the server's TLS configuration, not read from files here.
+	if s.HTTP.TLSConfig != nil {
+		err = s.HTTP.ServeTLS(ln, "", "")
+	} else {
+		err = s.HTTP.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
 		logger.Fatalf("error starting server: %s\n", err)
 	}
+	<-stopped
 }
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+)
+
+// writePIDFile records the process ID in path, for init scripts to signal or check on the
+// server. An existing file is overwritten, as one left behind by a crash or kill -9 must not
+// prevent the server from starting again.
+func writePIDFile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePIDFile removes the PID file on a clean shutdown. Why only log failures? Once
+// privileges are dropped, the server may no longer be allowed to delete a file it created
+// as root (e.g. in /run), and init scripts remove stale PID files themselves anyway.
+func removePIDFile(path string, logger *log.Logger) {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Printf("error removing PID file: %v\n", err)
+	}
+}
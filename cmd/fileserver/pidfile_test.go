@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fileserver.pid")
+	// Left behind by a server that was killed.
+	if err := os.WriteFile(path, []byte("99999\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writePIDFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strconv.Itoa(os.Getpid()) + "\n"; string(data) != want {
+		t.Errorf("got %q, want %q", data, want)
+	}
+
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+	removePIDFile(path, logger)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("PID file left behind: %v", err)
+	}
+	// Removing a file that has gone already is not worth a log message.
+	removePIDFile(path, logger)
+	if logs.Len() != 0 {
+		t.Errorf("logged %q", logs.String())
+	}
+}
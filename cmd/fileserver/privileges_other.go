@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// dropPrivileges fails on platforms without Unix users and groups. On Windows, choose the
+// account the service runs as in the service manager instead.
+func dropPrivileges(username, group string) error {
+	return errors.New("process.user and process.group are only supported on Unix")
+}
@@ -0,0 +1,46 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the given user and group. If group is empty, the
+// user's primary group is used; if username is empty, only the group is changed.
+func dropPrivileges(username, group string) error {
+	uid, gid := -1, -1
+	if username != "" {
+		u, err := user.Lookup(username)
+		if err != nil {
+			return err
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// Why this order? Once the user has changed, the process may no longer change its
+	// groups; and the supplementary groups, inherited from root, must go too.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setting supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setting group ID: %w", err)
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("setting user ID: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build unix
+
+package main
+
+import "testing"
+
+// TestDropPrivileges checks that unknown accounts are refused before anything changes;
+// actually switching would change the user of the test process itself.
+func TestDropPrivileges(t *testing.T) {
+	tests := []struct {
+		desc, user, group string
+	}{
+		{"an unknown user", "fileserver-no-such-user", ""},
+		{"an unknown group", "", "fileserver-no-such-group"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := dropPrivileges(tt.user, tt.group); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
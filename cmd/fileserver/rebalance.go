@@ -0,0 +1,74 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/shard"
+)
+
+const rebalanceUsage = `usage: fileserver rebalance [-dry-run]
+
+Move the files stored on another disk than the one the shards setting gives their
+prefix to that disk, as after a prefix was given a disk of its own. Stop the server
+first, as the files being moved are found neither where they were nor where they go.
+
+  -dry-run  list the files that would be moved, without moving them
+`
+
+// runRebalance implements the "rebalance" subcommand and returns the process exit code.
+func runRebalance(configPath string, args []string) int {
+	flags := flag.NewFlagSet("rebalance", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(os.Stderr, rebalanceUsage) }
+	dryRun := flags.Bool("dry-run", false, "list the files that would be moved")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return 2
+	}
+
+	logger := log.New(os.Stderr, "", 0)
+	cfg, err := config.NewConfig(configPath, logger)
+	if err != nil {
+		logger.Printf("error loading config: %v\n", err)
+		return 1
+	}
+	if dir := cfg.Process.WorkingDir; dir != "" {
+		if err := os.Chdir(dir); err != nil {
+			logger.Printf("error changing working directory: %v\n", err)
+			return 1
+		}
+	}
+	layout, err := shard.New(cfg.Uploader.StorageDir, cfg.Shards)
+	if err != nil {
+		logger.Printf("error reading shards: %v\n", err)
+		return 1
+	}
+
+	var moved, failed int
+	var bytes int64
+	err = layout.Rebalance(*dryRun, func(m shard.Move) {
+		if m.Err != nil {
+			failed++
+			logger.Printf("error moving %s from %s to %s: %v\n", m.Name, m.From, m.To, m.Err)
+			return
+		}
+		moved++
+		bytes += m.Size
+		fmt.Printf("%s\t%s -> %s\n", m.Name, m.From, m.To)
+	})
+	if err != nil {
+		logger.Printf("error rebalancing: %v\n", err)
+		return 1
+	}
+	verb := "moved"
+	if *dryRun {
+		verb = "would move"
+	}
+	fmt.Printf("%s %d files (%d bytes), %d failed\n", verb, moved, bytes, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
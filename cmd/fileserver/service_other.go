@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// isWindowsService reports whether the process was started by the Windows service
+// manager, which is never the case on other platforms.
+func isWindowsService() bool {
+	return false
+}
+
+// runService implements the "service" subcommand, which is only available on Windows.
+// Elsewhere, use the platform's own service manager (e.g. a systemd unit).
+func runService(configPath string, args []string) int {
+	fmt.Fprintln(os.Stderr, "the service command is only available on Windows")
+	return 2
+}
+
+// runAsService is never called on platforms other than Windows.
+func runAsService(configPath string) int {
+	return 1
+}
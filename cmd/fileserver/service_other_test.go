@@ -0,0 +1,16 @@
+//go:build !windows
+
+package main
+
+import "testing"
+
+func TestService(t *testing.T) {
+	if isWindowsService() {
+		t.Error("running as a Windows service")
+	}
+	for _, args := range [][]string{{"install"}, {"start"}, nil} {
+		if code := runService("fileserver.yaml", args); code != 2 {
+			t.Errorf("service %v exited with %d, want 2", args, code)
+		}
+	}
+}
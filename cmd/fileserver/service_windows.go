@@ -0,0 +1,243 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// serviceName is the name the server is registered under with the service manager.
+const serviceName = "fileserver"
+
+const serviceUsage = `usage: fileserver service <command>
+
+Manage the Windows service. The service runs this executable from its own directory,
+so fileserver.yaml and relative paths in it are resolved there.
+
+commands:
+  install      register the service (started automatically at boot) and its event log source
+  uninstall    remove the service and its event log source
+  start        start the service
+  stop         stop the service, letting in-flight requests complete
+`
+
+// isWindowsService reports whether the process was started by the service manager.
+func isWindowsService() bool {
+	ok, err := svc.IsWindowsService()
+	return err == nil && ok
+}
+
+// runService implements the "service" subcommand and returns the process exit code.
+func runService(configPath string, args []string) int {
+	if len(args) != 1 {
+		fmt.Fprint(os.Stderr, serviceUsage)
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(configPath)
+	case "uninstall":
+		err = uninstallService(configPath)
+	case "start":
+		err = startService()
+	case "stop":
+		err = stopService()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown service command %q\n\n%s", args[0], serviceUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// eventSource returns the event log source named by the configured log tag, so that the
+// "eventlog" output writes under the source the install command registered.
+func eventSource(configPath string) (string, error) {
+	cfg, err := config.NewConfig(configPath, log.New(os.Stderr, "", 0))
+	if err != nil {
+		return "", fmt.Errorf("loading config: %w", err)
+	}
+	return cfg.Logging.Syslog.Tag, nil
+}
+
+// installService registers the service to run this executable, and its event log source.
+func installService(configPath string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	source, err := eventSource(configPath)
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	if s, err := m.OpenService(serviceName); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s is already installed", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "File Server",
+		Description: "Uploads and downloads files over HTTP.",
+		StartType:   mgr.StartAutomatic,
+	})
+	if err != nil {
+		return fmt.Errorf("creating service: %w", err)
+	}
+	defer s.Close()
+
+	err = eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+	if err != nil {
+		s.Delete()
+		return fmt.Errorf("registering event log source %s: %w", source, err)
+	}
+	fmt.Printf("service %s installed\n", serviceName)
+	return nil
+}
+
+// uninstallService removes the service and its event log source.
+func uninstallService(configPath string) error {
+	source, err := eventSource(configPath)
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("deleting service: %w", err)
+	}
+	if err := eventlog.Remove(source); err != nil {
+		return fmt.Errorf("removing event log source %s: %w", source, err)
+	}
+	fmt.Printf("service %s uninstalled\n", serviceName)
+	return nil
+}
+
+// startService asks the service manager to start the service.
+func startService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("starting service: %w", err)
+	}
+	return nil
+}
+
+// stopService asks the service to stop and waits until it has.
+func stopService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", serviceName)
+	}
+	defer s.Close()
+	status, err := s.Control(svc.Stop)
+	if err != nil {
+		return fmt.Errorf("stopping service: %w", err)
+	}
+	// Why a little longer than shutdownTimeout? The service itself gives up on
+	// in-flight requests after that long.
+	deadline := time.Now().Add(shutdownTimeout + 5*time.Second)
+	for status.State != svc.Stopped {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for service %s to stop", serviceName)
+		}
+		time.Sleep(300 * time.Millisecond)
+		if status, err = s.Query(); err != nil {
+			return fmt.Errorf("querying service status: %w", err)
+		}
+	}
+	return nil
+}
+
+// runAsService runs the server under the service manager and returns the process exit code.
+func runAsService(configPath string) int {
+	// Why change directory? Services start in the system directory, whereas the
+	// configuration and the paths in it are relative to the server's own directory.
+	exe, err := os.Executable()
+	if err != nil {
+		return 1
+	}
+	if err := os.Chdir(filepath.Dir(exe)); err != nil {
+		return 1
+	}
+	if err := svc.Run(serviceName, &service{configPath: configPath}); err != nil {
+		return 1
+	}
+	return 0
+}
+
+// service is the svc.Handler that connects the server to the service manager.
+type service struct {
+	configPath string
+}
+
+// Execute runs the server and translates the service manager's requests into its lifecycle.
+func (s *service) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serve(s.configPath, nil, stop)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	// Why no case for the server failing? serve exits the process on fatal errors, and
+	// the service manager then reports the service as having terminated unexpectedly.
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending, WaitHint: uint32((shutdownTimeout + 5*time.Second).Milliseconds())}
+			close(stop)
+			<-done
+			return false, 0
+		}
+	}
+	return false, 0
+}
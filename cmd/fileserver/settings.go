@@ -0,0 +1,36 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// settingsFlag collects the -set flags, each a key=value pair such as
+// uploader.maxUploadSizeMB=1024, which override the configuration file and the environment.
+type settingsFlag []string
+
+func (s *settingsFlag) String() string {
+	return strings.Join(*s, " ")
+}
+
+func (s *settingsFlag) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return errors.New("must be key=value")
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+// apply overrides the settings of cfg, in the order the flags were given.
+func (s settingsFlag) apply(cfg *config.Config) error {
+	for _, kv := range s {
+		key, value, _ := strings.Cut(kv, "=")
+		if err := cfg.Set(key, value); err != nil {
+			return fmt.Errorf("-set %s: %w", kv, err)
+		}
+	}
+	return nil
+}
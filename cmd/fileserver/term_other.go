@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows)
+
+package main
+
+import "errors"
+
+// makeRaw is not implemented on this platform, so the browse command is unavailable.
+func makeRaw() (restore func(), err error) {
+	return nil, errors.ErrUnsupported
+}
+
+// terminalSize is not implemented on this platform.
+func terminalSize() (width, height int, err error) {
+	return 0, 0, errors.ErrUnsupported
+}
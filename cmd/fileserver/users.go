@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/tokens"
+	"github.com/mascotmascot1/fileserver/internal/users"
+)
+
+const usersUsage = `usage: fileserver users <command> [arguments]
+
+Manage the user accounts stored in the metadata directory. Stop the server first,
+or use "fileserverctl users" instead, as a running server does not see these changes.
+
+commands:
+  list                              list all users
+  add [-roles r1,r2] <username>     create a user (password is read from stdin)
+  passwd <username>                 set a user's password (read from stdin)
+  disable <username>                prevent a user from logging in, and revoke their tokens
+  enable <username>                 allow a disabled user to log in again
+  delete <username>                 remove a user, and revoke their tokens
+`
+
+// runUsers implements the "users" subcommand and returns the process exit code.
+func runUsers(configPath string, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usersUsage)
+		return 2
+	}
+
+	// Why a separate logger? Subcommands are interactive, so their diagnostics belong
+	// on stderr rather than in the server log.
+	logger := log.New(os.Stderr, "", 0)
+	cfg, err := config.NewConfig(configPath, logger)
+	if err != nil {
+		logger.Printf("error loading config: %v\n", err)
+		return 1
+	}
+	store, err := users.Open(cfg.Metadata.Path("users.json"), cfg.Auth.Users)
+	if err != nil {
+		logger.Printf("error opening user store: %v\n", err)
+		return 1
+	}
+
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		for _, u := range store.List() {
+			status := "enabled"
+			if u.Disabled {
+				status = "disabled"
+			}
+			if u.Static {
+				status += ", static"
+			}
+			fmt.Printf("%s\t[%s]\t(%s)\n", u.Username, strings.Join(u.Roles, ","), status)
+		}
+		return 0
+
+	case "add":
+		fs := flag.NewFlagSet("users add", flag.ContinueOnError)
+		roles := fs.String("roles", "", "comma-separated list of roles")
+		if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+			fmt.Fprint(os.Stderr, usersUsage)
+			return 2
+		}
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			logger.Printf("error reading password: %v\n", err)
+			return 1
+		}
+		var roleList []string
+		if *roles != "" {
+			roleList = strings.Split(*roles, ",")
+		}
+		if _, err := store.Create(fs.Arg(0), password, roleList); err != nil {
+			logger.Printf("error creating user: %v\n", err)
+			return 1
+		}
+		fmt.Printf("user '%s' created\n", fs.Arg(0))
+		return 0
+
+	case "passwd", "disable", "enable", "delete":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usersUsage)
+			return 2
+		}
+		username := args[0]
+		switch cmd {
+		case "delete":
+			err = store.Delete(username)
+		case "passwd":
+			var password string
+			if password, err = readPassword(os.Stdin); err == nil {
+				_, err = store.Update(username, func(u *users.User) error {
+					hash, err := users.HashPassword(password)
+					u.PasswordHash = hash
+					return err
+				})
+			}
+		default:
+			_, err = store.Update(username, func(u *users.User) error {
+				u.Disabled = cmd == "disable"
+				return nil
+			})
+		}
+		if err != nil {
+			logger.Printf("error updating user: %v\n", err)
+			return 1
+		}
+		fmt.Printf("user '%s' updated\n", username)
+		if cmd == "disable" || cmd == "delete" {
+			return revokeTokens(cfg, username, logger)
+		}
+		return 0
+
+	default:
+		fmt.Fprint(os.Stderr, usersUsage)
+		return 2
+	}
+}
+
+// revokeTokens revokes the tokens the user username minted, as the server does when the user
+// is disabled or deleted, and returns the exit code.
+func revokeTokens(cfg *config.Config, username string, logger *log.Logger) int {
+	store, err := tokens.Open(cfg.Metadata.Path("tokens.json"))
+	if err != nil {
+		logger.Printf("error opening token store: %v\n", err)
+		return 1
+	}
+	n, err := store.RevokeCreatedBy(username)
+	if err != nil {
+		logger.Printf("error revoking tokens: %v\n", err)
+		return 1
+	}
+	if n > 0 {
+		fmt.Printf("revoked %d token(s) of user '%s'\n", n, username)
+	}
+	return 0
+}
+
+// readPassword reads a single line from r, prompting on stderr. Reading from stdin
+// (rather than a flag) keeps passwords out of the shell history and process list.
+func readPassword(r io.Reader) (string, error) {
+	fmt.Fprint(os.Stderr, "Password: ")
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const jobsUsage = `usage: fileserverctl jobs <id>
+
+Shows the status of the background job processing an asynchronous upload.
+`
+
+const changesUsage = `usage: fileserverctl changes [-cursor c] [-f] [-interval 2s]
+
+Prints the changes made to stored files, oldest first: files created, modified,
+deleted or moved.
+
+  -cursor c     start after change c ("latest" for only those to come)
+  -f            keep printing changes as they are made, starting from the latest
+                unless -cursor is given
+  -interval d   how often -f asks the server for changes
+`
+
+func runJobs(c *client, args []string) error {
+	if len(args) != 1 {
+		return usageError(jobsUsage)
+	}
+	var job struct {
+		ID       string     `json:"id"`
+		Status   string     `json:"status"`
+		User     string     `json:"user"`
+		Created  time.Time  `json:"created"`
+		Finished *time.Time `json:"finished"`
+		Files    []struct {
+			Name   string `json:"name"`
+			Size   int64  `json:"size"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"files"`
+		Errors []string `json:"errors"`
+	}
+	if err := c.do(http.MethodGet, "/api/jobs/"+url.PathEscape(args[0]), nil, &job); err != nil {
+		return err
+	}
+	if c.raw {
+		return c.print(job)
+	}
+	fmt.Printf("job %s: %s (by %s, created %s", job.ID, job.Status, job.User, job.Created.Local().Format(time.DateTime))
+	if job.Finished != nil {
+		fmt.Printf(", finished %s", job.Finished.Local().Format(time.DateTime))
+	}
+	fmt.Println(")")
+	for _, f := range job.Files {
+		fmt.Printf("  %s\t%d bytes\t%s", f.Name, f.Size, f.Status)
+		if f.Error != "" {
+			fmt.Printf(": %s", f.Error)
+		}
+		fmt.Println()
+	}
+	for _, e := range job.Errors {
+		fmt.Printf("  refused: %s\n", e)
+	}
+	return nil
+}
+
+func runRescan(c *client, args []string) error {
+	if len(args) != 0 {
+		return usageError("usage: fileserverctl rescan\n")
+	}
+	var resp struct {
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+	}
+	if err := c.do(http.MethodPost, "/api/rescan", nil, &resp); err != nil {
+		return err
+	}
+	if c.raw {
+		return c.print(resp)
+	}
+	for _, name := range resp.Added {
+		fmt.Printf("added   %s\n", name)
+	}
+	for _, name := range resp.Removed {
+		fmt.Printf("removed %s\n", name)
+	}
+	fmt.Printf("%d files added, %d removed outside the server\n", len(resp.Added), len(resp.Removed))
+	return nil
+}
+
+// change is an entry of the change feed.
+type change struct {
+	Seq  int64     `json:"seq"`
+	Type string    `json:"type"`
+	Path string    `json:"path"`
+	From string    `json:"from,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+func runChanges(c *client, args []string) error {
+	fs := flag.NewFlagSet("changes", flag.ContinueOnError)
+	cursor := fs.String("cursor", "", "the change to start after")
+	follow := fs.Bool("f", false, "keep printing changes as they are made")
+	interval := fs.Duration("interval", 2*time.Second, "how often to ask for changes with -f")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *interval <= 0 {
+		return usageError(changesUsage)
+	}
+	if *follow && *cursor == "" {
+		*cursor = "latest"
+	}
+
+	// Each page is printed at once, so that a long feed piped into a file or grep does not
+	// cost a write per change.
+	out := bufio.NewWriter(os.Stdout)
+	for {
+		var page struct {
+			Changes []change `json:"changes"`
+			Cursor  string   `json:"cursor"`
+			More    bool     `json:"more"`
+		}
+		err := c.do(http.MethodGet, "/api/changes?cursor="+url.QueryEscape(*cursor), nil, &page)
+		if isStatus(err, http.StatusGone) {
+			return fmt.Errorf("changes after %s are no longer kept; start again with -cursor latest", *cursor)
+		}
+		if err != nil {
+			return err
+		}
+		for _, ch := range page.Changes {
+			if c.raw {
+				b, _ := json.Marshal(ch)
+				fmt.Fprintf(out, "%s\n", b)
+				continue
+			}
+			line := fmt.Sprintf("%s  %-8s %s", ch.Time.Local().Format(time.DateTime), ch.Type, ch.Path)
+			if ch.From != "" {
+				line += " (from " + ch.From + ")"
+			}
+			fmt.Fprintln(out, line)
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		*cursor = page.Cursor
+		if page.More {
+			continue
+		}
+		if !*follow {
+			return nil
+		}
+		time.Sleep(*interval)
+	}
+}
+
+const auditUsage = `usage: fileserverctl audit [-n 20] [-f] [-interval 2s]
+
+Prints the last requests recorded in the audit log, oldest first: who changed
+what, from where, and how the server answered.
+
+  -n count      how many of the last events to print, at most 1000
+  -f            keep printing events as they are recorded
+  -interval d   how often -f asks the server for events
+`
+
+// auditEvent is an entry of the audit log.
+type auditEvent struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	User   string    `json:"user"`
+	Client string    `json:"client"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+}
+
+func runAudit(c *client, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	n := fs.Int("n", 20, "how many of the last events to print")
+	follow := fs.Bool("f", false, "keep printing events as they are recorded")
+	interval := fs.Duration("interval", 2*time.Second, "how often to ask for events with -f")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *n < 1 || *interval <= 0 {
+		return usageError(auditUsage)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	query := "limit=" + strconv.Itoa(*n)
+	for {
+		var page struct {
+			Events []auditEvent `json:"events"`
+			Cursor string       `json:"cursor"`
+			More   bool         `json:"more"`
+		}
+		err := c.do(http.MethodGet, "/api/audit?"+query, nil, &page)
+		if isStatus(err, http.StatusGone) {
+			return errors.New("events were recorded faster than they could be followed; the rest are in the server's audit.log")
+		}
+		if err != nil {
+			return err
+		}
+		for _, e := range page.Events {
+			if c.raw {
+				b, _ := json.Marshal(e)
+				fmt.Fprintf(out, "%s\n", b)
+				continue
+			}
+			user := e.User
+			if user == "" {
+				user = "-"
+			}
+			fmt.Fprintf(out, "%s  %-15s %-15s %d %s %s\n", e.Time.Local().Format(time.DateTime), user, e.Client, e.Status, e.Method, e.Path)
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		query = "limit=1000&cursor=" + url.QueryEscape(page.Cursor)
+		if page.More {
+			continue
+		}
+		if !*follow {
+			return nil
+		}
+		time.Sleep(*interval)
+	}
+}
+
+func runStats(c *client, args []string) error {
+	if len(args) != 0 {
+		return usageError("usage: fileserverctl stats\n")
+	}
+	stats := map[string]any{}
+
+	var stored struct {
+		Files     int   `json:"files"`
+		Size      int64 `json:"size"`
+		DirQuotas []struct {
+			Path  string `json:"path"`
+			Limit int64  `json:"limit"`
+			Used  int64  `json:"used"`
+		} `json:"dirQuotas"`
+	}
+	if err := c.do(http.MethodGet, "/api/stats", nil, &stored); err != nil {
+		return err
+	}
+	stats["files"], stats["bytes"], stats["quotas"] = stored.Files, stored.Size, stored.DirQuotas
+
+	var missing []any
+	if err := c.do(http.MethodGet, "/api/missing", nil, &missing); err != nil {
+		return err
+	}
+	stats["missing"] = len(missing)
+
+	// The metrics are only served if enabled, so their absence is not an error.
+	text, err := c.text("/metrics")
+	if err != nil && !isStatus(err, http.StatusNotFound) {
+		return err
+	}
+	if err == nil {
+		stats["metrics"] = parseMetrics(text)
+	}
+
+	if c.raw {
+		return c.print(stats)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "files\t%d\n", stored.Files)
+	fmt.Fprintf(tw, "stored\t%s\n", formatBytes(stored.Size))
+	fmt.Fprintf(tw, "missing\t%d\n", len(missing))
+	for _, q := range stored.DirQuotas {
+		fmt.Fprintf(tw, "quota %s\t%s of %s\n", q.Path, formatBytes(q.Used), formatBytes(q.Limit))
+	}
+	if m, ok := stats["metrics"].(map[string]float64); ok {
+		fmt.Fprintf(tw, "requests\t%.0f\n", m["requests"])
+		fmt.Fprintf(tw, "downloads in progress\t%.0f\n", m["downloads"])
+		fmt.Fprintf(tw, "uploads in progress\t%.0f\n", m["uploads"])
+		fmt.Fprintf(tw, "jobs queued\t%.0f\n", m["jobsQueued"])
+	} else {
+		fmt.Fprintf(tw, "metrics\tnot enabled\n")
+	}
+	return tw.Flush()
+}
+
+// parseMetrics picks the figures summarised by stats out of the Prometheus metrics.
+func parseMetrics(text string) map[string]float64 {
+	m := map[string]float64{}
+	for _, line := range strings.Split(text, "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			continue
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			continue
+		}
+		name := line[:i]
+		switch {
+		case strings.HasPrefix(name, "fileserver_http_requests_total"):
+			m["requests"] += v
+		case name == `fileserver_active_transfers{direction="download"}`:
+			m["downloads"] = v
+		case name == `fileserver_active_transfers{direction="upload"}`:
+			m["uploads"] = v
+		case name == "fileserver_jobs_queued":
+			m["jobsQueued"] = v
+		}
+	}
+	return m
+}
+
+// formatBytes formats n bytes in the largest binary unit it reaches.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
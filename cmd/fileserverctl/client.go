@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds each request to the server.
+const requestTimeout = time.Minute
+
+// client sends requests to the server's API.
+type client struct {
+	base string // without a trailing slash
+	key  string
+	// raw prints answers as the server sent them instead of formatting them.
+	raw  bool
+	http *http.Client
+}
+
+// apiError is an error answered by the server.
+type apiError struct {
+	Status  int      `json:"status"`
+	Message string   `json:"message"`
+	Details []string `json:"details"`
+}
+
+func (e *apiError) Error() string {
+	msg := fmt.Sprintf("%d %s", e.Status, e.Message)
+	if len(e.Details) > 0 {
+		msg += ": " + strings.Join(e.Details, "; ")
+	}
+	return msg
+}
+
+func newClient(server, key string, raw bool) (*client, error) {
+	u, err := url.Parse(server)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server URL %q", server)
+	}
+	return &client{
+		base: strings.TrimSuffix(server, "/"),
+		key:  key,
+		raw:  raw,
+		http: &http.Client{Timeout: requestTimeout},
+	}, nil
+}
+
+// do sends a request for path with in, if not nil, as its JSON body, and decodes the JSON
+// answer into out, if not nil. Answers other than 2xx are returned as an *apiError.
+func (c *client) do(method, path string, in, out any) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.key != "" {
+		req.Header.Set("X-API-Key", c.key)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		e := &apiError{}
+		if json.Unmarshal(b, e) != nil || e.Message == "" {
+			e.Message = strings.TrimSpace(string(b))
+		}
+		e.Status = resp.StatusCode
+		return e
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, out); err != nil {
+		return fmt.Errorf("unexpected answer from %s: %w", path, err)
+	}
+	return nil
+}
+
+// text fetches path as text, for the endpoints that do not answer JSON.
+func (c *client) text(path string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, c.base+path, nil)
+	if err != nil {
+		return "", err
+	}
+	if c.key != "" {
+		req.Header.Set("X-API-Key", c.key)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		return "", &apiError{Status: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+	return string(b), nil
+}
+
+// print writes v as indented JSON, for -json and for answers with no table of their own.
+func (c *client) print(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// isStatus reports whether err is an answer of the server with the given status.
+func isStatus(err error, status int) bool {
+	var e *apiError
+	return errors.As(err, &e) && e.Status == status
+}
+
+// escapeName escapes each segment of a stored file's name for use in a URL path.
+func escapeName(name string) string {
+	segments := strings.Split(strings.Trim(name, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const filesUsage = `usage: fileserverctl files <command> [arguments]
+
+commands:
+  list [prefix]                  list the stored files, optionally only those below prefix
+  info <name>                    show the details of a file
+  delete [-r] <name>...          delete files (-r: directories with their contents)
+`
+
+// listedFile is a file of the listing.
+type listedFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+}
+
+// listFiles returns the files the server lists for the caller.
+func listFiles(c *client) ([]listedFile, error) {
+	var list struct {
+		Files []listedFile `json:"files"`
+	}
+	err := c.do(http.MethodGet, "/download/list.txt", nil, &list)
+	return list.Files, err
+}
+
+func runFiles(c *client, args []string) error {
+	if len(args) == 0 {
+		return usageError(filesUsage)
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		if len(args) > 1 {
+			return usageError(filesUsage)
+		}
+		files, err := listFiles(c)
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			prefix := strings.Trim(args[0], "/") + "/"
+			var below []listedFile
+			for _, f := range files {
+				if strings.HasPrefix(f.Name, prefix) {
+					below = append(below, f)
+				}
+			}
+			files = below
+		}
+		if c.raw {
+			return c.print(files)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+		for _, f := range files {
+			fmt.Fprintf(tw, "%d\t%s\t %s\n", f.Size, f.Modified.Local().Format(time.DateTime), f.Name)
+		}
+		return tw.Flush()
+
+	case "info":
+		if len(args) != 1 {
+			return usageError(filesUsage)
+		}
+		var info map[string]any
+		if err := c.do(http.MethodGet, "/api/files/"+escapeName(args[0]), nil, &info); err != nil {
+			return err
+		}
+		return c.print(info)
+
+	case "delete":
+		fs := flag.NewFlagSet("files delete", flag.ContinueOnError)
+		recursive := fs.Bool("r", false, "delete directories with their contents")
+		if err := fs.Parse(args); err != nil || fs.NArg() == 0 {
+			return usageError(filesUsage)
+		}
+		return deleteFiles(c, fs.Args(), *recursive)
+
+	default:
+		return usageError(filesUsage)
+	}
+}
+
+// deleteFiles deletes names in one batch, and fails if any of them could not be.
+//
+// Why a batch? The API has no delete request of its own, and one batch deletes any number
+// of files in a single round trip.
+func deleteFiles(c *client, names []string, recursive bool) error {
+	type operation struct {
+		Op        string `json:"op"`
+		Path      string `json:"path"`
+		Recursive bool   `json:"recursive,omitempty"`
+	}
+	var req struct {
+		Operations []operation `json:"operations"`
+	}
+	for _, name := range names {
+		req.Operations = append(req.Operations, operation{Op: "delete", Path: name, Recursive: recursive})
+	}
+	var resp struct {
+		Failed  int `json:"failed"`
+		Results []struct {
+			Path   string `json:"path"`
+			Status string `json:"status"`
+			Error  string `json:"error"`
+		} `json:"results"`
+	}
+	if err := c.do(http.MethodPost, "/api/batch", req, &resp); err != nil {
+		return err
+	}
+	if c.raw {
+		if err := c.print(resp); err != nil {
+			return err
+		}
+	} else {
+		for _, res := range resp.Results {
+			if res.Error != "" {
+				fmt.Printf("%s: %s\n", res.Path, res.Error)
+			} else {
+				fmt.Printf("%s: deleted\n", res.Path)
+			}
+		}
+	}
+	if resp.Failed > 0 {
+		return fmt.Errorf("%d of %d files were not deleted", resp.Failed, len(names))
+	}
+	return nil
+}
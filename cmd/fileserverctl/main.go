@@ -0,0 +1,98 @@
+// Command fileserverctl administers a running fileserver through its API, so that operators
+// need not craft the requests by hand.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+const usage = `usage: fileserverctl [-server url] [-key key] [-json] <command> [arguments]
+
+Talks to a running server. The server and API key may also be set in the
+FILESERVER_URL and FILESERVER_API_KEY environment variables; most commands need
+a key with the admin role.
+
+commands:
+  files    list, show or delete stored files
+  users    manage user accounts
+  tokens   mint, list and revoke access tokens
+  jobs     show the status of a background job
+  rescan   pick up files changed outside the server now
+  changes  print (or follow) the changes made to stored files
+  audit    print (or follow) the requests recorded in the audit log
+  stats    summarise the files stored and the server's activity
+
+Run "fileserverctl <command>" without arguments for its usage.
+`
+
+// defaultServer is the server talked to unless another is given.
+const defaultServer = "http://localhost:8090"
+
+func main() {
+	fs := flag.NewFlagSet("fileserverctl", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	server := fs.String("server", envOr("FILESERVER_URL", defaultServer), "URL of the server, base path included")
+	key := fs.String("key", os.Getenv("FILESERVER_API_KEY"), "API key or token to authenticate with")
+	raw := fs.Bool("json", false, "print the server's JSON answers as they are")
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+	if fs.NArg() == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	c, err := newClient(*server, *key, *raw)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(2)
+	}
+	cmd, args := fs.Arg(0), fs.Args()[1:]
+	var run func(*client, []string) error
+	switch cmd {
+	case "files":
+		run = runFiles
+	case "users":
+		run = runUsers
+	case "tokens":
+		run = runTokens
+	case "jobs":
+		run = runJobs
+	case "rescan":
+		run = runRescan
+	case "changes":
+		run = runChanges
+	case "audit":
+		run = runAudit
+	case "stats":
+		run = runStats
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err := run(c, args); err != nil {
+		if u, ok := err.(usageError); ok {
+			fmt.Fprint(os.Stderr, string(u))
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// usageError is returned by a command called with the wrong arguments, and holds its usage.
+type usageError string
+
+func (u usageError) Error() string {
+	return string(u)
+}
+
+// envOr returns the environment variable name, or fallback if it is not set.
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
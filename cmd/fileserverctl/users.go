@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usersUsage = `usage: fileserverctl users <command> [arguments]
+
+commands:
+  list                              list all users
+  add [-roles r1,r2] <username>     create a user (password is read from stdin)
+  passwd <username>                 set a user's password (read from stdin)
+  roles <username> <r1,r2>          replace a user's roles
+  disable <username>                prevent a user from logging in
+  enable <username>                 allow a disabled user to log in again
+  delete <username>                 remove a user
+`
+
+const tokensUsage = `usage: fileserverctl tokens <command> [arguments]
+
+commands:
+  list                                       list the tokens minted
+  create -name n -permissions p1,p2          mint a token; its secret is printed once
+         -prefixes d1,d2 [-expires 720h]
+  revoke <id>                                revoke a token
+`
+
+// user is a user account as the API describes it.
+type user struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles"`
+	Disabled bool     `json:"disabled"`
+	Static   bool     `json:"static"`
+}
+
+func runUsers(c *client, args []string) error {
+	if len(args) == 0 {
+		return usageError(usersUsage)
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		var users []user
+		if err := c.do(http.MethodGet, "/api/users", nil, &users); err != nil {
+			return err
+		}
+		if c.raw {
+			return c.print(users)
+		}
+		for _, u := range users {
+			status := "enabled"
+			if u.Disabled {
+				status = "disabled"
+			}
+			if u.Static {
+				status += ", static"
+			}
+			fmt.Printf("%s\t[%s]\t(%s)\n", u.Username, strings.Join(u.Roles, ","), status)
+		}
+		return nil
+
+	case "add":
+		fs := flag.NewFlagSet("users add", flag.ContinueOnError)
+		roles := fs.String("roles", "", "comma-separated list of roles")
+		if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+			return usageError(usersUsage)
+		}
+		password, err := readPassword(os.Stdin)
+		if err != nil {
+			return err
+		}
+		req := map[string]any{"username": fs.Arg(0), "password": password, "roles": splitList(*roles)}
+		if err := c.do(http.MethodPost, "/api/users", req, nil); err != nil {
+			return err
+		}
+		fmt.Printf("user '%s' created\n", fs.Arg(0))
+		return nil
+
+	case "passwd", "roles", "disable", "enable":
+		if (cmd == "roles") != (len(args) == 2) || len(args) == 0 || len(args) > 2 {
+			return usageError(usersUsage)
+		}
+		req := make(map[string]any)
+		switch cmd {
+		case "passwd":
+			password, err := readPassword(os.Stdin)
+			if err != nil {
+				return err
+			}
+			req["password"] = password
+		case "roles":
+			req["roles"] = splitList(args[1])
+		default:
+			req["disabled"] = cmd == "disable"
+		}
+		if err := c.do(http.MethodPatch, "/api/users/"+url.PathEscape(args[0]), req, nil); err != nil {
+			return err
+		}
+		fmt.Printf("user '%s' updated\n", args[0])
+		return nil
+
+	case "delete":
+		if len(args) != 1 {
+			return usageError(usersUsage)
+		}
+		if err := c.do(http.MethodDelete, "/api/users/"+url.PathEscape(args[0]), nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("user '%s' deleted\n", args[0])
+		return nil
+
+	default:
+		return usageError(usersUsage)
+	}
+}
+
+// token is a minted token as the API describes it.
+type token struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Secret      string    `json:"secret,omitempty"`
+	Prefixes    []string  `json:"prefixes"`
+	Permissions []string  `json:"permissions"`
+	CreatedBy   string    `json:"createdBy"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+func runTokens(c *client, args []string) error {
+	if len(args) == 0 {
+		return usageError(tokensUsage)
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "list":
+		var tokens []token
+		if err := c.do(http.MethodGet, "/api/tokens", nil, &tokens); err != nil {
+			return err
+		}
+		if c.raw {
+			return c.print(tokens)
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPERMISSIONS\tPREFIXES\tCREATED BY\tEXPIRES")
+		for _, t := range tokens {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", t.ID, t.Name, strings.Join(t.Permissions, ","),
+				strings.Join(t.Prefixes, ","), t.CreatedBy, t.ExpiresAt.Local().Format(time.DateTime))
+		}
+		return tw.Flush()
+
+	case "create":
+		fs := flag.NewFlagSet("tokens create", flag.ContinueOnError)
+		name := fs.String("name", "", "what the token is for")
+		permissions := fs.String("permissions", "", "comma-separated list of upload, download and delete")
+		prefixes := fs.String("prefixes", "", "comma-separated list of the directories the token may access, or / for every one")
+		expires := fs.Duration("expires", 30*24*time.Hour, "how long the token is valid")
+		if err := fs.Parse(args); err != nil || fs.NArg() != 0 || *name == "" || *permissions == "" || *prefixes == "" {
+			return usageError(tokensUsage)
+		}
+		req := map[string]any{
+			"name":        *name,
+			"permissions": splitList(*permissions),
+			"prefixes":    splitList(*prefixes),
+			"expiresIn":   expires.String(),
+		}
+		var t token
+		if err := c.do(http.MethodPost, "/api/tokens", req, &t); err != nil {
+			return err
+		}
+		if c.raw {
+			return c.print(t)
+		}
+		fmt.Printf("token %s created, valid until %s\n", t.ID, t.ExpiresAt.Local().Format(time.DateTime))
+		fmt.Printf("secret (shown only once): %s\n", t.Secret)
+		return nil
+
+	case "revoke":
+		if len(args) != 1 {
+			return usageError(tokensUsage)
+		}
+		if err := c.do(http.MethodDelete, "/api/tokens/"+url.PathEscape(args[0]), nil, nil); err != nil {
+			return err
+		}
+		fmt.Printf("token %s revoked\n", args[0])
+		return nil
+
+	default:
+		return usageError(tokensUsage)
+	}
+}
+
+// splitList splits a comma-separated list, returning an empty list rather than nil for "".
+func splitList(s string) []string {
+	list := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// readPassword reads a password from the first line of r. Why not prompt with echo
+// disabled? That needs a terminal package, and reading stdin also works in scripts
+// (e.g. "echo secret | fileserverctl users add alice").
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	return password, nil
+}
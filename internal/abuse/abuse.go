@@ -0,0 +1,312 @@
+// Package abuse temporarily bans clients whose requests follow patterns of abuse, such as
+// rapid-fire failed uploads, repeated oversized uploads or attempts at path traversal.
+package abuse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/clientip"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// Kind is a kind of incident.
+type Kind string
+
+// The kinds of incident that count towards a ban.
+const (
+	FailedUpload    Kind = "failed uploads"
+	OversizedUpload Kind = "oversized uploads"
+	PathTraversal   Kind = "path traversal attempts"
+)
+
+// Ban records one banned client.
+type Ban struct {
+	// Client is the banned address, or for IPv6, network.
+	Client string    `json:"client"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+// Guard counts the incidents of each client and bans those that reach a threshold. A nil
+// *Guard, for a server with banning off, does neither.
+//
+// Why keep incidents in memory but bans on disk? Losing a few incidents on restart merely
+// gives an abuser a fresh start on their way to a ban, whereas a restart must not lift one.
+type Guard struct {
+	mu            sync.Mutex
+	path          string
+	thresholds    map[Kind]int
+	window        time.Duration
+	banDuration   time.Duration
+	anonymousOnly bool
+	incidents     map[string]map[Kind][]time.Time // keyed by client, then kind, oldest first
+	lastSweep     time.Time
+	bans          map[string]Ban // keyed by client
+	render        *respond.Renderer
+	logger        *log.Logger
+}
+
+// New returns a guard configured by cfg that keeps its bans at path, or nil if banning is off.
+func New(cfg config.AbuseConfig, path string, render *respond.Renderer, logger *log.Logger) (*Guard, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	if cfg.Window <= 0 || cfg.BanDuration <= 0 {
+		return nil, errors.New("abuse.window and abuse.banDuration must be positive")
+	}
+	g := &Guard{
+		path: path,
+		thresholds: map[Kind]int{
+			FailedUpload:    cfg.FailedUploads,
+			OversizedUpload: cfg.OversizedUploads,
+			PathTraversal:   cfg.PathTraversals,
+		},
+		window:        cfg.Window,
+		banDuration:   cfg.BanDuration,
+		anonymousOnly: cfg.AnonymousOnly,
+		incidents:     make(map[string]map[Kind][]time.Time),
+		bans:          make(map[string]Ban),
+		render:        render,
+		logger:        logger,
+	}
+	if err := jsonfile.Load(path, &g.bans); err != nil {
+		return nil, fmt.Errorf("loading bans from %s: %w", path, err)
+	}
+	if g.bans == nil {
+		g.bans = make(map[string]Ban)
+	}
+	return g, nil
+}
+
+// contextKey is the type of the request context key holding the Guard.
+type contextKey struct{}
+
+// Report records an incident of kind for the client of r, if r passed through a guard's
+// Middleware. It is how handlers report what only they can detect.
+func Report(r *http.Request, kind Kind) {
+	if g, _ := r.Context().Value(contextKey{}).(*Guard); g != nil {
+		g.report(r, kind)
+	}
+}
+
+// Middleware refuses requests from banned clients with 403, and counts requests for paths
+// containing ".." as attempts at path traversal. It must run after the client's address is
+// known.
+//
+// Why count those? No link the server hands out ever contains "..", so a client sending one
+// is probing for files outside the storage directory.
+func (g *Guard) Middleware(next http.Handler) http.Handler {
+	if g == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := clientip.Key(clientip.Addr(r))
+		if ban, ok := g.banned(key); ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(ban.Until).Seconds())+1))
+			g.render.Error(w, r, http.StatusForbidden, "client is temporarily banned")
+			return
+		}
+		if hasDotDot(r.URL.Path) {
+			g.report(r, PathTraversal)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, g)))
+	})
+}
+
+// WatchUploads wraps an upload handler, counting its responses with a client error as failed
+// uploads, and those with 413 or 429 as oversized ones.
+func (g *Guard) WatchUploads(next http.HandlerFunc) http.HandlerFunc {
+	if g == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		switch {
+		case rec.status == http.StatusRequestEntityTooLarge || rec.status == http.StatusTooManyRequests:
+			g.report(r, OversizedUpload)
+		case rec.status >= 400 && rec.status < 500:
+			g.report(r, FailedUpload)
+		}
+	}
+}
+
+// report records an incident of kind for the client of r, and bans the client if that
+// brings it to the threshold.
+func (g *Guard) report(r *http.Request, kind Kind) {
+	threshold := g.thresholds[kind]
+	if threshold <= 0 {
+		return
+	}
+	if p, ok := auth.FromContext(r.Context()); g.anonymousOnly && ok && p != nil {
+		return
+	}
+	key := clientip.Key(clientip.Addr(r))
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.sweep(now)
+	if ban, ok := g.bans[key]; ok && now.Before(ban.Until) {
+		return
+	}
+	kinds := g.incidents[key]
+	if kinds == nil {
+		kinds = make(map[Kind][]time.Time)
+		g.incidents[key] = kinds
+	}
+	times := append(recent(kinds[kind], now.Add(-g.window)), now)
+	if len(times) < threshold {
+		kinds[kind] = times
+		return
+	}
+	delete(g.incidents, key)
+	ban := Ban{
+		Client: key,
+		Reason: fmt.Sprintf("%d %s within %s", len(times), kind, g.window),
+		Since:  now.UTC(),
+		Until:  now.Add(g.banDuration).UTC(),
+	}
+	g.bans[key] = ban
+	g.logger.Printf("banned %s until %s: %s\n", key, ban.Until.Format(time.RFC3339), ban.Reason)
+	if err := g.save(); err != nil {
+		g.logger.Printf("error saving bans: %v\n", err)
+	}
+}
+
+// banned returns the ban of the client with the given key, if it is in force.
+func (g *Guard) banned(key string) (Ban, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	ban, ok := g.bans[key]
+	return ban, ok && time.Now().Before(ban.Until)
+}
+
+// sweep drops expired bans and clients without recent incidents, at most once per window,
+// so that neither grows without bound. The caller must hold the lock.
+func (g *Guard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < g.window {
+		return
+	}
+	g.lastSweep = now
+	expired := false
+	for key, ban := range g.bans {
+		if !now.Before(ban.Until) {
+			delete(g.bans, key)
+			expired = true
+		}
+	}
+	for key, kinds := range g.incidents {
+		for kind, times := range kinds {
+			if times = recent(times, now.Add(-g.window)); len(times) == 0 {
+				delete(kinds, kind)
+			} else {
+				kinds[kind] = times
+			}
+		}
+		if len(kinds) == 0 {
+			delete(g.incidents, key)
+		}
+	}
+	if expired {
+		if err := g.save(); err != nil {
+			g.logger.Printf("error saving bans: %v\n", err)
+		}
+	}
+}
+
+// recent returns the times after since.
+func recent(times []time.Time, since time.Time) []time.Time {
+	for len(times) > 0 && !times[0].After(since) {
+		times = times[1:]
+	}
+	return times
+}
+
+// save writes the bans to disk. The caller must hold the lock.
+func (g *Guard) save() error {
+	return jsonfile.Save(g.path, g.bans)
+}
+
+// ListHandler returns the bans in force, newest first. Admin only.
+func (g *Guard) ListHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	bans := []Ban{}
+	g.mu.Lock()
+	for _, ban := range g.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	g.mu.Unlock()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Since.After(bans[j].Since) })
+	w.Header().Set("Cache-Control", "no-store")
+	g.render.JSON(w, http.StatusOK, bans)
+}
+
+// LiftHandler lifts the ban of a client, given as it appears in the list. Admin only.
+func (g *Guard) LiftHandler(w http.ResponseWriter, r *http.Request) {
+	client := r.PathValue("client")
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.bans[client]; !ok {
+		g.render.Error(w, r, http.StatusNotFound, "client is not banned")
+		return
+	}
+	delete(g.bans, client)
+	if err := g.save(); err != nil {
+		g.logger.Printf("error saving bans: %v\n", err)
+		g.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	g.logger.Printf("ban of %s lifted\n", client)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// hasDotDot reports whether path has a ".." segment, with either kind of slash.
+func hasDotDot(path string) bool {
+	for _, seg := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// statusRecorder captures the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
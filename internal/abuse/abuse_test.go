@@ -0,0 +1,182 @@
+package abuse
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// newTestGuard returns a guard keeping its bans at path, banning after three incidents of
+// each kind within an hour.
+func newTestGuard(t *testing.T, path string, anonymousOnly bool) *Guard {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	cfg := config.AbuseConfig{
+		Enabled:          true,
+		AnonymousOnly:    anonymousOnly,
+		Window:           time.Hour,
+		BanDuration:      time.Hour,
+		FailedUploads:    3,
+		OversizedUploads: 3,
+		PathTraversals:   3,
+	}
+	g, err := New(cfg, path, respond.NewRenderer(respond.FormatJSON, logger), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// request sends a request for target from addr through the guard, to an upload handler
+// answering status, and returns the response's status.
+func request(g *Guard, addr, target string, user *auth.Principal, status int) int {
+	upload := g.WatchUploads(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	})
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.URL.Path = target
+	r.RemoteAddr = addr
+	if user != nil {
+		r = r.WithContext(auth.NewContext(r.Context(), user))
+	}
+	w := httptest.NewRecorder()
+	g.Middleware(upload).ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestGuard(t *testing.T) {
+	alice := &auth.Principal{Username: "alice"}
+	tests := []struct {
+		desc          string
+		anonymousOnly bool
+		user          *auth.Principal
+		target        string
+		status        int
+		addrs         []string // one per request, after which the first address tries again
+		wantBanned    bool
+	}{
+		{"failed uploads", false, nil, "/upload", http.StatusUnsupportedMediaType, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, true},
+		{"too few failed uploads", false, nil, "/upload", http.StatusUnsupportedMediaType, []string{"192.0.2.1:1", "192.0.2.1:2"}, false},
+		{"oversized uploads", false, nil, "/upload", http.StatusRequestEntityTooLarge, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, true},
+		{"uploads over the quota", false, nil, "/upload", http.StatusTooManyRequests, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, true},
+		{"path traversal attempts", false, nil, "/download/../../etc/passwd", http.StatusOK, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, true},
+		{"path traversal attempts with backslashes", false, nil, `/download/..\..\win.ini`, http.StatusOK, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, true},
+		{"successful uploads", false, nil, "/upload", http.StatusOK, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, false},
+		{"server errors", false, nil, "/upload", http.StatusInternalServerError, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, false},
+		{"incidents of different clients", false, nil, "/upload", http.StatusBadRequest, []string{"192.0.2.1:1", "192.0.2.2:1", "192.0.2.3:1"}, false},
+		{"incidents from one IPv6 network", false, nil, "/upload", http.StatusBadRequest, []string{"[2001:db8::1]:1", "[2001:db8::2]:1", "[2001:db8::3]:1"}, true},
+		{"an authenticated user", false, alice, "/upload", http.StatusBadRequest, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, true},
+		{"an authenticated user, when only anonymous clients are counted", true, alice, "/upload", http.StatusBadRequest, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, false},
+		{"an anonymous client, when only anonymous clients are counted", true, nil, "/upload", http.StatusBadRequest, []string{"192.0.2.1:1", "192.0.2.1:2", "192.0.2.1:3"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			g := newTestGuard(t, filepath.Join(t.TempDir(), "bans.json"), tt.anonymousOnly)
+			for _, addr := range tt.addrs {
+				if got := request(g, addr, tt.target, tt.user, tt.status); got != tt.status {
+					t.Fatalf("request from %s answered %d before any ban, want %d", addr, got, tt.status)
+				}
+			}
+			got := request(g, tt.addrs[0], "/download/a.txt", nil, http.StatusOK)
+			if banned := got == http.StatusForbidden; banned != tt.wantBanned {
+				t.Errorf("answered %d, want banned %v", got, tt.wantBanned)
+			}
+			// Other clients are never affected.
+			if got := request(g, "198.51.100.1:1", "/download/a.txt", nil, http.StatusOK); got != http.StatusOK {
+				t.Errorf("another client answered %d, want %d", got, http.StatusOK)
+			}
+		})
+	}
+}
+
+// TestBans checks that bans outlast a restart, and can be listed, lifted and run out.
+func TestBans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	g := newTestGuard(t, path, false)
+	for range 3 {
+		request(g, "192.0.2.1:1", "/upload", nil, http.StatusBadRequest)
+	}
+	for range 3 {
+		request(g, "192.0.2.2:1", "/../x", nil, http.StatusOK)
+	}
+
+	g = newTestGuard(t, path, false)
+	w := httptest.NewRecorder()
+	g.ListHandler(w, httptest.NewRequest(http.MethodGet, "/api/bans", nil))
+	var bans []Ban
+	if err := json.NewDecoder(w.Body).Decode(&bans); err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 2 || bans[0].Client != "192.0.2.2" || bans[1].Client != "192.0.2.1" {
+		t.Fatalf("listed %+v after a restart, want both bans, newest first", bans)
+	}
+	if want := "3 failed uploads within 1h0m0s"; bans[1].Reason != want {
+		t.Errorf("ban given for %q, want %q", bans[1].Reason, want)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/download/a.txt", nil)
+	r.RemoteAddr = "192.0.2.1:1"
+	w = httptest.NewRecorder()
+	g.Middleware(http.NotFoundHandler()).ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden || w.Header().Get("Retry-After") == "" {
+		t.Errorf("banned client answered %d with Retry-After %q, want %d with one", w.Code, w.Header().Get("Retry-After"), http.StatusForbidden)
+	}
+
+	tests := []struct {
+		desc       string
+		client     string
+		wantStatus int
+	}{
+		{"lift a ban", "192.0.2.1", http.StatusNoContent},
+		{"lift it again", "192.0.2.1", http.StatusNotFound},
+		{"lift the ban of a client never banned", "198.51.100.1", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/api/bans/"+tt.client, nil)
+			r.SetPathValue("client", tt.client)
+			w := httptest.NewRecorder()
+			g.LiftHandler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+	if got := request(g, "192.0.2.1:1", "/download/a.txt", nil, http.StatusOK); got != http.StatusOK {
+		t.Errorf("client whose ban was lifted answered %d, want %d", got, http.StatusOK)
+	}
+
+	// A ban that has run out no longer applies, and is dropped once the guard sweeps.
+	g.mu.Lock()
+	ban := g.bans["192.0.2.2"]
+	ban.Until = time.Now().Add(-time.Second)
+	g.bans["192.0.2.2"] = ban
+	g.mu.Unlock()
+	if got := request(g, "192.0.2.2:1", "/download/a.txt", nil, http.StatusOK); got != http.StatusOK {
+		t.Errorf("client whose ban ran out answered %d, want %d", got, http.StatusOK)
+	}
+	request(g, "192.0.2.3:1", "/upload", nil, http.StatusBadRequest)
+	if g = newTestGuard(t, path, false); len(g.bans) != 0 {
+		t.Errorf("bans %+v kept, want none", g.bans)
+	}
+}
+
+func TestNilGuard(t *testing.T) {
+	g, err := New(config.AbuseConfig{}, filepath.Join(t.TempDir(), "bans.json"), nil, nil)
+	if err != nil || g != nil {
+		t.Fatalf("New = %v, %v, want nil with banning off", g, err)
+	}
+	for range 10 {
+		if got := request(g, "192.0.2.1:1", "/../upload", nil, http.StatusBadRequest); got != http.StatusBadRequest {
+			t.Fatalf("answered %d, want %d", got, http.StatusBadRequest)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package acl
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// Op is the kind of access being checked.
+type Op int
+
+const (
+	// Read covers downloading files and seeing them in listings.
+	Read Op = iota
+	// Write covers creating and overwriting files.
+	Write
+)
+
+// Subject forms accepted in rule lists.
+const (
+	subjectAnyone = "*"
+	prefixRole    = "role:"
+	prefixUser    = "user:"
+)
+
+// rule is a compiled ACL entry for one path prefix.
+type rule struct {
+	prefix string
+	read   []string
+	write  []string
+}
+
+// ACL decides whether a principal may read or write a path, based on the longest
+// configured path prefix that contains it. Paths not covered by any rule are unrestricted,
+// so an empty ACL preserves the server's open behaviour.
+type ACL struct {
+	rules []rule
+}
+
+// New compiles the configured rules.
+func New(rules []config.ACLRule) *ACL {
+	a := &ACL{rules: make([]rule, 0, len(rules))}
+	for _, r := range rules {
+		a.rules = append(a.rules, rule{
+			prefix: normalise(r.Path),
+			read:   r.Read,
+			write:  r.Write,
+		})
+	}
+	// Why sort by length? The first matching rule is then always the most specific one,
+	// so "/finance/reports" can override "/finance".
+	sort.SliceStable(a.rules, func(i, j int) bool { return len(a.rules[i].prefix) > len(a.rules[j].prefix) })
+	return a
+}
+
+// Allowed reports whether p may perform op on the file or directory at name, which is
+// relative to the storage directory. p may be nil for anonymous callers.
+//
+// Principals confined to path prefixes (e.g. scoped tokens) are refused anything outside
+// them before the rules are consulted.
+func (a *ACL) Allowed(p *auth.Principal, op Op, name string) bool {
+	if p != nil && !p.AllowsPath(name) {
+		return false
+	}
+	name = normalise(name)
+	for _, r := range a.rules {
+		if !contains(r.prefix, name) {
+			continue
+		}
+		subjects := r.read
+		if op == Write {
+			subjects = r.write
+		}
+		return matches(subjects, p)
+	}
+	return true
+}
+
+// contains reports whether the normalised path name lies within prefix.
+func contains(prefix, name string) bool {
+	return prefix == "/" || name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// matches reports whether p is one of subjects.
+func matches(subjects []string, p *auth.Principal) bool {
+	for _, s := range subjects {
+		switch {
+		case s == subjectAnyone:
+			return true
+		case p == nil:
+			continue
+		case strings.HasPrefix(s, prefixRole):
+			if p.HasRole(strings.TrimPrefix(s, prefixRole)) {
+				return true
+			}
+		case strings.TrimPrefix(s, prefixUser) == p.Username:
+			return true
+		}
+	}
+	return false
+}
+
+// normalise turns a storage-relative name into a clean, slash-rooted path so that
+// "finance", "/finance/" and "./finance" all compare equal.
+func normalise(name string) string {
+	return path.Clean("/" + strings.ReplaceAll(name, "\\", "/"))
+}
@@ -0,0 +1,60 @@
+package acl
+
+import (
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestAllowed(t *testing.T) {
+	a := New([]config.ACLRule{
+		{Path: "/finance", Read: []string{"role:finance"}, Write: []string{"user:carol"}},
+		{Path: "finance/reports/", Read: []string{"*"}, Write: []string{"role:finance"}},
+		{Path: "/private", Read: []string{"user:carol"}},
+	})
+	alice := &auth.Principal{Username: "alice"}
+	bob := &auth.Principal{Username: "bob", Roles: []string{"finance"}}
+	carol := &auth.Principal{Username: "carol"}
+	scoped := &auth.Principal{Username: "ci", Roles: []string{"finance"}, PathPrefixes: []string{"finance/reports"}}
+
+	tests := []struct {
+		desc string
+		p    *auth.Principal
+		op   Op
+		name string
+		want bool
+	}{
+		{"no rule covers the path", alice, Write, "public/a.txt", true},
+		{"anonymous, no rule covers the path", nil, Read, "public/a.txt", true},
+		{"read by role", bob, Read, "finance/budget.xlsx", true},
+		{"read without the role", alice, Read, "finance/budget.xlsx", false},
+		{"write by user", carol, Write, "finance/budget.xlsx", true},
+		{"role does not grant write", bob, Write, "finance/budget.xlsx", false},
+		{"the directory itself", alice, Read, "finance", false},
+		{"a longer rule overrides a shorter one", alice, Read, "finance/reports/q3.pdf", true},
+		{"the longer rule is all that applies", carol, Write, "finance/reports/q3.pdf", false},
+		{"anyone includes anonymous callers", nil, Read, "finance/reports/q3.pdf", true},
+		{"anonymous callers match no named subject", nil, Read, "finance/budget.xlsx", false},
+		{"a name sharing the prefix is not covered", alice, Read, "financed/a.txt", true},
+		{"names are normalised", alice, Read, "./finance//budget.xlsx", false},
+		{"backslashes are separators", alice, Read, `finance\budget.xlsx`, false},
+		{"dot-dot cannot escape a rule", alice, Read, "public/../finance/budget.xlsx", false},
+		{"an empty list allows nobody", carol, Write, "private/a.txt", false},
+		{"within the caller's path scope", scoped, Write, "finance/reports/q3.pdf", true},
+		{"outside the caller's path scope", scoped, Read, "public/a.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got := a.Allowed(tt.p, tt.op, tt.name); got != tt.want {
+				t.Errorf("Allowed(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAllowedEmpty(t *testing.T) {
+	if !New(nil).Allowed(nil, Write, "anything") {
+		t.Error("an ACL without rules refused an anonymous write")
+	}
+}
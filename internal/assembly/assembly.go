@@ -0,0 +1,324 @@
+// Package assembly assembles files uploaded in byte ranges, which a client may send over
+// several connections at once, into a staging file that is stored once every byte has arrived.
+package assembly
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+)
+
+// ErrNotFound is returned for an upload that does not exist, or has expired.
+var ErrNotFound = errors.New("upload is not found")
+
+// ErrOutOfRange is returned for a part that does not lie within the file.
+var ErrOutOfRange = errors.New("part lies beyond the end of the file")
+
+// Range is a range of bytes of the file that has been received.
+type Range struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// end returns the offset just past the range.
+func (r Range) end() int64 {
+	return r.Offset + r.Length
+}
+
+// Upload is a file being assembled.
+type Upload struct {
+	ID   string `json:"id"`
+	Name string `json:"name"` // the path the file is stored at once complete
+	Size int64  `json:"size"`
+	User string `json:"user"`
+	// Received lists the ranges received so far, in order, with adjacent ones merged.
+	Received []Range   `json:"received"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Complete reports whether every byte of the file has been received.
+func (u Upload) Complete() bool {
+	return u.Size == 0 || len(u.Received) == 1 && u.Received[0] == Range{0, u.Size}
+}
+
+// Missing returns the ranges not received yet, in order.
+func (u Upload) Missing() []Range {
+	missing := []Range{}
+	var off int64
+	for _, r := range u.Received {
+		if r.Offset > off {
+			missing = append(missing, Range{off, r.Offset - off})
+		}
+		off = r.end()
+	}
+	if off < u.Size {
+		missing = append(missing, Range{off, u.Size - off})
+	}
+	return missing
+}
+
+// Store keeps the uploads in a JSON file, and their content in a staging directory, so that
+// they survive a restart. Uploads not written to within the expiry are removed.
+type Store struct {
+	mu      sync.Mutex
+	path    string
+	dir     string
+	expiry  time.Duration
+	uploads map[string]*Upload
+	logger  *log.Logger
+	stop    chan struct{} // closed by Close
+	done    chan struct{} // closed once expiry stops
+}
+
+// Open loads the uploads from path, for files staged in dir, and starts removing them once
+// they expire, until the store is closed.
+func Open(path, dir string, expiry time.Duration, logger *log.Logger) (*Store, error) {
+	s := &Store{
+		path:    path,
+		dir:     dir,
+		expiry:  expiry,
+		uploads: make(map[string]*Upload),
+		logger:  logger,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if err := jsonfile.Load(path, &s.uploads); err != nil {
+		return nil, fmt.Errorf("loading uploads from %s: %w", path, err)
+	}
+	if s.uploads == nil {
+		s.uploads = make(map[string]*Upload)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	s.expire()
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				s.expire()
+			}
+		}
+	}()
+	return s, nil
+}
+
+// Close stops removing expired uploads. Those that expire meanwhile are removed once the
+// store is next opened.
+func (s *Store) Close() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	<-s.done
+}
+
+// Create starts an upload of size bytes by user, to be stored as name.
+func (s *Store) Create(name, user string, size int64) (Upload, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	now := time.Now().UTC()
+	u := &Upload{ID: hex.EncodeToString(id), Name: name, Size: size, User: user, Received: []Range{}, Created: now, Updated: now}
+
+	// Why size the staging file up front? Parts then land at their offsets in any order, and
+	// the file takes no disk space for the holes between them on most filesystems.
+	f, err := os.OpenFile(s.file(u.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return Upload{}, err
+	}
+	err = f.Truncate(size)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(s.file(u.ID))
+		return Upload{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.uploads[u.ID] = u
+	if err := jsonfile.Save(s.path, s.uploads); err != nil {
+		delete(s.uploads, u.ID)
+		os.Remove(s.file(u.ID))
+		return Upload{}, err
+	}
+	return u.clone(), nil
+}
+
+// Get returns the upload with the given ID.
+func (s *Store) Get(id string) (Upload, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.uploads[id]
+	if !ok {
+		return Upload{}, false
+	}
+	return u.clone(), true
+}
+
+// Write copies length bytes from r into the upload at offset, and returns the upload with
+// the range recorded as received. Parts may be written concurrently, and in any order.
+//
+// A part cut short, as by the client disconnecting or the server shutting down, still has
+// the bytes that did arrive recorded, so that the client resumes from where it stopped
+// rather than sending the whole part again.
+func (s *Store) Write(id string, offset, length int64, r io.Reader) (Upload, error) {
+	u, ok := s.Get(id)
+	if !ok {
+		return Upload{}, ErrNotFound
+	}
+	if offset < 0 || length < 0 || offset+length > u.Size {
+		return Upload{}, ErrOutOfRange
+	}
+	f, err := os.OpenFile(s.file(id), os.O_WRONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Upload{}, ErrNotFound
+		}
+		return Upload{}, err
+	}
+	n, err := io.CopyN(io.NewOffsetWriter(f, offset), r, length)
+	if closeErr := f.Close(); closeErr != nil {
+		// The bytes copied may not all have reached the file.
+		n = 0
+		if err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil && n == 0 {
+		return Upload{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.uploads[id]
+	if !ok {
+		// Aborted whilst the part was written.
+		return Upload{}, ErrNotFound
+	}
+	p.Received = merge(append(p.Received, Range{offset, n}))
+	p.Updated = time.Now().UTC()
+	if err := jsonfile.Save(s.path, s.uploads); err != nil {
+		s.logger.Printf("error saving uploads: %v\n", err)
+	}
+	if err != nil {
+		return Upload{}, err
+	}
+	return p.clone(), nil
+}
+
+// Expires returns when u expires, unless another part arrives before.
+func (s *Store) Expires(u Upload) time.Time {
+	return u.Updated.Add(s.expiry)
+}
+
+// Open opens the content of an upload for reading.
+func (s *Store) Open(id string) (*os.File, error) {
+	if _, ok := s.Get(id); !ok {
+		return nil, ErrNotFound
+	}
+	return os.Open(s.file(id))
+}
+
+// Remove removes an upload and its content, once stored or when the client gives up on it.
+func (s *Store) Remove(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeLocked(id)
+	if err := jsonfile.Save(s.path, s.uploads); err != nil {
+		s.logger.Printf("error saving uploads: %v\n", err)
+	}
+}
+
+// expire removes the uploads not written to within the expiry, and staged files that belong
+// to no upload, as left behind by a crash.
+func (s *Store) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cutoff := time.Now().Add(-s.expiry)
+	expired := 0
+	for id, u := range s.uploads {
+		if u.Updated.Before(cutoff) {
+			s.removeLocked(id)
+			expired++
+		}
+	}
+	if expired > 0 {
+		s.logger.Printf("removed %d expired uploads\n", expired)
+		if err := jsonfile.Save(s.path, s.uploads); err != nil {
+			s.logger.Printf("error saving uploads: %v\n", err)
+		}
+	}
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if _, ok := s.uploads[e.Name()]; !ok && time.Since(modTime(e)) > time.Minute {
+			os.Remove(filepath.Join(s.dir, e.Name()))
+		}
+	}
+}
+
+// removeLocked removes an upload and its content. The caller must hold the lock, and save.
+func (s *Store) removeLocked(id string) {
+	delete(s.uploads, id)
+	if err := os.Remove(s.file(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		s.logger.Printf("error removing staged upload %s: %v\n", id, err)
+	}
+}
+
+// file returns the path of the content of the upload with the given ID.
+func (s *Store) file(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// clone returns a copy of u that shares nothing with it.
+func (u *Upload) clone() Upload {
+	c := *u
+	c.Received = append([]Range{}, u.Received...)
+	return c
+}
+
+// merge sorts ranges and merges those that overlap or touch.
+func merge(ranges []Range) []Range {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Offset < ranges[j].Offset })
+	merged := ranges[:0]
+	for _, r := range ranges {
+		if r.Length == 0 {
+			continue
+		}
+		if n := len(merged); n > 0 && r.Offset <= merged[n-1].end() {
+			merged[n-1].Length = max(merged[n-1].end(), r.end()) - merged[n-1].Offset
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// modTime returns the modification time of a directory entry, or now if it cannot be read.
+func modTime(e os.DirEntry) time.Time {
+	info, err := e.Info()
+	if err != nil {
+		return time.Now()
+	}
+	return info.ModTime()
+}
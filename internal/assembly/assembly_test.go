@@ -0,0 +1,113 @@
+package assembly
+
+import (
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// cutReader returns what r holds, then fails as a dropped connection does.
+type cutReader struct {
+	r io.Reader
+}
+
+var errCut = errors.New("connection reset")
+
+func (c *cutReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err == io.EOF {
+		return n, errCut
+	}
+	return n, err
+}
+
+func openTestStore(t *testing.T, dir string) *Store {
+	t.Helper()
+	s, err := Open(filepath.Join(dir, "uploads.json"), filepath.Join(dir, "staging"), time.Hour, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWriteKeepsWhatArrives(t *testing.T) {
+	tests := []struct {
+		desc     string
+		offset   int64
+		length   int64
+		body     io.Reader
+		wantErr  bool
+		received []Range
+	}{
+		{"whole part", 10, 10, strings.NewReader("0123456789"), false, []Range{{10, 10}}},
+		{"part cut short", 10, 10, &cutReader{strings.NewReader("0123")}, true, []Range{{10, 4}}},
+		{"part cut before any byte", 10, 10, &cutReader{strings.NewReader("")}, true, []Range{}},
+		{"part past the end", 95, 10, strings.NewReader("0123456789"), true, []Range{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestStore(t, dir)
+			u, err := s.Create("file.bin", "alice", 100)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.Write(u.ID, tt.offset, tt.length, tt.body); (err != nil) != tt.wantErr {
+				t.Fatalf("Write: err = %v, want error %v", err, tt.wantErr)
+			}
+
+			// The ranges received are what a restarted server knows of the upload.
+			reopened := openTestStore(t, dir)
+			got, ok := reopened.Get(u.ID)
+			if !ok {
+				t.Fatal("upload is gone after reopening the store")
+			}
+			if !reflect.DeepEqual(got.Received, tt.received) {
+				t.Errorf("received %v, want %v", got.Received, tt.received)
+			}
+		})
+	}
+}
+
+func TestResumeAfterCut(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestStore(t, dir)
+	u, err := s.Create("file.bin", "alice", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Write(u.ID, 0, 10, &cutReader{strings.NewReader("012")}); !errors.Is(err, errCut) {
+		t.Fatalf("Write: err = %v, want the read error", err)
+	}
+
+	reopened := openTestStore(t, dir)
+	u, _ = reopened.Get(u.ID)
+	missing := u.Missing()
+	if !reflect.DeepEqual(missing, []Range{{3, 7}}) {
+		t.Fatalf("missing %v, want [{3 7}]", missing)
+	}
+	u, err = reopened.Write(u.ID, missing[0].Offset, missing[0].Length, strings.NewReader("3456789"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.Complete() {
+		t.Fatalf("upload is not complete: %v", u.Received)
+	}
+	f, err := reopened.Open(u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0123456789" {
+		t.Errorf("assembled %q, want %q", data, "0123456789")
+	}
+}
@@ -0,0 +1,306 @@
+// Package audit keeps a log of every request that changes something, such as an upload, a
+// delete or a change to a user, with who made it, from where, and how it was answered, and
+// serves its tail to admins.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/clientip"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// keep is the number of the latest events at least held in memory, to be served without
+// reading the file back.
+const keep = 10000
+
+// maxPage is the largest number of events answered at once.
+const maxPage = 1000
+
+// Event records one request.
+type Event struct {
+	Seq    int64     `json:"seq"`
+	Time   time.Time `json:"time"`
+	User   string    `json:"user,omitempty"`
+	Client string    `json:"client"`
+	Method string    `json:"method"`
+	// Path is the path requested, without its query, which may hold credentials such as the
+	// signature of a signed link.
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+}
+
+// Log appends events to a file of one JSON document per line, which can be read with
+// nothing but a text editor or jq, and holds the latest in memory.
+//
+// Why not record reads? Downloads and listings are by far the most frequent requests, and
+// change nothing; the server's log has them.
+type Log struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+	recent  []Event // the latest events, oldest first
+	next    int64   // the Seq of the next event
+	user    func(*http.Request) string
+	render  *respond.Renderer
+	logger  *log.Logger
+}
+
+// Open opens the log at path, creating it if need be, and reads back its latest events. Once
+// the file reaches maxSize bytes it is renamed with a ".1" suffix, replacing the previous
+// one, and a new file begun; 0 never rotates it. user names the caller of a request, if any.
+func Open(path string, maxSize int64, user func(*http.Request) string, render *respond.Renderer, logger *log.Logger) (*Log, error) {
+	l := &Log{path: path, maxSize: maxSize, next: 1, user: user, render: render, logger: logger}
+	// The events of a rotated file come first, so that numbering carries on after a restart
+	// that follows a rotation.
+	for _, name := range []string{path + ".1", path} {
+		if err := l.readBack(name); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	l.f, l.size = f, info.Size()
+	return l, nil
+}
+
+// readBack adds the events in the file name to those in memory.
+//
+// Why skip lines that cannot be read? A crash can leave the last line half written, and an
+// audit log that stops the server from starting would be worse than one missing an event.
+func (l *Log) readBack(name string) error {
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64<<10), 1<<20)
+	for sc.Scan() {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil || e.Seq < l.next {
+			continue
+		}
+		l.remember(e)
+		l.next = e.Seq + 1
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	return nil
+}
+
+// remember holds e in memory. The caller must hold the lock, if the log is in use.
+//
+// Why drop the oldest keep events at once? Dropping one per event would move all the others
+// each time.
+func (l *Log) remember(e Event) {
+	if len(l.recent) == 2*keep {
+		l.recent = append(l.recent[:0], l.recent[keep:]...)
+	}
+	l.recent = append(l.recent, e)
+}
+
+// Close closes the file. A nil log has nothing to close.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// Record numbers e, appends it to the file and holds it in memory. Failing to write it is
+// logged rather than returned: the request it records has already been answered.
+func (l *Log) Record(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e.Seq = l.next
+	l.next++
+	l.remember(e)
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		l.logger.Printf("error encoding audit event: %v\n", err)
+		return
+	}
+	b = append(b, '\n')
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(b)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			l.logger.Printf("error rotating audit log: %v\n", err)
+		}
+	}
+	n, err := l.f.Write(b)
+	l.size += int64(n)
+	if err != nil {
+		l.logger.Printf("error writing audit log: %v\n", err)
+	}
+}
+
+// rotate renames the file with a ".1" suffix and begins a new one. The caller must hold the
+// lock.
+func (l *Log) rotate() error {
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		// Carry on appending to the renamed file rather than lose events.
+		return err
+	}
+	l.f.Close()
+	l.f, l.size = f, 0
+	return nil
+}
+
+// Middleware records the requests that may change something: those with methods other than
+// GET, HEAD and OPTIONS. It must run after the caller is authenticated, and the client's
+// address known. A nil log records nothing.
+func (l *Log) Middleware(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		e := Event{
+			Time:   time.Now().UTC(),
+			Client: clientip.Addr(r).String(),
+			Method: r.Method,
+			Path:   r.URL.EscapedPath(),
+		}
+		sw := &statusRecorder{ResponseWriter: w}
+		returned := false
+		// Why record after a panic too? The request may have changed something before it
+		// crashed; the panic carries on to the recoverer outside, which answers 500.
+		defer func() {
+			e.User = l.user(r)
+			e.Status = sw.status
+			if e.Status == 0 {
+				// A handler that writes nothing is answered with 200 once it returns.
+				e.Status = http.StatusOK
+				if !returned {
+					e.Status = http.StatusInternalServerError
+				}
+			}
+			l.Record(e)
+		}()
+		next.ServeHTTP(sw, r)
+		returned = true
+	})
+}
+
+// statusRecorder captures the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusRecorder) WriteHeader(status int) {
+	if sw.status == 0 && status >= 200 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusRecorder) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (sw *statusRecorder) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// page is the answer of TailHandler.
+type page struct {
+	Events []Event `json:"events"`
+	// Cursor is the Seq of the last event answered, to continue from.
+	Cursor string `json:"cursor"`
+	// More reports that further events follow those answered.
+	More bool `json:"more"`
+}
+
+// TailHandler answers the events recorded, oldest first. Without a cursor, it answers the
+// last events recorded, up to limit (100 by default); with one, the events that followed
+// it, so that a client can follow the log by passing back the cursor of each answer. The
+// cursor "latest" answers no events, and the cursor to follow from. Admin only.
+func (l *Log) TailHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			l.render.Error(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, maxPage)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	latest := l.next - 1
+	var events []Event
+	switch v := q.Get("cursor"); v {
+	case "":
+		events = l.recent[max(len(l.recent)-limit, 0):]
+	case "latest":
+	default:
+		cursor, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || cursor < 0 {
+			l.render.Error(w, r, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		// Events are numbered without gaps, so the first one held gives the position of the
+		// one after the cursor.
+		first := latest - int64(len(l.recent)) + 1
+		if cursor+1 < first {
+			l.render.Error(w, r, http.StatusGone, "cursor has expired", "the events after it are only in the file; continue from cursor=latest")
+			return
+		}
+		if cursor < latest {
+			events = l.recent[cursor+1-first:]
+			events = events[:min(len(events), limit)]
+		}
+	}
+
+	p := page{Events: append([]Event{}, events...), Cursor: strconv.FormatInt(latest, 10)}
+	if len(events) > 0 {
+		last := events[len(events)-1].Seq
+		p.Cursor, p.More = strconv.FormatInt(last, 10), last < latest
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	l.render.JSON(w, http.StatusOK, p)
+}
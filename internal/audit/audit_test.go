@@ -0,0 +1,196 @@
+package audit
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// openTestLog opens a log at path, naming the caller of a request by its X-User header.
+func openTestLog(t *testing.T, path string, maxSize int64) *Log {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	l, err := Open(path, maxSize, func(r *http.Request) string { return r.Header.Get("X-User") }, respond.NewRenderer(respond.FormatJSON, logger), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// readEvents returns the events in the file at path.
+func readEvents(t *testing.T, path string) []Event {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []Event
+	for _, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestMiddleware(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	l := openTestLog(t, path, 0)
+	handler := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/files/secret.txt":
+			w.WriteHeader(http.StatusForbidden)
+		case "/upload":
+			w.WriteHeader(http.StatusCreated)
+		case "/panic":
+			panic(http.ErrAbortHandler)
+		}
+	}))
+	serve := func(method, target, user string) {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = "203.0.113.7:4711"
+		if user != "" {
+			r.Header.Set("X-User", user)
+		}
+		defer func() { recover() }()
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	serve(http.MethodGet, "/download/a.txt", "alice")
+	serve(http.MethodPost, "/upload?signature=s3cret", "alice")
+	serve(http.MethodHead, "/download/a.txt", "")
+	serve(http.MethodDelete, "/api/files/secret.txt", "bob")
+	serve(http.MethodOptions, "/upload", "")
+	serve(http.MethodPost, "/login", "")
+	serve(http.MethodPut, "/panic", "carol")
+
+	want := []Event{
+		{Seq: 1, User: "alice", Client: "203.0.113.7", Method: http.MethodPost, Path: "/upload", Status: http.StatusCreated},
+		{Seq: 2, User: "bob", Client: "203.0.113.7", Method: http.MethodDelete, Path: "/api/files/secret.txt", Status: http.StatusForbidden},
+		{Seq: 3, Client: "203.0.113.7", Method: http.MethodPost, Path: "/login", Status: http.StatusOK},
+		{Seq: 4, User: "carol", Client: "203.0.113.7", Method: http.MethodPut, Path: "/panic", Status: http.StatusInternalServerError},
+	}
+	got := readEvents(t, path)
+	if len(got) != len(want) {
+		t.Fatalf("recorded %d events, want %d: %+v", len(got), len(want), got)
+	}
+	for i, e := range got {
+		if e.Time.IsZero() {
+			t.Errorf("event %d has no time", e.Seq)
+		}
+		e.Time = want[i].Time
+		if e != want[i] {
+			t.Errorf("recorded %+v, want %+v", e, want[i])
+		}
+	}
+}
+
+func TestNilLogMiddleware(t *testing.T) {
+	var l *Log
+	called := false
+	l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", nil))
+	if !called {
+		t.Error("the request was not passed on")
+	}
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestReopen checks that a log opened again carries on numbering where it left off, over a
+// half-written last line and a rotation.
+func TestReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	// Each event takes about 100 bytes, so the log is rotated after a few.
+	l := openTestLog(t, path, 300)
+	for range 5 {
+		l.Record(Event{Method: http.MethodPost, Path: "/upload", Status: http.StatusCreated})
+	}
+	l.Close()
+
+	rotated, current := readEvents(t, path+".1"), readEvents(t, path)
+	if len(rotated) == 0 || len(current) == 0 || rotated[len(rotated)-1].Seq+1 != current[0].Seq || current[len(current)-1].Seq != 5 {
+		t.Fatalf("rotated events %+v and current events %+v, want 1 to 5 between them", rotated, current)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":6,"time":"2024-`)
+	f.Close()
+
+	l = openTestLog(t, path, 0)
+	l.Record(Event{Method: http.MethodDelete, Path: "/api/files/a.txt", Status: http.StatusNoContent})
+	if got := l.recent[len(l.recent)-1].Seq; got != 6 {
+		t.Errorf("event numbered %d after reopening, want 6", got)
+	}
+	if got := len(l.recent); got != 6 {
+		t.Errorf("%d events held after reopening, want 6", got)
+	}
+}
+
+func TestTailHandler(t *testing.T) {
+	l := openTestLog(t, filepath.Join(t.TempDir(), "audit.log"), 0)
+	const recorded = 2*keep + 10
+	for range recorded {
+		l.Record(Event{Method: http.MethodPost, Path: "/upload", Status: http.StatusCreated})
+	}
+
+	tests := []struct {
+		desc       string
+		query      string
+		wantStatus int
+		wantFirst  int64
+		wantCount  int
+		wantCursor string
+		wantMore   bool
+	}{
+		{"the last events", "", http.StatusOK, recorded - 99, 100, "20010", false},
+		{"the last few", "limit=3", http.StatusOK, recorded - 2, 3, "20010", false},
+		{"more than a page", "limit=5000", http.StatusOK, recorded - 999, 1000, "20010", false},
+		{"after a cursor", "cursor=20000&limit=4", http.StatusOK, 20001, 4, "20004", true},
+		{"after a cursor to the end", "cursor=20005", http.StatusOK, 20006, 5, "20010", false},
+		{"after the last event", "cursor=20010", http.StatusOK, 0, 0, "20010", false},
+		{"from the latest", "cursor=latest", http.StatusOK, 0, 0, "20010", false},
+		{"after the oldest event held", "cursor=10000&limit=1", http.StatusOK, 10001, 1, "10001", true},
+		{"before the oldest event held", "cursor=9999", http.StatusGone, 0, 0, "", false},
+		{"an invalid cursor", "cursor=abc", http.StatusBadRequest, 0, 0, "", false},
+		{"an invalid limit", "limit=0", http.StatusBadRequest, 0, 0, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			l.TailHandler(w, httptest.NewRequest(http.MethodGet, "/api/audit?"+tt.query, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var got page
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got.Events) != tt.wantCount || got.Cursor != tt.wantCursor || got.More != tt.wantMore {
+				t.Fatalf("got %d events, cursor %s and more %v, want %d, %s and %v", len(got.Events), got.Cursor, got.More, tt.wantCount, tt.wantCursor, tt.wantMore)
+			}
+			for i, e := range got.Events {
+				if e.Seq != tt.wantFirst+int64(i) {
+					t.Fatalf("event %d is numbered %d, want %d", i, e.Seq, tt.wantFirst+int64(i))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+	"github.com/mascotmascot1/fileserver/internal/session"
+	"github.com/mascotmascot1/fileserver/internal/tokens"
+	"github.com/mascotmascot1/fileserver/internal/users"
+)
+
+// Authenticator resolves the principal of each request and guards protected routes.
+type Authenticator struct {
+	sessions  *session.Manager
+	users     *users.Store
+	apiKeys   map[string]config.APIKey   // keyed by SHA-256 hash of the key
+	sigV4Keys map[string]config.SigV4Key // keyed by access key ID
+	tokens    *tokens.Store
+	signed    *signedURLs
+	render    *respond.Renderer
+	logger    *log.Logger
+}
+
+// NewAuthenticator creates an Authenticator from the application configuration.
+func NewAuthenticator(cfg *config.Config, sessions *session.Manager, userStore *users.Store, tokenStore *tokens.Store, render *respond.Renderer, logger *log.Logger) *Authenticator {
+	apiKeys := make(map[string]config.APIKey, len(cfg.Auth.APIKeys))
+	for _, k := range cfg.Auth.APIKeys {
+		apiKeys[strings.ToLower(k.SHA256)] = k
+	}
+	return &Authenticator{
+		sessions:  sessions,
+		users:     userStore,
+		apiKeys:   apiKeys,
+		sigV4Keys: newSigV4Keys(cfg.Auth.SigV4Keys),
+		tokens:    tokenStore,
+		signed:    newSignedURLs(cfg.Auth.SignedURLs, cfg.Server.GetBasePath()),
+		render:    render,
+		logger:    logger,
+	}
+}
+
+// Middleware attaches the principal of a valid signed URL, AWS signature, API key or session
+// to the request context. It never rejects a request itself, except for an invalid credential; the
+// authorisation layer does that for protected routes.
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Why take precedence over other credentials? A signed link is meant to work for
+		// whoever follows it, logged in or not, and to grant exactly what it names.
+		p, err := a.signed.principal(r)
+		if err != nil {
+			a.logger.Printf("rejected signed URL from %s for %s: %v\n", r.RemoteAddr, r.URL.Path, err)
+			a.render.Error(w, r, http.StatusForbidden, err.Error())
+			return
+		}
+		if p != nil {
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+			return
+		}
+
+		if isSigV4(r) {
+			p, err := a.lookupSigV4(r)
+			if err != nil {
+				a.logger.Printf("rejected request from %s: %v\n", r.RemoteAddr, err)
+				a.render.Error(w, r, http.StatusUnauthorized, "invalid or expired credential")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+			return
+		}
+		if key := apiKeyFrom(r); key != "" {
+			// Why reject an unknown key outright? Silently treating the caller as anonymous
+			// would hide a misconfigured CI job behind confusing 401s further down the line.
+			p, ok := a.lookupCredential(key)
+			if !ok {
+				a.logger.Printf("invalid or expired credential from %s\n", r.RemoteAddr)
+				a.render.Error(w, r, http.StatusUnauthorized, "invalid or expired credential")
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), p)))
+			return
+		}
+
+		if s, ok := a.sessions.Load(r); ok {
+			// Why look the user up on every request? Roles and the disabled flag may have
+			// changed since login, and those changes must take effect immediately.
+			if u, err := a.users.Get(s.Username); err == nil && !u.Disabled {
+				p := &Principal{Username: u.Username, Roles: u.Roles, SessionID: s.ID}
+				r = r.WithContext(NewContext(r.Context(), p))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lookupCredential returns the principal for a presented bearer credential, which is
+// either a scoped token minted via the API or a static API key.
+func (a *Authenticator) lookupCredential(credential string) (*Principal, bool) {
+	if !tokens.IsSecret(credential) {
+		return a.lookupAPIKey(credential)
+	}
+	t, ok := a.tokens.Lookup(credential)
+	if !ok {
+		return nil, false
+	}
+	// Why a non-nil empty slice? A nil Permissions field would fall back to roles,
+	// whereas a token without permissions must grant nothing at all.
+	perms := append([]string{}, t.Permissions...)
+	return &Principal{Username: "token:" + t.Name, Permissions: perms, PathPrefixes: t.Prefixes}, true
+}
+
+// lookupAPIKey returns the principal for a presented API key.
+// Only SHA-256 hashes of keys are configured, so the map lookup by hash is safe against
+// timing attacks: an attacker cannot learn anything about a key from a hash prefix.
+func (a *Authenticator) lookupAPIKey(key string) (*Principal, bool) {
+	sum := sha256.Sum256([]byte(key))
+	k, ok := a.apiKeys[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil, false
+	}
+	return &Principal{Username: "apikey:" + k.Name, Roles: k.Roles}, true
+}
+
+// apiKeyFrom extracts an API key from the X-API-Key header or a bearer Authorization header.
+func apiKeyFrom(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/internal/session"
+)
+
+// maxJSONBodySize bounds the JSON request bodies accepted by the auth endpoints;
+// credentials and account changes are never larger than this.
+const maxJSONBodySize = 4 << 10
+
+// sessionInfo is the JSON representation of a session returned to clients.
+// It deliberately omits the token hash.
+type sessionInfo struct {
+	ID         string    `json:"id"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeen   time.Time `json:"lastSeen"`
+	RemoteAddr string    `json:"remoteAddr"`
+	UserAgent  string    `json:"userAgent"`
+	Current    bool      `json:"current"`
+}
+
+// LoginHandler verifies a username and password and starts a session.
+// Credentials may be sent as JSON or as an urlencoded form, so both scripts
+// and plain HTML login forms are supported.
+func (a *Authenticator) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	a.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
+
+	var creds struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+			a.render.Error(w, r, http.StatusBadRequest, "malformed JSON body")
+			return
+		}
+	case "application/x-www-form-urlencoded":
+		creds.Username = r.PostFormValue("username")
+		creds.Password = r.PostFormValue("password")
+	default:
+		a.render.Error(w, r, http.StatusUnsupportedMediaType, "request body must be JSON or an urlencoded form")
+		return
+	}
+
+	if _, ok := a.users.Authenticate(creds.Username, creds.Password); !ok {
+		a.logger.Printf("failed login for user '%s' from %s\n", creds.Username, r.RemoteAddr)
+		a.render.Error(w, r, http.StatusUnauthorized, "invalid username or password")
+		return
+	}
+
+	// Why destroy any existing session first? Issuing a fresh token on login prevents
+	// session fixation, where an attacker plants a known token before the victim logs in.
+	a.sessions.Destroy(w, r)
+	s, err := a.sessions.Create(w, r, creds.Username)
+	if err != nil {
+		a.logger.Printf("error creating session: %v\n", err)
+		a.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	a.logger.Printf("user '%s' logged in from %s\n", s.Username, r.RemoteAddr)
+
+	w.Header().Set("Cache-Control", "no-store")
+	a.render.JSON(w, http.StatusOK, toSessionInfo(s, s.ID))
+}
+
+// LogoutHandler revokes the caller's session and clears the cookie.
+func (a *Authenticator) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	a.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	if err := a.sessions.Destroy(w, r); err != nil {
+		a.logger.Printf("error destroying session: %v\n", err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListSessionsHandler returns the caller's active sessions.
+func (a *Authenticator) ListSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := FromContext(r.Context())
+	if !ok {
+		a.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	sessions, err := a.sessions.List(p.Username)
+	if err != nil {
+		a.logger.Printf("error listing sessions: %v\n", err)
+		a.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	infos := make([]sessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, toSessionInfo(s, p.SessionID))
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	a.render.JSON(w, http.StatusOK, infos)
+}
+
+// RevokeSessionHandler revokes one of the caller's sessions by its public ID.
+func (a *Authenticator) RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := FromContext(r.Context())
+	if !ok {
+		a.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	err := a.sessions.Revoke(r.PathValue("id"), p.Username)
+	if err != nil {
+		if errors.Is(err, session.ErrNotFound) {
+			a.render.Error(w, r, http.StatusNotFound, "session not found")
+			return
+		}
+		a.logger.Printf("error revoking session: %v\n", err)
+		a.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	a.logger.Printf("user '%s' revoked session %s\n", p.Username, r.PathValue("id"))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// toSessionInfo converts a session for output, flagging it if it is the caller's own.
+func toSessionInfo(s session.Session, currentID string) sessionInfo {
+	return sessionInfo{
+		ID:         s.ID,
+		Username:   s.Username,
+		CreatedAt:  s.CreatedAt,
+		LastSeen:   s.LastSeen,
+		RemoteAddr: s.RemoteAddr,
+		UserAgent:  s.UserAgent,
+		Current:    s.ID == currentID,
+	}
+}
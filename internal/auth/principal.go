@@ -0,0 +1,58 @@
+package auth
+
+import (
+	"context"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Principal identifies the authenticated caller of a request.
+type Principal struct {
+	Username string
+	Roles    []string
+	// SessionID is the public ID of the browser session the request was made with,
+	// or empty if the caller authenticated by other means.
+	SessionID string
+	// Permissions, when not nil, grants exactly these permissions instead of those of
+	// the roles. Scoped tokens use it to hand out narrowly limited access.
+	Permissions []string
+	// PathPrefixes, when not empty, confines the caller to files below these prefixes
+	// of the storage directory.
+	PathPrefixes []string
+}
+
+// HasRole reports whether the principal has been assigned the given role.
+func (p *Principal) HasRole(role string) bool {
+	return slices.Contains(p.Roles, role)
+}
+
+// AllowsPath reports whether the principal's path scope covers name, which is relative
+// to the storage directory.
+func (p *Principal) AllowsPath(name string) bool {
+	if len(p.PathPrefixes) == 0 {
+		return true
+	}
+	name = path.Clean("/" + name)
+	for _, prefix := range p.PathPrefixes {
+		prefix = path.Clean("/" + prefix)
+		if prefix == "/" || name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// contextKey is unexported so no other package can collide with or overwrite the principal.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the given principal.
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// FromContext returns the principal attached to ctx, if any.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+	return p, ok
+}
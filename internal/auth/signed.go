@@ -0,0 +1,116 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// SignedURLUser names the principal of requests authorised by a signed URL, so that ACL
+// rules can grant or deny such requests access like any other user. Its colon keeps it apart
+// from every username, which cannot hold one.
+const SignedURLUser = "signed-url:"
+
+// signedURLs verifies download links signed by another application, in the style of nginx's
+// secure_link module: the link carries an expiry time and an HMAC-SHA256 signature of that
+// time followed by the request path, made with a secret shared with the application.
+//
+// Why not issue the links here? The application that decides who may download what already
+// has the secret; the server only has to check its work, without a round trip or shared state.
+type signedURLs struct {
+	secret         []byte
+	prefixes       []string // the paths below which links are accepted
+	expiresParam   string
+	signatureParam string
+}
+
+// newSignedURLs returns a verifier for links below the routes that serve files, or nil if no
+// secret is configured.
+func newSignedURLs(cfg config.SignedURLConfig, basePath string) *signedURLs {
+	if cfg.Secret == "" {
+		return nil
+	}
+	return &signedURLs{
+		secret:         []byte(cfg.Secret),
+		prefixes:       []string{basePath + "/download/", basePath + "/stream/", basePath + "/view/", basePath + "/preview/"},
+		expiresParam:   cfg.ExpiresParam,
+		signatureParam: cfg.SignatureParam,
+	}
+}
+
+// errBadSignature is returned for a link whose signature or expiry time is invalid.
+var errBadSignature = errors.New("invalid signature")
+
+// errExpired is returned for a validly signed link that has expired.
+var errExpired = errors.New("link has expired")
+
+// principal returns the principal for a signed request, or nil if r is not one. A signed
+// link grants downloading the one file it names, and nothing else.
+func (s *signedURLs) principal(r *http.Request) (*Principal, error) {
+	if s == nil {
+		return nil, nil
+	}
+	var name string
+	for _, prefix := range s.prefixes {
+		if rest, ok := strings.CutPrefix(r.URL.Path, prefix); ok {
+			name = rest
+			break
+		}
+	}
+	if name == "" {
+		return nil, nil
+	}
+	query := r.URL.Query()
+	signature := query.Get(s.signatureParam)
+	if signature == "" {
+		return nil, nil
+	}
+	expires := query.Get(s.expiresParam)
+	if !hmac.Equal(decodeSignature(signature), s.sign(expires, r.URL.Path)) {
+		return nil, errBadSignature
+	}
+	// Checked after the signature, so that a tampered expiry time is reported as such.
+	unix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, errBadSignature
+	}
+	if time.Now().Unix() > unix {
+		return nil, errExpired
+	}
+	return &Principal{Username: SignedURLUser, Permissions: []string{"download"}, PathPrefixes: []string{name}}, nil
+}
+
+// sign returns the HMAC-SHA256 of expires followed by path.
+func (s *signedURLs) sign(expires, path string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(expires + path))
+	return mac.Sum(nil)
+}
+
+// decodeSignature accepts the encodings applications commonly produce: base64url without
+// padding (as nginx's secure_link expects), standard base64, or hex. It returns nil for
+// anything else, which never matches.
+func decodeSignature(s string) []byte {
+	if len(s) == hex.EncodedLen(sha256.Size) {
+		if b, err := hex.DecodeString(s); err == nil {
+			return b
+		}
+	}
+	// A "+" that was not percent-encoded arrives as a space.
+	s = strings.TrimRight(strings.ReplaceAll(s, " ", "+"), "=")
+	if b, err := base64.RawURLEncoding.DecodeString(s); err == nil {
+		return b
+	}
+	if b, err := base64.RawStdEncoding.DecodeString(s); err == nil {
+		return b
+	}
+	return nil
+}
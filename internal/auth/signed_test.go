@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/users"
+)
+
+// signLink signs a link as the application sharing the secret does.
+func signLink(secret, expires, path string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(expires + path))
+	return mac.Sum(nil)
+}
+
+func TestSignedURLs(t *testing.T) {
+	s := newSignedURLs(config.SignedURLConfig{Secret: "secret", ExpiresParam: "expires", SignatureParam: "signature"}, "/files")
+	valid := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	path := "/files/download/reports/q3.pdf"
+	sig := signLink("secret", valid, path)
+
+	tests := []struct {
+		desc      string
+		path      string
+		expires   string
+		signature string
+		wantErr   error
+		wantNone  bool // the request is not a signed one
+	}{
+		{"base64url signature", path, valid, base64.RawURLEncoding.EncodeToString(sig), nil, false},
+		{"padded standard base64 signature", path, valid, base64.StdEncoding.EncodeToString(sig), nil, false},
+		{"hex signature", path, valid, hex.EncodeToString(sig), nil, false},
+		{"a stream of the file", "/files/stream/reports/q3.pdf", valid,
+			base64.RawURLEncoding.EncodeToString(signLink("secret", valid, "/files/stream/reports/q3.pdf")), nil, false},
+		{"another route that serves files", "/files/view/reports/q3.pdf", valid,
+			base64.RawURLEncoding.EncodeToString(signLink("secret", valid, "/files/view/reports/q3.pdf")), nil, false},
+		{"expired link", path, past, base64.RawURLEncoding.EncodeToString(signLink("secret", past, path)), errExpired, false},
+		{"expiry time moved", path, strconv.FormatInt(time.Now().Add(48*time.Hour).Unix(), 10),
+			base64.RawURLEncoding.EncodeToString(sig), errBadSignature, false},
+		{"another file", "/files/download/reports/q4.pdf", valid, base64.RawURLEncoding.EncodeToString(sig), errBadSignature, false},
+		{"another secret", path, valid, base64.RawURLEncoding.EncodeToString(signLink("other", valid, path)), errBadSignature, false},
+		{"malformed expiry time", path, "soon", base64.RawURLEncoding.EncodeToString(signLink("secret", "soon", path)), errBadSignature, false},
+		{"garbled signature", path, valid, "!!!", errBadSignature, false},
+		{"no signature", path, valid, "", nil, true},
+		{"a route that does not serve files", "/files/api/delete", valid,
+			base64.RawURLEncoding.EncodeToString(signLink("secret", valid, "/files/api/delete")), nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			query := url.Values{"expires": {tt.expires}}
+			if tt.signature != "" {
+				query.Set("signature", tt.signature)
+			}
+			r := httptest.NewRequest(http.MethodGet, tt.path+"?"+query.Encode(), nil)
+			p, err := s.principal(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("principal: err = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if tt.wantNone {
+				if p != nil {
+					t.Errorf("principal %+v for a request that is not signed", p)
+				}
+				return
+			}
+			if p == nil || p.Username != SignedURLUser {
+				t.Fatalf("principal %+v, want %s", p, SignedURLUser)
+			}
+			// The link grants the one file it names.
+			if !p.AllowsPath("reports/q3.pdf") || p.AllowsPath("reports/q4.pdf") || !slices.Equal(p.Permissions, []string{"download"}) {
+				t.Errorf("principal %+v grants more or less than downloading reports/q3.pdf", p)
+			}
+		})
+	}
+}
+
+func TestSignedURLsDisabled(t *testing.T) {
+	if s := newSignedURLs(config.SignedURLConfig{}, ""); s != nil {
+		t.Fatal("signed URLs are enabled without a secret")
+	}
+	var s *signedURLs
+	if p, err := s.principal(httptest.NewRequest(http.MethodGet, "/download/a.txt?signature=x", nil)); p != nil || err != nil {
+		t.Errorf("principal = %+v, %v without a secret, want neither", p, err)
+	}
+}
+
+// TestSignedURLUserIsNoUsername checks that no user account, created or configured, can take
+// the name of signed URLs' principal, and so be granted what ACL rules allow signed links.
+func TestSignedURLUserIsNoUsername(t *testing.T) {
+	a := newTestAuthenticator(t, config.Default())
+	if _, err := a.users.Create(SignedURLUser, "a password", nil); !errors.Is(err, users.ErrInvalidUsername) {
+		t.Errorf("creating user %q: got error %v, want %v", SignedURLUser, err, users.ErrInvalidUsername)
+	}
+	static := []config.StaticUser{{Username: SignedURLUser, PasswordHash: "$2a$10$x"}}
+	if _, err := users.Open(filepath.Join(t.TempDir(), "users.json"), static); !errors.Is(err, users.ErrInvalidUsername) {
+		t.Errorf("configuring user %q: got error %v, want %v", SignedURLUser, err, users.ErrInvalidUsername)
+	}
+}
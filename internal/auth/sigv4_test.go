@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// TestSigV4Signature checks the signing against the examples AWS publishes.
+func TestSigV4Signature(t *testing.T) {
+	tests := []struct {
+		desc    string
+		req     func() *http.Request
+		secret  string
+		scope   string
+		date    string
+		headers []string
+		payload string
+		want    string
+	}{
+		{
+			"get-vanilla of the SigV4 test suite",
+			func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "http://example.amazonaws.com/", nil)
+				r.Header.Set("X-Amz-Date", "20150830T123600Z")
+				return r
+			},
+			"wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20150830/us-east-1/service/aws4_request", "20150830T123600Z",
+			[]string{"host", "x-amz-date"}, emptyPayloadHash,
+			"5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			"GET object of the S3 documentation",
+			func() *http.Request {
+				r := httptest.NewRequest(http.MethodGet, "http://examplebucket.s3.amazonaws.com/test.txt", nil)
+				r.Header.Set("Range", "bytes=0-9")
+				r.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+				r.Header.Set("X-Amz-Date", "20130524T000000Z")
+				return r
+			},
+			"wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "20130524/us-east-1/s3/aws4_request", "20130524T000000Z",
+			[]string{"host", "range", "x-amz-content-sha256", "x-amz-date"}, emptyPayloadHash,
+			"f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			signed, _ := time.Parse(sigV4TimeFormat, tt.date)
+			sr := &sigV4Request{scope: tt.scope, signedHeaders: tt.headers, time: signed, payloadHash: tt.payload}
+			if got := sigV4Signature(tt.secret, sr, canonicalRequest(tt.req(), sr)); got != tt.want {
+				t.Errorf("signature %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+const (
+	testAccessKey = "AKIDEXAMPLE"
+	testSecret    = "secret"
+)
+
+// signSigV4 signs r as an S3 client does, with the given payload hash and signing time.
+// An empty payload hash leaves out X-Amz-Content-Sha256.
+func signSigV4(r *http.Request, secret, payloadHash string, signed time.Time) {
+	scope := signed.Format("20060102") + "/us-east-1/s3/aws4_request"
+	headers := []string{"host", "x-amz-date"}
+	r.Header.Set("X-Amz-Date", signed.Format(sigV4TimeFormat))
+	sr := &sigV4Request{scope: scope, signedHeaders: headers, time: signed, payloadHash: emptyPayloadHash}
+	if payloadHash != "" {
+		r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+		sr.signedHeaders = append(headers, "x-amz-content-sha256")
+		sr.payloadHash = payloadHash
+	}
+	r.Header.Set("Authorization", sigV4Algorithm+" Credential="+testAccessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(sr.signedHeaders, ";")+", Signature="+sigV4Signature(secret, sr, canonicalRequest(r, sr)))
+}
+
+// presignSigV4 turns r into a presigned URL valid for expires seconds.
+func presignSigV4(r *http.Request, secret string, signed time.Time, expires string) {
+	scope := signed.Format("20060102") + "/us-east-1/s3/aws4_request"
+	q := r.URL.Query()
+	q.Set("X-Amz-Algorithm", sigV4Algorithm)
+	q.Set("X-Amz-Credential", testAccessKey+"/"+scope)
+	q.Set("X-Amz-Date", signed.Format(sigV4TimeFormat))
+	q.Set("X-Amz-Expires", expires)
+	q.Set("X-Amz-SignedHeaders", "host")
+	r.URL.RawQuery = q.Encode()
+	sr := &sigV4Request{scope: scope, signedHeaders: []string{"host"}, time: signed, payloadHash: unsignedPayload, presigned: true}
+	q.Set("X-Amz-Signature", sigV4Signature(secret, sr, canonicalRequest(r, sr)))
+	r.URL.RawQuery = q.Encode()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestLookupSigV4(t *testing.T) {
+	a := &Authenticator{sigV4Keys: newSigV4Keys([]config.SigV4Key{
+		{Name: "backup", AccessKeyID: testAccessKey, SecretAccessKey: testSecret, Roles: []string{"writer"}},
+	})}
+	now := time.Now().UTC()
+
+	tests := []struct {
+		desc    string
+		method  string
+		body    string
+		sign    func(r *http.Request)
+		wantErr bool // the signature is refused
+		badBody bool // the signature is accepted, but reading the body fails
+	}{
+		{"request without a body", http.MethodGet, "",
+			func(r *http.Request) { signSigV4(r, testSecret, "", now) }, false, false},
+		{"body matching its hash", http.MethodPut, "hello",
+			func(r *http.Request) { signSigV4(r, testSecret, sha256Hex("hello"), now) }, false, false},
+		{"unsigned payload", http.MethodPut, "hello",
+			func(r *http.Request) { signSigV4(r, testSecret, unsignedPayload, now) }, false, false},
+		{"body not matching its hash", http.MethodPut, "hellO",
+			func(r *http.Request) { signSigV4(r, testSecret, sha256Hex("hello"), now) }, false, true},
+		{"body declared empty", http.MethodPut, "hello",
+			func(r *http.Request) { signSigV4(r, testSecret, emptyPayloadHash, now) }, false, true},
+		{"body without a payload hash", http.MethodPut, "hello",
+			func(r *http.Request) { signSigV4(r, testSecret, "", now) }, true, false},
+		{"streaming payload", http.MethodPut, "hello",
+			func(r *http.Request) { signSigV4(r, testSecret, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD", now) }, true, false},
+		{"wrong secret", http.MethodGet, "",
+			func(r *http.Request) { signSigV4(r, "other", "", now) }, true, false},
+		{"unknown access key", http.MethodGet, "",
+			func(r *http.Request) {
+				signSigV4(r, testSecret, "", now)
+				r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), testAccessKey, "AKIDOTHER", 1))
+			}, true, false},
+		{"signed too long ago", http.MethodGet, "",
+			func(r *http.Request) { signSigV4(r, testSecret, "", now.Add(-time.Hour)) }, true, false},
+		{"tampered path", http.MethodGet, "",
+			func(r *http.Request) {
+				signSigV4(r, testSecret, "", now)
+				r.URL.Path = "/bucket/other.txt"
+			}, true, false},
+		{"presigned URL", http.MethodGet, "",
+			func(r *http.Request) { presignSigV4(r, testSecret, now, "3600") }, false, false},
+		{"expired presigned URL", http.MethodGet, "",
+			func(r *http.Request) { presignSigV4(r, testSecret, now.Add(-2*time.Hour), "3600") }, true, false},
+		{"presigned URL valid for too long", http.MethodGet, "",
+			func(r *http.Request) { presignSigV4(r, testSecret, now, "700000") }, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://files.example.com/bucket/file.txt", strings.NewReader(tt.body))
+			tt.sign(r)
+			if !isSigV4(r) {
+				t.Fatal("request is not recognised as signed")
+			}
+			p, err := a.lookupSigV4(r)
+			if tt.wantErr {
+				if !errors.Is(err, errSigV4) {
+					t.Fatalf("lookupSigV4: err = %v, want errSigV4", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("lookupSigV4: %v", err)
+			}
+			if p.Username != "sigv4:backup" || !p.HasRole("writer") {
+				t.Errorf("principal %+v, want sigv4:backup with role writer", p)
+			}
+			body, err := io.ReadAll(r.Body)
+			if tt.badBody {
+				if !errors.Is(err, errSigV4) {
+					t.Errorf("reading the body: err = %v, want errSigV4", err)
+				}
+				return
+			}
+			if err != nil || string(body) != tt.body {
+				t.Errorf("body %q (err %v), want %q", body, err, tt.body)
+			}
+		})
+	}
+}
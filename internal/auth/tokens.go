@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/tokens"
+)
+
+// maxTokenLifetime caps how long a minted token may remain valid.
+const maxTokenLifetime = 365 * 24 * time.Hour
+
+// scopablePermissions are the permissions a token may carry. Why not "admin"? Tokens are
+// meant for handing out narrow access; administrative access belongs to named accounts.
+var scopablePermissions = []string{"upload", "download", "delete"}
+
+// tokenInfo is the JSON representation of a token returned to clients. Secret is only
+// populated in the response to the request that created the token.
+type tokenInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	Secret      string    `json:"secret,omitempty"`
+	Prefixes    []string  `json:"prefixes"`
+	Permissions []string  `json:"permissions"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// CreateTokenHandler mints a token limited to path prefixes, permissions and an expiry
+// time. The secret is returned once and cannot be retrieved later. Admin only.
+func (a *Authenticator) CreateTokenHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := FromContext(r.Context())
+	if !ok {
+		a.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	var req struct {
+		Name        string   `json:"name"`
+		Prefixes    []string `json:"prefixes"`
+		Permissions []string `json:"permissions"`
+		ExpiresIn   string   `json:"expiresIn"`
+	}
+	if !a.decodeJSON(w, r, &req) {
+		return
+	}
+
+	if req.Name == "" {
+		a.render.Error(w, r, http.StatusBadRequest, "token name is required")
+		return
+	}
+	// Why require prefixes? A token without any would reach every file, which is too easy to
+	// grant by leaving the list out; "/" grants that on purpose.
+	if len(req.Prefixes) == 0 {
+		a.render.Error(w, r, http.StatusBadRequest, "at least one path prefix is required", "use \"/\" for every file")
+		return
+	}
+	if slices.Contains(req.Prefixes, "") {
+		a.render.Error(w, r, http.StatusBadRequest, "path prefixes must not be empty")
+		return
+	}
+	if len(req.Permissions) == 0 {
+		a.render.Error(w, r, http.StatusBadRequest, "at least one permission is required")
+		return
+	}
+	for _, perm := range req.Permissions {
+		if !slices.Contains(scopablePermissions, perm) {
+			a.render.Error(w, r, http.StatusBadRequest, fmt.Sprintf("permission '%s' cannot be granted to a token", perm))
+			return
+		}
+	}
+	lifetime, err := time.ParseDuration(req.ExpiresIn)
+	if err != nil || lifetime <= 0 || lifetime > maxTokenLifetime {
+		a.render.Error(w, r, http.StatusBadRequest, "expiresIn must be a positive duration of at most 8760h (e.g. \"72h\")")
+		return
+	}
+
+	t, secret, err := a.tokens.Create(tokens.Token{
+		Name:        req.Name,
+		Prefixes:    req.Prefixes,
+		Permissions: req.Permissions,
+		CreatedBy:   p.Username,
+		ExpiresAt:   time.Now().Add(lifetime).UTC(),
+	})
+	if err != nil {
+		a.logger.Printf("error creating token: %v\n", err)
+		a.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	a.logger.Printf("user '%s' created token '%s' (%s) for %v on %v until %s\n",
+		p.Username, t.Name, t.ID, t.Permissions, t.Prefixes, t.ExpiresAt.Format(time.RFC3339))
+
+	info := toTokenInfo(t)
+	info.Secret = secret
+	w.Header().Set("Cache-Control", "no-store")
+	a.render.JSON(w, http.StatusCreated, info)
+}
+
+// ListTokensHandler returns all unexpired tokens without their secrets. Admin only.
+func (a *Authenticator) ListTokensHandler(w http.ResponseWriter, r *http.Request) {
+	list := a.tokens.List()
+	infos := make([]tokenInfo, 0, len(list))
+	for _, t := range list {
+		infos = append(infos, toTokenInfo(t))
+	}
+	a.render.JSON(w, http.StatusOK, infos)
+}
+
+// RevokeTokenHandler deletes a token by ID, invalidating it immediately. Admin only.
+func (a *Authenticator) RevokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := FromContext(r.Context())
+	if !ok {
+		a.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	id := r.PathValue("id")
+	if err := a.tokens.Revoke(id); err != nil {
+		if errors.Is(err, tokens.ErrNotFound) {
+			a.render.Error(w, r, http.StatusNotFound, "token not found")
+			return
+		}
+		a.logger.Printf("error revoking token: %v\n", err)
+		a.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	a.logger.Printf("user '%s' revoked token %s\n", p.Username, id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// toTokenInfo converts a token for output.
+func toTokenInfo(t tokens.Token) tokenInfo {
+	return tokenInfo{
+		ID:          t.ID,
+		Name:        t.Name,
+		Prefixes:    t.Prefixes,
+		Permissions: t.Permissions,
+		CreatedBy:   t.CreatedBy,
+		CreatedAt:   t.CreatedAt,
+		ExpiresAt:   t.ExpiresAt,
+	}
+}
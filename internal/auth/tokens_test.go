@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+	"github.com/mascotmascot1/fileserver/internal/session"
+	"github.com/mascotmascot1/fileserver/internal/tokens"
+	"github.com/mascotmascot1/fileserver/internal/users"
+)
+
+// newTestAuthenticator returns an authenticator for cfg, as the server sets one up, with its
+// users and tokens kept in temporary files and its sessions in memory.
+func newTestAuthenticator(t *testing.T, cfg *config.Config) *Authenticator {
+	t.Helper()
+	dir := t.TempDir()
+	userStore, err := users.Open(filepath.Join(dir, "users.json"), cfg.Auth.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokenStore, err := tokens.Open(filepath.Join(dir, "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.New(io.Discard, "", 0)
+	return NewAuthenticator(cfg, session.NewManager(cfg, session.NewMemoryStore()), userStore, tokenStore, respond.NewRenderer(respond.FormatJSON, logger), logger)
+}
+
+func TestCreateTokenHandler(t *testing.T) {
+	a := newTestAuthenticator(t, config.Default())
+	admin := &Principal{Username: "admin", Roles: []string{"admin"}}
+
+	tests := []struct {
+		desc       string
+		p          *Principal
+		body       string
+		wantStatus int
+	}{
+		{"a token for a directory", admin, `{"name": "ci", "prefixes": ["/builds"], "permissions": ["upload"], "expiresIn": "72h"}`, http.StatusCreated},
+		{"a token for every file", admin, `{"name": "ci", "prefixes": ["/"], "permissions": ["download"], "expiresIn": "72h"}`, http.StatusCreated},
+		{"no caller", nil, `{"name": "ci", "prefixes": ["/builds"], "permissions": ["upload"], "expiresIn": "72h"}`, http.StatusUnauthorized},
+		{"no prefixes", admin, `{"name": "ci", "permissions": ["upload"], "expiresIn": "72h"}`, http.StatusBadRequest},
+		{"an empty prefix list", admin, `{"name": "ci", "prefixes": [], "permissions": ["upload"], "expiresIn": "72h"}`, http.StatusBadRequest},
+		{"an empty prefix", admin, `{"name": "ci", "prefixes": [""], "permissions": ["upload"], "expiresIn": "72h"}`, http.StatusBadRequest},
+		{"no permissions", admin, `{"name": "ci", "prefixes": ["/builds"], "permissions": [], "expiresIn": "72h"}`, http.StatusBadRequest},
+		{"the admin permission", admin, `{"name": "ci", "prefixes": ["/builds"], "permissions": ["admin"], "expiresIn": "72h"}`, http.StatusBadRequest},
+		{"no name", admin, `{"prefixes": ["/builds"], "permissions": ["upload"], "expiresIn": "72h"}`, http.StatusBadRequest},
+		{"a lifetime over a year", admin, `{"name": "ci", "prefixes": ["/builds"], "permissions": ["upload"], "expiresIn": "8761h"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/tokens", strings.NewReader(tt.body))
+			if tt.p != nil {
+				r = r.WithContext(NewContext(r.Context(), tt.p))
+			}
+			w := httptest.NewRecorder()
+			a.CreateTokenHandler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRevokeTokenHandlerWithoutCaller(t *testing.T) {
+	a := newTestAuthenticator(t, config.Default())
+	tok, _, err := a.tokens.Create(tokens.Token{Name: "ci", Prefixes: []string{"/"}, Permissions: []string{"download"}, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodDelete, "/api/tokens/"+tok.ID, nil)
+	r.SetPathValue("id", tok.ID)
+	w := httptest.NewRecorder()
+	a.RevokeTokenHandler(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if len(a.tokens.List()) != 1 {
+		t.Error("token was revoked without a caller")
+	}
+}
+
+// TestTokenScope checks that a token grants exactly its own permissions, below its own
+// prefixes, until it expires.
+func TestTokenScope(t *testing.T) {
+	a := newTestAuthenticator(t, config.Default())
+	tests := []struct {
+		desc        string
+		permissions []string
+		prefixes    []string
+		expiresIn   time.Duration
+		name        string
+		wantValid   bool
+		wantAllowed bool
+	}{
+		{"a file below the prefix", []string{"download"}, []string{"/public"}, time.Hour, "public/a.txt", true, true},
+		{"the prefix itself", []string{"download"}, []string{"/public"}, time.Hour, "public", true, true},
+		{"a prefix given without its slash", []string{"download"}, []string{"public"}, time.Hour, "public/a.txt", true, true},
+		{"a name the prefix only starts", []string{"download"}, []string{"/public"}, time.Hour, "publicity/a.txt", true, false},
+		{"a name leaving the prefix", []string{"download"}, []string{"/public"}, time.Hour, "public/../secret/a.txt", true, false},
+		{"another of several prefixes", []string{"upload", "delete"}, []string{"/public", "/builds"}, time.Hour, "builds/app.tar.gz", true, true},
+		{"every file", []string{"upload"}, []string{"/"}, time.Hour, "secret/a.txt", true, true},
+		{"an expired token", []string{"download"}, []string{"/public"}, -time.Second, "public/a.txt", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, secret, err := a.tokens.Create(tokens.Token{
+				Name:        "test",
+				Prefixes:    tt.prefixes,
+				Permissions: tt.permissions,
+				CreatedBy:   "admin",
+				ExpiresAt:   time.Now().Add(tt.expiresIn),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, ok := a.lookupCredential(secret)
+			if ok != tt.wantValid {
+				t.Fatalf("token valid %v, want %v", ok, tt.wantValid)
+			}
+			if !ok {
+				return
+			}
+			// The token's permissions replace those of any role, its creator's included.
+			if p.Permissions == nil || !slices.Equal(p.Permissions, tt.permissions) || len(p.Roles) > 0 {
+				t.Errorf("token grants permissions %v and roles %v, want exactly %v", p.Permissions, p.Roles, tt.permissions)
+			}
+			if got := p.AllowsPath(tt.name); got != tt.wantAllowed {
+				t.Errorf("AllowsPath(%q) = %v, want %v", tt.name, got, tt.wantAllowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/users"
+)
+
+// userInfo is the JSON representation of a user returned to clients.
+// It deliberately omits the password hash.
+type userInfo struct {
+	Username  string    `json:"username"`
+	Roles     []string  `json:"roles"`
+	Disabled  bool      `json:"disabled"`
+	Static    bool      `json:"static"`
+	CreatedAt time.Time `json:"createdAt,omitzero"`
+	UpdatedAt time.Time `json:"updatedAt,omitzero"`
+}
+
+// ListUsersHandler returns all user accounts. Admin only.
+func (a *Authenticator) ListUsersHandler(w http.ResponseWriter, r *http.Request) {
+	list := a.users.List()
+	infos := make([]userInfo, 0, len(list))
+	for _, u := range list {
+		infos = append(infos, toUserInfo(u))
+	}
+	a.render.JSON(w, http.StatusOK, infos)
+}
+
+// CreateUserHandler creates a user account from a JSON body. Admin only.
+func (a *Authenticator) CreateUserHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := FromContext(r.Context())
+	if !ok {
+		a.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	var req struct {
+		Username string   `json:"username"`
+		Password string   `json:"password"`
+		Roles    []string `json:"roles"`
+	}
+	if !a.decodeJSON(w, r, &req) {
+		return
+	}
+
+	u, err := a.users.Create(req.Username, req.Password, req.Roles)
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	a.logger.Printf("user '%s' created user '%s' with roles %v\n", p.Username, u.Username, u.Roles)
+	a.render.JSON(w, http.StatusCreated, toUserInfo(u))
+}
+
+// UpdateUserHandler changes a user's roles, password or disabled flag. Admin only.
+// Omitted fields are left unchanged. Disabling a user revokes its sessions and the tokens it
+// minted.
+func (a *Authenticator) UpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := FromContext(r.Context())
+	if !ok {
+		a.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	var req struct {
+		Password *string   `json:"password"`
+		Roles    *[]string `json:"roles"`
+		Disabled *bool     `json:"disabled"`
+	}
+	if !a.decodeJSON(w, r, &req) {
+		return
+	}
+
+	username := r.PathValue("username")
+	u, err := a.users.Update(username, func(u *users.User) error {
+		if req.Password != nil {
+			hash, err := users.HashPassword(*req.Password)
+			if err != nil {
+				return err
+			}
+			u.PasswordHash = hash
+		}
+		if req.Roles != nil {
+			u.Roles = *req.Roles
+		}
+		if req.Disabled != nil {
+			u.Disabled = *req.Disabled
+		}
+		return nil
+	})
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+
+	// Why revoke sessions? A reset password or disabled account must lock out
+	// anyone still holding an old session, not just future logins.
+	if req.Password != nil || u.Disabled {
+		if err := a.sessions.RevokeUser(username); err != nil {
+			a.logger.Printf("error revoking sessions of user '%s': %v\n", username, err)
+		}
+	}
+	if u.Disabled {
+		a.revokeTokens(username)
+	}
+	a.logger.Printf("user '%s' updated user '%s'\n", p.Username, username)
+	a.render.JSON(w, http.StatusOK, toUserInfo(u))
+}
+
+// DeleteUserHandler removes a user account, its sessions and the tokens it minted. Admin only.
+func (a *Authenticator) DeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := FromContext(r.Context())
+	if !ok {
+		a.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	username := r.PathValue("username")
+	if err := a.users.Delete(username); err != nil {
+		a.userError(w, r, err)
+		return
+	}
+	if err := a.sessions.RevokeUser(username); err != nil {
+		a.logger.Printf("error revoking sessions of user '%s': %v\n", username, err)
+	}
+	a.revokeTokens(username)
+	a.logger.Printf("user '%s' deleted user '%s'\n", p.Username, username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeTokens revokes the tokens the user username minted, whose access would otherwise
+// outlast the account's.
+func (a *Authenticator) revokeTokens(username string) {
+	n, err := a.tokens.RevokeCreatedBy(username)
+	if err != nil {
+		a.logger.Printf("error revoking tokens of user '%s': %v\n", username, err)
+		return
+	}
+	if n > 0 {
+		a.logger.Printf("revoked %d token(s) of user '%s'\n", n, username)
+	}
+}
+
+// ChangePasswordHandler lets the caller change their own password after confirming
+// the current one. All of the caller's other sessions are revoked.
+func (a *Authenticator) ChangePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := FromContext(r.Context())
+	if !ok {
+		a.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"currentPassword"`
+		NewPassword     string `json:"newPassword"`
+	}
+	if !a.decodeJSON(w, r, &req) {
+		return
+	}
+	if _, ok := a.users.Authenticate(p.Username, req.CurrentPassword); !ok {
+		a.render.Error(w, r, http.StatusForbidden, "current password is incorrect")
+		return
+	}
+
+	_, err := a.users.Update(p.Username, func(u *users.User) error {
+		hash, err := users.HashPassword(req.NewPassword)
+		if err != nil {
+			return err
+		}
+		u.PasswordHash = hash
+		return nil
+	})
+	if err != nil {
+		a.userError(w, r, err)
+		return
+	}
+
+	sessions, err := a.sessions.List(p.Username)
+	if err != nil {
+		a.logger.Printf("error listing sessions of user '%s': %v\n", p.Username, err)
+	}
+	for _, s := range sessions {
+		if s.ID != p.SessionID {
+			a.sessions.Revoke(s.ID, p.Username)
+		}
+	}
+	a.logger.Printf("user '%s' changed their password\n", p.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decodeJSON decodes a bounded JSON request body into v, rendering an error on failure.
+func (a *Authenticator) decodeJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxJSONBodySize)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		a.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return false
+	}
+	return true
+}
+
+// userError maps a users package error to an HTTP error response.
+func (a *Authenticator) userError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, users.ErrNotFound):
+		a.render.Error(w, r, http.StatusNotFound, err.Error())
+	case errors.Is(err, users.ErrExists):
+		a.render.Error(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, users.ErrStatic):
+		a.render.Error(w, r, http.StatusConflict, err.Error())
+	case errors.Is(err, users.ErrInvalidUsername), errors.Is(err, users.ErrInvalidPassword):
+		a.render.Error(w, r, http.StatusBadRequest, err.Error())
+	default:
+		a.logger.Printf("error updating users: %v\n", err)
+		a.render.Error(w, r, http.StatusInternalServerError, "internal error")
+	}
+}
+
+// toUserInfo converts a user for output.
+func toUserInfo(u users.User) userInfo {
+	return userInfo{
+		Username:  u.Username,
+		Roles:     u.Roles,
+		Disabled:  u.Disabled,
+		Static:    u.Static,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+	}
+}
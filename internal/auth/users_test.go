@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/session"
+	"github.com/mascotmascot1/fileserver/internal/tokens"
+)
+
+// login starts a session for username, as LoginHandler does, and returns its cookie and
+// the session.
+func login(t *testing.T, a *Authenticator, username string) (*http.Cookie, session.Session) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s, err := a.sessions.Create(w, httptest.NewRequest(http.MethodPost, "/login", nil), username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()[0], s
+}
+
+// authenticated returns the principal Middleware attaches to a request with cookie, if any.
+func authenticated(a *Authenticator, cookie *http.Cookie) (*Principal, bool) {
+	var p *Principal
+	var ok bool
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok = FromContext(r.Context())
+	})).ServeHTTP(httptest.NewRecorder(), r)
+	return p, ok
+}
+
+func TestChangePasswordHandler(t *testing.T) {
+	tests := []struct {
+		desc       string
+		caller     bool
+		body       string
+		wantStatus int
+	}{
+		{"the current password", true, `{"currentPassword": "old password", "newPassword": "new password"}`, http.StatusNoContent},
+		{"a wrong current password", true, `{"currentPassword": "wrong password", "newPassword": "new password"}`, http.StatusForbidden},
+		{"a new password too short", true, `{"currentPassword": "old password", "newPassword": "short"}`, http.StatusBadRequest},
+		{"no caller", false, `{"currentPassword": "old password", "newPassword": "new password"}`, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			a := newTestAuthenticator(t, config.Default())
+			if _, err := a.users.Create("alice", "old password", []string{"uploader"}); err != nil {
+				t.Fatal(err)
+			}
+			current, s := login(t, a, "alice")
+			other, _ := login(t, a, "alice")
+
+			r := httptest.NewRequest(http.MethodPut, "/api/me/password", strings.NewReader(tt.body))
+			if tt.caller {
+				r = r.WithContext(NewContext(r.Context(), &Principal{Username: "alice", Roles: []string{"uploader"}, SessionID: s.ID}))
+			}
+			w := httptest.NewRecorder()
+			a.ChangePasswordHandler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+
+			changed := tt.wantStatus == http.StatusNoContent
+			if _, ok := a.users.Authenticate("alice", "old password"); ok == changed {
+				t.Errorf("old password accepted %v, want %v", ok, !changed)
+			}
+			if _, ok := a.users.Authenticate("alice", "new password"); ok != changed {
+				t.Errorf("new password accepted %v, want %v", ok, changed)
+			}
+			// The session the password was changed from is kept, and every other one ends.
+			if _, ok := authenticated(a, current); !ok {
+				t.Error("the caller's own session was revoked")
+			}
+			if _, ok := authenticated(a, other); ok == changed {
+				t.Errorf("another session kept %v, want %v", ok, !changed)
+			}
+		})
+	}
+}
+
+// TestDisableUser disables a user, who may no longer log in, whose sessions end and whose
+// tokens are revoked, leaving other users' alone.
+func TestDisableUser(t *testing.T) {
+	for _, disable := range []string{"disable", "delete"} {
+		t.Run(disable, func(t *testing.T) {
+			a := newTestAuthenticator(t, config.Default())
+			for _, name := range []string{"alice", "bob"} {
+				if _, err := a.users.Create(name, "a password", []string{"admin"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			aliceSession, _ := login(t, a, "alice")
+			bobSession, _ := login(t, a, "bob")
+			mint := func(createdBy string) string {
+				_, secret, err := a.tokens.Create(tokens.Token{Name: "ci", Prefixes: []string{"/"}, Permissions: []string{"upload"}, CreatedBy: createdBy, ExpiresAt: time.Now().Add(time.Hour)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return secret
+			}
+			aliceToken, bobToken := mint("alice"), mint("bob")
+
+			var r *http.Request
+			w := httptest.NewRecorder()
+			if disable == "disable" {
+				r = httptest.NewRequest(http.MethodPatch, "/api/users/alice", strings.NewReader(`{"disabled": true}`))
+				r.SetPathValue("username", "alice")
+				r = r.WithContext(NewContext(r.Context(), &Principal{Username: "bob", Roles: []string{"admin"}}))
+				a.UpdateUserHandler(w, r)
+			} else {
+				r = httptest.NewRequest(http.MethodDelete, "/api/users/alice", nil)
+				r.SetPathValue("username", "alice")
+				r = r.WithContext(NewContext(r.Context(), &Principal{Username: "bob", Roles: []string{"admin"}}))
+				a.DeleteUserHandler(w, r)
+			}
+			if w.Code >= 300 {
+				t.Fatalf("got status %d %s", w.Code, w.Body)
+			}
+
+			r = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{"username": "alice", "password": "a password"}`))
+			r.Header.Set("Content-Type", "application/json")
+			w = httptest.NewRecorder()
+			a.LoginHandler(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("login got status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if _, ok := authenticated(a, aliceSession); ok {
+				t.Error("the user's session still authenticates")
+			}
+			if _, ok := a.lookupCredential(aliceToken); ok {
+				t.Error("the user's token still authenticates")
+			}
+			if _, ok := authenticated(a, bobSession); !ok {
+				t.Error("another user's session was revoked")
+			}
+			if _, ok := a.lookupCredential(bobToken); !ok {
+				t.Error("another user's token was revoked")
+			}
+		})
+	}
+}
+
+func TestUserHandlersWithoutCaller(t *testing.T) {
+	a := newTestAuthenticator(t, config.Default())
+	if _, err := a.users.Create("alice", "a password", nil); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		desc    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+	}{
+		{"create", a.CreateUserHandler, http.MethodPost, `{"username": "bob", "password": "a password"}`},
+		{"update", a.UpdateUserHandler, http.MethodPatch, `{"disabled": true}`},
+		{"delete", a.DeleteUserHandler, http.MethodDelete, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/users/alice", strings.NewReader(tt.body))
+			r.SetPathValue("username", "alice")
+			w := httptest.NewRecorder()
+			tt.handler(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+		})
+	}
+	if u, err := a.users.Get("alice"); err != nil || u.Disabled {
+		t.Errorf("user changed without a caller: %+v, %v", u, err)
+	}
+}
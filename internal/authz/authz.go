@@ -0,0 +1,112 @@
+package authz
+
+import (
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// Permission is a single capability that a role can grant.
+type Permission string
+
+// The permissions understood by the server.
+const (
+	PermUpload   Permission = "upload"
+	PermDownload Permission = "download"
+	PermDelete   Permission = "delete"
+	PermAdmin    Permission = "admin"
+)
+
+// defaultRoles are the built-in roles. The configuration may redefine them or add new ones.
+var defaultRoles = map[string][]Permission{
+	"admin":    {PermUpload, PermDownload, PermDelete, PermAdmin},
+	"uploader": {PermUpload},
+	"viewer":   {PermDownload},
+}
+
+// Authorizer is the central authorisation component: it resolves a principal's roles into
+// permissions and guards routes that require them.
+type Authorizer struct {
+	roles       map[string]map[Permission]bool
+	defaults    map[Permission]bool
+	anonymousOK bool
+	render      *respond.Renderer
+	logger      *log.Logger
+}
+
+// New creates an Authorizer from the application configuration.
+func New(cfg *config.Config, render *respond.Renderer, logger *log.Logger) *Authorizer {
+	a := &Authorizer{
+		roles:       make(map[string]map[Permission]bool),
+		defaults:    toSet(cfg.RBAC.DefaultPermissions),
+		anonymousOK: !cfg.Auth.Required,
+		render:      render,
+		logger:      logger,
+	}
+	for name, perms := range defaultRoles {
+		a.roles[name] = make(map[Permission]bool, len(perms))
+		for _, perm := range perms {
+			a.roles[name][perm] = true
+		}
+	}
+	for name, perms := range cfg.RBAC.Roles {
+		a.roles[name] = toSet(perms)
+	}
+	return a
+}
+
+// Can reports whether p holds perm. p may be nil for anonymous callers.
+//
+// Scoped callers (e.g. tokens) hold exactly their listed permissions. Callers with roles
+// receive the union of their roles' permissions. Callers without any role (including
+// anonymous ones, unless authentication is required) receive the default permissions,
+// which keeps a server without RBAC configuration behaving as before.
+func (a *Authorizer) Can(p *auth.Principal, perm Permission) bool {
+	if p == nil {
+		return a.anonymousOK && a.defaults[perm]
+	}
+	if p.Permissions != nil {
+		return slices.Contains(p.Permissions, string(perm))
+	}
+	if len(p.Roles) == 0 {
+		return a.defaults[perm]
+	}
+	for _, role := range p.Roles {
+		if a.roles[role][perm] {
+			return true
+		}
+	}
+	return false
+}
+
+// Require wraps a handler so it is only reachable by callers holding perm.
+// Anonymous callers are told to authenticate (401); authenticated callers lacking
+// the permission are refused (403).
+func (a *Authorizer) Require(perm Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, _ := auth.FromContext(r.Context())
+		if a.Can(p, perm) {
+			next(w, r)
+			return
+		}
+		if p == nil {
+			a.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		a.logger.Printf("user '%s' denied '%s' permission for %s %s\n", p.Username, perm, r.Method, r.URL.Path)
+		a.render.Error(w, r, http.StatusForbidden, "insufficient permissions")
+	}
+}
+
+// toSet converts a list of permission names to a lookup set.
+func toSet(perms []string) map[Permission]bool {
+	set := make(map[Permission]bool, len(perms))
+	for _, perm := range perms {
+		set[Permission(perm)] = true
+	}
+	return set
+}
@@ -0,0 +1,127 @@
+package authz
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+func newTestAuthorizer(cfg *config.Config) *Authorizer {
+	logger := log.New(io.Discard, "", 0)
+	return New(cfg, respond.NewRenderer(respond.FormatJSON, logger), logger)
+}
+
+// TestCan checks what each kind of caller may do where. Path prefixes confine the caller
+// through its principal, which the ACL consults, so both are checked as the handlers do.
+func TestCan(t *testing.T) {
+	cfg := config.Default()
+	cfg.RBAC.Roles = map[string][]string{"editor": {"upload", "download"}}
+	a := newTestAuthorizer(cfg)
+	rules := acl.New(nil)
+
+	var anonymous *auth.Principal
+	plain := &auth.Principal{Username: "bob"}
+	viewer := &auth.Principal{Username: "vera", Roles: []string{"viewer"}}
+	uploader := &auth.Principal{Username: "ulla", Roles: []string{"uploader"}}
+	admin := &auth.Principal{Username: "ada", Roles: []string{"admin"}}
+	editor := &auth.Principal{Username: "ed", Roles: []string{"editor"}}
+	both := &auth.Principal{Username: "bo", Roles: []string{"viewer", "uploader"}}
+	unknown := &auth.Principal{Username: "gus", Roles: []string{"ghost"}}
+	token := &auth.Principal{Username: "token:ci", Permissions: []string{"download"}, PathPrefixes: []string{"/public"}}
+	empty := &auth.Principal{Username: "token:none", Permissions: []string{}}
+	scopedAdmin := &auth.Principal{Username: "ada", Roles: []string{"admin"}, PathPrefixes: []string{"/team"}}
+
+	tests := []struct {
+		desc string
+		p    *auth.Principal
+		perm Permission
+		name string
+		want bool
+	}{
+		{"anonymous callers get the defaults", anonymous, PermUpload, "a.txt", true},
+		{"anonymous callers cannot delete", anonymous, PermDelete, "a.txt", false},
+		{"callers without roles get the defaults", plain, PermDownload, "a.txt", true},
+		{"callers without roles cannot administer", plain, PermAdmin, "a.txt", false},
+		{"viewers download", viewer, PermDownload, "a.txt", true},
+		{"viewers cannot upload", viewer, PermUpload, "a.txt", false},
+		{"uploaders upload", uploader, PermUpload, "a.txt", true},
+		{"uploaders cannot download", uploader, PermDownload, "a.txt", false},
+		{"admins delete", admin, PermDelete, "a.txt", true},
+		{"admins administer", admin, PermAdmin, "a.txt", true},
+		{"configured roles grant their permissions", editor, PermUpload, "a.txt", true},
+		{"configured roles grant no others", editor, PermDelete, "a.txt", false},
+		{"several roles grant the union", both, PermDownload, "a.txt", true},
+		{"several roles grant nothing beyond it", both, PermDelete, "a.txt", false},
+		{"unknown roles grant nothing", unknown, PermDownload, "a.txt", false},
+		{"tokens grant their permissions below their prefixes", token, PermDownload, "public/a.txt", true},
+		{"tokens grant nothing outside their prefixes", token, PermDownload, "private/a.txt", false},
+		{"tokens grant no other permissions", token, PermUpload, "public/a.txt", false},
+		{"tokens without permissions grant nothing", empty, PermDownload, "a.txt", false},
+		{"prefixes confine callers with roles too", scopedAdmin, PermDelete, "other/a.txt", false},
+		{"prefixed callers keep their roles inside", scopedAdmin, PermDelete, "team/a.txt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			op := acl.Read
+			if tt.perm == PermUpload || tt.perm == PermDelete {
+				op = acl.Write
+			}
+			if got := a.Can(tt.p, tt.perm) && rules.Allowed(tt.p, op, tt.name); got != tt.want {
+				t.Errorf("%s on %s = %v, want %v", tt.perm, tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanWithAuthRequired(t *testing.T) {
+	cfg := config.Default()
+	cfg.Auth.Required = true
+	a := newTestAuthorizer(cfg)
+	for _, perm := range []Permission{PermUpload, PermDownload, PermDelete, PermAdmin} {
+		if a.Can(nil, perm) {
+			t.Errorf("anonymous callers hold %s with authentication required", perm)
+		}
+	}
+	if !a.Can(&auth.Principal{Username: "bob"}, PermDownload) {
+		t.Error("authenticated callers without roles lost the default permissions")
+	}
+}
+
+func TestRequire(t *testing.T) {
+	cfg := config.Default()
+	cfg.Auth.Required = true
+	a := newTestAuthorizer(cfg)
+	handler := a.Require(PermDelete, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		desc       string
+		p          *auth.Principal
+		wantStatus int
+	}{
+		{"anonymous caller", nil, http.StatusUnauthorized},
+		{"caller lacking the permission", &auth.Principal{Username: "vera", Roles: []string{"viewer"}}, http.StatusForbidden},
+		{"caller holding the permission", &auth.Principal{Username: "ada", Roles: []string{"admin"}}, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodDelete, "/api/files/a.txt", nil)
+			if tt.p != nil {
+				r = r.WithContext(auth.NewContext(r.Context(), tt.p))
+			}
+			w := httptest.NewRecorder()
+			handler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
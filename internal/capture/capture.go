@@ -0,0 +1,406 @@
+// Package capture records the headers of a sample of requests, with a summary of each part of
+// their multipart bodies, in a ring buffer the admin API shows, for troubleshooting clients
+// that upload in ways the server does not expect.
+package capture
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/clientip"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// maxParts is the number of parts recorded of one body; those beyond are only counted.
+const maxParts = 100
+
+// maxSettingsBodySize is the maximum size of the body of a request to change the settings.
+const maxSettingsBodySize = 64 << 10
+
+// redacted replaces the values of credentials.
+const redacted = "<redacted>"
+
+// Settings decide which requests are captured.
+type Settings struct {
+	Enabled bool `json:"enabled"`
+	// SampleRate is the share of requests captured, from 0 to 1.
+	SampleRate float64 `json:"sampleRate"`
+	// Paths, if not empty, limits capturing to requests for paths starting with one of them.
+	Paths []string `json:"paths"`
+}
+
+// Part summarises one part of a multipart body.
+type Part struct {
+	Name        string               `json:"name"`
+	Filename    string               `json:"filename,omitempty"`
+	ContentType string               `json:"contentType,omitempty"`
+	Size        int64                `json:"size"`
+	Headers     textproto.MIMEHeader `json:"headers"`
+}
+
+// Capture records one request and the response to it.
+type Capture struct {
+	ID       int64       `json:"id"`
+	Time     time.Time   `json:"time"`
+	Client   string      `json:"client"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Proto    string      `json:"proto"`
+	Host     string      `json:"host"`
+	Headers  http.Header `json:"headers"`
+	Status   int         `json:"status"`
+	Duration float64     `json:"durationSeconds"`
+	// BodyRead is the number of bytes of the body the server read, which is less than its
+	// Content-Length if the request was refused before it was read to the end.
+	BodyRead        int64       `json:"bodyRead"`
+	ResponseHeaders http.Header `json:"responseHeaders"`
+	// Parts summarise the parts of a multipart body, as far as it was read, and PartsError
+	// says why the rest could not be, such as a missing closing boundary.
+	Parts        []Part `json:"parts,omitempty"`
+	PartsOmitted int    `json:"partsOmitted,omitempty"`
+	PartsError   string `json:"partsError,omitempty"`
+}
+
+// Recorder captures a sample of requests into a ring buffer. It is created whether capturing
+// is enabled or not, so that an admin can turn it on without a restart.
+//
+// Why not keep captures on disk? They are for watching a misbehaving client whilst it
+// misbehaves, and headers are better not left lying around afterwards.
+type Recorder struct {
+	settings   atomic.Pointer[Settings]
+	secretHdrs []string
+	mu         sync.Mutex
+	ring       []Capture // capture n at ring[(n-1) % len(ring)]
+	next       int64     // the ID of the next capture
+	render     *respond.Renderer
+	logger     *log.Logger
+}
+
+// New returns a recorder configured by cfg. secretHeaders are redacted in addition to the
+// usual credentials, such as the configured CSRF header.
+func New(cfg config.DebugCaptureConfig, secretHeaders []string, render *respond.Renderer, logger *log.Logger) (*Recorder, error) {
+	if cfg.Size <= 0 {
+		return nil, errors.New("debugCapture.size must be positive")
+	}
+	s := Settings{Enabled: cfg.Enabled, SampleRate: cfg.SampleRate, Paths: cfg.Paths}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	rec := &Recorder{
+		secretHdrs: append([]string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-API-Key"}, secretHeaders...),
+		ring:       make([]Capture, cfg.Size),
+		next:       1,
+		render:     render,
+		logger:     logger,
+	}
+	rec.settings.Store(&s)
+	return rec, nil
+}
+
+func (s *Settings) validate() error {
+	if s.SampleRate < 0 || s.SampleRate > 1 {
+		return errors.New("debugCapture.sampleRate must be between 0 and 1")
+	}
+	for _, p := range s.Paths {
+		if !strings.HasPrefix(p, "/") {
+			return errors.New("debugCapture.paths must start with a slash")
+		}
+	}
+	return nil
+}
+
+// sampled reports whether r is to be captured.
+func (rec *Recorder) sampled(r *http.Request) bool {
+	s := rec.settings.Load()
+	if !s.Enabled || s.SampleRate <= 0 {
+		return false
+	}
+	if len(s.Paths) > 0 {
+		matched := false
+		for _, p := range s.Paths {
+			if strings.HasPrefix(r.URL.Path, p) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return s.SampleRate >= 1 || rand.Float64() < s.SampleRate
+}
+
+// Middleware captures the requests sampled. It must run after the client's address is known.
+func (rec *Recorder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rec.sampled(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		c := Capture{
+			Time:    time.Now(),
+			Client:  clientip.Addr(r).String(),
+			Method:  r.Method,
+			URL:     rec.redactURL(r.URL),
+			Proto:   r.Proto,
+			Host:    r.Host,
+			Headers: rec.redactHeaders(r.Header),
+		}
+		tap := &bodyTap{ReadCloser: r.Body}
+		var parts chan partSummary
+		if boundary := multipartBoundary(r); boundary != "" {
+			pr, pw := io.Pipe()
+			tap.pw = pw
+			parts = make(chan partSummary, 1)
+			go summariseParts(pr, boundary, parts)
+		}
+		r.Body = tap
+		sw := &statusRecorder{ResponseWriter: w}
+
+		// Why record after a panic too? A request that crashes a handler is as worth seeing as
+		// any; the panic carries on to the recoverer outside.
+		defer func() {
+			c.Duration = time.Since(c.Time).Seconds()
+			c.Status = sw.status
+			c.BodyRead = tap.read
+			c.ResponseHeaders = rec.redactHeaders(w.Header())
+			if parts != nil {
+				if tap.eof {
+					tap.pw.Close()
+				} else {
+					tap.pw.CloseWithError(errUnread)
+				}
+				s := <-parts
+				c.Parts, c.PartsOmitted = s.parts, s.omitted
+				if s.err != nil {
+					c.PartsError = s.err.Error()
+				}
+			}
+			rec.add(c)
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// errUnread ends the summary of a body the server did not read to the end.
+var errUnread = errors.New("the rest of the body was not read")
+
+// add stores c, overwriting the oldest capture once the ring is full.
+func (rec *Recorder) add(c Capture) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	c.ID = rec.next
+	rec.ring[(rec.next-1)%int64(len(rec.ring))] = c
+	rec.next++
+}
+
+// captures returns the captures held, newest first.
+func (rec *Recorder) captures() []Capture {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	n := min(rec.next-1, int64(len(rec.ring)))
+	list := make([]Capture, 0, n)
+	for id := rec.next - 1; id > rec.next-1-n; id-- {
+		list = append(list, rec.ring[(id-1)%int64(len(rec.ring))])
+	}
+	return list
+}
+
+// redactHeaders returns a copy of h with the values of credentials replaced. The scheme of an
+// Authorization header is kept, as a client sending the wrong one is a common fault.
+func (rec *Recorder) redactHeaders(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range rec.secretHdrs {
+		values := out.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		hidden := make([]string, len(values))
+		for i, v := range values {
+			hidden[i] = redacted
+			if scheme, _, ok := strings.Cut(v, " "); ok && strings.HasSuffix(name, "Authorization") {
+				hidden[i] = scheme + " " + redacted
+			}
+		}
+		out[textproto.CanonicalMIMEHeaderKey(name)] = hidden
+	}
+	return out
+}
+
+// redactURL returns u as requested, with the values of query parameters that look like
+// credentials, such as the signature of a signed link, replaced.
+func (rec *Recorder) redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.RequestURI()
+	}
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return u.EscapedPath() + "?" + redacted
+	}
+	for name, values := range query {
+		lower := strings.ToLower(name)
+		for _, secret := range []string{"signature", "token", "key", "credential", "password"} {
+			if strings.Contains(lower, secret) {
+				for i := range values {
+					values[i] = redacted
+				}
+				break
+			}
+		}
+	}
+	// The placeholder is left unescaped, so that it reads the same as in the headers.
+	return u.EscapedPath() + "?" + strings.ReplaceAll(query.Encode(), url.QueryEscape(redacted), redacted)
+}
+
+// multipartBoundary returns the boundary of r's body if it is multipart, or "".
+func multipartBoundary(r *http.Request) string {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// partSummary is the outcome of summariseParts.
+type partSummary struct {
+	parts   []Part
+	omitted int
+	err     error
+}
+
+// summariseParts reads the multipart body from r, as the handler reads it, and sends a summary
+// of its parts on done.
+func summariseParts(r *io.PipeReader, boundary string, done chan<- partSummary) {
+	var s partSummary
+	mr := multipart.NewReader(r, boundary)
+	for {
+		// Why raw parts? A client's Content-Transfer-Encoding is among the things worth
+		// seeing, so the parts are measured as sent rather than decoded.
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			s.err = err
+			break
+		}
+		n, err := io.Copy(io.Discard, p)
+		if len(s.parts) < maxParts {
+			s.parts = append(s.parts, Part{
+				Name:        p.FormName(),
+				Filename:    p.FileName(),
+				ContentType: p.Header.Get("Content-Type"),
+				Size:        n,
+				Headers:     p.Header,
+			})
+		} else {
+			s.omitted++
+		}
+		if err != nil {
+			s.err = err
+			break
+		}
+	}
+	// The handler's reads must never wait on a summary that has stopped.
+	io.Copy(io.Discard, r)
+	done <- s
+}
+
+// bodyTap counts the bytes of a body read by the handler, and copies them to pw, if set.
+type bodyTap struct {
+	io.ReadCloser
+	pw   *io.PipeWriter
+	read int64
+	eof  bool
+}
+
+func (t *bodyTap) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.read += int64(n)
+	if t.pw != nil && n > 0 {
+		t.pw.Write(p[:n])
+	}
+	if err == io.EOF {
+		t.eof = true
+	}
+	return n, err
+}
+
+// statusRecorder captures the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusRecorder) WriteHeader(status int) {
+	if sw.status == 0 && status >= 200 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusRecorder) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (sw *statusRecorder) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// ListHandler returns the captures held, newest first. Admin only.
+func (rec *Recorder) ListHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	rec.render.JSON(w, http.StatusOK, rec.captures())
+}
+
+// ClearHandler discards the captures held. Admin only.
+func (rec *Recorder) ClearHandler(w http.ResponseWriter, r *http.Request) {
+	rec.mu.Lock()
+	clear(rec.ring)
+	rec.next = 1
+	rec.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SettingsHandler returns the settings in force. Admin only.
+func (rec *Recorder) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	rec.render.JSON(w, http.StatusOK, rec.settings.Load())
+}
+
+// UpdateSettingsHandler replaces the settings until the next restart, which returns to those
+// configured. Fields left out of the body keep their values. Admin only.
+func (rec *Recorder) UpdateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	s := *rec.settings.Load()
+	r.Body = http.MaxBytesReader(w, r.Body, maxSettingsBodySize)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&s); err != nil {
+		rec.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return
+	}
+	if err := s.validate(); err != nil {
+		rec.render.Error(w, r, http.StatusBadRequest, "invalid settings", err.Error())
+		return
+	}
+	rec.settings.Store(&s)
+	rec.logger.Printf("debug capture set to enabled=%t sampleRate=%g paths=%q by %s\n", s.Enabled, s.SampleRate, s.Paths, r.RemoteAddr)
+	rec.render.JSON(w, http.StatusOK, &s)
+}
@@ -0,0 +1,36 @@
+// Package cdn supports a CDN in front of the server: it issues the signed cookies with which
+// CloudFront or Akamai serve the files below a protected prefix only to those allowed to read
+// them, and asks Cloudflare, Fastly or a webhook to purge the copies of files that changed.
+//
+// Why is this needed with Cache-Control alone? A CDN cannot ask this server who may read a
+// file, so without signed cookies protected files could not be cached at all; and files that
+// change would be served stale until their copies expired.
+package cdn
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// routes are the routes that serve a stored file, under each of which a CDN may cache it.
+var routes = []string{"/download/", "/stream/", "/view/"}
+
+// parseBase validates the CDN URL that paths are appended to, and returns it without a
+// trailing slash.
+func parseBase(raw string) (string, *url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || u.RawQuery != "" {
+		return "", nil, fmt.Errorf("invalid cdn url %q: must be an http(s) URL without a query", raw)
+	}
+	return strings.TrimSuffix(raw, "/"), u, nil
+}
+
+// escapePath escapes each segment of a storage path for use in a URL, keeping the slashes.
+func escapePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,290 @@
+package cdn
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/filemeta"
+)
+
+const (
+	// cloudflareAPI is the Cloudflare API endpoint purge requests are sent to.
+	cloudflareAPI = "https://api.cloudflare.com/client/v4"
+	// fastlyAPI is the Fastly API endpoint purge requests are sent to.
+	fastlyAPI = "https://api.fastly.com"
+	// cloudflareBatch is the most URLs Cloudflare purges in one request on every plan.
+	cloudflareBatch = 30
+	// requestTimeout bounds each request to a provider.
+	requestTimeout = 30 * time.Second
+)
+
+// provider is a CDN that purges cached URLs.
+type provider interface {
+	name() string
+	purge(ctx context.Context, urls []string) error
+}
+
+// Purger sends purge requests to the configured CDNs.
+type Purger struct {
+	base      string
+	providers []provider
+	logger    *log.Logger
+
+	// ctx is cancelled by Close, to stop Watch and the purges it sent.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Result is the outcome of a purge with one provider.
+type Result struct {
+	Provider string `json:"provider"`
+	Error    string `json:"error,omitempty"`
+}
+
+// NewPurger validates the purge settings of cfg, and returns nil if there are none.
+func NewPurger(cfg config.CDNConfig, logger *log.Logger) (*Purger, error) {
+	if len(cfg.Purge) == 0 {
+		return nil, nil
+	}
+	base, _, err := parseBase(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	p := &Purger{base: base, logger: logger}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	client := &http.Client{Timeout: requestTimeout}
+	for _, pc := range cfg.Purge {
+		var pr provider
+		switch pc.Provider {
+		case "cloudflare":
+			if pc.ZoneID == "" || pc.Token == "" {
+				return nil, errors.New("cloudflare purging needs a zoneID and a token")
+			}
+			pr = &cloudflare{zone: pc.ZoneID, token: pc.Token, client: client}
+		case "fastly":
+			if pc.Token == "" {
+				return nil, errors.New("fastly purging needs a token")
+			}
+			pr = &fastly{token: pc.Token, client: client}
+		case "webhook":
+			if u, err := url.Parse(pc.URL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+				return nil, errors.New("webhook purging needs an http(s) url")
+			}
+			pr = &webhook{url: pc.URL, client: client}
+		default:
+			return nil, fmt.Errorf("invalid cdn purge provider %q: must be cloudflare, fastly or webhook", pc.Provider)
+		}
+		p.providers = append(p.providers, pr)
+	}
+	return p, nil
+}
+
+// URLs returns the CDN URLs at which the stored files names may be cached.
+func (p *Purger) URLs(names []string) []string {
+	urls := make([]string, 0, len(names)*len(routes))
+	for _, name := range names {
+		for _, r := range routes {
+			urls = append(urls, p.base+r+escapePath(name))
+		}
+	}
+	return urls
+}
+
+// Purge asks every provider to drop its copies of the stored files names, and returns the
+// outcome for each.
+func (p *Purger) Purge(ctx context.Context, names []string) []Result {
+	urls := p.URLs(names)
+	results := make([]Result, 0, len(p.providers))
+	for _, pr := range p.providers {
+		res := Result{Provider: pr.name()}
+		if err := pr.purge(ctx, urls); err != nil {
+			res.Error = err.Error()
+		}
+		results = append(results, res)
+	}
+	return results
+}
+
+// Watch starts purging the files that the change feed of store reports changed, every
+// interval, until the purger is closed. Failures are logged and not retried, as the copies
+// expire in time all the same.
+//
+// Why follow the change feed? Files change through a great many routes, as well as on disk
+// behind the server's back, and the feed is where all of them are recorded.
+func (p *Purger) Watch(store *filemeta.Store, interval time.Duration) {
+	if p == nil {
+		return
+	}
+	p.wg.Go(func() { p.watch(store, interval) })
+}
+
+// Close stops Watch, cancelling the purges in progress, and waits for it to return.
+func (p *Purger) Close() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+}
+
+// watch is the loop of Watch.
+func (p *Purger) watch(store *filemeta.Store, interval time.Duration) {
+	cursor := store.LatestChange()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		var names []string
+		seen := make(map[string]bool)
+		for {
+			changes, next, ok := store.Changes(cursor, 1000)
+			if !ok {
+				// The feed was lost or has moved on past the cursor: the changes missed can no
+				// longer be told, so carry on from now.
+				p.logger.Printf("warn: missed changes to purge from the CDN\n")
+				cursor = store.LatestChange()
+				break
+			}
+			for _, c := range changes {
+				for _, name := range []string{c.Path, c.From} {
+					if name != "" && !seen[name] {
+						seen[name] = true
+						names = append(names, name)
+					}
+				}
+			}
+			cursor = next
+			if len(changes) < 1000 {
+				break
+			}
+		}
+		if len(names) == 0 {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(p.ctx, interval+requestTimeout)
+		for _, res := range p.Purge(ctx, names) {
+			// Purges cut short by Close are not failures of the provider.
+			if res.Error != "" && p.ctx.Err() == nil {
+				p.logger.Printf("error purging %d changed files from %s: %s\n", len(names), res.Provider, res.Error)
+			}
+		}
+		cancel()
+	}
+}
+
+// cloudflare purges URLs through the Cloudflare API.
+type cloudflare struct {
+	zone   string
+	token  string
+	client *http.Client
+}
+
+func (c *cloudflare) name() string {
+	return "cloudflare"
+}
+
+func (c *cloudflare) purge(ctx context.Context, urls []string) error {
+	for len(urls) > 0 {
+		n := min(len(urls), cloudflareBatch)
+		body, err := json.Marshal(map[string][]string{"files": urls[:n]})
+		if err != nil {
+			return err
+		}
+		endpoint := cloudflareAPI + "/zones/" + url.PathEscape(c.zone) + "/purge_cache"
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+c.token)
+		req.Header.Set("Content-Type", "application/json")
+		if err := send(c.client, req, "cloudflare"); err != nil {
+			return err
+		}
+		urls = urls[n:]
+	}
+	return nil
+}
+
+// fastly purges URLs through the Fastly API, one at a time as it requires.
+type fastly struct {
+	token  string
+	client *http.Client
+}
+
+func (f *fastly) name() string {
+	return "fastly"
+}
+
+func (f *fastly) purge(ctx context.Context, urls []string) error {
+	for _, u := range urls {
+		// The API names the URL to purge by its host and path, without the scheme.
+		target := u[strings.Index(u, "://")+3:]
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, fastlyAPI+"/purge/"+target, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Fastly-Key", f.token)
+		if err := send(f.client, req, "fastly"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// webhook posts the URLs to purge as JSON, for CDNs and caches without a provider of their own.
+type webhook struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhook) name() string {
+	return "webhook"
+}
+
+func (w *webhook) purge(ctx context.Context, urls []string) error {
+	body, err := json.Marshal(map[string][]string{"urls": urls})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return send(w.client, req, "webhook")
+}
+
+// send sends req, and fails unless it succeeds.
+func send(client *http.Client, req *http.Request, provider string) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		// Why unwrap? The error would otherwise quote the URL, which may hold a secret.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", provider, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package cdn
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// Signer issues the cookies with which a CDN serves the files below a protected prefix.
+type Signer struct {
+	provider   string
+	base       string // the CDN URL, for CloudFront policies
+	basePath   string // its path, for Akamai tokens
+	prefixes   []string
+	ttl        time.Duration
+	domain     string
+	secure     bool
+	keyPairID  string
+	privateKey *rsa.PrivateKey
+	key        []byte
+	cookieName string
+}
+
+// NewSigner validates the signed cookie settings of cfg, and returns nil if there are none.
+func NewSigner(cfg config.CDNConfig) (*Signer, error) {
+	sc := cfg.SignedCookies
+	if sc.Provider == "" {
+		return nil, nil
+	}
+	base, u, err := parseBase(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	if sc.TTL <= 0 {
+		return nil, fmt.Errorf("invalid cdn signedCookies ttl %s: must be positive", sc.TTL)
+	}
+	s := &Signer{
+		provider: sc.Provider,
+		base:     base,
+		basePath: strings.TrimSuffix(u.EscapedPath(), "/"),
+		ttl:      sc.TTL,
+		domain:   sc.CookieDomain,
+		secure:   u.Scheme == "https",
+	}
+	for _, p := range sc.Prefixes {
+		prefix := strings.Trim(path.Clean("/"+p), "/")
+		// Why refuse these characters? They are wildcards or separators in policies and
+		// tokens, and would widen what the cookies grant.
+		if prefix == "" || strings.ContainsAny(prefix, "*?~!") {
+			return nil, fmt.Errorf("invalid cdn signedCookies prefix %q: must be a directory, without * ? ~ or !", p)
+		}
+		s.prefixes = append(s.prefixes, prefix)
+	}
+	switch sc.Provider {
+	case "cloudfront":
+		if sc.KeyPairID == "" {
+			return nil, fmt.Errorf("cloudfront signed cookies need a keyPairID")
+		}
+		s.keyPairID = sc.KeyPairID
+		if s.privateKey, err = loadPrivateKey(sc.PrivateKeyFile); err != nil {
+			return nil, fmt.Errorf("loading cloudfront private key %s: %w", sc.PrivateKeyFile, err)
+		}
+	case "akamai":
+		if s.key, err = hex.DecodeString(sc.Key); err != nil || len(s.key) == 0 {
+			return nil, fmt.Errorf("akamai signed cookies need a hex-encoded key")
+		}
+		if sc.CookieName == "" {
+			return nil, fmt.Errorf("akamai signed cookies need a cookieName")
+		}
+		s.cookieName = sc.CookieName
+	default:
+		return nil, fmt.Errorf("invalid cdn signedCookies provider %q: must be cloudfront or akamai", sc.Provider)
+	}
+	return s, nil
+}
+
+// loadPrivateKey reads a PEM-encoded RSA private key, in PKCS #1 or PKCS #8 form.
+func loadPrivateKey(file string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// Prefix returns the protected prefix that name, a storage path, is, and false if it is none.
+func (s *Signer) Prefix(name string) (string, bool) {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	for _, p := range s.prefixes {
+		if p == name {
+			return p, true
+		}
+	}
+	return "", false
+}
+
+// Prefixes returns the protected prefixes.
+func (s *Signer) Prefixes() []string {
+	return s.prefixes
+}
+
+// Cookies returns the cookies granting access to the downloads below prefix until they expire,
+// and when that is.
+func (s *Signer) Cookies(prefix string) ([]*http.Cookie, time.Time, error) {
+	expires := time.Now().Add(s.ttl).Truncate(time.Second)
+	resource := "/download/" + escapePath(prefix) + "/*"
+	var values [][2]string
+	switch s.provider {
+	case "cloudfront":
+		policy, err := json.Marshal(cloudFrontPolicy{Statement: []cloudFrontStatement{{
+			Resource:  s.base + resource,
+			Condition: cloudFrontCondition{DateLessThan: map[string]int64{"AWS:EpochTime": expires.Unix()}},
+		}}})
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		digest := sha1.Sum(policy)
+		sig, err := rsa.SignPKCS1v15(rand.Reader, s.privateKey, crypto.SHA1, digest[:])
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		values = [][2]string{
+			{"CloudFront-Policy", cloudFrontEncode(policy)},
+			{"CloudFront-Signature", cloudFrontEncode(sig)},
+			{"CloudFront-Key-Pair-Id", s.keyPairID},
+		}
+	case "akamai":
+		token := "exp=" + strconv.FormatInt(expires.Unix(), 10) + "~acl=" + s.basePath + resource
+		mac := hmac.New(sha256.New, s.key)
+		mac.Write([]byte(token))
+		values = [][2]string{{s.cookieName, token + "~hmac=" + hex.EncodeToString(mac.Sum(nil))}}
+	}
+	cookies := make([]*http.Cookie, 0, len(values))
+	for _, v := range values {
+		cookies = append(cookies, &http.Cookie{
+			Name:     v[0],
+			Value:    v[1],
+			Path:     "/",
+			Domain:   s.domain,
+			Expires:  expires,
+			Secure:   s.secure,
+			HttpOnly: true,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return cookies, expires, nil
+}
+
+// cloudFrontPolicy is a CloudFront custom policy, granting access to one resource.
+type cloudFrontPolicy struct {
+	Statement []cloudFrontStatement
+}
+
+type cloudFrontStatement struct {
+	Resource  string
+	Condition cloudFrontCondition
+}
+
+type cloudFrontCondition struct {
+	DateLessThan map[string]int64
+}
+
+// cloudFrontReplacer replaces the base64 characters that are invalid in cookie values.
+var cloudFrontReplacer = strings.NewReplacer("+", "-", "=", "_", "/", "~")
+
+// cloudFrontEncode encodes b as CloudFront expects it in cookies.
+func cloudFrontEncode(b []byte) string {
+	return cloudFrontReplacer.Replace(base64.StdEncoding.EncodeToString(b))
+}
@@ -0,0 +1,108 @@
+// Package clamav scans files for malware with a ClamAV daemon (clamd).
+package clamav
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// timeout bounds connecting to clamd and each exchange with it. A large file can take longer
+// than this to scan in total, but data keeps flowing in the meantime.
+const timeout = 30 * time.Second
+
+// chunkSize is the size of the chunks the file is streamed to clamd in.
+const chunkSize = 64 << 10
+
+// Scanner sends files to clamd's INSTREAM command.
+//
+// Why stream the contents rather than pass a path? clamd often runs in its own container or
+// as its own user, without access to the server's files.
+type Scanner struct {
+	network string
+	address string
+}
+
+// New returns a scanner for the clamd daemon at address: "host:port", or the path of its
+// Unix socket.
+func New(address string) *Scanner {
+	network := "tcp"
+	if strings.Contains(address, "/") {
+		network = "unix"
+	}
+	return &Scanner{network: network, address: address}
+}
+
+// Scan streams r to clamd. It returns the name of the malware found, or "" if the file is
+// clean; an error means the file could not be scanned.
+func (s *Scanner) Scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := io.WriteString(conn, "zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, readErr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			conn.SetDeadline(time.Now().Add(timeout))
+			if _, err := conn.Write(buf[:4+n]); err != nil {
+				// clamd hangs up once a stream exceeds its StreamMaxLength, having said why.
+				if reply, replyErr := readReply(conn); replyErr == nil {
+					return "", fmt.Errorf("clamd: %s", reply)
+				}
+				return "", err
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+
+	reply, err := readReply(conn)
+	if err != nil {
+		return "", err
+	}
+	// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or "<reason> ERROR".
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd: %s", reply)
+	}
+}
+
+// readReply reads clamd's null-terminated reply.
+func readReply(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil {
+		return "", err
+	}
+	reply = bytes.TrimRight(reply, "\x00\n")
+	if len(reply) == 0 {
+		return "", errors.New("clamd closed the connection without replying")
+	}
+	return string(reply), nil
+}
@@ -0,0 +1,100 @@
+// Package clientip determines the address of the client behind each request, including
+// requests forwarded by trusted reverse proxies.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Resolver rewrites the remote address of requests arriving through trusted proxies.
+type Resolver struct {
+	trusted []netip.Prefix
+}
+
+// New returns a resolver that trusts the X-Forwarded-For header of requests from the given
+// proxies, each an IP address or a CIDR range.
+func New(proxies []string) (*Resolver, error) {
+	res := &Resolver{}
+	for _, p := range proxies {
+		prefix, err := netip.ParsePrefix(p)
+		if err != nil {
+			addr, addrErr := netip.ParseAddr(p)
+			if addrErr != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: must be an IP address or CIDR range", p)
+			}
+			prefix = netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen())
+		}
+		res.trusted = append(res.trusted, prefix.Masked())
+	}
+	return res, nil
+}
+
+// Middleware replaces the remote address of a request from a trusted proxy with the address
+// of the client the proxy received it from, so that logs, quotas and the like see the client.
+//
+// Why walk X-Forwarded-For from the right? Each proxy appends the address it received the
+// request from, so the entries to the right of the last untrusted one were added by trusted
+// proxies, whereas anything further left may have been made up by the client.
+func (res *Resolver) Middleware(next http.Handler) http.Handler {
+	if len(res.trusted) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr := Addr(r)
+		if !res.isTrusted(addr) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			addr = hop.Unmap()
+			if !res.isTrusted(addr) {
+				break
+			}
+		}
+		r2 := *r
+		r2.RemoteAddr = addr.String()
+		next.ServeHTTP(w, &r2)
+	})
+}
+
+func (res *Resolver) isTrusted(addr netip.Addr) bool {
+	for _, p := range res.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Addr returns the client address of r, which is the invalid address if r.RemoteAddr cannot
+// be parsed. After Middleware, RemoteAddr may hold an address without a port.
+func Addr(r *http.Request) netip.Addr {
+	host := r.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addr, _ := netip.ParseAddr(host)
+	return addr.Unmap()
+}
+
+// Key returns the key under which per-client limits count the client at addr: the address
+// itself, or for IPv6, its /64 network.
+//
+// Why count IPv6 clients by /64? A single host is usually given a whole /64, and can pick a
+// fresh address from it for every request.
+func Key(addr netip.Addr) string {
+	if addr.Is6() {
+		prefix, _ := addr.Prefix(64)
+		return prefix.String()
+	}
+	return addr.String()
+}
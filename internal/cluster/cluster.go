@@ -0,0 +1,315 @@
+// Package cluster spreads files over the nodes of a cluster with consistent hashing, and
+// sends requests for a file to the node that owns it.
+package cluster
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/coord"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// ForwardedHeader marks a request another node has proxied, with that node's name, the Unix
+// time it was proxied at and an HMAC-SHA256 signature of both made with the cluster secret,
+// separated by spaces. Such a request is always served where it arrives, so that nodes whose
+// peer lists disagree, as whilst a node is being added, cannot bounce it between them
+// forever.
+const ForwardedHeader = "X-Fileserver-Node"
+
+// forwardedValidity is how long after it was proxied a request is accepted as forwarded,
+// allowing for the nodes' clocks to differ.
+const forwardedValidity = time.Minute
+
+// Peer is a node of the cluster.
+type Peer struct {
+	Name string
+	URL  *url.URL
+	// proxy forwards requests to the node, in proxy mode.
+	proxy *httputil.ReverseProxy
+}
+
+// point is one of a node's positions on the hash ring.
+type point struct {
+	hash uint64
+	peer *Peer
+}
+
+// Cluster maps file names to the nodes that own them.
+//
+// Why consistent hashing? Adding or removing a node moves only the files that hash to it,
+// about one in every n, rather than reshuffling nearly all of them as a plain modulus would.
+type Cluster struct {
+	self     string
+	proxy    bool
+	vnodes   int
+	selfNode coord.Node
+	secret   []byte
+
+	mu   sync.RWMutex
+	ring []point
+
+	render *respond.Renderer
+	logger *log.Logger
+
+	// ctx is cancelled by Close, to stop following the coordination service.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// New returns the cluster configured by cfg, or nil if clustering is off.
+func New(cfg config.ClusterConfig, render *respond.Renderer, logger *log.Logger) (*Cluster, error) {
+	if cfg.Self == "" {
+		return nil, nil
+	}
+	if cfg.Mode != "redirect" && cfg.Mode != "proxy" {
+		return nil, fmt.Errorf("invalid cluster mode %q: must be redirect or proxy", cfg.Mode)
+	}
+	if cfg.VirtualNodes <= 0 {
+		return nil, fmt.Errorf("invalid cluster virtualNodes %d: must be positive", cfg.VirtualNodes)
+	}
+	if cfg.Mode == "proxy" && cfg.Secret == "" {
+		return nil, fmt.Errorf("cluster secret must be set in proxy mode")
+	}
+	c := &Cluster{self: cfg.Self, proxy: cfg.Mode == "proxy", vnodes: cfg.VirtualNodes, secret: []byte(cfg.Secret), render: render, logger: logger}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	nodes := make([]coord.Node, 0, len(cfg.Peers))
+	for _, pc := range cfg.Peers {
+		nodes = append(nodes, coord.Node{Name: pc.Name, URL: pc.URL})
+		if pc.Name == cfg.Self {
+			c.selfNode = nodes[len(nodes)-1]
+		}
+	}
+	if c.selfNode.Name == "" {
+		return nil, fmt.Errorf("cluster self %q is not among the peers", cfg.Self)
+	}
+	if err := c.build(nodes); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Follow registers this node with the coordination service, and from then on builds the
+// ring from the nodes registered there, as they come and go, checking every interval until
+// the cluster is closed. If the service cannot be reached, the ring stays as it was.
+func (c *Cluster) Follow(backend coord.Backend, interval time.Duration) {
+	refresh := func() {
+		ctx, cancel := context.WithTimeout(c.ctx, interval)
+		defer cancel()
+		// Joined again each time, which is harmless, so that a node whose registration was
+		// lost, e.g. after the service was restored from a backup, returns to the ring.
+		if err := backend.Join(ctx, c.selfNode); err != nil {
+			// A check cut short by Close is no failure of the service.
+			if c.ctx.Err() == nil {
+				c.logger.Printf("error joining the cluster: %v\n", err)
+			}
+			return
+		}
+		nodes, err := backend.Members(ctx)
+		if err != nil {
+			if c.ctx.Err() == nil {
+				c.logger.Printf("error reading the cluster members: %v\n", err)
+			}
+			return
+		}
+		if err := c.build(nodes); err != nil {
+			c.logger.Printf("error building the cluster ring: %v\n", err)
+		}
+	}
+	refresh()
+	c.wg.Go(func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.ctx.Done():
+				return
+			case <-ticker.C:
+				refresh()
+			}
+		}
+	})
+}
+
+// Close stops following the coordination service, and waits for a check in progress. The
+// ring stays as it was.
+func (c *Cluster) Close() {
+	if c == nil {
+		return
+	}
+	c.cancel()
+	c.wg.Wait()
+}
+
+// build replaces the ring with one of nodes.
+func (c *Cluster) build(nodes []coord.Node) error {
+	var ring []point
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		if n.Name == "" || seen[n.Name] {
+			return fmt.Errorf("invalid cluster peer %q: names must be unique and not empty", n.Name)
+		}
+		seen[n.Name] = true
+		u, err := url.Parse(n.URL)
+		if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid URL %q for cluster peer %q", n.URL, n.Name)
+		}
+		p := &Peer{Name: n.Name, URL: u}
+		if c.proxy {
+			p.proxy = c.newProxy(p)
+		}
+		for i := range c.vnodes {
+			ring = append(ring, point{hash: hash(n.Name + "#" + strconv.Itoa(i)), peer: p})
+		}
+	}
+	if !seen[c.self] {
+		return fmt.Errorf("cluster self %q is not among the peers", c.self)
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(ring) != len(c.ring) && c.ring != nil {
+		c.logger.Printf("cluster membership changed, to %d nodes\n", len(nodes))
+	}
+	c.ring = ring
+	return nil
+}
+
+// Owner returns the node that owns the file name: the first on the ring at or after the
+// file's hash.
+func (c *Cluster) Owner(name string) *Peer {
+	h := hash(key(name))
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.ring[i].peer
+}
+
+// Owns reports whether this node owns the file name. Without a cluster, it owns everything.
+func (c *Cluster) Owns(name string) bool {
+	return c == nil || c.Owner(name).Name == c.self
+}
+
+// Forward sends a request for the file name to the node that owns it, by redirecting the
+// client there or by proxying the request, and reports true. It reports false, and leaves
+// the request to be served here, if this node owns the file or the request was proxied.
+func (c *Cluster) Forward(w http.ResponseWriter, r *http.Request, name string) bool {
+	if c.Owns(name) || c.forwarded(r, time.Now()) {
+		return false
+	}
+	owner := c.Owner(name)
+	if owner.proxy != nil {
+		owner.proxy.ServeHTTP(w, r)
+		return true
+	}
+	target := *owner.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + r.URL.Path
+	target.RawPath = ""
+	target.RawQuery = r.URL.RawQuery
+	// 307 rather than 302, so that uploads are sent again with their method and body.
+	http.Redirect(w, r, target.String(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// Admit removes the ForwardedHeader from r unless another node of the cluster sent it.
+//
+// Why? A client setting the header itself would otherwise have its request served wherever it
+// arrives, rather than by the node owning the file.
+func (c *Cluster) Admit(r *http.Request) {
+	if r.Header.Get(ForwardedHeader) == "" || c.forwarded(r, time.Now()) {
+		return
+	}
+	if c != nil {
+		c.logger.Printf("warn: ignored an unsigned or invalid %s header from %s\n", ForwardedHeader, r.RemoteAddr)
+	}
+	r.Header.Del(ForwardedHeader)
+}
+
+// sign returns the ForwardedHeader for a request the node name proxies at t.
+func (c *Cluster) sign(name string, t time.Time) string {
+	signed := name + " " + strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write([]byte(signed))
+	return signed + " " + hex.EncodeToString(mac.Sum(nil))
+}
+
+// forwarded reports whether r was proxied by a node of the cluster, signed with the secret
+// within forwardedValidity of now.
+func (c *Cluster) forwarded(r *http.Request, now time.Time) bool {
+	if c == nil || len(c.secret) == 0 {
+		return false
+	}
+	fields := strings.Fields(r.Header.Get(ForwardedHeader))
+	if len(fields) != 3 || !c.member(fields[0]) {
+		return false
+	}
+	unix, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return false
+	}
+	t := time.Unix(unix, 0)
+	if now.Sub(t).Abs() > forwardedValidity {
+		return false
+	}
+	return hmac.Equal([]byte(c.sign(fields[0], t)), []byte(strings.Join(fields, " ")))
+}
+
+// member reports whether name is a node on the ring.
+func (c *Cluster) member(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, p := range c.ring {
+		if p.peer.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// newProxy returns a reverse proxy to the node p.
+func (c *Cluster) newProxy(p *Peer) *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(p.URL)
+			pr.SetXForwarded()
+			pr.Out.Header.Set(ForwardedHeader, c.sign(c.self, time.Now()))
+		},
+		// Flushed straight away, so that downloads stream through rather than pile up here.
+		FlushInterval: -1,
+		ErrorLog:      c.logger,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			c.logger.Printf("error proxying %s to node %s: %v\n", r.URL.Path, p.Name, err)
+			c.render.Error(w, r, http.StatusBadGateway, "node "+p.Name+" is unavailable")
+		},
+	}
+}
+
+// key returns the name a file is hashed by, the same however the client spelt its path.
+func key(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// hash returns the position of s on the ring.
+func hash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
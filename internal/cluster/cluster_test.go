@@ -0,0 +1,355 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/coord"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// newTestCluster returns the cluster of node-a and node-b, as node self sees it.
+func newTestCluster(t *testing.T, self, mode, urlA, urlB string) *Cluster {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	c, err := New(config.ClusterConfig{
+		Self:         self,
+		Peers:        []config.ClusterPeer{{Name: "node-a", URL: urlA}, {Name: "node-b", URL: urlB}},
+		Mode:         mode,
+		VirtualNodes: 100,
+		Secret:       "secret",
+	}, respond.NewRenderer(respond.FormatJSON, logger), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// ownedBy returns the name of a file the node owns.
+func ownedBy(t *testing.T, c *Cluster, node string) string {
+	t.Helper()
+	for i := range 1000 {
+		if name := fmt.Sprintf("file%d.txt", i); c.Owner(name).Name == node {
+			return name
+		}
+	}
+	t.Fatalf("no file hashes to %s", node)
+	return ""
+}
+
+func TestNew(t *testing.T) {
+	peers := []config.ClusterPeer{{Name: "node-a", URL: "http://node-a:8090"}, {Name: "node-b", URL: "http://node-b:8090"}}
+	tests := []struct {
+		desc    string
+		cfg     config.ClusterConfig
+		wantErr bool
+	}{
+		{"a cluster", config.ClusterConfig{Self: "node-a", Peers: peers, Mode: "redirect", VirtualNodes: 100}, false},
+		{"an unknown mode", config.ClusterConfig{Self: "node-a", Peers: peers, Mode: "relay", VirtualNodes: 100}, true},
+		{"no virtual nodes", config.ClusterConfig{Self: "node-a", Peers: peers, Mode: "redirect"}, true},
+		{"self not among the peers", config.ClusterConfig{Self: "node-c", Peers: peers, Mode: "redirect", VirtualNodes: 100}, true},
+		{"a peer twice", config.ClusterConfig{Self: "node-a", Peers: append(peers, peers[1]), Mode: "redirect", VirtualNodes: 100}, true},
+		{"a peer without a name", config.ClusterConfig{Self: "node-a", Peers: append(peers, config.ClusterPeer{URL: "http://node-c:8090"}), Mode: "redirect", VirtualNodes: 100}, true},
+		{"a peer with an invalid URL", config.ClusterConfig{Self: "node-a", Peers: append(peers, config.ClusterPeer{Name: "node-c", URL: "node-c:8090"}), Mode: "redirect", VirtualNodes: 100}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			c, err := New(tt.cfg, nil, log.New(io.Discard, "", 0))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, tt.wantErr)
+			}
+			c.Close()
+		})
+	}
+	if c, err := New(config.ClusterConfig{}, nil, nil); c != nil || err != nil {
+		t.Errorf("got %v, %v without a self, want no cluster", c, err)
+	}
+}
+
+// TestOwner checks that files are spread over the nodes, whatever the spelling of their
+// paths, and that a node joining takes files from the others without moving any between them.
+func TestOwner(t *testing.T) {
+	two := newTestCluster(t, "node-a", "redirect", "http://node-a:8090", "http://node-b:8090")
+	three, err := New(config.ClusterConfig{
+		Self: "node-a",
+		Peers: []config.ClusterPeer{
+			{Name: "node-a", URL: "http://node-a:8090"},
+			{Name: "node-b", URL: "http://node-b:8090"},
+			{Name: "node-c", URL: "http://node-c:8090"},
+		},
+		Mode:         "redirect",
+		VirtualNodes: 100,
+	}, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const files = 3000
+	counts := make(map[string]int)
+	moved := 0
+	for i := range files {
+		name := fmt.Sprintf("docs/file%d.txt", i)
+		before, after := two.Owner(name).Name, three.Owner(name).Name
+		counts[after]++
+		if before != after {
+			moved++
+			if after != "node-c" {
+				t.Fatalf("%s moved from %s to %s", name, before, after)
+			}
+		}
+		for _, spelling := range []string{"/" + name, "./" + name, "docs//x/../" + name[len("docs/"):]} {
+			if got := three.Owner(spelling).Name; got != after {
+				t.Fatalf("%s is owned by %s, but %s by %s", spelling, got, name, after)
+			}
+		}
+	}
+	for node, n := range counts {
+		if n < files/5 {
+			t.Errorf("%s owns %d of %d files", node, n, files)
+		}
+	}
+	if moved < files/5 || moved > files/2 {
+		t.Errorf("%d of %d files moved to the new node, want about a third", moved, files)
+	}
+	if !two.Owns(ownedBy(t, two, "node-a")) || two.Owns(ownedBy(t, two, "node-b")) {
+		t.Error("Owns disagrees with Owner")
+	}
+	var none *Cluster
+	if !none.Owns("a.txt") {
+		t.Error("a server that is not clustered does not own a file")
+	}
+}
+
+// TestForwardRedirect checks that a request for a file another node owns is redirected
+// there, keeping its method, path and query.
+func TestForwardRedirect(t *testing.T) {
+	c := newTestCluster(t, "node-a", "redirect", "http://node-a:8090", "https://node-b.example.com/files/")
+	mine, theirs := ownedBy(t, c, "node-a"), ownedBy(t, c, "node-b")
+
+	w := httptest.NewRecorder()
+	if c.Forward(w, httptest.NewRequest(http.MethodGet, "/download/"+mine, nil), mine) {
+		t.Errorf("a request for a file this node owns was forwarded, with status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPut, "/api/files/"+theirs+"?overwrite=true", strings.NewReader("content"))
+	if !c.Forward(w, r, theirs) {
+		t.Fatal("a request for a file another node owns was not forwarded")
+	}
+	if w.Code != http.StatusTemporaryRedirect {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusTemporaryRedirect)
+	}
+	if got, want := w.Header().Get("Location"), "https://node-b.example.com/files/api/files/"+theirs+"?overwrite=true"; got != want {
+		t.Errorf("redirected to %s, want %s", got, want)
+	}
+}
+
+func TestNewRequiresSecretToProxy(t *testing.T) {
+	cfg := config.ClusterConfig{
+		Self:         "node-a",
+		Peers:        []config.ClusterPeer{{Name: "node-a", URL: "http://node-a:8090"}},
+		Mode:         "proxy",
+		VirtualNodes: 100,
+	}
+	if _, err := New(cfg, nil, log.New(io.Discard, "", 0)); err == nil {
+		t.Error("a cluster proxying without a secret was set up")
+	}
+}
+
+// TestForwardedHeader checks that a request marked as proxied is served where it arrives only
+// if another node of the cluster marked it.
+func TestForwardedHeader(t *testing.T) {
+	c := newTestCluster(t, "node-a", "redirect", "http://node-a:8090", "http://node-b:8090")
+	other := newTestCluster(t, "node-a", "redirect", "http://node-a:8090", "http://node-b:8090")
+	other.secret = []byte("another secret")
+	name := ownedBy(t, c, "node-b")
+	now := time.Now()
+	signed := c.sign("node-b", now)
+	sig := signed[strings.LastIndex(signed, " ")+1:]
+
+	tests := []struct {
+		desc       string
+		header     string
+		wantServed bool
+	}{
+		{"a request not proxied", "", false},
+		{"a node's name alone", "node-b", false},
+		{"a signature made with another secret", other.sign("node-b", now), false},
+		{"a node outside the cluster", c.sign("node-c", now), false},
+		{"a signature too old", c.sign("node-b", now.Add(-2*forwardedValidity)), false},
+		{"a signature for another time", "node-b " + strconv.FormatInt(now.Unix()+1, 10) + " " + sig, false},
+		{"a request another node proxied", signed, true},
+		{"a request this node proxied", c.sign("node-a", now), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/download/"+name, nil)
+			if tt.header != "" {
+				r.Header.Set(ForwardedHeader, tt.header)
+			}
+			c.Admit(r)
+			if kept := r.Header.Get(ForwardedHeader) != ""; kept != tt.wantServed {
+				t.Errorf("header kept %v, want %v", kept, tt.wantServed)
+			}
+			w := httptest.NewRecorder()
+			if served := !c.Forward(w, r, name); served != tt.wantServed {
+				t.Errorf("served here %v, want %v", served, tt.wantServed)
+			}
+			if !tt.wantServed && w.Code != http.StatusTemporaryRedirect {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusTemporaryRedirect)
+			}
+		})
+	}
+}
+
+// TestAdmitWithoutCluster checks that a server that is not clustered drops the header too.
+func TestAdmitWithoutCluster(t *testing.T) {
+	var c *Cluster
+	r := httptest.NewRequest(http.MethodGet, "/download/a.txt", nil)
+	r.Header.Set(ForwardedHeader, "node-b")
+	c.Admit(r)
+	if h := r.Header.Get(ForwardedHeader); h != "" {
+		t.Errorf("header %q kept without a cluster", h)
+	}
+}
+
+// TestProxy sends a request with a spoofed header to a node that does not own the file, which
+// must still proxy it to the owner, signing it as it goes.
+func TestProxy(t *testing.T) {
+	var b *Cluster
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !b.forwarded(r, time.Now()) {
+			http.Error(w, "not proxied by a node", http.StatusForbidden)
+			return
+		}
+		io.WriteString(w, "node-b")
+	}))
+	defer owner.Close()
+	var a *Cluster
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.Admit(r)
+		if a.Forward(w, r, r.URL.Path) {
+			return
+		}
+		io.WriteString(w, "node-a")
+	}))
+	defer proxy.Close()
+	a = newTestCluster(t, "node-a", "proxy", proxy.URL, owner.URL)
+	b = newTestCluster(t, "node-b", "proxy", proxy.URL, owner.URL)
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/"+ownedBy(t, a, "node-b"), nil)
+	req.Header.Set(ForwardedHeader, "node-b")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(got) != "node-b" {
+		t.Errorf("got %s %q, want %d %q", resp.Status, got, http.StatusOK, "node-b")
+	}
+}
+
+// memberBackend is a coordination service that registers nothing, answering with members
+// for the members of the deployment.
+type memberBackend struct {
+	coord.Backend
+	mu      sync.Mutex
+	members []coord.Node
+	joins   int
+}
+
+func (b *memberBackend) Join(ctx context.Context, node coord.Node) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if node.Name != "node-a" {
+		return fmt.Errorf("joined as %q", node.Name)
+	}
+	b.joins++
+	return nil
+}
+
+func (b *memberBackend) Members(ctx context.Context) ([]coord.Node, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.members, nil
+}
+
+func (b *memberBackend) set(members ...coord.Node) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.members = members
+}
+
+// owners returns the nodes that own any of a thousand files.
+func owners(c *Cluster) map[string]bool {
+	seen := make(map[string]bool)
+	for i := range 1000 {
+		seen[c.Owner(fmt.Sprintf("file%d.txt", i)).Name] = true
+	}
+	return seen
+}
+
+// TestFollow checks that the ring follows the members registered with the coordination
+// service, and is kept as it was when they make no sense.
+func TestFollow(t *testing.T) {
+	c := newTestCluster(t, "node-a", "redirect", "http://10.0.0.1", "http://10.0.0.2")
+	nodeA := coord.Node{Name: "node-a", URL: "http://10.0.0.1"}
+	nodeC := coord.Node{Name: "node-c", URL: "http://10.0.0.3"}
+	backend := &memberBackend{members: []coord.Node{nodeA, nodeC}}
+	c.Follow(backend, 10*time.Millisecond)
+	defer c.Close()
+	// The first check is made before Follow returns.
+	if got := owners(c); !got["node-a"] || !got["node-c"] || len(got) != 2 {
+		t.Fatalf("got owners %v, want node-a and node-c", got)
+	}
+
+	// awaitOwners waits for the ring to have the owners want.
+	awaitOwners := func(want ...string) {
+		t.Helper()
+		var got map[string]bool
+		for range 100 {
+			if got = owners(c); len(got) == len(want) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, n := range want {
+			if !got[n] || len(got) != len(want) {
+				t.Fatalf("got owners %v, want %v", got, want)
+			}
+		}
+	}
+	backend.set(nodeA)
+	awaitOwners("node-a")
+	// A ring without this node, or with an invalid one, is not built.
+	backend.set(nodeC)
+	time.Sleep(50 * time.Millisecond)
+	awaitOwners("node-a")
+	backend.set(nodeA, coord.Node{Name: "node-d", URL: "10.0.0.4"})
+	time.Sleep(50 * time.Millisecond)
+	awaitOwners("node-a")
+	backend.set(nodeA, nodeC)
+	awaitOwners("node-a", "node-c")
+
+	// No checks are made once the cluster is closed.
+	c.Close()
+	backend.mu.Lock()
+	joins := backend.joins
+	backend.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	if backend.joins != joins {
+		t.Errorf("joined %d times after the cluster was closed", backend.joins-joins)
+	}
+}
@@ -0,0 +1,118 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretKeys are the settings whose values are replaced when the configuration is printed.
+var secretKeys = map[string]bool{
+	"password":        true,
+	"passwordHash":    true,
+	"secret":          true,
+	"secretAccessKey": true,
+	"token":           true,
+	"botToken":        true,
+	"dsn":             true,
+	"key":             true,
+}
+
+// redacted replaces the values of secretKeys.
+const redacted = "<redacted>"
+
+// CheckKeys reports the settings in the file at path that the configuration does not have,
+// such as misspelt ones, which NewConfig ignores. A missing file has none.
+func CheckKeys(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var cfg Config
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// Dump returns the configuration as YAML, in the layout of the configuration file, with
+// the values of secrets replaced.
+//
+// Why not marshal it directly? Durations would come out as nanoseconds, which the file
+// never uses, and secrets would end up in the output of build machines.
+func (c *Config) Dump() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(dumpNode(reflect.ValueOf(*c), false)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), enc.Close()
+}
+
+// dumpNode returns the YAML node of v; secret replaces scalar values that are set.
+func dumpNode(v reflect.Value, secret bool) *yaml.Node {
+	if v.Type() == reflect.TypeFor[time.Duration]() {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v.Interface().(time.Duration).String()}
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+		}
+		return dumpNode(v.Elem(), secret)
+	case reflect.Struct:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		for i := range v.NumField() {
+			f := v.Type().Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+			if name == "" || name == "-" || !f.IsExported() {
+				continue
+			}
+			n.Content = append(n.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: name},
+				dumpNode(v.Field(i), secretKeys[name]))
+		}
+		return n
+	case reflect.Map:
+		n := &yaml.Node{Kind: yaml.MappingNode}
+		keys := v.MapKeys()
+		// Sorted, so that dumps of one configuration can be compared.
+		slices.SortFunc(keys, func(a, b reflect.Value) int { return strings.Compare(a.String(), b.String()) })
+		for _, k := range keys {
+			n.Content = append(n.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Value: k.String()},
+				dumpNode(v.MapIndex(k), secret))
+		}
+		return n
+	case reflect.Slice, reflect.Array:
+		n := &yaml.Node{Kind: yaml.SequenceNode}
+		if v.Len() == 0 {
+			n.Style = yaml.FlowStyle
+		}
+		for i := range v.Len() {
+			n.Content = append(n.Content, dumpNode(v.Index(i), secret))
+		}
+		return n
+	}
+	if secret && !v.IsZero() {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: redacted}
+	}
+	var n yaml.Node
+	if err := n.Encode(v.Interface()); err != nil {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: err.Error()}
+	}
+	return &n
+}
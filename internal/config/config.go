@@ -1,8 +1,13 @@
 package config
 
 import (
+	"io/fs"
 	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -10,10 +15,35 @@ import (
 
 // ServerConfig holds settings specific to the HTTP server.
 type ServerConfig struct {
-	Addr         string        `yaml:"address"`
-	ReadTimeout  time.Duration `yaml:"readTimeout"`
-	WriteTimeout time.Duration `yaml:"writeTimeout"`
-	IdleTimeout  time.Duration `yaml:"idleTimeout"`
+	Addr     string `yaml:"address"`
+	BasePath string `yaml:"basePath"`
+	// PublicURL is the address clients reach the server at, including any base path
+	// (e.g. "https://example.com/files"). It is used to link to files from notifications
+	// and in the answers to pastes.
+	PublicURL     string        `yaml:"publicURL"`
+	ErrorFormat   string        `yaml:"errorFormat"`
+	SecureCookies bool          `yaml:"secureCookies"`
+	ReadTimeout   time.Duration `yaml:"readTimeout"`
+	WriteTimeout  time.Duration `yaml:"writeTimeout"`
+	IdleTimeout   time.Duration `yaml:"idleTimeout"`
+	// StallTimeout bounds how long an upload or download may go without moving any data.
+	// Whilst data keeps flowing, read and write deadlines are extended by this amount,
+	// so large transfers are not cut off by ReadTimeout or WriteTimeout. Zero disables it.
+	StallTimeout time.Duration `yaml:"stallTimeout"`
+	// TrustedProxies lists the reverse proxies, as IP addresses or CIDR ranges, whose
+	// X-Forwarded-For header is believed when determining a client's address.
+	TrustedProxies []string `yaml:"trustedProxies"`
+	// TLS serves HTTPS rather than HTTP, with this certificate for the host names that no
+	// tenant has a certificate of its own for.
+	TLS TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig holds a certificate and its private key, as PEM files. TLS is disabled when
+// CertFile is empty. The files are read again when they change, so renewed certificates are
+// picked up without a restart.
+type TLSConfig struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
 }
 
 // UploaderConfig holds settings related to the file uploading functionality.
@@ -22,12 +52,884 @@ type UploaderConfig struct {
 	StorageDir       string `yaml:"storageDir"`
 	MaxUploadSizeMB  int64  `yaml:"maxUploadSizeMB"`
 	MaxFormMemSizeMB int64  `yaml:"maxFormMemSizeMB"`
+	// MaxFileSizeMB bounds each file of an upload on its own, so that an oversized file is
+	// refused whilst the other files of the upload are stored. 0 leaves only MaxUploadSizeMB.
+	MaxFileSizeMB int64 `yaml:"maxFileSizeMB"`
+	// MinFreeSpaceMB refuses uploads to a disk with less than this free, so that the disk
+	// never fills completely. 0 turns the check off.
+	MinFreeSpaceMB int64 `yaml:"minFreeSpaceMB"`
+	// MetadataFields names the text fields of an upload form, such as "description", that are
+	// kept with the uploaded files and shown in their details.
+	MetadataFields []string `yaml:"metadataFields"`
+	// DateDirs files uploads into directories named after the day they arrive, e.g.
+	// "{year}/{month}/{day}", with {year}, {month}, {day} and {hour} replaced. Empty stores
+	// them as named.
+	DateDirs string `yaml:"dateDirs"`
+	// NameTemplate renames uploaded files as they are stored, e.g. "{date}-{uuid}-{original}",
+	// with {original}, {name} (without extension), {ext}, {date}, {time} and {uuid} replaced.
+	// Empty keeps the names files are uploaded with.
+	NameTemplate string `yaml:"nameTemplate"`
+	// Symlinks sets how symbolic links placed in the storage directory by other means are
+	// treated: "follow" serves them as what they lead to, "refuse" lists them but refuses to
+	// serve them, and "hide" leaves them out of listings as if they did not exist.
+	Symlinks string `yaml:"symlinks"`
+	// HardlinkCopies makes server-side copies hard links to the original where the filesystem
+	// allows it, so that copying takes no time or space. A copy is separated from the
+	// original when either is written or touched. Files under write-once retention are always
+	// copied.
+	HardlinkCopies bool `yaml:"hardlinkCopies"`
+	// SparseFiles leaves blocks of zeros in uploaded files unwritten, as holes, so that disk
+	// images and the like take up only the space of their data.
+	SparseFiles bool `yaml:"sparseFiles"`
+	// FileMode and DirMode are the permissions, in octal such as "0640", given to stored files
+	// and to the directories created for them, whatever the umask. Empty leaves files at 0666
+	// and directories at 0755, less the umask.
+	FileMode string `yaml:"fileMode"`
+	DirMode  string `yaml:"dirMode"`
+	// UID and GID make stored files and the directories created for them belong to this user
+	// and group, for another service that reads the storage directory. Changing the owner
+	// takes root's privileges. -1 leaves it to the server's own user.
+	UID int `yaml:"uid"`
+	GID int `yaml:"gid"`
+}
+
+// GetFileMode returns the permissions FileMode sets, and whether it sets valid ones.
+func (uc *UploaderConfig) GetFileMode() (fs.FileMode, bool) {
+	return parseMode(uc.FileMode)
+}
+
+// GetDirMode returns the permissions DirMode sets, and whether it sets valid ones.
+func (uc *UploaderConfig) GetDirMode() (fs.FileMode, bool) {
+	return parseMode(uc.DirMode)
+}
+
+// parseMode parses octal permissions such as "0640".
+func parseMode(s string) (fs.FileMode, bool) {
+	if s == "" {
+		return 0, false
+	}
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, false
+	}
+	return fs.FileMode(m), true
+}
+
+// ValidationConfig holds the checks uploaded files must pass before they are stored. A client
+// can also have a file's checksum verified by sending a Content-Digest header with its part.
+type ValidationConfig struct {
+	// AllowedTypes restricts uploads to these media types (e.g. "image/png", or "image/*"
+	// for a whole family). Empty allows every type.
+	AllowedTypes []string `yaml:"allowedTypes"`
+	// ClamAV is the address of a clamd daemon that scans every upload for malware: "host:port",
+	// or the path of its Unix socket. Empty disables scanning.
+	ClamAV string `yaml:"clamAV"`
+	// Quarantine keeps rejected files in the metadata directory, for an administrator to
+	// inspect, release or purge, instead of discarding them.
+	Quarantine bool `yaml:"quarantine"`
+}
+
+// UploadQuotaConfig limits how much each client address may upload within a rolling window,
+// however it authenticates. IPv6 clients are counted by their /64 network.
+type UploadQuotaConfig struct {
+	// PerIPMB is the number of megabytes a client may upload per window. Zero disables the quota.
+	PerIPMB int64         `yaml:"perIPMB"`
+	Window  time.Duration `yaml:"window"`
+}
+
+// GetPerIP returns the quota per client address in bytes.
+func (qc *UploadQuotaConfig) GetPerIP() int64 {
+	return qc.PerIPMB << 20
+}
+
+// HiddenFilesConfig sets which stored files are hidden from clients: left out of listings
+// and not found when requested. The metadata directory, if it lies within the storage
+// directory, is always hidden, and can never be written to through the API.
+type HiddenFilesConfig struct {
+	// Dotfiles hides files and directories whose names start with a dot, and what lies below.
+	Dotfiles bool `yaml:"dotfiles"`
+	// Names hides files and directories whose names match one of these patterns, such as
+	// "Thumbs.db" or "*.tmp", in the syntax of Go's path.Match.
+	Names []string `yaml:"names"`
+	// RejectUploads refuses uploads, and other writes, to hidden names, rather than storing
+	// files that clients then cannot see.
+	RejectUploads bool `yaml:"rejectUploads"`
+}
+
+// DirQuotaConfig caps the total size of the files below a directory of the storage directory.
+type DirQuotaConfig struct {
+	// Path is the directory, such as "/incoming"; "/" caps the whole storage directory.
+	Path      string `yaml:"path"`
+	MaxSizeMB int64  `yaml:"maxSizeMB"`
+}
+
+// GetMaxSize returns the quota in bytes.
+func (dq *DirQuotaConfig) GetMaxSize() int64 {
+	return dq.MaxSizeMB << 20
+}
+
+// EvictionConfig deletes stored files automatically as the storage directory nears a cap on
+// its size, rather than refusing uploads as a directory quota does.
+type EvictionConfig struct {
+	// Policy chooses the files to evict first: "lru", those least recently downloaded, or
+	// "oldest", those least recently uploaded. Empty evicts nothing.
+	Policy    string `yaml:"policy"`
+	MaxSizeMB int64  `yaml:"maxSizeMB"`
+	// HighWatermark is the percentage of maxSizeMB at which files start to be evicted, and
+	// LowWatermark the one at which they stop, so that each eviction makes room for more
+	// than the next upload.
+	HighWatermark int `yaml:"highWatermark"`
+	LowWatermark  int `yaml:"lowWatermark"`
+	// Interval is how often the size of the storage directory is checked.
+	Interval time.Duration `yaml:"interval"`
+	// Pinned lists files and directories, such as "/releases", that are never evicted. Files
+	// under a hold or write-once retention are not evicted either.
+	Pinned []string `yaml:"pinned"`
+}
+
+// GetHighWatermark returns the size in bytes at which eviction starts.
+func (ec *EvictionConfig) GetHighWatermark() int64 {
+	return (ec.MaxSizeMB << 20) * int64(ec.HighWatermark) / 100
+}
+
+// GetLowWatermark returns the size in bytes that eviction brings the storage directory down to.
+func (ec *EvictionConfig) GetLowWatermark() int64 {
+	return (ec.MaxSizeMB << 20) * int64(ec.LowWatermark) / 100
+}
+
+// ShardConfig stores the files below a directory of the storage directory on another disk.
+type ShardConfig struct {
+	// Prefix is the directory, such as "/videos", whose files, at any depth, are stored on Dir.
+	Prefix string `yaml:"prefix"`
+	// Dir is where they are stored, under their full names, e.g. "/mnt/disk2/fileserver". It
+	// must exist. Prefixes may share a disk, with the same Dir.
+	Dir string `yaml:"dir"`
+}
+
+// TenantConfig defines a tenant: a team served by the same process below /t/<name>, kept
+// apart from the others with a storage directory, metadata directory, users and limits of
+// its own.
+type TenantConfig struct {
+	Name string `yaml:"name"`
+	// StorageDir and MetadataDir default to "files" and "metadata" in the tenant's directory
+	// below TenancyConfig.Dir.
+	StorageDir  string `yaml:"storageDir"`
+	MetadataDir string `yaml:"metadataDir"`
+	// MaxSizeMB caps the total size of the tenant's files; zero leaves it unlimited.
+	MaxSizeMB int64 `yaml:"maxSizeMB"`
+	// MaxUploadSizeMB and UploadQuotaMB, if set, replace uploader.maxUploadSizeMB and
+	// uploadQuota.perIPMB for the tenant.
+	MaxUploadSizeMB int64 `yaml:"maxUploadSizeMB"`
+	UploadQuotaMB   int64 `yaml:"uploadQuotaMB"`
+	// Hosts are host names, such as files.team-a.example.com, whose requests go to the tenant,
+	// below the server's base path rather than /t/<name>.
+	Hosts []string `yaml:"hosts"`
+	// TLS is the certificate of the tenant's hosts; without one, the server's is used.
+	TLS TLSConfig `yaml:"tls"`
+	// AuthRequired refuses anonymous requests to the tenant, as auth.required does.
+	AuthRequired bool         `yaml:"authRequired"`
+	Users        []StaticUser `yaml:"users"`
+	APIKeys      []APIKey     `yaml:"apiKeys"`
+	ACL          []ACLRule    `yaml:"acl"`
+}
+
+// TenancyConfig holds the tenants served besides the main storage directory.
+type TenancyConfig struct {
+	// Dir holds a directory per tenant, for those without directories of their own and
+	// those created through the API, and the list of the latter.
+	Dir     string         `yaml:"dir"`
+	Tenants []TenantConfig `yaml:"tenants"`
+}
+
+// ProcessingConfig holds the settings for processing uploads in the background.
+type ProcessingConfig struct {
+	// Async selects when uploaded files are validated and stored by a background job, with the
+	// upload answered by 202 Accepted as soon as they have been received: "off", "request" (when
+	// the client sends "Prefer: respond-async") or "always".
+	Async string `yaml:"async"`
+	// Workers is the number of jobs processed at once.
+	Workers int `yaml:"workers"`
+	// QueueDepth is how many jobs may wait for a worker before further uploads are refused
+	// with 503; 0 means no limit.
+	QueueDepth int `yaml:"queueDepth"`
+	// JobTimeout is how long a job may run before its remaining files are failed; 0 means no
+	// limit.
+	JobTimeout time.Duration `yaml:"jobTimeout"`
+}
+
+// VideoConfig holds the settings for extracting previews of uploaded videos.
+type VideoConfig struct {
+	// FFmpeg is the ffmpeg executable, as a path or a name to look up in PATH. Empty disables
+	// previews.
+	FFmpeg string `yaml:"ffmpeg"`
+	// Timeout is how long ffmpeg may take over one video.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ConversionConfig holds the settings for converting office documents for preview, with
+// either a command or an HTTP service.
+type ConversionConfig struct {
+	// Command is run for each document, with "{input}" and "{output}" in its arguments
+	// replaced by the paths of the document and of the file to write.
+	Command []string `yaml:"command"`
+	// URL is that of a service the document is posted to, as the "files" field of a form,
+	// which answers with the converted document.
+	URL string `yaml:"url"`
+	// Format is what documents are converted to: "pdf" or "html".
+	Format string `yaml:"format"`
+	// Extensions are those of the files that are converted.
+	Extensions []string `yaml:"extensions"`
+	// Timeout is how long converting one document may take.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ViewerConfig holds the settings for the PDF reader page at /read/, which shows PDF documents
+// with PDF.js in any browser, including those without a PDF viewer of their own.
+type ViewerConfig struct {
+	// PDFJS is the URL of the build directory of a PDF.js distribution, holding pdf.min.mjs
+	// and pdf.worker.min.mjs: on a CDN, or a path on a server of the operator's. Empty
+	// disables the reader page.
+	PDFJS string `yaml:"pdfjs"`
+}
+
+// EditorConfig holds the settings for saving text files edited in place.
+type EditorConfig struct {
+	// MaxSizeKB is the largest file that can be saved, in kilobytes. 0 disables saving.
+	MaxSizeKB int64 `yaml:"maxSizeKB"`
+}
+
+// GetMaxSize returns the largest file that can be saved, in bytes.
+func (ec *EditorConfig) GetMaxSize() int64 {
+	return ec.MaxSizeKB << 10
+}
+
+// ParallelUploadsConfig holds the settings for uploads sent as byte ranges, over as many
+// connections at once as the client likes, and assembled by the server.
+type ParallelUploadsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Expiry is how long an unfinished upload is kept after its last part arrived.
+	Expiry time.Duration `yaml:"expiry"`
+}
+
+// PasteConfig holds the settings for sharing snippets of text, such as logs, with POST /paste.
+type PasteConfig struct {
+	// Dir is the directory, within the storage directory, that snippets are stored in.
+	Dir string `yaml:"dir"`
+	// MaxSizeKB is the largest snippet that can be shared, in kilobytes. 0 disables pasting.
+	MaxSizeKB int64 `yaml:"maxSizeKB"`
+}
+
+// GetMaxSize returns the largest snippet that can be shared, in bytes.
+func (pc *PasteConfig) GetMaxSize() int64 {
+	return pc.MaxSizeKB << 10
+}
+
+// FetchConfig holds the settings for storing files the server downloads itself, with
+// POST /api/fetch, from the hosts allowed here.
+type FetchConfig struct {
+	// Hosts lists the hosts files may be fetched from: a name, or "*.example.com" for its
+	// subdomains. Empty disables fetching.
+	Hosts []string `yaml:"hosts"`
+	// Schemes lists the URL schemes that may be fetched, "https" and "http".
+	Schemes []string `yaml:"schemes"`
+	// AllowPrivate allows fetching from loopback, private and link-local addresses, which
+	// are refused by default so that fetches cannot reach services behind the server.
+	AllowPrivate bool `yaml:"allowPrivate"`
+	// MaxSizeMB is the largest file that can be fetched, in megabytes. 0 leaves only the
+	// maximum upload size.
+	MaxSizeMB int64 `yaml:"maxSizeMB"`
+	// Timeout bounds how long fetching one file may take.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// GetMaxSize returns the largest file that can be fetched, in bytes.
+func (fc *FetchConfig) GetMaxSize() int64 {
+	return fc.MaxSizeMB << 20
+}
+
+// MirrorConfig holds the settings for running as a caching mirror of another server: a
+// download of a file that is not stored fetches it from the upstream first.
+type MirrorConfig struct {
+	// Upstream is the URL files are fetched from, with their names appended, e.g.
+	// "https://files.example.com/download/". Empty turns mirroring off.
+	Upstream string `yaml:"upstream"`
+	// Authorization is sent as the Authorization header of requests to the upstream.
+	Authorization string `yaml:"authorization"`
+	// MaxSizeMB is the largest file that is mirrored, in megabytes. 0 leaves only the
+	// maximum upload size.
+	MaxSizeMB int64 `yaml:"maxSizeMB"`
+	// Timeout bounds how long fetching one file may take.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// GetMaxSize returns the largest file that is mirrored, in bytes.
+func (mc *MirrorConfig) GetMaxSize() int64 {
+	return mc.MaxSizeMB << 20
+}
+
+// ClusterConfig holds the settings for spreading the files over several instances, each
+// storing those that hash to it.
+type ClusterConfig struct {
+	// Self is the name of this node among Peers. Empty turns clustering off.
+	Self string `yaml:"self"`
+	// Peers lists every node of the cluster, this one included.
+	Peers []ClusterPeer `yaml:"peers"`
+	// Mode is how a request for a file another node owns is answered: "redirect" sends the
+	// client there, and "proxy" forwards the request itself.
+	Mode string `yaml:"mode"`
+	// VirtualNodes is how many points each node has on the hash ring; more spread the files
+	// more evenly.
+	VirtualNodes int `yaml:"virtualNodes"`
+	// Secret, the same on every node, signs the requests the nodes proxy to each other, which
+	// are served where they arrive. Proxy mode requires it.
+	Secret string `yaml:"secret"`
+}
+
+// ClusterPeer is a node of the cluster.
+type ClusterPeer struct {
+	Name string `yaml:"name"`
+	// URL is where the node is reached, by clients it redirects to it and by the nodes that
+	// proxy to it, e.g. "http://node-a:8090".
+	URL string `yaml:"url"`
+}
+
+// ReplicaConfig holds the settings for running as a read replica of another instance, which
+// serves downloads from its own copy of the files and forwards writes to the primary.
+type ReplicaConfig struct {
+	// Primary is the URL of the primary, e.g. "http://primary:8090". Empty runs this
+	// instance on its own.
+	Primary string `yaml:"primary"`
+}
+
+// CoordinationConfig holds the settings for the coordination service shared by the nodes of
+// a multi-node deployment.
+type CoordinationConfig struct {
+	// Backend is "etcd" or "consul". Empty turns coordination off.
+	Backend string `yaml:"backend"`
+	// Endpoint is the URL of the service's HTTP API, e.g. "http://127.0.0.1:2379" for etcd
+	// or "http://127.0.0.1:8500" for Consul.
+	Endpoint string `yaml:"endpoint"`
+	// Token is the Consul ACL token sent with each request.
+	Token string `yaml:"token"`
+	// Prefix is prepended to every key the server uses, so that deployments can share a service.
+	Prefix string `yaml:"prefix"`
+	// TTL is how long the membership and locks of a node outlive it should it stop renewing them.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// LeaderConfig holds the settings for electing, among the instances that share one storage
+// directory, the one that runs the scheduled jobs about it.
+type LeaderConfig struct {
+	// Election is "file", a lock on LockFile, or "coordination", a lock in the coordination
+	// service. Empty makes every instance run them, as a single instance should.
+	Election string `yaml:"election"`
+	// LockFile is the file locked by the leader, in file election. It must be on the storage
+	// that the instances share, e.g. "/mnt/nfs/.fileserver-leader".
+	LockFile string `yaml:"lockFile"`
+	// Interval is how often an instance tries to become the leader, or, in coordination
+	// election, checks that it still is.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// AbuseConfig holds the settings for temporarily banning clients that behave like abusers,
+// as a public drop-box attracts. A client is banned when any kind of incident reaches its
+// threshold within the window; a threshold of zero ignores that kind.
+type AbuseConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// AnonymousOnly counts the incidents of anonymous clients only, so that authenticated
+	// users are never banned by mistake.
+	AnonymousOnly bool          `yaml:"anonymousOnly"`
+	Window        time.Duration `yaml:"window"`
+	BanDuration   time.Duration `yaml:"banDuration"`
+	// FailedUploads counts uploads refused with a client error, such as a disallowed type.
+	FailedUploads int `yaml:"failedUploads"`
+	// OversizedUploads counts uploads over the maximum upload size or the upload quota.
+	OversizedUploads int `yaml:"oversizedUploads"`
+	// PathTraversals counts requests for paths, or uploads of files, containing "..".
+	PathTraversals int `yaml:"pathTraversals"`
+}
+
+// GeoIPConfig holds the settings for looking up the country of each client, which is added to
+// the logs and metrics, and for allowing or denying requests by it.
+type GeoIPConfig struct {
+	// Database is the path of a MaxMind DB file with country data, such as GeoLite2-Country.mmdb.
+	// Empty disables GeoIP.
+	Database string `yaml:"database"`
+	// Allow, if not empty, admits only requests from these countries, given as ISO 3166-1
+	// alpha-2 codes (e.g. "DE"). Deny refuses requests from its countries.
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	// AllowUnknown admits requests from addresses the database has no country for, such as
+	// private networks.
+	AllowUnknown bool `yaml:"allowUnknown"`
+}
+
+// CSRFConfig holds settings for the cross-site request forgery protection applied
+// to state-changing requests made by browsers.
+type CSRFConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	CookieName string `yaml:"cookieName"`
+	HeaderName string `yaml:"headerName"`
+}
+
+// SessionConfig holds settings for browser login sessions.
+// Store selects where sessions are kept: "memory" (lost on restart), "file" (persisted to the
+// JSON document File) or "sqlite" (kept in the SQLite database File).
+type SessionConfig struct {
+	CookieName      string        `yaml:"cookieName"`
+	Store           string        `yaml:"store"`
+	File            string        `yaml:"file"`
+	IdleTimeout     time.Duration `yaml:"idleTimeout"`
+	AbsoluteTimeout time.Duration `yaml:"absoluteTimeout"`
+}
+
+// StaticUser is a user account defined directly in the configuration file.
+// PasswordHash is a bcrypt hash; the plain-text password is never stored.
+type StaticUser struct {
+	Username     string   `yaml:"username"`
+	PasswordHash string   `yaml:"passwordHash"`
+	Roles        []string `yaml:"roles"`
+}
+
+// APIKey is a static credential for scripts and CI jobs, sent as "Authorization: Bearer <key>"
+// or in the X-API-Key header. Only the hex-encoded SHA-256 hash of the key is configured.
+type APIKey struct {
+	Name   string   `yaml:"name"`
+	SHA256 string   `yaml:"sha256"`
+	Roles  []string `yaml:"roles"`
+}
+
+// SigV4Key is an access key pair for clients that sign requests with AWS Signature Version 4,
+// such as S3 tooling. Unlike an API key, the secret itself must be configured, as verifying a
+// signature means computing it again.
+type SigV4Key struct {
+	Name            string   `yaml:"name"`
+	AccessKeyID     string   `yaml:"accessKeyID"`
+	SecretAccessKey string   `yaml:"secretAccessKey"`
+	Roles           []string `yaml:"roles"`
+}
+
+// AuthConfig holds authentication settings. When Required is false, all endpoints
+// remain open to anonymous clients and logging in is optional.
+type AuthConfig struct {
+	Required   bool            `yaml:"required"`
+	Users      []StaticUser    `yaml:"users"`
+	APIKeys    []APIKey        `yaml:"apiKeys"`
+	SigV4Keys  []SigV4Key      `yaml:"sigV4Keys"`
+	SignedURLs SignedURLConfig `yaml:"signedURLs"`
+}
+
+// SignedURLConfig holds settings for download links signed by another application, in the
+// style of nginx's secure_link: the link's query carries an expiry time (Unix seconds) and an
+// HMAC-SHA256 signature of that time followed by the request path. An empty Secret disables them.
+type SignedURLConfig struct {
+	Secret         string `yaml:"secret"`
+	ExpiresParam   string `yaml:"expiresParam"`
+	SignatureParam string `yaml:"signatureParam"`
+}
+
+// RBACConfig holds role-based access control settings. Roles maps role names to the
+// permissions they grant ("upload", "download", "delete", "admin"), adding to or overriding
+// the built-in admin, uploader and viewer roles. DefaultPermissions apply to callers without
+// any role, including anonymous callers when authentication is not required.
+type RBACConfig struct {
+	Roles              map[string][]string `yaml:"roles"`
+	DefaultPermissions []string            `yaml:"defaultPermissions"`
+}
+
+// ACLRule grants read and write access to everything below a path prefix of the storage
+// directory. Subjects are "*" (anyone, including anonymous clients), "role:<name>", or a
+// username (optionally written as "user:<name>"). An empty list denies everyone.
+type ACLRule struct {
+	Path  string   `yaml:"path"`
+	Read  []string `yaml:"read"`
+	Write []string `yaml:"write"`
+}
+
+// WORMRule makes the files below Path write-once: once stored, they can no longer be
+// overwritten, appended to, moved or deleted through the API until Retention has passed
+// since they were written. A zero Retention keeps them forever. The longest matching Path wins.
+type WORMRule struct {
+	Path      string        `yaml:"path"`
+	Retention time.Duration `yaml:"retention"`
+	// DeleteExpired deletes the files once Retention has passed, in the retention sweep,
+	// for records that must be disposed of as well as kept.
+	DeleteExpired bool `yaml:"deleteExpired"`
+}
+
+// WORMConfig holds the write-once (WORM) rules for compliance storage.
+type WORMConfig struct {
+	Rules []WORMRule `yaml:"rules"`
+	// SweepInterval is how often the files of rules with DeleteExpired set are looked for
+	// and deleted once their retention has passed.
+	SweepInterval time.Duration `yaml:"sweepInterval"`
+}
+
+// IntegrityConfig holds the settings for checking stored files against their recorded
+// checksums, to find those the storage has corrupted. Zero Interval disables the checks.
+type IntegrityConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// MetadataConfig holds settings for the metadata database: the directory of JSON
+// documents in which the server keeps its own state (users, and so on). It should be
+// kept outside the storage directory so that it can never be downloaded.
+type MetadataConfig struct {
+	Dir string `yaml:"dir"`
+	// Xattrs also writes each stored file's ID, checksum and upload fields to its extended
+	// attributes (Linux only), from which they are recovered if the database is lost.
+	Xattrs bool `yaml:"xattrs"`
+}
+
+// Path returns the location of a named document inside the metadata directory.
+func (mc *MetadataConfig) Path(name string) string {
+	return filepath.Join(mc.Dir, name)
+}
+
+// IndexConfig holds settings for the in-memory index of stored files that listings are
+// served from. The server keeps it current itself; RescanInterval controls how often it is
+// rebuilt from disk to pick up files changed by other means. Zero disables rescans.
+type IndexConfig struct {
+	RescanInterval time.Duration `yaml:"rescanInterval"`
+	// Watch also rescans shortly after files are added or removed, using the operating
+	// system's change notifications (Linux only).
+	Watch bool `yaml:"watch"`
+}
+
+// CacheRule sets the Cache-Control header for downloads whose path lies below Path and
+// whose media type matches MIMEType (e.g. "image/png", or "image/*" for a whole family).
+// An empty Path or MIMEType matches everything.
+type CacheRule struct {
+	Path         string `yaml:"path"`
+	MIMEType     string `yaml:"mimeType"`
+	CacheControl string `yaml:"cacheControl"`
+}
+
+// CacheConfig holds the Cache-Control policy for downloads. The first matching rule wins;
+// Default applies when none matches, and no header is sent when it is empty.
+type CacheConfig struct {
+	Default string      `yaml:"default"`
+	Rules   []CacheRule `yaml:"rules"`
+}
+
+// FileCacheConfig holds settings for the in-memory cache of small, frequently downloaded
+// files. Caching is disabled when MaxSizeMB is zero.
+type FileCacheConfig struct {
+	MaxSizeMB  int64 `yaml:"maxSizeMB"`
+	MaxEntryKB int64 `yaml:"maxEntryKB"`
+}
+
+// GetMaxSize returns the total cache size in bytes.
+func (fc *FileCacheConfig) GetMaxSize() int64 {
+	return fc.MaxSizeMB << 20
+}
+
+// GetMaxEntrySize returns the size of the largest cacheable file in bytes.
+func (fc *FileCacheConfig) GetMaxEntrySize() int64 {
+	return fc.MaxEntryKB << 10
+}
+
+// CDNSigningConfig holds settings for issuing signed cookies, with which a CDN serves the
+// files below protected prefixes to the callers allowed to read them. Signing is disabled when
+// Provider is empty.
+type CDNSigningConfig struct {
+	// Provider is "cloudfront" or "akamai".
+	Provider string `yaml:"provider"`
+	// Prefixes lists the storage paths that cookies may be issued for.
+	Prefixes []string      `yaml:"prefixes"`
+	TTL      time.Duration `yaml:"ttl"`
+	// CookieDomain is the Domain of the cookies, such as .example.com, for them to be sent
+	// to the CDN's host as well as this server's; empty means this server's host alone.
+	CookieDomain string `yaml:"cookieDomain"`
+	// KeyPairID and PrivateKeyFile name a CloudFront public key and its RSA private key.
+	KeyPairID      string `yaml:"keyPairID"`
+	PrivateKeyFile string `yaml:"privateKeyFile"`
+	// Key is the hex-encoded Akamai token authentication key, and CookieName the name of
+	// the token cookie.
+	Key        string `yaml:"key"`
+	CookieName string `yaml:"cookieName"`
+}
+
+// CDNPurgeConfig holds settings for sending purge requests to a CDN.
+type CDNPurgeConfig struct {
+	// Provider is "cloudflare", "fastly" or "webhook".
+	Provider string `yaml:"provider"`
+	// ZoneID names the Cloudflare zone.
+	ZoneID string `yaml:"zoneID"`
+	// Token is the Cloudflare API token, or the Fastly API key.
+	Token string `yaml:"token"`
+	// URL receives the URLs to purge, as a JSON POST, for the webhook provider.
+	URL string `yaml:"url"`
+}
+
+// CDNConfig holds settings for serving files through a CDN.
+type CDNConfig struct {
+	// URL is the address the CDN serves this server at, base path included, such as
+	// https://cdn.example.com; the paths of signed cookies and purged files are below it.
+	URL           string           `yaml:"url"`
+	SignedCookies CDNSigningConfig `yaml:"signedCookies"`
+	Purge         []CDNPurgeConfig `yaml:"purge"`
+	// PurgeInterval is how often the files changed meanwhile are purged.
+	PurgeInterval time.Duration `yaml:"purgeInterval"`
+}
+
+// SecurityHeadersConfig holds the security headers added to every response. An empty
+// value disables the header. StrictTransportSecurity is only sent over HTTPS.
+type SecurityHeadersConfig struct {
+	ContentTypeOptions      string `yaml:"contentTypeOptions"`
+	FrameOptions            string `yaml:"frameOptions"`
+	ReferrerPolicy          string `yaml:"referrerPolicy"`
+	ContentSecurityPolicy   string `yaml:"contentSecurityPolicy"`
+	StrictTransportSecurity string `yaml:"strictTransportSecurity"`
+}
+
+// ResponseHeadersRule adds headers to the responses to requests for Path and the paths below
+// it, given without server.basePath, such as "/download/public". Where rules overlap, those
+// of the longer path take precedence. An empty value removes the header, including a
+// security header.
+type ResponseHeadersRule struct {
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// StatsDConfig holds settings for sending metrics to a StatsD or DogStatsD agent.
+// Format is "dogstatsd" (labels become tags) or "statsd" (labels are folded into names).
+type StatsDConfig struct {
+	Enabled       bool          `yaml:"enabled"`
+	Address       string        `yaml:"address"`
+	Prefix        string        `yaml:"prefix"`
+	Format        string        `yaml:"format"`
+	Tags          []string      `yaml:"tags"`
+	FlushInterval time.Duration `yaml:"flushInterval"`
+}
+
+// MetricsConfig holds settings for metrics. Enabled exposes them for Prometheus at /metrics;
+// StatsD pushes the same metric set to an agent instead or as well.
+type MetricsConfig struct {
+	Enabled bool         `yaml:"enabled"`
+	StatsD  StatsDConfig `yaml:"statsd"`
+}
+
+// ErrorReportingConfig holds settings for sending panics and internal errors to a
+// Sentry-compatible error tracker. Reporting is disabled when DSN is empty.
+type ErrorReportingConfig struct {
+	DSN         string `yaml:"dsn"`
+	Environment string `yaml:"environment"`
+}
+
+// EmailConfig holds settings for emailing a list of recipients about new uploads.
+// Email is disabled when Host is empty.
+type EmailConfig struct {
+	Host string `yaml:"host"`
+	Port int    `yaml:"port"`
+	// Security is "starttls" (upgrade the connection, refusing servers that cannot),
+	// "tls" (connect over TLS, usually on port 465) or "none".
+	Security string   `yaml:"security"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	// Paths limits the emails to uploads at or below these storage paths; empty means all.
+	Paths []string `yaml:"paths"`
+	// Subject and Body are text/template templates; see the README for the fields.
+	Subject string `yaml:"subject"`
+	Body    string `yaml:"body"`
+}
+
+// ChatConfig holds settings for posting file events to a chat channel.
+type ChatConfig struct {
+	// Type is "slack", "mattermost" or "telegram".
+	Type string `yaml:"type"`
+	// WebhookURL is the incoming webhook of a Slack or Mattermost channel.
+	WebhookURL string `yaml:"webhookURL"`
+	// BotToken and ChatID name the Telegram bot that posts and the chat it posts to.
+	BotToken string `yaml:"botToken"`
+	ChatID   string `yaml:"chatID"`
+	// Events lists "upload", "modify" (partial writes and appends), "delete" and "lowSpace",
+	// the disk falling below uploader.minFreeSpaceMB; empty means all but "modify".
+	Events []string `yaml:"events"`
+	// Paths limits the messages to files at or below these storage paths; empty means all.
+	Paths []string `yaml:"paths"`
+}
+
+// PublishConfig holds settings for publishing file events as JSON messages to a message
+// broker. Publishing is disabled when Broker is empty.
+type PublishConfig struct {
+	// Broker is "nats" or "kafka".
+	Broker string `yaml:"broker"`
+	// Addresses lists the servers to connect to; the first reachable one is used.
+	Addresses []string `yaml:"addresses"`
+	// Topic is the NATS subject or Kafka topic the events are published to.
+	Topic string `yaml:"topic"`
+	// JetStream waits for each NATS message to be stored by a JetStream stream, rather than
+	// only for the server to have received it.
+	JetStream bool `yaml:"jetStream"`
+	TLS       bool `yaml:"tls"`
+	// Username and Password authenticate with NATS, or with Kafka using SASL/PLAIN.
+	// Token authenticates with NATS instead.
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Token    string `yaml:"token"`
+	// Events lists "upload", "modify", "delete" and "lowSpace"; empty means uploads,
+	// modifications and deletes.
+	Events []string `yaml:"events"`
+	// Paths limits the events to files at or below these storage paths; empty means all.
+	Paths []string `yaml:"paths"`
+	// MaxQueued bounds the events kept for delivery whilst the broker is unreachable.
+	MaxQueued int `yaml:"maxQueued"`
+}
+
+// NotificationsConfig holds settings for telling people and systems about file events.
+type NotificationsConfig struct {
+	Email   EmailConfig   `yaml:"email"`
+	Chat    []ChatConfig  `yaml:"chat"`
+	Publish PublishConfig `yaml:"publish"`
+}
+
+// SyslogConfig holds settings for the syslog log output.
+type SyslogConfig struct {
+	// Network is "udp" or "tcp" for a remote daemon; empty selects the local one.
+	Network  string `yaml:"network"`
+	Address  string `yaml:"address"`
+	Facility string `yaml:"facility"`
+	// Tag identifies the server's messages in syslog and in the journal.
+	Tag string `yaml:"tag"`
+}
+
+// LoggingConfig holds settings for where log messages are written.
+type LoggingConfig struct {
+	// Outputs lists any of "stdout", "file", "syslog" and "journald".
+	Outputs []string     `yaml:"outputs"`
+	File    string       `yaml:"file"`
+	Syslog  SyslogConfig `yaml:"syslog"`
+}
+
+// AuditConfig holds the settings for the audit log, a record of every request that may change
+// something, kept as audit.log in the metadata directory.
+type AuditConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxSizeMB is the size at which the log is renamed audit.log.1, replacing the previous
+	// one, and a new one begun; 0 lets it grow without limit.
+	MaxSizeMB int64 `yaml:"maxSizeMB"`
+}
+
+// GetMaxSize returns the size at which the log is rotated, in bytes.
+func (ac *AuditConfig) GetMaxSize() int64 {
+	return ac.MaxSizeMB << 20
+}
+
+// DebugCaptureConfig holds the settings for recording the headers of a sample of requests,
+// and a summary of the parts of their multipart bodies, for troubleshooting clients. Admins
+// can change them at run time through the API.
+type DebugCaptureConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// SampleRate is the share of requests recorded, from 0 to 1.
+	SampleRate float64 `yaml:"sampleRate"`
+	// Size is the number of requests kept; the oldest are discarded to make room.
+	Size int `yaml:"size"`
+	// Paths, if not empty, limits recording to requests for paths starting with one of them.
+	Paths []string `yaml:"paths"`
+}
+
+// FaultsConfig holds the settings for injecting slow writes and write errors into stored
+// files, for testing clients and the server's clean-up against failing disks. Never enable
+// it in production.
+type FaultsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Seed seeds the draws of the rules with a rate, so that runs are repeatable.
+	Seed  uint64      `yaml:"seed"`
+	Rules []FaultRule `yaml:"rules"`
+}
+
+// FaultRule injects faults into the writes of the files whose storage names start with one
+// of Paths, or of every file if Paths is empty. The first rule that matches a file applies.
+type FaultRule struct {
+	Paths []string `yaml:"paths"`
+	// WriteDelay is slept before each write, of up to 1 MB, to simulate a slow disk.
+	WriteDelay time.Duration `yaml:"writeDelay"`
+	// Error is "nospace" (ENOSPC) or "io" (EIO); it is returned once AfterBytes bytes of the
+	// file have been written. Empty injects no error.
+	Error      string `yaml:"error"`
+	AfterBytes int64  `yaml:"afterBytes"`
+	// Rate is the share of the matching files affected, from 0 to 1; 0 affects them all.
+	Rate float64 `yaml:"rate"`
+}
+
+// ProcessConfig holds settings for running the server from an init script or as a daemon.
+type ProcessConfig struct {
+	// PIDFile, if set, receives the server's process ID whilst it runs.
+	PIDFile string `yaml:"pidFile"`
+	// WorkingDir, if set, is changed to after the configuration is loaded, so that relative
+	// paths in it resolve against this directory.
+	WorkingDir string `yaml:"workingDir"`
+	// User and Group, if set, are switched to once the listening port is bound (Unix only).
+	// Group defaults to the user's primary group.
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
 }
 
 // Config is the root structure that encapsulates all application settings.
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	Uploader UploaderConfig `yaml:"uploader"`
+	Server          ServerConfig          `yaml:"server"`
+	Uploader        UploaderConfig        `yaml:"uploader"`
+	Validation      ValidationConfig      `yaml:"validation"`
+	UploadQuota     UploadQuotaConfig     `yaml:"uploadQuota"`
+	DirQuotas       []DirQuotaConfig      `yaml:"dirQuotas"`
+	Eviction        EvictionConfig        `yaml:"eviction"`
+	Shards          []ShardConfig         `yaml:"shards"`
+	Tenancy         TenancyConfig         `yaml:"tenancy"`
+	HiddenFiles     HiddenFilesConfig     `yaml:"hiddenFiles"`
+	GeoIP           GeoIPConfig           `yaml:"geoIP"`
+	Abuse           AbuseConfig           `yaml:"abuse"`
+	Processing      ProcessingConfig      `yaml:"processing"`
+	Video           VideoConfig           `yaml:"video"`
+	Conversion      ConversionConfig      `yaml:"conversion"`
+	Viewer          ViewerConfig          `yaml:"viewer"`
+	Editor          EditorConfig          `yaml:"editor"`
+	ParallelUploads ParallelUploadsConfig `yaml:"parallelUploads"`
+	Paste           PasteConfig           `yaml:"paste"`
+	Fetch           FetchConfig           `yaml:"fetch"`
+	Mirror          MirrorConfig          `yaml:"mirror"`
+	Cluster         ClusterConfig         `yaml:"cluster"`
+	Replica         ReplicaConfig         `yaml:"replica"`
+	Coordination    CoordinationConfig    `yaml:"coordination"`
+	Leader          LeaderConfig          `yaml:"leader"`
+	Index           IndexConfig           `yaml:"index"`
+	Cache           CacheConfig           `yaml:"cache"`
+	FileCache       FileCacheConfig       `yaml:"fileCache"`
+	CDN             CDNConfig             `yaml:"cdn"`
+	SecurityHeaders SecurityHeadersConfig `yaml:"securityHeaders"`
+	ResponseHeaders []ResponseHeadersRule `yaml:"responseHeaders"`
+	CSRF            CSRFConfig            `yaml:"csrf"`
+	Session         SessionConfig         `yaml:"session"`
+	Auth            AuthConfig            `yaml:"auth"`
+	Metadata        MetadataConfig        `yaml:"metadata"`
+	ACL             []ACLRule             `yaml:"acl"`
+	WORM            WORMConfig            `yaml:"worm"`
+	Integrity       IntegrityConfig       `yaml:"integrity"`
+	RBAC            RBACConfig            `yaml:"rbac"`
+	Metrics         MetricsConfig         `yaml:"metrics"`
+	ErrorReporting  ErrorReportingConfig  `yaml:"errorReporting"`
+	Notifications   NotificationsConfig   `yaml:"notifications"`
+	Logging         LoggingConfig         `yaml:"logging"`
+	Audit           AuditConfig           `yaml:"audit"`
+	DebugCapture    DebugCaptureConfig    `yaml:"debugCapture"`
+	Faults          FaultsConfig          `yaml:"faults"`
+	Process         ProcessConfig         `yaml:"process"`
+}
+
+// GetBasePath returns the normalised route prefix under which all endpoints are mounted.
+// The result always starts with a slash and never ends with one, so it can be prepended
+// directly to route paths. An empty string is returned when the server is mounted at the root.
+func (sc *ServerConfig) GetBasePath() string {
+	if sc.BasePath == "" {
+		return ""
+	}
+	p := path.Clean("/" + sc.BasePath)
+	if p == "/" {
+		return ""
+	}
+	return p
 }
 
 // GetMaxUploadSize returns the maximum permitted upload size in bytes.
@@ -36,45 +938,255 @@ func (uc *UploaderConfig) GetMaxUploadSize() int64 {
 	return uc.MaxUploadSizeMB << 20
 }
 
+// GetMaxFileSize returns the maximum size of a single uploaded file in bytes, which is the
+// maximum upload size unless MaxFileSizeMB sets a smaller one.
+func (uc *UploaderConfig) GetMaxFileSize() int64 {
+	if uc.MaxFileSizeMB > 0 && uc.MaxFileSizeMB < uc.MaxUploadSizeMB {
+		return uc.MaxFileSizeMB << 20
+	}
+	return uc.GetMaxUploadSize()
+}
+
 // GetMaxFormMemSize returns the maximum memory to use for multipart form parsing in bytes.
 // It converts the megabyte value from the configuration into bytes.
 func (uc *UploaderConfig) GetMaxFormMemSize() int64 {
 	return uc.MaxFormMemSizeMB << 20
 }
 
+// DateDir returns the directory an upload arriving at t is filed into, as set by DateDirs,
+// or "" if uploads are not filed by date.
+func (uc *UploaderConfig) DateDir(t time.Time) string {
+	if uc.DateDirs == "" {
+		return ""
+	}
+	return strings.NewReplacer(
+		"{year}", t.Format("2006"),
+		"{month}", t.Format("01"),
+		"{day}", t.Format("02"),
+		"{hour}", t.Format("15"),
+	).Replace(uc.DateDirs)
+}
+
+// StoredName returns the name a file uploaded as original at t is stored under, as set by
+// NameTemplate, with id for {uuid}.
+func (uc *UploaderConfig) StoredName(original string, t time.Time, id string) string {
+	if uc.NameTemplate == "" {
+		return original
+	}
+	ext := path.Ext(original)
+	return strings.NewReplacer(
+		"{original}", original,
+		"{name}", strings.TrimSuffix(original, ext),
+		"{ext}", ext,
+		"{date}", t.Format("2006-01-02"),
+		"{time}", t.Format("150405"),
+		"{uuid}", id,
+	).Replace(uc.NameTemplate)
+}
+
 // NewConfig loads the application configuration from the specified YAML file path.
 // If the file does not exist, it logs a warning and returns a default configuration.
 // It returns an error for any other file access or parsing issues.
 func NewConfig(path string, logger *log.Logger) (*Config, error) {
 	// Initialise with default values, which will be used if the config file is not found.
-	var cfg = Config{
+	cfg := Default()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			// Any other error (e.g., permissions) is considered fatal.
+			return nil, err
+		}
+		logger.Printf("warn: config file '%s' not found, using default settings.\n", path)
+	} else if err = yaml.Unmarshal(data, cfg); err != nil {
+		// If the file exists, its content is unmarshalled over the default configuration.
+		return nil, err
+	}
+
+	// Why environment variables over the file? Containers and CI set a few settings per
+	// deployment, such as the address or a secret, whilst sharing one file.
+	if err := cfg.ApplyEnv(os.Environ(), logger); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Default returns the configuration used where the configuration file does not set a value.
+func Default() *Config {
+	return &Config{
 		Server: ServerConfig{
 			Addr:         ":8090",
+			ErrorFormat:  "auto",
 			ReadTimeout:  5 * time.Second,
 			WriteTimeout: 10 * time.Second,
 			IdleTimeout:  30 * time.Second,
+			StallTimeout: 30 * time.Second,
 		},
 		Uploader: UploaderConfig{
 			StorageDir:       "storage",
 			MaxUploadSizeMB:  3072,
 			MaxFormMemSizeMB: 32,
+			MetadataFields:   []string{"description"},
+			Symlinks:         "follow",
+			UID:              -1,
+			GID:              -1,
+		},
+		UploadQuota: UploadQuotaConfig{
+			Window: 24 * time.Hour,
+		},
+		HiddenFiles: HiddenFilesConfig{
+			Dotfiles: true,
+		},
+		GeoIP: GeoIPConfig{
+			AllowUnknown: true,
+		},
+		Abuse: AbuseConfig{
+			AnonymousOnly:    true,
+			Window:           10 * time.Minute,
+			BanDuration:      time.Hour,
+			FailedUploads:    20,
+			OversizedUploads: 5,
+			PathTraversals:   3,
+		},
+		Processing: ProcessingConfig{
+			Async:      "off",
+			Workers:    4,
+			QueueDepth: 100,
+			JobTimeout: 10 * time.Minute,
+		},
+		Video: VideoConfig{
+			Timeout: time.Minute,
+		},
+		Conversion: ConversionConfig{
+			Format:     "pdf",
+			Extensions: []string{"doc", "docx", "odt", "rtf", "xls", "xlsx", "ods", "ppt", "pptx", "odp"},
+			Timeout:    2 * time.Minute,
+		},
+		Editor: EditorConfig{
+			MaxSizeKB: 1024,
+		},
+		ParallelUploads: ParallelUploadsConfig{
+			Expiry: 24 * time.Hour,
+		},
+		Paste: PasteConfig{
+			Dir:       "pastes",
+			MaxSizeKB: 1024,
+		},
+		Fetch: FetchConfig{
+			Schemes: []string{"https"},
+			Timeout: time.Hour,
+		},
+		Mirror: MirrorConfig{
+			Timeout: time.Hour,
+		},
+		Cluster: ClusterConfig{
+			Mode:         "redirect",
+			VirtualNodes: 100,
+		},
+		Coordination: CoordinationConfig{
+			Prefix: "fileserver/",
+			TTL:    15 * time.Second,
+		},
+		Leader: LeaderConfig{
+			Interval: 10 * time.Second,
+		},
+		WORM: WORMConfig{
+			SweepInterval: time.Hour,
+		},
+		Eviction: EvictionConfig{
+			HighWatermark: 90,
+			LowWatermark:  80,
+			Interval:      time.Minute,
+		},
+		Tenancy: TenancyConfig{
+			Dir: "tenants",
+		},
+		Index: IndexConfig{
+			RescanInterval: 5 * time.Minute,
+			Watch:          true,
+		},
+		FileCache: FileCacheConfig{
+			MaxEntryKB: 256,
+		},
+		CDN: CDNConfig{
+			SignedCookies: CDNSigningConfig{
+				TTL:        time.Hour,
+				CookieName: "__token__",
+			},
+			PurgeInterval: 5 * time.Second,
+		},
+		SecurityHeaders: SecurityHeadersConfig{
+			ContentTypeOptions:      "nosniff",
+			FrameOptions:            "DENY",
+			ReferrerPolicy:          "no-referrer",
+			ContentSecurityPolicy:   "default-src 'none'; style-src 'unsafe-inline'; frame-ancestors 'none'",
+			StrictTransportSecurity: "max-age=31536000; includeSubDomains",
+		},
+		Metrics: MetricsConfig{
+			StatsD: StatsDConfig{
+				Address:       "127.0.0.1:8125",
+				Prefix:        "fileserver.",
+				Format:        "dogstatsd",
+				FlushInterval: time.Second,
+			},
+		},
+		ErrorReporting: ErrorReportingConfig{
+			Environment: "production",
+		},
+		Notifications: NotificationsConfig{
+			Email: EmailConfig{
+				Port:     587,
+				Security: "starttls",
+				Subject:  "New upload: {{.Name}}",
+				Body:     "{{.User}} uploaded {{.Name}} ({{.Size}} bytes) at {{.Time.Format \"2006-01-02 15:04:05 MST\"}}.\n",
+			},
+			Publish: PublishConfig{
+				Topic:     "fileserver.events",
+				MaxQueued: 10000,
+			},
+		},
+		Logging: LoggingConfig{
+			Outputs: []string{"stdout", "file"},
+			File:    "server.log",
+			Syslog: SyslogConfig{
+				Facility: "daemon",
+				Tag:      "fileserver",
+			},
+		},
+		Audit: AuditConfig{
+			Enabled:   true,
+			MaxSizeMB: 100,
+		},
+		DebugCapture: DebugCaptureConfig{
+			SampleRate: 1,
+			Size:       100,
+		},
+		Faults: FaultsConfig{
+			Seed: 1,
+		},
+		CSRF: CSRFConfig{
+			Enabled:    true,
+			CookieName: "fileserver_csrf",
+			HeaderName: "X-CSRF-Token",
+		},
+		Session: SessionConfig{
+			CookieName:      "fileserver_session",
+			Store:           "memory",
+			File:            "sessions.json",
+			IdleTimeout:     30 * time.Minute,
+			AbsoluteTimeout: 12 * time.Hour,
+		},
+		Metadata: MetadataConfig{
+			Dir: "metadata",
+		},
+		Auth: AuthConfig{
+			SignedURLs: SignedURLConfig{
+				ExpiresParam:   "expires",
+				SignatureParam: "signature",
+			},
+		},
+		RBAC: RBACConfig{
+			DefaultPermissions: []string{"upload", "download"},
 		},
 	}
-
-	data, err := os.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			logger.Printf("warn: config file '%s' not found, using default settings.\n", path)
-			return &cfg, nil
-		}
-		// Any other error (e.g., permissions) is considered fatal.
-		return nil, err
-	}
-
-	// If the file exists, unmarshal its content over the default configuration.
-	if err = yaml.Unmarshal(data, &cfg); err != nil {
-		return nil, err
-	}
-
-	return &cfg, nil
 }
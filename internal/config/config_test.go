@@ -0,0 +1,84 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGetBasePath(t *testing.T) {
+	tests := []struct {
+		basePath string
+		want     string
+	}{
+		{"", ""},
+		{"/", ""},
+		{"files", "/files"},
+		{"/files", "/files"},
+		{"/files/", "/files"},
+		{"//files//share/", "/files/share"},
+		{"/files/../share", "/share"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.basePath, func(t *testing.T) {
+			sc := ServerConfig{BasePath: tt.basePath}
+			if got := sc.GetBasePath(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDateDir(t *testing.T) {
+	at := time.Date(2026, time.October, 5, 7, 30, 0, 0, time.UTC)
+	tests := []struct {
+		dateDirs string
+		want     string
+	}{
+		{"", ""},
+		{"{year}/{month}/{day}", "2026/10/05"},
+		{"{year}-{month}/{day}T{hour}", "2026-10/05T07"},
+		{"incoming", "incoming"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dateDirs, func(t *testing.T) {
+			uc := UploaderConfig{DateDirs: tt.dateDirs}
+			if got := uc.DateDir(at); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStoredName(t *testing.T) {
+	at := time.Date(2026, time.October, 5, 7, 30, 9, 0, time.UTC)
+	tests := []struct {
+		template string
+		original string
+		want     string
+	}{
+		{"", "image.jpg", "image.jpg"},
+		{"{date}-{uuid}-{original}", "image.jpg", "2026-10-05-id-image.jpg"},
+		{"{name}_{time}{ext}", "image.jpg", "image_073009.jpg"},
+		{"{name}_{time}{ext}", "archive.tar.gz", "archive.tar_073009.gz"},
+		{"{name}-{uuid}{ext}", "README", "README-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template+" "+tt.original, func(t *testing.T) {
+			uc := UploaderConfig{NameTemplate: tt.template}
+			if got := uc.StoredName(tt.original, at, "id"); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvictionWatermarks(t *testing.T) {
+	ec := Default().Eviction
+	ec.MaxSizeMB = 1000
+	if got, want := ec.GetHighWatermark(), int64(900<<20); got != want {
+		t.Errorf("got high watermark %d, want %d", got, want)
+	}
+	if got, want := ec.GetLowWatermark(), int64(800<<20); got != want {
+		t.Errorf("got low watermark %d, want %d", got, want)
+	}
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// EnvPrefix starts the names of the environment variables that override settings of the
+// configuration file: FILESERVER_SERVER_ADDRESS sets server.address, and
+// FILESERVER_UPLOADER_MAXUPLOADSIZEMB sets uploader.maxUploadSizeMB.
+const EnvPrefix = "FILESERVER_"
+
+// ErrUnknownSetting is reported by Set for keys that name no setting.
+var ErrUnknownSetting = errors.New("unknown setting")
+
+// Set sets the setting at key, the names of its sections and its own joined by dots, such as
+// "uploader.maxUploadSizeMB", to value, written as it would be in the configuration file:
+// "[a, b]" for a list, "1m" for a duration. Names are not case sensitive. Settings made of
+// others, such as a list of rules, are replaced as a whole.
+func (c *Config) Set(key, value string) error {
+	_, err := c.set(key, value)
+	return err
+}
+
+// set is Set, returning key as the configuration file spells it.
+func (c *Config) set(key, value string) (string, error) {
+	v := reflect.ValueOf(c).Elem()
+	var names []string
+	for name := range strings.SplitSeq(key, ".") {
+		f, tag, ok := fieldByTag(v, name)
+		if !ok {
+			return "", fmt.Errorf("%w %q", ErrUnknownSetting, key)
+		}
+		v = f
+		names = append(names, tag)
+	}
+	key = strings.Join(names, ".")
+	// Why set strings directly? Parsed as YAML, values such as "0750" or "yes" would be
+	// read as numbers or booleans first, and "#" would start a comment.
+	if v.Kind() == reflect.String {
+		v.SetString(value)
+		return key, nil
+	}
+	if value == "" {
+		v.SetZero()
+		return key, nil
+	}
+	p := reflect.New(v.Type())
+	if err := yaml.Unmarshal([]byte(value), p.Interface()); err != nil {
+		return "", fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	v.Set(p.Elem())
+	return key, nil
+}
+
+// fieldByTag returns the field of the struct v with the YAML name name, in any case, and the
+// name as its tag spells it.
+func fieldByTag(v reflect.Value, name string) (reflect.Value, string, bool) {
+	if v.Kind() != reflect.Struct {
+		return reflect.Value{}, "", false
+	}
+	for i := range v.NumField() {
+		f := v.Type().Field(i)
+		tag, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if f.IsExported() && tag != "" && tag != "-" && strings.EqualFold(tag, name) {
+			return v.Field(i), tag, true
+		}
+	}
+	return reflect.Value{}, "", false
+}
+
+// ApplyEnv overrides the settings named by the variables in environ, in the form os.Environ
+// returns them, whose names start with EnvPrefix, logging each. The sections and the setting
+// are separated by underscores, which no setting's name has.
+//
+// Why are variables that name no setting only logged? The client commands read others, such
+// as FILESERVER_API_KEY, from the same environment.
+func (c *Config) ApplyEnv(environ []string, logger *log.Logger) error {
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		rest, ok := strings.CutPrefix(name, EnvPrefix)
+		if !ok || rest == "" {
+			continue
+		}
+		key, err := c.set(strings.ReplaceAll(rest, "_", "."), value)
+		if errors.Is(err, ErrUnknownSetting) {
+			logger.Printf("environment variable %s names no setting, and is ignored\n", name)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("environment variable %s: %w", name, err)
+		}
+		logger.Printf("setting %s from environment variable %s\n", key, name)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSet(t *testing.T) {
+	tests := []struct {
+		key, value string
+		get        func(*Config) any
+		want       any
+	}{
+		{"server.address", ":9090", func(c *Config) any { return c.Server.Addr }, ":9090"},
+		{"uploader.dirMode", "0750", func(c *Config) any { return c.Uploader.DirMode }, "0750"},
+		{"uploader.maxUploadSizeMB", "1024", func(c *Config) any { return c.Uploader.MaxUploadSizeMB }, int64(1024)},
+		{"UPLOADER.MAXUPLOADSIZEMB", "2048", func(c *Config) any { return c.Uploader.MaxUploadSizeMB }, int64(2048)},
+		{"server.readTimeout", "1m", func(c *Config) any { return c.Server.ReadTimeout }, time.Minute},
+		{"server.secureCookies", "true", func(c *Config) any { return c.Server.SecureCookies }, true},
+		{"uploader.metadataFields", "[title, author]", func(c *Config) any { return c.Uploader.MetadataFields }, []string{"title", "author"}},
+		{"uploader.metadataFields", "", func(c *Config) any { return c.Uploader.MetadataFields }, []string(nil)},
+		{"worm.rules", "[{path: /records, retention: 24h}]", func(c *Config) any { return c.WORM.Rules }, []WORMRule{{Path: "/records", Retention: 24 * time.Hour}}},
+	}
+	for _, tt := range tests {
+		cfg := Default()
+		if err := cfg.Set(tt.key, tt.value); err != nil {
+			t.Errorf("Set(%q, %q): %v", tt.key, tt.value, err)
+			continue
+		}
+		if got := tt.get(cfg); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Set(%q, %q) set %#v, want %#v", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestSetInvalid(t *testing.T) {
+	tests := []struct {
+		key, value string
+		unknown    bool
+	}{
+		{"server.port", "80", true},
+		{"server.address.host", "x", true},
+		{"server.readTimeout", "soon", false},
+		{"uploader.maxUploadSizeMB", "big", false},
+	}
+	for _, tt := range tests {
+		err := Default().Set(tt.key, tt.value)
+		if err == nil || errors.Is(err, ErrUnknownSetting) != tt.unknown {
+			t.Errorf("Set(%q, %q) = %v, want an error, unknown setting %v", tt.key, tt.value, err, tt.unknown)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	var logs bytes.Buffer
+	cfg := Default()
+	err := cfg.ApplyEnv([]string{
+		"PATH=/usr/bin",
+		"FILESERVER_SERVER_ADDRESS=:9090",
+		"FILESERVER_UPLOADER_MAXUPLOADSIZEMB=1024",
+		"FILESERVER_API_KEY=secret",
+		"FILESERVER_=x",
+	}, log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Addr != ":9090" || cfg.Uploader.MaxUploadSizeMB != 1024 {
+		t.Errorf("address %q and maximum upload size %d, want :9090 and 1024", cfg.Server.Addr, cfg.Uploader.MaxUploadSizeMB)
+	}
+	for _, want := range []string{
+		"setting server.address from environment variable FILESERVER_SERVER_ADDRESS",
+		"setting uploader.maxUploadSizeMB from environment variable FILESERVER_UPLOADER_MAXUPLOADSIZEMB",
+		"FILESERVER_API_KEY names no setting",
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("the log does not say %q:\n%s", want, logs.String())
+		}
+	}
+
+	err = Default().ApplyEnv([]string{"FILESERVER_SERVER_READTIMEOUT=soon"}, log.New(&logs, "", 0))
+	if err == nil || !strings.Contains(err.Error(), "FILESERVER_SERVER_READTIMEOUT") {
+		t.Errorf("ApplyEnv = %v, want an error naming the variable", err)
+	}
+}
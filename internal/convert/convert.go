@@ -0,0 +1,312 @@
+// Package convert turns office documents into PDF or HTML with an external converter, so
+// that they can be previewed in the browser, and keeps the results.
+package convert
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// Converter converts the document at src into the format it was set up for, writing the
+// result to dst.
+type Converter interface {
+	Convert(ctx context.Context, src, dst string) error
+}
+
+// commandConverter runs a command, such as unoconv, for each document.
+type commandConverter struct {
+	args []string // with "{input}" and "{output}" standing for the paths
+}
+
+func (c commandConverter) Convert(ctx context.Context, src, dst string) error {
+	args := make([]string, len(c.args))
+	for i, arg := range c.args {
+		arg = strings.ReplaceAll(arg, "{input}", src)
+		args[i] = strings.ReplaceAll(arg, "{output}", dst)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, lastLine(msg))
+		}
+		return err
+	}
+	if _, err := os.Stat(dst); err != nil {
+		return errors.New("converter produced no output")
+	}
+	return nil
+}
+
+// httpConverter posts each document to a conversion service.
+//
+// Why a multipart form with a "files" field? It is what Gotenberg, the usual service for this,
+// expects, and simple enough for anything else to accept.
+type httpConverter struct {
+	url    string
+	client *http.Client
+}
+
+func (c httpConverter) Convert(ctx context.Context, src, dst string) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Streamed through a pipe, so a large document is never held in memory.
+	pr, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		part, err := form.CreateFormFile("files", filepath.Base(src))
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, pr)
+	if err != nil {
+		pr.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("converter answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, resp.Body)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// lastLine returns the last line of msg, which is where tools explain why they failed.
+func lastLine(msg string) string {
+	lines := strings.Split(msg, "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// Previews converts documents on request and keeps the results, by the checksum of the
+// document, in a directory of their own. A nil *Previews, for a server without a converter,
+// converts nothing.
+//
+// Why convert on request rather than on upload? Most documents are never previewed, and
+// converting office formats is slow; the first preview of a document pays for it instead.
+type Previews struct {
+	converter  Converter
+	format     string
+	extensions map[string]bool
+	timeout    time.Duration
+	dir        string
+	storage    storage.Disk
+	logger     *log.Logger
+
+	mu       sync.Mutex
+	inflight map[string]*conversion // keyed by checksum
+
+	// ctx is cancelled by Close, to stop the conversions in progress, which wg waits for.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// conversion is a conversion in progress, which requests for the same document wait for.
+type conversion struct {
+	done chan struct{}
+	err  error
+}
+
+// New returns previews as configured by cfg, kept in dir, for the documents stored in st. It
+// returns nil if no converter is configured. As the converter is given the documents' paths,
+// they must be stored on disk.
+func New(cfg config.ConversionConfig, dir string, st storage.Storage, logger *log.Logger) (*Previews, error) {
+	var converter Converter
+	switch {
+	case len(cfg.Command) > 0 && cfg.URL != "":
+		return nil, errors.New("conversion.command and conversion.url cannot both be set")
+	case len(cfg.Command) > 0:
+		converter = commandConverter{args: cfg.Command}
+	case cfg.URL != "":
+		converter = httpConverter{url: cfg.URL, client: &http.Client{}}
+	default:
+		return nil, nil
+	}
+	if cfg.Format != "pdf" && cfg.Format != "html" {
+		return nil, fmt.Errorf("invalid conversion.format %q: must be pdf or html", cfg.Format)
+	}
+	disk, ok := st.(storage.Disk)
+	if !ok {
+		return nil, fmt.Errorf("document previews: %w", storage.ErrNotOnDisk)
+	}
+	extensions := make(map[string]bool, len(cfg.Extensions))
+	for _, ext := range cfg.Extensions {
+		extensions[strings.ToLower("."+strings.TrimPrefix(ext, "."))] = true
+	}
+	p := &Previews{
+		converter:  converter,
+		format:     cfg.Format,
+		extensions: extensions,
+		timeout:    cfg.Timeout,
+		dir:        dir,
+		storage:    disk,
+		logger:     logger,
+		inflight:   make(map[string]*conversion),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	return p, nil
+}
+
+// Close stops the conversions in progress, and waits for them to give up. It is called once
+// the requests for previews have completed.
+func (p *Previews) Close() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	p.wg.Wait()
+}
+
+// Convertible reports whether the file stored at name can be previewed.
+func (p *Previews) Convertible(name string) bool {
+	return p != nil && p.extensions[strings.ToLower(path.Ext(name))]
+}
+
+// MediaType returns the media type of the previews.
+func (p *Previews) MediaType() string {
+	if p.format == "html" {
+		return "text/html; charset=utf-8"
+	}
+	return "application/pdf"
+}
+
+// Extension returns the file name extension of the previews, e.g. ".pdf".
+func (p *Previews) Extension() string {
+	return "." + p.format
+}
+
+// Get returns the path of the preview of the document stored at name, whose checksum is sum,
+// converting it first unless that has been done before. Requests for a document that is
+// being converted wait for that conversion rather than starting another.
+func (p *Previews) Get(ctx context.Context, name, sum string) (string, error) {
+	dst := filepath.Join(p.dir, sum+p.Extension())
+	if _, err := os.Stat(dst); err == nil {
+		return dst, nil
+	}
+
+	p.mu.Lock()
+	c, ok := p.inflight[sum]
+	if !ok {
+		c = &conversion{done: make(chan struct{})}
+		p.inflight[sum] = c
+		// Why not tie the conversion to the request? Another request may be waiting for it,
+		// and a client that gave up can still find the result when it comes back.
+		p.wg.Go(func() {
+			c.err = p.convert(name, dst)
+			p.mu.Lock()
+			delete(p.inflight, sum)
+			p.mu.Unlock()
+			close(c.done)
+		})
+	}
+	p.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return dst, c.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// convert converts the document stored at name to dst.
+func (p *Previews) convert(name, dst string) error {
+	src, err := filepath.Abs(p.storage.Path(name))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return err
+	}
+	ctx := p.ctx
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+
+	// Converted to a temporary file first, so that a failed or interrupted conversion is never
+	// served as the preview. The extension is kept, as converters go by it.
+	tmp := strings.TrimSuffix(dst, p.Extension()) + ".tmp" + p.Extension()
+	defer os.Remove(tmp)
+	start := time.Now()
+	if err := p.converter.Convert(ctx, src, tmp); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("conversion timed out after %s", p.timeout)
+		}
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	p.logger.Printf("converted '%s' to %s in %s\n", name, p.format, time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// Prune removes the previews of documents whose checksum is not in keep, such as those
+// deleted or replaced since.
+func (p *Previews) Prune(keep map[string]bool) {
+	if p == nil {
+		return
+	}
+	entries, err := os.ReadDir(p.dir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			p.logger.Printf("error reading previews: %v\n", err)
+		}
+		return
+	}
+	pruned := 0
+	for _, e := range entries {
+		sum, _, _ := strings.Cut(e.Name(), ".")
+		if !keep[sum] || path.Ext(e.Name()) != p.Extension() || strings.Contains(e.Name(), ".tmp.") {
+			os.Remove(filepath.Join(p.dir, e.Name()))
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		p.logger.Printf("pruned %d document previews\n", pruned)
+	}
+}
@@ -0,0 +1,223 @@
+package coord
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// consul is a Backend on Consul's KV store. The session is a Consul session, which the
+// membership key and the lock keys are acquired with, and which deletes them when it ends.
+type consul struct {
+	endpoint string
+	token    string
+	prefix   string
+	ttl      time.Duration
+	client   *http.Client
+	logger   *log.Logger
+	stop     chan struct{} // closed by Close
+	done     chan struct{} // closed once keepAlive returns
+
+	mu      sync.Mutex
+	session string
+	joined  *Node // rejoined under a new session should the old one expire
+}
+
+func newConsul(endpoint, token, prefix string, ttl time.Duration, client *http.Client, logger *log.Logger) (*consul, error) {
+	c := &consul{endpoint: endpoint, token: token, prefix: prefix, ttl: ttl, client: client, logger: logger, stop: make(chan struct{}), done: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := c.create(ctx); err != nil {
+		return nil, fmt.Errorf("connecting to Consul at %s: %w", endpoint, err)
+	}
+	go keepAlive(ttl, c.stop, c.done, c.renew, logger)
+	return c, nil
+}
+
+// create starts a new session.
+func (c *consul) create(ctx context.Context) error {
+	req := map[string]any{"Name": "fileserver", "TTL": c.ttl.String(), "Behavior": "delete", "LockDelay": "0s"}
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	if _, err := c.call(ctx, http.MethodPut, "/v1/session/create", req, &resp); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.session = resp.ID
+	c.mu.Unlock()
+	return nil
+}
+
+// renew keeps the session alive, or starts a new one, and joins again, if it has expired.
+func (c *consul) renew(ctx context.Context) error {
+	status, err := c.call(ctx, http.MethodPut, "/v1/session/renew/"+c.sessionID(), nil, nil)
+	if err == nil {
+		return nil
+	}
+	if status != http.StatusNotFound {
+		return err
+	}
+	c.logger.Printf("Consul session has expired, starting a new one\n")
+	if err := c.create(ctx); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	joined := c.joined
+	c.mu.Unlock()
+	if joined != nil {
+		return c.Join(ctx, *joined)
+	}
+	return nil
+}
+
+func (c *consul) sessionID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.session
+}
+
+func (c *consul) Join(ctx context.Context, node Node) error {
+	var acquired bool
+	if _, err := c.call(ctx, http.MethodPut, c.kv("members/"+node.Name)+"?acquire="+c.sessionID(), node, &acquired); err != nil {
+		return err
+	}
+	if !acquired {
+		return fmt.Errorf("member %q is registered by another session", node.Name)
+	}
+	c.mu.Lock()
+	c.joined = &node
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *consul) Members(ctx context.Context) ([]Node, error) {
+	var entries []struct {
+		Value string `json:"Value"`
+	}
+	status, err := c.call(ctx, http.MethodGet, c.kv("members/")+"?recurse", nil, &entries)
+	if status == http.StatusNotFound {
+		return []Node{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(entries))
+	for _, e := range entries {
+		value, err := base64.StdEncoding.DecodeString(e.Value)
+		if err != nil {
+			return nil, err
+		}
+		var node Node
+		if err := json.Unmarshal(value, &node); err != nil {
+			return nil, fmt.Errorf("malformed member: %w", err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (c *consul) TryLock(ctx context.Context, key string) (bool, error) {
+	var acquired bool
+	_, err := c.call(ctx, http.MethodPut, c.kv("locks/"+key)+"?acquire="+c.sessionID(), c.sessionID(), &acquired)
+	return acquired, err
+}
+
+func (c *consul) Unlock(ctx context.Context, key string) error {
+	// Deleted only whilst this session holds it, in a single transaction, so that a lock
+	// that expired and was taken by another node meanwhile is left alone.
+	k := c.prefix + "locks/" + key
+	txn := []map[string]any{
+		{"KV": map[string]any{"Verb": "check-session", "Key": k, "Session": c.sessionID()}},
+		{"KV": map[string]any{"Verb": "delete", "Key": k}},
+	}
+	status, err := c.call(ctx, http.MethodPut, "/v1/txn", txn, nil)
+	if status == http.StatusConflict {
+		return nil
+	}
+	return err
+}
+
+func (c *consul) Get(ctx context.Context, key string) (string, bool, error) {
+	var entries []struct {
+		Value string `json:"Value"`
+	}
+	status, err := c.call(ctx, http.MethodGet, c.kv(key), nil, &entries)
+	if status == http.StatusNotFound {
+		return "", false, nil
+	}
+	if err != nil || len(entries) == 0 {
+		return "", false, err
+	}
+	value, err := base64.StdEncoding.DecodeString(entries[0].Value)
+	return string(value), err == nil, err
+}
+
+func (c *consul) Put(ctx context.Context, key, value string) error {
+	_, err := c.call(ctx, http.MethodPut, c.kv(key), value, nil)
+	return err
+}
+
+func (c *consul) Close() error {
+	close(c.stop)
+	<-c.done
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := c.call(ctx, http.MethodPut, "/v1/session/destroy/"+c.sessionID(), nil, nil)
+	return err
+}
+
+// kv returns the path of key within the prefix in the KV API.
+func (c *consul) kv(key string) string {
+	parts := strings.Split(c.prefix+key, "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return "/v1/kv/" + strings.Join(parts, "/")
+}
+
+// call sends req to the API at path, a string as it is and anything else as JSON, and
+// decodes the answer into resp unless it is nil. It returns the status of the answer.
+func (c *consul) call(ctx context.Context, method, path string, req, resp any) (int, error) {
+	var body io.Reader
+	switch v := req.(type) {
+	case nil:
+	case string:
+		body = strings.NewReader(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	hreq, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, body)
+	if err != nil {
+		return 0, err
+	}
+	if c.token != "" {
+		hreq.Header.Set("X-Consul-Token", c.token)
+	}
+	hresp, err := c.client.Do(hreq)
+	if err != nil {
+		return 0, err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(hresp.Body, 1<<10))
+		return hresp.StatusCode, fmt.Errorf("Consul answered %s: %s", hresp.Status, bytes.TrimSpace(msg))
+	}
+	if resp == nil {
+		return hresp.StatusCode, nil
+	}
+	return hresp.StatusCode, json.NewDecoder(hresp.Body).Decode(resp)
+}
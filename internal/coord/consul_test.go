@@ -0,0 +1,303 @@
+package coord
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeConsul is as much of Consul's HTTP API as the backend uses: sessions, which delete the
+// keys they hold when they end, keys acquired by sessions, and check-and-delete transactions.
+type fakeConsul struct {
+	mu       sync.Mutex
+	token    string
+	sessions map[string]bool
+	created  int
+	kvs      map[string]fakeConsulKV
+}
+
+type fakeConsulKV struct {
+	value   []byte
+	session string
+}
+
+func newFakeConsul(token string) *fakeConsul {
+	return &fakeConsul{token: token, sessions: make(map[string]bool), kvs: make(map[string]fakeConsulKV)}
+}
+
+// expire ends session as Consul does once its TTL passes without a renewal.
+func (f *fakeConsul) expire(session string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.end(session)
+}
+
+func (f *fakeConsul) end(session string) {
+	delete(f.sessions, session)
+	for k, kv := range f.kvs {
+		if kv.session == session {
+			delete(f.kvs, k)
+		}
+	}
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("X-Consul-Token") != f.token {
+		http.Error(w, "ACL not found", http.StatusForbidden)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var resp any
+	switch path := r.URL.Path; {
+	case path == "/v1/session/create":
+		f.created++
+		id := "session-" + strconv.Itoa(f.created)
+		f.sessions[id] = true
+		resp = map[string]string{"ID": id}
+	case strings.HasPrefix(path, "/v1/session/renew/"):
+		if !f.sessions[strings.TrimPrefix(path, "/v1/session/renew/")] {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+	case strings.HasPrefix(path, "/v1/session/destroy/"):
+		f.end(strings.TrimPrefix(path, "/v1/session/destroy/"))
+		resp = true
+	case path == "/v1/txn":
+		var ops []struct {
+			KV struct {
+				Verb, Key, Session string
+			}
+		}
+		if err := json.Unmarshal(body, &ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, op := range ops {
+			if op.KV.Verb == "check-session" && f.kvs[op.KV.Key].session != op.KV.Session {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+		}
+		for _, op := range ops {
+			if op.KV.Verb == "delete" {
+				delete(f.kvs, op.KV.Key)
+			}
+		}
+	case strings.HasPrefix(path, "/v1/kv/"):
+		key := strings.TrimPrefix(path, "/v1/kv/")
+		if r.Method == http.MethodGet {
+			var entries []map[string]string
+			for k, kv := range f.kvs {
+				if k == key || r.URL.Query().Has("recurse") && strings.HasPrefix(k, key) {
+					entries = append(entries, map[string]string{"Key": k, "Value": base64.StdEncoding.EncodeToString(kv.value)})
+				}
+			}
+			if len(entries) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			resp = entries
+			break
+		}
+		session := r.URL.Query().Get("acquire")
+		if session == "" {
+			f.kvs[key] = fakeConsulKV{value: body}
+			resp = true
+			break
+		}
+		if !f.sessions[session] {
+			http.Error(w, "invalid session", http.StatusInternalServerError)
+			return
+		}
+		held, ok := f.kvs[key]
+		acquired := !ok || held.session == "" || held.session == session
+		if acquired {
+			f.kvs[key] = fakeConsulKV{value: body, session: session}
+		}
+		resp = acquired
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// newTestConsul returns a session on the agent at endpoint.
+func newTestConsul(t *testing.T, endpoint string) *consul {
+	t.Helper()
+	c, err := newConsul(endpoint, "token", "fileserver/", 30*time.Second, http.DefaultClient, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// TestConsulLocks checks that a lock is held by one session at a time, and that the session
+// holding it can take it again.
+func TestConsulLocks(t *testing.T) {
+	srv := httptest.NewServer(newFakeConsul("token"))
+	defer srv.Close()
+	a, b := newTestConsul(t, srv.URL), newTestConsul(t, srv.URL)
+	defer a.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		desc    string
+		session *consul
+		unlock  bool
+		key     string
+		want    bool
+	}{
+		{"take a free lock", a, false, "a.txt", true},
+		{"take it again", a, false, "a.txt", true},
+		{"take it from another session", b, false, "a.txt", false},
+		{"take another lock", b, false, "docs/b file.txt", true},
+		{"release a lock held by another session", b, true, "a.txt", false},
+		{"release it", a, true, "a.txt", true},
+		{"take it once released", b, false, "a.txt", true},
+		{"take it back", a, false, "a.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.unlock {
+				if err := tt.session.Unlock(ctx, tt.key); err != nil {
+					t.Fatal(err)
+				}
+				_, held, err := a.Get(ctx, "locks/"+tt.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if released := !held; released != tt.want {
+					t.Errorf("released %v, want %v", released, tt.want)
+				}
+				return
+			}
+			got, err := tt.session.TryLock(ctx, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("TryLock = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Locks go with the session holding them.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.TryLock(ctx, "a.txt"); err != nil || !ok {
+		t.Errorf("TryLock = %v, %v once the holder closed, want true", ok, err)
+	}
+}
+
+// names returns the names of nodes, in order.
+func names(nodes []Node) []string {
+	var s []string
+	for _, n := range nodes {
+		s = append(s, n.Name)
+	}
+	slices.Sort(s)
+	return s
+}
+
+func TestConsulMembers(t *testing.T) {
+	fake := newFakeConsul("token")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	a, b := newTestConsul(t, srv.URL), newTestConsul(t, srv.URL)
+	defer a.Close()
+	ctx := context.Background()
+
+	if nodes, err := a.Members(ctx); err != nil || len(nodes) != 0 {
+		t.Fatalf("got members %v, %v before any joined", nodes, err)
+	}
+	nodeA := Node{Name: "node-a", URL: "http://10.0.0.1:8080"}
+	if err := a.Join(ctx, nodeA); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Join(ctx, Node{Name: "node-b", URL: "http://10.0.0.2:8080"}); err != nil {
+		t.Fatal(err)
+	}
+	// Joining again is harmless.
+	if err := a.Join(ctx, nodeA); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Join(ctx, Node{Name: "node-a", URL: "http://10.0.0.9:8080"}); err == nil {
+		t.Error("a node registered under the name of another")
+	}
+	nodes, err := a.Members(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := names(nodes); !slices.Equal(got, []string{"node-a", "node-b"}) {
+		t.Errorf("got members %v", got)
+	}
+	if i := slices.IndexFunc(nodes, func(n Node) bool { return n.Name == "node-a" }); nodes[i] != nodeA {
+		t.Errorf("got %+v, want %+v", nodes[i], nodeA)
+	}
+
+	// A node leaves once its session ends.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := a.Members(ctx); err != nil || !slices.Equal(names(nodes), []string{"node-a"}) {
+		t.Errorf("got members %v, %v once node-b closed", names(nodes), err)
+	}
+
+	// A session that expired, e.g. whilst the node was cut off, is replaced by a new one,
+	// under which the node joins again.
+	old := a.sessionID()
+	fake.expire(old)
+	if nodes, err := a.Members(ctx); err != nil || len(nodes) != 0 {
+		t.Fatalf("got members %v, %v once the session expired", names(nodes), err)
+	}
+	if err := a.renew(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if a.sessionID() == old {
+		t.Error("no new session was started")
+	}
+	if nodes, err := a.Members(ctx); err != nil || !slices.Equal(names(nodes), []string{"node-a"}) {
+		t.Errorf("got members %v, %v once renewed", names(nodes), err)
+	}
+}
+
+func TestConsulValues(t *testing.T) {
+	srv := httptest.NewServer(newFakeConsul("token"))
+	defer srv.Close()
+	c := newTestConsul(t, srv.URL)
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, ok, err := c.Get(ctx, "cursors/alice/sync"); ok || err != nil {
+		t.Errorf("got %v, %v for a missing key", ok, err)
+	}
+	for _, value := range []string{"42", "43"} {
+		if err := c.Put(ctx, "cursors/alice/sync", value); err != nil {
+			t.Fatal(err)
+		}
+		if got, ok, err := c.Get(ctx, "cursors/alice/sync"); got != value || !ok || err != nil {
+			t.Errorf("got %q, %v, %v, want %q", got, ok, err, value)
+		}
+	}
+
+	// The token is sent with every call.
+	c.token = "wrong"
+	if err := c.Put(ctx, "cursors/alice/sync", "44"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got error %v with a wrong token, want the answer of Consul", err)
+	}
+	c.token = "token"
+}
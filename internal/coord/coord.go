@@ -0,0 +1,151 @@
+// Package coord talks to the coordination service that the instances of a multi-node
+// deployment share, etcd or Consul: for node membership, locks on file names, and small
+// values such as the positions of change feed consumers.
+//
+// Why speak their HTTP APIs rather than use their client libraries? The few calls needed
+// are plain JSON over HTTP, and the libraries would bring in far more code than the rest of
+// the server put together.
+package coord
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+)
+
+// requestTimeout bounds each call to the coordination service.
+const requestTimeout = 5 * time.Second
+
+// Node is a member of the deployment.
+type Node struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// Backend is a coordination service. Membership and locks are tied to a session that the
+// backend keeps alive for as long as the process runs, so that those of a node that dies
+// go with it once the session's TTL has passed.
+type Backend interface {
+	// Join registers node as a member.
+	Join(ctx context.Context, node Node) error
+	// Members returns the registered members.
+	Members(ctx context.Context) ([]Node, error)
+	// TryLock takes the lock key, and reports false if another session holds it. Taking a
+	// lock this session holds already succeeds.
+	TryLock(ctx context.Context, key string) (bool, error)
+	// Unlock releases the lock key.
+	Unlock(ctx context.Context, key string) error
+	// Get returns the value of key, and false if it has none.
+	Get(ctx context.Context, key string) (string, bool, error)
+	// Put sets the value of key.
+	Put(ctx context.Context, key, value string) error
+	// Close ends the session, releasing its membership and locks.
+	Close() error
+}
+
+// New connects to the coordination service configured by cfg, or returns nil if there is none.
+func New(cfg config.CoordinationConfig, logger *log.Logger) (Backend, error) {
+	if cfg.Backend == "" {
+		return nil, nil
+	}
+	if cfg.Endpoint == "" {
+		return nil, fmt.Errorf("coordination endpoint is required")
+	}
+	if cfg.TTL < time.Second {
+		return nil, fmt.Errorf("invalid coordination ttl %s: must be at least a second", cfg.TTL)
+	}
+	endpoint := strings.TrimSuffix(cfg.Endpoint, "/")
+	client := &http.Client{Timeout: requestTimeout}
+	// Why not return the constructors' results directly? A nil *etcd or *consul would make
+	// a Backend that is not nil.
+	var b Backend
+	var err error
+	switch cfg.Backend {
+	case "etcd":
+		b, err = newEtcd(endpoint, cfg.Prefix, cfg.TTL, client, logger)
+	case "consul":
+		b, err = newConsul(endpoint, cfg.Token, cfg.Prefix, cfg.TTL, client, logger)
+	default:
+		return nil, fmt.Errorf("invalid coordination backend %q: must be etcd or consul", cfg.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// keepAlive calls renew every third of ttl until stop is closed, logging failures, and then
+// closes done. Backends wait for done before ending the session, as a renewal in flight
+// could otherwise start a new one.
+func keepAlive(ttl time.Duration, stop <-chan struct{}, done chan<- struct{}, renew func(context.Context) error, logger *log.Logger) {
+	defer close(done)
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			if err := renew(ctx); err != nil {
+				logger.Printf("error renewing coordination session: %v\n", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// Cursors keeps the positions of named change feed consumers: in the coordination service
+// if there is one, so that a consumer can resume on whichever node it reaches next, or else
+// in a local file.
+type Cursors struct {
+	backend Backend
+
+	mu    sync.Mutex
+	path  string
+	local map[string]string
+}
+
+// OpenCursors returns the cursors kept in backend, or in the file at path if backend is nil.
+func OpenCursors(backend Backend, path string) (*Cursors, error) {
+	c := &Cursors{backend: backend, path: path, local: make(map[string]string)}
+	if backend != nil {
+		return c, nil
+	}
+	if err := jsonfile.Load(path, &c.local); err != nil {
+		return nil, fmt.Errorf("loading cursors from %s: %w", path, err)
+	}
+	if c.local == nil {
+		c.local = make(map[string]string)
+	}
+	return c, nil
+}
+
+// Get returns the position of consumer, and false if it has none yet.
+func (c *Cursors) Get(ctx context.Context, consumer string) (string, bool, error) {
+	if c.backend != nil {
+		return c.backend.Get(ctx, "cursors/"+consumer)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.local[consumer]
+	return v, ok, nil
+}
+
+// Put records the position of consumer.
+func (c *Cursors) Put(ctx context.Context, consumer, cursor string) error {
+	if c.backend != nil {
+		return c.backend.Put(ctx, "cursors/"+consumer, cursor)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.local[consumer] = cursor
+	return jsonfile.Save(c.path, c.local)
+}
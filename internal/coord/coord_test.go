@@ -0,0 +1,89 @@
+package coord
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestNew(t *testing.T) {
+	srv := httptest.NewServer(newFakeConsul("token"))
+	defer srv.Close()
+	logger := log.New(io.Discard, "", 0)
+
+	tests := []struct {
+		desc    string
+		cfg     config.CoordinationConfig
+		wantErr bool
+	}{
+		{"Consul", config.CoordinationConfig{Backend: "consul", Endpoint: srv.URL + "/", Token: "token", TTL: 10 * time.Second}, false},
+		{"no endpoint", config.CoordinationConfig{Backend: "consul", TTL: 10 * time.Second}, true},
+		{"too short a ttl", config.CoordinationConfig{Backend: "consul", Endpoint: srv.URL, TTL: time.Millisecond}, true},
+		{"an unknown backend", config.CoordinationConfig{Backend: "zookeeper", Endpoint: srv.URL, TTL: 10 * time.Second}, true},
+		{"an unreachable service", config.CoordinationConfig{Backend: "consul", Endpoint: "http://127.0.0.1:1", TTL: 10 * time.Second}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			b, err := New(tt.cfg, logger)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want an error: %v", err, tt.wantErr)
+			}
+			if b != nil {
+				if err := b.Close(); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+	if b, err := New(config.CoordinationConfig{}, logger); b != nil || err != nil {
+		t.Errorf("got %v, %v with no backend, want none", b, err)
+	}
+}
+
+func TestCursors(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(newFakeConsul("token"))
+	defer srv.Close()
+	backend := newTestConsul(t, srv.URL)
+	defer backend.Close()
+	path := filepath.Join(t.TempDir(), "cursors.json")
+
+	for _, tt := range []struct {
+		desc    string
+		backend Backend
+	}{
+		{"in a local file", nil},
+		{"in the coordination service", backend},
+	} {
+		t.Run(tt.desc, func(t *testing.T) {
+			c, err := OpenCursors(tt.backend, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok, err := c.Get(ctx, "alice/sync"); ok || err != nil {
+				t.Fatalf("got %v, %v for a new consumer", ok, err)
+			}
+			if err := c.Put(ctx, "alice/sync", "42"); err != nil {
+				t.Fatal(err)
+			}
+			// Read back by another instance, as after a restart, or on another node.
+			c, err = OpenCursors(tt.backend, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, ok, err := c.Get(ctx, "alice/sync"); got != "42" || !ok || err != nil {
+				t.Errorf("got %q, %v, %v, want 42", got, ok, err)
+			}
+		})
+	}
+	// With a coordination service, the cursors are kept there alone.
+	if got, ok, _ := backend.Get(ctx, "cursors/alice/sync"); got != "42" || !ok {
+		t.Errorf("got %q, %v in the coordination service", got, ok)
+	}
+}
@@ -0,0 +1,239 @@
+package coord
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// etcd is a Backend on etcd's v3 API, through its JSON gateway. The session is a lease,
+// which the membership key and the lock keys are attached to.
+type etcd struct {
+	endpoint string
+	prefix   string
+	ttl      time.Duration
+	client   *http.Client
+	logger   *log.Logger
+	stop     chan struct{} // closed by Close
+	done     chan struct{} // closed once keepAlive returns
+
+	mu     sync.Mutex
+	lease  string
+	joined *Node // rejoined under a new lease should the old one expire
+}
+
+// etcdKV is a key and value in etcd's answers, both base64-encoded.
+type etcdKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+func newEtcd(endpoint, prefix string, ttl time.Duration, client *http.Client, logger *log.Logger) (*etcd, error) {
+	e := &etcd{endpoint: endpoint, prefix: prefix, ttl: ttl, client: client, logger: logger, stop: make(chan struct{}), done: make(chan struct{})}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if err := e.grant(ctx); err != nil {
+		return nil, fmt.Errorf("connecting to etcd at %s: %w", endpoint, err)
+	}
+	go keepAlive(ttl, e.stop, e.done, e.renew, logger)
+	return e, nil
+}
+
+// grant starts a new session.
+func (e *etcd) grant(ctx context.Context) error {
+	var resp struct {
+		ID string `json:"ID"`
+	}
+	if err := e.call(ctx, "/v3/lease/grant", map[string]any{"TTL": int64(e.ttl.Seconds())}, &resp); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.lease = resp.ID
+	e.mu.Unlock()
+	return nil
+}
+
+// renew keeps the session alive, or starts a new one, and joins again, if it has expired,
+// as it does whilst etcd cannot be reached for longer than the TTL.
+func (e *etcd) renew(ctx context.Context) error {
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := e.call(ctx, "/v3/lease/keepalive", map[string]any{"ID": e.leaseID()}, &resp); err != nil {
+		return err
+	}
+	if ttl, _ := strconv.ParseInt(resp.Result.TTL, 10, 64); ttl > 0 {
+		return nil
+	}
+	e.logger.Printf("etcd lease has expired, starting a new one\n")
+	if err := e.grant(ctx); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	joined := e.joined
+	e.mu.Unlock()
+	if joined != nil {
+		return e.Join(ctx, *joined)
+	}
+	return nil
+}
+
+func (e *etcd) leaseID() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.lease
+}
+
+func (e *etcd) Join(ctx context.Context, node Node) error {
+	value, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	if err := e.call(ctx, "/v3/kv/put", map[string]any{"key": e.key("members/" + node.Name), "value": b64(string(value)), "lease": e.leaseID()}, nil); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.joined = &node
+	e.mu.Unlock()
+	return nil
+}
+
+func (e *etcd) Members(ctx context.Context) ([]Node, error) {
+	prefix := e.prefix + "members/"
+	var resp struct {
+		KVs []etcdKV `json:"kvs"`
+	}
+	if err := e.call(ctx, "/v3/kv/range", map[string]any{"key": b64(prefix), "range_end": b64(prefixEnd(prefix))}, &resp); err != nil {
+		return nil, err
+	}
+	nodes := make([]Node, 0, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, err
+		}
+		var node Node
+		if err := json.Unmarshal(value, &node); err != nil {
+			return nil, fmt.Errorf("malformed member: %w", err)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (e *etcd) TryLock(ctx context.Context, key string) (bool, error) {
+	// Created only if it does not exist yet, in a single transaction.
+	k := e.key("locks/" + key)
+	txn := map[string]any{
+		"compare": []map[string]any{{"key": k, "result": "EQUAL", "target": "CREATE", "create_revision": "0"}},
+		"success": []map[string]any{{"request_put": map[string]any{"key": k, "value": b64(e.leaseID()), "lease": e.leaseID()}}},
+	}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := e.call(ctx, "/v3/kv/txn", txn, &resp); err != nil {
+		return false, err
+	}
+	if resp.Succeeded {
+		return true, nil
+	}
+	// Held already, which may be by this session: the value is the lease of the holder.
+	holder, ok, err := e.Get(ctx, "locks/"+key)
+	return ok && holder == e.leaseID(), err
+}
+
+func (e *etcd) Unlock(ctx context.Context, key string) error {
+	// Deleted only whilst this session holds it, so that a lock that expired and was taken
+	// by another node meanwhile is left alone.
+	k := e.key("locks/" + key)
+	txn := map[string]any{
+		"compare": []map[string]any{{"key": k, "result": "EQUAL", "target": "LEASE", "lease": e.leaseID()}},
+		"success": []map[string]any{{"request_delete_range": map[string]any{"key": k}}},
+	}
+	return e.call(ctx, "/v3/kv/txn", txn, nil)
+}
+
+func (e *etcd) Get(ctx context.Context, key string) (string, bool, error) {
+	var resp struct {
+		KVs []etcdKV `json:"kvs"`
+	}
+	if err := e.call(ctx, "/v3/kv/range", map[string]any{"key": e.key(key)}, &resp); err != nil {
+		return "", false, err
+	}
+	if len(resp.KVs) == 0 {
+		return "", false, nil
+	}
+	value, err := base64.StdEncoding.DecodeString(resp.KVs[0].Value)
+	return string(value), err == nil, err
+}
+
+func (e *etcd) Put(ctx context.Context, key, value string) error {
+	return e.call(ctx, "/v3/kv/put", map[string]any{"key": e.key(key), "value": b64(value)}, nil)
+}
+
+func (e *etcd) Close() error {
+	close(e.stop)
+	<-e.done
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return e.call(ctx, "/v3/lease/revoke", map[string]any{"ID": e.leaseID()}, nil)
+}
+
+// key returns key within the prefix, encoded for the gateway.
+func (e *etcd) key(key string) string {
+	return b64(e.prefix + key)
+}
+
+// call posts req to the gateway at path, and decodes the answer into resp unless it is nil.
+func (e *etcd) call(ctx context.Context, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hresp, err := e.client.Do(hreq)
+	if err != nil {
+		return err
+	}
+	defer hresp.Body.Close()
+	if hresp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(hresp.Body, 1<<10))
+		return fmt.Errorf("etcd answered %s: %s", hresp.Status, bytes.TrimSpace(msg))
+	}
+	if resp == nil {
+		return nil
+	}
+	return json.NewDecoder(hresp.Body).Decode(resp)
+}
+
+// b64 encodes s as etcd's gateway expects keys and values.
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// prefixEnd returns the end of the range of keys starting with prefix: prefix with its last
+// byte incremented.
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
@@ -0,0 +1,168 @@
+package coord
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd is as much of etcd's JSON gateway as the backend uses for locks: leases, and
+// keys created, compared and deleted in transactions.
+type fakeEtcd struct {
+	mu     sync.Mutex
+	leases int
+	kvs    map[string]fakeKV // by base64-encoded key
+}
+
+type fakeKV struct {
+	value string // base64-encoded
+	lease string
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID      string `json:"ID"`
+		Key     string `json:"key"`
+		Value   string `json:"value"`
+		Lease   string `json:"lease"`
+		Compare []struct {
+			Key    string `json:"key"`
+			Target string `json:"target"`
+			Lease  string `json:"lease"`
+		} `json:"compare"`
+		Success []struct {
+			Put *struct {
+				Key   string `json:"key"`
+				Value string `json:"value"`
+				Lease string `json:"lease"`
+			} `json:"request_put"`
+			Delete *struct {
+				Key string `json:"key"`
+			} `json:"request_delete_range"`
+		} `json:"success"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var resp any = struct{}{}
+	switch r.URL.Path {
+	case "/v3/lease/grant":
+		f.leases++
+		resp = map[string]string{"ID": strconv.Itoa(f.leases)}
+	case "/v3/lease/keepalive":
+		resp = map[string]any{"result": map[string]string{"TTL": "30"}}
+	case "/v3/lease/revoke":
+		for k, kv := range f.kvs {
+			if kv.lease == req.ID {
+				delete(f.kvs, k)
+			}
+		}
+	case "/v3/kv/put":
+		f.kvs[req.Key] = fakeKV{req.Value, req.Lease}
+	case "/v3/kv/range":
+		var kvs []etcdKV
+		if kv, ok := f.kvs[req.Key]; ok {
+			kvs = append(kvs, etcdKV{Key: req.Key, Value: kv.value})
+		}
+		resp = map[string]any{"kvs": kvs}
+	case "/v3/kv/txn":
+		c := req.Compare[0]
+		kv, exists := f.kvs[c.Key]
+		succeeded := c.Target == "CREATE" && !exists || c.Target == "LEASE" && exists && kv.lease == c.Lease
+		if succeeded {
+			for _, op := range req.Success {
+				if op.Put != nil {
+					f.kvs[op.Put.Key] = fakeKV{op.Put.Value, op.Put.Lease}
+				}
+				if op.Delete != nil {
+					delete(f.kvs, op.Delete.Key)
+				}
+			}
+		}
+		resp = map[string]bool{"succeeded": succeeded}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// newTestEtcd returns a session on the gateway at endpoint.
+func newTestEtcd(t *testing.T, endpoint string) *etcd {
+	t.Helper()
+	e, err := newEtcd(endpoint, "fileserver/", 30*time.Second, http.DefaultClient, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// TestEtcdLocks checks that a lock is held by one session at a time, and that the session
+// holding it can take it again.
+func TestEtcdLocks(t *testing.T) {
+	srv := httptest.NewServer(&fakeEtcd{kvs: make(map[string]fakeKV)})
+	defer srv.Close()
+	a, b := newTestEtcd(t, srv.URL), newTestEtcd(t, srv.URL)
+	defer a.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		desc    string
+		session *etcd
+		unlock  bool
+		key     string
+		want    bool
+	}{
+		{"take a free lock", a, false, "a.txt", true},
+		{"take it again", a, false, "a.txt", true},
+		{"take it from another session", b, false, "a.txt", false},
+		{"take another lock", b, false, "b.txt", true},
+		{"release a lock held by another session", b, true, "a.txt", false},
+		{"release it", a, true, "a.txt", true},
+		{"take it once released", b, false, "a.txt", true},
+		{"take it back", a, false, "a.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if tt.unlock {
+				if err := tt.session.Unlock(ctx, tt.key); err != nil {
+					t.Fatal(err)
+				}
+				// Whether the lock was released shows in whether it is still held.
+				_, held, err := a.Get(ctx, "locks/"+tt.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if released := !held; released != tt.want {
+					t.Errorf("released %v, want %v", released, tt.want)
+				}
+				return
+			}
+			got, err := tt.session.TryLock(ctx, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("TryLock = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Locks go with the session holding them.
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := a.TryLock(ctx, "a.txt"); err != nil || !ok {
+		t.Errorf("TryLock = %v, %v once the holder closed, want true", ok, err)
+	}
+}
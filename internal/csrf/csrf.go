@@ -0,0 +1,142 @@
+package csrf
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"mime"
+	"net/http"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// FieldName is the urlencoded form field that may carry the token for plain HTML forms.
+const FieldName = "csrf_token"
+
+// Protector issues CSRF tokens and validates them on state-changing requests.
+//
+// It implements the double-submit cookie pattern: the token lives in an HttpOnly cookie
+// and must be echoed back in a header (or form field) that a malicious cross-site page
+// cannot read or forge. Fields are unexported so the policy cannot change after start-up.
+type Protector struct {
+	enabled    bool
+	cookieName string
+	headerName string
+	secure     bool
+	render     *respond.Renderer
+	logger     *log.Logger
+}
+
+// NewProtector creates a Protector from the application configuration.
+func NewProtector(cfg *config.Config, render *respond.Renderer, logger *log.Logger) *Protector {
+	return &Protector{
+		enabled:    cfg.CSRF.Enabled,
+		cookieName: cfg.CSRF.CookieName,
+		headerName: cfg.CSRF.HeaderName,
+		secure:     cfg.Server.SecureCookies,
+		render:     render,
+		logger:     logger,
+	}
+}
+
+// Middleware rejects unsafe requests that carry cookies but no matching CSRF token.
+//
+// Why only requests with cookies? CSRF abuses credentials that the browser attaches
+// automatically. Scripted clients such as curl send no cookies and have no ambient
+// credentials to abuse, so they are left untouched.
+func (p *Protector) Middleware(next http.Handler) http.Handler {
+	if !p.enabled {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isSafeMethod(r.Method) || len(r.Cookies()) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cookie, err := r.Cookie(p.cookieName)
+		if err != nil || cookie.Value == "" {
+			p.logger.Printf("csrf: missing token cookie from %s for %s %s\n", r.RemoteAddr, r.Method, r.URL.Path)
+			p.render.Error(w, r, http.StatusForbidden, "missing CSRF token")
+			return
+		}
+
+		submitted := p.submittedToken(r)
+		if subtle.ConstantTimeCompare([]byte(submitted), []byte(cookie.Value)) != 1 {
+			p.logger.Printf("csrf: invalid token from %s for %s %s\n", r.RemoteAddr, r.Method, r.URL.Path)
+			p.render.Error(w, r, http.StatusForbidden, "invalid CSRF token")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TokenHandler returns the caller's CSRF token as JSON, issuing a new one if needed.
+// Browser scripts call it once and send the token in the configured header thereafter.
+func (p *Protector) TokenHandler(w http.ResponseWriter, r *http.Request) {
+	token, err := p.Token(w, r)
+	if err != nil {
+		p.logger.Printf("error generating csrf token: %v\n", err)
+		p.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	// Why no-store? The token is a per-browser secret and must never be cached by proxies.
+	w.Header().Set("Cache-Control", "no-store")
+	resp := struct {
+		Token      string `json:"token"`
+		HeaderName string `json:"headerName"`
+		FieldName  string `json:"fieldName"`
+	}{token, p.headerName, FieldName}
+	p.render.JSON(w, http.StatusOK, resp)
+}
+
+// Token returns the request's existing CSRF token, or generates one and sets its cookie.
+func (p *Protector) Token(w http.ResponseWriter, r *http.Request) (string, error) {
+	if cookie, err := r.Cookie(p.cookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, nil
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(buf)
+
+	// Why SameSite=Strict and HttpOnly? The cookie is never needed cross-site, and scripts
+	// obtain the value through TokenHandler rather than reading document.cookie.
+	http.SetCookie(w, &http.Cookie{
+		Name:     p.cookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   p.secure,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token, nil
+}
+
+// submittedToken extracts the token echoed by the client. The header is always accepted;
+// the form field only for urlencoded bodies. Why not multipart? Parsing a multipart body
+// here would bypass the upload size limits, so multipart clients must use the header.
+func (p *Protector) submittedToken(r *http.Request) string {
+	if token := r.Header.Get(p.headerName); token != "" {
+		return token
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "application/x-www-form-urlencoded" {
+		return r.PostFormValue(FieldName)
+	}
+	return ""
+}
+
+// isSafeMethod reports whether a method is defined as read-only by RFC 9110.
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,102 @@
+package csrf
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+func newTestProtector() *Protector {
+	logger := log.New(io.Discard, "", 0)
+	cfg := config.Default()
+	cfg.CSRF.Enabled = true
+	return NewProtector(cfg, respond.NewRenderer(respond.FormatJSON, logger), logger)
+}
+
+func TestMiddleware(t *testing.T) {
+	p := newTestProtector()
+	handler := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	session := &http.Cookie{Name: "fileserver_session", Value: "s"}
+	token := &http.Cookie{Name: p.cookieName, Value: "token"}
+	form := url.Values{FieldName: {"token"}}.Encode()
+
+	tests := []struct {
+		desc        string
+		method      string
+		cookies     []*http.Cookie
+		header      string
+		contentType string
+		body        string
+		want        int
+	}{
+		{"safe method", http.MethodGet, []*http.Cookie{session}, "", "", "", http.StatusNoContent},
+		{"no cookies, as from scripts", http.MethodPost, nil, "", "", "", http.StatusNoContent},
+		{"cookies but no token cookie", http.MethodPost, []*http.Cookie{session}, "token", "", "", http.StatusForbidden},
+		{"token cookie but no token sent", http.MethodPost, []*http.Cookie{session, token}, "", "", "", http.StatusForbidden},
+		{"token in the header", http.MethodDelete, []*http.Cookie{session, token}, "token", "", "", http.StatusNoContent},
+		{"wrong token in the header", http.MethodPut, []*http.Cookie{session, token}, "other", "", "", http.StatusForbidden},
+		{"token in a urlencoded form", http.MethodPost, []*http.Cookie{session, token}, "", "application/x-www-form-urlencoded", form, http.StatusNoContent},
+		{"token in a multipart form", http.MethodPost, []*http.Cookie{session, token}, "", "multipart/form-data; boundary=x",
+			"--x\r\nContent-Disposition: form-data; name=\"csrf_token\"\r\n\r\ntoken\r\n--x--\r\n", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/upload", strings.NewReader(tt.body))
+			for _, c := range tt.cookies {
+				r.AddCookie(c)
+			}
+			if tt.header != "" {
+				r.Header.Set(p.headerName, tt.header)
+			}
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenHandler(t *testing.T) {
+	p := newTestProtector()
+
+	w := httptest.NewRecorder()
+	p.TokenHandler(w, httptest.NewRequest(http.MethodGet, "/api/csrf", nil))
+	var resp struct{ Token, HeaderName string }
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != resp.Token || resp.Token == "" {
+		t.Fatalf("token %q with cookies %v, want the token set as a cookie", resp.Token, cookies)
+	}
+	if c := cookies[0]; !c.HttpOnly || c.SameSite != http.SameSiteStrictMode {
+		t.Errorf("cookie %v is not HttpOnly and SameSite=Strict", c)
+	}
+	if resp.HeaderName != p.headerName {
+		t.Errorf("header name %q, want %q", resp.HeaderName, p.headerName)
+	}
+
+	// A browser that has a token keeps it.
+	r := httptest.NewRequest(http.MethodGet, "/api/csrf", nil)
+	r.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	p.TokenHandler(w, r)
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Token != cookies[0].Value || len(w.Result().Cookies()) != 0 {
+		t.Errorf("token %q issued again, want %q kept", resp.Token, cookies[0].Value)
+	}
+}
@@ -0,0 +1,159 @@
+// Package delta implements the rsync algorithm's side of the server: block signatures of a
+// stored file, from which a client works out which parts of its newer copy the server
+// already has, and the reconstruction of that copy from a delta listing the blocks to reuse
+// and the data in between.
+package delta
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// The bounds of the block size, and the default for a file with no better fit.
+const (
+	MinBlockSize = 1 << 10  // 1 KB
+	MaxBlockSize = 16 << 20 // 16 MB
+)
+
+// MaxLiteral bounds the data of a single literal instruction, so that a delta cannot make
+// the server buffer more than that at once.
+const MaxLiteral = 16 << 20 // 16 MB
+
+// The instructions a delta is made of.
+const (
+	// OpCopy is followed by the index of a block of the basis file, as a big-endian uint64,
+	// and the number of consecutive blocks to copy from there, as a big-endian uint32.
+	OpCopy = 'C'
+	// OpData is followed by the length of the data, as a big-endian uint32, and the data.
+	OpData = 'D'
+)
+
+// ErrMalformed is returned by Apply for a delta that cannot be applied to the basis file.
+var ErrMalformed = errors.New("malformed delta")
+
+// ErrTooLarge is returned by Apply once the reconstructed file exceeds its maximum size.
+var ErrTooLarge = errors.New("reconstructed file is too large")
+
+// Block is the signature of one block of a file.
+type Block struct {
+	// Weak is the rolling checksum of the block, which a client computes at every offset of
+	// its copy to find candidate matches cheaply.
+	Weak uint32 `json:"weak"`
+	// Strong is the hex-encoded SHA-256 checksum of the block, which confirms a match.
+	Strong string `json:"strong"`
+}
+
+// BlockSize returns the default block size for a file of size bytes: about its square root,
+// as rsync uses, which balances the size of the signatures against that of the data resent
+// around each change. It is rounded up to a multiple of 1 KB.
+func BlockSize(size int64) int {
+	n := int64(math.Sqrt(float64(size)))
+	n = (n + MinBlockSize - 1) / MinBlockSize * MinBlockSize
+	return int(min(max(n, MinBlockSize), MaxBlockSize))
+}
+
+// Signature returns the signatures of the consecutive blocks of r, the last of which may be
+// short.
+func Signature(r io.Reader, blockSize int) ([]Block, error) {
+	buf := make([]byte, blockSize)
+	var blocks []Block
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			blocks = append(blocks, Block{Weak: Weak(buf[:n]), Strong: hex.EncodeToString(sum[:])})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Weak returns the rolling checksum of b, as rsync computes it: the sum of the bytes in the
+// low 16 bits, and the sum of the running sums in the high 16 bits. A client rolls it along
+// its copy one byte at a time by subtracting the byte that leaves the window and adding the
+// one that enters.
+func Weak(b []byte) uint32 {
+	var a, s uint32
+	for i, c := range b {
+		a += uint32(c)
+		s += uint32(len(b)-i) * uint32(c)
+	}
+	return a&0xffff | s<<16
+}
+
+// Apply reconstructs a file from the delta read from d, writing it to w, with the blocks it
+// copies read from basis, which is size bytes long and was divided into blocks of blockSize.
+// It returns the length of the file, which may not exceed maxSize.
+func Apply(w io.Writer, d io.Reader, basis io.ReaderAt, size int64, blockSize int, maxSize int64) (int64, error) {
+	blocks := (size + int64(blockSize) - 1) / int64(blockSize)
+	var hdr [12]byte
+	buf := make([]byte, blockSize)
+	var written int64
+	for {
+		if _, err := io.ReadFull(d, hdr[:1]); err == io.EOF {
+			return written, nil
+		} else if err != nil {
+			return written, err
+		}
+		switch hdr[0] {
+		case OpCopy:
+			if _, err := io.ReadFull(d, hdr[:12]); err != nil {
+				return written, truncated(err)
+			}
+			first := binary.BigEndian.Uint64(hdr[:8])
+			count := uint64(binary.BigEndian.Uint32(hdr[8:12]))
+			if first >= uint64(blocks) || count > uint64(blocks)-first {
+				return written, fmt.Errorf("%w: blocks %d to %d are beyond the %d of the basis file", ErrMalformed, first, first+count, blocks)
+			}
+			for i := first; i < first+count; i++ {
+				off := int64(i) * int64(blockSize)
+				n := int(min(int64(blockSize), size-off))
+				if written+int64(n) > maxSize {
+					return written, ErrTooLarge
+				}
+				if _, err := basis.ReadAt(buf[:n], off); err != nil {
+					return written, err
+				}
+				if _, err := w.Write(buf[:n]); err != nil {
+					return written, err
+				}
+				written += int64(n)
+			}
+		case OpData:
+			if _, err := io.ReadFull(d, hdr[:4]); err != nil {
+				return written, truncated(err)
+			}
+			n := int64(binary.BigEndian.Uint32(hdr[:4]))
+			if n > MaxLiteral {
+				return written, fmt.Errorf("%w: literal of %d bytes exceeds %d", ErrMalformed, n, MaxLiteral)
+			}
+			if written+n > maxSize {
+				return written, ErrTooLarge
+			}
+			copied, err := io.CopyN(w, d, n)
+			written += copied
+			if err != nil {
+				return written, truncated(err)
+			}
+		default:
+			return written, fmt.Errorf("%w: unknown instruction %q", ErrMalformed, hdr[0])
+		}
+	}
+}
+
+// truncated turns the end of a delta within an instruction into ErrMalformed.
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: truncated instruction", ErrMalformed)
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package delta
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/rand/v2"
+	"testing"
+)
+
+// makeDelta works out the delta of newer against the file with the given signatures, as a
+// client does: it rolls the weak checksum along newer, confirms candidate blocks with the
+// strong checksum, and sends the data between matches as literals.
+func makeDelta(blocks []Block, blockSize int, newer []byte) []byte {
+	byWeak := make(map[uint32][]int)
+	for i, b := range blocks {
+		byWeak[b.Weak] = append(byWeak[b.Weak], i)
+	}
+	var d, literal []byte
+	flush := func() {
+		if len(literal) > 0 {
+			d = append(d, OpData)
+			d = binary.BigEndian.AppendUint32(d, uint32(len(literal)))
+			d = append(d, literal...)
+			literal = nil
+		}
+	}
+	match := func(at int) int {
+		end := min(at+blockSize, len(newer))
+		window := newer[at:end]
+		for _, i := range byWeak[Weak(window)] {
+			sum := sha256.Sum256(window)
+			if blocks[i].Strong == hex.EncodeToString(sum[:]) {
+				return i
+			}
+		}
+		return -1
+	}
+	for at := 0; at < len(newer); {
+		if i := match(at); i >= 0 {
+			flush()
+			d = append(d, OpCopy)
+			d = binary.BigEndian.AppendUint64(d, uint64(i))
+			d = binary.BigEndian.AppendUint32(d, 1)
+			at += min(blockSize, len(newer)-at)
+			continue
+		}
+		literal = append(literal, newer[at])
+		at++
+	}
+	flush()
+	return d
+}
+
+func TestBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, MinBlockSize},
+		{1 << 20, 1 << 10},
+		{1025 * 1025, 2 << 10},
+		{100 << 20, 10 << 10},
+		{1 << 60, MaxBlockSize},
+	}
+	for _, tt := range tests {
+		if got := BlockSize(tt.size); got != tt.want {
+			t.Errorf("BlockSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+// TestWeak checks that the checksum can be rolled one byte at a time, as clients do.
+func TestWeak(t *testing.T) {
+	data := make([]byte, 4096)
+	for i := range data {
+		data[i] = byte(rand.IntN(256))
+	}
+	const l = 700
+	sum := Weak(data[:l])
+	a, b := sum&0xffff, sum>>16
+	for i := 1; i+l <= len(data); i++ {
+		out, in := uint32(data[i-1]), uint32(data[i+l-1])
+		a = (a - out + in) & 0xffff
+		b = (b - l*out + a) & 0xffff
+		if want := Weak(data[i : i+l]); a|b<<16 != want {
+			t.Fatalf("rolled to %d: got %#x, want %#x", i, a|b<<16, want)
+		}
+	}
+}
+
+func TestSignature(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 250)
+	blocks, err := Signature(bytes.NewReader(data), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 3 {
+		t.Fatalf("got %d blocks of 2500 bytes, want 3", len(blocks))
+	}
+	last := sha256.Sum256(data[2048:])
+	if blocks[2].Strong != hex.EncodeToString(last[:]) || blocks[2].Weak != Weak(data[2048:]) {
+		t.Errorf("got %+v for the short last block", blocks[2])
+	}
+	if blocks, err := Signature(bytes.NewReader(nil), 1024); err != nil || len(blocks) != 0 {
+		t.Errorf("got %v, %v for an empty file", blocks, err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	const blockSize = 1024
+	basis := make([]byte, 20*blockSize+100)
+	for i := range basis {
+		basis[i] = byte(rand.IntN(256))
+	}
+	blocks, err := Signature(bytes.NewReader(basis), blockSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := func(f func(b []byte) []byte) []byte { return f(append([]byte(nil), basis...)) }
+	tests := []struct {
+		desc  string
+		newer []byte
+	}{
+		{"the same file", basis},
+		{"a byte changed", edit(func(b []byte) []byte { b[5000]++; return b })},
+		{"data inserted", edit(func(b []byte) []byte { return append(b[:3000], append([]byte("inserted"), b[3000:]...)...) })},
+		{"data removed", edit(func(b []byte) []byte { return append(b[:3000], b[6000:]...) })},
+		{"data appended", edit(func(b []byte) []byte { return append(b, "appended"...) })},
+		{"another file", []byte("entirely new")},
+		{"an empty file", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			d := makeDelta(blocks, blockSize, tt.newer)
+			var out bytes.Buffer
+			n, err := Apply(&out, bytes.NewReader(d), bytes.NewReader(basis), int64(len(basis)), blockSize, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != int64(len(tt.newer)) || !bytes.Equal(out.Bytes(), tt.newer) {
+				t.Errorf("reconstructed %d bytes that differ from the %d of the file", n, len(tt.newer))
+			}
+			// A small change costs little more than the blocks it touches.
+			if len(tt.newer) > len(basis)/2 && len(d) > 4*blockSize {
+				t.Errorf("got a delta of %d bytes", len(d))
+			}
+		})
+	}
+}
+
+func TestApplyErrors(t *testing.T) {
+	const blockSize = 1024
+	basis := bytes.Repeat([]byte("a"), 3*blockSize)
+	copyOp := func(first uint64, count uint32) []byte {
+		d := binary.BigEndian.AppendUint64([]byte{OpCopy}, first)
+		return binary.BigEndian.AppendUint32(d, count)
+	}
+	dataOp := func(n uint32, data string) []byte {
+		return append(binary.BigEndian.AppendUint32([]byte{OpData}, n), data...)
+	}
+	tests := []struct {
+		desc    string
+		delta   []byte
+		maxSize int64
+		wantErr error
+	}{
+		{"an unknown instruction", []byte("X"), 1 << 20, ErrMalformed},
+		{"blocks beyond the basis file", copyOp(2, 2), 1 << 20, ErrMalformed},
+		{"a first block beyond the basis file", copyOp(3, 0), 1 << 20, ErrMalformed},
+		{"a truncated copy", copyOp(0, 1)[:6], 1 << 20, ErrMalformed},
+		{"truncated data", dataOp(10, "short"), 1 << 20, ErrMalformed},
+		{"too long a literal", dataOp(MaxLiteral+1, ""), 1 << 30, ErrMalformed},
+		{"copies over the maximum size", copyOp(0, 3), 2 * blockSize, ErrTooLarge},
+		{"data over the maximum size", dataOp(11, "hello world"), 10, ErrTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			_, err := Apply(&bytes.Buffer{}, bytes.NewReader(tt.delta), bytes.NewReader(basis), int64(len(basis)), blockSize, tt.maxSize)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+// Package diskspace refuses uploads whilst a disk that files are stored on is nearly full.
+//
+// Why stop short of full? A full disk fails more than the upload that filled it: the metadata
+// stores and logs cannot be written either, and on a volume shared with the system, neither
+// can anything else on the machine.
+package diskspace
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/notify"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// checkInterval is how often the disks are checked between uploads, so that metrics and
+// alerts follow their free space whilst none arrive.
+const checkInterval = 30 * time.Second
+
+// Observer is told the free space of the disks, for metrics.
+type Observer interface {
+	// SetFreeSpace reports the bytes free on the disk of the storage directory dir, and
+	// whether that is below the minimum.
+	SetFreeSpace(dir string, free int64, low bool)
+}
+
+// Guard watches the free space of the disks that files are stored on. A nil *Guard, for a
+// server without a minimum, refuses nothing.
+type Guard struct {
+	min      int64
+	storage  storage.Disk
+	notifier *notify.Notifier
+	render   *respond.Renderer
+	logger   *log.Logger
+
+	mu       sync.Mutex
+	low      map[string]bool // by directory; guarded by mu
+	observer Observer        // guarded by mu
+
+	stop chan struct{} // closed by Close
+	wg   sync.WaitGroup
+}
+
+// New returns a guard keeping minFreeMB free on the disk of every directory of st, or nil if
+// minFreeMB is 0. It fails if the free space of a directory cannot be read, or if st is not
+// on disk.
+func New(minFreeMB int64, st storage.Storage, notifier *notify.Notifier, render *respond.Renderer, logger *log.Logger) (*Guard, error) {
+	if minFreeMB <= 0 {
+		return nil, nil
+	}
+	disk, ok := st.(storage.Disk)
+	if !ok {
+		return nil, fmt.Errorf("minimum free space: %w", storage.ErrNotOnDisk)
+	}
+	g := &Guard{
+		min:      minFreeMB << 20,
+		storage:  disk,
+		notifier: notifier,
+		render:   render,
+		logger:   logger,
+		low:      make(map[string]bool),
+		stop:     make(chan struct{}),
+	}
+	for _, dir := range disk.Dirs() {
+		if _, err := available(dir); err != nil {
+			return nil, fmt.Errorf("error reading the free space of %s: %w", dir, err)
+		}
+		g.check(dir)
+	}
+	return g, nil
+}
+
+// Observe reports the free space of the disks to obs from now on.
+func (g *Guard) Observe(obs Observer) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	g.observer = obs
+	g.mu.Unlock()
+	for _, dir := range g.storage.Dirs() {
+		g.check(dir)
+	}
+}
+
+// Watch starts checking the disks periodically, until the guard is closed.
+func (g *Guard) Watch() {
+	if g == nil {
+		return
+	}
+	g.wg.Go(func() {
+		ticker := time.NewTicker(checkInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-g.stop:
+				return
+			case <-ticker.C:
+			}
+			for _, dir := range g.storage.Dirs() {
+				g.check(dir)
+			}
+		}
+	})
+}
+
+// Close stops the periodic checks started by Watch. Uploads are still checked.
+func (g *Guard) Close() {
+	if g == nil {
+		return
+	}
+	close(g.stop)
+	g.wg.Wait()
+}
+
+// Low reports whether the disk that the file or directory name is stored on has less than
+// the minimum free. The disk is checked anew, as an upload can use up the space in seconds.
+func (g *Guard) Low(name string) bool {
+	if g == nil {
+		return false
+	}
+	return g.check(g.storage.Dir(name))
+}
+
+// Refuse wraps an upload handler, refusing its requests with 507 whilst the disk they would
+// be stored on is low on space: that of the file named in the path, or else the storage
+// directory's. The files of an upload are checked again as they are stored, as they may be
+// sharded to other disks.
+func (g *Guard) Refuse(next http.HandlerFunc) http.HandlerFunc {
+	if g == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !g.Low(r.PathValue("name")) {
+			next(w, r)
+			return
+		}
+		// The body is never read, so the connection cannot be reused.
+		w.Header().Set("Connection", "close")
+		g.render.Error(w, r, http.StatusInsufficientStorage, "insufficient storage",
+			fmt.Sprintf("uploads are refused whilst less than %d MB is free", g.min>>20))
+	}
+}
+
+// check reads the free space of the disk of dir, and reports whether it is below the
+// minimum, logging and alerting when it falls below or recovers.
+//
+// Why count an error as enough space? A check that fails, such as on a network filesystem
+// that does not report its space, must not stop every upload; the error is logged instead.
+func (g *Guard) check(dir string) bool {
+	free, err := available(dir)
+	if err != nil {
+		g.logger.Printf("error reading the free space of %s: %v\n", dir, err)
+		return false
+	}
+	low := free < g.min
+	g.mu.Lock()
+	was := g.low[dir]
+	g.low[dir] = low
+	obs := g.observer
+	g.mu.Unlock()
+
+	if obs != nil {
+		obs.SetFreeSpace(dir, free, low)
+	}
+	switch {
+	case low && !was:
+		g.logger.Printf("WARNING: %s has %d MB free, below the minimum of %d MB; refusing uploads to it\n", dir, free>>20, g.min>>20)
+		g.notifier.Notify(notify.Event{Type: notify.LowSpace, Name: dir, Size: free})
+	case !low && was:
+		g.logger.Printf("%s has %d MB free again; accepting uploads to it\n", dir, free>>20)
+	}
+	return low
+}
+
+// available returns the bytes free on the disk of dir, or of its nearest parent if dir has
+// yet to be created, as the storage directory is by the first upload.
+func available(dir string) (int64, error) {
+	for {
+		free, err := freeSpace(dir)
+		parent := filepath.Dir(dir)
+		if !errors.Is(err, fs.ErrNotExist) || parent == dir {
+			return free, err
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,146 @@
+package diskspace
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/respond"
+	"github.com/mascotmascot1/fileserver/internal/shard"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+	"github.com/mascotmascot1/fileserver/pkg/storage/memfs"
+)
+
+// observation is a call to SetFreeSpace.
+type observation struct {
+	dir  string
+	free int64
+	low  bool
+}
+
+// recorder is an Observer keeping what it is told.
+type recorder []observation
+
+func (rec *recorder) SetFreeSpace(dir string, free int64, low bool) {
+	*rec = append(*rec, observation{dir, free, low})
+}
+
+// newTestGuard returns a guard keeping minFreeMB free in a new storage directory, and the
+// log it writes to.
+func newTestGuard(t *testing.T, minFreeMB int64) (*Guard, *bytes.Buffer) {
+	t.Helper()
+	layout, err := shard.New(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	logger := log.New(&logs, "", 0)
+	g, err := New(minFreeMB, layout, nil, respond.NewRenderer(respond.FormatJSON, logger), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Close)
+	return g, &logs
+}
+
+func TestNew(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	if g, err := New(0, memfs.New().Dir("/srv/files"), nil, nil, logger); g != nil || err != nil {
+		t.Errorf("got %v, %v with no minimum, want no guard", g, err)
+	}
+	if _, err := New(100, memfs.New().Dir("/srv/files"), nil, nil, logger); !errors.Is(err, storage.ErrNotOnDisk) {
+		t.Errorf("got error %v for a storage in memory, want %v", err, storage.ErrNotOnDisk)
+	}
+}
+
+func TestLow(t *testing.T) {
+	// No disk has a petabyte free.
+	g, logs := newTestGuard(t, 1<<30)
+	dir := g.storage.Dir("")
+	var rec recorder
+	g.Observe(&rec)
+	if len(rec) != 1 || rec[0].dir != dir || rec[0].free <= 0 || !rec[0].low {
+		t.Fatalf("observed %+v, want the free space of %s, low", rec, dir)
+	}
+
+	for range 2 {
+		if !g.Low("docs/a.txt") {
+			t.Error("the disk is not low on space")
+		}
+	}
+	if n := strings.Count(logs.String(), "WARNING: "+dir+" has "); n != 1 {
+		t.Errorf("warned %d times, want once:\n%s", n, logs)
+	}
+
+	g.min = 1
+	if g.Low("docs/a.txt") {
+		t.Error("the disk is low on space below the new minimum")
+	}
+	if !strings.Contains(logs.String(), dir+" has ") || !strings.Contains(logs.String(), " MB free again; accepting uploads to it") {
+		t.Errorf("the recovery was not logged:\n%s", logs)
+	}
+	if last := rec[len(rec)-1]; last.low {
+		t.Errorf("observed %+v once recovered", last)
+	}
+
+	var none *Guard
+	if none.Low("a.txt") {
+		t.Error("a nil guard reports low space")
+	}
+}
+
+func TestRefuse(t *testing.T) {
+	low, _ := newTestGuard(t, 1<<30)
+	enough, _ := newTestGuard(t, 1)
+	tests := []struct {
+		desc       string
+		guard      *Guard
+		wantStatus int
+	}{
+		{"a disk low on space", low, http.StatusInsufficientStorage},
+		{"a disk with enough space", enough, http.StatusCreated},
+		{"no minimum", nil, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			served := false
+			h := tt.guard.Refuse(func(w http.ResponseWriter, r *http.Request) {
+				served = true
+				w.WriteHeader(http.StatusCreated)
+			})
+			r := httptest.NewRequest(http.MethodPut, "/api/files/a.txt", strings.NewReader("a.txt"))
+			r.SetPathValue("name", "a.txt")
+			w := httptest.NewRecorder()
+			h(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			refused := tt.wantStatus == http.StatusInsufficientStorage
+			if served == refused {
+				t.Errorf("served %v, want %v", served, !refused)
+			}
+			// The body is left unread, so the connection cannot be kept.
+			if got := w.Header().Get("Connection"); (got == "close") != refused {
+				t.Errorf("got Connection %q", got)
+			}
+		})
+	}
+}
+
+// TestAvailable checks that a directory yet to be created is measured by its parent.
+func TestAvailable(t *testing.T) {
+	dir := t.TempDir()
+	free, err := available(filepath.Join(dir, "files", "docs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free <= 0 {
+		t.Errorf("got %d bytes free", free)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || dragonfly || openbsd || netbsd || solaris || windows)
+
+package diskspace
+
+import "errors"
+
+// freeSpace reports that the free space of disks cannot be read on this platform.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
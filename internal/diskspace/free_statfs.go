@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+package diskspace
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the bytes available to the server on the disk of dir, leaving out those
+// reserved for the superuser.
+func freeSpace(dir string) (int64, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
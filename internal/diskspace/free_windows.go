@@ -0,0 +1,19 @@
+//go:build windows
+
+package diskspace
+
+import "golang.org/x/sys/windows"
+
+// freeSpace returns the bytes available to the server on the disk of dir, within any disk
+// quota of the account it runs as.
+func freeSpace(dir string) (int64, error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var avail uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &avail, nil, nil); err != nil {
+		return 0, err
+	}
+	return int64(avail), nil
+}
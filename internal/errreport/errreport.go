@@ -0,0 +1,269 @@
+package errreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// queueSize bounds the number of events waiting to be sent. Why drop events beyond it?
+// An outage that makes every request fail must not also make the server buffer an
+// unbounded number of reports, or block requests on a slow error tracker.
+const queueSize = 100
+
+// redactedHeaders are never sent to the error tracker, as they carry credentials.
+var redactedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"X-Api-Key":     true,
+	"X-Csrf-Token":  true,
+}
+
+// event is a Sentry event, reduced to the fields the server fills in.
+type event struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Message     *message          `json:"message,omitempty"`
+	Exception   *exceptions       `json:"exception,omitempty"`
+	Request     *request          `json:"request,omitempty"`
+	User        map[string]string `json:"user,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]string `json:"extra,omitempty"`
+}
+
+type message struct {
+	Formatted string `json:"formatted"`
+}
+
+type exceptions struct {
+	Values []exception `json:"values"`
+}
+
+type exception struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type request struct {
+	URL         string            `json:"url"`
+	Method      string            `json:"method"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+}
+
+// Reporter sends panics and internal errors to a Sentry-compatible error tracker
+// (Sentry, GlitchTip, and so on). A nil *Reporter is valid and reports nothing, so callers
+// need not check whether reporting is enabled.
+type Reporter struct {
+	endpoint    string
+	auth        string
+	environment string
+	serverName  string
+	userOf      func(*http.Request) string
+	client      *http.Client
+	queue       chan *event
+	logger      *log.Logger
+	stop        chan struct{} // closed by Close
+	done        chan struct{} // closed once run returns
+}
+
+// New creates a Reporter for the given DSN, of the form "https://<key>@<host>/<project>".
+// It returns nil if dsn is empty. userOf names the caller of a request, if known.
+func New(dsn, environment string, userOf func(*http.Request) string, logger *log.Logger) (*Reporter, error) {
+	if dsn == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("parsing error reporting DSN: %w", err)
+	}
+	key := u.User.Username()
+	// The project ID is the last path segment; anything before it is a path prefix
+	// under which a self-hosted tracker is mounted.
+	prefix, project := "", strings.Trim(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	if key == "" || project == "" || u.Host == "" {
+		return nil, fmt.Errorf("error reporting DSN must look like https://<key>@<host>/<project>")
+	}
+	hostname, _ := os.Hostname()
+
+	rep := &Reporter{
+		endpoint:    fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, prefix, project),
+		auth:        fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=fileserver/1.0", key),
+		environment: environment,
+		serverName:  hostname,
+		userOf:      userOf,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *event, queueSize),
+		logger:      logger,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go rep.run()
+	return rep, nil
+}
+
+// CapturePanic reports a recovered panic together with its stack trace.
+func (rep *Reporter) CapturePanic(r *http.Request, value any, stack []byte) {
+	if rep == nil {
+		return
+	}
+	ev := rep.newEvent(r, "fatal")
+	ev.Exception = &exceptions{Values: []exception{{Type: "panic", Value: fmt.Sprint(value)}}}
+	ev.Extra = map[string]string{"stack": string(stack)}
+	rep.enqueue(ev)
+}
+
+// CaptureMessage reports an internal error that was answered with the given status.
+func (rep *Reporter) CaptureMessage(r *http.Request, status int, msg string) {
+	if rep == nil {
+		return
+	}
+	ev := rep.newEvent(r, "error")
+	ev.Message = &message{Formatted: msg}
+	ev.Tags["status"] = fmt.Sprint(status)
+	rep.enqueue(ev)
+}
+
+// newEvent builds an event describing the request it occurred in.
+func (rep *Reporter) newEvent(r *http.Request, level string) *event {
+	id := make([]byte, 16)
+	rand.Read(id)
+	ev := &event{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Level:       level,
+		Platform:    "go",
+		Logger:      "fileserver",
+		ServerName:  rep.serverName,
+		Environment: rep.environment,
+		Tags:        map[string]string{},
+	}
+	if r == nil {
+		return ev
+	}
+
+	headers := make(map[string]string, len(r.Header))
+	for name, values := range r.Header {
+		if !redactedHeaders[name] {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	ev.Request = &request{
+		URL:         scheme + "://" + r.Host + r.URL.Path,
+		Method:      r.Method,
+		QueryString: r.URL.RawQuery,
+		Headers:     headers,
+		Env:         map[string]string{"REMOTE_ADDR": r.RemoteAddr},
+	}
+	if r.Pattern != "" {
+		ev.Tags["route"] = r.Pattern
+	}
+	if rep.userOf != nil {
+		if username := rep.userOf(r); username != "" {
+			ev.User = map[string]string{"username": username}
+		}
+	}
+	return ev
+}
+
+// enqueue hands the event to the sender without blocking the request.
+func (rep *Reporter) enqueue(ev *event) {
+	select {
+	case rep.queue <- ev:
+	default:
+		rep.logger.Printf("error reporting queue is full, dropping event %s\n", ev.EventID)
+	}
+}
+
+// run sends queued events one at a time until the reporter is closed.
+func (rep *Reporter) run() {
+	defer close(rep.done)
+	for {
+		select {
+		case <-rep.stop:
+			if len(rep.queue) > 0 {
+				rep.logger.Printf("warn: dropping %d error reports not sent before the server stopped\n", len(rep.queue))
+			}
+			return
+		case ev := <-rep.queue:
+			if err := rep.send(ev); err != nil {
+				rep.logger.Printf("error sending error report %s: %v\n", ev.EventID, err)
+			}
+		}
+	}
+}
+
+// Close stops sending reports, waiting for the one being sent.
+func (rep *Reporter) Close() {
+	if rep == nil {
+		return
+	}
+	close(rep.stop)
+	<-rep.done
+}
+
+// send posts one event as a Sentry envelope: a header line, an item header and the event.
+func (rep *Reporter) send(ev *event) error {
+	payload, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "{\"event_id\":%q,\"sent_at\":%q}\n", ev.EventID, time.Now().UTC().Format(time.RFC3339Nano))
+	fmt.Fprintf(&body, "{\"type\":\"event\",\"length\":%d}\n", len(payload))
+	body.Write(payload)
+	body.WriteByte('\n')
+
+	req, err := http.NewRequest(http.MethodPost, rep.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", rep.auth)
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("error tracker responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// contextKey is the type of the request context key holding the Reporter.
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying rep, so that code deep in the handler chain
+// (e.g. the error renderer) can report without having the reporter passed in.
+func NewContext(ctx context.Context, rep *Reporter) context.Context {
+	return context.WithValue(ctx, contextKey{}, rep)
+}
+
+// FromContext returns the Reporter stored in ctx, or nil.
+func FromContext(ctx context.Context) *Reporter {
+	rep, _ := ctx.Value(contextKey{}).(*Reporter)
+	return rep
+}
@@ -0,0 +1,161 @@
+package errreport
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestTracker starts an error tracker accepting envelopes for project 42 with key
+// "key", and returns its DSN and the events it receives.
+func newTestTracker(t *testing.T) (string, <-chan event) {
+	t.Helper()
+	events := make(chan event, 10)
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/42/envelope/" || !strings.Contains(r.Header.Get("X-Sentry-Auth"), "sentry_key=key,") {
+			t.Errorf("got envelope for %s with auth %q", r.URL.Path, r.Header.Get("X-Sentry-Auth"))
+			http.Error(w, "unknown project", http.StatusForbidden)
+			return
+		}
+		// An envelope header, an item header and the event.
+		lines := bufio.NewScanner(r.Body)
+		lines.Buffer(nil, 1<<20)
+		var got []string
+		for lines.Scan() {
+			got = append(got, lines.Text())
+		}
+		if len(got) != 3 {
+			t.Errorf("got an envelope of %d lines, want 3", len(got))
+			return
+		}
+		var ev event
+		if err := json.Unmarshal([]byte(got[2]), &ev); err != nil {
+			t.Error(err)
+			return
+		}
+		if !strings.Contains(got[0], ev.EventID) {
+			t.Errorf("envelope header %s does not name event %s", got[0], ev.EventID)
+		}
+		events <- ev
+	}))
+	t.Cleanup(tracker.Close)
+	return strings.Replace(tracker.URL, "://", "://key@", 1) + "/42", events
+}
+
+// receive returns the next event sent to the tracker.
+func receive(t *testing.T, events <-chan event) event {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event reported")
+		return event{}
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		dsn          string
+		wantEndpoint string // "" for an invalid DSN
+	}{
+		{"https://key@sentry.example.com/42", "https://sentry.example.com/api/42/envelope/"},
+		{"https://key@example.com/sentry/42/", "https://example.com/sentry/api/42/envelope/"},
+		{"http://key@localhost:9000/1", "http://localhost:9000/api/1/envelope/"},
+		{"https://sentry.example.com/42", ""},
+		{"https://key@sentry.example.com/", ""},
+		{"key@sentry.example.com/42", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dsn, func(t *testing.T) {
+			rep, err := New(tt.dsn, "", nil, log.New(io.Discard, "", 0))
+			if tt.wantEndpoint == "" {
+				if err == nil {
+					rep.Close()
+					t.Fatal("accepted an invalid DSN")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rep.Close()
+			if rep.endpoint != tt.wantEndpoint {
+				t.Errorf("got endpoint %s, want %s", rep.endpoint, tt.wantEndpoint)
+			}
+		})
+	}
+
+	if rep, err := New("", "", nil, nil); rep != nil || err != nil {
+		t.Errorf("got %v, %v without a DSN, want reporting disabled", rep, err)
+	}
+}
+
+func TestCapture(t *testing.T) {
+	dsn, events := newTestTracker(t)
+	rep, err := New(dsn, "staging", func(r *http.Request) string { return "alice" }, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rep.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "http://files.example.com/download/a.txt?inline=1", nil)
+	r.Pattern = "GET /download/{name...}"
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("User-Agent", "curl/8.0")
+
+	rep.CaptureMessage(r, http.StatusInternalServerError, "reading a.txt failed")
+	ev := receive(t, events)
+	if ev.Level != "error" || ev.Environment != "staging" || ev.Message == nil || ev.Message.Formatted != "reading a.txt failed" {
+		t.Errorf("got %+v", ev)
+	}
+	if ev.Tags["status"] != "500" || ev.Tags["route"] != r.Pattern {
+		t.Errorf("got tags %v", ev.Tags)
+	}
+	if ev.User["username"] != "alice" {
+		t.Errorf("got user %v, want alice", ev.User)
+	}
+	if ev.Request == nil {
+		t.Fatal("no request in the event")
+	}
+	if ev.Request.URL != "http://files.example.com/download/a.txt" || ev.Request.QueryString != "inline=1" || ev.Request.Method != http.MethodGet {
+		t.Errorf("got request %+v", ev.Request)
+	}
+	if ev.Request.Headers["User-Agent"] != "curl/8.0" {
+		t.Errorf("got headers %v, want User-Agent", ev.Request.Headers)
+	}
+	for _, name := range []string{"Authorization", "Cookie"} {
+		if _, ok := ev.Request.Headers[name]; ok {
+			t.Errorf("sent %s to the tracker", name)
+		}
+	}
+
+	rep.CapturePanic(r, "nil map", []byte("goroutine 1 [running]:"))
+	ev = receive(t, events)
+	if ev.Level != "fatal" || ev.Exception == nil || ev.Exception.Values[0].Value != "nil map" || ev.Extra["stack"] != "goroutine 1 [running]:" {
+		t.Errorf("got %+v", ev)
+	}
+}
+
+// TestDisabled checks that a nil Reporter, as returned without a DSN, may be used.
+func TestDisabled(t *testing.T) {
+	var rep *Reporter
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	rep.CaptureMessage(r, http.StatusInternalServerError, "failed")
+	rep.CapturePanic(r, "panic", nil)
+	rep.Close()
+	if FromContext(context.Background()) != nil {
+		t.Error("found a reporter in an empty context")
+	}
+	if FromContext(NewContext(context.Background(), rep)) != nil {
+		t.Error("found a reporter after storing none")
+	}
+}
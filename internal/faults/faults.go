@@ -0,0 +1,134 @@
+// Package faults injects slow writes and write errors into stored files, so that the retries
+// of clients and the clean-up of partial files can be tested against a real server. It is for
+// test and development servers only.
+//
+// Why rules by path rather than faults at random? A test uploads to a path of its choosing and
+// knows which fault it meets, and the same test meets the same fault on every run.
+package faults
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// rule is a parsed config.FaultRule.
+type rule struct {
+	prefixes   []string
+	writeDelay time.Duration
+	err        error
+	afterBytes int64
+	rate       float64
+}
+
+// Injector decides which writes fail. A nil *Injector, for a server without fault injection,
+// injects nothing.
+type Injector struct {
+	rules []rule
+	mu    sync.Mutex
+	rng   *rand.Rand // guarded by mu
+}
+
+// New returns an injector with the rules of cfg, or nil if fault injection is off.
+func New(cfg config.FaultsConfig, logger *log.Logger) (*Injector, error) {
+	if !cfg.Enabled {
+		return nil, nil
+	}
+	inj := &Injector{rng: rand.New(rand.NewPCG(cfg.Seed, 0))}
+	for i, rc := range cfg.Rules {
+		r := rule{writeDelay: rc.WriteDelay, afterBytes: rc.AfterBytes, rate: rc.Rate}
+		for _, p := range rc.Paths {
+			r.prefixes = append(r.prefixes, strings.TrimPrefix(p, "/"))
+		}
+		switch rc.Error {
+		case "":
+		case "nospace":
+			r.err = syscall.ENOSPC
+		case "io":
+			r.err = syscall.EIO
+		default:
+			return nil, fmt.Errorf("faults.rules[%d]: unknown error %q: use \"nospace\" or \"io\"", i, rc.Error)
+		}
+		if rc.WriteDelay < 0 || rc.AfterBytes < 0 || rc.Rate < 0 || rc.Rate > 1 {
+			return nil, fmt.Errorf("faults.rules[%d]: writeDelay and afterBytes must not be negative, and rate must be between 0 and 1", i)
+		}
+		inj.rules = append(inj.rules, r)
+	}
+	if len(inj.rules) == 0 {
+		return nil, errors.New("faults.enabled is set, but faults.rules is empty")
+	}
+	logger.Printf("WARNING: fault injection is enabled; writes matching %d rules will be slowed or fail\n", len(inj.rules))
+	return inj, nil
+}
+
+// Writer returns w, the writer of the stored file name, wrapped so that its writes meet the
+// faults of the first rule that matches name. Whether a rule with a rate applies is drawn
+// once per file.
+func (inj *Injector) Writer(name string, w io.Writer) io.Writer {
+	if inj == nil {
+		return w
+	}
+	for _, r := range inj.rules {
+		if !r.matches(name) {
+			continue
+		}
+		if r.rate > 0 && r.rate < 1 {
+			inj.mu.Lock()
+			skip := inj.rng.Float64() >= r.rate
+			inj.mu.Unlock()
+			if skip {
+				return w
+			}
+		}
+		return &faultyWriter{w: w, name: name, rule: r}
+	}
+	return w
+}
+
+func (r *rule) matches(name string) bool {
+	if len(r.prefixes) == 0 {
+		return true
+	}
+	for _, p := range r.prefixes {
+		if strings.HasPrefix(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// faultyWriter writes to w with the faults of rule.
+type faultyWriter struct {
+	w       io.Writer
+	name    string
+	rule    rule
+	written int64
+}
+
+func (fw *faultyWriter) Write(p []byte) (int, error) {
+	if fw.rule.writeDelay > 0 {
+		time.Sleep(fw.rule.writeDelay)
+	}
+	if fw.rule.err == nil || fw.written+int64(len(p)) <= fw.rule.afterBytes {
+		n, err := fw.w.Write(p)
+		fw.written += int64(n)
+		return n, err
+	}
+	// The bytes up to the limit are written, as a disk filling up would, so that the partial
+	// file is left for the server to clean up.
+	n, err := fw.w.Write(p[:max(fw.rule.afterBytes-fw.written, 0)])
+	fw.written += int64(n)
+	if err == nil {
+		err = &fs.PathError{Op: "write", Path: fw.name, Err: fw.rule.err}
+	}
+	return n, err
+}
@@ -0,0 +1,155 @@
+// Package fetch downloads files from remote servers on behalf of clients, from the hosts
+// and over the schemes the operator allows.
+package fetch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// ErrNotAllowed is wrapped by the errors for URLs that may not be fetched.
+var ErrNotAllowed = errors.New("URL is not allowed")
+
+// StatusError is returned for a remote server answering with anything but success.
+type StatusError struct {
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "remote server answered " + e.Status
+}
+
+// Fetcher fetches URLs that pass its allowlist. A nil *Fetcher, for a server that does not
+// fetch, allows nothing.
+type Fetcher struct {
+	hosts   []string
+	schemes map[string]bool
+	client  *http.Client
+}
+
+// New returns a fetcher as configured by cfg, or nil if no hosts are allowed.
+func New(cfg config.FetchConfig) (*Fetcher, error) {
+	if len(cfg.Hosts) == 0 {
+		return nil, nil
+	}
+	f := &Fetcher{schemes: make(map[string]bool, len(cfg.Schemes))}
+	for _, scheme := range cfg.Schemes {
+		scheme = strings.ToLower(scheme)
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("invalid fetch scheme %q: must be http or https", scheme)
+		}
+		f.schemes[scheme] = true
+	}
+	for _, host := range cfg.Hosts {
+		f.hosts = append(f.hosts, strings.ToLower(strings.TrimSpace(host)))
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	if !cfg.AllowPrivate {
+		// Why check at dial time rather than when the URL is checked? The name could resolve
+		// to a public address then and a private one a moment later; the address actually
+		// connected to is the one that matters.
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !public(ip) {
+				return fmt.Errorf("%w: %s is not a public address", ErrNotAllowed, host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// Proxies are not used, as the dial check would only ever see the proxy's address.
+	transport.Proxy = nil
+	f.client = &http.Client{
+		Transport: transport,
+		Timeout:   cfg.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			// Redirects must stay within the allowlist, or one allowed host could send the
+			// server anywhere.
+			return f.Check(req.URL)
+		},
+	}
+	return f, nil
+}
+
+// public reports whether ip is an address on the public internet.
+func public(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsUnspecified() && !ip.IsMulticast() && !ip.IsInterfaceLocalMulticast()
+}
+
+// Check returns an error wrapping ErrNotAllowed unless u may be fetched.
+func (f *Fetcher) Check(u *url.URL) error {
+	if f == nil {
+		return fmt.Errorf("%w: fetching is disabled", ErrNotAllowed)
+	}
+	if !f.schemes[strings.ToLower(u.Scheme)] {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrNotAllowed, u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%w: URLs with credentials are not allowed", ErrNotAllowed)
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range f.hosts {
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: host %q is not allowed", ErrNotAllowed, host)
+}
+
+// Get requests rawURL, which must pass the allowlist, and returns the response of a remote
+// server that answered with success. The caller must close its body.
+func (f *Fetcher) Get(ctx context.Context, rawURL string) (*http.Response, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotAllowed, err)
+	}
+	if err := f.Check(u); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{Status: resp.Status}
+	}
+	return resp, nil
+}
+
+// FileName returns the name a fetched file is stored under unless the client chose one:
+// the name the remote server gave it, or else the last element of the URL's path.
+func FileName(resp *http.Response) string {
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return path.Base(strings.ReplaceAll(params["filename"], "\\", "/"))
+	}
+	name := path.Base(resp.Request.URL.Path)
+	if name == "/" || name == "." {
+		return ""
+	}
+	return name
+}
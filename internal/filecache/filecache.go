@@ -0,0 +1,118 @@
+package filecache
+
+import (
+	"container/list"
+	"io/fs"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is the cached content of one file, together with the attributes it had when it
+// was read, so that a stale entry can be recognised cheaply.
+type Entry struct {
+	Data    []byte
+	ModTime time.Time
+}
+
+// Matches reports whether info still describes the file the entry was read from.
+func (e *Entry) Matches(info fs.FileInfo) bool {
+	return info.Mode().IsRegular() && info.Size() == int64(len(e.Data)) && info.ModTime().Equal(e.ModTime)
+}
+
+// item is the value stored in the LRU list.
+type item struct {
+	name  string
+	entry *Entry
+}
+
+// Cache is a size-bounded, least-recently-used cache of small file contents.
+//
+// Why cache files in memory? Small files that are downloaded constantly (icons, configs)
+// otherwise cost an open, a read and a close every time. A nil *Cache is valid and caches nothing,
+// so callers need not check whether caching is enabled.
+type Cache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	maxEntry int64
+	used     int64
+	order    *list.List               // front is most recently used
+	items    map[string]*list.Element // keyed by storage-relative name
+}
+
+// New creates a cache holding at most maxBytes of file data, with no single file larger
+// than maxEntry. It returns nil, a disabled cache, when either limit is not positive.
+func New(maxBytes, maxEntry int64) *Cache {
+	if maxBytes <= 0 || maxEntry <= 0 {
+		return nil
+	}
+	return &Cache{
+		maxBytes: maxBytes,
+		maxEntry: min(maxEntry, maxBytes),
+		order:    list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+// Fits reports whether a file of the given size may be cached.
+func (c *Cache) Fits(size int64) bool {
+	return c != nil && size <= c.maxEntry
+}
+
+// Get returns the entry for name and marks it as recently used.
+func (c *Cache) Get(name string) (*Entry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[name]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*item).entry, true
+}
+
+// Put stores the content of name, evicting the least recently used entries to make room.
+// Content larger than the per-entry limit is ignored.
+func (c *Cache) Put(name string, data []byte, modTime time.Time) {
+	if !c.Fits(int64(len(data))) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[name]; ok {
+		c.removeElement(el)
+	}
+	c.items[name] = c.order.PushFront(&item{name: name, entry: &Entry{Data: data, ModTime: modTime}})
+	c.used += int64(len(data))
+	for c.used > c.maxBytes {
+		c.removeElement(c.order.Back())
+	}
+}
+
+// Invalidate drops name and, if it is a directory, every cached file below it.
+// Handlers call it whenever they overwrite, move or delete files.
+func (c *Cache) Invalidate(name string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[name]; ok {
+		c.removeElement(el)
+	}
+	for key, el := range c.items {
+		if strings.HasPrefix(key, name+"/") {
+			c.removeElement(el)
+		}
+	}
+}
+
+// removeElement deletes an entry. The caller must hold the lock.
+func (c *Cache) removeElement(el *list.Element) {
+	it := c.order.Remove(el).(*item)
+	delete(c.items, it.name)
+	c.used -= int64(len(it.entry.Data))
+}
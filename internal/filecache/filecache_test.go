@@ -0,0 +1,116 @@
+package filecache
+
+import (
+	"io/fs"
+	"slices"
+	"testing"
+	"time"
+)
+
+// fileInfo describes a file for Matches.
+type fileInfo struct {
+	size    int64
+	modTime time.Time
+	mode    fs.FileMode
+}
+
+func (fi fileInfo) Name() string       { return "a.txt" }
+func (fi fileInfo) Size() int64        { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() any           { return nil }
+
+// cached returns the names in c, most recently used first.
+func cached(c *Cache) []string {
+	var names []string
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		names = append(names, el.Value.(*item).name)
+	}
+	return names
+}
+
+func TestCache(t *testing.T) {
+	now := time.Now()
+	c := New(10, 4)
+	c.Put("a", []byte("aaa"), now)
+	c.Put("b", []byte("bbb"), now)
+	c.Put("big", []byte("bigger"), now)
+	if _, ok := c.Get("big"); ok {
+		t.Error("cached a file over the per-entry limit")
+	}
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("a is not cached")
+	}
+	// b is now the least recently used, and goes to make room.
+	c.Put("c", []byte("ccc"), now)
+	c.Put("d", []byte("ddd"), now)
+	if got, want := cached(c), []string{"d", "c", "a"}; !slices.Equal(got, want) {
+		t.Errorf("cached %v, want %v", got, want)
+	}
+	if c.used != 9 {
+		t.Errorf("%d bytes used, want 9", c.used)
+	}
+
+	// Putting a file again replaces its entry.
+	c.Put("a", []byte("a2"), now)
+	if e, ok := c.Get("a"); !ok || string(e.Data) != "a2" || c.used != 8 {
+		t.Errorf("got %v, %v with %d bytes used, want a2 with 8", e, ok, c.used)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	now := time.Now()
+	c := New(100, 20)
+	for _, name := range []string{"docs", "docs/a.txt", "docs/sub/b.txt", "docsets/c.txt", "d.txt"} {
+		c.Put(name, []byte(name), now)
+	}
+	c.Invalidate("docs")
+	got := cached(c)
+	slices.Sort(got)
+	if want := []string{"d.txt", "docsets/c.txt"}; !slices.Equal(got, want) {
+		t.Errorf("cached %v after invalidating docs, want %v", got, want)
+	}
+	if c.used != int64(len("d.txt")+len("docsets/c.txt")) {
+		t.Errorf("%d bytes used, want those of the files left", c.used)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	now := time.Now()
+	e := &Entry{Data: []byte("abc"), ModTime: now}
+	tests := []struct {
+		desc string
+		info fileInfo
+		want bool
+	}{
+		{"the same file", fileInfo{3, now, 0}, true},
+		{"a file of another size", fileInfo{4, now, 0}, false},
+		{"a file modified since", fileInfo{3, now.Add(time.Second), 0}, false},
+		{"a directory", fileInfo{3, now, fs.ModeDir}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got := e.Matches(tt.info); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDisabled(t *testing.T) {
+	for _, c := range []*Cache{New(0, 10), New(10, 0)} {
+		if c != nil {
+			t.Fatalf("New returned an enabled cache with a limit of zero")
+		}
+		c.Put("a", []byte("a"), time.Now())
+		if _, ok := c.Get("a"); ok || c.Fits(0) {
+			t.Error("disabled cache holds a file")
+		}
+		c.Invalidate("a")
+	}
+	// A per-entry limit over the total is lowered to it.
+	if c := New(10, 100); c.Fits(11) {
+		t.Error("file larger than the cache fits")
+	}
+}
@@ -0,0 +1,86 @@
+package filemeta
+
+import (
+	"time"
+)
+
+// maxChanges is the number of changes the feed keeps. Older ones are dropped, and a client
+// whose cursor points before the oldest kept change has to list the files again.
+//
+// Why not keep them all? The feed is saved with every change, and a busy server would grow
+// it without bound, whereas clients that sync regularly only ever read its recent end.
+const maxChanges = 10000
+
+// The kinds of change recorded in the feed.
+const (
+	Created  = "create"
+	Modified = "modify"
+	Deleted  = "delete"
+	Moved    = "move"
+)
+
+// Change is one event of the change feed: a stored file that was created, modified, deleted
+// or moved, whether through the server or, as found by reconciliation, by other means.
+type Change struct {
+	// Seq orders the changes; it only ever grows, and serves as the cursor of the feed.
+	Seq  int64     `json:"seq"`
+	Type string    `json:"type"`
+	Path string    `json:"path"`
+	From string    `json:"from,omitempty"` // the previous path, for moves
+	ID   string    `json:"id,omitempty"`
+	Time time.Time `json:"time"`
+}
+
+// changeFeed is the document the change feed is saved as.
+type changeFeed struct {
+	Next    int64    `json:"next"` // the sequence number of the next change
+	Changes []Change `json:"changes"`
+}
+
+// changedLocked appends a change of kind typ to the feed. The caller must hold the lock, and
+// save the store.
+func (s *Store) changedLocked(typ string, e Entry, from string) {
+	s.feed.Next++
+	s.feed.Changes = append(s.feed.Changes, Change{
+		Seq:  s.feed.Next,
+		Type: typ,
+		Path: e.Path,
+		From: from,
+		ID:   e.ID,
+		Time: time.Now().UTC(),
+	})
+	if n := len(s.feed.Changes) - maxChanges; n > 0 {
+		// The dropped changes are freed once append next moves the slice to a new array.
+		s.feed.Changes = s.feed.Changes[n:]
+	}
+}
+
+// Changes returns up to limit changes made after the one numbered cursor, oldest first, or
+// from the oldest change kept for a negative cursor, along with the cursor to read on from.
+// It reports false if changes after cursor have already been dropped from the feed, or if
+// the cursor is from beyond its end, as after the feed was lost with the metadata directory.
+func (s *Store) Changes(cursor int64, limit int) ([]Change, int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cursor > s.feed.Next || len(s.feed.Changes) > 0 && cursor >= 0 && cursor < s.feed.Changes[0].Seq-1 {
+		return nil, 0, false
+	}
+	var list []Change
+	for _, c := range s.feed.Changes {
+		if c.Seq > cursor {
+			list = append(list, c)
+			if len(list) == limit {
+				return list, c.Seq, true
+			}
+		}
+	}
+	return list, s.feed.Next, true
+}
+
+// LatestChange returns the number of the latest change, a cursor from which only changes
+// made from now on are read.
+func (s *Store) LatestChange() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.feed.Next
+}
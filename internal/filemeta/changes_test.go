@@ -0,0 +1,106 @@
+package filemeta
+
+import (
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage/memfs"
+)
+
+// kinds returns the type and path of each change, as "type path" or "type from>path".
+func kinds(changes []Change) []string {
+	var list []string
+	for _, c := range changes {
+		s := c.Type + " "
+		if c.From != "" {
+			s += c.From + ">"
+		}
+		list = append(list, s+c.Path)
+	}
+	return list
+}
+
+func TestChanges(t *testing.T) {
+	fsys := memfs.New()
+	meta, st := fsys.Dir("metadata"), fsys.Dir("files")
+	s := openTestStore(t, meta, st)
+
+	s.Record("a.txt", writeFile(t, st, "a.txt", "first"), "")
+	s.Record("a.txt", writeFile(t, st, "a.txt", "second"), "")
+	root, err := st.OpenRoot("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	if err := root.MkdirAll("docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Rename("a.txt", "docs/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	s.Rename("a.txt", "docs/a.txt")
+	if err := root.Remove("docs/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	s.Remove("docs/a.txt")
+	want := []string{"create a.txt", "modify a.txt", "move a.txt>docs/a.txt", "delete docs/a.txt"}
+
+	changes, next, ok := s.Changes(-1, 10)
+	if got := kinds(changes); !ok || next != 4 || len(got) != len(want) {
+		t.Fatalf("got %v, %d, %v, want %v up to 4", got, next, ok, want)
+	}
+	for i, c := range changes {
+		if kinds(changes)[i] != want[i] || c.Seq != int64(i+1) || c.ID == "" || c.Time.IsZero() {
+			t.Errorf("change %d is %+v, want %s", i, c, want[i])
+		}
+	}
+	if changes[0].ID != changes[3].ID {
+		t.Error("the changes to one file have different IDs")
+	}
+
+	// Pages follow on from their cursor.
+	page, next, ok := s.Changes(1, 2)
+	if got := kinds(page); !ok || next != 3 || len(got) != 2 || got[0] != want[1] || got[1] != want[2] {
+		t.Errorf("got %v, %d, %v, want changes 2 and 3", got, next, ok)
+	}
+	if page, next, ok := s.Changes(s.LatestChange(), 10); !ok || len(page) != 0 || next != 4 {
+		t.Errorf("got %v, %d, %v from the latest change, want none", kinds(page), next, ok)
+	}
+	if _, _, ok := s.Changes(5, 10); ok {
+		t.Error("read on from a cursor beyond the end of the feed")
+	}
+
+	// The feed outlasts a restart, and the reconciliation records what changed meanwhile.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, st, "outside.txt", "added by hand")
+	s = openTestStore(t, meta, st)
+	if err := s.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	if page, next, ok := s.Changes(4, 10); !ok || next != 5 || len(page) != 1 || kinds(page)[0] != "create outside.txt" {
+		t.Errorf("got %v, %d, %v after reconciling, want outside.txt created", kinds(page), next, ok)
+	}
+}
+
+// TestChangesDropped checks that the feed keeps the latest changes, and that a cursor from
+// before them cannot be read on from.
+func TestChangesDropped(t *testing.T) {
+	fsys := memfs.New()
+	meta, st := fsys.Dir("metadata"), fsys.Dir("files")
+	s := openTestStore(t, meta, st)
+	info := writeFile(t, st, "a.txt", "content")
+	for range maxChanges + 10 {
+		s.Record("a.txt", info, "")
+	}
+	changes, next, ok := s.Changes(-1, maxChanges+10)
+	if !ok || len(changes) != maxChanges || changes[0].Seq != 11 || next != maxChanges+10 {
+		t.Fatalf("got %d changes from %d, %d, %v, want the latest %d", len(changes), changes[0].Seq, next, ok, maxChanges)
+	}
+	if _, _, ok := s.Changes(10, 10); !ok {
+		t.Error("refused the cursor of the last change dropped")
+	}
+	if _, _, ok := s.Changes(9, 10); ok {
+		t.Error("read on from a cursor before the changes kept")
+	}
+}
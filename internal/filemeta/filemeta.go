@@ -0,0 +1,756 @@
+// Package filemeta records what the server knows about each stored file beyond the
+// file itself, starting with its SHA-256 checksum.
+package filemeta
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"maps"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// saveDelay is how long a change may wait before the store is written to disk.
+//
+// Why not save on every change? The store holds an entry for every stored file, so a busy
+// upload directory would rewrite a large file many times a second. Anything lost in a crash
+// is rebuilt by the reconciliation at the next start.
+const saveDelay = time.Second
+
+// Entry records one stored file. Size and Modified describe the file when the entry was
+// last updated; the other fields only hold whilst the file still matches them.
+type Entry struct {
+	// ID identifies the file for good: it stays the same when the file is renamed, moved or
+	// replaced, so that others can refer to the file whatever becomes of its name.
+	ID string `json:"id,omitempty"`
+	// Path is the file's path relative to the storage directory.
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// SHA256 is the hex-encoded checksum of the contents, empty until it has been computed.
+	SHA256 string `json:"sha256,omitempty"`
+	// Fields holds the form fields the file was uploaded with, such as a description. Unlike
+	// the fields above, they describe the file whatever becomes of its contents.
+	Fields map[string]string `json:"fields,omitempty"`
+	// MissingSince is set when the file vanished from the storage directory without the
+	// server deleting it. The entry is kept so an administrator can tell what was lost, and
+	// verify a restored copy against its checksum.
+	MissingSince *time.Time `json:"missingSince,omitempty"`
+	// LastDownloaded is when the file was last downloaded, unset if it has not been since it
+	// was stored, for evicting the least recently used files first.
+	LastDownloaded *time.Time `json:"lastDownloaded,omitempty"`
+}
+
+// LastUsed returns when the file was last downloaded, or else stored.
+func (e Entry) LastUsed() time.Time {
+	if e.LastDownloaded != nil {
+		return *e.LastDownloaded
+	}
+	return e.Modified
+}
+
+// matches reports whether the entry still describes the file with the given attributes.
+func (e Entry) matches(info fs.FileInfo) bool {
+	return e.Size == info.Size() && e.Modified.Equal(info.ModTime().UTC())
+}
+
+// Store persists the entries to a JSON file in the metadata directory, and computes missing
+// checksums in the background.
+type Store struct {
+	meta     storage.Storage // the metadata directory
+	name     string
+	feedName string // where the change feed is saved, beside name
+	storage  storage.Storage
+	disk     storage.Disk // the storage, if entries are mirrored to extended attributes
+	logger   *log.Logger
+
+	mu        sync.Mutex
+	files     map[string]Entry  // keyed by path
+	ids       map[string]string // paths keyed by ID
+	saving    bool              // a save is scheduled
+	saveTimer *time.Timer       // of the scheduled save
+	pending   []string          // files waiting for their checksum
+	feed      changeFeed
+	wake      chan struct{}
+
+	// ctx is cancelled by Close, to stop the checksum worker.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// Open loads the store from the file name in meta, the metadata directory, for the files
+// stored in st, and starts computing checksums. With xattrs set, entries are also mirrored
+// to the files' extended attributes, which needs st to be on disk.
+func Open(meta storage.Storage, name string, st storage.Storage, xattrs bool, logger *log.Logger) (*Store, error) {
+	var disk storage.Disk
+	if xattrs {
+		if !xattrsSupported {
+			return nil, errors.New("extended attributes are only supported on Linux")
+		}
+		var ok bool
+		if disk, ok = st.(storage.Disk); !ok {
+			return nil, fmt.Errorf("extended attributes: %w", storage.ErrNotOnDisk)
+		}
+	}
+	s := &Store{
+		meta:     meta,
+		name:     name,
+		feedName: path.Join(path.Dir(name), "changes.json"),
+		storage:  st,
+		disk:     disk,
+		logger:   logger,
+		files:    make(map[string]Entry),
+		wake:     make(chan struct{}, 1),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	if err := jsonfile.LoadFrom(meta, name, &s.files); err != nil {
+		return nil, fmt.Errorf("loading file metadata from %s: %w", name, err)
+	}
+	if s.files == nil {
+		s.files = make(map[string]Entry)
+	}
+	if err := jsonfile.LoadFrom(meta, s.feedName, &s.feed); err != nil {
+		return nil, fmt.Errorf("loading change feed from %s: %w", s.feedName, err)
+	}
+	s.ids = make(map[string]string, len(s.files))
+	assigned := false
+	for _, e := range s.files {
+		// Entries recorded before files had IDs are given one now.
+		if e.ID == "" {
+			assigned = true
+		}
+		s.put(e)
+	}
+	if assigned {
+		s.mu.Lock()
+		s.saveLocked()
+		s.mu.Unlock()
+	}
+	s.wg.Go(s.hashPending)
+	return s, nil
+}
+
+// Close stops computing checksums, and writes a scheduled save to disk. The files waiting for
+// their checksum are queued again by the reconciliation at the next start.
+func (s *Store) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return s.Flush()
+}
+
+// Reconcile compares the store with the storage directory: files without an entry are
+// registered, files changed since their entry was made are updated, both are queued for
+// checksumming, and entries whose file has vanished are flagged. It is meant to run at
+// startup, before requests are served.
+func (s *Store) Reconcile() error {
+	type found struct {
+		name string
+		info fs.FileInfo
+		// mirrored is the entry recovered from the extended attributes of a file the store has
+		// no entry for, if any.
+		mirrored *Entry
+	}
+	var files []found
+	err := s.storage.Walk(func(name string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		f := found{name: name, info: info}
+		if s.disk != nil {
+			s.mu.Lock()
+			_, known := s.files[f.name]
+			s.mu.Unlock()
+			if e, ok := s.recovered(f.name, info); ok && !known {
+				f.mirrored = &e
+			}
+		}
+		files = append(files, f)
+		return nil
+	})
+	// Why give up on any error? Entries under an unreadable directory would otherwise be
+	// flagged as vanished when they are merely out of reach.
+	if err != nil {
+		return fmt.Errorf("scanning storage directory: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var registered, recovered, changed, restored, vanished int
+	seen := make(map[string]bool, len(files))
+	for _, f := range files {
+		seen[f.name] = true
+		e, ok := s.files[f.name]
+		change := ""
+		switch {
+		case !ok && f.mirrored != nil:
+			e = *f.mirrored
+			if _, taken := s.ids[e.ID]; taken {
+				e.ID = "" // a copy of a file that is still here
+			}
+			recovered++
+			change = Created
+		case !ok:
+			registered++
+			change = Created
+		case e.MissingSince != nil && e.matches(f.info):
+			s.logger.Printf("file '%s' reappeared in the storage directory\n", f.name)
+			restored++
+			change = Created
+		case !e.matches(f.info):
+			changed++
+			change = Modified
+			if e.MissingSince != nil {
+				change = Created
+			}
+		}
+		if !ok || !e.matches(f.info) {
+			sum := e.SHA256
+			e = Entry{ID: e.ID, Path: f.name, Size: f.info.Size(), Modified: f.info.ModTime().UTC(), Fields: e.Fields}
+			if !ok {
+				// The mirrored checksum is only recovered if it is of the file as it is.
+				e.SHA256 = sum
+			}
+		}
+		e.MissingSince = nil
+		s.put(e)
+		if change != "" {
+			s.changedLocked(change, s.files[f.name], "")
+		}
+		if e.SHA256 == "" {
+			s.pending = append(s.pending, f.name)
+		}
+	}
+	now := time.Now().UTC()
+	for name, e := range s.files {
+		if !seen[name] && e.MissingSince == nil {
+			s.logger.Printf("warn: file '%s' has vanished from the storage directory\n", name)
+			e.MissingSince = &now
+			s.files[name] = e
+			s.changedLocked(Deleted, e, "")
+			vanished++
+		}
+	}
+	if registered+recovered+changed+restored+vanished > 0 {
+		s.logger.Printf("file metadata reconciled: %d files registered, %d recovered from extended attributes, %d changed, %d reappeared, %d vanished\n",
+			registered, recovered, changed, restored, vanished)
+		s.saveLocked()
+	}
+	if len(s.pending) > 0 {
+		s.logger.Printf("computing checksums of %d files in the background\n", len(s.pending))
+		s.wakeLocked()
+	}
+	return nil
+}
+
+// Checksum returns the recorded checksum of name, if the file still matches info.
+func (s *Store) Checksum(name string, info fs.FileInfo) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.files[normalise(name)]
+	if !ok || e.SHA256 == "" || !e.matches(info) {
+		return "", false
+	}
+	return e.SHA256, true
+}
+
+// Record stores the attributes and checksum of name, as just written by the server. An
+// empty checksum is computed in the background.
+func (s *Store) Record(name string, info fs.FileInfo, sum string) {
+	name = normalise(name)
+	s.mu.Lock()
+	old, ok := s.files[name]
+	s.put(Entry{ID: old.ID, Path: name, Size: info.Size(), Modified: info.ModTime().UTC(), SHA256: sum, Fields: old.Fields})
+	if sum == "" {
+		s.pending = append(s.pending, name)
+		s.wakeLocked()
+	}
+	e := s.files[name]
+	if ok && old.MissingSince == nil {
+		s.changedLocked(Modified, e, "")
+	} else {
+		s.changedLocked(Created, e, "")
+	}
+	s.saveLocked()
+	s.mu.Unlock()
+	s.mirror(e)
+}
+
+// SetFields replaces the form fields recorded for name, which must have been recorded before.
+// Nil or empty fields remove them.
+func (s *Store) SetFields(name string, fields map[string]string) {
+	name = normalise(name)
+	s.mu.Lock()
+	e, ok := s.files[name]
+	if !ok || len(e.Fields) == 0 && len(fields) == 0 {
+		s.mu.Unlock()
+		return
+	}
+	e.Fields = maps.Clone(fields)
+	if len(e.Fields) == 0 {
+		e.Fields = nil
+	}
+	s.files[name] = e
+	s.saveLocked()
+	s.mu.Unlock()
+	s.mirror(e)
+}
+
+// Fields returns the form fields recorded for name, or nil if there are none.
+func (s *Store) Fields(name string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return maps.Clone(s.files[normalise(name)].Fields)
+}
+
+// Update records that name changed in a way that invalidates its checksum, such as a partial
+// write. A file that no longer exists is forgotten.
+func (s *Store) Update(name string) {
+	info, err := s.stat(normalise(name))
+	if err != nil || !info.Mode().IsRegular() {
+		s.Remove(name)
+		return
+	}
+	s.Record(name, info, "")
+}
+
+// stat returns the attributes of the stored file name.
+func (s *Store) stat(name string) (fs.FileInfo, error) {
+	root, err := s.storage.OpenRoot(name)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.Stat(name)
+}
+
+// Downloaded records that name was just downloaded.
+//
+// Why not the file's access time? Many filesystems are mounted noatime or relatime, and
+// checksumming, backups and scans would count as uses all the same.
+func (s *Store) Downloaded(name string) {
+	name = normalise(name)
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.files[name]
+	if !ok || e.MissingSince != nil {
+		return
+	}
+	e.LastDownloaded = &now
+	s.files[name] = e
+	s.saveLocked()
+}
+
+// Remove forgets name and, if it was a directory, everything below it.
+func (s *Store) Remove(name string) {
+	name = normalise(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.files[name]; ok {
+		s.removeLocked(e)
+		return
+	}
+	for p, e := range s.files {
+		if strings.HasPrefix(p, name+"/") {
+			s.removeLocked(e)
+		}
+	}
+}
+
+// Rename moves the entry of name, or the entries below it if it is a directory, to newName.
+// Entries already at newName are replaced.
+func (s *Store) Rename(name, newName string) {
+	name, newName = normalise(name), normalise(newName)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p, e := range s.files {
+		if within(p, newName) {
+			s.removeLocked(e)
+		}
+	}
+	// Collected first, as adding keys to a map whilst ranging over it may revisit them.
+	var moved []Entry
+	for p, e := range s.files {
+		if within(p, name) {
+			moved = append(moved, e)
+			s.delete(p)
+		}
+	}
+	for _, e := range moved {
+		from := e.Path
+		e.Path = newName + strings.TrimPrefix(e.Path, name)
+		s.put(e)
+		if e.MissingSince == nil {
+			s.changedLocked(Moved, e, from)
+		}
+	}
+	s.saveLocked()
+}
+
+// Vanished flags the entries of name, and of everything below it, as missing.
+func (s *Store) Vanished(name string) {
+	name = normalise(name)
+	now := time.Now().UTC()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for p, e := range s.files {
+		if within(p, name) && e.MissingSince == nil {
+			e.MissingSince = &now
+			s.files[p] = e
+			s.changedLocked(Deleted, e, "")
+			s.saveLocked()
+		}
+	}
+}
+
+// Missing returns the entries flagged as missing, sorted by path.
+func (s *Store) Missing() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Entry, 0)
+	for _, e := range s.files {
+		if e.MissingSince != nil {
+			list = append(list, e)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// Checksums returns the set of recorded checksums, including those of missing files.
+func (s *Store) Checksums() map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sums := make(map[string]bool, len(s.files))
+	for _, e := range s.files {
+		if e.SHA256 != "" {
+			sums[e.SHA256] = true
+		}
+	}
+	return sums
+}
+
+// Forget removes the entry of a missing file once an administrator has dealt with it. It
+// reports false if name has no entry flagged as missing.
+func (s *Store) Forget(name string) bool {
+	name = normalise(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.files[name]
+	if !ok || e.MissingSince == nil {
+		return false
+	}
+	s.delete(name)
+	s.saveLocked()
+	return true
+}
+
+// hashPending computes the checksums of queued files, one at a time, for the lifetime of
+// the process.
+//
+// Why one at a time? After an import the queue may cover the whole storage directory, and
+// hashing it in parallel would compete with downloads for the disk.
+func (s *Store) hashPending() {
+	buf := make([]byte, 1<<20) // 1 MB buffer
+	done := 0
+	for {
+		s.mu.Lock()
+		if len(s.pending) == 0 {
+			if done > 0 {
+				s.logger.Printf("computed checksums of %d files\n", done)
+				done = 0
+			}
+			s.mu.Unlock()
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-s.wake:
+			}
+			continue
+		}
+		name := s.pending[0]
+		s.pending = s.pending[1:]
+		e, ok := s.files[name]
+		s.mu.Unlock()
+		if !ok || e.SHA256 != "" || e.MissingSince != nil {
+			continue
+		}
+
+		sum, info, err := s.hash(s.ctx, name, buf)
+		if s.ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errChanged) {
+			// The change that removed or modified the file updates the store itself.
+			continue
+		}
+		if err != nil {
+			s.logger.Printf("error computing checksum of '%s': %v\n", name, err)
+			continue
+		}
+
+		s.mu.Lock()
+		// The file may have changed whilst it was read; the change queues it again.
+		e, ok = s.files[name]
+		if ok && e.SHA256 == "" && e.matches(info) {
+			e.SHA256 = sum
+			s.files[name] = e
+			s.saveLocked()
+			done++
+		} else {
+			ok = false
+		}
+		s.mu.Unlock()
+		if ok {
+			s.mirror(e)
+		}
+	}
+}
+
+// contextReader reads from r until ctx is done, so that a checksum of a large file can be
+// given up within one buffer.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// errChanged reports that a file was modified whilst its checksum was being computed.
+var errChanged = errors.New("file changed whilst being read")
+
+// hash returns the checksum of name, with the file's attributes from before it was read. It
+// gives up once ctx is done.
+func (s *Store) hash(ctx context.Context, name string, buf []byte) (string, fs.FileInfo, error) {
+	root, err := s.storage.OpenRoot(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer root.Close()
+	file, err := root.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	h := sha256.New()
+	if _, err := io.CopyBuffer(h, contextReader{ctx, file}, buf); err != nil {
+		return "", nil, err
+	}
+	// Why compare with the attributes from after the read? A write during the read would
+	// leave a checksum of neither version, and the modification time gives it away.
+	after, err := file.Stat()
+	if err != nil {
+		return "", nil, err
+	}
+	if after.Size() != info.Size() || !after.ModTime().Equal(info.ModTime()) {
+		return "", nil, errChanged
+	}
+	return hex.EncodeToString(h.Sum(nil)), info, nil
+}
+
+// Verify computes the checksums of the stored files again, one at a time, and returns how many
+// it checked and the entries of those whose contents no longer match their recorded checksum
+// although neither their size nor their modification time has changed: the storage has
+// corrupted them. Files without a checksum yet, or changed since it was recorded, are passed
+// over. It stops, with the files checked so far, once ctx is done.
+func (s *Store) Verify(ctx context.Context) (int, []Entry) {
+	buf := make([]byte, 1<<20) // 1 MB buffer
+	checked := 0
+	var corrupt []Entry
+	for _, e := range s.Present() {
+		if e.SHA256 == "" {
+			continue
+		}
+		sum, info, err := s.hash(ctx, e.Path, buf)
+		if ctx.Err() != nil {
+			break
+		}
+		if errors.Is(err, fs.ErrNotExist) || errors.Is(err, errChanged) {
+			continue
+		}
+		if err != nil {
+			s.logger.Printf("error verifying checksum of '%s': %v\n", e.Path, err)
+			continue
+		}
+		if !e.matches(info) {
+			continue
+		}
+		checked++
+		if sum != e.SHA256 {
+			corrupt = append(corrupt, e)
+		}
+	}
+	return checked, corrupt
+}
+
+// ByID returns the entry of the file with the given ID.
+func (s *Store) ByID(id string) (Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.ids[id]
+	if !ok {
+		return Entry{}, false
+	}
+	return s.files[p], true
+}
+
+// ID returns the ID of name, or "" if it has no entry.
+func (s *Store) ID(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.files[normalise(name)].ID
+}
+
+// Usage returns the total size of the files at or below name, which is "" for the whole
+// storage directory. Files that have gone missing are not counted.
+func (s *Store) Usage(name string) int64 {
+	name = normalise(name)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var total int64
+	for p, e := range s.files {
+		if e.MissingSince == nil && (name == "" || within(p, name)) {
+			total += e.Size
+		}
+	}
+	return total
+}
+
+// Present returns the entries of the files that have not gone missing, in no particular order.
+func (s *Store) Present() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]Entry, 0, len(s.files))
+	for _, e := range s.files {
+		if e.MissingSince == nil {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// put adds or replaces the entry at its path, giving it an ID if it has none. The caller
+// must hold the lock, or have the store to itself.
+func (s *Store) put(e Entry) {
+	if e.ID == "" {
+		e.ID = newID()
+	}
+	s.files[e.Path] = e
+	s.ids[e.ID] = e.Path
+}
+
+// removeLocked removes the entry e of a file deleted by the server, recording the deletion
+// unless the file had already vanished. The caller must hold the lock.
+func (s *Store) removeLocked(e Entry) {
+	s.delete(e.Path)
+	if e.MissingSince == nil {
+		s.changedLocked(Deleted, e, "")
+	}
+	s.saveLocked()
+}
+
+// delete removes the entry at p. The caller must hold the lock.
+func (s *Store) delete(p string) {
+	if e, ok := s.files[p]; ok {
+		delete(s.ids, e.ID)
+		delete(s.files, p)
+	}
+}
+
+// newID returns a random (version 4) UUID.
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// wakeLocked wakes the checksum worker. The caller must hold the lock.
+func (s *Store) wakeLocked() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// saveLocked schedules a save, unless one is already scheduled. The caller must hold the lock.
+func (s *Store) saveLocked() {
+	if s.saving {
+		return
+	}
+	s.saving = true
+	s.saveTimer = time.AfterFunc(saveDelay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// Flushed meanwhile.
+		if !s.saving {
+			return
+		}
+		s.saving = false
+		if err := s.saveNowLocked(); err != nil {
+			s.logger.Printf("error saving file metadata: %v\n", err)
+		}
+	})
+}
+
+// Flush writes a scheduled save to disk immediately, for use when the server stops.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.saving {
+		return nil
+	}
+	s.saving = false
+	s.saveTimer.Stop()
+	return s.saveNowLocked()
+}
+
+// saveNowLocked writes the entries and the change feed to the metadata directory. The caller
+// must hold the lock.
+func (s *Store) saveNowLocked() error {
+	if err := jsonfile.SaveTo(s.meta, s.name, s.files); err != nil {
+		return err
+	}
+	return jsonfile.SaveTo(s.meta, s.feedName, s.feed)
+}
+
+// within reports whether p is name or lies below it.
+func within(p, name string) bool {
+	return p == name || strings.HasPrefix(p, name+"/")
+}
+
+// normalise turns a storage-relative path into the store's key form, without a leading slash.
+func normalise(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,201 @@
+package filemeta
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+	"github.com/mascotmascot1/fileserver/pkg/storage/memfs"
+)
+
+// openTestStore opens the store kept in meta for the files in st, and closes it at the end of
+// the test.
+func openTestStore(t *testing.T, meta, st storage.Storage) *Store {
+	t.Helper()
+	s, err := Open(meta, "files.json", st, false, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// writeFile stores content as name in st, and returns its attributes.
+func writeFile(t *testing.T, st storage.Storage, name, content string) fs.FileInfo {
+	t.Helper()
+	root, err := st.OpenRoot(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	if err := root.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := root.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestIDs(t *testing.T) {
+	fsys := memfs.New()
+	meta, st := fsys.Dir("metadata"), fsys.Dir("files")
+	s := openTestStore(t, meta, st)
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	s.Record("a.txt", writeFile(t, st, "a.txt", "first"), "")
+	id := s.ID("a.txt")
+	if !uuid.MatchString(id) {
+		t.Fatalf("got ID %q, want a UUID", id)
+	}
+	s.Record("b.txt", writeFile(t, st, "b.txt", "other"), "")
+	if s.ID("b.txt") == id {
+		t.Fatal("two files share an ID")
+	}
+
+	// The ID stays with the file when it is replaced and when it is moved.
+	s.Record("a.txt", writeFile(t, st, "a.txt", "second"), "")
+	if got := s.ID("a.txt"); got != id {
+		t.Errorf("got ID %s after replacing the file, want %s", got, id)
+	}
+	s.Rename("a.txt", "docs/a.txt")
+	if e, ok := s.ByID(id); !ok || e.Path != "docs/a.txt" {
+		t.Errorf("ByID = %+v, %v, want docs/a.txt", e, ok)
+	}
+	if s.ID("a.txt") != "" {
+		t.Error("the old name still has an ID")
+	}
+
+	// A file moved over another takes its place, and the other's ID is gone.
+	other := s.ID("b.txt")
+	s.Rename("docs/a.txt", "b.txt")
+	if _, ok := s.ByID(other); ok {
+		t.Error("found the replaced file by its ID")
+	}
+	if e, ok := s.ByID(id); !ok || e.Path != "b.txt" {
+		t.Errorf("ByID = %+v, %v, want b.txt", e, ok)
+	}
+
+	// IDs outlast a restart.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestStore(t, meta, st)
+	if e, ok := s.ByID(id); !ok || e.Path != "b.txt" {
+		t.Errorf("ByID = %+v, %v after reopening, want b.txt", e, ok)
+	}
+
+	s.Remove("b.txt")
+	if _, ok := s.ByID(id); ok {
+		t.Error("found a removed file by its ID")
+	}
+	if _, ok := s.ByID("unknown"); ok {
+		t.Error("found a file by an unknown ID")
+	}
+}
+
+// TestIDsAssigned checks that files registered by the reconciliation, and entries recorded
+// before files had IDs, are given one.
+func TestIDsAssigned(t *testing.T) {
+	fsys := memfs.New()
+	meta, st := fsys.Dir("metadata"), fsys.Dir("files")
+	info := writeFile(t, st, "old.txt", "old")
+	writeFile(t, st, "new.txt", "new")
+	root, err := meta.OpenRoot("files.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy := `{"old.txt":{"path":"old.txt","size":3,"modified":"` + info.ModTime().UTC().Format("2006-01-02T15:04:05.999999999Z07:00") + `"}}`
+	if err := root.WriteFile("files.json", []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root.Close()
+
+	s := openTestStore(t, meta, st)
+	if err := s.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"old.txt", "new.txt"} {
+		id := s.ID(name)
+		if e, ok := s.ByID(id); id == "" || !ok || e.Path != name {
+			t.Errorf("%s has ID %q, found as %+v", name, id, e)
+		}
+	}
+}
+
+// entry returns the entry of name in s.
+func entry(t *testing.T, s *Store, name string) Entry {
+	t.Helper()
+	e, ok := s.ByID(s.ID(name))
+	if !ok {
+		t.Fatalf("no entry for %s", name)
+	}
+	return e
+}
+
+func TestDownloaded(t *testing.T) {
+	fsys := memfs.New()
+	meta, st := fsys.Dir("metadata"), fsys.Dir("files")
+	s := openTestStore(t, meta, st)
+	s.Record("a.txt", writeFile(t, st, "a.txt", "a.txt"), "")
+
+	// A file not downloaded counts as used when it was stored.
+	e := entry(t, s, "a.txt")
+	if e.LastDownloaded != nil || !e.LastUsed().Equal(e.Modified) {
+		t.Errorf("got last downloaded %v, last used %v, want the modification time %v", e.LastDownloaded, e.LastUsed(), e.Modified)
+	}
+
+	before := time.Now()
+	s.Downloaded("/a.txt")
+	e = entry(t, s, "a.txt")
+	if e.LastDownloaded == nil || e.LastDownloaded.Before(before) || !e.LastUsed().Equal(*e.LastDownloaded) {
+		t.Fatalf("got last downloaded %v, last used %v, want since %v", e.LastDownloaded, e.LastUsed(), before)
+	}
+	downloaded := *e.LastDownloaded
+
+	// Downloads of files the store does not know, or has lost, are not recorded.
+	s.Downloaded("unknown.txt")
+	if s.ID("unknown.txt") != "" {
+		t.Error("a download added an entry")
+	}
+	s.Record("b.txt", writeFile(t, st, "b.txt", "b.txt"), "")
+	s.Vanished("b.txt")
+	s.Downloaded("b.txt")
+	if e := entry(t, s, "b.txt"); e.LastDownloaded != nil {
+		t.Errorf("recorded a download of a missing file at %v", e.LastDownloaded)
+	}
+
+	// The time outlasts a restart.
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	s = openTestStore(t, meta, st)
+	if e := entry(t, s, "a.txt"); e.LastDownloaded == nil || !e.LastDownloaded.Equal(downloaded) {
+		t.Errorf("got last downloaded %v after reopening, want %v", e.LastDownloaded, downloaded)
+	}
+}
+
+func TestPresent(t *testing.T) {
+	fsys := memfs.New()
+	meta, st := fsys.Dir("metadata"), fsys.Dir("files")
+	s := openTestStore(t, meta, st)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		s.Record(name, writeFile(t, st, name, name), "")
+	}
+	s.Vanished("c.txt")
+
+	var got []string
+	for _, e := range s.Present() {
+		got = append(got, e.Path)
+	}
+	slices.Sort(got)
+	if want := []string{"a.txt", "b.txt"}; !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
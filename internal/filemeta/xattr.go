@@ -0,0 +1,72 @@
+package filemeta
+
+import (
+	"encoding/json"
+	"io/fs"
+	"time"
+)
+
+// The extended attributes entries are mirrored to, in the "user" namespace that any process
+// able to write the file may set.
+const (
+	xattrID       = "user.fileserver.id"
+	xattrSHA256   = "user.fileserver.sha256"
+	xattrModified = "user.fileserver.modified" // the modification time the checksum is of
+	xattrFields   = "user.fileserver.fields"   // JSON-encoded
+)
+
+// mirror writes e to the extended attributes of its file, if the store mirrors them. It is
+// called without the lock held, as it writes to the disk.
+//
+// Why mirror at all? The attributes travel with the file, so its ID, checksum and fields
+// survive the loss of the metadata directory, and tools such as getfattr can read them.
+func (s *Store) mirror(e Entry) {
+	if s.disk == nil {
+		return
+	}
+	p := s.disk.Path(e.Path)
+	err := setXattr(p, xattrID, []byte(e.ID))
+	if err == nil && e.SHA256 != "" {
+		err = setXattr(p, xattrSHA256, []byte(e.SHA256))
+		if err == nil {
+			err = setXattr(p, xattrModified, []byte(e.Modified.Format(time.RFC3339Nano)))
+		}
+	} else if err == nil {
+		// A stale checksum would mislead anyone reading the attributes.
+		err = removeXattr(p, xattrSHA256)
+		if err == nil {
+			err = removeXattr(p, xattrModified)
+		}
+	}
+	if err == nil && len(e.Fields) > 0 {
+		b, _ := json.Marshal(e.Fields)
+		err = setXattr(p, xattrFields, b)
+	} else if err == nil {
+		err = removeXattr(p, xattrFields)
+	}
+	if err != nil {
+		s.logger.Printf("error writing extended attributes of '%s': %v\n", e.Path, err)
+	}
+}
+
+// recovered returns the entry mirrored to the extended attributes of the file name, which has
+// the attributes info, for a file the store has no entry for. The checksum is only taken if
+// the file has not been modified since it was computed.
+func (s *Store) recovered(name string, info fs.FileInfo) (Entry, bool) {
+	p := s.disk.Path(name)
+	id, err := getXattr(p, xattrID)
+	if err != nil || len(id) == 0 {
+		return Entry{}, false
+	}
+	e := Entry{ID: string(id)}
+	if sum, err := getXattr(p, xattrSHA256); err == nil && len(sum) > 0 {
+		modified, _ := getXattr(p, xattrModified)
+		if t, err := time.Parse(time.RFC3339Nano, string(modified)); err == nil && t.Equal(info.ModTime()) {
+			e.SHA256 = string(sum)
+		}
+	}
+	if b, err := getXattr(p, xattrFields); err == nil && len(b) > 0 {
+		json.Unmarshal(b, &e.Fields)
+	}
+	return e, true
+}
@@ -0,0 +1,43 @@
+//go:build linux
+
+package filemeta
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrsSupported reports whether extended attributes are implemented on this platform.
+const xattrsSupported = true
+
+// setXattr sets the extended attribute attr of the file at p.
+func setXattr(p, attr string, value []byte) error {
+	return unix.Lsetxattr(p, attr, value, 0)
+}
+
+// getXattr returns the extended attribute attr of the file at p, or nil if it has none.
+func getXattr(p, attr string) ([]byte, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := unix.Lgetxattr(p, attr, buf)
+		switch {
+		case errors.Is(err, unix.ENODATA):
+			return nil, nil
+		case errors.Is(err, unix.ERANGE):
+			buf = make([]byte, len(buf)*4)
+			continue
+		case err != nil:
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+}
+
+// removeXattr removes the extended attribute attr of the file at p, if it has it.
+func removeXattr(p, attr string) error {
+	if err := unix.Lremovexattr(p, attr); err != nil && !errors.Is(err, unix.ENODATA) {
+		return err
+	}
+	return nil
+}
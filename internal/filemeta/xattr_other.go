@@ -0,0 +1,21 @@
+//go:build !linux
+
+package filemeta
+
+import "errors"
+
+// xattrsSupported reports whether extended attributes are implemented on this platform; they
+// are only on Linux.
+const xattrsSupported = false
+
+func setXattr(p, attr string, value []byte) error {
+	return errors.ErrUnsupported
+}
+
+func getXattr(p, attr string) ([]byte, error) {
+	return nil, errors.ErrUnsupported
+}
+
+func removeXattr(p, attr string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,188 @@
+// Package geoip looks up the country of each client in a MaxMind DB file, and allows or
+// denies requests by it.
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mascotmascot1/fileserver/internal/clientip"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// Unknown labels the metrics of requests from addresses the database has no country for,
+// such as private networks.
+const Unknown = "unknown"
+
+// DB looks up countries in a MaxMind DB file, such as GeoLite2-Country or GeoIP2-City.
+type DB struct {
+	db *mmdb
+	// Why cache by record? Countless addresses share the few hundred country records, so
+	// each is decoded only once.
+	mu        sync.Mutex
+	countries map[uint]string
+}
+
+// Open reads the database at path into memory.
+func Open(path string) (*DB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading GeoIP database: %w", err)
+	}
+	db, err := parseMMDB(buf)
+	if err != nil {
+		return nil, fmt.Errorf("reading GeoIP database %s: %w", path, err)
+	}
+	return &DB{db: db, countries: make(map[uint]string)}, nil
+}
+
+// Country returns the ISO 3166-1 alpha-2 code of the country addr is in, or "" if it is not
+// known. The country of the network's registration stands in for an address with no country
+// of its own.
+func (d *DB) Country(addr netip.Addr) (string, error) {
+	if !addr.IsValid() {
+		return "", nil
+	}
+	offset, ok, err := d.db.lookup(addr)
+	if err != nil || !ok {
+		return "", err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if country, ok := d.countries[offset]; ok {
+		return country, nil
+	}
+	v, _, err := d.db.decode(offset)
+	if err != nil {
+		return "", err
+	}
+	record, _ := v.(map[string]any)
+	country := isoCode(record, "country")
+	if country == "" {
+		country = isoCode(record, "registered_country")
+	}
+	d.countries[offset] = country
+	return country, nil
+}
+
+// isoCode returns record[field]["iso_code"].
+func isoCode(record map[string]any, field string) string {
+	m, _ := record[field].(map[string]any)
+	code, _ := m["iso_code"].(string)
+	return code
+}
+
+// Filter records the country of every request and refuses those from countries that are not
+// allowed. A nil *Filter, for a server without a database, does neither.
+type Filter struct {
+	db           *DB
+	allow        map[string]bool
+	deny         map[string]bool
+	allowUnknown bool
+	render       *respond.Renderer
+	logger       *log.Logger
+}
+
+// New opens the configured database, returning nil if none is configured.
+func New(cfg config.GeoIPConfig, render *respond.Renderer, logger *log.Logger) (*Filter, error) {
+	if cfg.Database == "" {
+		return nil, nil
+	}
+	db, err := Open(cfg.Database)
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{
+		db:           db,
+		allow:        countrySet(cfg.Allow),
+		deny:         countrySet(cfg.Deny),
+		allowUnknown: cfg.AllowUnknown,
+		render:       render,
+		logger:       logger,
+	}, nil
+}
+
+func countrySet(codes []string) map[string]bool {
+	set := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		set[strings.ToUpper(c)] = true
+	}
+	return set
+}
+
+// contextKey is the type of the context key the country is stored under.
+type contextKey struct{}
+
+// Locate looks up the country of each request's client and stores it in the request context,
+// for Restrict, the logs and the metrics. It must run after the client's address is known.
+func (f *Filter) Locate(next http.Handler) http.Handler {
+	if f == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		country, err := f.db.Country(clientip.Addr(r))
+		if err != nil {
+			f.logger.Printf("error looking up the country of %s: %v\n", r.RemoteAddr, err)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, country)))
+	})
+}
+
+// Restrict refuses requests from countries that are denied, or not allowed, with 403.
+func (f *Filter) Restrict(next http.Handler) http.Handler {
+	if f == nil || (len(f.allow) == 0 && len(f.deny) == 0 && f.allowUnknown) {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		country := Country(r.Context())
+		if !f.allowed(country) {
+			f.logger.Printf("refused request from %s for %s\n", Client(r), r.URL.Path)
+			f.render.Error(w, r, http.StatusForbidden, "access from your location is not permitted")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowed reports whether requests from country may proceed.
+func (f *Filter) allowed(country string) bool {
+	if country == "" {
+		return f.allowUnknown
+	}
+	if f.deny[country] {
+		return false
+	}
+	return len(f.allow) == 0 || f.allow[country]
+}
+
+// Country returns the country Locate found for the request with context ctx, or "" if it is
+// not known or GeoIP is off.
+func Country(ctx context.Context) string {
+	country, _ := ctx.Value(contextKey{}).(string)
+	return country
+}
+
+// MetricsLabel returns the country of r for labelling its metrics: the country code, or
+// Unknown.
+func MetricsLabel(r *http.Request) string {
+	if country := Country(r.Context()); country != "" {
+		return country
+	}
+	return Unknown
+}
+
+// Client describes the client of r for the logs: its address, followed by its country if
+// that is known.
+func Client(r *http.Request) string {
+	if country := Country(r.Context()); country != "" {
+		return r.RemoteAddr + " (" + country + ")"
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,312 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// dataPointer refers to an earlier item of a test database's data section.
+type dataPointer int
+
+// testData are the items of the data section of the test databases. Networks point to them
+// by index; a pointer within an item must refer to an earlier one.
+var testData = []any{
+	map[string]any{"iso_code": "GB"},
+	map[string]any{"country": map[string]any{"iso_code": "GB", "names": map[string]any{"en": "United Kingdom"}}, "continent": map[string]any{"code": "EU"}},
+	map[string]any{"country": map[string]any{"iso_code": "SE"}, "registered_country": map[string]any{"iso_code": "DE"}},
+	// A record sharing its country through a pointer, as MaxMind's files do.
+	map[string]any{"country": dataPointer(0)},
+	// An address with no country of its own, such as an anycast one.
+	map[string]any{"registered_country": map[string]any{"iso_code": "JP"}},
+	map[string]any{"country": map[string]any{"iso_code": "DE"}},
+}
+
+// testNetworks are the networks of the test databases, and the items of testData they
+// point to. IPv6 networks are left out of IPv4 databases.
+var testNetworks = map[string]int{
+	"81.2.69.0/24":     1,
+	"89.160.20.128/25": 2,
+	"2.125.160.216/29": 3,
+	"203.0.113.0/24":   4,
+	"2001:db8::/32":    5,
+}
+
+// writeTestDB writes a MaxMind DB file of testNetworks with the given IP version and record
+// size, and returns its path.
+func writeTestDB(t *testing.T, ipVersion, recordSize uint) string {
+	t.Helper()
+	var data bytes.Buffer
+	offsets := make([]int, len(testData))
+	for i, item := range testData {
+		offsets[i] = data.Len()
+		encodeField(&data, item, offsets)
+	}
+
+	// Each node holds its two children: the index of a node, 0 for none (the root is never
+	// a child), or -(i+1) for the ith item of testData.
+	nodes := [][2]int{{}}
+	for network, item := range testNetworks {
+		prefix := netip.MustParsePrefix(network)
+		if prefix.Addr().Is6() && ipVersion == 4 {
+			continue
+		}
+		ip, bits := prefix.Addr().AsSlice(), prefix.Bits()
+		if prefix.Addr().Is4() && ipVersion == 6 {
+			// IPv4 addresses lie below 96 zero bits of an IPv6 tree.
+			ip, bits = append(make([]byte, 12), ip...), bits+96
+		}
+		n := 0
+		for i := range bits {
+			bit := ip[i/8] >> (7 - i%8) & 1
+			if i == bits-1 {
+				nodes[n][bit] = -(item + 1)
+				break
+			}
+			if nodes[n][bit] == 0 {
+				nodes = append(nodes, [2]int{})
+				nodes[n][bit] = len(nodes) - 1
+			}
+			n = nodes[n][bit]
+		}
+	}
+	nodeCount := len(nodes)
+	var tree bytes.Buffer
+	for _, node := range nodes {
+		var records [2]uint32
+		for bit, child := range node {
+			switch {
+			case child > 0:
+				records[bit] = uint32(child)
+			case child == 0:
+				records[bit] = uint32(nodeCount)
+			default:
+				records[bit] = uint32(nodeCount + 16 + offsets[-child-1])
+			}
+		}
+		left, right := records[0], records[1]
+		switch recordSize {
+		case 24:
+			tree.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(right >> 16), byte(right >> 8), byte(right)})
+		case 28:
+			tree.Write([]byte{byte(left >> 16), byte(left >> 8), byte(left), byte(left>>24)<<4 | byte(right>>24), byte(right >> 16), byte(right >> 8), byte(right)})
+		default:
+			tree.Write(binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, left), right))
+		}
+	}
+
+	buf := append(tree.Bytes(), make([]byte, 16)...)
+	buf = append(buf, data.Bytes()...)
+	buf = append(buf, metadataMarker...)
+	var meta bytes.Buffer
+	encodeField(&meta, map[string]any{
+		"node_count":    uint64(nodeCount),
+		"record_size":   uint64(recordSize),
+		"ip_version":    uint64(ipVersion),
+		"database_type": "GeoLite2-Country",
+	}, nil)
+	buf = append(buf, meta.Bytes()...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// encodeField appends v to b in the encoding of the data section, in which offsets are those
+// of the items of testData.
+func encodeField(b *bytes.Buffer, v any, offsets []int) {
+	control := func(typ, size int) {
+		if typ < 8 {
+			b.WriteByte(byte(typ<<5 | size))
+			return
+		}
+		b.Write([]byte{byte(size), byte(typ - 7)})
+	}
+	switch v := v.(type) {
+	case string:
+		control(typeString, len(v))
+		b.WriteString(v)
+	case uint64:
+		control(typeUint32, 4)
+		b.Write(binary.BigEndian.AppendUint32(nil, uint32(v)))
+	case dataPointer:
+		p := offsets[v]
+		b.Write([]byte{byte(typePointer<<5 | p>>8&7), byte(p)})
+	case map[string]any:
+		control(typeMap, len(v))
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			encodeField(b, k, offsets)
+			encodeField(b, v[k], offsets)
+		}
+	default:
+		panic("unsupported field")
+	}
+}
+
+func TestCountry(t *testing.T) {
+	tests := []struct {
+		addr  string
+		want4 string // in an IPv4 database
+		want6 string // in an IPv6 database
+	}{
+		{"81.2.69.142", "GB", "GB"},
+		{"81.2.70.1", "", ""},
+		{"89.160.20.129", "SE", "SE"},
+		{"89.160.20.127", "", ""},
+		{"2.125.160.217", "GB", "GB"},
+		{"203.0.113.9", "JP", "JP"},
+		{"::ffff:81.2.69.142", "GB", "GB"},
+		{"10.0.0.1", "", ""},
+		{"2001:db8::1", "", "DE"},
+		{"2001:db9::1", "", ""},
+		{"", "", ""},
+	}
+	for _, ipVersion := range []uint{4, 6} {
+		for _, recordSize := range []uint{24, 28, 32} {
+			db, err := Open(writeTestDB(t, ipVersion, recordSize))
+			if err != nil {
+				t.Fatalf("IPv%d, %d bit records: %v", ipVersion, recordSize, err)
+			}
+			for _, tt := range tests {
+				var addr netip.Addr
+				if tt.addr != "" {
+					addr = netip.MustParseAddr(tt.addr)
+				}
+				want := tt.want4
+				if ipVersion == 6 {
+					want = tt.want6
+				}
+				// Twice, the second time from the cache.
+				for range 2 {
+					got, err := db.Country(addr)
+					if err != nil || got != want {
+						t.Errorf("IPv%d, %d bit records: Country(%s) = %q, %v, want %q", ipVersion, recordSize, tt.addr, got, err, want)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestOpen(t *testing.T) {
+	valid, err := os.ReadFile(writeTestDB(t, 6, 24))
+	if err != nil {
+		t.Fatal(err)
+	}
+	marker := bytes.LastIndex(valid, metadataMarker)
+	withMetadata := func(meta map[string]any) []byte {
+		var b bytes.Buffer
+		encodeField(&b, meta, nil)
+		return append(bytes.Clone(valid[:marker+len(metadataMarker)]), b.Bytes()...)
+	}
+	tests := []struct {
+		desc    string
+		content []byte
+		wantErr bool
+	}{
+		{"a valid database", valid, false},
+		{"not a database", []byte("GIF89a"), true},
+		{"an empty file", nil, true},
+		{"metadata that is not a map", append(bytes.Clone(valid[:marker+len(metadataMarker)]), typeString<<5|1, 'x'), true},
+		{"truncated metadata", valid[:len(valid)-3], true},
+		{"an unsupported record size", withMetadata(map[string]any{"node_count": uint64(1), "record_size": uint64(20), "ip_version": uint64(6)}), true},
+		{"an unsupported IP version", withMetadata(map[string]any{"node_count": uint64(1), "record_size": uint64(24), "ip_version": uint64(5)}), true},
+		{"a tree larger than the file", withMetadata(map[string]any{"node_count": uint64(1 << 20), "record_size": uint64(24), "ip_version": uint64(6)}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.mmdb")
+			if err := os.WriteFile(path, tt.content, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := Open(path); (err != nil) != tt.wantErr {
+				t.Errorf("Open = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+	if _, err := Open(filepath.Join(t.TempDir(), "missing.mmdb")); err == nil {
+		t.Error("opened a missing database")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	database := writeTestDB(t, 6, 28)
+	tests := []struct {
+		desc       string
+		cfg        config.GeoIPConfig
+		addr       string
+		wantStatus int
+		wantClient string
+		wantLabel  string
+	}{
+		{"no restrictions", config.GeoIPConfig{AllowUnknown: true}, "81.2.69.142:1", http.StatusOK, "81.2.69.142:1 (GB)", "GB"},
+		{"an allowed country", config.GeoIPConfig{Allow: []string{"gb", "SE"}}, "81.2.69.142:1", http.StatusOK, "81.2.69.142:1 (GB)", "GB"},
+		{"a country not allowed", config.GeoIPConfig{Allow: []string{"SE"}}, "81.2.69.142:1", http.StatusForbidden, "", ""},
+		{"a denied country", config.GeoIPConfig{Deny: []string{"SE"}, AllowUnknown: true}, "89.160.20.129:1", http.StatusForbidden, "", ""},
+		{"a country not denied", config.GeoIPConfig{Deny: []string{"SE"}, AllowUnknown: true}, "[2001:db8::1]:1", http.StatusOK, "[2001:db8::1]:1 (DE)", "DE"},
+		{"a denied country that is also allowed", config.GeoIPConfig{Allow: []string{"SE"}, Deny: []string{"SE"}}, "89.160.20.129:1", http.StatusForbidden, "", ""},
+		{"an unknown country, allowed", config.GeoIPConfig{Deny: []string{"SE"}, AllowUnknown: true}, "10.0.0.1:1", http.StatusOK, "10.0.0.1:1", Unknown},
+		{"an unknown country, refused", config.GeoIPConfig{Deny: []string{"SE"}}, "10.0.0.1:1", http.StatusForbidden, "", ""},
+		{"an unknown country with only an allow list", config.GeoIPConfig{Allow: []string{"GB"}, AllowUnknown: true}, "10.0.0.1:1", http.StatusOK, "10.0.0.1:1", Unknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			logger := log.New(io.Discard, "", 0)
+			tt.cfg.Database = database
+			f, err := New(tt.cfg, respond.NewRenderer(respond.FormatJSON, logger), logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var client, label string
+			handler := f.Locate(f.Restrict(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				client, label = Client(r), MetricsLabel(r)
+			})))
+			r := httptest.NewRequest(http.MethodGet, "/download/a.txt", nil)
+			r.RemoteAddr = tt.addr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if client != tt.wantClient || label != tt.wantLabel {
+				t.Errorf("client %q labelled %q, want %q labelled %q", client, label, tt.wantClient, tt.wantLabel)
+			}
+		})
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	f, err := New(config.GeoIPConfig{Allow: []string{"GB"}}, nil, nil)
+	if err != nil || f != nil {
+		t.Fatalf("New = %v, %v, want nil without a database", f, err)
+	}
+	var client, label string
+	handler := f.Locate(f.Restrict(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, label = Client(r), MetricsLabel(r)
+	})))
+	r := httptest.NewRequest(http.MethodGet, "/download/a.txt", nil)
+	r.RemoteAddr = "81.2.69.142:1"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || client != r.RemoteAddr || label != Unknown {
+		t.Errorf("got status %d, client %q labelled %q, want %d, %q labelled %q", w.Code, client, label, http.StatusOK, r.RemoteAddr, Unknown)
+	}
+}
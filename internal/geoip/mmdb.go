@@ -0,0 +1,288 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+)
+
+// metadataMarker precedes the metadata at the end of a MaxMind DB file.
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// Data section field types. The data cache container (12) and end marker (13) never occur
+// in a record.
+const (
+	typePointer = 1
+	typeString  = 2
+	typeDouble  = 3
+	typeBytes   = 4
+	typeUint16  = 5
+	typeUint32  = 6
+	typeMap     = 7
+	typeInt32   = 8
+	typeUint64  = 9
+	typeUint128 = 10
+	typeArray   = 11
+	typeBool    = 14
+	typeFloat   = 15
+)
+
+// errCorrupt is returned for a database that does not follow the format.
+var errCorrupt = errors.New("corrupt MaxMind DB")
+
+// mmdb reads a database in the MaxMind DB format
+// (https://maxmind.github.io/MaxMind-DB/): a binary search tree over the bits of an address,
+// whose leaves point into a data section of records in a compact, typed encoding.
+//
+// Why not MaxMind's library? Only the lookup of a single field is needed, and the format is
+// documented and small enough that reading it here avoids a dependency.
+type mmdb struct {
+	tree       []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // the node reached after the 96 zero bits of an IPv4 address in an IPv6 tree
+	dbType     string
+}
+
+// parseMMDB parses the metadata of a database held in buf.
+func parseMMDB(buf []byte) (*mmdb, error) {
+	i := bytes.LastIndex(buf, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file: metadata marker not found")
+	}
+	meta := &mmdb{data: buf[i+len(metadataMarker):]}
+	v, _, err := meta.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("reading metadata: %w", err)
+	}
+	m, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("reading metadata: %w", errCorrupt)
+	}
+	db := &mmdb{
+		nodeCount:  toUint(m["node_count"]),
+		recordSize: toUint(m["record_size"]),
+		ipVersion:  toUint(m["ip_version"]),
+	}
+	db.dbType, _ = m["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", db.ipVersion)
+	}
+	// The tree is followed by 16 zero bytes, then the data section.
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+16 > uint(i) {
+		return nil, fmt.Errorf("search tree: %w", errCorrupt)
+	}
+	db.tree = buf[:treeSize]
+	db.data = buf[treeSize+16 : i]
+
+	if db.ipVersion == 6 {
+		node := uint(0)
+		for range 96 {
+			if node >= db.nodeCount {
+				break
+			}
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// lookup returns the offset in the data section of the record for addr, or false if the
+// database holds none.
+func (db *mmdb) lookup(addr netip.Addr) (uint, bool, error) {
+	addr = addr.Unmap()
+	ip := addr.AsSlice()
+	node := uint(0)
+	if addr.Is4() && db.ipVersion == 6 {
+		node = db.ipv4Start
+	} else if addr.Is6() && db.ipVersion == 4 {
+		return 0, false, nil
+	}
+	for i := 0; i < len(ip)*8 && node < db.nodeCount; i++ {
+		bit := uint(ip[i/8]>>(7-i%8)) & 1
+		node = db.record(node, bit)
+	}
+	switch {
+	case node == db.nodeCount:
+		return 0, false, nil
+	case node > db.nodeCount:
+		offset := node - db.nodeCount - 16
+		if offset >= uint(len(db.data)) {
+			return 0, false, fmt.Errorf("record pointer: %w", errCorrupt)
+		}
+		return offset, true, nil
+	}
+	return 0, false, fmt.Errorf("search tree ends in a node: %w", errCorrupt)
+}
+
+// record returns the left (bit 0) or right (bit 1) record of node.
+func (db *mmdb) record(node, bit uint) uint {
+	b := db.tree[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		b = b[bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		// The middle byte holds the top four bits of the left record, then those of the right.
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// decode decodes the field at offset in the data section, returning it and the offset of the
+// next field. Maps decode to map[string]any, arrays to []any, and integers to uint64 or int64.
+func (db *mmdb) decode(offset uint) (any, uint, error) {
+	typ, size, offset, err := db.control(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	if typ == typePointer {
+		// A pointer's target is decoded in its place, but reading carries on after it.
+		v, _, err := db.decode(size)
+		return v, offset, err
+	}
+	if typ != typeMap && typ != typeArray && offset+size > uint(len(db.data)) {
+		return nil, 0, errCorrupt
+	}
+	field := db.data[offset : offset+min(size, uint(len(db.data))-offset)]
+	switch typ {
+	case typeString:
+		return string(field), offset + size, nil
+	case typeBytes:
+		return bytes.Clone(field), offset + size, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupt
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(field)), offset + size, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupt
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(field))), offset + size, nil
+	case typeUint16, typeUint32, typeUint64, typeUint128:
+		if size > 16 {
+			return nil, 0, errCorrupt
+		}
+		// Only the low 64 bits of a uint128 are kept; no field of interest needs more.
+		var n uint64
+		for _, b := range field {
+			n = n<<8 | uint64(b)
+		}
+		return n, offset + size, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errCorrupt
+		}
+		var n uint32
+		for _, b := range field {
+			n = n<<8 | uint32(b)
+		}
+		return int64(int32(n)), offset + size, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeMap:
+		m := make(map[string]any, min(size, 64))
+		for range size {
+			var k, v any
+			if k, offset, err = db.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errCorrupt
+			}
+			if v, offset, err = db.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			m[key] = v
+		}
+		return m, offset, nil
+	case typeArray:
+		a := make([]any, 0, min(size, 64))
+		for range size {
+			var v any
+			if v, offset, err = db.decode(offset); err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+		}
+		return a, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unexpected field type %d: %w", typ, errCorrupt)
+}
+
+// control reads the control byte of the field at offset, returning the field's type, its
+// size (or, for a pointer, the offset it points to) and the offset of its payload.
+func (db *mmdb) control(offset uint) (typ, size, next uint, err error) {
+	read := func(n uint) ([]byte, error) {
+		if offset+n > uint(len(db.data)) {
+			return nil, errCorrupt
+		}
+		b := db.data[offset : offset+n]
+		offset += n
+		return b, nil
+	}
+	b, err := read(1)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	ctrl := b[0]
+	typ = uint(ctrl >> 5)
+
+	if typ == typePointer {
+		// The size bits select the pointer's length; the low three bits are its top bits.
+		n := uint(ctrl>>3)&3 + 1
+		if b, err = read(n); err != nil {
+			return 0, 0, 0, err
+		}
+		var p uint
+		if n < 4 {
+			p = uint(ctrl & 7)
+		}
+		for _, c := range b {
+			p = p<<8 | uint(c)
+		}
+		p += [...]uint{0, 2048, 526336, 0}[n-1]
+		return typ, p, offset, nil
+	}
+	if typ == 0 {
+		// An extended type is given by the next byte, offset by 7.
+		if b, err = read(1); err != nil {
+			return 0, 0, 0, err
+		}
+		typ = 7 + uint(b[0])
+	}
+	size = uint(ctrl & 0x1f)
+	if size >= 29 {
+		if b, err = read(size - 28); err != nil {
+			return 0, 0, 0, err
+		}
+		n := uint(0)
+		for _, c := range b {
+			n = n<<8 | uint(c)
+		}
+		size = [...]uint{29, 285, 65821}[size-29] + n
+	}
+	return typ, size, offset, nil
+}
+
+// toUint converts a decoded integer to uint, returning 0 for anything else.
+func toUint(v any) uint {
+	n, _ := v.(uint64)
+	return uint(n)
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/assembly"
+	"github.com/mascotmascot1/fileserver/internal/authz"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+)
+
+// maxCreateUploadBodySize bounds the JSON body of a request to start a parallel upload.
+const maxCreateUploadBodySize = 64 << 10 // 64 KB
+
+// assemblyStatus describes a parallel upload in the answers of the API.
+type assemblyStatus struct {
+	assembly.Upload
+	Missing  []assembly.Range `json:"missing"`
+	Complete bool             `json:"complete"`
+	Expires  time.Time        `json:"expires"`
+}
+
+// assemblyStatusOf returns the description of u.
+func (h *Handlers) assemblyStatusOf(u assembly.Upload) assemblyStatus {
+	return assemblyStatus{Upload: u, Missing: u.Missing(), Complete: u.Complete(), Expires: h.assembled.Expires(u)}
+}
+
+// CreateUploadHandler starts a parallel upload of a file of a known size:
+//
+//	{"name": "images/vm.qcow2", "size": 21474836480}
+//
+// The client then sends the file's byte ranges to UploadPartHandler, over as many
+// connections as it likes, and has the file stored with CompleteUploadHandler.
+//
+// Why split a file across connections? A single TCP stream over a fast link with high latency
+// is held back by its window, and a handful of streams in parallel fill the link instead.
+func (h *Handlers) CreateUploadHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	var req struct {
+		Name string `json:"name"`
+		Size *int64 `json:"size"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxCreateUploadBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return
+	}
+	if req.Size == nil || *req.Size < 0 {
+		h.render.Error(w, r, http.StatusBadRequest, "size is required")
+		return
+	}
+	name, err := cleanStoragePath(req.Name)
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Write, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	if err := h.hidden.checkWrite(name); err != nil {
+		h.render.Error(w, r, http.StatusUnprocessableEntity, "file is refused", err.Error())
+		return
+	}
+	// Checked up front, so that a client does not send gigabytes only to have them refused.
+	if limit := h.uploadLimit(w, r); limit.exceeds(*req.Size) {
+		h.rejectOverLimit(w, r, limit)
+		return
+	}
+	if err := h.checkDirQuotas(name, *req.Size, ""); err != nil {
+		h.render.Error(w, r, http.StatusInsufficientStorage, "directory quota exceeded", err.Error())
+		return
+	}
+
+	u, err := h.assembled.Create(name, principalName(principalFrom(r)), *req.Size)
+	if err != nil {
+		h.logger.Printf("error starting upload of '%s': %v\n", name, err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to start upload")
+		return
+	}
+	h.logger.Printf("started parallel upload %s of %d bytes to '%s' for %s\n", u.ID, u.Size, name, r.RemoteAddr)
+	w.Header().Set("Location", h.basePath+"/api/uploads/"+u.ID)
+	h.render.JSON(w, http.StatusCreated, h.assemblyStatusOf(u))
+}
+
+// UploadStatusHandler reports which byte ranges of a parallel upload have arrived, and which
+// are missing, so that a client can resume after losing connections.
+func (h *Handlers) UploadStatusHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	h.render.JSON(w, http.StatusOK, h.assemblyStatusOf(u))
+}
+
+// UploadPartHandler writes the request body into a parallel upload at the range given by its
+// Content-Range header. Parts may arrive in any order and at once, and a part sent again
+// simply overwrites the same bytes.
+func (h *Handlers) UploadPartHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	oversized := false
+	defer func() {
+		if oversized {
+			r.Body.Close()
+			return
+		}
+		cleanupRequest(r)
+	}()
+
+	u, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	rng, err := parseContentRange(r.Header.Get("Content-Range"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid Content-Range", err.Error())
+		return
+	}
+	if r.ContentLength >= 0 && r.ContentLength != rng.length() {
+		h.render.Error(w, r, http.StatusBadRequest, "Content-Length does not match Content-Range")
+		return
+	}
+	if rng.end >= u.Size {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", u.Size))
+		h.render.Error(w, r, http.StatusRequestedRangeNotSatisfiable, "part lies beyond the end of the file")
+		return
+	}
+
+	limit := h.uploadLimit(w, r)
+	if limit.exceeds(rng.length()) {
+		oversized = true
+		h.rejectOverLimit(w, r, limit)
+		return
+	}
+	defer h.meterUpload(w, r, &limit)()
+	h.withStallTimeout(w, r)
+
+	u, err = h.assembled.Write(u.ID, rng.start, rng.length(), newContextReader(r.Context(), r.Body))
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+	case r.Context().Err() != nil:
+		h.logger.Printf("client %s disconnected whilst sending a part of upload %s\n", r.RemoteAddr, r.PathValue("id"))
+		return
+	case errors.As(err, &tooLarge):
+		oversized = true
+		h.rejectOverLimit(w, r, limit)
+		return
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		h.render.Error(w, r, http.StatusBadRequest, "body is shorter than its Content-Range")
+		return
+	case errors.Is(err, assembly.ErrNotFound):
+		h.render.Error(w, r, http.StatusNotFound, "upload is not found")
+		return
+	default:
+		h.logger.Printf("error writing part of upload %s: %v\n", r.PathValue("id"), err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to write part")
+		return
+	}
+	h.render.JSON(w, http.StatusOK, h.assemblyStatusOf(u))
+}
+
+// CompleteUploadHandler stores a parallel upload whose every byte has arrived, after the
+// checks an upload goes through, and answers with the stored file's details. The request may
+// carry If-None-Match: * or If-Match, as an upload may, and a Repr-Digest header with the
+// SHA-256 checksum of the file to have it verified.
+func (h *Handlers) CompleteUploadHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	u, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	if !u.Complete() {
+		h.render.Error(w, r, http.StatusConflict, "upload is incomplete", fmt.Sprintf("%d ranges are missing", len(u.Missing())))
+		return
+	}
+	principal := principalFrom(r)
+	// Checked again, as the ACL may have changed since the upload started.
+	if !h.acl.Allowed(principal, acl.Write, u.Name) {
+		h.denyAccess(w, r)
+		return
+	}
+
+	if err := h.makeStorageDir(); err != nil {
+		h.logger.Printf("error creating file directory: %v\n", err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to prepare storage directory")
+		return
+	}
+	root, err := h.storage.OpenRoot(u.Name)
+	if err != nil {
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	conditions := uploadConditionsFrom(r)
+	if err := conditions.check(root, u.Name); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			h.render.Error(w, r, http.StatusPreconditionFailed, "precondition failed")
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", u.Name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	if err := h.checkProtected(root, principal, u.Name, "overwrite"); err != nil {
+		if errors.Is(err, errHeld) || errors.Is(err, errRetained) {
+			h.render.Error(w, r, protectedStatus(err), "protected files cannot be changed", err.Error())
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", u.Name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	_, statErr := root.Stat(u.Name)
+	created := errors.Is(statErr, fs.ErrNotExist)
+
+	content, err := h.assembled.Open(u.ID)
+	if err != nil {
+		h.logger.Printf("error opening upload %s: %v\n", u.ID, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to open upload")
+		return
+	}
+	defer content.Close()
+	fh := &multipart.FileHeader{Filename: u.Name, Header: make(textproto.MIMEHeader), Size: u.Size}
+	if digest := r.Header.Get("Repr-Digest"); digest != "" {
+		fh.Header.Set("Repr-Digest", digest)
+	}
+	if fail := h.checkUpload("from "+r.RemoteAddr, principalName(principal), u.Name, fh, content); fail != nil {
+		// A file refused for what it holds would be refused again; the parts go with it.
+		if fail.status != 0 {
+			h.assembled.Remove(u.ID)
+		}
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		h.logger.Printf("error rewinding upload %s: %v\n", u.ID, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if _, fail := h.storeUpload(root, u.Name, content, conditions.createOnly(), principalName(principal), u.Size); fail != nil {
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+	h.assembled.Remove(u.ID)
+
+	stat, err := root.Stat(u.Name)
+	if err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", u.Name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	h.logger.Printf("assembled %d bytes of upload %s into '%s' for %s\n", u.Size, u.ID, u.Name, r.RemoteAddr)
+	h.renderStored(w, u.Name, stat, created)
+}
+
+// AbortUploadHandler gives up on a parallel upload, discarding the parts received so far.
+func (h *Handlers) AbortUploadHandler(w http.ResponseWriter, r *http.Request) {
+	u, ok := h.ownUpload(w, r)
+	if !ok {
+		return
+	}
+	h.assembled.Remove(u.ID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownUpload returns the parallel upload named in the request path. Only the user who started
+// it, or an administrator, can see it; anyone else is answered as if it did not exist, and
+// false is reported.
+func (h *Handlers) ownUpload(w http.ResponseWriter, r *http.Request) (assembly.Upload, bool) {
+	u, ok := h.assembled.Get(r.PathValue("id"))
+	p := principalFrom(r)
+	if !ok || (u.User != principalName(p) && !h.authz.Can(p, authz.PermAdmin)) {
+		h.render.Error(w, r, http.StatusNotFound, "upload is not found")
+		return assembly.Upload{}, false
+	}
+	return u, true
+}
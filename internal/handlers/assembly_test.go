@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/assembly"
+	"github.com/mascotmascot1/fileserver/internal/auth"
+)
+
+// openAssembly enables parallel uploads on h, staged in a temporary directory.
+func openAssembly(t *testing.T, h *Handlers) {
+	t.Helper()
+	dir := t.TempDir()
+	s, err := assembly.Open(filepath.Join(dir, "uploads.json"), filepath.Join(dir, "parts"), time.Hour, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Close)
+	h.assembled = s
+}
+
+// asUser returns r as made by username, who is not an administrator.
+func asUser(r *http.Request, username string) *http.Request {
+	return r.WithContext(auth.NewContext(r.Context(), &auth.Principal{Username: username}))
+}
+
+// createUpload starts a parallel upload of body, and returns its description.
+func createUpload(t *testing.T, h *Handlers, body string) (*httptest.ResponseRecorder, assemblyStatus) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.CreateUploadHandler(w, asAdmin(httptest.NewRequest(http.MethodPost, "/api/uploads", strings.NewReader(body))))
+	var status assemblyStatus
+	if w.Code == http.StatusCreated {
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, status
+}
+
+// uploadRequest returns a request for the parallel upload id, with its path value set.
+func uploadRequest(method, id string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, "/api/uploads/"+id, body)
+	r.SetPathValue("id", id)
+	return r
+}
+
+func TestCreateUpload(t *testing.T) {
+	tests := []struct {
+		desc       string
+		body       string
+		wantStatus int
+	}{
+		{"a file", `{"name": "images/vm.img", "size": 10}`, http.StatusCreated},
+		{"an empty file", `{"name": "empty.img", "size": 0}`, http.StatusCreated},
+		{"no size", `{"name": "images/vm.img"}`, http.StatusBadRequest},
+		{"a negative size", `{"name": "images/vm.img", "size": -1}`, http.StatusBadRequest},
+		{"no name", `{"size": 10}`, http.StatusBadRequest},
+		{"the storage root", `{"name": "/", "size": 10}`, http.StatusBadRequest},
+		{"malformed JSON", `{"name": `, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h := newTestHandlers(t, openTestTree(t), nil)
+			openAssembly(t, h)
+			w, status := createUpload(t, h, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if w.Code != http.StatusCreated {
+				return
+			}
+			if got := w.Header().Get("Location"); got != "/api/uploads/"+status.ID {
+				t.Errorf("got Location %q for upload %s", got, status.ID)
+			}
+			if status.User != "admin" || status.Complete != (status.Size == 0) {
+				t.Errorf("got upload %+v", status)
+			}
+		})
+	}
+}
+
+func TestParallelUpload(t *testing.T) {
+	root := openTestTree(t)
+	h := newTestHandlers(t, root, nil)
+	openAssembly(t, h)
+	const content = "0123456789"
+	w, u := createUpload(t, h, `{"name": "images/vm.img", "size": 10}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	sum := sha256.Sum256([]byte(content))
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+
+	tests := []struct {
+		desc         string
+		method       string
+		contentRange string // for parts only
+		body         string
+		user         string // an administrator if empty
+		digest       string
+		wantStatus   int
+		wantMissing  []assembly.Range
+	}{
+		{"completing before every part arrives", http.MethodPost, "", "", "", "", http.StatusConflict, nil},
+		{"the second half", http.MethodPut, "bytes 5-9/10", content[5:], "", "", http.StatusOK, []assembly.Range{{Offset: 0, Length: 5}}},
+		{"a part beyond the end", http.MethodPut, "bytes 8-11/*", "89ab", "", "", http.StatusRequestedRangeNotSatisfiable, nil},
+		{"a part in another unit", http.MethodPut, "items 0-4/10", content[:5], "", "", http.StatusBadRequest, nil},
+		{"a body longer than its range", http.MethodPut, "bytes 0-4/10", content, "", "", http.StatusBadRequest, nil},
+		{"another user's part", http.MethodPut, "bytes 0-4/10", content[:5], "alice", "", http.StatusNotFound, nil},
+		{"another user's status", http.MethodGet, "", "", "alice", "", http.StatusNotFound, nil},
+		{"the status", http.MethodGet, "", "", "", "", http.StatusOK, []assembly.Range{{Offset: 0, Length: 5}}},
+		{"the first half", http.MethodPut, "bytes 0-4/10", content[:5], "", "", http.StatusOK, []assembly.Range{}},
+		// A part sent again overwrites the same bytes.
+		{"the first half again", http.MethodPut, "bytes 0-4/10", content[:5], "", "", http.StatusOK, []assembly.Range{}},
+		{"another user completing", http.MethodPost, "", "", "alice", digest, http.StatusNotFound, nil},
+		{"completing", http.MethodPost, "", "", "", digest, http.StatusCreated, nil},
+		// The parts are removed once the file is stored.
+		{"the status once complete", http.MethodGet, "", "", "", "", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := uploadRequest(tt.method, u.ID, strings.NewReader(tt.body))
+			if tt.contentRange != "" {
+				r.Header.Set("Content-Range", tt.contentRange)
+			}
+			if tt.digest != "" {
+				r.Header.Set("Repr-Digest", tt.digest)
+			}
+			if tt.user != "" {
+				r = asUser(r, tt.user)
+			} else {
+				r = asAdmin(r)
+			}
+			w := httptest.NewRecorder()
+			switch tt.method {
+			case http.MethodGet:
+				h.UploadStatusHandler(w, r)
+			case http.MethodPut:
+				h.UploadPartHandler(w, r)
+			default:
+				h.CompleteUploadHandler(w, r)
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if tt.wantMissing != nil {
+				var status assemblyStatus
+				if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(status.Missing, tt.wantMissing) || status.Complete != (len(tt.wantMissing) == 0) {
+					t.Errorf("got missing %v, complete %v, want missing %v", status.Missing, status.Complete, tt.wantMissing)
+				}
+			}
+			if w.Code == http.StatusRequestedRangeNotSatisfiable && w.Header().Get("Content-Range") != "bytes */10" {
+				t.Errorf("got Content-Range %q, want bytes */10", w.Header().Get("Content-Range"))
+			}
+		})
+	}
+	if b, err := root.ReadFile("images/vm.img"); err != nil || string(b) != content {
+		t.Errorf("got %q, %v, want %q", b, err, content)
+	}
+}
+
+func TestParallelUploadRefused(t *testing.T) {
+	wrong := "sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, 32)) + ":"
+	tests := []struct {
+		desc        string
+		digest      string
+		existing    bool // whether a file is already stored at the name
+		ifNoneMatch bool
+		wantStatus  int
+		wantParts   bool // whether the parts are kept
+	}{
+		{"a wrong digest", wrong, false, false, http.StatusUnprocessableEntity, false},
+		{"a file that exists already", "", true, true, http.StatusPreconditionFailed, true},
+		{"a file that does not exist yet", "", false, true, http.StatusCreated, false},
+		{"overwriting a file", "", true, false, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			root := openTestTree(t)
+			if tt.existing {
+				if err := root.WriteFile("vm.img", []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			h := newTestHandlers(t, root, nil)
+			openAssembly(t, h)
+			_, u := createUpload(t, h, `{"name": "vm.img", "size": 3}`)
+			r := uploadRequest(http.MethodPut, u.ID, strings.NewReader("new"))
+			r.Header.Set("Content-Range", "bytes 0-2/3")
+			w := httptest.NewRecorder()
+			h.UploadPartHandler(w, asAdmin(r))
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+			}
+
+			r = uploadRequest(http.MethodPost, u.ID, nil)
+			if tt.digest != "" {
+				r.Header.Set("Repr-Digest", tt.digest)
+			}
+			if tt.ifNoneMatch {
+				r.Header.Set("If-None-Match", "*")
+			}
+			w = httptest.NewRecorder()
+			h.CompleteUploadHandler(w, asAdmin(r))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if _, ok := h.assembled.Get(u.ID); ok != tt.wantParts {
+				t.Errorf("the parts were kept: %v, want %v", ok, tt.wantParts)
+			}
+			// A refused file leaves what was stored before, if anything.
+			want := "new"
+			if w.Code >= http.StatusBadRequest {
+				want = ""
+				if tt.existing {
+					want = "old"
+				}
+			}
+			if b, _ := root.ReadFile("vm.img"); string(b) != want {
+				t.Errorf("the file holds %q, want %q", b, want)
+			}
+		})
+	}
+}
+
+func TestAbortUpload(t *testing.T) {
+	h := newTestHandlers(t, openTestTree(t), nil)
+	openAssembly(t, h)
+	_, u := createUpload(t, h, `{"name": "vm.img", "size": 10}`)
+
+	w := httptest.NewRecorder()
+	h.AbortUploadHandler(w, asUser(uploadRequest(http.MethodDelete, u.ID, nil), "alice"))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("another user aborting: got status %d %s, want %d", w.Code, w.Body, http.StatusNotFound)
+	}
+	w = httptest.NewRecorder()
+	h.AbortUploadHandler(w, asAdmin(uploadRequest(http.MethodDelete, u.ID, nil)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusNoContent)
+	}
+	if _, ok := h.assembled.Get(u.ID); ok {
+		t.Error("the upload was kept")
+	}
+}
@@ -0,0 +1,435 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/authz"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/internal/notify"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// Batch request limits. Why cap them? A single request must not be able to tie up the
+// server indefinitely or force it to buffer an arbitrarily large operation list.
+const (
+	maxBatchBodySize   = 1 << 20 // 1 MB
+	maxBatchOperations = 1000
+)
+
+// batchOperation is a single entry of a batch request.
+type batchOperation struct {
+	Op        string `json:"op"`
+	Path      string `json:"path"`
+	To        string `json:"to,omitempty"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+// batchResult reports the outcome of one operation.
+type batchResult struct {
+	Index  int    `json:"index"`
+	Op     string `json:"op"`
+	Path   string `json:"path"`
+	To     string `json:"to,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// batchResponse is the document returned by BatchHandler.
+type batchResponse struct {
+	Succeeded int           `json:"succeeded"`
+	Failed    int           `json:"failed"`
+	Results   []batchResult `json:"results"`
+}
+
+// errBatchDenied is reported for operations the caller is not permitted to perform.
+var errBatchDenied = errors.New("permission denied")
+
+// errBatchBusy is reported for operations on files that an upload is writing.
+var errBatchBusy = errors.New("a file is being written by an upload")
+
+// errSpansDisks is reported for moving a directory from one disk to another, or deleting or
+// moving one whose files are stored on several, which must be done file by file.
+var errSpansDisks = errors.New("directories cannot be moved or deleted whole across disks; move or delete their files instead")
+
+// BatchHandler executes a list of delete, move and copy operations server-side and
+// reports a result per operation, so bulk clean-ups do not need a round trip per file.
+// Operations run in order and independently: a failure does not stop the ones after it.
+func (h *Handlers) BatchHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	var req struct {
+		Operations []batchOperation `json:"operations"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			h.render.TooLarge(w, r, "batch request body is too large", maxBatchBodySize)
+			return
+		}
+		h.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return
+	}
+	if len(req.Operations) == 0 {
+		h.render.Error(w, r, http.StatusBadRequest, "no operations given")
+		return
+	}
+	if len(req.Operations) > maxBatchOperations {
+		h.render.Error(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d operations are allowed per batch", maxBatchOperations))
+		return
+	}
+
+	roots := storage.NewRoots(h.storage)
+	defer roots.Close()
+
+	principal := principalFrom(r)
+	resp := batchResponse{Results: make([]batchResult, 0, len(req.Operations))}
+	for i, op := range req.Operations {
+		res := batchResult{Index: i, Op: op.Op, Path: op.Path, To: op.To, Status: "ok"}
+		if err := h.runBatchOperation(roots, principal, op); err != nil {
+			res.Status = "error"
+			res.Error = err.Error()
+			resp.Failed++
+		} else {
+			resp.Succeeded++
+			h.logger.Printf("batch %s '%s' %s by %s\n", op.Op, op.Path, op.To, r.RemoteAddr)
+		}
+		resp.Results = append(resp.Results, res)
+	}
+
+	// Why StatusMultiStatus? As with uploads, it signals that some operations may have
+	// succeeded whilst others failed; the per-item results say which.
+	status := http.StatusOK
+	if resp.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	h.render.JSON(w, status, resp)
+}
+
+// runBatchOperation authorises and performs a single batch operation.
+func (h *Handlers) runBatchOperation(roots *storage.Roots, p *auth.Principal, op batchOperation) error {
+	src, err := cleanStoragePath(op.Path)
+	if err != nil {
+		return err
+	}
+	// Hidden files are not found, whatever the operation, so that none reveals they exist.
+	if h.hidden.hidden(src) {
+		return describeFSError(fs.ErrNotExist)
+	}
+	root, err := roots.Open(src)
+	if err != nil {
+		return describeFSError(err)
+	}
+	if err := h.checkSymlinks(root, src, false); err != nil {
+		return describeFSError(err)
+	}
+
+	switch op.Op {
+	case "delete":
+		if !h.authz.Can(p, authz.PermDelete) || !h.acl.Allowed(p, acl.Write, src) || h.hidden.holdsInternal(src) {
+			return errBatchDenied
+		}
+		if err := h.checkProtected(root, p, src, "delete"); err != nil {
+			return describeFSError(err)
+		}
+		if op.Recursive {
+			if err := h.checkTreeACL(root, p, acl.Write, src, ""); err != nil {
+				return err
+			}
+		}
+		release, err := h.guardTree(root, src, "")
+		if err != nil {
+			return err
+		}
+		defer release()
+		if op.Recursive {
+			// Why check existence first? RemoveAll succeeds silently on missing paths,
+			// which would hide typos in the operation list.
+			if _, err := root.Lstat(src); err != nil {
+				return describeFSError(err)
+			}
+			if h.storage.Spans(src) {
+				return errSpansDisks
+			}
+			if err := root.RemoveAll(src); err != nil {
+				return describeFSError(err)
+			}
+		} else if err := root.Remove(src); err != nil {
+			return describeFSError(err)
+		}
+		h.index.Remove(src)
+		h.fileCache.Invalidate(src)
+		h.fileMeta.Remove(src)
+		h.notifier.Notify(notify.Event{Type: notify.Delete, Name: src, User: principalName(p)})
+		return nil
+
+	case "move", "copy":
+		dst, err := cleanStoragePath(op.To)
+		if err != nil {
+			return fmt.Errorf("invalid destination: %w", err)
+		}
+		if src == dst {
+			return errors.New("source and destination are the same")
+		}
+		if err := h.hidden.checkWrite(dst); err != nil {
+			return err
+		}
+		dstRoot, err := roots.Open(dst)
+		if err != nil {
+			return describeFSError(err)
+		}
+		if err := h.checkSymlinks(dstRoot, dst, true); err != nil {
+			return describeFSError(err)
+		}
+
+		// A move deletes the source, so it needs delete rights there; a copy only reads it.
+		srcPerm, srcOp := authz.PermDelete, acl.Write
+		if op.Op == "copy" {
+			srcPerm, srcOp = authz.PermDownload, acl.Read
+		}
+		if !h.authz.Can(p, srcPerm) || !h.acl.Allowed(p, srcOp, src) ||
+			!h.authz.Can(p, authz.PermUpload) || !h.acl.Allowed(p, acl.Write, dst) {
+			return errBatchDenied
+		}
+		if err := h.checkTreeACL(root, p, srcOp, src, dst); err != nil {
+			return err
+		}
+
+		if !op.Overwrite {
+			if _, err := dstRoot.Lstat(dst); err == nil {
+				return errors.New("destination already exists")
+			}
+		}
+		// Directories are moved by renaming them, which cannot take them from one disk to
+		// another; files are copied across instead.
+		if info, err := root.Lstat(src); err == nil && info.IsDir() && op.Op == "move" &&
+			(dstRoot != root || h.storage.Spans(src) || h.storage.Spans(dst)) {
+			return errSpansDisks
+		}
+		if op.Op == "move" {
+			if h.hidden.holdsInternal(src) {
+				return errBatchDenied
+			}
+			if err := h.checkProtected(root, p, src, "move"); err != nil {
+				return describeFSError(err)
+			}
+		}
+		if err := h.checkProtected(dstRoot, p, dst, "overwrite"); err != nil {
+			return describeFSError(err)
+		}
+		from := ""
+		if op.Op == "move" {
+			from = src
+		}
+		if err := h.checkDirQuotas(dst, h.fileMeta.Usage(src), from); err != nil {
+			return err
+		}
+		release, err := h.guardTree(root, src, dst)
+		if err != nil {
+			return err
+		}
+		defer release()
+		if dir := path.Dir(dst); dir != "." {
+			if err := h.makeDirs(dstRoot, dir); err != nil {
+				return describeFSError(err)
+			}
+		}
+		if op.Op == "move" {
+			if dstRoot != root {
+				err = h.copyFile(root, src, dstRoot, dst)
+				if err == nil {
+					err = root.Remove(src)
+				}
+			} else {
+				err = root.Rename(src, dst)
+			}
+			if err != nil {
+				return describeFSError(err)
+			}
+			h.index.Rename(src, dst)
+			h.fileCache.Invalidate(src)
+			h.fileCache.Invalidate(dst)
+			h.fileMeta.Rename(src, dst)
+			return describeFSError(h.restartRetention(dstRoot, dst))
+		}
+		if err := h.copyFile(root, src, dstRoot, dst); err != nil {
+			return describeFSError(err)
+		}
+		h.index.Add(dst)
+		h.fileCache.Invalidate(dst)
+		h.fileMeta.Update(dst)
+		return describeFSError(h.restartRetention(dstRoot, dst))
+
+	default:
+		return fmt.Errorf("unknown operation '%s' (expected delete, move or copy)", op.Op)
+	}
+}
+
+// walkTree calls fn for name and, when it is a directory, for everything below it. A
+// missing name is left for the operation itself to report.
+func walkTree(root storage.Root, name string, fn func(file string, d fs.DirEntry) error) error {
+	info, err := root.Lstat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return describeFSError(err)
+	}
+	if !info.IsDir() {
+		return fn(name, fs.FileInfoToDirEntry(info))
+	}
+	return fs.WalkDir(root.FS(), name, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return describeFSError(err)
+		}
+		return fn(file, d)
+	})
+}
+
+// checkTreeACL checks that the ACL lets p perform op on name and everything below it and,
+// for a move or copy to dst, write where each of them ends up.
+//
+// Why every entry? ACL rules can be narrower than the directory named, and deleting or
+// moving the directory whole would otherwise reach files the caller cannot touch one by one.
+func (h *Handlers) checkTreeACL(root storage.Root, p *auth.Principal, op acl.Op, name, dst string) error {
+	return walkTree(root, name, func(file string, d fs.DirEntry) error {
+		if !h.acl.Allowed(p, op, file) {
+			return errBatchDenied
+		}
+		if dst != "" && !h.acl.Allowed(p, acl.Write, dst+strings.TrimPrefix(file, name)) {
+			return errBatchDenied
+		}
+		return nil
+	})
+}
+
+// guardTree takes the write guard of the regular files at or below name and, for a move or
+// copy to dst, of the names they end up at, so that no upload writes them meanwhile. The
+// returned function releases them all.
+func (h *Handlers) guardTree(root storage.Root, name, dst string) (func(), error) {
+	var held []string
+	release := func() {
+		for _, n := range held {
+			h.writing.release(n)
+		}
+	}
+	err := walkTree(root, name, func(file string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		names := []string{file}
+		if dst != "" {
+			names = append(names, dst+strings.TrimPrefix(file, name))
+		}
+		for _, n := range names {
+			if !h.writing.acquire(n) {
+				return errBatchBusy
+			}
+			held = append(held, n)
+		}
+		return nil
+	})
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// copyBetweenRoots copies the regular file src in from to dst in to, which may be the same
+// root, removing the partial copy on failure.
+//
+// Why not just io.Copy? It already has the kernel copy the data between files where it can
+// (copy_file_range on Linux, which ZFS and NFS servers can even do without moving the
+// data), but a reflink, tried first, shares the data outright on filesystems that allow it.
+func copyBetweenRoots(from storage.Root, src string, to storage.Root, dst string) error {
+	in, err := from.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errors.New("only regular files can be copied")
+	}
+
+	out, err := to.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := cloneFile(out, in); err != nil {
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			to.Remove(dst)
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		to.Remove(dst)
+		return err
+	}
+	return nil
+}
+
+// cleanStoragePath validates a client-supplied path relative to the storage directory.
+// os.Root already refuses escapes, but rejecting them here yields a clearer message and
+// stops the storage directory itself from being deleted or moved.
+func cleanStoragePath(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("path is required")
+	}
+	clean := path.Clean("/" + filepath.ToSlash(name))[1:]
+	if clean == "" {
+		return "", errors.New("the storage root cannot be modified")
+	}
+	return clean, nil
+}
+
+// describeFSError turns a filesystem error into a short client-facing message
+// that does not expose server paths.
+func describeFSError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errRetained), errors.Is(err, errHeld):
+		return err
+	case errors.Is(err, fs.ErrNotExist):
+		return errors.New("not found")
+	case errors.Is(err, errSymlink):
+		return errSymlink
+	case errors.Is(err, syscall.ENOTEMPTY):
+		// Checked before ErrExist, which ENOTEMPTY also matches.
+		return errors.New("directory is not empty (set \"recursive\" to delete it)")
+	case errors.Is(err, fs.ErrExist):
+		return errors.New("already exists")
+	case errors.Is(err, fs.ErrPermission):
+		return errors.New("permission denied on the server")
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	var linkErr *os.LinkError
+	if errors.As(err, &linkErr) {
+		return linkErr.Err
+	}
+	return err
+}
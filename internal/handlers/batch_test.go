@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/authz"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/filecache"
+	"github.com/mascotmascot1/fileserver/internal/filemeta"
+	"github.com/mascotmascot1/fileserver/internal/holds"
+	"github.com/mascotmascot1/fileserver/internal/index"
+	"github.com/mascotmascot1/fileserver/internal/locks"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+	"github.com/mascotmascot1/fileserver/internal/shard"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// openTestTree creates files in a temporary storage directory and opens it.
+func openTestTree(t *testing.T, files ...string) storage.Root {
+	t.Helper()
+	dir := t.TempDir()
+	for _, f := range files {
+		full := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, err := storage.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { root.Close() })
+	return root
+}
+
+// newTestHandlers returns handlers for the files in root, set up as the server sets them up
+// without a configuration file, with the metadata and holds of the files kept in temporary
+// files. A nil logger discards the log. Tests set what they exercise, such as the retention
+// policy, on the handlers returned.
+func newTestHandlers(t *testing.T, root storage.Root, logger *log.Logger) *Handlers {
+	t.Helper()
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	layout, err := shard.New(root.Name(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	metaDir, err := shard.New(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := filemeta.Open(metaDir, "files.json", layout, false, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { meta.Close() })
+	holdStore, err := holds.Open(metaDir, "holds.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.Default()
+	cfg.Uploader.StorageDir = root.Name()
+	render := respond.NewRenderer(respond.FormatJSON, logger)
+	return &Handlers{
+		uploader:  &cfg.Uploader,
+		editor:    &cfg.Editor,
+		validator: newValidator(cfg.Validation),
+		logger:    logger,
+		render:    render,
+		acl:       acl.New(nil),
+		authz:     authz.New(cfg, render, logger),
+		index:     index.New(layout, false, logger),
+		cache:     newCachePolicy(cfg.Cache),
+		fileCache: filecache.New(cfg.FileCache.GetMaxSize(), cfg.FileCache.GetMaxEntrySize()),
+		retention: newRetentionPolicy(cfg.WORM),
+		holds:     holdStore,
+		fileMeta:  meta,
+		dirQuotas: newDirQuotas(nil),
+		hidden:    newHiddenPolicy(cfg.HiddenFiles, root.Name(), ""),
+		locks:     locks.NewManager(),
+		writing:   newWriteGuard(nil, nil),
+		storage:   layout,
+	}
+}
+
+func TestCheckTreeACL(t *testing.T) {
+	root := openTestTree(t, "team/a.txt", "team/secret/b.txt", "other/c.txt")
+	h := &Handlers{acl: acl.New([]config.ACLRule{
+		{Path: "/team/secret", Read: []string{"user:boss"}, Write: []string{"user:boss"}},
+		{Path: "/archive", Read: []string{"*"}, Write: []string{"user:boss"}},
+	})}
+	alice := &auth.Principal{Username: "alice"}
+	boss := &auth.Principal{Username: "boss"}
+
+	tests := []struct {
+		desc     string
+		p        *auth.Principal
+		op       acl.Op
+		name     string
+		dst      string
+		wantDeny bool
+	}{
+		{"delete a directory holding a file the caller cannot write", alice, acl.Write, "team", "", true},
+		{"delete a directory the caller can write throughout", boss, acl.Write, "team", "", false},
+		{"delete a file outside the rules", alice, acl.Write, "other/c.txt", "", false},
+		{"move a directory holding a file the caller cannot delete", alice, acl.Write, "team", "moved", true},
+		{"move a directory to where the caller cannot write", alice, acl.Write, "other", "archive/other", true},
+		{"move a directory to where the caller can write", boss, acl.Write, "other", "archive/other", false},
+		{"copy a file the caller cannot read", alice, acl.Read, "team/secret/b.txt", "b.txt", true},
+		{"missing names are left to the operation", alice, acl.Write, "missing", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := h.checkTreeACL(root, tt.p, tt.op, tt.name, tt.dst)
+			if denied := errors.Is(err, errBatchDenied); denied != tt.wantDeny || (err != nil && !denied) {
+				t.Errorf("checkTreeACL = %v, want denied %v", err, tt.wantDeny)
+			}
+		})
+	}
+}
+
+func TestGuardTree(t *testing.T) {
+	root := openTestTree(t, "dir/a.txt", "dir/sub/b.txt")
+
+	tests := []struct {
+		desc     string
+		busy     string
+		name     string
+		dst      string
+		wantBusy bool
+	}{
+		{"no upload running", "", "dir", "", false},
+		{"an upload writes a file below the directory", "dir/sub/b.txt", "dir", "", true},
+		{"an upload writes where a file is moved to", "moved/sub/b.txt", "dir", "moved", true},
+		{"an upload writes elsewhere", "other.txt", "dir", "moved", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h := &Handlers{writing: newWriteGuard(nil, nil)}
+			if tt.busy != "" {
+				h.writing.acquire(tt.busy)
+			}
+			release, err := h.guardTree(root, tt.name, tt.dst)
+			if tt.wantBusy {
+				if !errors.Is(err, errBatchBusy) {
+					t.Fatalf("guardTree = %v, want errBatchBusy", err)
+				}
+				// Names taken before the busy one was met are given back.
+				if h.writing.busy("dir/a.txt") {
+					t.Error("guardTree kept names after failing")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range []string{"dir/a.txt", "dir/sub/b.txt"} {
+				if !h.writing.busy(n) {
+					t.Errorf("'%s' is not guarded", n)
+				}
+			}
+			release()
+			if h.writing.busy("dir/a.txt") || h.writing.busy("dir/sub/b.txt") {
+				t.Error("release left names guarded")
+			}
+		})
+	}
+}
+
+// TestBatchAcrossDisks checks that files are moved and copied between the disks of a sharded
+// storage directory, and that directories spanning several are refused whole.
+func TestBatchAcrossDisks(t *testing.T) {
+	tests := []struct {
+		desc     string
+		op       batchOperation
+		wantErr  error
+		wantDisk string // the file's new name, which must be on the photos disk
+	}{
+		{"move a file onto another disk", batchOperation{Op: "move", Path: "a.txt", To: "media/photos/a.txt"}, nil, "media/photos/a.txt"},
+		{"move a file off its disk", batchOperation{Op: "move", Path: "media/photos/b.jpg", To: "b.jpg"}, nil, ""},
+		{"copy a file onto another disk", batchOperation{Op: "copy", Path: "a.txt", To: "media/photos/2024/a.txt"}, nil, "media/photos/2024/a.txt"},
+		{"move a directory onto another disk", batchOperation{Op: "move", Path: "docs", To: "media/photos/docs"}, errSpansDisks, ""},
+		{"move a directory holding another disk", batchOperation{Op: "move", Path: "media", To: "archive"}, errSpansDisks, ""},
+		{"delete a directory holding another disk", batchOperation{Op: "delete", Path: "media", Recursive: true}, errSpansDisks, ""},
+		{"delete a directory on its own disk", batchOperation{Op: "delete", Path: "media/photos", Recursive: true}, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			root := openTestTree(t, "a.txt", "docs/c.txt", "media/d.txt")
+			photos := t.TempDir()
+			layout, err := shard.New(root.Name(), []config.ShardConfig{{Prefix: "media/photos", Dir: photos}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(filepath.Join(photos, "media", "photos"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(layout.Path("media/photos/b.jpg"), []byte("media/photos/b.jpg"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			h := newTestHandlers(t, root, nil)
+			h.storage, h.index = layout, index.New(layout, false, h.logger)
+
+			roots := storage.NewRoots(h.storage)
+			defer roots.Close()
+			err = h.runBatchOperation(roots, &auth.Principal{Username: "admin", Roles: []string{"admin"}}, tt.op)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("runBatchOperation = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				for _, name := range []string{"a.txt", "docs/c.txt", "media/d.txt", "media/photos/b.jpg"} {
+					if _, err := os.Stat(layout.Path(name)); err != nil {
+						t.Errorf("'%s' is gone: %v", name, err)
+					}
+				}
+				return
+			}
+			if tt.wantDisk != "" {
+				if b, err := os.ReadFile(filepath.Join(photos, filepath.FromSlash(tt.wantDisk))); err != nil || string(b) != tt.op.Path {
+					t.Errorf("'%s' holds %q, %v on the photos disk, want %q", tt.wantDisk, b, err, tt.op.Path)
+				}
+			}
+			_, err = os.Stat(layout.Path(tt.op.Path))
+			if gone := errors.Is(err, fs.ErrNotExist); gone != (tt.op.Op != "copy") {
+				t.Errorf("'%s' gone %v after %s", tt.op.Path, gone, tt.op.Op)
+			}
+		})
+	}
+}
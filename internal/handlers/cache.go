@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// cachePolicy chooses the Cache-Control header for a download.
+//
+// Why make it configurable? Without the header, browsers and CDNs fall back to heuristics:
+// they may cache private files they should not store, and revalidate content-addressed
+// blobs that can never change. Only the operator knows which paths hold which kind of file.
+type cachePolicy struct {
+	fallback string
+	rules    []config.CacheRule
+}
+
+// newCachePolicy normalises the configured rules once, so matching stays cheap.
+func newCachePolicy(cfg config.CacheConfig) *cachePolicy {
+	cp := &cachePolicy{fallback: cfg.Default, rules: make([]config.CacheRule, 0, len(cfg.Rules))}
+	for _, rule := range cfg.Rules {
+		if rule.Path != "" {
+			rule.Path = path.Clean("/" + rule.Path)
+		}
+		rule.MIMEType = strings.ToLower(rule.MIMEType)
+		cp.rules = append(cp.rules, rule)
+	}
+	return cp
+}
+
+// header returns the Cache-Control value for the storage-relative file name,
+// or an empty string if none should be sent.
+func (cp *cachePolicy) header(name string) string {
+	name = path.Clean("/" + name)
+	mimeType, _, _ := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+	for _, rule := range cp.rules {
+		if rule.Path != "" && rule.Path != "/" && name != rule.Path && !strings.HasPrefix(name, rule.Path+"/") {
+			continue
+		}
+		if !matchMIMEType(rule.MIMEType, mimeType) {
+			continue
+		}
+		return rule.CacheControl
+	}
+	return cp.fallback
+}
+
+// matchMIMEType reports whether mimeType matches pattern, which may be empty (anything),
+// a full type such as "application/pdf", or a family such as "image/*".
+func matchMIMEType(pattern, mimeType string) bool {
+	switch {
+	case pattern == "" || pattern == "*/*":
+		return true
+	case strings.HasSuffix(pattern, "/*"):
+		return strings.HasPrefix(mimeType, strings.TrimSuffix(pattern, "*"))
+	default:
+		return pattern == mimeType
+	}
+}
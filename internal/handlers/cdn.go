@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/cdn"
+)
+
+const (
+	// maxPurgeBodySize bounds the JSON body of a purge request.
+	maxPurgeBodySize = 1 << 20 // 1 MB
+	// maxPurgePaths bounds the files purged by one request.
+	maxPurgePaths = 1000
+	// purgeTimeout bounds the purge requests sent for one purge request.
+	purgeTimeout = 2 * time.Minute
+)
+
+// cdnCookies is the answer to a request for signed cookies.
+type cdnCookies struct {
+	Prefix  string    `json:"prefix"`
+	Expires time.Time `json:"expires"`
+	// Cookies holds the cookies set, by name, for clients that send them to the CDN themselves.
+	Cookies map[string]string `json:"cookies"`
+}
+
+// CDNCookiesHandler sets the signed cookies with which the CDN serves the downloads below the
+// protected prefix in the "prefix" query parameter, if the caller may read it.
+//
+// Why cookies rather than signed URLs? One set of cookies grants a whole directory, such as
+// the segments of a video, whose URLs a player builds itself and could not have signed.
+func (h *Handlers) CDNCookiesHandler(w http.ResponseWriter, r *http.Request) {
+	prefix, ok := h.cdnSigner.Prefix(r.URL.Query().Get("prefix"))
+	if !ok {
+		h.render.Error(w, r, http.StatusNotFound, "not a protected prefix")
+		return
+	}
+	p := principalFrom(r)
+	// The cookies grant everything below the prefix, so the caller must be allowed to read
+	// the prefix itself.
+	if h.hidden.hidden(prefix) || !h.acl.Allowed(p, acl.Read, prefix) {
+		h.denyAccess(w, r)
+		return
+	}
+	cookies, expires, err := h.cdnSigner.Cookies(prefix)
+	if err != nil {
+		h.logger.Printf("error signing CDN cookies for '%s': %v\n", prefix, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	resp := cdnCookies{Prefix: prefix, Expires: expires.UTC(), Cookies: make(map[string]string, len(cookies))}
+	for _, c := range cookies {
+		http.SetCookie(w, c)
+		resp.Cookies[c.Name] = c.Value
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	h.render.JSON(w, http.StatusOK, resp)
+}
+
+// purgeResult is the answer to a purge request.
+type purgeResult struct {
+	URLs    []string     `json:"urls"`
+	Results []cdn.Result `json:"results"`
+}
+
+// PurgeCacheHandler asks the configured CDNs to drop their copies of the stored files listed
+// in the "paths" of the JSON body, answering 502 Bad Gateway if any of them failed. Admin only.
+//
+// Changed files are purged automatically; this is for copies that went stale otherwise, such
+// as after the cache policy changed.
+func (h *Handlers) PurgeCacheHandler(w http.ResponseWriter, r *http.Request) {
+	defer cleanupRequest(r)
+
+	var req struct {
+		Paths []string `json:"paths"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxPurgeBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return
+	}
+	if len(req.Paths) == 0 || len(req.Paths) > maxPurgePaths {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid paths", "list between 1 and 1000 paths")
+		return
+	}
+	names := make([]string, 0, len(req.Paths))
+	for _, p := range req.Paths {
+		name, err := cleanStoragePath(p)
+		if err != nil {
+			h.render.Error(w, r, http.StatusBadRequest, "invalid path", err.Error())
+			return
+		}
+		names = append(names, name)
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), purgeTimeout)
+	defer cancel()
+	resp := purgeResult{URLs: h.purger.URLs(names), Results: h.purger.Purge(ctx, names)}
+	status := http.StatusOK
+	for _, res := range resp.Results {
+		if res.Error != "" {
+			h.logger.Printf("error purging %d files from %s: %s\n", len(names), res.Provider, res.Error)
+			status = http.StatusBadGateway
+		}
+	}
+	h.logger.Printf("%s asked the CDN to purge %d files\n", principalName(principalFrom(r)), len(names))
+	h.render.JSON(w, status, resp)
+}
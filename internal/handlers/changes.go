@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/filemeta"
+)
+
+// maxChangesPage is the most changes answered at once, and the default.
+const maxChangesPage = 1000
+
+// consumerName matches the names change feed consumers may give themselves.
+var consumerName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// changesPage is the answer of the change feed.
+type changesPage struct {
+	Changes []filemeta.Change `json:"changes"`
+	// Cursor is passed back to read on from the last change of the page.
+	Cursor string `json:"cursor"`
+	// More reports that further changes can be read straight away.
+	More bool `json:"more"`
+}
+
+// ChangesHandler returns the changes to stored files made after the one in the "cursor"
+// query parameter, oldest first: files created, modified, deleted or moved. Without a
+// cursor, it starts at the oldest change kept; "latest" skips to the end, for a client that
+// has just listed every file. A cursor too old to resume from is answered with 410 Gone,
+// after which the client has to list the files again.
+//
+// Why a feed rather than comparing listings? A sync client or a cache then learns what
+// changed since it last looked at the cost of the changes alone, however many files there are.
+//
+// A client that names itself in the "consumer" query parameter has its position kept by the
+// server, per user: the cursor it sends is recorded as the point up to which it has processed
+// the changes, and without a cursor it resumes from the last one recorded. It may then crash
+// at any point without missing a change.
+func (h *Handlers) ChangesHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	consumer := q.Get("consumer")
+	if consumer != "" && !consumerName.MatchString(consumer) {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid consumer", "use up to 64 letters, digits, dots, dashes and underscores")
+		return
+	}
+	consumerKey := principalName(principalFrom(r)) + "/" + consumer
+	v := q.Get("cursor")
+	if consumer != "" && v == "" {
+		saved, ok, err := h.cursors.Get(r.Context(), consumerKey)
+		if err != nil {
+			h.logger.Printf("error reading the position of consumer '%s': %v\n", consumerKey, err)
+			h.render.Error(w, r, http.StatusServiceUnavailable, "unable to read consumer position")
+			return
+		}
+		if ok {
+			v = saved
+		}
+	}
+	cursor := int64(-1)
+	switch v {
+	case "":
+	case "latest":
+		cursor = h.fileMeta.LatestChange()
+	default:
+		c, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || c < 0 {
+			h.render.Error(w, r, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		cursor = c
+	}
+	if consumer != "" && q.Get("cursor") != "" {
+		if err := h.cursors.Put(r.Context(), consumerKey, strconv.FormatInt(cursor, 10)); err != nil {
+			// The consumer reads on all the same; it would only see these changes again.
+			h.logger.Printf("error recording the position of consumer '%s': %v\n", consumerKey, err)
+		}
+	}
+	limit := maxChangesPage
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			h.render.Error(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, maxChangesPage)
+	}
+
+	changes, next, ok := h.fileMeta.Changes(cursor, limit)
+	if !ok {
+		h.render.Error(w, r, http.StatusGone, "cursor has expired", "list the files again and continue from cursor=latest")
+		return
+	}
+	// Changes to files the caller may not read are left out, so protected names do not leak.
+	// A move between a readable and an unreadable path shows as the half the caller can see.
+	principal := principalFrom(r)
+	visible := func(name string) bool {
+		return name != "" && !h.hidden.hidden(name) && h.acl.Allowed(principal, acl.Read, name)
+	}
+	page := changesPage{Changes: make([]filemeta.Change, 0, len(changes)), Cursor: strconv.FormatInt(next, 10)}
+	for _, c := range changes {
+		if c.Type == filemeta.Moved {
+			switch to, from := visible(c.Path), visible(c.From); {
+			case to && !from:
+				c.Type, c.From = filemeta.Created, ""
+			case from && !to:
+				c.Type, c.Path, c.From = filemeta.Deleted, c.From, ""
+			}
+		}
+		if visible(c.Path) {
+			page.Changes = append(page.Changes, c)
+		}
+	}
+	page.More = next < h.fileMeta.LatestChange()
+	w.Header().Set("Cache-Control", "no-store")
+	h.render.JSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/coord"
+)
+
+// getChanges reads the change feed with the given query as user, or as an admin for "".
+func getChanges(t *testing.T, h *Handlers, query, user string) (*httptest.ResponseRecorder, changesPage) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/changes"+query, nil)
+	if user == "" {
+		r = asAdmin(r)
+	} else {
+		r = r.WithContext(auth.NewContext(r.Context(), &auth.Principal{Username: user}))
+	}
+	w := httptest.NewRecorder()
+	h.ChangesHandler(w, r)
+	var page changesPage
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, page
+}
+
+// describe returns the type and path of each change, as "type path" or "type from>path".
+func describe(page changesPage) []string {
+	var list []string
+	for _, c := range page.Changes {
+		s := c.Type + " "
+		if c.From != "" {
+			s += c.From + ">"
+		}
+		list = append(list, s+c.Path)
+	}
+	return list
+}
+
+func TestChangesHandler(t *testing.T) {
+	root := openTestTree(t)
+	h := newTestHandlers(t, root, nil)
+	h.acl = acl.New([]config.ACLRule{{Path: "/private", Read: []string{"role:admin"}, Write: []string{"role:admin"}}})
+	upload(t, h, "/upload", formPart{"file", "a.txt", "a"}, formPart{"file", "private/plans.txt", "plans"})
+	for _, op := range []batchOperation{
+		{Op: "move", Path: "private/plans.txt", To: "plans.txt"},
+		{Op: "move", Path: "a.txt", To: "private/a.txt"},
+	} {
+		ops, _ := json.Marshal(map[string]any{"operations": []batchOperation{op}})
+		w := httptest.NewRecorder()
+		h.BatchHandler(w, asAdmin(httptest.NewRequest(http.MethodPost, "/api/batch", bytes.NewReader(ops))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+		}
+	}
+
+	tests := []struct {
+		desc       string
+		query      string
+		user       string
+		wantStatus int
+		want       []string
+		wantCursor string
+		wantMore   bool
+	}{
+		{"the whole feed", "", "", http.StatusOK,
+			[]string{"create a.txt", "create private/plans.txt", "move private/plans.txt>plans.txt", "move a.txt>private/a.txt"}, "4", false},
+		{"a page", "?cursor=1&limit=2", "", http.StatusOK,
+			[]string{"create private/plans.txt", "move private/plans.txt>plans.txt"}, "3", true},
+		// Moves in and out of a directory the caller cannot read show as the half it can see.
+		{"the feed without the private directory", "", "alice", http.StatusOK,
+			[]string{"create a.txt", "create plans.txt", "delete a.txt"}, "4", false},
+		{"from the latest change", "?cursor=latest", "", http.StatusOK, nil, "4", false},
+		{"a cursor beyond the end", "?cursor=9", "", http.StatusGone, nil, "", false},
+		{"a malformed cursor", "?cursor=soon", "", http.StatusBadRequest, nil, "", false},
+		{"a negative cursor", "?cursor=-1", "", http.StatusBadRequest, nil, "", false},
+		{"a malformed limit", "?limit=0", "", http.StatusBadRequest, nil, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w, page := getChanges(t, h, tt.query, tt.user)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := describe(page); !slices.Equal(got, tt.want) || page.Cursor != tt.wantCursor || page.More != tt.wantMore {
+				t.Errorf("got %v up to %s, more %v, want %v up to %s, more %v", got, page.Cursor, page.More, tt.want, tt.wantCursor, tt.wantMore)
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("got Cache-Control %q, want no-store", got)
+			}
+		})
+	}
+}
+
+// downBackend is a coordination service that cannot be reached.
+type downBackend struct {
+	coord.Backend
+}
+
+func (downBackend) Get(ctx context.Context, key string) (string, bool, error) {
+	return "", false, errors.New("connection refused")
+}
+
+// TestChangesConsumer checks that a named consumer resumes from the last cursor it sent,
+// and that each user's consumers are kept apart.
+func TestChangesConsumer(t *testing.T) {
+	root := openTestTree(t)
+	h := newTestHandlers(t, root, nil)
+	cursors, err := coord.OpenCursors(nil, filepath.Join(t.TempDir(), "cursors.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.cursors = cursors
+	upload(t, h, "/upload", formPart{"file", "a.txt", "a"}, formPart{"file", "b.txt", "b"})
+
+	tests := []struct {
+		desc       string
+		query      string
+		user       string
+		wantStatus int
+		want       []string
+	}{
+		{"a new consumer", "?consumer=sync&limit=1", "", http.StatusOK, []string{"create a.txt"}},
+		{"the first change processed", "?consumer=sync&cursor=1", "", http.StatusOK, []string{"create b.txt"}},
+		// The second change was read, but its processing was not confirmed.
+		{"resuming", "?consumer=sync", "", http.StatusOK, []string{"create b.txt"}},
+		{"another user's consumer of the same name", "?consumer=sync", "alice", http.StatusOK, []string{"create a.txt", "create b.txt"}},
+		{"another consumer", "?consumer=backup", "", http.StatusOK, []string{"create a.txt", "create b.txt"}},
+		{"every change processed", "?consumer=sync&cursor=2", "", http.StatusOK, nil},
+		{"resuming once up to date", "?consumer=sync", "", http.StatusOK, nil},
+		{"a consumer name with a slash", "?consumer=sync/2", "", http.StatusBadRequest, nil},
+		{"too long a consumer name", "?consumer=" + strings.Repeat("s", 65), "", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w, page := getChanges(t, h, tt.query, tt.user)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if got := describe(page); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// Without its position, a consumer would read the whole feed again.
+	h.cursors, err = coord.OpenCursors(downBackend{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := getChanges(t, h, "?consumer=sync", ""); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d %s, want %d", w.Code, w.Body, http.StatusServiceUnavailable)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package handlers
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// cloneFile makes dst share the data of src by reflink (FICLONE), which Btrfs and XFS
+// support: the copy is instant and takes no space until either file is changed. Files that
+// are not on disk are copied.
+func cloneFile(dst, src storage.File) error {
+	out, ok := dst.(*os.File)
+	in, ok2 := src.(*os.File)
+	if !ok || !ok2 {
+		return errors.ErrUnsupported
+	}
+	return unix.IoctlFileClone(int(out.Fd()), int(in.Fd()))
+}
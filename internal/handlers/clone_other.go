@@ -0,0 +1,14 @@
+//go:build !linux
+
+package handlers
+
+import (
+	"errors"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// cloneFile is only implemented on Linux; elsewhere the data is copied.
+func cloneFile(dst, src storage.File) error {
+	return errors.ErrUnsupported
+}
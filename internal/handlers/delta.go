@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/delta"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// fileSignatures is the answer of SignaturesHandler.
+type fileSignatures struct {
+	Name      string        `json:"name"`
+	Size      int64         `json:"size"`
+	ETag      string        `json:"etag"`
+	BlockSize int           `json:"blockSize"`
+	Blocks    []delta.Block `json:"blocks"`
+}
+
+// SignaturesHandler returns the block signatures of the file named in the request path, the
+// first step of a delta upload: the client finds the blocks it shares with its newer copy,
+// and sends DeltaHandler only the data in between. The "blockSize" query parameter sets the
+// size of the blocks; by default it is about the square root of the file's size.
+func (h *Handlers) SignaturesHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if h.hiddenFile(w, r, name) {
+		return
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Read, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	blockSize, ok := deltaBlockSize(r)
+	if !ok {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid blockSize")
+		return
+	}
+
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			h.render.Error(w, r, http.StatusNotFound, "file is not found")
+			return
+		}
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	file, stat, ok := h.openBasis(w, r, root, name, false)
+	if !ok {
+		return
+	}
+	defer file.Close()
+	if blockSize == 0 {
+		blockSize = delta.BlockSize(stat.Size())
+	}
+	blocks, err := delta.Signature(newContextReader(r.Context(), file), blockSize)
+	if err != nil {
+		if r.Context().Err() == nil {
+			h.logger.Printf("error reading file '%s': %v\n", name, err)
+			h.render.Error(w, r, http.StatusInternalServerError, "unable to read file")
+		}
+		return
+	}
+	if blocks == nil {
+		blocks = []delta.Block{}
+	}
+	etag := fileETag(stat.ModTime(), stat.Size())
+	w.Header().Set("ETag", etag)
+	h.render.JSON(w, http.StatusOK, fileSignatures{Name: name, Size: stat.Size(), ETag: etag, BlockSize: blockSize, Blocks: blocks})
+}
+
+// DeltaHandler replaces the file named in the request path with the file reconstructed from
+// the delta in the request body, the second step of a delta upload (see the delta package for
+// its format). The request must carry If-Match with the ETag the signatures were made for,
+// and the same "blockSize". A Repr-Digest header with the SHA-256 checksum of the new file
+// has it verified once reconstructed.
+//
+// Why is the file reconstructed elsewhere first? It goes through the same checks as an
+// upload before it replaces the stored file, and a delta that turns out to be malformed must
+// leave the stored file as it was.
+func (h *Handlers) DeltaHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	oversized := false
+	defer func() {
+		if oversized {
+			r.Body.Close()
+			return
+		}
+		cleanupRequest(r)
+	}()
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	principal := principalFrom(r)
+	if !h.acl.Allowed(principal, acl.Write, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	if err := h.hidden.checkWrite(name); err != nil {
+		h.render.Error(w, r, http.StatusUnprocessableEntity, "file is refused", err.Error())
+		return
+	}
+	conditions := uploadConditionsFrom(r)
+	if conditions.ifMatch == "" {
+		h.render.Error(w, r, http.StatusPreconditionRequired, "If-Match is required", "send the ETag the signatures were made for")
+		return
+	}
+	blockSize, ok := deltaBlockSize(r)
+	if !ok || blockSize == 0 {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid blockSize", "send the blockSize the signatures were made with")
+		return
+	}
+
+	limit := h.uploadLimit(w, r)
+	if limit.exceeds(r.ContentLength) {
+		oversized = true
+		h.rejectOverLimit(w, r, limit)
+		return
+	}
+	defer h.meterUpload(w, r, &limit)()
+	h.withStallTimeout(w, r)
+
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			h.render.Error(w, r, http.StatusNotFound, "file is not found")
+			return
+		}
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	if err := conditions.check(root, name); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			h.render.Error(w, r, http.StatusPreconditionFailed, "file has changed since its signatures were made")
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	if err := h.checkProtected(root, principal, name, "overwrite"); err != nil {
+		if errors.Is(err, errHeld) || errors.Is(err, errRetained) {
+			h.render.Error(w, r, protectedStatus(err), "protected files cannot be changed", err.Error())
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	basis, stat, ok := h.openBasis(w, r, root, name, true)
+	if !ok {
+		return
+	}
+	defer basis.Close()
+
+	tmp, err := os.CreateTemp("", "delta-*")
+	if err != nil {
+		h.logger.Printf("error creating temporary file: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	maxSize := h.uploader.GetMaxUploadSize()
+	n, err := delta.Apply(tmp, newContextReader(r.Context(), r.Body), basis, stat.Size(), blockSize, maxSize)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+	case r.Context().Err() != nil:
+		h.logger.Printf("client %s disconnected whilst sending a delta for '%s'\n", r.RemoteAddr, name)
+		return
+	case errors.As(err, &tooLarge):
+		oversized = true
+		h.rejectOverLimit(w, r, limit)
+		return
+	case errors.Is(err, delta.ErrTooLarge):
+		h.logger.Printf("file reconstructed from a delta from %s exceeds the limit of %d bytes\n", r.RemoteAddr, maxSize)
+		h.render.TooLarge(w, r, "reconstructed file exceeds the maximum upload size", maxSize)
+		return
+	case errors.Is(err, delta.ErrMalformed):
+		h.render.Error(w, r, http.StatusBadRequest, "malformed delta", err.Error())
+		return
+	default:
+		h.logger.Printf("error applying delta to '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to apply delta")
+		return
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		h.logger.Printf("error rewinding reconstructed file: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	// The digest is of the reconstructed file, not of the delta the body holds.
+	fh := &multipart.FileHeader{Filename: name, Header: make(textproto.MIMEHeader), Size: n}
+	if digest := r.Header.Get("Repr-Digest"); digest != "" {
+		fh.Header.Set("Repr-Digest", digest)
+	}
+	if fail := h.checkUpload("from "+r.RemoteAddr, principalName(principal), name, fh, tmp); fail != nil {
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		h.logger.Printf("error rewinding reconstructed file: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if _, fail := h.storeUpload(root, name, tmp, false, principalName(principal), n); fail != nil {
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+
+	stat, err = root.Stat(name)
+	if err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	h.logger.Printf("reconstructed %d bytes of '%s' from a delta for %s\n", n, name, r.RemoteAddr)
+	h.renderStored(w, name, stat, false)
+}
+
+// openBasis opens the stored file name that a delta refers to. It answers the request
+// itself, and reports false, if the file cannot be opened or is not a regular file.
+func (h *Handlers) openBasis(w http.ResponseWriter, r *http.Request, root storage.Root, name string, write bool) (storage.File, fs.FileInfo, bool) {
+	// Reading through a link is for openStored to decide; replacing one is refused.
+	if write {
+		if err := h.checkSymlinks(root, name, true); err != nil {
+			h.render.Error(w, r, http.StatusForbidden, "unable to open file", err.Error())
+			return nil, nil, false
+		}
+	}
+	file, err := h.openStored(root, name)
+	if err != nil {
+		status := openErrorStatus(err)
+		if status == http.StatusNotFound {
+			h.render.Error(w, r, status, "file is not found")
+		} else {
+			h.logger.Printf("error opening file '%s': %v\n", name, err)
+			h.render.Error(w, r, status, "unable to open file")
+		}
+		return nil, nil, false
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return nil, nil, false
+	}
+	if !stat.Mode().IsRegular() {
+		file.Close()
+		h.render.Error(w, r, http.StatusForbidden, "requested path is a directory")
+		return nil, nil, false
+	}
+	return file, stat, true
+}
+
+// deltaBlockSize returns the "blockSize" query parameter of r, or 0 if there is none. It
+// reports false if the block size is out of bounds.
+func deltaBlockSize(r *http.Request) (int, bool) {
+	v := r.URL.Query().Get("blockSize")
+	if v == "" {
+		return 0, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < delta.MinBlockSize || n > delta.MaxBlockSize {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/delta"
+)
+
+// copyBlocks returns the delta instruction copying count blocks from first.
+func copyBlocks(first uint64, count uint32) []byte {
+	d := binary.BigEndian.AppendUint64([]byte{delta.OpCopy}, first)
+	return binary.BigEndian.AppendUint32(d, count)
+}
+
+// literal returns the delta instruction adding data.
+func literal(data string) []byte {
+	return append(binary.BigEndian.AppendUint32([]byte{delta.OpData}, uint32(len(data))), data...)
+}
+
+func TestDelta(t *testing.T) {
+	root := openTestTree(t)
+	h := newTestHandlers(t, root, nil)
+	basis := bytes.Repeat([]byte("0123456789abcdef"), 512) // 8 blocks of 1 KB
+	if err := root.WriteFile("vm.img", basis, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/api/signatures/vm.img?blockSize=1024", nil)
+	r.SetPathValue("name", "vm.img")
+	w := httptest.NewRecorder()
+	h.SignaturesHandler(w, asAdmin(r))
+	var sigs fileSignatures
+	if err := json.Unmarshal(w.Body.Bytes(), &sigs); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if sigs.Size != int64(len(basis)) || sigs.BlockSize != 1024 || len(sigs.Blocks) != 8 || sigs.ETag != w.Header().Get("ETag") {
+		t.Fatalf("got signatures %+v", sigs)
+	}
+
+	newer := append(append(append([]byte(nil), basis[:4096]...), "inserted"...), basis[4096:]...)
+	d := append(append(copyBlocks(0, 4), literal("inserted")...), copyBlocks(4, 4)...)
+	sum := sha256.Sum256(newer)
+	digest := "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+	wrong := "sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, 32)) + ":"
+
+	tests := []struct {
+		desc       string
+		query      string
+		ifMatch    string
+		digest     string
+		body       []byte
+		wantStatus int
+	}{
+		{"no If-Match", "?blockSize=1024", "", digest, d, http.StatusPreconditionRequired},
+		{"no block size", "", sigs.ETag, digest, d, http.StatusBadRequest},
+		{"too small a block size", "?blockSize=512", sigs.ETag, digest, d, http.StatusBadRequest},
+		{"a malformed delta", "?blockSize=1024", sigs.ETag, "", copyBlocks(7, 2), http.StatusBadRequest},
+		{"a wrong digest", "?blockSize=1024", sigs.ETag, wrong, d, http.StatusUnprocessableEntity},
+		{"a delta", "?blockSize=1024", sigs.ETag, digest, d, http.StatusOK},
+		// The file has changed since the signatures were made.
+		{"the delta again", "?blockSize=1024", sigs.ETag, digest, d, http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPut, "/api/delta/vm.img"+tt.query, bytes.NewReader(tt.body))
+			r.SetPathValue("name", "vm.img")
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			if tt.digest != "" {
+				r.Header.Set("Repr-Digest", tt.digest)
+			}
+			w := httptest.NewRecorder()
+			h.DeltaHandler(w, asAdmin(r))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			want := basis
+			if tt.wantStatus == http.StatusOK || tt.wantStatus == http.StatusPreconditionFailed {
+				want = newer
+			}
+			if b, err := root.ReadFile("vm.img"); err != nil || !bytes.Equal(b, want) {
+				t.Errorf("the file holds %d bytes, %v, want %d", len(b), err, len(want))
+			}
+			if w.Code == http.StatusOK && w.Header().Get("ETag") == sigs.ETag {
+				t.Error("the ETag did not change")
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// errDirQuota is reported for changes that would take a directory over its quota.
+var errDirQuota = errors.New("directory quota exceeded")
+
+// dirQuotas caps the total size of the files below certain directories.
+//
+// Why count from the file metadata rather than the disk? The metadata already holds the size
+// of every stored file, so the usage of a directory is a sum in memory, where walking a large
+// directory on every upload would not be.
+type dirQuotas struct {
+	dirs []config.DirQuotaConfig
+}
+
+// newDirQuotas normalises the configured directories.
+func newDirQuotas(cfg []config.DirQuotaConfig) *dirQuotas {
+	dq := &dirQuotas{dirs: make([]config.DirQuotaConfig, 0, len(cfg))}
+	for _, q := range cfg {
+		q.Path = path.Clean("/" + q.Path)
+		dq.dirs = append(dq.dirs, q)
+	}
+	return dq
+}
+
+// dirQuotaUsage describes a directory quota in the answers of the API.
+type dirQuotaUsage struct {
+	Path  string `json:"path"`
+	Limit int64  `json:"limit"`
+	Used  int64  `json:"used"`
+	Free  int64  `json:"free"`
+}
+
+// checkDirQuotas returns an error wrapping errDirQuota if storing size bytes at name would
+// take a directory over its quota. The file already at name, which is replaced, does not
+// count. from is the name of a file being moved to name, or "": moving a file within a
+// directory does not change its usage.
+//
+// The quota is checked rather than reserved, so uploads running at once may together go
+// over it by as much as they hold; the next upload is refused then.
+func (h *Handlers) checkDirQuotas(name string, size int64, from string) error {
+	name = path.Clean("/" + name)
+	for _, q := range h.dirQuotas.dirs {
+		if !withinDir(name, q.Path) || from != "" && withinDir(path.Clean("/"+from), q.Path) {
+			continue
+		}
+		free := q.GetMaxSize() - h.fileMeta.Usage(q.Path)
+		if size-h.fileMeta.Usage(name) > free {
+			return fmt.Errorf("%w: '%s' has %d of its %d bytes free", errDirQuota, q.Path, max(free, 0), q.GetMaxSize())
+		}
+	}
+	return nil
+}
+
+// withinDir reports whether the slash-rooted name is dir or lies below it.
+func withinDir(name, dir string) bool {
+	return dir == "/" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// dirQuotaUsage returns the standing of every directory with a quota.
+func (h *Handlers) dirQuotaUsage() []dirQuotaUsage {
+	usage := make([]dirQuotaUsage, 0, len(h.dirQuotas.dirs))
+	for _, q := range h.dirQuotas.dirs {
+		used := h.fileMeta.Usage(q.Path)
+		usage = append(usage, dirQuotaUsage{
+			Path:  q.Path,
+			Limit: q.GetMaxSize(),
+			Used:  used,
+			Free:  max(q.GetMaxSize()-used, 0),
+		})
+	}
+	return usage
+}
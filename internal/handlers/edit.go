@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"unicode/utf8"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+)
+
+// memoryFile is file content held in memory, which validation can read like an uploaded part.
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error { return nil }
+
+// PutFileHandler replaces a small text file with the request body, for quick edits without
+// downloading and uploading the file. The request must be conditional: If-Match with the ETag
+// the client last saw, or "If-None-Match: *" to create a new file.
+//
+// Why insist on a condition? An editor holds a file for minutes whilst its user types, and
+// saving over a version someone else wrote in the meantime would silently discard their work.
+// A client that lost the race gets 412, and can reload the file and reapply its changes.
+func (h *Handlers) PutFileHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	oversized := false
+	defer func() {
+		if oversized {
+			r.Body.Close()
+			return
+		}
+		cleanupRequest(r)
+	}()
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	principal := principalFrom(r)
+	if !h.acl.Allowed(principal, acl.Write, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	conditions := uploadConditionsFrom(r)
+	if conditions.ifMatch == "" && !conditions.createOnly() {
+		h.render.Error(w, r, http.StatusPreconditionRequired, "If-Match or If-None-Match: * is required")
+		return
+	}
+
+	var content []byte
+	var ok bool
+	if content, oversized, ok = h.readBody(w, r, h.editor.GetMaxSize()); !ok {
+		return
+	}
+	// Why only text? The editor is for configuration files and notes; anything else is better
+	// replaced by an upload, which handles files of any size.
+	if !isText(content) {
+		h.render.Error(w, r, http.StatusUnsupportedMediaType, "content must be UTF-8 text")
+		return
+	}
+
+	if err := h.makeStorageDir(); err != nil {
+		h.logger.Printf("error creating file directory: %v\n", err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to prepare storage directory")
+		return
+	}
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	if err := conditions.check(root, name); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			h.render.Error(w, r, http.StatusPreconditionFailed, "file has changed since it was loaded")
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	if err := h.checkProtected(root, principal, name, "overwrite"); err != nil {
+		if errors.Is(err, errHeld) || errors.Is(err, errRetained) {
+			h.render.Error(w, r, protectedStatus(err), "protected files cannot be changed", err.Error())
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	_, statErr := root.Stat(name)
+	created := errors.Is(statErr, fs.ErrNotExist)
+
+	// Saved files pass the same checks as uploaded ones, so editing cannot smuggle in what an
+	// upload would be refused for.
+	fh := &multipart.FileHeader{Filename: name, Size: int64(len(content))}
+	if fail := h.checkUpload("from "+r.RemoteAddr, principalName(principal), name, fh, memoryFile{bytes.NewReader(content)}); fail != nil {
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+	if _, fail := h.storeUpload(root, name, bytes.NewReader(content), conditions.createOnly(), principalName(principal), int64(len(content))); fail != nil {
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+
+	stat, err := root.Stat(name)
+	if err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	h.logger.Printf("saved %d bytes to '%s' for %s\n", len(content), name, r.RemoteAddr)
+	h.renderStored(w, name, stat, created)
+}
+
+// readBody reads a request body of at most maxSize bytes, within the client's upload limit,
+// into memory. It answers the request itself, and reports false, if the body cannot be read;
+// oversized reports that it was refused for its size and has been left unread.
+func (h *Handlers) readBody(w http.ResponseWriter, r *http.Request, maxSize int64) (content []byte, oversized, ok bool) {
+	if r.ContentLength > maxSize {
+		h.rejectTooLarge(w, r, maxSize)
+		return nil, true, false
+	}
+	limit := h.uploadLimit(w, r)
+	if limit.exceeds(r.ContentLength) {
+		h.rejectOverLimit(w, r, limit)
+		return nil, true, false
+	}
+	defer h.meterUpload(w, r, &limit)()
+
+	content, err := io.ReadAll(io.LimitReader(newContextReader(r.Context(), r.Body), maxSize+1))
+	if err != nil {
+		if r.Context().Err() != nil {
+			h.logger.Printf("client %s disconnected during write to %s\n", r.RemoteAddr, r.URL.Path)
+			return nil, false, false
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			h.rejectOverLimit(w, r, limit)
+			return nil, true, false
+		}
+		h.logger.Printf("error reading request body: %v\n", err)
+		h.render.Error(w, r, http.StatusBadRequest, "unable to read request body")
+		return nil, false, false
+	}
+	if int64(len(content)) > maxSize {
+		h.rejectTooLarge(w, r, maxSize)
+		return nil, true, false
+	}
+	return content, false, true
+}
+
+// isText reports whether content is UTF-8 text, without the NUL bytes of binary formats.
+func isText(content []byte) bool {
+	return utf8.Valid(content) && bytes.IndexByte(content, 0) < 0
+}
+
+// renderStored answers a request that stored the file name, now described by stat, with its
+// details and ETag: 201 Created if the file is new, or 200 OK if it replaced another.
+func (h *Handlers) renderStored(w http.ResponseWriter, name string, stat fs.FileInfo, created bool) {
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+	etag := fileETag(stat.ModTime(), stat.Size())
+	w.Header().Set("ETag", etag)
+	info := fileInfo{
+		ID:       h.fileMeta.ID(name),
+		Name:     name,
+		Type:     "file",
+		Size:     stat.Size(),
+		Modified: stat.ModTime().UTC(),
+		ETag:     etag,
+		Links: fileLinks{
+			Self:     h.basePath + "/api/files/" + escapePath(name),
+			Download: h.basePath + "/download/" + escapePath(name),
+		},
+	}
+	if info.ID != "" {
+		info.Links.Permanent = h.basePath + "/api/files/by-id/" + info.ID + "/download"
+	}
+	h.render.JSON(w, status, info)
+}
+
+// editorPage edits a text file in the browser. html/template escapes every value for where
+// it appears, the URLs in the script included.
+var editorPage = template.Must(template.New("editor").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>
+html, body { height: 100%; }
+body { display: flex; flex-direction: column; margin: 0; font-family: system-ui, sans-serif; }
+header { display: flex; gap: 1rem; align-items: baseline; padding: .5rem 1rem; background: #323639; color: #eee; }
+header strong { overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+header a { color: #8ab4f8; }
+header button { margin-left: auto; }
+textarea { flex: 1; margin: 0; padding: .75rem 1rem; border: 0; resize: none; font: 14px/1.4 ui-monospace, monospace; tab-size: 4; }
+</style>
+</head>
+<body>
+<header><strong>{{.Name}}</strong><span id="status">Loading…</span><a href="{{.Download}}">Download</a><button id="save" disabled>Save</button></header>
+<textarea id="content" spellcheck="false" disabled></textarea>
+<script nonce="{{.Nonce}}">
+const status = document.getElementById("status");
+const content = document.getElementById("content");
+const save = document.getElementById("save");
+const maxSize = {{.MaxSize}};
+// etag is the version of the file the text was loaded from; saving sends it back in
+// If-Match, so that a version someone else saved in the meantime is never overwritten.
+// A file that does not exist yet is created with If-None-Match: * instead.
+let etag = null;
+let saved = "";
+
+async function load() {
+	const resp = await fetch({{.Download}}, {cache: "no-store"});
+	if (resp.status === 404) {
+		status.textContent = "New file";
+	} else if (!resp.ok) {
+		throw new Error(resp.status + " " + resp.statusText);
+	} else if (Number(resp.headers.get("Content-Length")) > maxSize) {
+		throw new Error("the file is too large to edit here");
+	} else {
+		etag = resp.headers.get("ETag");
+		saved = await resp.text();
+		status.textContent = "";
+	}
+	content.value = saved;
+	content.disabled = false;
+	save.disabled = false;
+}
+
+async function store() {
+	save.disabled = true;
+	status.textContent = "Saving…";
+	const text = content.value;
+	const headers = {"Content-Type": "text/plain; charset=utf-8"};
+	if (etag === null) {
+		headers["If-None-Match"] = "*";
+	} else {
+		headers["If-Match"] = etag;
+	}
+	try {
+		const resp = await fetch({{.Save}}, {method: "PUT", headers: headers, body: text});
+		if (resp.status === 412) {
+			status.textContent = "The file has changed since it was loaded: copy your changes, then reload the page.";
+			return;
+		}
+		if (!resp.ok) {
+			const body = await resp.json().catch(() => ({}));
+			status.textContent = "Not saved: " + (body.error || resp.statusText);
+			return;
+		}
+		etag = resp.headers.get("ETag");
+		saved = text;
+		status.textContent = "Saved";
+	} catch (err) {
+		status.textContent = "Not saved: " + err.message;
+	} finally {
+		save.disabled = false;
+	}
+}
+
+save.addEventListener("click", store);
+document.addEventListener("keydown", e => {
+	if ((e.ctrlKey || e.metaKey) && e.key === "s") {
+		e.preventDefault();
+		if (!save.disabled) {
+			store();
+		}
+	}
+});
+window.addEventListener("beforeunload", e => {
+	if (content.value !== saved) {
+		e.preventDefault();
+	}
+});
+load().catch(err => {
+	status.textContent = "The file cannot be edited: " + err.message;
+});
+</script>
+</body>
+</html>
+`))
+
+// EditHandler serves a page that edits a small text file in the browser. The page loads the
+// file from /download/ and saves it with PutFileHandler, with the caller's own credentials,
+// so the same permissions, ACL rules and checks apply as to any other client.
+//
+// Why a nonce? As on the reader page, the page's own script is inline, and the security
+// headers allow no scripts at all; the nonce lets that one script run, and nothing injected
+// besides.
+func (h *Handlers) EditHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if h.hiddenFile(w, r, name) {
+		return
+	}
+	principal := principalFrom(r)
+	if !h.acl.Allowed(principal, acl.Read, name) || !h.acl.Allowed(principal, acl.Write, name) {
+		h.denyAccess(w, r)
+		return
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	nonce := base64.RawURLEncoding.EncodeToString(buf)
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'nonce-"+nonce+"'; connect-src 'self'; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err = editorPage.Execute(w, struct {
+		Name, Download, Save, Nonce string
+		MaxSize                     int64
+	}{
+		Name:     path.Base(name),
+		Download: h.basePath + "/download/" + escapePath(name),
+		Save:     h.basePath + "/api/files/" + escapePath(name),
+		Nonce:    nonce,
+		MaxSize:  h.editor.GetMaxSize(),
+	})
+	if err != nil {
+		h.logger.Printf("error writing editor page: %v\n", err)
+	}
+}
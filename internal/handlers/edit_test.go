@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestEditHandler(t *testing.T) {
+	h := newTestHandlers(t, openTestTree(t), nil)
+	h.acl = acl.New([]config.ACLRule{{Path: "/private", Read: []string{"*"}, Write: []string{"user:boss"}}})
+	h.basePath = "/files"
+	nonce := regexp.MustCompile(`<script nonce="([^"]+)">`)
+
+	tests := []struct {
+		desc   string
+		name   string
+		status int
+	}{
+		{"a text file", "conf/app <test>.ini", http.StatusOK},
+		{"a hidden file", ".env", http.StatusNotFound},
+		{"a file the caller cannot write", "private/app.ini", http.StatusUnauthorized},
+		{"no file", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/files/edit/x", nil)
+			r.SetPathValue("name", tt.name)
+			w := httptest.NewRecorder()
+			h.EditHandler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			page := w.Body.String()
+			m := nonce.FindStringSubmatch(page)
+			if m == nil {
+				t.Fatal("the page has no script with a nonce")
+			}
+			csp := w.Header().Get("Content-Security-Policy")
+			if !strings.Contains(csp, "script-src 'nonce-"+m[1]+"';") || !strings.Contains(csp, "connect-src 'self';") {
+				t.Errorf("Content-Security-Policy %q does not allow the page's script and requests", csp)
+			}
+			for _, want := range []string{
+				`fetch("/files/download/conf/app%20%3Ctest%3E.ini", {cache`,
+				`fetch("/files/api/files/conf/app%20%3Ctest%3E.ini", {method: "PUT"`,
+				`headers["If-Match"] = etag;`,
+				`<title>app &lt;test&gt;.ini</title>`,
+			} {
+				if !strings.Contains(page, want) {
+					t.Errorf("the page does not contain %s", want)
+				}
+			}
+		})
+	}
+}
+
+// TestPutFileHandler saves a file as the edit page does: with the ETag it was loaded with,
+// which stops being accepted once the file has been saved again.
+func TestPutFileHandler(t *testing.T) {
+	root := openTestTree(t, "conf/app.ini")
+	h := newTestHandlers(t, root, nil)
+	put := func(name, content string, header ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPut, "/api/files/"+name, strings.NewReader(content))
+		r.SetPathValue("name", name)
+		for i := 0; i < len(header); i += 2 {
+			r.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		h.PutFileHandler(w, r)
+		return w
+	}
+	info, err := root.Stat("conf/app.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := fileETag(info.ModTime(), info.Size())
+
+	w := put("conf/app.ini", "port = 8090\n", "If-Match", loaded)
+	if w.Code != http.StatusOK {
+		t.Fatalf("save with the current ETag got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	saved := w.Header().Get("ETag")
+	if saved == "" || saved == loaded {
+		t.Errorf("save answered with ETag %q, want a new one", saved)
+	}
+	if got, err := root.ReadFile("conf/app.ini"); err != nil || string(got) != "port = 8090\n" {
+		t.Errorf("file holds %q, %v after saving", got, err)
+	}
+
+	tests := []struct {
+		desc    string
+		name    string
+		content string
+		header  []string
+		status  int
+	}{
+		{"the ETag of a version since replaced", "conf/app.ini", "port = 8091\n", []string{"If-Match", loaded}, http.StatusPreconditionFailed},
+		{"no condition", "conf/app.ini", "port = 8091\n", nil, http.StatusPreconditionRequired},
+		{"creating a file that exists", "conf/app.ini", "port = 8091\n", []string{"If-None-Match", "*"}, http.StatusPreconditionFailed},
+		{"content that is not text", "conf/app.ini", "port\x00= 8091\n", []string{"If-Match", saved}, http.StatusUnsupportedMediaType},
+		{"creating a new file", "conf/new.ini", "port = 8092\n", []string{"If-None-Match", "*"}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if w := put(tt.name, tt.content, tt.header...); w.Code != tt.status {
+				t.Errorf("got status %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+		})
+	}
+	// No refused save changed the file.
+	if got, err := root.ReadFile("conf/app.ini"); err != nil || string(got) != "port = 8090\n" {
+		t.Errorf("file holds %q, %v after refused saves", got, err)
+	}
+}
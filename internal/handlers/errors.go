@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"syscall"
+)
+
+// parseErrorStatus maps an error returned by ParseMultipartForm to an HTTP status code.
+// Why distinguish? A request that exceeds the size limit or is malformed is the client's
+// fault, whereas running out of disk whilst spooling parts is the server's.
+func parseErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, http.ErrNotMultipart), errors.Is(err, http.ErrMissingBoundary):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, syscall.ENOSPC):
+		return http.StatusInsufficientStorage
+	case errors.As(err, new(*fs.PathError)):
+		// Spooling to temporary files failed for some other reason (e.g. permissions).
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// parseErrorMessage returns a client-facing message for a status produced by parseErrorStatus.
+func parseErrorMessage(status int) string {
+	switch status {
+	case http.StatusRequestEntityTooLarge:
+		return "request body exceeds the maximum upload size"
+	case http.StatusUnsupportedMediaType:
+		return "request body must be multipart/form-data"
+	case http.StatusInsufficientStorage:
+		return "insufficient storage to process the upload"
+	case http.StatusInternalServerError:
+		return "internal error"
+	default:
+		return "malformed multipart request"
+	}
+}
+
+// storageErrorStatus maps a filesystem error on the storage directory to an HTTP status code.
+func storageErrorStatus(err error) int {
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT) {
+		return http.StatusInsufficientStorage
+	}
+	return http.StatusInternalServerError
+}
+
+// openErrorStatus maps an error from opening a requested file to an HTTP status code.
+// Names that cannot be resolved inside the storage root (e.g. "../secret") are reported
+// as bad requests rather than leaking whether the target exists.
+func openErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, fs.ErrPermission):
+		return http.StatusForbidden
+	case errors.Is(err, fs.ErrInvalid):
+		return http.StatusBadRequest
+	default:
+		// os.Root reports names that escape the root with a plain error rather than an
+		// errno, so anything that is not a system error was a rejected name.
+		var errno syscall.Errno
+		if !errors.As(err, &errno) {
+			return http.StatusBadRequest
+		}
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"syscall"
+	"testing"
+)
+
+func TestParseErrorStatus(t *testing.T) {
+	tests := []struct {
+		desc string
+		err  error
+		want int
+	}{
+		{"a body over its limit", &http.MaxBytesError{Limit: 10}, http.StatusRequestEntityTooLarge},
+		{"a body that is not a form", http.ErrNotMultipart, http.StatusUnsupportedMediaType},
+		{"a form without a boundary", http.ErrMissingBoundary, http.StatusUnsupportedMediaType},
+		{"a full disk", &fs.PathError{Op: "write", Path: "/tmp/multipart-1", Err: syscall.ENOSPC}, http.StatusInsufficientStorage},
+		{"a temporary file that cannot be created", &fs.PathError{Op: "open", Path: "/tmp/multipart-1", Err: syscall.EACCES}, http.StatusInternalServerError},
+		{"a malformed form", errors.New("multipart: NextPart: EOF"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got := parseErrorStatus(fmt.Errorf("parsing form: %w", tt.err)); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+			if parseErrorMessage(tt.want) == "" {
+				t.Error("no message for the status")
+			}
+		})
+	}
+}
+
+func TestStorageErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{syscall.ENOSPC, http.StatusInsufficientStorage},
+		{syscall.EDQUOT, http.StatusInsufficientStorage},
+		{syscall.EIO, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			if got := storageErrorStatus(&fs.PathError{Op: "write", Path: "a.txt", Err: tt.err}); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpenErrorStatus(t *testing.T) {
+	root := openTestTree(t, "a.txt")
+	_, escaped := root.Open("../secret")
+	if escaped == nil {
+		t.Fatal("opened a file outside the storage directory")
+	}
+	tests := []struct {
+		desc string
+		err  error
+		want int
+	}{
+		{"a missing file", &fs.PathError{Op: "open", Path: "a.txt", Err: syscall.ENOENT}, http.StatusNotFound},
+		{"a file it may not read", &fs.PathError{Op: "open", Path: "a.txt", Err: syscall.EACCES}, http.StatusForbidden},
+		{"an invalid name", fs.ErrInvalid, http.StatusBadRequest},
+		{"a name outside the storage directory", escaped, http.StatusBadRequest},
+		{"a failing disk", &fs.PathError{Op: "open", Path: "a.txt", Err: syscall.EIO}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if got := openErrorStatus(tt.err); got != tt.want {
+				t.Errorf("got %d for %v, want %d", got, tt.err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/filemeta"
+	"github.com/mascotmascot1/fileserver/internal/notify"
+)
+
+// evictionUser names the author of evictions in file events.
+const evictionUser = "eviction"
+
+// evictionPolicy deletes stored files to keep the storage directory below a cap on its size.
+//
+// Why sizes from the file metadata? As with directory quotas, the metadata holds the size of
+// every stored file, so the usage is a sum in memory rather than a walk of the disk.
+type evictionPolicy struct {
+	cfg    config.EvictionConfig
+	pinned []string
+}
+
+// newEvictionPolicy normalises the pinned paths, or returns nil if nothing is to be evicted.
+func newEvictionPolicy(cfg config.EvictionConfig) *evictionPolicy {
+	if cfg.Policy == "" {
+		return nil
+	}
+	ep := &evictionPolicy{cfg: cfg}
+	for _, p := range cfg.Pinned {
+		ep.pinned = append(ep.pinned, path.Clean("/"+p))
+	}
+	return ep
+}
+
+// pinnedFile reports whether the storage-relative name is, or lies below, a pinned path.
+func (ep *evictionPolicy) pinnedFile(name string) bool {
+	name = path.Clean("/" + name)
+	for _, p := range ep.pinned {
+		if withinDir(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// order sorts entries so that those to be evicted first come first.
+func (ep *evictionPolicy) order(entries []filemeta.Entry) {
+	used := func(e filemeta.Entry) time.Time {
+		if ep.cfg.Policy == "lru" {
+			return e.LastUsed()
+		}
+		return e.Modified
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := used(entries[i]), used(entries[j])
+		if a.Equal(b) {
+			return entries[i].Path < entries[j].Path
+		}
+		return a.Before(b)
+	})
+}
+
+// watchEviction evicts files whenever the storage directory has grown past the high
+// watermark, until the handlers are closed.
+//
+// Only the leader evicts, as every instance sharing the storage directory would otherwise
+// delete the same files, or more than needed.
+func (h *Handlers) watchEviction() {
+	h.every(h.eviction.cfg.Interval, func() {
+		if h.leader.Leading() {
+			h.evict(h.ctx)
+		}
+	})
+}
+
+// evict deletes files in the order of the policy until the storage directory is down to the
+// low watermark, passing over those that are pinned, held, retained or being written. It
+// stops once ctx is done.
+func (h *Handlers) evict(ctx context.Context) {
+	used := h.fileMeta.Usage("")
+	if used < h.eviction.cfg.GetHighWatermark() {
+		return
+	}
+	target := h.eviction.cfg.GetLowWatermark()
+	entries := h.fileMeta.Present()
+	h.eviction.order(entries)
+
+	evicted, freed := 0, int64(0)
+	for _, e := range entries {
+		if used <= target || ctx.Err() != nil {
+			break
+		}
+		if h.eviction.pinnedFile(e.Path) || h.hidden.internalFile(e.Path) {
+			continue
+		}
+		if _, held := h.holds.Within(e.Path); held {
+			continue
+		}
+		size, ok := h.evictFile(e)
+		if !ok {
+			continue
+		}
+		used -= size
+		freed += size
+		evicted++
+	}
+	if evicted > 0 {
+		h.logger.Printf("evicted %d files, freeing %d bytes, to keep the storage directory under %d MB\n", evicted, freed, h.eviction.cfg.MaxSizeMB)
+	}
+	if used > target {
+		h.logger.Printf("WARNING: the storage directory holds %d MB, over the %d%% of %d MB eviction aims for, but no other file may be evicted\n",
+			used>>20, h.eviction.cfg.LowWatermark, h.eviction.cfg.MaxSizeMB)
+	}
+}
+
+// evictFile deletes the file of e, logging it, and returns its size. It reports false if the
+// file was not deleted.
+func (h *Handlers) evictFile(e filemeta.Entry) (int64, bool) {
+	info, ok := h.removeScheduled(e.Path, evictionUser)
+	if !ok {
+		return 0, false
+	}
+	used := "never downloaded"
+	if e.LastDownloaded != nil {
+		used = "last downloaded " + e.LastDownloaded.Format(time.RFC3339)
+	}
+	h.logger.Printf("evicted '%s' (%d bytes, stored %s, %s) by the %s policy\n",
+		e.Path, info.Size(), e.Modified.Format(time.RFC3339), used, h.eviction.cfg.Policy)
+	return info.Size(), true
+}
+
+// removeScheduled deletes the file name for a scheduled job, reported in file events as the
+// author user, and returns what it was. It reports false if the file was not deleted: if it is
+// being written or is retained, or if it is gone already.
+func (h *Handlers) removeScheduled(name, user string) (fs.FileInfo, bool) {
+	// Why take the name as an upload does? An upload replacing the file meanwhile would
+	// otherwise be deleted in its place.
+	if !h.writing.acquire(name) {
+		return nil, false
+	}
+	defer h.writing.release(name)
+
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		h.logger.Printf("error root opening: %v\n", err)
+		return nil, false
+	}
+	defer root.Close()
+	info, err := root.Lstat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, false
+	}
+	if _, retained := h.retention.lockedUntil(name, info.ModTime()); retained {
+		return nil, false
+	}
+	if err := root.Remove(name); err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			h.logger.Printf("error deleting '%s': %v\n", name, err)
+		}
+		return nil, false
+	}
+	h.index.Remove(name)
+	h.fileCache.Invalidate(name)
+	h.fileMeta.Remove(name)
+	h.notifier.Notify(notify.Event{Type: notify.Delete, Name: name, Size: info.Size(), User: user})
+	return info, true
+}
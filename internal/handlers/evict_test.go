@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/holds"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// evictionFiles are stored by newEvictionTest a quarter of a megabyte each, oldest first.
+var evictionFiles = []string{"a.bin", "b.bin", "c.bin", "d.bin"}
+
+// newEvictionTest returns handlers for a storage directory holding evictionFiles, an hour
+// apart, recorded in the file metadata, along with the directory and the log they write to.
+func newEvictionTest(t *testing.T, cfg config.EvictionConfig) (*Handlers, storage.Root, *bytes.Buffer) {
+	t.Helper()
+	root := openTestTree(t)
+	var logs bytes.Buffer
+	h := newTestHandlers(t, root, log.New(&logs, "", 0))
+	h.eviction = newEvictionPolicy(cfg)
+	start := time.Now().Add(-time.Duration(len(evictionFiles)) * time.Hour)
+	for i, name := range evictionFiles {
+		full := filepath.Join(root.Name(), name)
+		if err := os.WriteFile(full, bytes.Repeat([]byte("x"), 256<<10), 0644); err != nil {
+			t.Fatal(err)
+		}
+		modified := start.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(full, modified, modified); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(full)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.fileMeta.Record(name, info, "")
+	}
+	return h, root, &logs
+}
+
+// download downloads name from h, with the given method.
+func download(h *Handlers, method, name string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/download/"+name, nil)
+	r.SetPathValue("name", name)
+	w := httptest.NewRecorder()
+	h.DownloadHandle(w, r)
+	return w
+}
+
+func TestEvict(t *testing.T) {
+	// The files fill the megabyte, and eviction brings them down to half of it.
+	cfg := config.EvictionConfig{Policy: "oldest", MaxSizeMB: 1, HighWatermark: 90, LowWatermark: 50}
+	tests := []struct {
+		desc        string
+		policy      string
+		maxSizeMB   int64
+		pinned      []string
+		setup       func(t *testing.T, h *Handlers) // run before evicting, unless nil
+		wantEvicted []string
+	}{
+		{"the oldest files", "oldest", 1, nil, nil, []string{"a.bin", "b.bin"}},
+		{"below the high watermark", "oldest", 2, nil, nil, nil},
+		{"the least recently downloaded files", "lru", 1, nil, func(t *testing.T, h *Handlers) {
+			if w := download(h, http.MethodGet, "a.bin"); w.Code != http.StatusOK {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+			}
+		}, []string{"b.bin", "c.bin"}},
+		{"the oldest files, however recently downloaded", "oldest", 1, nil, func(t *testing.T, h *Handlers) {
+			download(h, http.MethodGet, "a.bin")
+		}, []string{"a.bin", "b.bin"}},
+		{"not a pinned file", "oldest", 1, []string{"a.bin"}, nil, []string{"b.bin", "c.bin"}},
+		{"not below a pinned directory", "oldest", 1, []string{"/"}, nil, nil},
+		{"not a held file", "oldest", 1, nil, func(t *testing.T, h *Handlers) {
+			if err := h.holds.Set(holds.Hold{Path: "a.bin", Locked: true}); err != nil {
+				t.Fatal(err)
+			}
+		}, []string{"b.bin", "c.bin"}},
+		{"not a retained file", "oldest", 1, nil, func(t *testing.T, h *Handlers) {
+			h.retention = newRetentionPolicy(config.WORMConfig{Rules: []config.WORMRule{{Path: "a.bin"}}})
+		}, []string{"b.bin", "c.bin"}},
+		{"not a file being written", "oldest", 1, nil, func(t *testing.T, h *Handlers) {
+			h.writing.acquire("a.bin")
+		}, []string{"b.bin", "c.bin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := cfg
+			cfg.Policy, cfg.MaxSizeMB, cfg.Pinned = tt.policy, tt.maxSizeMB, tt.pinned
+			h, root, logs := newEvictionTest(t, cfg)
+			if tt.setup != nil {
+				tt.setup(t, h)
+			}
+			h.evict(t.Context())
+
+			for _, name := range evictionFiles {
+				evicted := slices.Contains(tt.wantEvicted, name)
+				if exists(t, root, name) == evicted {
+					t.Errorf("'%s' evicted %v, want %v", name, !evicted, evicted)
+				}
+				if recorded := h.fileMeta.ID(name) != ""; recorded == evicted {
+					t.Errorf("'%s' in the file metadata %v, want %v", name, recorded, !evicted)
+				}
+				if logged := strings.Contains(logs.String(), "evicted '"+name+"'"); logged != evicted {
+					t.Errorf("'%s' logged as evicted %v, want %v", name, logged, evicted)
+				}
+			}
+			// Without enough files to evict, the storage directory stays over the low watermark.
+			if warned := strings.Contains(logs.String(), "WARNING"); warned != (tt.maxSizeMB == 1 && len(tt.wantEvicted) < 2) {
+				t.Errorf("warned %v:\n%s", warned, logs)
+			}
+		})
+	}
+}
+
+// TestDownloadRecorded checks that downloads, but not requests for a file's headers, count
+// as uses of the file.
+func TestDownloadRecorded(t *testing.T) {
+	h, _, _ := newEvictionTest(t, config.EvictionConfig{})
+	lastDownloaded := func(name string) *time.Time {
+		e, _ := h.fileMeta.ByID(h.fileMeta.ID(name))
+		return e.LastDownloaded
+	}
+	if w := download(h, http.MethodHead, "a.bin"); w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if got := lastDownloaded("a.bin"); got != nil {
+		t.Errorf("a HEAD request recorded a download at %v", got)
+	}
+	before := time.Now()
+	download(h, http.MethodGet, "a.bin")
+	if got := lastDownloaded("a.bin"); got == nil || got.Before(before) {
+		t.Errorf("got last downloaded %v, want since %v", got, before)
+	}
+	if got := lastDownloaded("b.bin"); got != nil {
+		t.Errorf("another file was downloaded at %v", got)
+	}
+}
@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/mascotmascot1/fileserver/internal/notify"
+)
+
+// externalUser names the author of changes made outside the server in file events.
+const externalUser = "external"
+
+// externalChanges handles files added to or removed from the storage directory other than
+// through the server, so that they reach notifications and event consumers like uploads and
+// deletes do. Removed files are flagged in the file metadata rather than forgotten, as
+// nothing known to the server deleted them.
+//
+// Only the leader reports them, as every instance sharing the storage directory notices
+// the same changes.
+func (h *Handlers) externalChanges(added, removed []string) {
+	report := h.leader.Leading()
+	for _, name := range added {
+		h.fileCache.Invalidate(name)
+		h.fileMeta.Update(name)
+		var size int64
+		if root, err := h.storage.OpenRoot(name); err == nil {
+			if info, err := root.Stat(name); err == nil {
+				size = info.Size()
+			}
+			root.Close()
+		}
+		if report {
+			h.notifier.Notify(notify.Event{Type: notify.Upload, Name: name, Size: size, User: externalUser})
+		}
+	}
+	for _, name := range removed {
+		h.fileCache.Invalidate(name)
+		h.fileMeta.Vanished(name)
+		if report {
+			h.notifier.Notify(notify.Event{Type: notify.Delete, Name: name, User: externalUser})
+		}
+	}
+}
+
+// rescanResult is the answer to a rescan request.
+type rescanResult struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// RescanHandler rescans the storage directory straight away rather than at the next scheduled
+// rescan, and answers the files found added or removed outside the server. Admin only.
+//
+// Why on demand? An operator who has just copied files in by hand wants them served now, not
+// in rescanInterval.
+func (h *Handlers) RescanHandler(w http.ResponseWriter, r *http.Request) {
+	defer cleanupRequest(r)
+
+	added, removed, err := h.index.Reconcile()
+	if err != nil {
+		h.logger.Printf("error rescanning storage directory: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if len(added) > 0 || len(removed) > 0 {
+		h.externalChanges(added, removed)
+	}
+	h.logger.Printf("%s rescanned the storage directory: %d files added, %d removed\n", principalName(principalFrom(r)), len(added), len(removed))
+	// Empty lists rather than null, for clients that range over them.
+	resp := rescanResult{Added: append([]string{}, added...), Removed: append([]string{}, removed...)}
+	h.render.JSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"os"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/fetch"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+)
+
+// maxFetchBodySize bounds the JSON body of a fetch request.
+const maxFetchBodySize = 64 << 10 // 64 KB
+
+// FetchHandler downloads the file at a URL straight into storage, so that a large file
+// on another server need not pass through the client's own connection on its way here:
+//
+//	{"url": "https://example.com/dataset.tar.gz", "name": "datasets/dataset.tar.gz"}
+//
+// Without a name, the file is stored under the name the remote server gives it, or the last
+// element of the URL's path. The request is answered once the file has been stored.
+func (h *Handlers) FetchHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	var req struct {
+		URL  string `json:"url"`
+		Name string `json:"name"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxFetchBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return
+	}
+	if req.URL == "" {
+		h.render.Error(w, r, http.StatusBadRequest, "url is required")
+		return
+	}
+	principal := principalFrom(r)
+	// A chosen name is checked before anything is downloaded, so a client cannot make the
+	// server fetch what it may not store.
+	if req.Name != "" && !h.fetchName(w, r, req.Name) {
+		return
+	}
+	limit := h.uploadLimit(w, r)
+	if maxSize := h.fetch.GetMaxSize(); maxSize > 0 && maxSize < limit.bytes {
+		limit = uploadLimit{bytes: maxSize}
+	}
+	if limit.exceeds(0) {
+		h.rejectFetchOverLimit(w, r, limit)
+		return
+	}
+
+	resp, err := h.fetcher.Get(r.Context(), req.URL)
+	if err != nil {
+		var statusErr *fetch.StatusError
+		switch {
+		case errors.Is(err, fetch.ErrNotAllowed):
+			h.render.Error(w, r, http.StatusForbidden, "URL may not be fetched", err.Error())
+		case errors.As(err, &statusErr):
+			h.render.Error(w, r, http.StatusBadGateway, "unable to fetch URL", err.Error())
+		case r.Context().Err() != nil:
+			h.logger.Printf("client %s disconnected whilst fetching %s\n", r.RemoteAddr, req.URL)
+		default:
+			h.logger.Printf("error fetching %s: %v\n", req.URL, err)
+			h.render.Error(w, r, http.StatusBadGateway, "unable to fetch URL", err.Error())
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	if req.Name == "" {
+		req.Name = fetch.FileName(resp)
+		if req.Name == "" {
+			h.render.Error(w, r, http.StatusBadRequest, "name is required", "the URL does not name a file")
+			return
+		}
+		if !h.fetchName(w, r, req.Name) {
+			return
+		}
+	}
+	name, _ := cleanStoragePath(req.Name)
+	if limit.exceeds(resp.ContentLength) {
+		h.rejectFetchOverLimit(w, r, limit)
+		return
+	}
+
+	// Downloaded to a temporary file first, as validation reads the file before it is stored.
+	tmp, err := os.CreateTemp("", "fetch-*")
+	if err != nil {
+		h.logger.Printf("error creating temporary file: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// Charged like an upload, as the file takes up the same room once stored.
+	charge := h.reserveQuota(r, &limit, resp.ContentLength)
+	if limit.exceeds(resp.ContentLength) {
+		charge(0)
+		h.rejectFetchOverLimit(w, r, limit)
+		return
+	}
+
+	var body io.Reader = resp.Body
+	if h.stallTimeout > 0 {
+		// Extended whilst the remote server keeps sending, as the client waits for the answer.
+		body = &deadlineReader{ReadCloser: resp.Body, rc: http.NewResponseController(w), stall: h.stallTimeout}
+	}
+	n, err := io.Copy(tmp, io.LimitReader(newContextReader(r.Context(), body), limit.bytes+1))
+	charge(n)
+	if err != nil {
+		if r.Context().Err() != nil {
+			h.logger.Printf("client %s disconnected whilst fetching %s\n", r.RemoteAddr, req.URL)
+			return
+		}
+		h.logger.Printf("error fetching %s: %v\n", req.URL, err)
+		h.render.Error(w, r, http.StatusBadGateway, "unable to fetch URL", err.Error())
+		return
+	}
+	if n > limit.bytes {
+		h.rejectFetchOverLimit(w, r, limit)
+		return
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		h.logger.Printf("error rewinding fetched file: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+
+	if err := h.makeStorageDir(); err != nil {
+		h.logger.Printf("error creating file directory: %v\n", err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to prepare storage directory")
+		return
+	}
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	if err := h.checkProtected(root, principal, name, "overwrite"); err != nil {
+		if errors.Is(err, errHeld) || errors.Is(err, errRetained) {
+			h.render.Error(w, r, protectedStatus(err), "protected files cannot be changed", err.Error())
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	_, statErr := root.Stat(name)
+	created := errors.Is(statErr, fs.ErrNotExist)
+
+	fh := &multipart.FileHeader{Filename: name, Size: n}
+	if fail := h.checkUpload("from "+req.URL, principalName(principal), name, fh, tmp); fail != nil {
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		h.logger.Printf("error rewinding fetched file: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if _, fail := h.storeUpload(root, name, tmp, false, principalName(principal), n); fail != nil {
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+
+	stat, err := root.Stat(name)
+	if err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	h.logger.Printf("fetched %d bytes from %s to '%s' for %s\n", n, req.URL, name, r.RemoteAddr)
+	h.renderStored(w, name, stat, created)
+}
+
+// fetchName checks that a fetched file may be stored as name. It answers the request itself,
+// and reports false, if it may not.
+func (h *Handlers) fetchName(w http.ResponseWriter, r *http.Request, name string) bool {
+	name, err := cleanStoragePath(name)
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return false
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Write, name) {
+		h.denyAccess(w, r)
+		return false
+	}
+	return true
+}
+
+// rejectFetchOverLimit answers a fetch of a file over its limit: 413 for the maximum size, or
+// 429 for the quota, as for uploads.
+func (h *Handlers) rejectFetchOverLimit(w http.ResponseWriter, r *http.Request, limit uploadLimit) {
+	if limit.quota {
+		h.rejectOverLimit(w, r, limit)
+		return
+	}
+	h.logger.Printf("fetch for %s exceeds the limit of %d bytes\n", r.RemoteAddr, limit.bytes)
+	h.render.TooLarge(w, r, "remote file exceeds the maximum size", limit.bytes)
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	// maxFormParts bounds the parts of an upload form, as the standard library does for
+	// ParseMultipartForm, so that a form of countless empty parts cannot tie up the server.
+	maxFormParts = 1000
+	// maxFormValuesSize bounds the text fields of an upload form together.
+	maxFormValuesSize = 10 << 20 // 10 MB
+)
+
+// uploadForm is the form of an upload, read part by part so that each file is held to the
+// maximum file size as it arrives.
+//
+// Why not ParseMultipartForm? It holds the form to a single limit: one file over it fails the
+// whole upload, including the files that were received in full before it.
+type uploadForm struct {
+	// Form holds the text fields; the files are in files instead.
+	*multipart.Form
+	// files are in the order they were sent.
+	files []*formFile
+	// truncated reports that the body went over the upload's limit, and was not read to its
+	// end. The parts before are complete, and those after were never seen.
+	truncated bool
+}
+
+// formFile is a file of an upload form, held in memory or spooled to a temporary file.
+type formFile struct {
+	field  string
+	header *multipart.FileHeader
+	// tooLarge reports that the file went over the maximum file size, or that the body went
+	// over the upload's limit whilst it was sent. Its content is not kept.
+	tooLarge bool
+	content  []byte
+	tmpfile  string
+	// received is how long the file took to arrive, from the headers of its part to its end.
+	received time.Duration
+}
+
+// readUploadForm reads the multipart body of r, keeping files in memory until maxMemory is
+// used up and spooling the rest to temporary files, and marking files over maxFileSize as too
+// large rather than failing the form. The caller removes the temporary files with removeAll,
+// whatever the error.
+//
+// If the body goes over its own limit, the form read so far is returned with truncated set
+// and the *http.MaxBytesError, so that the files received before can still be stored.
+func readUploadForm(r *http.Request, maxMemory, maxFileSize int64) (*uploadForm, error) {
+	form := &uploadForm{Form: &multipart.Form{Value: make(map[string][]string)}}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return form, err
+	}
+	valuesLeft := int64(maxFormValuesSize)
+	for range maxFormParts {
+		p, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			return form, form.fail(err)
+		}
+		name := p.FormName()
+		if name == "" {
+			continue
+		}
+		if p.FileName() == "" {
+			var buf bytes.Buffer
+			n, err := io.Copy(&buf, io.LimitReader(p, valuesLeft+1))
+			if err != nil {
+				return form, form.fail(err)
+			}
+			if n > valuesLeft {
+				return form, multipart.ErrMessageTooLarge
+			}
+			valuesLeft -= n
+			form.Value[name] = append(form.Value[name], buf.String())
+			continue
+		}
+
+		ff := &formFile{field: name, header: &multipart.FileHeader{Filename: p.FileName(), Header: p.Header}}
+		form.files = append(form.files, ff)
+		start := time.Now()
+		n, err := ff.receive(p, maxMemory, maxFileSize)
+		ff.header.Size, ff.received = n, time.Since(start)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				ff.discard()
+				ff.tooLarge = true
+			}
+			return form, form.fail(err)
+		}
+		if !ff.tooLarge && ff.tmpfile == "" {
+			maxMemory -= n
+		}
+	}
+	return form, multipart.ErrMessageTooLarge
+}
+
+// fail returns err, noting in the form if it was the body going over its limit.
+func (f *uploadForm) fail(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		f.truncated = true
+	}
+	return err
+}
+
+// received returns the number of files that were received in full.
+func (f *uploadForm) received() int {
+	n := 0
+	for _, ff := range f.files {
+		if !ff.tooLarge {
+			n++
+		}
+	}
+	return n
+}
+
+// removeAll removes the temporary files of the form.
+func (f *uploadForm) removeAll() {
+	for _, ff := range f.files {
+		ff.discard()
+	}
+}
+
+// receive reads the file from p, in memory if it fits in maxMemory or else to a temporary
+// file. A file over maxFileSize is read to its end, so that the parts after it can be, but
+// not kept. It returns the size of the file.
+func (ff *formFile) receive(p io.Reader, maxMemory, maxFileSize int64) (int64, error) {
+	src := &io.LimitedReader{R: p, N: maxFileSize + 1}
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, io.LimitReader(src, max(maxMemory, 0)+1))
+	if err != nil {
+		return n, err
+	}
+	if src.N == 0 {
+		return ff.skip(p, n)
+	}
+	if n <= maxMemory {
+		ff.content = buf.Bytes()
+		return n, nil
+	}
+
+	// Why spool what does not fit? A batch of large files would otherwise be held in memory
+	// as a whole, which is what maxFormMemSizeMB is for.
+	tmp, err := os.CreateTemp("", "multipart-")
+	if err != nil {
+		return n, err
+	}
+	ff.tmpfile = tmp.Name()
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return n, err
+	}
+	m, err := io.Copy(tmp, src)
+	n += m
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	if src.N == 0 {
+		ff.discard()
+		return ff.skip(p, n)
+	}
+	return n, nil
+}
+
+// skip marks the file as too large and reads the rest of it from p, of which n bytes were
+// read, returning the size of the whole file. The bytes skipped count towards the upload's
+// limit all the same.
+func (ff *formFile) skip(p io.Reader, n int64) (int64, error) {
+	ff.tooLarge = true
+	m, err := io.Copy(io.Discard, p)
+	return n + m, err
+}
+
+// discard drops the content of the file.
+func (ff *formFile) discard() {
+	ff.content = nil
+	if ff.tmpfile != "" {
+		os.Remove(ff.tmpfile)
+		ff.tmpfile = ""
+	}
+}
+
+// open returns the content of the file.
+func (ff *formFile) open() (multipart.File, error) {
+	if ff.tmpfile != "" {
+		return os.Open(ff.tmpfile)
+	}
+	return memoryFile{bytes.NewReader(ff.content)}, nil
+}
@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// formPart is a part of a test upload form; a part without a filename is a text field.
+type formPart struct {
+	field, filename, content string
+}
+
+// encodeForm returns the multipart body of parts and its content type. The filename is sent
+// as given, path and all, as a client may.
+func encodeForm(t *testing.T, parts ...formPart) ([]byte, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, p := range parts {
+		disposition := fmt.Sprintf(`form-data; name="%s"`, p.field)
+		if p.filename != "" {
+			disposition += fmt.Sprintf(`; filename="%s"`, p.filename)
+		}
+		w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Disposition": {disposition}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, p.content)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return body.Bytes(), mw.FormDataContentType()
+}
+
+// wantFile is a file expected in a form read; content is checked unless the file is too large.
+type wantFile struct {
+	field, name string
+	size        int64
+	tooLarge    bool
+	content     string
+}
+
+func TestReadUploadForm(t *testing.T) {
+	large := strings.Repeat("x", 100)
+	tests := []struct {
+		desc        string
+		parts       []formPart
+		contentType string // replaces the form's own, if set
+		cut         int    // bytes dropped from the end of the body
+		limit       int64  // of the body, if set
+		maxMemory   int64
+		wantFiles   []wantFile
+		wantValues  map[string][]string
+		wantErr     error
+		truncated   bool
+	}{
+		{
+			desc: "multiple files",
+			parts: []formPart{
+				{"file", "a.txt", "alpha"},
+				{"file", "b.txt", "bravo!"},
+				{"other", "c.txt", ""},
+			},
+			maxMemory: 1 << 20,
+			wantFiles: []wantFile{
+				{field: "file", name: "a.txt", size: 5, content: "alpha"},
+				{field: "file", name: "b.txt", size: 6, content: "bravo!"},
+				{field: "other", name: "c.txt", size: 0, content: ""},
+			},
+			wantValues: map[string][]string{},
+		},
+		{
+			desc: "a field after a file",
+			parts: []formPart{
+				{"path", "", "docs"},
+				{"file", "a.txt", "alpha"},
+				{"overwrite", "", "true"},
+				{"path", "", "more"},
+			},
+			maxMemory:  1 << 20,
+			wantFiles:  []wantFile{{field: "file", name: "a.txt", size: 5, content: "alpha"}},
+			wantValues: map[string][]string{"path": {"docs", "more"}, "overwrite": {"true"}},
+		},
+		{
+			desc: "files spooled once memory is used up",
+			parts: []formPart{
+				{"file", "a.txt", "alpha"},
+				{"file", "b.txt", "bravo"},
+			},
+			maxMemory: 8,
+			wantFiles: []wantFile{
+				{field: "file", name: "a.txt", size: 5, content: "alpha"},
+				{field: "file", name: "b.txt", size: 5, content: "bravo"},
+			},
+			wantValues: map[string][]string{},
+		},
+		{
+			desc: "an oversized file between others",
+			parts: []formPart{
+				{"file", "a.txt", "alpha"},
+				{"file", "large.bin", large},
+				{"file", "b.txt", "bravo"},
+			},
+			maxMemory: 1 << 20,
+			wantFiles: []wantFile{
+				{field: "file", name: "a.txt", size: 5, content: "alpha"},
+				{field: "file", name: "large.bin", size: 100, tooLarge: true},
+				{field: "file", name: "b.txt", size: 5, content: "bravo"},
+			},
+			wantValues: map[string][]string{},
+		},
+		{
+			desc: "an oversized file spooled",
+			parts: []formPart{
+				{"file", "large.bin", large},
+			},
+			maxMemory:  10,
+			wantFiles:  []wantFile{{field: "file", name: "large.bin", size: 100, tooLarge: true}},
+			wantValues: map[string][]string{},
+		},
+		{
+			desc: "an oversized field",
+			parts: []formPart{
+				{"file", "a.txt", "alpha"},
+				{"comment", "", strings.Repeat("x", maxFormValuesSize+1)},
+			},
+			maxMemory:  1 << 20,
+			wantFiles:  []wantFile{{field: "file", name: "a.txt", size: 5, content: "alpha"}},
+			wantValues: map[string][]string{},
+			wantErr:    multipart.ErrMessageTooLarge,
+		},
+		{
+			desc: "a body over its limit",
+			parts: []formPart{
+				{"file", "a.txt", "alpha"},
+				{"file", "large.bin", strings.Repeat("x", 60)},
+				{"file", "b.txt", "bravo"},
+			},
+			limit:     300,
+			maxMemory: 1 << 20,
+			wantFiles: []wantFile{
+				{field: "file", name: "a.txt", size: 5, content: "alpha"},
+				{field: "file", name: "large.bin", tooLarge: true},
+			},
+			wantValues: map[string][]string{},
+			wantErr:    &http.MaxBytesError{},
+			truncated:  true,
+		},
+		{
+			desc: "a truncated body",
+			parts: []formPart{
+				{"file", "a.txt", "alpha"},
+				{"file", "b.txt", "bravo"},
+			},
+			cut:        20,
+			maxMemory:  1 << 20,
+			wantFiles:  []wantFile{{field: "file", name: "a.txt", size: 5, content: "alpha"}, {field: "file", name: "b.txt"}},
+			wantValues: map[string][]string{},
+			wantErr:    io.ErrUnexpectedEOF,
+		},
+		{
+			desc:        "a missing boundary",
+			parts:       []formPart{{"file", "a.txt", "alpha"}},
+			contentType: "multipart/form-data",
+			maxMemory:   1 << 20,
+			wantValues:  map[string][]string{},
+			wantErr:     http.ErrMissingBoundary,
+		},
+		{
+			desc: "a filename with path components",
+			parts: []formPart{
+				{"file", "../../etc/passwd", "root"},
+				{"file", "/tmp/dir/a.txt", "alpha"},
+			},
+			maxMemory: 1 << 20,
+			wantFiles: []wantFile{
+				{field: "file", name: "passwd", size: 4, content: "root"},
+				{field: "file", name: "a.txt", size: 5, content: "alpha"},
+			},
+			wantValues: map[string][]string{},
+		},
+		{
+			desc:       "a part without a name",
+			parts:      []formPart{{"", "a.txt", "alpha"}, {"path", "", "docs"}},
+			maxMemory:  1 << 20,
+			wantValues: map[string][]string{"path": {"docs"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			body, contentType := encodeForm(t, tt.parts...)
+			body = body[:len(body)-tt.cut]
+			if tt.contentType != "" {
+				contentType = tt.contentType
+			}
+			r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+			r.Header.Set("Content-Type", contentType)
+			if tt.limit > 0 {
+				r.Body = http.MaxBytesReader(nil, r.Body, tt.limit)
+			}
+
+			form, err := readUploadForm(r, tt.maxMemory, 50)
+			defer form.removeAll()
+			var maxBytesErr *http.MaxBytesError
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("got error %v", err)
+			case errors.As(tt.wantErr, &maxBytesErr) && !errors.As(err, &maxBytesErr):
+				t.Fatalf("got error %v, want an *http.MaxBytesError", err)
+			case tt.wantErr != nil && !errors.As(tt.wantErr, &maxBytesErr) && !errors.Is(err, tt.wantErr):
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if form.truncated != tt.truncated {
+				t.Errorf("truncated is %v, want %v", form.truncated, tt.truncated)
+			}
+			if !reflect.DeepEqual(form.Value, tt.wantValues) {
+				t.Errorf("got fields %v, want %v", form.Value, tt.wantValues)
+			}
+			if len(form.files) != len(tt.wantFiles) {
+				t.Fatalf("got %d files, want %d", len(form.files), len(tt.wantFiles))
+			}
+			for i, want := range tt.wantFiles {
+				ff := form.files[i]
+				if ff.field != want.field || ff.header.Filename != want.name || ff.tooLarge != want.tooLarge {
+					t.Errorf("file %d is %s %q, too large %v, want %s %q, too large %v", i, ff.field, ff.header.Filename, ff.tooLarge, want.field, want.name, want.tooLarge)
+				}
+				if ff.tooLarge {
+					if ff.content != nil || ff.tmpfile != "" {
+						t.Errorf("the content of %q was kept", want.name)
+					}
+					if want.size > 0 && ff.header.Size != want.size {
+						t.Errorf("%q has size %d, want %d", want.name, ff.header.Size, want.size)
+					}
+					continue
+				}
+				if err != nil && i == len(tt.wantFiles)-1 {
+					// The part the error arose in is incomplete.
+					continue
+				}
+				if ff.header.Size != want.size {
+					t.Errorf("%q has size %d, want %d", want.name, ff.header.Size, want.size)
+				}
+				f, err := ff.open()
+				if err != nil {
+					t.Fatal(err)
+				}
+				content, _ := io.ReadAll(f)
+				f.Close()
+				if string(content) != want.content {
+					t.Errorf("%q holds %q, want %q", want.name, content, want.content)
+				}
+			}
+			if got := form.received(); tt.wantErr == nil && got != len(tt.wantFiles)-countTooLarge(tt.wantFiles) {
+				t.Errorf("%d files received, want %d", got, len(tt.wantFiles)-countTooLarge(tt.wantFiles))
+			}
+
+			var spooled []string
+			for _, ff := range form.files {
+				if ff.tmpfile != "" {
+					spooled = append(spooled, ff.tmpfile)
+				}
+			}
+			form.removeAll()
+			for _, name := range spooled {
+				if _, err := os.Stat(name); !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("temporary file %s was not removed", name)
+				}
+			}
+		})
+	}
+}
+
+// countTooLarge returns the number of files expected to be too large.
+func countTooLarge(files []wantFile) int {
+	n := 0
+	for _, f := range files {
+		if f.tooLarge {
+			n++
+		}
+	}
+	return n
+}
@@ -1,17 +1,55 @@
 package handlers
 
 import (
-	"encoding/json"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
+	"github.com/mascotmascot1/fileserver/internal/abuse"
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/assembly"
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/authz"
+	"github.com/mascotmascot1/fileserver/internal/cdn"
+	"github.com/mascotmascot1/fileserver/internal/cluster"
 	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/convert"
+	"github.com/mascotmascot1/fileserver/internal/coord"
+	"github.com/mascotmascot1/fileserver/internal/diskspace"
+	"github.com/mascotmascot1/fileserver/internal/faults"
+	"github.com/mascotmascot1/fileserver/internal/fetch"
+	"github.com/mascotmascot1/fileserver/internal/filecache"
+	"github.com/mascotmascot1/fileserver/internal/filemeta"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/internal/holds"
+	"github.com/mascotmascot1/fileserver/internal/index"
+	"github.com/mascotmascot1/fileserver/internal/jobs"
+	"github.com/mascotmascot1/fileserver/internal/leader"
+	"github.com/mascotmascot1/fileserver/internal/locks"
+	"github.com/mascotmascot1/fileserver/internal/mirror"
+	"github.com/mascotmascot1/fileserver/internal/notify"
+	"github.com/mascotmascot1/fileserver/internal/quarantine"
+	"github.com/mascotmascot1/fileserver/internal/quota"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+	"github.com/mascotmascot1/fileserver/internal/shortlinks"
+	"github.com/mascotmascot1/fileserver/internal/video"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
 )
 
 // Handlers encapsulates the dependencies required by the HTTP handlers,
@@ -19,129 +57,480 @@ import (
 // making the handlers easier to test and manage.
 // Fields are unexported to prevent external packages from modifying their state after initialisation.
 type Handlers struct {
-	uploader *config.UploaderConfig
-	logger   *log.Logger
+	uploader     *config.UploaderConfig
+	logger       *log.Logger
+	render       *respond.Renderer
+	acl          *acl.ACL
+	authz        *authz.Authorizer
+	stallTimeout time.Duration
+	basePath     string
+	index        *index.Index
+	cache        *cachePolicy
+	fileCache    *filecache.Cache
+	retention    *retentionPolicy
+	reader       *pdfReader // nil without the reader page
+	holds        *holds.Store
+	fileMeta     *filemeta.Store
+	validator    *validator
+	quarantine   *quarantine.Store
+	quota        *quota.Store
+	dirQuotas    *dirQuotas
+	eviction     *evictionPolicy // nil unless evicting files
+	hidden       *hiddenPolicy
+	locks        *locks.Manager
+	writing      *writeGuard
+	notifier     *notify.Notifier
+	jobs         *jobs.Queue
+	asyncMode    string
+	videos       *video.Previews
+	converter    *convert.Previews
+	editor       *config.EditorConfig
+	paste        *config.PasteConfig
+	publicURL    string
+	fetch        *config.FetchConfig
+	fetcher      *fetch.Fetcher
+	links        *shortlinks.Store
+	assembled    *assembly.Store // nil unless parallel uploads are enabled
+	mirror       *config.MirrorConfig
+	upstream     *mirror.Mirror // nil unless mirroring
+	cluster      *cluster.Cluster
+	cursors      *coord.Cursors
+	leader       *leader.Elector  // nil unless electing a leader
+	storage      storage.Storage  // where each file is stored
+	cdnSigner    *cdn.Signer      // nil unless issuing signed cookies
+	purger       *cdn.Purger      // nil unless purging a CDN
+	faults       *faults.Injector // nil unless injecting faults for testing
+	space        *diskspace.Guard // nil unless keeping space free
+
+	// ctx is cancelled by Close, to stop the scheduled jobs, which wg waits for.
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
 // NewHandlers is a constructor that creates a new Handlers instance with the necessary dependencies.
-func NewHandlers(cfg *config.Config, logger *log.Logger) *Handlers {
-	return &Handlers{
-		uploader: &cfg.Uploader,
-		logger:   logger,
+func NewHandlers(cfg *config.Config, holdStore *holds.Store, fileMeta *filemeta.Store, quarantined *quarantine.Store, uploadQuota *quota.Store, notifier *notify.Notifier, jobQueue *jobs.Queue, videos *video.Previews, converter *convert.Previews, fetcher *fetch.Fetcher, links *shortlinks.Store, assembled *assembly.Store, upstream *mirror.Mirror, nodes *cluster.Cluster, backend coord.Backend, cursors *coord.Cursors, elector *leader.Elector, storage storage.Storage, signer *cdn.Signer, purger *cdn.Purger, injector *faults.Injector, space *diskspace.Guard, logger *log.Logger) *Handlers {
+	render := respond.NewRenderer(cfg.Server.ErrorFormat, logger)
+	h := &Handlers{
+		uploader:     &cfg.Uploader,
+		logger:       logger,
+		render:       render,
+		acl:          acl.New(cfg.ACL),
+		authz:        authz.New(cfg, render, logger),
+		stallTimeout: cfg.Server.StallTimeout,
+		basePath:     cfg.Server.GetBasePath(),
+		index:        index.New(storage, cfg.Uploader.Symlinks == "hide", logger),
+		cache:        newCachePolicy(cfg.Cache),
+		fileCache:    filecache.New(cfg.FileCache.GetMaxSize(), cfg.FileCache.GetMaxEntrySize()),
+		retention:    newRetentionPolicy(cfg.WORM),
+		reader:       newPDFReader(cfg.Viewer),
+		holds:        holdStore,
+		fileMeta:     fileMeta,
+		validator:    newValidator(cfg.Validation),
+		quarantine:   quarantined,
+		quota:        uploadQuota,
+		dirQuotas:    newDirQuotas(cfg.DirQuotas),
+		eviction:     newEvictionPolicy(cfg.Eviction),
+		hidden:       newHiddenPolicy(cfg.HiddenFiles, cfg.Uploader.StorageDir, cfg.Metadata.Dir),
+		locks:        locks.NewManager(),
+		writing:      newWriteGuard(backend, logger),
+		notifier:     notifier,
+		jobs:         jobQueue,
+		asyncMode:    cfg.Processing.Async,
+		videos:       videos,
+		converter:    converter,
+		editor:       &cfg.Editor,
+		paste:        &cfg.Paste,
+		publicURL:    cfg.Server.PublicURL,
+		fetch:        &cfg.Fetch,
+		fetcher:      fetcher,
+		links:        links,
+		assembled:    assembled,
+		mirror:       &cfg.Mirror,
+		upstream:     upstream,
+		cluster:      nodes,
+		cursors:      cursors,
+		leader:       elector,
+		storage:      storage,
+		cdnSigner:    signer,
+		purger:       purger,
+		faults:       injector,
+		space:        space,
+	}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	h.index.Watch(index.WatchOptions{
+		Interval: cfg.Index.RescanInterval,
+		Notify:   cfg.Index.Watch,
+		Busy:     h.writing.busy,
+		Changed:  h.externalChanges,
+	})
+	h.jobs.Start(h.processJobFile)
+	if h.eviction != nil {
+		h.wg.Go(h.watchEviction)
+	}
+	if h.retention.sweepInterval > 0 {
+		h.wg.Go(h.watchRetention)
+	}
+	if interval := cfg.Integrity.Interval; interval > 0 {
+		h.wg.Go(func() { h.watchIntegrity(interval) })
+	}
+	return h
+}
+
+// Close stops the work the handlers do in the background: following changes to the storage
+// directory, processing the jobs of uploads, and the scheduled jobs. It waits for all of them
+// to return, and is called once the requests to the handlers have completed.
+func (h *Handlers) Close() {
+	h.cancel()
+	h.index.Close()
+	h.jobs.Close()
+	h.wg.Wait()
+}
+
+// every calls fn every interval until the handlers are closed.
+func (h *Handlers) every(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
 	}
 }
 
 // UploadHandler processes multipart/form-data requests to upload files.
 func (h *Handlers) UploadHandler(w http.ResponseWriter, r *http.Request) {
-	h.logger.Printf("received request from %s for %s\n", r.RemoteAddr, r.URL.Path)
-	defer cleanupRequest(r)
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	// Why not defer cleanupRequest directly? An oversized body is deliberately left unread:
+	// draining gigabytes the server has already refused would only waste bandwidth, so the
+	// connection is closed instead.
+	oversized := false
+	defer func() {
+		if oversized {
+			r.Body.Close()
+			return
+		}
+		cleanupRequest(r)
+	}()
 
-	if r.Method != http.MethodPost {
-		http.Error(w, "method must be POST", http.StatusMethodNotAllowed)
+	// Why check the media type up front? ParseMultipartForm would otherwise fail with a
+	// generic error, and the client deserves to know it sent the wrong kind of body.
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		h.render.Error(w, r, http.StatusUnsupportedMediaType, "request body must be multipart/form-data")
 		return
 	}
 
 	// Why wrap the body? To prevent resource exhaustion. This enforces a hard limit
 	// on the total request size, protecting the server from malicious or accidental DoS attacks.
-	r.Body = http.MaxBytesReader(w, r.Body, h.uploader.GetMaxUploadSize())
+	limit := h.uploadLimit(w, r)
+	// A declared Content-Length over the limit can be refused before reading a single byte.
+	if limit.exceeds(r.ContentLength) {
+		oversized = true
+		h.rejectOverLimit(w, r, limit)
+		return
+	}
+	defer h.meterUpload(w, r, &limit)()
+	// Large uploads outlast ReadTimeout, so the deadline is extended whilst data keeps arriving.
+	h.withStallTimeout(w, r)
 
 	// Why parse with a memory limit? To balance performance against resource usage.
 	// Form parts smaller than this limit are kept in RAM for speed; larger ones are
 	// spooled to temporary files on disk, preventing a single request from consuming all memory.
-	err := r.ParseMultipartForm(h.uploader.GetMaxFormMemSize())
+	form, err := readUploadForm(r, h.uploader.GetMaxFormMemSize(), h.uploader.GetMaxFileSize())
+	defer form.removeAll()
 	if err != nil {
-		h.logger.Printf("error multipart parsing: %v\n", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
+		// A client that went away mid-upload cannot receive a response anyway.
+		if r.Context().Err() != nil {
+			h.logger.Printf("client %s disconnected during upload: %v\n", r.RemoteAddr, err)
+			return
+		}
+		status := parseErrorStatus(err)
+		switch {
+		case status == http.StatusRequestEntityTooLarge && form.truncated && form.received() > 0:
+			// Why carry on with a body over the limit? The files received before it went over
+			// are complete, and are stored as if the upload had ended there.
+			oversized = true
+			w.Header().Set("Connection", "close")
+			h.logger.Printf("upload from %s exceeds the limit of %d bytes after %d files\n", r.RemoteAddr, limit.bytes, form.received())
+		case status == http.StatusRequestEntityTooLarge:
+			oversized = true
+			h.rejectOverLimit(w, r, limit)
+			return
+		default:
+			h.logger.Printf("error multipart parsing: %v\n", err)
+			h.render.Error(w, r, status, parseErrorMessage(status))
+			return
+		}
 	}
+	// The helpers reading the text fields of the form find them where ParseMultipartForm
+	// would have put them.
+	r.MultipartForm = form.Form
 
 	// Why MkdirAll? For idempotency and robustness. This ensures the storage path exists
 	// without failing if it's already there, and it creates any necessary parent directories.
-	err = os.MkdirAll(h.uploader.StorageDir, 0755) // Создаст все недостающие подкаталоги.
+	err = h.makeStorageDir() // Создаст все недостающие подкаталоги.
 	if err != nil {
 		h.logger.Printf("error creating file directory: %v\n", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to prepare storage directory")
 		return
 	}
 
-	// Why open the root directory once? For security and performance.
-	// It confines all subsequent file operations within this directory, preventing path traversal
-	// attacks, and avoids the overhead of opening the directory repeatedly within the loop.
-	root, err := os.OpenRoot(h.uploader.StorageDir)
+	// Why open the root directories once? For security and performance.
+	// They confine all subsequent file operations within the storage directory, or the disk a
+	// file's prefix is sharded to, preventing path traversal attacks, and each is opened once
+	// rather than repeatedly within the loop.
+	roots := storage.NewRoots(h.storage)
+	defer roots.Close()
+
+	dir, err := uploadDir(r)
 	if err != nil {
-		h.logger.Printf("error root opening: %v\n", err)
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		h.logger.Printf("invalid upload directory from %s: %v\n", r.RemoteAddr, err)
+		abuse.Report(r, abuse.PathTraversal)
+		h.render.Error(w, r, http.StatusBadRequest, "invalid directory", err.Error())
 		return
 	}
-	defer root.Close()
+	// Why file by date below the chosen directory? A client that picks its directory, such as
+	// a camera's, still gets one folder a day inside it rather than one ever-growing folder.
+	dir = path.Join(dir, h.uploader.DateDir(time.Now()))
+	fields, err := h.uploadFields(r.MultipartForm)
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid metadata", err.Error())
+		return
+	}
+	principal := principalFrom(r)
+	conditions := uploadConditionsFrom(r)
+	// Why decide before the loop? An upload is either answered once all of its files are
+	// stored, or as soon as they are received, never a mixture of both.
+	var job *jobs.Job
+	if h.wantsAsync(r) {
+		job = h.jobs.New(principalName(principal), conditions.createOnly())
+		job.Fields = fields
+	}
 
 	var uploadErrors []string
+	// Why count failures by status? If every file failed for the same reason a client can act
+	// on (a failed precondition, a protected file, a concurrent upload), the request as a whole
+	// is answered with that status, which conditional and sync clients expect.
+	stored := 0
+	results := make([]uploadedFile, 0)
+	failures := make(map[int]int)
+	// refuse records a file that was not stored, and the status it alone would be answered with.
+	refuse := func(fieldName string, fh *multipart.FileHeader, name string, status int, msg string) {
+		uploadErrors = append(uploadErrors, msg)
+		results = append(results, uploadedFile{Field: fieldName, Filename: sentFilename(fh), Name: name, Status: "failed", Size: fh.Size, Error: msg, Code: status})
+	}
 	// Process each file submitted in the form.
-	for fieldName, fileHeaders := range r.MultipartForm.File {
-		for _, fh := range fileHeaders {
-			// Why can fh.Open fail? This operation deals with the client-provided data.
-			// Failure here usually implies a client-side issue (e.g., malformed data)
-			// or that the server's temporary file was cleaned up prematurely.
-			file, err := fh.Open()
-			if err != nil {
-				msg := fmt.Sprintf("error getting file '%s' from field '%s'", fh.Filename, fieldName)
-				h.logger.Printf("%s: %v\n", msg, err)
-				uploadErrors = append(uploadErrors, msg)
-				continue
+fileLoop:
+	for _, ff := range form.files {
+		fieldName, fh := ff.field, ff.header
+		// Why not fh.Filename? The multipart reader strips it down to its base name,
+		// flattening folder uploads. uploadPath recovers the relative path instead.
+		name, err := uploadPath(fh)
+		if err != nil {
+			msg := fmt.Sprintf("invalid file name '%s': %v", fh.Filename, err)
+			h.logger.Printf("%s from %s\n", msg, r.RemoteAddr)
+			if !errors.Is(err, errNoFileName) {
+				abuse.Report(r, abuse.PathTraversal)
 			}
+			refuse(fieldName, fh, "", http.StatusBadRequest, msg)
+			continue
+		}
+		name = path.Join(dir, h.storedName(name))
 
-			// Why create the file with 'root.Create'? For security.
-			// This guarantees the file is created inside the sandboxed storage directory.
-			dst, err := root.Create(fh.Filename)
-			if err != nil {
-				// Failure here indicates a server-side problem (e.g., file permissions, disk space).
-				msg := fmt.Sprintf("error creating file '%s'", fh.Filename)
+		if ff.tooLarge {
+			status, msg := h.tooLargeFile(form, ff, limit, name)
+			h.logger.Printf("%s from %s\n", msg, r.RemoteAddr)
+			refuse(fieldName, fh, name, status, msg)
+			failures[status]++
+			continue
+		}
+
+		// Why check the ACL per file? Each file may land in a differently protected
+		// directory, and a denied file must not prevent its siblings from being stored.
+		if !h.acl.Allowed(principal, acl.Write, name) {
+			msg := fmt.Sprintf("permission denied for file '%s'", name)
+			h.logger.Printf("%s from %s\n", msg, r.RemoteAddr)
+			refuse(fieldName, fh, name, http.StatusForbidden, msg)
+			continue
+		}
+
+		root, err := roots.Open(name)
+		if err != nil {
+			msg := fmt.Sprintf("error opening the directory of file '%s'", name)
+			h.logger.Printf("%s: %v\n", msg, err)
+			refuse(fieldName, fh, name, storageErrorStatus(err), msg)
+			continue
+		}
+
+		// If-Match and If-None-Match let sync clients create a file only if it does not
+		// exist yet, or replace only the version they last saw.
+		if err := conditions.check(root, name); err != nil {
+			msg, status := fmt.Sprintf("precondition failed for file '%s'", name), http.StatusPreconditionFailed
+			if errors.Is(err, errPreconditionFailed) {
+				failures[status]++
+			} else {
+				msg, status = fmt.Sprintf("error checking file '%s'", name), http.StatusInternalServerError
 				h.logger.Printf("%s: %v\n", msg, err)
-				uploadErrors = append(uploadErrors, msg)
-				file.Close() // Ensure the source file handle is closed on error.
-				continue
 			}
+			refuse(fieldName, fh, name, status, msg)
+			continue
+		}
 
-			// Why use a buffer for copying? To stream the file content efficiently
-			// without loading the entire file into memory at once, which is crucial for large files.
-			buf := make([]byte, 1<<20) // 1 MB buffer
-			_, err = io.CopyBuffer(dst, file, buf)
-			if err != nil {
-				// An I/O error occurred whilst writing to the server's filesystem.
-				msg := fmt.Sprintf("error writing file '%s'", fh.Filename)
+		// Held files, and write-once files within their retention, must not be replaced.
+		if err := h.checkProtected(root, principal, name, "overwrite"); err != nil {
+			msg, status := fmt.Sprintf("file '%s' cannot be overwritten: %v", name, err), protectedStatus(err)
+			if errors.Is(err, errHeld) || errors.Is(err, errRetained) {
+				failures[status]++
+			} else {
+				msg, status = fmt.Sprintf("error checking file '%s'", name), http.StatusInternalServerError
 				h.logger.Printf("%s: %v\n", msg, err)
-				uploadErrors = append(uploadErrors, msg)
+			}
+			refuse(fieldName, fh, name, status, msg)
+			continue
+		}
 
-				// Ensure all opened resources for this file are closed on error.
-				file.Close()
-				dst.Close()
+		modified, err := clientModified(fh, r.MultipartForm)
+		if err != nil {
+			refuse(fieldName, fh, name, http.StatusBadRequest, fmt.Sprintf("file '%s' has a %v", name, err))
+			failures[http.StatusBadRequest]++
+			continue
+		}
+
+		// Why can opening the file fail? Files too large to be kept in memory are spooled to
+		// temporary files, which may have been cleaned up prematurely.
+		file, err := ff.open()
+		if err != nil {
+			msg := fmt.Sprintf("error getting file '%s' from field '%s'", name, fieldName)
+			h.logger.Printf("%s: %v\n", msg, err)
+			refuse(fieldName, fh, name, http.StatusInternalServerError, msg)
+			continue
+		}
 
-				// It's good practice to remove the partial file to avoid leaving corrupted data.
-				if removeErr := os.Remove(filepath.Join(h.uploader.StorageDir, fh.Filename)); removeErr != nil {
-					h.logger.Printf("failed to remove partial file '%s': %v\n", fh.Filename, removeErr)
+		if job != nil {
+			// Only the checks that need nothing but the request are made whilst the client
+			// waits; validating and storing the file is left to the job.
+			err := h.jobs.Stage(job, jobs.File{Name: name, ContentDigest: fh.Header.Get("Content-Digest"), Modified: modified}, newContextReader(r.Context(), file))
+			file.Close()
+			if err != nil {
+				msg := fmt.Sprintf("error receiving file '%s'", name)
+				h.logger.Printf("%s: %v\n", msg, err)
+				refuse(fieldName, fh, name, storageErrorStatus(err), msg)
+				if r.Context().Err() != nil {
+					break fileLoop
 				}
 				continue
 			}
-			// Why close handles inside the loop? Using defer would leak file descriptors
-			// until the handler returns, potentially exhausting system resources on requests with many files.
+			stored++
+			continue
+		}
+
+		// Why validate before creating the file? A rejected file must never be visible,
+		// nor replace the version already stored under its name.
+		if fail := h.checkUpload("from "+r.RemoteAddr, principalName(principal), name, fh, file); fail != nil {
+			refuse(fieldName, fh, name, fail.httpStatus(), fail.msg)
+			if fail.status != 0 {
+				failures[fail.status]++
+			}
 			file.Close()
-			dst.Close()
+			continue
+		}
+
+		// The source is wrapped so the copy stops as soon as the client disconnects.
+		start := time.Now()
+		sum, fail := h.storeUpload(root, name, newContextReader(r.Context(), file), conditions.createOnly(), principalName(principal), fh.Size)
+		// Why close handles inside the loop? Using defer would leak file descriptors
+		// until the handler returns, potentially exhausting system resources on requests with many files.
+		file.Close()
+		if fail != nil {
+			refuse(fieldName, fh, name, fail.httpStatus(), fail.msg)
+			if fail.status != 0 {
+				failures[fail.status]++
+			}
+			// Why stop entirely on cancellation? The client is gone, so storing the
+			// remaining files would only consume disk for an upload it considers failed.
+			if r.Context().Err() != nil {
+				h.logger.Printf("client %s disconnected, abandoning remaining uploads\n", r.RemoteAddr)
+				break fileLoop
+			}
+			continue
+		}
+		transfer := newTransferStats(fh.Size, ff.received, time.Since(start))
+		h.logger.Printf("file '%s' from %s stored: %d bytes %s\n", name, r.RemoteAddr, fh.Size, transfer)
+		// Why set the fields even if there are none? They describe the upload, so a file
+		// uploaded again without a description no longer has the old one.
+		if err := h.setClientModified(root, name, modified, sum); err != nil {
+			h.logger.Printf("error setting modification time of '%s': %v\n", name, err)
+		}
+		h.fileMeta.SetFields(name, fields)
+		results = append(results, uploadedFile{
+			Field:    fieldName,
+			Filename: sentFilename(fh),
+			Name:     name,
+			Status:   "stored",
+			Size:     fh.Size,
+			SHA256:   sum,
+			URL:      h.basePath + "/download/" + escapePath(name),
+			Transfer: transfer,
+		})
+		stored++
+	}
+
+	// A body that went over its limit outside a file still lost the parts after it.
+	if form.truncated && !form.files[len(form.files)-1].tooLarge {
+		uploadErrors = append(uploadErrors, fmt.Sprintf("the upload exceeds the limit of %d bytes, and the parts after file '%s' were not read", limit.bytes, sentFilename(form.files[len(form.files)-1].header)))
+	}
+
+	if r.Context().Err() != nil {
+		if job != nil {
+			h.jobs.Discard(job)
 		}
+		return
+	}
+
+	if job != nil {
+		if stored > 0 {
+			job.Errors = uploadErrors
+			h.acceptJob(w, r, job)
+			return
+		}
+		// With nothing to process, the upload is answered as if it were synchronous.
+		h.jobs.Discard(job)
 	}
 
 	// Why check for upload errors? To provide clear feedback to the client
 	// about which files, if any, failed to process.
-	if len(uploadErrors) > 0 {
-		errData, err := json.MarshalIndent(uploadErrors, "", "\t")
-		if err != nil {
-			h.logger.Printf("error marshalling uploadErrors to json: %v\n", err)
+	status, msg := http.StatusOK, "all files uploaded successfully"
+	for s, n := range failures {
+		if stored == 0 && n == len(uploadErrors) {
+			status, msg = s, uploadFailureMessage(s)
 		}
+	}
+	if status == http.StatusOK && len(uploadErrors) > 0 {
 		// Why StatusMultiStatus? It correctly signals that the request was partially
 		// successful, as some files may have been saved whilst others failed.
-		http.Error(w, string(errData), http.StatusMultiStatus)
-		return
+		status, msg = http.StatusMultiStatus, "some files failed to upload"
 	}
 
+	if acceptsJSON(r) {
+		h.render.JSON(w, status, uploadResults{
+			Status:  status,
+			Error:   errorText(status),
+			Message: msg,
+			Details: uploadErrors,
+			Stored:  stored,
+			Failed:  len(results) - stored,
+			Files:   results,
+		})
+		return
+	}
+	if status != http.StatusOK {
+		h.render.Error(w, r, status, msg, uploadErrors...)
+		return
+	}
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 
@@ -152,102 +541,263 @@ func (h *Handlers) UploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// uploadFailureMessage describes an upload in which every file failed with status.
+func uploadFailureMessage(status int) string {
+	switch status {
+	case http.StatusPreconditionFailed:
+		return "precondition failed"
+	case http.StatusConflict:
+		return "files are being written by another upload"
+	case http.StatusLocked, http.StatusForbidden:
+		return "protected files cannot be overwritten"
+	case http.StatusUnsupportedMediaType:
+		return "file type is not allowed"
+	case http.StatusUnprocessableEntity:
+		return "files were rejected"
+	case http.StatusRequestEntityTooLarge:
+		return "files exceed the maximum size"
+	case http.StatusTooManyRequests:
+		return "upload quota exceeded"
+	case http.StatusBadRequest:
+		return "malformed upload"
+	default:
+		return "no files were uploaded"
+	}
+}
+
 // DownloadHandle serves a specific file from the storage directory.
 func (h *Handlers) DownloadHandle(w http.ResponseWriter, r *http.Request) {
-	h.logger.Printf("received request from %s for %s\n", r.RemoteAddr, r.URL.Path)
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
 	defer cleanupRequest(r)
 
-	if r.Method != http.MethodGet {
-		http.Error(w, "method must be GET", http.StatusMethodNotAllowed)
+	// Why PathValue? The router has already matched "GET /download/{name...}", so the
+	// remainder of the path is available as a wildcard without any manual prefix trimming.
+	fileName := r.PathValue("name")
+	if fileName == "" {
+		h.render.Error(w, r, http.StatusBadRequest, "file name is not indicated")
 		return
 	}
+	h.sendFile(w, r, fileName, "")
+}
 
-	const downloadPrefix = "/download/"
-	fileName := strings.TrimPrefix(r.URL.Path, downloadPrefix)
-	if fileName == "" {
-		http.Error(w, "file name is not indicated", http.StatusBadRequest)
+// sendFile serves the stored file fileName: as a download, or with mediaType set, for display
+// in the browser as that type.
+func (h *Handlers) sendFile(w http.ResponseWriter, r *http.Request, fileName, mediaType string) {
+	if h.hiddenFile(w, r, fileName) {
+		return
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Read, fileName) {
+		h.denyAccess(w, r)
 		return
 	}
+	if h.serveStored(w, r, fileName, mediaType) {
+		return
+	}
+	if h.upstream == nil {
+		h.render.Error(w, r, http.StatusNotFound, "file is not found")
+		return
+	}
+	// A mirror fetches the files it does not have yet from its upstream, and serves them as
+	// if they had been stored all along.
+	if !h.pullFromMirror(w, r, fileName) {
+		return
+	}
+	if !h.serveStored(w, r, fileName, mediaType) {
+		// Deleted again straight after it was pulled.
+		h.render.Error(w, r, http.StatusNotFound, "file is not found")
+	}
+}
 
+// serveStored serves the stored file fileName, as sendFile does. It reports false, without
+// answering the request, if there is no such file.
+func (h *Handlers) serveStored(w http.ResponseWriter, r *http.Request, fileName, mediaType string) bool {
 	// Why OpenRoot? For security. This ensures that the requested file path
 	// is resolved strictly within the storage directory, preventing path traversal vulnerabilities.
-	root, err := os.OpenRoot(h.uploader.StorageDir)
+	root, err := h.storage.OpenRoot(fileName)
 	if err != nil {
-		// Failure here is an internal server error as the storage directory should be accessible.
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
+		// The storage directory is created lazily by the first upload, so until then
+		// every file is simply not found.
+		if errors.Is(err, fs.ErrNotExist) {
+			return false
+		}
+		// Any other failure is an internal server error as the storage directory should be accessible.
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return true
 	}
 	defer root.Close()
 
-	file, err := root.Open(fileName)
+	// Why consult the cache before opening the file? A hit then costs a single stat, which
+	// also catches files that were changed on disk behind the server's back. The symlink
+	// policy is applied first all the same, as a cached file may be reached through a link.
+	err = h.checkSymlinks(root, fileName, false)
+	cacheKey := path.Clean(fileName)
+	if entry, ok := h.fileCache.Get(cacheKey); ok && err == nil {
+		if info, err := root.Stat(fileName); err == nil && entry.Matches(info) {
+			h.serveFile(w, r, fileName, mediaType, entry.ModTime, int64(len(entry.Data)), bytes.NewReader(entry.Data))
+			return true
+		}
+		h.fileCache.Invalidate(cacheKey)
+	}
+
+	var file storage.File
+	if err == nil {
+		file, err = root.Open(fileName)
+	}
 	if err != nil {
-		// We assume the file doesn't exist if opening it fails.
-		http.Error(w, "file is not found", http.StatusNotFound)
-		return
+		status := openErrorStatus(err)
+		if status == http.StatusNotFound {
+			return false
+		}
+		h.logger.Printf("error opening file '%s': %v\n", fileName, err)
+		h.render.Error(w, r, status, "unable to open file")
+		return true
 	}
 	defer file.Close()
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		http.Error(w, "unable to access file", http.StatusInternalServerError)
-		return
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return true
 	}
 
 	if fileInfo.IsDir() {
-		http.Error(w, "requested path is a directory", http.StatusForbidden)
-		return
+		h.render.Error(w, r, http.StatusForbidden, "requested path is a directory")
+		return true
 	}
 
-	// Set headers to instruct the browser to download the file rather than displaying it.
-	// Content-Length allows the browser to show download progress.
-	w.Header().Set("Content-Length", fmt.Sprint(fileInfo.Size()))
-	// application/octet-stream is a generic MIME type for binary data.
-	w.Header().Set("Content-Type", "application/octet-stream")
-	// Content-Disposition with 'attachment' suggests a "Save As" dialogue.
-	// Why filepath.Base? For security, to sanitise the filename and prevent header injection attacks
-	// where a malicious filename could manipulate the HTTP response.
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filepath.Base(fileName)))
-	// Explicitly write headers before the body. This is good practice as it finalises the response status.
-	w.WriteHeader(http.StatusOK)
+	// Small files are read whole so the next request can be answered from memory.
+	var content io.ReadSeeker = file
+	if h.fileCache.Fits(fileInfo.Size()) {
+		data, err := io.ReadAll(file)
+		if err != nil {
+			h.logger.Printf("error reading file '%s': %v\n", fileName, err)
+			h.render.Error(w, r, http.StatusInternalServerError, "unable to read file")
+			return true
+		}
+		// A file that changed size whilst being read is served as read, but not cached.
+		if int64(len(data)) == fileInfo.Size() {
+			h.fileCache.Put(cacheKey, data, fileInfo.ModTime())
+		}
+		content = bytes.NewReader(data)
+	}
 
-	_, err = io.Copy(w, file)
-	if err != nil {
-		h.logger.Printf("Error transferring file %s: %v\n", fileName, err)
-		return
+	h.serveFile(w, r, fileName, mediaType, fileInfo.ModTime(), fileInfo.Size(), content)
+	return true
+}
+
+// serveFile writes content as the download of fileName, or with mediaType set, as its inline
+// content of that type.
+//
+// Why http.ServeContent? It implements Range requests, including multipart/byteranges
+// responses for several ranges, which download accelerators and PDF viewers rely on, as well
+// as HEAD and conditional requests. It copies through the download writer, which stops as soon as
+// the client disconnects and extends the write deadline chunk by chunk, so large files are not
+// cut off by WriteTimeout; an unwrapped *os.File is still sent with sendfile.
+func (h *Handlers) serveFile(w http.ResponseWriter, r *http.Request, fileName, mediaType string, modTime time.Time, size int64, content io.ReadSeeker) {
+	h.setDownloadHeaders(w, fileName, mediaType)
+	// ServeContent answers If-None-Match and If-Range from the ETag, and clients can send it
+	// back in If-Match to guard an upload that replaces this version of the file.
+	w.Header().Set("ETag", fileETag(modTime, size))
+	dw := h.newDownloadWriter(w, r)
+	http.ServeContent(dw, r, fileName, modTime, content)
+	// A download cut short, or answered from the client's cache, still shows the file is
+	// wanted, and so keeps it from being evicted.
+	if r.Method == http.MethodGet {
+		h.fileMeta.Downloaded(fileName)
 	}
+	if dw.err != nil {
+		if clientGone(r, dw.err) {
+			h.logger.Printf("client %s disconnected during download of %s\n", r.RemoteAddr, fileName)
+			return
+		}
+		h.logger.Printf("Error transferring file %s: %v\n", fileName, dw.err)
+	}
+}
+
+// setDownloadHeaders sets the response headers for a successful download of fileName, or
+// with mediaType set, for showing it inline. Content-Length and the range headers are left to
+// http.ServeContent.
+func (h *Handlers) setDownloadHeaders(w http.ResponseWriter, fileName, mediaType string) {
+	// Why path.Base? Only the file's own name is offered, not the directories it is stored in.
+	if mediaType != "" {
+		w.Header().Set("Content-Type", mediaType)
+		w.Header().Set("Content-Disposition", contentDisposition("inline", path.Base(fileName)))
+	} else {
+		// application/octet-stream is a generic MIME type for binary data, and instructs the
+		// browser to download the file rather than displaying it.
+		w.Header().Set("Content-Type", "application/octet-stream")
+		// Content-Disposition with 'attachment' suggests a "Save As" dialogue.
+		w.Header().Set("Content-Disposition", contentDisposition("attachment", path.Base(fileName)))
+	}
+	// Set only once the file has been found, so that error responses are never cached under its policy.
+	if cc := h.cache.header(fileName); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+}
+
+// contentDisposition builds an RFC 6266 header of the given kind, "attachment" or "inline",
+// for name.
+//
+// Why two parameters? filename* carries the exact name, percent-encoded as UTF-8 (RFC 5987),
+// and is preferred by every current browser. The quoted filename is a sanitised ASCII fallback
+// for older clients: characters that cannot appear in it safely (non-ASCII, control characters,
+// quotes and backslashes) are replaced, which also rules out header injection.
+func contentDisposition(kind, name string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range name {
+		if r < 0x20 || r >= 0x7f || r == '"' || r == '\\' {
+			fallback.WriteByte('_')
+		} else {
+			fallback.WriteRune(r)
+		}
+	}
+	for _, b := range []byte(name) {
+		if isAttrChar(b) {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, kind, fallback.String(), encoded.String())
+}
+
+// isAttrChar reports whether b may appear unencoded in an RFC 5987 extended parameter value.
+func isAttrChar(b byte) bool {
+	switch {
+	case 'a' <= b && b <= 'z', 'A' <= b && b <= 'Z', '0' <= b && b <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$&+-.^_`|~", b) >= 0
 }
 
 // DownloadList serves a plain text file containing a list of all available files.
 func (h *Handlers) DownloadList(w http.ResponseWriter, r *http.Request) {
-	h.logger.Printf("received request from %s for %s\n", r.RemoteAddr, r.URL.Path)
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
 	defer cleanupRequest(r)
 
-	if r.Method != http.MethodGet {
-		http.Error(w, "method must be GET", http.StatusMethodNotAllowed)
+	principal := principalFrom(r)
+
+	// Why the index? Walking the storage directory on every request is slow for large
+	// collections, so the listing is served from memory instead.
+	var names []string
+	for _, name := range h.index.List() {
+		// Files the caller may not read are left out, so protected names do not leak.
+		if h.hidden.hidden(name) || !h.acl.Allowed(principal, acl.Read, name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	if acceptsJSON(r) {
+		h.listFilesJSON(w, r, names)
 		return
 	}
 
-	// Why strings.Builder? To efficiently build the list in memory.
 	var sb strings.Builder
 	sb.WriteString("Files currently available:\n")
-	err := filepath.WalkDir(h.uploader.StorageDir, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			return err
-		}
-		if d.IsDir() {
-			return nil
-		}
-		relPath, err := filepath.Rel(h.uploader.StorageDir, path)
-		if err != nil {
-			return err
-		}
-		sb.WriteString(relPath)
+	for _, name := range names {
+		sb.WriteString(name)
 		sb.WriteByte('\n')
-		return nil
-	})
-	if err != nil {
-		http.Error(w, "internal error", http.StatusInternalServerError)
-		return
 	}
 	fileList := sb.String()
 
@@ -255,12 +805,346 @@ func (h *Handlers) DownloadList(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.Header().Set("Content-Disposition", "attachment; filename=list.txt")
 	w.WriteHeader(http.StatusOK)
-	if _, err = w.Write([]byte(fileList)); err != nil {
+	if _, err := w.Write([]byte(fileList)); err != nil {
 		h.logger.Printf("error writing response: %s\n", err)
 		return
 	}
 }
 
+// listedFile describes a stored file in the JSON listing.
+type listedFile struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	// Metadata holds the form fields the file was uploaded with, as in its details.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// listFilesJSON answers a listing of names with their sizes and modification times, which
+// sync clients compare with their own copies to tell what changed, and the fields they were
+// uploaded with.
+func (h *Handlers) listFilesJSON(w http.ResponseWriter, r *http.Request, names []string) {
+	files := make([]listedFile, 0, len(names))
+	roots := storage.NewRoots(h.storage)
+	defer roots.Close()
+	for _, name := range names {
+		root, err := roots.Open(name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			h.logger.Printf("error root opening: %v\n", err)
+			h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+			return
+		}
+		info, err := root.Stat(name)
+		if err != nil || !info.Mode().IsRegular() {
+			// Removed since the index was last updated.
+			continue
+		}
+		files = append(files, listedFile{Name: name, Size: info.Size(), Modified: info.ModTime().UTC(), Metadata: h.fileMeta.Fields(name)})
+	}
+	h.render.JSON(w, http.StatusOK, struct {
+		Files []listedFile `json:"files"`
+	}{files})
+}
+
+// uploadFailure describes a file of an upload that was not stored.
+type uploadFailure struct {
+	// status is the status the whole upload is answered with if every file failed alike, or
+	// 0 for failures the client cannot act on, such as server errors.
+	status int
+	msg    string
+}
+
+// httpStatus returns the status a request storing only this file is answered with.
+func (f *uploadFailure) httpStatus() int {
+	if f.status == 0 {
+		return http.StatusInternalServerError
+	}
+	return f.status
+}
+
+// checkUpload runs the configured checks on an uploaded file about to be stored at name,
+// quarantining it if it is rejected. from describes where the file came from, for the log.
+func (h *Handlers) checkUpload(from, user, name string, fh *multipart.FileHeader, file multipart.File) *uploadFailure {
+	// Files are only routed to their owner by the path of single-file requests; those in the
+	// body of an upload may belong elsewhere.
+	if !h.cluster.Owns(name) {
+		owner := h.cluster.Owner(name)
+		h.logger.Printf("file '%s' %s refused: it belongs to node %s\n", name, from, owner.Name)
+		return &uploadFailure{http.StatusMisdirectedRequest, fmt.Sprintf("file '%s' belongs to node %s at %s", name, owner.Name, owner.URL)}
+	}
+	if err := h.hidden.checkWrite(name); err != nil {
+		h.logger.Printf("file '%s' %s refused: %v\n", name, from, err)
+		return &uploadFailure{http.StatusUnprocessableEntity, fmt.Sprintf("file '%s' is refused: %v", name, err)}
+	}
+	if err := h.checkDirQuotas(name, fh.Size, ""); err != nil {
+		h.logger.Printf("file '%s' %s refused: %v\n", name, from, err)
+		return &uploadFailure{http.StatusInsufficientStorage, fmt.Sprintf("file '%s' does not fit: %v", name, err)}
+	}
+	err := h.validator.validate(name, fh, file)
+	var rej *rejection
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &rej):
+		return &uploadFailure{rej.status, h.rejectUpload(from, user, name, file, rej)}
+	case errors.Is(err, errMalformedDigest):
+		return &uploadFailure{http.StatusBadRequest, fmt.Sprintf("file '%s' has a %v", name, err)}
+	}
+	msg := fmt.Sprintf("error validating file '%s'", name)
+	h.logger.Printf("%s: %v\n", msg, err)
+	return &uploadFailure{0, msg}
+}
+
+// storeUpload writes the content of an uploaded file to name, replacing any file there
+// unless createOnly is set, and returns its SHA-256 checksum.
+func (h *Handlers) storeUpload(root storage.Root, name string, src io.Reader, createOnly bool, user string, size int64) (string, *uploadFailure) {
+	// Recreate the uploaded folder structure. makeDirs, like root.Create below,
+	// cannot reach outside the storage directory, whatever the client sent.
+	if dir := path.Dir(name); dir != "." {
+		if err := h.makeDirs(root, dir); err != nil {
+			msg := fmt.Sprintf("error creating directory for file '%s'", name)
+			h.logger.Printf("%s: %v\n", msg, err)
+			return "", &uploadFailure{0, msg}
+		}
+	}
+
+	if err := h.checkSymlinks(root, name, true); err != nil {
+		msg := fmt.Sprintf("file '%s' would be written through a symbolic link", name)
+		h.logger.Printf("%s, refused\n", msg)
+		return "", &uploadFailure{http.StatusForbidden, msg}
+	}
+
+	// Why check the disk of each file? The files of an upload may be sharded to several
+	// disks, only some of which are low on space.
+	if h.space.Low(name) {
+		msg := fmt.Sprintf("insufficient storage for file '%s'", name)
+		h.logger.Printf("%s, refused\n", msg)
+		return "", &uploadFailure{http.StatusInsufficientStorage, msg}
+	}
+
+	// Why guard the name? Two uploads writing the same file at once would interleave
+	// their data into a corrupt result, so the later one is refused instead.
+	if !h.writing.acquire(name) {
+		msg := fmt.Sprintf("file '%s' is being written by another upload", name)
+		h.logger.Printf("%s, refused\n", msg)
+		return "", &uploadFailure{http.StatusConflict, msg}
+	}
+	// Released only once indexed, so a rescan never mistakes the file for one
+	// added outside the server.
+	defer h.writing.release(name)
+
+	// Why create the file with 'root.Create'? For security.
+	// This guarantees the file is created inside the sandboxed storage directory.
+	// Create-only uploads use O_EXCL instead, so that a file created by a concurrent
+	// request since the check above is not overwritten either.
+	var dst storage.File
+	var err error
+	if !createOnly {
+		// Truncating a file that has other hard links would empty them too.
+		if err := detach(root, name); err != nil {
+			msg := fmt.Sprintf("error replacing file '%s'", name)
+			h.logger.Printf("%s: %v\n", msg, err)
+			return "", &uploadFailure{0, msg}
+		}
+	}
+	if createOnly {
+		dst, err = root.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	} else {
+		dst, err = root.Create(name)
+	}
+	if errors.Is(err, fs.ErrExist) && createOnly {
+		return "", &uploadFailure{http.StatusPreconditionFailed, fmt.Sprintf("precondition failed for file '%s'", name)}
+	}
+	if err != nil {
+		// Failure here indicates a server-side problem (e.g., file permissions, disk space).
+		msg := fmt.Sprintf("error creating file '%s'", name)
+		h.logger.Printf("%s: %v\n", msg, err)
+		return "", &uploadFailure{0, msg}
+	}
+	if err := h.setOwnership(root, name, false); err != nil {
+		msg := fmt.Sprintf("error setting permissions of file '%s'", name)
+		h.logger.Printf("%s: %v\n", msg, err)
+		dst.Close()
+		root.Remove(name)
+		return "", &uploadFailure{0, msg}
+	}
+
+	// Why use a buffer for copying? To stream the file content efficiently
+	// without loading the entire file into memory at once, which is crucial for large files.
+	// The checksum is computed on the way, whilst the data is at hand anyway.
+	buf := make([]byte, 1<<20) // 1 MB buffer
+	hash := sha256.New()
+	var out io.Writer = dst
+	var sparse *sparseWriter
+	if h.uploader.SparseFiles {
+		sparse = &sparseWriter{f: dst}
+		out = sparse
+	}
+	_, err = io.CopyBuffer(io.MultiWriter(h.faults.Writer(name, out), hash), src, buf)
+	if err == nil && sparse != nil {
+		err = sparse.finish()
+	}
+	if err != nil {
+		// An I/O error occurred whilst writing to the server's filesystem.
+		msg := fmt.Sprintf("error writing file '%s'", name)
+		h.logger.Printf("%s: %v\n", msg, err)
+		dst.Close()
+
+		// It's good practice to remove the partial file to avoid leaving corrupted data.
+		if removeErr := root.Remove(name); removeErr != nil {
+			h.logger.Printf("failed to remove partial file '%s': %v\n", name, removeErr)
+		} else {
+			// The partial file may have replaced an indexed one of the same name.
+			h.index.Remove(name)
+			h.fileCache.Invalidate(name)
+			h.fileMeta.Remove(name)
+		}
+		// A full disk is worth telling the client about, so that it retries later rather than at once.
+		status := 0
+		if storageErrorStatus(err) == http.StatusInsufficientStorage {
+			status = http.StatusInsufficientStorage
+		}
+		return "", &uploadFailure{status, msg}
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if info, err := dst.Stat(); err == nil {
+		h.fileMeta.Record(name, info, sum)
+		h.videos.Extract(name, sum)
+	} else {
+		h.fileMeta.Update(name)
+	}
+	dst.Close()
+	h.index.Add(name)
+	h.fileCache.Invalidate(name)
+	h.notifier.Notify(notify.Event{Type: notify.Upload, Name: name, Size: size, User: user})
+	return sum, nil
+}
+
+// uploadPath returns the storage-relative path for an uploaded file part.
+//
+// Browsers uploading a folder (<input webkitdirectory>) send each file's path relative to
+// the chosen folder, e.g. "photos/2024/img.jpg", as the part's filename. That raw value is
+// read from the Content-Disposition header, normalised to forward slashes, and rejected if
+// it is absolute or climbs out of the storage directory.
+func uploadPath(fh *multipart.FileHeader) (string, error) {
+	name := strings.ReplaceAll(sentFilename(fh), "\\", "/")
+	if strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", errors.New("absolute paths are not allowed")
+	}
+	name = path.Clean(name)
+	if name == "." {
+		return "", errNoFileName
+	}
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", errors.New("path must stay within the storage directory")
+	}
+	return name, nil
+}
+
+// sentFilename returns the filename of a part as the client sent it, before the multipart
+// reader stripped it down to its base name.
+func sentFilename(fh *multipart.FileHeader) string {
+	if _, params, err := mime.ParseMediaType(fh.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	return fh.Filename
+}
+
+// uploadDir returns the directory an upload is stored in, relative to the storage directory:
+// the "dir" field of the form, or else the "dir" query parameter. It is "" for the storage
+// directory itself, and an error if the directory would lie outside it.
+func uploadDir(r *http.Request) (string, error) {
+	dir := r.MultipartForm.Value["dir"]
+	if len(dir) == 0 || dir[0] == "" {
+		dir = []string{r.URL.Query().Get("dir")}
+	}
+	name := strings.ReplaceAll(dir[0], "\\", "/")
+	if name == "" {
+		return "", nil
+	}
+	if strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", errors.New("absolute paths are not allowed")
+	}
+	name = path.Clean(name)
+	if name == ".." || strings.HasPrefix(name, "../") {
+		return "", errors.New("path must stay within the storage directory")
+	}
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+// errNoFileName is returned by uploadPath for a part without a file name. Any other error
+// means the client tried to write outside the storage directory.
+var errNoFileName = errors.New("file name is required")
+
+// maxFieldSize bounds the value of a metadata field, so that the file metadata stays small.
+const maxFieldSize = 4 << 10 // 4 KB
+
+// uploadFields returns the values of the metadata fields of an upload form, as named by
+// uploader.metadataFields, or nil if it has none.
+func (h *Handlers) uploadFields(form *multipart.Form) (map[string]string, error) {
+	var fields map[string]string
+	for _, key := range h.uploader.MetadataFields {
+		values := form.Value[key]
+		if len(values) == 0 || values[0] == "" {
+			continue
+		}
+		if len(values[0]) > maxFieldSize {
+			return nil, fmt.Errorf("field '%s' is longer than %d bytes", key, maxFieldSize)
+		}
+		if !utf8.ValidString(values[0]) {
+			return nil, fmt.Errorf("field '%s' is not UTF-8 text", key)
+		}
+		if fields == nil {
+			fields = make(map[string]string)
+		}
+		fields[key] = values[0]
+	}
+	return fields, nil
+}
+
+// tooLargeFile returns the status and message of ff, a file of form stored at name that was
+// not kept for being too large: for going over the maximum file size, or for the body going
+// over limit whilst it was sent.
+func (h *Handlers) tooLargeFile(form *uploadForm, ff *formFile, limit uploadLimit, name string) (int, string) {
+	if !form.truncated || ff != form.files[len(form.files)-1] {
+		return http.StatusRequestEntityTooLarge, fmt.Sprintf("file '%s' exceeds the maximum file size of %d bytes", name, h.uploader.GetMaxFileSize())
+	}
+	if limit.quota {
+		return http.StatusTooManyRequests, fmt.Sprintf("file '%s' exceeds the remaining upload quota of %d bytes, and no parts after it were read", name, limit.bytes)
+	}
+	return http.StatusRequestEntityTooLarge, fmt.Sprintf("file '%s' exceeds the maximum upload size of %d bytes, and no parts after it were read", name, limit.bytes)
+}
+
+// rejectTooLarge answers an upload that exceeds the maximum upload size with 413 and the
+// configured limit. The connection is closed afterwards, as the rest of the body is never read.
+func (h *Handlers) rejectTooLarge(w http.ResponseWriter, r *http.Request, limit int64) {
+	h.logger.Printf("upload from %s exceeds the limit of %d bytes\n", r.RemoteAddr, limit)
+	w.Header().Set("Connection", "close")
+	h.render.TooLarge(w, r, "request body exceeds the maximum upload size", limit)
+}
+
+// principalFrom returns the authenticated caller of a request, or nil for anonymous callers.
+func principalFrom(r *http.Request) *auth.Principal {
+	p, _ := auth.FromContext(r.Context())
+	return p
+}
+
+// denyAccess rejects a request that the ACL does not permit. Anonymous callers are told to
+// authenticate (401), whereas authenticated callers simply lack permission (403).
+func (h *Handlers) denyAccess(w http.ResponseWriter, r *http.Request) {
+	if principalFrom(r) == nil {
+		h.render.Error(w, r, http.StatusUnauthorized, "authentication required")
+		return
+	}
+	h.render.Error(w, r, http.StatusForbidden, "access denied")
+}
+
 // Why have cleanupRequest? To ensure TCP connections can be reused (HTTP Keep-Alive).
 // By reading and discarding the remainder of the request body, we ensure the connection
 // is left in a clean state, ready for the next request.
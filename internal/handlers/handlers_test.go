@@ -0,0 +1,439 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/diskspace"
+	"github.com/mascotmascot1/fileserver/internal/filecache"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+func TestContentDisposition(t *testing.T) {
+	tests := []struct {
+		desc         string
+		name         string
+		want         string
+		wantFallback string
+	}{
+		{"an ASCII name", "report-2024.pdf", `attachment; filename="report-2024.pdf"; filename*=UTF-8''report-2024.pdf`, "report-2024.pdf"},
+		{"spaces", "annual report.pdf", `attachment; filename="annual report.pdf"; filename*=UTF-8''annual%20report.pdf`, "annual report.pdf"},
+		{"accents", "résumé.pdf", `attachment; filename="r_sum_.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9.pdf`, "r_sum_.pdf"},
+		{"another script", "отчёт.txt", `attachment; filename="_____.txt"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.txt`, "_____.txt"},
+		{"quotes and backslashes", `say "hi"\bye.txt`, `attachment; filename="say _hi__bye.txt"; filename*=UTF-8''say%20%22hi%22%5Cbye.txt`, "say _hi__bye.txt"},
+		{"a header injection", "a.txt\r\nSet-Cookie: x=1", `attachment; filename="a.txt__Set-Cookie: x=1"; filename*=UTF-8''a.txt%0D%0ASet-Cookie%3A%20x%3D1`, "a.txt__Set-Cookie: x=1"},
+		{"parameter separators", "a;b=c.txt", `attachment; filename="a;b=c.txt"; filename*=UTF-8''a%3Bb%3Dc.txt`, "a;b=c.txt"},
+		{"percent signs", "100%.txt", `attachment; filename="100%.txt"; filename*=UTF-8''100%25.txt`, "100%.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := contentDisposition("attachment", tt.name)
+			if got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if strings.ContainsAny(got, "\r\n") {
+				t.Fatal("header holds a line break")
+			}
+			// A client that reads filename* gets the exact name back.
+			disposition, params, err := mime.ParseMediaType(got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if disposition != "attachment" || params["filename"] != tt.name {
+				t.Errorf("parsed as %s with filename %q, want attachment with %q", disposition, params["filename"], tt.name)
+			}
+			// One that does not gets the fallback.
+			if _, params, _ := mime.ParseMediaType(got[:strings.Index(got, "; filename*=")]); params["filename"] != tt.wantFallback {
+				t.Errorf("fallback %q, want %q", params["filename"], tt.wantFallback)
+			}
+		})
+	}
+	if got, want := contentDisposition("inline", "a.pdf"), `inline; filename="a.pdf"; filename*=UTF-8''a.pdf`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+// TestDownloadContentDisposition checks that a download offers the file's own name, without
+// the directories it is stored in.
+func TestDownloadContentDisposition(t *testing.T) {
+	h := newTestHandlers(t, openTestTree(t, "docs/2024/résumé final.pdf"), nil)
+	r := httptest.NewRequest(http.MethodGet, "/download/docs/2024/r%C3%A9sum%C3%A9%20final.pdf", nil)
+	r.SetPathValue("name", "docs/2024/résumé final.pdf")
+	w := httptest.NewRecorder()
+	h.DownloadHandle(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	want := `attachment; filename="r_sum_ final.pdf"; filename*=UTF-8''r%C3%A9sum%C3%A9%20final.pdf`
+	if got := w.Header().Get("Content-Disposition"); got != want {
+		t.Errorf("got Content-Disposition %s, want %s", got, want)
+	}
+}
+
+// upload sends parts to the upload handler as an admin, and returns the response.
+func upload(t *testing.T, h *Handlers, target string, parts ...formPart) *httptest.ResponseRecorder {
+	t.Helper()
+	body, contentType := encodeForm(t, parts...)
+	r := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	h.UploadHandler(w, asAdmin(r))
+	return w
+}
+
+func TestUploadPath(t *testing.T) {
+	tests := []struct {
+		desc    string
+		sent    string // the filename of the part, as the client sent it
+		want    string
+		wantErr bool
+	}{
+		{"a plain name", "a.txt", "a.txt", false},
+		{"a folder upload", "photos/2024/img.jpg", "photos/2024/img.jpg", false},
+		{"Windows separators", `photos\2024\img.jpg`, "photos/2024/img.jpg", false},
+		{"redundant elements", "photos/./2024//img.jpg", "photos/2024/img.jpg", false},
+		{"a climb that stays inside", "photos/../img.jpg", "img.jpg", false},
+		{"an absolute path", "/etc/passwd", "", true},
+		{"an absolute Windows path", `\Windows\win.ini`, "", true},
+		{"a climb out", "../secret.txt", "", true},
+		{"a climb out after a folder", "photos/../../secret.txt", "", true},
+		{"the parent directory", "..", "", true},
+		{"the storage directory", "photos/..", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// As the multipart reader leaves it: the base name in Filename, the full name
+			// only in the header.
+			fh := &multipart.FileHeader{
+				Filename: filepath.Base(tt.sent),
+				Header:   textproto.MIMEHeader{"Content-Disposition": {mime.FormatMediaType("form-data", map[string]string{"name": "file", "filename": tt.sent})}},
+			}
+			got, err := uploadPath(fh)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("got %q, %v, want %q, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestFolderUpload checks that the folders of an upload are recreated, and that a file that
+// would land outside the storage directory is refused without its siblings being.
+func TestFolderUpload(t *testing.T) {
+	root := openTestTree(t, "a.txt")
+	h := newTestHandlers(t, root, nil)
+	w := upload(t, h, "/upload",
+		formPart{"file", "photos/2024/img.jpg", "image"},
+		formPart{"file", "../escaped.txt", "escaped"},
+		formPart{"file", "photos/notes.txt", "notes"},
+	)
+	if w.Code != http.StatusMultiStatus {
+		t.Errorf("got status %d %s, want %d", w.Code, w.Body, http.StatusMultiStatus)
+	}
+	for name, want := range map[string]string{"photos/2024/img.jpg": "image", "photos/notes.txt": "notes"} {
+		if b, err := root.ReadFile(name); err != nil || string(b) != want {
+			t.Errorf("%s holds %q, %v, want %q", name, b, err, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(root.Name()), "escaped.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file stored outside the storage directory: %v", err)
+	}
+}
+
+// TestUploadDir checks that uploads are stored in the directory named by the dir field or
+// query parameter, and that one outside the storage directory is refused.
+func TestUploadDir(t *testing.T) {
+	tests := []struct {
+		desc       string
+		query      string
+		field      string
+		wantStatus int
+		want       []string // the files stored
+	}{
+		{"a field", "", "reports/2024", http.StatusOK, []string{"reports/2024/q3.pdf", "reports/2024/photos/img.jpg"}},
+		{"a query parameter", "?dir=reports", "", http.StatusOK, []string{"reports/q3.pdf", "reports/photos/img.jpg"}},
+		{"a field over a query parameter", "?dir=reports", "archive", http.StatusOK, []string{"archive/q3.pdf", "archive/photos/img.jpg"}},
+		{"Windows separators", "", `reports\2024`, http.StatusOK, []string{"reports/2024/q3.pdf"}},
+		{"the storage directory", "", "reports/..", http.StatusOK, []string{"q3.pdf", "photos/img.jpg"}},
+		{"an absolute path", "", "/etc", http.StatusBadRequest, nil},
+		{"a climb out", "?dir=../outside", "", http.StatusBadRequest, nil},
+		{"a climb out after a folder", "", "reports/../../outside", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			root := openTestTree(t)
+			h := newTestHandlers(t, root, nil)
+			parts := []formPart{{"file", "q3.pdf", "report"}, {"file", "photos/img.jpg", "image"}}
+			if tt.field != "" {
+				parts = append([]formPart{{"dir", "", tt.field}}, parts...)
+			}
+			w := upload(t, h, "/upload"+tt.query, parts...)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			for _, name := range tt.want {
+				if !exists(t, root, name) {
+					t.Errorf("%s not stored", name)
+				}
+			}
+			if tt.want == nil && exists(t, root, "q3.pdf") {
+				t.Error("stored a file of a refused upload")
+			}
+		})
+	}
+}
+
+// TestDateDirs checks that uploads are filed into a directory for the day, below the one
+// chosen by the client.
+func TestDateDirs(t *testing.T) {
+	root := openTestTree(t)
+	h := newTestHandlers(t, root, nil)
+	h.uploader.DateDirs = "{year}/{month}/{day}"
+	day := time.Now().Format("2006/01/02")
+	w := upload(t, h, "/upload?dir=camera", formPart{"file", "img.jpg", "image"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	// The day may have turned during the upload.
+	after := time.Now().Format("2006/01/02")
+	if !exists(t, root, path.Join("camera", day, "img.jpg")) && !exists(t, root, path.Join("camera", after, "img.jpg")) {
+		t.Errorf("camera/%s/img.jpg not stored", day)
+	}
+}
+
+// readCounter is a request body that counts the bytes read from it.
+type readCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	n, err := rc.r.Read(p)
+	rc.n += int64(n)
+	return n, err
+}
+
+// TestTooLarge checks that requests over a limit are answered 413 with the limit, and that
+// an upload declared over it is refused unread, on a connection that is then closed.
+func TestTooLarge(t *testing.T) {
+	upload, contentType := encodeForm(t, formPart{"file", "big.bin", strings.Repeat("x", 2<<20)})
+	batch, _ := json.Marshal(map[string]any{"operations": []batchOperation{{Op: "delete", Path: strings.Repeat("x", 2<<20)}}})
+	tests := []struct {
+		desc       string
+		target     string
+		body       []byte
+		declared   bool // whether Content-Length is sent
+		wantLimit  int64
+		wantUnread bool
+	}{
+		{"an upload declared over the limit", "/upload", upload, true, 1 << 20, true},
+		{"an upload over the limit, of undeclared length", "/upload", upload, false, 1 << 20, false},
+		{"a batch over the limit", "/api/batch", batch, true, maxBatchBodySize, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h := newTestHandlers(t, openTestTree(t), nil)
+			h.uploader.MaxUploadSizeMB = 1
+			body := &readCounter{r: bytes.NewReader(tt.body)}
+			r := httptest.NewRequest(http.MethodPost, tt.target, body)
+			r.ContentLength = -1
+			if tt.declared {
+				r.ContentLength = int64(len(tt.body))
+			}
+			w := httptest.NewRecorder()
+			if tt.target == "/upload" {
+				r.Header.Set("Content-Type", contentType)
+				h.UploadHandler(w, asAdmin(r))
+			} else {
+				r.Header.Set("Content-Type", "application/json")
+				h.BatchHandler(w, asAdmin(r))
+			}
+			if w.Code != http.StatusRequestEntityTooLarge {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusRequestEntityTooLarge)
+			}
+			var got respond.ErrorBody
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got.LimitBytes != tt.wantLimit {
+				t.Errorf("got limitBytes %d, want %d", got.LimitBytes, tt.wantLimit)
+			}
+			if tt.wantUnread && (body.n != 0 || w.Header().Get("Connection") != "close") {
+				t.Errorf("read %d bytes of the body with Connection %q, want none read and the connection closed", body.n, w.Header().Get("Connection"))
+			}
+		})
+	}
+}
+
+// TestLowSpace checks that files are not stored on a disk below the minimum free space.
+func TestLowSpace(t *testing.T) {
+	tests := []struct {
+		desc       string
+		minFreeMB  int64
+		wantStatus int
+	}{
+		// No disk has a petabyte free.
+		{"a disk low on space", 1 << 30, http.StatusInsufficientStorage},
+		{"a disk with enough space", 1, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			root := openTestTree(t)
+			h := newTestHandlers(t, root, nil)
+			space, err := diskspace.New(tt.minFreeMB, h.storage, nil, h.render, h.logger)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h.space = space
+			w := upload(t, h, "/upload", formPart{"file", "docs/a.txt", "docs/a.txt"})
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if stored := exists(t, root, "docs/a.txt"); stored != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("stored %v", stored)
+			}
+		})
+	}
+}
+
+// TestDownloadCache checks that small files are served from memory until they change, on
+// disk or through the server.
+func TestDownloadCache(t *testing.T) {
+	root := openTestTree(t, "a.txt", "docs/b.txt")
+	h := newTestHandlers(t, root, nil)
+	h.fileCache = filecache.New(1<<20, 1<<10)
+	download := func(name string) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodGet, "/download/"+name, nil)
+		r.SetPathValue("name", name)
+		w := httptest.NewRecorder()
+		h.DownloadHandle(w, r)
+		return w.Body.String()
+	}
+
+	if got := download("a.txt"); got != "a.txt" {
+		t.Fatalf("got %q, want %q", got, "a.txt")
+	}
+	if _, ok := h.fileCache.Get("a.txt"); !ok {
+		t.Fatal("downloaded file not cached")
+	}
+	// Served from memory: the cached content is what is sent.
+	entry, _ := h.fileCache.Get("a.txt")
+	copy(entry.Data, "A.TXT")
+	if got := download("a.txt"); got != "A.TXT" {
+		t.Errorf("got %q, want the cached %q", got, "A.TXT")
+	}
+
+	// Changed on disk behind the server's back.
+	if err := root.WriteFile("a.txt", []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := download("a.txt"); got != "changed" {
+		t.Errorf("got %q after the file changed on disk, want %q", got, "changed")
+	}
+
+	// Moved through the server: the directory's files are dropped.
+	download("docs/b.txt")
+	ops, _ := json.Marshal(map[string]any{"operations": []batchOperation{{Op: "move", Path: "docs", To: "archive"}}})
+	w := httptest.NewRecorder()
+	h.BatchHandler(w, asAdmin(httptest.NewRequest(http.MethodPost, "/api/batch", bytes.NewReader(ops))))
+	if _, ok := h.fileCache.Get("docs/b.txt"); ok {
+		t.Errorf("moved file still cached: %s", w.Body)
+	}
+}
+
+// TestDownloadRanges checks the ranges of a download, whether the file is served from the
+// disk or from the cache.
+func TestDownloadRanges(t *testing.T) {
+	const content = "0123456789abcdefghij"
+	tests := []struct {
+		desc       string
+		method     string
+		header     string // a request header, as "Name: value"
+		wantStatus int
+		wantRange  string   // Content-Range
+		wantBody   []string // the body, or its parts for several ranges
+	}{
+		{"the whole file", http.MethodGet, "", http.StatusOK, "", []string{content}},
+		{"a range", http.MethodGet, "Range: bytes=2-5", http.StatusPartialContent, "bytes 2-5/20", []string{"2345"}},
+		{"the rest of the file", http.MethodGet, "Range: bytes=15-", http.StatusPartialContent, "bytes 15-19/20", []string{"fghij"}},
+		{"the end of the file", http.MethodGet, "Range: bytes=-3", http.StatusPartialContent, "bytes 17-19/20", []string{"hij"}},
+		{"several ranges", http.MethodGet, "Range: bytes=0-1,10-12", http.StatusPartialContent, "", []string{"01", "abc"}},
+		{"a range past the end", http.MethodGet, "Range: bytes=30-40", http.StatusRequestedRangeNotSatisfiable, "bytes */20", nil},
+		{"a range for a version since replaced", http.MethodGet, `If-Range: "stale"`, http.StatusOK, "", []string{content}},
+		{"the headers only", http.MethodHead, "", http.StatusOK, "", []string{""}},
+		{"a file not modified since", http.MethodGet, "If-Modified-Since: " + time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), http.StatusNotModified, "", []string{""}},
+	}
+	for _, cached := range []bool{false, true} {
+		root := openTestTree(t)
+		if err := root.WriteFile("a.txt", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		h := newTestHandlers(t, root, nil)
+		h.fileCache = nil
+		if cached {
+			h.fileCache = filecache.New(1<<20, 1<<10)
+		}
+		for _, tt := range tests {
+			t.Run(fmt.Sprintf("%s, cached %v", tt.desc, cached), func(t *testing.T) {
+				r := httptest.NewRequest(tt.method, "/download/a.txt", nil)
+				r.SetPathValue("name", "a.txt")
+				if name, value, ok := strings.Cut(tt.header, ": "); ok {
+					r.Header.Set(name, value)
+					if name == "If-Range" {
+						r.Header.Set("Range", "bytes=0-1")
+					}
+				}
+				w := httptest.NewRecorder()
+				h.DownloadHandle(w, r)
+				if w.Code != tt.wantStatus {
+					t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+				}
+				if got := w.Header().Get("Content-Range"); got != tt.wantRange {
+					t.Errorf("got Content-Range %q, want %q", got, tt.wantRange)
+				}
+				if tt.wantBody == nil {
+					return
+				}
+				mediaType, params, _ := mime.ParseMediaType(w.Header().Get("Content-Type"))
+				if mediaType != "multipart/byteranges" {
+					if got := w.Body.String(); got != tt.wantBody[0] {
+						t.Errorf("got %q, want %q", got, tt.wantBody[0])
+					}
+					return
+				}
+				var parts []string
+				mr := multipart.NewReader(w.Body, params["boundary"])
+				for {
+					p, err := mr.NextPart()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatal(err)
+					}
+					b, _ := io.ReadAll(p)
+					parts = append(parts, string(b))
+				}
+				if !slices.Equal(parts, tt.wantBody) {
+					t.Errorf("got parts %q, want %q", parts, tt.wantBody)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"path"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// copyFile copies the regular file src in from to dst in to, the roots of the storage
+// directory or of the disks their prefixes are sharded to, replacing any file at dst. With
+// uploader.hardlinkCopies set, dst becomes a hard link to src where both are on the same
+// disk and the filesystem allows it, which takes no time and no space whatever the size of
+// the file.
+//
+// Why is that safe when files are written in place? Every write to a stored file detaches it
+// from its other links first (see detach and unshare), so changing one copy never changes
+// another.
+//
+// Why never link files under write-once retention? Links share one modification time, from
+// which retention runs: a copy of an old file linked into a retained path would be released
+// at once, and the copy of a retained file would share its retention.
+func (h *Handlers) copyFile(from storage.Root, src string, to storage.Root, dst string) error {
+	if h.uploader.HardlinkCopies && from == to && !h.retention.retains(src) && !h.retention.retains(dst) {
+		root := from
+		info, err := root.Lstat(src)
+		if err != nil {
+			return err
+		}
+		if _, ok := linkCount(info); ok && info.Mode().IsRegular() {
+			if err := root.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			// A link across filesystems, or on one without hard links, fails; the data is
+			// copied instead.
+			if err := root.Link(src, dst); err == nil {
+				return nil
+			}
+		}
+	}
+	if err := detach(to, dst); err != nil {
+		return err
+	}
+	if err := copyBetweenRoots(from, src, to, dst); err != nil {
+		return err
+	}
+	return h.setOwnership(to, dst, false)
+}
+
+// shared reports whether name is a regular file with other hard links.
+func shared(root storage.Root, name string) (bool, error) {
+	info, err := root.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	n, ok := linkCount(info)
+	return ok && n > 1 && info.Mode().IsRegular(), nil
+}
+
+// detach removes name if it is linked to other files, before it is written from scratch, so
+// that the new content does not reach them.
+func detach(root storage.Root, name string) error {
+	if s, err := shared(root, name); err != nil || !s {
+		return err
+	}
+	return root.Remove(name)
+}
+
+// unshare gives name a copy of its content of its own if it is linked to other files, before
+// it is written in place, so that the change does not reach them.
+func unshare(root storage.Root, name string) error {
+	if s, err := shared(root, name); err != nil || !s {
+		return err
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	tmp := path.Join(path.Dir(name), ".unshare-"+hex.EncodeToString(b))
+	if err := copyBetweenRoots(root, name, root, tmp); err != nil {
+		return err
+	}
+	if err := root.Rename(tmp, name); err != nil {
+		root.Remove(tmp)
+		return err
+	}
+	return nil
+}
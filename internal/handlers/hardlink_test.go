@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// TestCopyFileRetained checks that files are never linked into, or out of, a path under
+// write-once retention, whose retention would otherwise run from the original's time.
+func TestCopyFileRetained(t *testing.T) {
+	root := openTestTree(t, "compliance/a.txt", "public/b.txt")
+	if err := root.Link("public/b.txt", "public/probe"); err != nil {
+		t.Skipf("hard links are not supported: %v", err)
+	}
+	if err := root.Remove("public/probe"); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handlers{
+		uploader:  &config.UploaderConfig{HardlinkCopies: true, UID: -1, GID: -1},
+		retention: newRetentionPolicy(config.WORMConfig{Rules: []config.WORMRule{{Path: "compliance", Retention: 24 * time.Hour}}}),
+	}
+
+	tests := []struct {
+		desc   string
+		src    string
+		dst    string
+		linked bool
+	}{
+		{"a copy outside retention", "public/b.txt", "public/c.txt", true},
+		{"a copy of a retained file", "compliance/a.txt", "public/a.txt", false},
+		{"a copy into a retained path", "public/b.txt", "compliance/b.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := h.copyFile(root, tt.src, root, tt.dst); err != nil {
+				t.Fatal(err)
+			}
+			s, err := shared(root, tt.dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info, _ := root.Stat(tt.dst); info != nil {
+				if _, ok := linkCount(info); !ok {
+					t.Skip("link counts are not supported")
+				}
+			}
+			if s != tt.linked {
+				t.Errorf("copy linked %v, want %v", s, tt.linked)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// errHiddenName is reported for writes to names that are hidden from clients.
+var errHiddenName = errors.New("hidden file names are not accepted")
+
+// hiddenPolicy decides which stored files clients cannot see.
+type hiddenPolicy struct {
+	dotfiles      bool
+	names         []string
+	rejectUploads bool
+	// internal is the metadata directory, relative to the storage directory, if it lies
+	// within it, or "".
+	internal string
+}
+
+// newHiddenPolicy returns the policy of cfg for files stored in storageDir, whose own
+// bookkeeping is kept in metadataDir.
+func newHiddenPolicy(cfg config.HiddenFilesConfig, storageDir, metadataDir string) *hiddenPolicy {
+	hp := &hiddenPolicy{dotfiles: cfg.Dotfiles, names: cfg.Names, rejectUploads: cfg.RejectUploads}
+	storage, err1 := filepath.Abs(storageDir)
+	metadata, err2 := filepath.Abs(metadataDir)
+	if err1 == nil && err2 == nil {
+		if rel, err := filepath.Rel(storage, metadata); err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			hp.internal = filepath.ToSlash(rel)
+		}
+	}
+	return hp
+}
+
+// internalFile reports whether the storage-relative name is, or lies below, the server's
+// own metadata directory.
+func (hp *hiddenPolicy) internalFile(name string) bool {
+	if hp.internal == "" {
+		return false
+	}
+	name = path.Clean("/" + name)
+	return withinDir(name, path.Clean("/"+hp.internal))
+}
+
+// holdsInternal reports whether deleting or moving the storage-relative name would take the
+// metadata directory with it.
+func (hp *hiddenPolicy) holdsInternal(name string) bool {
+	return hp.internal != "" && withinDir(path.Clean("/"+hp.internal), path.Clean("/"+name))
+}
+
+// hidden reports whether the storage-relative name, or a directory it lies below, is hidden.
+func (hp *hiddenPolicy) hidden(name string) bool {
+	if hp.internalFile(name) {
+		return true
+	}
+	for elem := range strings.SplitSeq(strings.Trim(path.Clean("/"+name), "/"), "/") {
+		if hp.dotfiles && strings.HasPrefix(elem, ".") {
+			return true
+		}
+		for _, pattern := range hp.names {
+			if ok, _ := path.Match(pattern, elem); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkWrite returns errHiddenName if name may not be written: always within the metadata
+// directory, and for any hidden name if uploads of them are rejected.
+func (hp *hiddenPolicy) checkWrite(name string) error {
+	if hp.internalFile(name) || hp.rejectUploads && hp.hidden(name) {
+		return errHiddenName
+	}
+	return nil
+}
+
+// hiddenFile answers the request with 404 Not Found, and reports true, if name is hidden.
+//
+// Why not 403 Forbidden? That would tell the client the file exists.
+func (h *Handlers) hiddenFile(w http.ResponseWriter, r *http.Request, name string) bool {
+	if !h.hidden.hidden(name) {
+		return false
+	}
+	h.render.Error(w, r, http.StatusNotFound, "file is not found")
+	return true
+}
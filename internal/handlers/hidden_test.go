@@ -0,0 +1,301 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// hiddenTestFiles are the files of the tree the hidden file tests run on: dotfiles, files in a
+// dot directory, files matching a hidden pattern, and the server's metadata directory, which
+// lies within the storage directory, beside files clients can see.
+var hiddenTestFiles = []string{
+	"a.txt", ".env", ".git/config", "docs/b.txt", "docs/.secret", "docs/c.tmp", "cache.tmp/d.txt", "var/meta/files.json",
+}
+
+// newHiddenTestHandlers returns handlers for a tree of hiddenTestFiles, hiding dotfiles and
+// names matching "*.tmp", with the metadata directory at "var/meta".
+func newHiddenTestHandlers(t *testing.T, rejectUploads bool) (*Handlers, storage.Root) {
+	t.Helper()
+	root := openTestTree(t, hiddenTestFiles...)
+	h := newTestHandlers(t, root, nil)
+	cfg := config.HiddenFilesConfig{Dotfiles: true, Names: []string{"*.tmp"}, RejectUploads: rejectUploads}
+	h.hidden = newHiddenPolicy(cfg, root.Name(), filepath.Join(root.Name(), "var", "meta"))
+	return h, root
+}
+
+// asAdmin returns r made by an admin, who may do anything the hidden file policy allows.
+func asAdmin(r *http.Request) *http.Request {
+	return r.WithContext(auth.NewContext(r.Context(), &auth.Principal{Username: "admin", Roles: []string{"admin"}}))
+}
+
+// exists reports whether name is in root.
+func exists(t *testing.T, root storage.Root, name string) bool {
+	t.Helper()
+	_, err := root.Stat(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		t.Fatal(err)
+	}
+	return err == nil
+}
+
+func TestHiddenList(t *testing.T) {
+	h, _ := newHiddenTestHandlers(t, false)
+	if err := h.index.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/download/list.txt", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	h.DownloadList(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	var got struct {
+		Files []struct {
+			Name string `json:"name"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range got.Files {
+		names = append(names, f.Name)
+	}
+	slices.Sort(names)
+	// Hidden names, and everything below hidden directories, are left out.
+	if want := []string{"a.txt", "docs/b.txt"}; !slices.Equal(names, want) {
+		t.Errorf("listed %v, want %v", names, want)
+	}
+}
+
+func TestHiddenDownload(t *testing.T) {
+	h, _ := newHiddenTestHandlers(t, false)
+	tests := []struct {
+		desc       string
+		name       string
+		wantStatus int
+	}{
+		{"a visible file", "docs/b.txt", http.StatusOK},
+		{"a dotfile", ".env", http.StatusNotFound},
+		{"a dotfile in a directory", "docs/.secret", http.StatusNotFound},
+		{"a name matching a pattern", "docs/c.tmp", http.StatusNotFound},
+		{"a file in a dot directory", ".git/config", http.StatusNotFound},
+		{"a file in a directory matching a pattern", "cache.tmp/d.txt", http.StatusNotFound},
+		{"a file in the metadata directory", "var/meta/files.json", http.StatusNotFound},
+		{"a hidden file that does not exist", ".missing", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/download/"+tt.name, nil)
+			r.SetPathValue("name", tt.name)
+			w := httptest.NewRecorder()
+			h.DownloadHandle(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			// A hidden file is answered as a missing one, so that its existence is not given
+			// away, and its content never is.
+			if tt.wantStatus == http.StatusOK && w.Body.String() != tt.name {
+				t.Errorf("got %q, want %q", w.Body, tt.name)
+			}
+			if tt.wantStatus != http.StatusOK && strings.Contains(w.Body.String(), tt.name) {
+				t.Errorf("the answer %s names the hidden file", w.Body)
+			}
+		})
+	}
+}
+
+func TestHiddenUpload(t *testing.T) {
+	tests := []struct {
+		desc          string
+		dir           string
+		filename      string
+		rejectUploads bool
+		wantStatus    int
+		wantStored    string
+	}{
+		{"a visible file", "", "new.txt", true, http.StatusOK, "new.txt"},
+		{"a dotfile", "", ".env.local", true, http.StatusUnprocessableEntity, ""},
+		{"a name matching a pattern", "docs", "d.tmp", true, http.StatusUnprocessableEntity, ""},
+		{"a file in a dot directory", "", ".git/hooks/pre-commit", true, http.StatusUnprocessableEntity, ""},
+		{"a file in a dot directory chosen by the form", ".git", "hooks.txt", true, http.StatusUnprocessableEntity, ""},
+		{"a file in the metadata directory", "var/meta", "new.json", false, http.StatusUnprocessableEntity, ""},
+		{"a dotfile, when hidden uploads are accepted", "", ".env.local", false, http.StatusOK, ".env.local"},
+		{"a file in a dot directory, when hidden uploads are accepted", "", ".git/hooks/pre-commit", false, http.StatusOK, ".git/hooks/pre-commit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h, root := newHiddenTestHandlers(t, tt.rejectUploads)
+			var body bytes.Buffer
+			mw := multipart.NewWriter(&body)
+			if tt.dir != "" {
+				mw.WriteField("dir", tt.dir)
+			}
+			fw, err := mw.CreateFormFile("file", tt.filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fw.Write([]byte("uploaded"))
+			mw.Close()
+			r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+			r.Header.Set("Content-Type", mw.FormDataContentType())
+			w := httptest.NewRecorder()
+			h.UploadHandler(w, asAdmin(r))
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			name := filepath.ToSlash(filepath.Join(tt.dir, tt.filename))
+			if stored := exists(t, root, name); stored != (tt.wantStored != "") {
+				t.Errorf("'%s' stored %v, want %v", name, stored, tt.wantStored != "")
+			}
+			// The metadata directory is never written to.
+			if b, err := root.ReadFile("var/meta/files.json"); err != nil || string(b) != "var/meta/files.json" {
+				t.Errorf("the metadata directory was written to: %q, %v", b, err)
+			}
+		})
+	}
+}
+
+func TestHiddenBatchMove(t *testing.T) {
+	// Hidden files are reported as missing ones are.
+	notFound := describeFSError(fs.ErrNotExist).Error()
+	tests := []struct {
+		desc          string
+		op            string
+		path          string
+		to            string
+		rejectUploads bool
+		wantErr       string
+		wantGone      string // a name moved away
+	}{
+		{"a visible file", "move", "a.txt", "docs/a.txt", true, "", "a.txt"},
+		{"a hidden file", "move", ".env", "env.txt", false, notFound, ""},
+		{"a file in a hidden directory", "move", ".git/config", "config", false, notFound, ""},
+		{"a hidden directory", "move", ".git", "git", false, notFound, ""},
+		{"a hidden file copied", "copy", "docs/.secret", "secret", false, notFound, ""},
+		{"the metadata directory", "move", "var/meta", "meta", false, notFound, ""},
+		{"a directory holding the metadata directory moved", "move", "var", "var2", false, errBatchDenied.Error(), ""},
+		{"a directory holding the metadata directory deleted", "delete", "var", "", false, errBatchDenied.Error(), ""},
+		{"a file to a hidden name", "move", "a.txt", ".a.txt", true, errHiddenName.Error(), ""},
+		{"a file to a hidden directory", "move", "a.txt", ".git/a.txt", true, errHiddenName.Error(), ""},
+		{"a file to the metadata directory", "move", "a.txt", "var/meta/a.txt", false, errHiddenName.Error(), ""},
+		{"a file to a hidden name, when hidden uploads are accepted", "move", "a.txt", ".a.txt", false, "", "a.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h, root := newHiddenTestHandlers(t, tt.rejectUploads)
+			ops, _ := json.Marshal(map[string]any{"operations": []batchOperation{{Op: tt.op, Path: tt.path, To: tt.to, Recursive: true}}})
+			w := httptest.NewRecorder()
+			h.BatchHandler(w, asAdmin(httptest.NewRequest(http.MethodPost, "/api/batch", bytes.NewReader(ops))))
+			var resp batchResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("status %d: %v", w.Code, err)
+			}
+			if len(resp.Results) != 1 {
+				t.Fatalf("got %d results, want 1", len(resp.Results))
+			}
+			res := resp.Results[0]
+			switch {
+			case tt.wantErr == "" && res.Status != "ok":
+				t.Fatalf("got error %q", res.Error)
+			case tt.wantErr != "" && res.Error != tt.wantErr:
+				t.Fatalf("got status %s and error %q, want error %q", res.Status, res.Error, tt.wantErr)
+			}
+			if tt.wantGone != "" {
+				if exists(t, root, tt.wantGone) || !exists(t, root, tt.to) {
+					t.Errorf("'%s' was not moved to '%s'", tt.wantGone, tt.to)
+				}
+				return
+			}
+			for _, name := range hiddenTestFiles {
+				if !exists(t, root, name) {
+					t.Errorf("'%s' is gone", name)
+				}
+			}
+		})
+	}
+}
+
+func TestHiddenDelta(t *testing.T) {
+	h, root := newHiddenTestHandlers(t, true)
+	tests := []struct {
+		desc       string
+		signatures bool
+		name       string
+		wantStatus int
+	}{
+		{"signatures of a visible file", true, "docs/b.txt", http.StatusOK},
+		{"signatures of a hidden file", true, "docs/.secret", http.StatusNotFound},
+		{"signatures of a file in a hidden directory", true, ".git/config", http.StatusNotFound},
+		{"a delta to a hidden file", false, ".env", http.StatusUnprocessableEntity},
+		{"a delta to a file in a hidden directory", false, "cache.tmp/d.txt", http.StatusUnprocessableEntity},
+		{"a delta to the metadata directory", false, "var/meta/files.json", http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if tt.signatures {
+				r := httptest.NewRequest(http.MethodGet, "/api/signatures/"+tt.name, nil)
+				r.SetPathValue("name", tt.name)
+				h.SignaturesHandler(w, asAdmin(r))
+			} else {
+				r := httptest.NewRequest(http.MethodPatch, "/api/delta/"+tt.name+"?blockSize=4", strings.NewReader("delta"))
+				r.SetPathValue("name", tt.name)
+				r.Header.Set("If-Match", `"etag"`)
+				h.DeltaHandler(w, asAdmin(r))
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if b, err := root.ReadFile(tt.name); err != nil || string(b) != tt.name {
+				t.Errorf("'%s' was changed: %q, %v", tt.name, b, err)
+			}
+		})
+	}
+}
+
+func TestHiddenAssembly(t *testing.T) {
+	tests := []struct {
+		desc          string
+		name          string
+		rejectUploads bool
+		wantStatus    int
+	}{
+		{"a hidden name", ".env.local", true, http.StatusUnprocessableEntity},
+		{"a name matching a pattern", "docs/e.tmp", true, http.StatusUnprocessableEntity},
+		{"a file in a hidden directory", ".git/objects/pack.bin", true, http.StatusUnprocessableEntity},
+		{"a file in the metadata directory", "var/meta/holds.json", false, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h, root := newHiddenTestHandlers(t, tt.rejectUploads)
+			body, _ := json.Marshal(map[string]any{"name": tt.name, "size": 10})
+			w := httptest.NewRecorder()
+			h.CreateUploadHandler(w, asAdmin(httptest.NewRequest(http.MethodPost, "/api/uploads", bytes.NewReader(body))))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), errHiddenName.Error()) {
+				t.Errorf("the answer %s does not give the reason", w.Body)
+			}
+			if tt.name != "var/meta/holds.json" && exists(t, root, tt.name) {
+				t.Errorf("'%s' was created", tt.name)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/holds"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// maxHoldBodySize bounds the JSON body of a hold request.
+const maxHoldBodySize = 64 << 10 // 64 KB
+
+// errHeld is reported for changes to files under a legal hold or lock.
+var errHeld = errors.New("file is locked")
+
+// checkHold returns an error wrapping errHeld if name, or any file below it if it is a
+// directory, is locked or under a legal hold. action describes the attempted change for the
+// log, which records every refused attempt.
+func (h *Handlers) checkHold(p *auth.Principal, name, action string) error {
+	hold, ok := h.holds.Within(name)
+	if !ok {
+		return nil
+	}
+	kind := "locked"
+	if hold.LegalHold {
+		kind = "under legal hold"
+	}
+	err := fmt.Errorf("%w: '%s' is %s", errHeld, hold.Path, kind)
+	h.logger.Printf("warn: refused to %s '%s' for %s: %v\n", action, name, principalName(p), err)
+	return err
+}
+
+// checkProtected returns an error if changing name would alter a held or retained file,
+// wrapping errHeld or errRetained respectively.
+func (h *Handlers) checkProtected(root storage.Root, p *auth.Principal, name, action string) error {
+	if err := h.checkHold(p, name, action); err != nil {
+		return err
+	}
+	return h.checkRetention(root, p, name, action)
+}
+
+// protectedStatus maps an error from checkProtected to an HTTP status code: 423 Locked for
+// held files, 403 Forbidden for retained ones.
+func protectedStatus(err error) int {
+	switch {
+	case errors.Is(err, errHeld):
+		return http.StatusLocked
+	case errors.Is(err, errRetained):
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// ListHoldsHandler returns every file that is locked or under a legal hold. Admin only.
+func (h *Handlers) ListHoldsHandler(w http.ResponseWriter, r *http.Request) {
+	h.render.JSON(w, http.StatusOK, h.holds.List())
+}
+
+// SetHoldHandler sets or clears the lock and legal hold flags of a stored file. Clearing
+// both removes the hold. Admin only.
+func (h *Handlers) SetHoldHandler(w http.ResponseWriter, r *http.Request) {
+	defer cleanupRequest(r)
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	var req struct {
+		LegalHold bool   `json:"legalHold"`
+		Locked    bool   `json:"locked"`
+		Reason    string `json:"reason"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxHoldBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return
+	}
+
+	// Only existing files can be held, so that a typo does not silently succeed. Clearing
+	// is always allowed, so holds on files removed outside the server can be dropped.
+	if req.LegalHold || req.Locked {
+		if status, msg := h.statStoredFile(name); status != http.StatusOK {
+			h.render.Error(w, r, status, msg)
+			return
+		}
+	}
+
+	p := principalFrom(r)
+	hold := holds.Hold{Path: name, LegalHold: req.LegalHold, Locked: req.Locked, Reason: req.Reason, SetBy: principalName(p)}
+	if err := h.holds.Set(hold); err != nil {
+		h.logger.Printf("error saving hold: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	h.logger.Printf("%s set legalHold=%t locked=%t on '%s'\n", hold.SetBy, hold.LegalHold, hold.Locked, name)
+	if !hold.Active() {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	hold, _ = h.holds.Get(name)
+	h.render.JSON(w, http.StatusOK, hold)
+}
+
+// ClearHoldHandler removes the lock and legal hold from a stored file. Admin only.
+func (h *Handlers) ClearHoldHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if _, ok := h.holds.Get(name); !ok {
+		h.render.Error(w, r, http.StatusNotFound, "file is not held")
+		return
+	}
+	if err := h.holds.Set(holds.Hold{Path: name}); err != nil {
+		h.logger.Printf("error saving hold: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	h.logger.Printf("%s cleared the hold on '%s'\n", principalName(principalFrom(r)), name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// statStoredFile checks that name is an existing regular file in the storage directory,
+// returning http.StatusOK if so, or an error status and message.
+func (h *Handlers) statStoredFile(name string) (int, string) {
+	root, err := h.storage.OpenRoot(name)
+	if err == nil {
+		defer root.Close()
+		var info fs.FileInfo
+		if err = h.checkSymlinks(root, name, false); err != nil {
+			// Refused links are not found either, for callers that only look files up.
+			err = fs.ErrNotExist
+		} else if info, err = root.Stat(name); err == nil && info.IsDir() {
+			err = fs.ErrNotExist
+		}
+	}
+	switch {
+	case err == nil:
+		return http.StatusOK, ""
+	case errors.Is(err, fs.ErrNotExist):
+		return http.StatusNotFound, "file is not found"
+	default:
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		return http.StatusInternalServerError, "unable to access file"
+	}
+}
+
+// principalName names the caller in log messages and records.
+func principalName(p *auth.Principal) string {
+	if p == nil {
+		return "anonymous"
+	}
+	return p.Username
+}
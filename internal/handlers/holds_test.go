@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/holds"
+)
+
+// setHold sends body to the hold handler for name as an admin, and returns the response.
+func setHold(h *Handlers, name, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPut, "/api/holds/"+name, strings.NewReader(body))
+	r.SetPathValue("name", name)
+	w := httptest.NewRecorder()
+	h.SetHoldHandler(w, asAdmin(r))
+	return w
+}
+
+func TestSetHold(t *testing.T) {
+	h := newTestHandlers(t, openTestTree(t, "docs/report.pdf"), nil)
+	tests := []struct {
+		desc       string
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"a missing file", "docs/missing.pdf", `{"legalHold": true}`, http.StatusNotFound},
+		{"a directory", "docs", `{"locked": true}`, http.StatusNotFound},
+		{"a malformed body", "docs/report.pdf", `{"locked": `, http.StatusBadRequest},
+		{"a file", "docs/report.pdf", `{"legalHold": true, "reason": "case 42"}`, http.StatusOK},
+		{"a hold cleared by its flags", "docs/report.pdf", `{}`, http.StatusNoContent},
+		{"a hold on a file gone since, cleared", "docs/missing.pdf", `{}`, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w := setHold(h, tt.name, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var hold holds.Hold
+			if err := json.Unmarshal(w.Body.Bytes(), &hold); err != nil {
+				t.Fatal(err)
+			}
+			if hold.Path != tt.name || !hold.LegalHold || hold.Reason != "case 42" || hold.SetBy != "admin" {
+				t.Errorf("got %+v", hold)
+			}
+		})
+	}
+	if list := h.holds.List(); len(list) != 0 {
+		t.Errorf("holds %+v left, want none", list)
+	}
+}
+
+// TestHolds checks that held files cannot be changed until the hold is cleared.
+func TestHolds(t *testing.T) {
+	root := openTestTree(t, "docs/report.pdf", "docs/notes.txt", "releases/v1.zip")
+	h := newTestHandlers(t, root, nil)
+	if w := setHold(h, "docs/report.pdf", `{"legalHold": true}`); w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if w := setHold(h, "releases/v1.zip", `{"locked": true}`); w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+
+	if w := upload(t, h, "/upload", formPart{"file", "docs/report.pdf", "replaced"}); w.Code != http.StatusLocked {
+		t.Errorf("upload over a held file: got status %d %s, want %d", w.Code, w.Body, http.StatusLocked)
+	}
+	batch := []struct {
+		desc string
+		op   batchOperation
+	}{
+		{"deleting a held file", batchOperation{Op: "delete", Path: "docs/report.pdf"}},
+		{"deleting the directory holding it", batchOperation{Op: "delete", Path: "docs", Recursive: true}},
+		{"moving a locked file", batchOperation{Op: "move", Path: "releases/v1.zip", To: "v1.zip"}},
+		{"copying over a locked file", batchOperation{Op: "copy", Path: "docs/notes.txt", To: "releases/v1.zip", Overwrite: true}},
+	}
+	for _, tt := range batch {
+		t.Run(tt.desc, func(t *testing.T) {
+			ops, _ := json.Marshal(map[string]any{"operations": []batchOperation{tt.op}})
+			w := httptest.NewRecorder()
+			h.BatchHandler(w, asAdmin(httptest.NewRequest(http.MethodPost, "/api/batch", bytes.NewReader(ops))))
+			var resp batchResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("status %d: %v", w.Code, err)
+			}
+			if len(resp.Results) != 1 || !strings.Contains(resp.Results[0].Error, errHeld.Error()) {
+				t.Errorf("got results %+v, want the file locked", resp.Results)
+			}
+		})
+	}
+	for _, name := range []string{"docs/report.pdf", "docs/notes.txt", "releases/v1.zip"} {
+		if b, err := root.ReadFile(name); err != nil || string(b) != name {
+			t.Errorf("%s holds %q, %v, want it unchanged", name, b, err)
+		}
+	}
+
+	// Once cleared, the file may be replaced; clearing it again finds no hold.
+	clear := func() int {
+		r := httptest.NewRequest(http.MethodDelete, "/api/holds/docs/report.pdf", nil)
+		r.SetPathValue("name", "docs/report.pdf")
+		w := httptest.NewRecorder()
+		h.ClearHoldHandler(w, asAdmin(r))
+		return w.Code
+	}
+	if code := clear(); code != http.StatusNoContent {
+		t.Errorf("clearing the hold: got status %d, want %d", code, http.StatusNoContent)
+	}
+	if code := clear(); code != http.StatusNotFound {
+		t.Errorf("clearing it again: got status %d, want %d", code, http.StatusNotFound)
+	}
+	if w := upload(t, h, "/upload", formPart{"file", "docs/report.pdf", "replaced"}); w.Code != http.StatusOK {
+		t.Errorf("upload after clearing the hold: got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/coord"
+)
+
+// lockTimeout bounds the calls to the coordination service that lock and unlock a name.
+const lockTimeout = 5 * time.Second
+
+// writeGuard tracks the file names uploads are currently writing, so that two uploads of
+// the same name cannot write into one file at the same time.
+//
+// Why refuse rather than wait? A client uploading a file that another upload is replacing
+// cannot know which version should win; failing fast lets it decide, and a waiting
+// request would hold its connection and body open for as long as the other upload takes.
+//
+// With a coordination service, names are locked there as well, so that uploads on other
+// nodes sharing the storage are kept out too.
+type writeGuard struct {
+	mu      sync.Mutex
+	names   map[string]struct{}
+	backend coord.Backend
+	logger  *log.Logger
+}
+
+// newWriteGuard returns an empty writeGuard, which also locks names in backend unless it is nil.
+func newWriteGuard(backend coord.Backend, logger *log.Logger) *writeGuard {
+	return &writeGuard{names: make(map[string]struct{}), backend: backend, logger: logger}
+}
+
+// acquire marks name as being written. It reports false if another upload already holds it,
+// or, as the name then cannot be known to be free, if the coordination service fails.
+func (g *writeGuard) acquire(name string) bool {
+	g.mu.Lock()
+	if _, busy := g.names[name]; busy {
+		g.mu.Unlock()
+		return false
+	}
+	g.names[name] = struct{}{}
+	g.mu.Unlock()
+	if g.backend == nil {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+	defer cancel()
+	locked, err := g.backend.TryLock(ctx, "files/"+name)
+	if err != nil {
+		g.logger.Printf("error locking '%s': %v\n", name, err)
+	}
+	if !locked {
+		g.mu.Lock()
+		delete(g.names, name)
+		g.mu.Unlock()
+	}
+	return locked
+}
+
+// busy reports whether an upload is writing name.
+func (g *writeGuard) busy(name string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.names[name]
+	return ok
+}
+
+// release marks name as no longer being written.
+func (g *writeGuard) release(name string) {
+	if g.backend != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), lockTimeout)
+		if err := g.backend.Unlock(ctx, "files/"+name); err != nil {
+			g.logger.Printf("error unlocking '%s': %v\n", name, err)
+		}
+		cancel()
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.names, name)
+}
@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/coord"
+	"github.com/mascotmascot1/fileserver/internal/index"
+)
+
+// lockBackend is a coordination service in which the names in held are locked by another
+// node. It fails every call if err is set.
+type lockBackend struct {
+	coord.Backend
+	held     map[string]bool
+	err      error
+	unlocked []string
+}
+
+func (b *lockBackend) TryLock(ctx context.Context, key string) (bool, error) {
+	if b.err != nil {
+		return false, b.err
+	}
+	return !b.held[key], nil
+}
+
+func (b *lockBackend) Unlock(ctx context.Context, key string) error {
+	b.unlocked = append(b.unlocked, key)
+	return b.err
+}
+
+func TestWriteGuard(t *testing.T) {
+	g := newWriteGuard(nil, nil)
+	if !g.acquire("a.txt") || !g.busy("a.txt") {
+		t.Fatal("a.txt not acquired")
+	}
+	if g.acquire("a.txt") {
+		t.Error("a.txt acquired twice")
+	}
+	if !g.acquire("b.txt") {
+		t.Error("b.txt not acquired beside a.txt")
+	}
+	g.release("a.txt")
+	if g.busy("a.txt") || !g.acquire("a.txt") {
+		t.Error("a.txt not free once released")
+	}
+}
+
+// TestWriteGuardCoordinated checks that names written on other nodes are refused, and that
+// names are refused rather than risked when the coordination service fails.
+func TestWriteGuardCoordinated(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	backend := &lockBackend{held: map[string]bool{"files/b.txt": true}}
+	g := newWriteGuard(backend, logger)
+	if !g.acquire("a.txt") {
+		t.Error("a.txt not acquired")
+	}
+	if g.acquire("b.txt") || g.busy("b.txt") {
+		t.Error("b.txt acquired whilst another node writes it")
+	}
+	g.release("a.txt")
+	if !slices.Equal(backend.unlocked, []string{"files/a.txt"}) {
+		t.Errorf("unlocked %v, want files/a.txt", backend.unlocked)
+	}
+
+	backend.err = errors.New("connection refused")
+	if g.acquire("c.txt") || g.busy("c.txt") {
+		t.Error("c.txt acquired without the coordination service")
+	}
+}
+
+// TestConcurrentUpload checks that an upload of a name another upload is writing is
+// refused, and that the file being written is left out of listings until it is complete.
+func TestConcurrentUpload(t *testing.T) {
+	root := openTestTree(t, "a.txt")
+	h := newTestHandlers(t, root, nil)
+	h.index.Watch(index.WatchOptions{Busy: h.writing.busy})
+	t.Cleanup(h.index.Close)
+
+	// An upload is writing b.txt.
+	if !h.writing.acquire("b.txt") {
+		t.Fatal("b.txt not acquired")
+	}
+	if err := root.WriteFile("b.txt", []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.index.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.index.List(); slices.Contains(got, "b.txt") {
+		t.Errorf("listed %v whilst b.txt is written", got)
+	}
+
+	if w := upload(t, h, "/upload", formPart{"file", "b.txt", "other"}); w.Code != http.StatusConflict {
+		t.Errorf("got status %d %s, want %d", w.Code, w.Body, http.StatusConflict)
+	}
+	if w := upload(t, h, "/upload", formPart{"file", "b.txt", "other"}, formPart{"file", "c.txt", "c"}); w.Code != http.StatusMultiStatus {
+		t.Errorf("got status %d %s, want %d", w.Code, w.Body, http.StatusMultiStatus)
+	}
+	if b, err := root.ReadFile("b.txt"); err != nil || string(b) != "partial" {
+		t.Errorf("b.txt holds %q, %v, want the first upload's data", b, err)
+	}
+	if b, err := root.ReadFile("c.txt"); err != nil || string(b) != "c" {
+		t.Errorf("c.txt holds %q, %v, want c", b, err)
+	}
+
+	h.writing.release("b.txt")
+	if w := upload(t, h, "/upload", formPart{"file", "b.txt", "other"}); w.Code != http.StatusOK {
+		t.Errorf("once written: got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if got := h.index.List(); !slices.Contains(got, "b.txt") || !slices.Contains(got, "c.txt") {
+		t.Errorf("listed %v, want b.txt and c.txt", got)
+	}
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/internal/holds"
+	"github.com/mascotmascot1/fileserver/internal/locks"
+)
+
+// fileInfo is the document returned by FileInfoHandler.
+type fileInfo struct {
+	// ID stays the same when the file is renamed or moved; see FileByIDHandler.
+	ID       string      `json:"id,omitempty"`
+	Name     string      `json:"name"`
+	Type     string      `json:"type"` // "file" or "directory"
+	Size     int64       `json:"size"`
+	Modified time.Time   `json:"modified"`
+	MIMEType string      `json:"mimeType,omitempty"`
+	SHA256   string      `json:"sha256,omitempty"`
+	ETag     string      `json:"etag,omitempty"`
+	Hold     *holds.Hold `json:"hold,omitempty"`
+	Lock     *locks.Lock `json:"lock,omitempty"`
+	Video    *videoInfo  `json:"video,omitempty"`
+	// Metadata holds the form fields the file was uploaded with, such as a description.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Links    fileLinks         `json:"links"`
+}
+
+// videoInfo describes a video, once its preview has been extracted.
+type videoInfo struct {
+	// Duration is the length of the video in seconds.
+	Duration float64 `json:"duration"`
+}
+
+// fileLinks holds URLs related to a file, relative to the server's origin.
+type fileLinks struct {
+	Self     string `json:"self"`
+	Download string `json:"download,omitempty"`
+	// Permanent downloads the file by its ID, so it keeps working when the file is moved.
+	Permanent string `json:"permanent,omitempty"`
+	Stream    string `json:"stream,omitempty"`
+	View      string `json:"view,omitempty"`
+	Read      string `json:"read,omitempty"`
+	Preview   string `json:"preview,omitempty"`
+	Edit      string `json:"edit,omitempty"`
+	Poster    string `json:"poster,omitempty"`
+}
+
+// FileInfoHandler returns structured information about a stored file, so clients can
+// display its details without issuing a HEAD request and parsing headers.
+func (h *Handlers) FileInfoHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	h.sendFileInfo(w, r, name)
+}
+
+// FileByIDHandler returns the details of the file with the ID in the request path, wherever
+// it has been moved since.
+func (h *Handlers) FileByIDHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	if name, ok := h.fileByID(w, r); ok {
+		h.sendFileInfo(w, r, name)
+	}
+}
+
+// DownloadByIDHandler serves the file with the ID in the request path, like DownloadHandle.
+// Links to it keep working when the file is renamed or moved.
+func (h *Handlers) DownloadByIDHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	if name, ok := h.fileByID(w, r); ok {
+		h.sendFile(w, r, name, "")
+	}
+}
+
+// fileByID returns the name of the file with the ID in the request path. It answers the
+// request itself, and reports false, if there is no such file.
+func (h *Handlers) fileByID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	e, ok := h.fileMeta.ByID(r.PathValue("id"))
+	if !ok || e.MissingSince != nil {
+		h.render.Error(w, r, http.StatusNotFound, "file is not found")
+		return "", false
+	}
+	return e.Path, true
+}
+
+// sendFileInfo answers with the details of the file or directory name.
+func (h *Handlers) sendFileInfo(w http.ResponseWriter, r *http.Request, name string) {
+	if h.hiddenFile(w, r, name) {
+		return
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Read, name) {
+		h.denyAccess(w, r)
+		return
+	}
+
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			h.render.Error(w, r, http.StatusNotFound, "file is not found")
+			return
+		}
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	file, err := h.openStored(root, name)
+	if err != nil {
+		status := openErrorStatus(err)
+		if status == http.StatusNotFound {
+			h.render.Error(w, r, status, "file is not found")
+		} else {
+			h.logger.Printf("error opening file '%s': %v\n", name, err)
+			h.render.Error(w, r, status, "unable to open file")
+		}
+		return
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+
+	info := fileInfo{
+		Name:     name,
+		Type:     "file",
+		Size:     stat.Size(),
+		Modified: stat.ModTime().UTC(),
+		Links:    fileLinks{Self: h.basePath + "/api/files/" + escapePath(name)},
+	}
+	if stat.IsDir() {
+		info.Type = "directory"
+		h.render.JSON(w, http.StatusOK, info)
+		return
+	}
+
+	info.Links.Download = h.basePath + "/download/" + escapePath(name)
+	if info.ID = h.fileMeta.ID(name); info.ID != "" {
+		info.Links.Permanent = h.basePath + "/api/files/by-id/" + info.ID + "/download"
+	}
+	if streamType(name) != "" {
+		info.Links.Stream = h.basePath + "/stream/" + escapePath(name)
+	}
+	if isPDF(name) {
+		info.Links.View = h.basePath + "/view/" + escapePath(name)
+		if h.reader != nil {
+			info.Links.Read = h.basePath + "/read/" + escapePath(name)
+		}
+	}
+	if h.converter.Convertible(name) {
+		info.Links.Preview = h.basePath + "/preview/" + escapePath(name)
+	}
+	if maxSize := h.editor.GetMaxSize(); maxSize > 0 && stat.Size() <= maxSize {
+		info.Links.Edit = h.basePath + "/edit/" + escapePath(name)
+	}
+	info.ETag = fileETag(stat.ModTime(), stat.Size())
+	info.Metadata = h.fileMeta.Fields(name)
+	if hold, ok := h.holds.Get(name); ok {
+		info.Hold = &hold
+	}
+	if lock, ok := h.locks.Get(name); ok {
+		// The token is the lock holder's secret: anyone with it could release the lock.
+		lock.Token = ""
+		info.Lock = &lock
+	}
+	if info.MIMEType, err = detectMIMEType(file, name); err == nil {
+		info.SHA256, err = h.checksum(r, name, file, stat)
+	}
+	if err != nil {
+		if r.Context().Err() != nil {
+			h.logger.Printf("client %s disconnected during file info of %s\n", r.RemoteAddr, name)
+			return
+		}
+		h.logger.Printf("error reading file '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to read file")
+		return
+	}
+	if preview, ok := h.videos.Get(info.SHA256); ok {
+		info.Video = &videoInfo{Duration: preview.Duration}
+		if preview.Poster {
+			info.Links.Poster = h.basePath + "/api/posters/" + escapePath(name)
+		}
+	}
+	h.render.JSON(w, http.StatusOK, info)
+}
+
+// detectMIMEType guesses a file's media type from its extension, falling back to
+// sniffing its first 512 bytes. The file offset is left at the start.
+func detectMIMEType(file io.ReadSeeker, name string) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t, nil
+	}
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(file, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// checksum returns the hex-encoded SHA-256 hash of the contents of file, stored at name,
+// preferring the one recorded in the file metadata whilst the file still matches stat.
+func (h *Handlers) checksum(r *http.Request, name string, file io.Reader, stat fs.FileInfo) (string, error) {
+	if sum, ok := h.fileMeta.Checksum(name, stat); ok {
+		return sum, nil
+	}
+	return checksumFile(r, file)
+}
+
+// checksumFile computes the hex-encoded SHA-256 hash of file's contents.
+// Why not record the result? The metadata's own worker is already hashing files without a
+// checksum, and hashing here stops early if the client goes away, so an abandoned request
+// costs little.
+func checksumFile(r *http.Request, file io.Reader) (string, error) {
+	hash := sha256.New()
+	buf := make([]byte, 1<<20) // 1 MB buffer
+	if _, err := io.CopyBuffer(hash, newContextReader(r.Context(), file), buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// escapePath percent-encodes each segment of a storage-relative path for use in a URL,
+// keeping the slashes that separate directories.
+func escapePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
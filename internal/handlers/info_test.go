@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// getFileInfo requests the details of name from h, and returns the response and the details
+// it holds, if any.
+func getFileInfo(t *testing.T, h *Handlers, name string) (*httptest.ResponseRecorder, fileInfo) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/api/files/"+escapePath(name), nil)
+	r.SetPathValue("name", name)
+	w := httptest.NewRecorder()
+	h.FileInfoHandler(w, r)
+	var info fileInfo
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &info); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, info
+}
+
+func TestFileInfo(t *testing.T) {
+	h := newTestHandlers(t, openTestTree(t, "a.txt", "docs/report final.txt", "docs/README"), nil)
+	sum := func(content string) string {
+		s := sha256.Sum256([]byte(content))
+		return hex.EncodeToString(s[:])
+	}
+	tests := []struct {
+		desc       string
+		name       string
+		wantStatus int
+		want       fileInfo
+	}{
+		{"a file", "a.txt", http.StatusOK, fileInfo{
+			Name: "a.txt", Type: "file", Size: 5, MIMEType: "text/plain; charset=utf-8", SHA256: sum("a.txt"),
+			Links: fileLinks{Self: "/api/files/a.txt", Download: "/download/a.txt"},
+		}},
+		{"a file whose name needs escaping", "docs/report final.txt", http.StatusOK, fileInfo{
+			Name: "docs/report final.txt", Type: "file", Size: 21, MIMEType: "text/plain; charset=utf-8", SHA256: sum("docs/report final.txt"),
+			Links: fileLinks{Self: "/api/files/docs/report%20final.txt", Download: "/download/docs/report%20final.txt"},
+		}},
+		{"a file without an extension, whose type is sniffed", "docs/README", http.StatusOK, fileInfo{
+			Name: "docs/README", Type: "file", Size: 11, MIMEType: "text/plain; charset=utf-8", SHA256: sum("docs/README"),
+			Links: fileLinks{Self: "/api/files/docs/README", Download: "/download/docs/README"},
+		}},
+		{"a directory", "docs", http.StatusOK, fileInfo{
+			Name: "docs", Type: "directory",
+			Links: fileLinks{Self: "/api/files/docs"},
+		}},
+		{"a missing file", "b.txt", http.StatusNotFound, fileInfo{}},
+		{"a name climbing out, kept within the storage directory", "../a.txt", http.StatusOK, fileInfo{
+			Name: "a.txt", Type: "file", Size: 5, MIMEType: "text/plain; charset=utf-8", SHA256: sum("a.txt"),
+			Links: fileLinks{Self: "/api/files/a.txt", Download: "/download/a.txt"},
+		}},
+		{"the storage directory", "..", http.StatusBadRequest, fileInfo{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w, got := getFileInfo(t, h, tt.name)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got.Modified.IsZero() {
+				t.Error("no modification time")
+			}
+			if (got.ETag != "") != (tt.want.Type == "file") {
+				t.Errorf("got ETag %q for a %s", got.ETag, tt.want.Type)
+			}
+			if tt.want.Type == "directory" {
+				// The size of a directory is whatever the file system reports.
+				got.Size = 0
+			}
+			if got.Name != tt.want.Name || got.Type != tt.want.Type || got.Size != tt.want.Size || got.MIMEType != tt.want.MIMEType || got.SHA256 != tt.want.SHA256 {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got.Links.Self != tt.want.Links.Self || got.Links.Download != tt.want.Links.Download {
+				t.Errorf("got links %+v, want %+v", got.Links, tt.want.Links)
+			}
+		})
+	}
+}
+
+// TestFileByID checks that a file is found by its ID after being moved, through the details
+// and the permanent link given for it.
+func TestFileByID(t *testing.T) {
+	root := openTestTree(t)
+	h := newTestHandlers(t, root, nil)
+	if w := upload(t, h, "/upload", formPart{"file", "a.txt", "content"}); w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	_, info := getFileInfo(t, h, "a.txt")
+	if info.ID == "" || info.Links.Permanent != "/api/files/by-id/"+info.ID+"/download" {
+		t.Fatalf("got ID %q and permanent link %q", info.ID, info.Links.Permanent)
+	}
+	ops, _ := json.Marshal(map[string]any{"operations": []batchOperation{{Op: "move", Path: "a.txt", To: "docs/b.txt"}}})
+	w := httptest.NewRecorder()
+	h.BatchHandler(w, asAdmin(httptest.NewRequest(http.MethodPost, "/api/batch", bytes.NewReader(ops))))
+	if w.Code != http.StatusOK {
+		t.Fatalf("moving: got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+
+	byID := func(handler http.HandlerFunc, id string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/api/files/by-id/"+id, nil)
+		r.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		handler(w, asAdmin(r))
+		return w
+	}
+	w = byID(h.FileByIDHandler, info.ID)
+	var moved fileInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &moved); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if moved.Name != "docs/b.txt" || moved.ID != info.ID || moved.Links.Permanent != info.Links.Permanent {
+		t.Errorf("got %+v, want docs/b.txt with the same ID", moved)
+	}
+	w = byID(h.DownloadByIDHandler, info.ID)
+	if w.Code != http.StatusOK || w.Body.String() != "content" {
+		t.Errorf("got status %d %q, want %d and the file", w.Code, w.Body, http.StatusOK)
+	}
+	if got, want := w.Header().Get("Content-Disposition"), `attachment; filename="b.txt"; filename*=UTF-8''b.txt`; got != want {
+		t.Errorf("got Content-Disposition %s, want %s", got, want)
+	}
+
+	for _, handler := range []http.HandlerFunc{h.FileByIDHandler, h.DownloadByIDHandler} {
+		if w := byID(handler, "unknown"); w.Code != http.StatusNotFound {
+			t.Errorf("got status %d for an unknown ID, want %d", w.Code, http.StatusNotFound)
+		}
+	}
+	// A file that vanished is no longer found.
+	h.fileMeta.Vanished("docs/b.txt")
+	if w := byID(h.FileByIDHandler, info.ID); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for a vanished file, want %d", w.Code, http.StatusNotFound)
+	}
+}
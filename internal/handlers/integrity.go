@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"context"
+	"time"
+)
+
+// watchIntegrity checks the stored files against their recorded checksums every interval,
+// until the handlers are closed.
+//
+// Only the leader checks, as every instance sharing the storage directory would otherwise
+// read all of it again.
+func (h *Handlers) watchIntegrity(interval time.Duration) {
+	h.every(interval, func() {
+		if h.leader.Leading() {
+			h.checkIntegrity(h.ctx)
+		}
+	})
+}
+
+// checkIntegrity checks the stored files against their recorded checksums, logging those
+// the storage has corrupted. It stops once ctx is done.
+//
+// Why not repair them? Only a backup or a replica holds the right contents; the log tells an
+// administrator which files to restore, and the recorded checksum verifies the restored copy.
+func (h *Handlers) checkIntegrity(ctx context.Context) {
+	start := time.Now()
+	checked, corrupt := h.fileMeta.Verify(ctx)
+	for _, e := range corrupt {
+		h.logger.Printf("ERROR: '%s' is corrupt: its contents no longer match the checksum %s recorded when it was stored at %s\n",
+			e.Path, e.SHA256, e.Modified.Format(time.RFC3339))
+	}
+	h.logger.Printf("checked the integrity of %d files in %s: %d corrupt\n", checked, time.Since(start).Round(time.Second), len(corrupt))
+}
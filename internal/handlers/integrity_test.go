@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckIntegrity(t *testing.T) {
+	files := []string{"intact.txt", "corrupt.txt", "rewritten.txt"}
+	root := openTestTree(t, files...)
+	var logs bytes.Buffer
+	h := newTestHandlers(t, root, log.New(&logs, "", 0))
+	for _, name := range files {
+		info, err := root.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each test file holds its own name.
+		sum := sha256.Sum256([]byte(name))
+		h.fileMeta.Record(name, info, hex.EncodeToString(sum[:]))
+	}
+
+	// The storage flips bits without changing the file's size or time.
+	info, err := root.Stat("corrupt.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := root.WriteFile("corrupt.txt", []byte("CORRUPT.txt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Chtimes("corrupt.txt", info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	// A write the store has not heard of yet changes the time.
+	later := time.Now().Add(time.Hour)
+	if err := root.WriteFile("rewritten.txt", []byte("REWRITTEN.txt"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Chtimes("rewritten.txt", later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	logs.Reset()
+	h.checkIntegrity(t.Context())
+
+	out := logs.String()
+	if !strings.Contains(out, "'corrupt.txt' is corrupt") {
+		t.Errorf("the corrupt file is not logged:\n%s", out)
+	}
+	for _, name := range []string{"intact.txt", "rewritten.txt"} {
+		if strings.Contains(out, "'"+name+"' is corrupt") {
+			t.Errorf("'%s' is logged as corrupt:\n%s", name, out)
+		}
+	}
+	if !strings.Contains(out, "checked the integrity of 2 files") || !strings.Contains(out, ": 1 corrupt") {
+		t.Errorf("the summary does not count 2 files checked and 1 corrupt:\n%s", out)
+	}
+}
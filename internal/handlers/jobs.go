@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/authz"
+	"github.com/mascotmascot1/fileserver/internal/jobs"
+)
+
+// wantsAsync reports whether the files of the upload r are to be processed by a background
+// job, as configured by processing.async.
+func (h *Handlers) wantsAsync(r *http.Request) bool {
+	switch h.asyncMode {
+	case "always":
+		return true
+	case "request":
+		return prefersAsync(r)
+	}
+	return false
+}
+
+// prefersAsync reports whether r carries the respond-async preference of RFC 7240.
+func prefersAsync(r *http.Request) bool {
+	for _, v := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(v, ",") {
+			if name, _, _ := strings.Cut(strings.TrimSpace(pref), ";"); strings.EqualFold(name, "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// acceptJob submits the job of an upload whose files have been staged, and answers with
+// 202 Accepted and the job, whose status can then be polled at its Location.
+func (h *Handlers) acceptJob(w http.ResponseWriter, r *http.Request, job *jobs.Job) {
+	if err := h.jobs.Submit(job); err != nil {
+		h.jobs.Discard(job)
+		// Why refuse rather than queue regardless? Staged files fill the disk much as stored
+		// ones do, and a client told to come back later can do so once the backlog clears.
+		if errors.Is(err, jobs.ErrQueueFull) {
+			h.logger.Printf("refused upload from %s: %v\n", r.RemoteAddr, err)
+			w.Header().Set("Retry-After", "60")
+			h.render.Error(w, r, http.StatusServiceUnavailable, "too many uploads are waiting to be processed")
+			return
+		}
+		h.logger.Printf("error submitting job %s: %v\n", job.ID, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to queue the upload for processing")
+		return
+	}
+	h.logger.Printf("queued job %s with %d files from %s\n", job.ID, len(job.Files), r.RemoteAddr)
+	if prefersAsync(r) {
+		w.Header().Set("Preference-Applied", "respond-async")
+	}
+	w.Header().Set("Location", h.basePath+"/api/jobs/"+job.ID)
+	h.render.JSON(w, http.StatusAccepted, job)
+}
+
+// processJobFile validates and stores one file of a background job, as UploadHandler does
+// for the files it stores itself. Storing stops once ctx is done.
+func (h *Handlers) processJobFile(ctx context.Context, job jobs.Job, file jobs.File, content *os.File) jobs.File {
+	fh := &multipart.FileHeader{Filename: file.Name, Header: make(textproto.MIMEHeader), Size: file.Size}
+	if file.ContentDigest != "" {
+		fh.Header.Set("Content-Digest", file.ContentDigest)
+	}
+	if fail := h.checkUpload("in job "+job.ID, job.User, file.Name, fh, content); fail != nil {
+		// Failures with a status are the file's fault; the others, the server's.
+		file.Status = jobs.Failed
+		if fail.status != 0 {
+			file.Status = jobs.Rejected
+		}
+		file.Error = fail.msg
+		return file
+	}
+
+	if err := h.makeStorageDir(); err != nil {
+		h.logger.Printf("error creating file directory: %v\n", err)
+		file.Status, file.Error = jobs.Failed, "unable to prepare storage directory"
+		return file
+	}
+	root, err := h.storage.OpenRoot(file.Name)
+	if err != nil {
+		h.logger.Printf("error root opening: %v\n", err)
+		file.Status, file.Error = jobs.Failed, "internal error"
+		return file
+	}
+	defer root.Close()
+
+	sum, fail := h.storeUpload(root, file.Name, newContextReader(ctx, content), job.CreateOnly, job.User, file.Size)
+	if fail != nil {
+		file.Status, file.Error = jobs.Failed, fail.msg
+		return file
+	}
+	if err := h.setClientModified(root, file.Name, file.Modified, sum); err != nil {
+		h.logger.Printf("error setting modification time of '%s': %v\n", file.Name, err)
+	}
+	h.fileMeta.SetFields(file.Name, job.Fields)
+	file.Status, file.SHA256 = jobs.Stored, sum
+	return file
+}
+
+// JobHandler reports the status of a background job, and the outcome of each of its files.
+// Only the user who uploaded the files, or an administrator, can see it.
+func (h *Handlers) JobHandler(w http.ResponseWriter, r *http.Request) {
+	job, ok := h.jobs.Get(r.PathValue("id"))
+	p := principalFrom(r)
+	if !ok || (job.User != principalName(p) && !h.authz.Can(p, authz.PermAdmin)) {
+		h.render.Error(w, r, http.StatusNotFound, "job is not found")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	h.render.JSON(w, http.StatusOK, job)
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/jobs"
+)
+
+// TestAsyncUpload checks that uploads asking for it are processed by background jobs, and
+// refused with 503 once as many jobs wait as the queue holds.
+func TestAsyncUpload(t *testing.T) {
+	root := openTestTree(t)
+	h := newTestHandlers(t, root, nil)
+	dir := t.TempDir()
+	cfg := config.Default().Processing
+	cfg.Workers, cfg.QueueDepth = 1, 1
+	q, err := jobs.Open(filepath.Join(dir, "jobs.json"), filepath.Join(dir, "staging"), cfg, h.logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.jobs, h.asyncMode = q, "request"
+
+	send := func(name string) *httptest.ResponseRecorder {
+		body, contentType := encodeForm(t, formPart{"file", name, name})
+		r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Prefer", "wait=10, respond-async")
+		w := httptest.NewRecorder()
+		h.UploadHandler(w, asAdmin(r))
+		return w
+	}
+
+	// The workers are not started yet, so the first job waits in the queue.
+	w := send("a.txt")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusAccepted)
+	}
+	var job jobs.Job
+	if err := json.Unmarshal(w.Body.Bytes(), &job); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Location") != "/api/jobs/"+job.ID || w.Header().Get("Preference-Applied") != "respond-async" {
+		t.Errorf("got headers %v", w.Header())
+	}
+	if exists(t, root, "a.txt") {
+		t.Error("a.txt stored before its job ran")
+	}
+
+	w = send("b.txt")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "60" {
+		t.Errorf("got status %d %s and Retry-After %q, want %d", w.Code, w.Body, w.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+	// Only the queued job's files are staged.
+	if staged, _ := os.ReadDir(filepath.Join(dir, "staging")); len(staged) != 1 {
+		t.Errorf("%d jobs staged, want 1", len(staged))
+	}
+
+	q.Start(h.processJobFile)
+	defer q.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for job, _ = q.Get(job.ID); job.Status != jobs.Done && time.Now().Before(deadline); job, _ = q.Get(job.ID) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if job.Status != jobs.Done || job.Files[0].Status != jobs.Stored {
+		t.Fatalf("got job %+v, want a.txt stored", job)
+	}
+	if b, err := root.ReadFile("a.txt"); err != nil || string(b) != "a.txt" {
+		t.Errorf("a.txt holds %q, %v", b, err)
+	}
+}
+
+func TestPrefersAsync(t *testing.T) {
+	tests := []struct {
+		prefer []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"respond-async"}, true},
+		{[]string{"wait=10, Respond-Async"}, true},
+		{[]string{"return=minimal", "respond-async; foo=bar"}, true},
+		{[]string{"respond-asynchronously"}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		for _, v := range tt.prefer {
+			r.Header.Add("Prefer", v)
+		}
+		if got := prefersAsync(r); got != tt.want {
+			t.Errorf("prefersAsync(%q) = %v, want %v", tt.prefer, got, tt.want)
+		}
+	}
+}
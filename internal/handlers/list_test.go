@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// TestDownloadListJSON checks that the JSON listing gives each file the fields it was
+// uploaded with, and leaves them out for files uploaded without any.
+func TestDownloadListJSON(t *testing.T) {
+	files := []string{"a.txt", "docs/b.txt"}
+	root := openTestTree(t, files...)
+	h := newTestHandlers(t, root, nil)
+	if err := h.index.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		info, err := root.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.fileMeta.Record(name, info, "checksum")
+	}
+	h.fileMeta.SetFields("docs/b.txt", map[string]string{"description": "quarterly figures", "project": "atlas"})
+
+	r := httptest.NewRequest(http.MethodGet, "/download/list.txt", nil)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	h.DownloadList(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	var got struct {
+		Files []struct {
+			Name     string            `json:"name"`
+			Size     int64             `json:"size"`
+			Metadata map[string]string `json:"metadata"`
+		} `json:"files"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		"a.txt":      nil,
+		"docs/b.txt": {"description": "quarterly figures", "project": "atlas"},
+	}
+	if len(got.Files) != len(want) {
+		t.Fatalf("listing holds %d files, want %d: %s", len(got.Files), len(want), w.Body)
+	}
+	for _, f := range got.Files {
+		// Each test file holds its own name.
+		if f.Size != int64(len(f.Name)) {
+			t.Errorf("'%s' listed with size %d, want %d", f.Name, f.Size, len(f.Name))
+		}
+		if !reflect.DeepEqual(f.Metadata, want[f.Name]) {
+			t.Errorf("'%s' listed with metadata %v, want %v", f.Name, f.Metadata, want[f.Name])
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/locks"
+)
+
+// Lock timeouts. Why cap them? An abandoned lock blocks other clients until it expires, so
+// clients that need longer must refresh their lock, proving they are still alive.
+const (
+	defaultLockTimeout = 10 * time.Minute
+	maxLockTimeout     = time.Hour
+)
+
+// LockHandler acquires an advisory lock on a file, or refreshes one when the request carries
+// its token in a Lock-Token (or WebDAV If) header. Cooperating clients lock a shared file
+// before editing it, so they do not clobber each other's changes. The lock does not stop
+// other writes; it only tells other clients that the file is being edited.
+func (h *Handlers) LockHandler(w http.ResponseWriter, r *http.Request) {
+	defer cleanupRequest(r)
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	p := principalFrom(r)
+	if !h.acl.Allowed(p, acl.Write, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	timeout, err := parseLockTimeout(r.Header.Get("Timeout"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid Timeout header", err.Error())
+		return
+	}
+
+	var lock locks.Lock
+	if token := lockTokenFrom(r); token != "" {
+		lock, err = h.locks.Refresh(name, token, timeout)
+		if err != nil {
+			h.render.Error(w, r, http.StatusPreconditionFailed, err.Error())
+			return
+		}
+	} else {
+		// The body is optional and names the lock's owner for other clients, e.g. a person.
+		var req struct {
+			Owner string `json:"owner"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxHoldBodySize)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			h.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+			return
+		}
+		lock, err = h.locks.Acquire(name, req.Owner, principalName(p), timeout)
+		if err != nil {
+			if errors.Is(err, locks.ErrLocked) {
+				h.render.Error(w, r, http.StatusLocked, err.Error())
+				return
+			}
+			h.logger.Printf("error creating lock token: %v\n", err)
+			h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+			return
+		}
+		h.logger.Printf("%s locked '%s' until %s\n", lock.LockedBy, name, lock.Expires.Format(time.RFC3339))
+	}
+
+	w.Header().Set("Lock-Token", "<"+lock.Token+">")
+	h.render.JSON(w, http.StatusOK, lock)
+}
+
+// UnlockHandler releases the advisory lock held with the token in the Lock-Token header.
+func (h *Handlers) UnlockHandler(w http.ResponseWriter, r *http.Request) {
+	defer cleanupRequest(r)
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Write, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	token := lockTokenFrom(r)
+	if token == "" {
+		h.render.Error(w, r, http.StatusBadRequest, "Lock-Token header is required")
+		return
+	}
+	// Why 409? WebDAV answers an UNLOCK with a token that does not hold the lock this way.
+	if err := h.locks.Release(name, token); err != nil {
+		h.render.Error(w, r, http.StatusConflict, err.Error())
+		return
+	}
+	h.logger.Printf("%s unlocked '%s'\n", principalName(principalFrom(r)), name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lockTokenFrom returns the lock token a request carries, from a Lock-Token header or from
+// the simple "(<token>)" form of a WebDAV If header, without angle brackets.
+func lockTokenFrom(r *http.Request) string {
+	v := r.Header.Get("Lock-Token")
+	if v == "" {
+		v = strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("If"), "("), ")")
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(v), "<"), ">")
+}
+
+// parseLockTimeout parses a WebDAV Timeout header ("Second-600" or "Infinite"), capping it
+// at maxLockTimeout. An absent header selects defaultLockTimeout.
+func parseLockTimeout(header string) (time.Duration, error) {
+	if header == "" {
+		return defaultLockTimeout, nil
+	}
+	// Clients may offer several timeouts; the first is the one they prefer.
+	first, _, _ := strings.Cut(header, ",")
+	first = strings.TrimSpace(first)
+	if strings.EqualFold(first, "Infinite") {
+		return maxLockTimeout, nil
+	}
+	secs, ok := strings.CutPrefix(first, "Second-")
+	if !ok {
+		return 0, errors.New(`expected "Second-<n>" or "Infinite"`)
+	}
+	n, err := strconv.ParseInt(secs, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, errors.New("the timeout must be a positive number of seconds")
+	}
+	return min(time.Duration(n)*time.Second, maxLockTimeout), nil
+}
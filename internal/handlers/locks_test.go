@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/locks"
+)
+
+// lockRequest sends a LOCK or UNLOCK request for name with the given headers as an admin,
+// and returns the response.
+func lockRequest(h *Handlers, method, name, body string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/api/files/"+name, strings.NewReader(body))
+	r.SetPathValue("name", name)
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	if method == "UNLOCK" {
+		h.UnlockHandler(w, asAdmin(r))
+	} else {
+		h.LockHandler(w, asAdmin(r))
+	}
+	return w
+}
+
+func TestLocks(t *testing.T) {
+	h := newTestHandlers(t, openTestTree(t, "docs/a.txt"), nil)
+
+	w := lockRequest(h, "LOCK", "docs/a.txt", `{"owner": "Alice's laptop"}`, map[string]string{"Timeout": "Second-60"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	var lock locks.Lock
+	if err := json.Unmarshal(w.Body.Bytes(), &lock); err != nil {
+		t.Fatal(err)
+	}
+	if w.Header().Get("Lock-Token") != "<"+lock.Token+">" || lock.Owner != "Alice's laptop" || lock.LockedBy != "admin" {
+		t.Errorf("got Lock-Token %s and %+v", w.Header().Get("Lock-Token"), lock)
+	}
+	if d := time.Until(lock.Expires); d <= 0 || d > time.Minute {
+		t.Errorf("lock expires in %v, want a minute", d)
+	}
+
+	// Others see who holds the lock, but not its token.
+	if w, info := getFileInfo(t, h, "docs/a.txt"); w.Code != http.StatusOK || info.Lock == nil || info.Lock.Owner != "Alice's laptop" || info.Lock.Token != "" {
+		t.Errorf("got status %d and lock %+v in the file info", w.Code, info.Lock)
+	}
+
+	tests := []struct {
+		desc       string
+		method     string
+		body       string
+		header     map[string]string
+		wantStatus int
+	}{
+		{"locking it again", "LOCK", "", nil, http.StatusLocked},
+		{"refreshing with another token", "LOCK", "", map[string]string{"Lock-Token": "<opaquelocktoken:other>"}, http.StatusPreconditionFailed},
+		{"refreshing through an If header", "LOCK", "", map[string]string{"If": "(<" + lock.Token + ">)", "Timeout": "Infinite"}, http.StatusOK},
+		{"an invalid timeout", "LOCK", "", map[string]string{"Timeout": "Minute-5"}, http.StatusBadRequest},
+		{"a malformed body", "LOCK", "{", nil, http.StatusBadRequest},
+		{"unlocking without a token", "UNLOCK", "", nil, http.StatusBadRequest},
+		{"unlocking with another token", "UNLOCK", "", map[string]string{"Lock-Token": "<opaquelocktoken:other>"}, http.StatusConflict},
+		{"unlocking", "UNLOCK", "", map[string]string{"Lock-Token": "<" + lock.Token + ">"}, http.StatusNoContent},
+		{"unlocking again", "UNLOCK", "", map[string]string{"Lock-Token": "<" + lock.Token + ">"}, http.StatusConflict},
+		{"locking it once unlocked", "LOCK", "", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w := lockRequest(h, tt.method, "docs/a.txt", tt.body, tt.header)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestParseLockTimeout(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", defaultLockTimeout, false},
+		{"Second-600", 10 * time.Minute, false},
+		{"Second-30, Infinite", 30 * time.Second, false},
+		{"Infinite", maxLockTimeout, false},
+		{"Second-86400", maxLockTimeout, false},
+		{"Second-0", 0, true},
+		{"Second--5", 0, true},
+		{"600", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			got, err := parseLockTimeout(tt.header)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("got %v, %v, want %v, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+
+	"github.com/mascotmascot1/fileserver/internal/mirror"
+)
+
+// Error returns the message of the failure, so that a failed pull from the upstream can be
+// shared with the requests waiting for it.
+func (f *uploadFailure) Error() string {
+	return f.msg
+}
+
+// pullFromMirror fetches the file name, which is not stored, from the upstream and stores it.
+// It answers the request itself, and reports false, if the file could not be pulled.
+func (h *Handlers) pullFromMirror(w http.ResponseWriter, r *http.Request, name string) bool {
+	user := principalName(principalFrom(r))
+	// Why not pull with the request's context? Other requests may be waiting for the same
+	// pull, and a client that gives up should not fail it for them; the timeout bounds it.
+	ctx := context.WithoutCancel(r.Context())
+	err := h.upstream.Once(name, func() error {
+		return h.pull(ctx, user, name)
+	})
+	var fail *uploadFailure
+	var statusErr *mirror.StatusError
+	switch {
+	case err == nil:
+		return true
+	case r.Context().Err() != nil:
+		h.logger.Printf("client %s disconnected whilst '%s' was pulled from the upstream\n", r.RemoteAddr, name)
+	case errors.Is(err, mirror.ErrNotFound):
+		h.render.Error(w, r, http.StatusNotFound, "file is not found")
+	case errors.As(err, &fail):
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+	case errors.As(err, &statusErr):
+		h.render.Error(w, r, http.StatusBadGateway, "unable to fetch file from upstream", err.Error())
+	default:
+		h.logger.Printf("error pulling '%s' from the upstream: %v\n", name, err)
+		h.render.Error(w, r, http.StatusBadGateway, "unable to fetch file from upstream")
+	}
+	return false
+}
+
+// pull fetches the file name from the upstream and stores it, after the checks an upload goes
+// through, with the modification time the upstream gives it.
+func (h *Handlers) pull(ctx context.Context, user, name string) error {
+	maxSize := h.uploader.GetMaxUploadSize()
+	if mirrorMax := h.mirror.GetMaxSize(); mirrorMax > 0 && mirrorMax < maxSize {
+		maxSize = mirrorMax
+	}
+	tooLarge := &uploadFailure{http.StatusBadGateway, fmt.Sprintf("file '%s' exceeds the maximum size of %d bytes", name, maxSize)}
+
+	resp, err := h.upstream.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.ContentLength > maxSize {
+		h.logger.Printf("file '%s' upstream exceeds the limit of %d bytes\n", name, maxSize)
+		return tooLarge
+	}
+
+	// Downloaded to a temporary file first, as validation reads the file before it is stored.
+	tmp, err := os.CreateTemp("", "mirror-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	n, err := io.Copy(tmp, io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if n > maxSize {
+		h.logger.Printf("file '%s' upstream exceeds the limit of %d bytes\n", name, maxSize)
+		return tooLarge
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := h.makeStorageDir(); err != nil {
+		return err
+	}
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+
+	from := "from " + h.upstream.URL(name)
+	if fail := h.checkUpload(from, user, name, &multipart.FileHeader{Filename: name, Size: n}, tmp); fail != nil {
+		return fail
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	// Create-only, so that a file uploaded here in the meantime is not replaced by the
+	// upstream's copy.
+	sum, fail := h.storeUpload(root, name, tmp, true, user, n)
+	if fail != nil {
+		if fail.status == http.StatusPreconditionFailed {
+			return nil
+		}
+		return fail
+	}
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		if err := h.setClientModified(root, name, modified, sum); err != nil {
+			h.logger.Printf("error setting modification time of '%s': %v\n", name, err)
+		}
+	}
+	h.logger.Printf("mirrored %d bytes of '%s' %s\n", n, name, from)
+	return nil
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/mirror"
+)
+
+func TestMirror(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/download/docs/a.txt":
+			w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+			io.WriteString(w, "from upstream")
+		case "/download/large.bin":
+			io.WriteString(w, strings.Repeat("x", 1<<20+1))
+		case "/download/broken.txt":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	root := openTestTree(t, "local.txt")
+	h := newTestHandlers(t, root, nil)
+	h.mirror = &config.MirrorConfig{Upstream: upstream.URL + "/download/", MaxSizeMB: 1, Timeout: time.Minute}
+	m, err := mirror.New(*h.mirror)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.upstream = m
+
+	tests := []struct {
+		desc       string
+		name       string
+		wantStatus int
+		want       string
+		wantHits   int // requests the upstream has had for the file, in all
+	}{
+		{"a stored file", "local.txt", http.StatusOK, "local.txt", 0},
+		{"a file that is not stored", "docs/a.txt", http.StatusOK, "from upstream", 1},
+		// Served from storage, once pulled.
+		{"the file again", "docs/a.txt", http.StatusOK, "from upstream", 1},
+		{"a file the upstream does not have", "missing.txt", http.StatusNotFound, "", 1},
+		{"a failing upstream", "broken.txt", http.StatusBadGateway, "", 1},
+		{"a file over the size limit", "large.bin", http.StatusBadGateway, "", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/download/"+tt.name, nil)
+			r.SetPathValue("name", tt.name)
+			w := httptest.NewRecorder()
+			h.DownloadHandle(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			mu.Lock()
+			got := hits["/download/"+tt.name]
+			mu.Unlock()
+			if got != tt.wantHits {
+				t.Errorf("the upstream had %d requests, want %d", got, tt.wantHits)
+			}
+			if w.Code != http.StatusOK {
+				if exists(t, root, tt.name) {
+					t.Errorf("'%s' was stored", tt.name)
+				}
+				return
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("got %q, want %q", w.Body, tt.want)
+			}
+		})
+	}
+
+	// A mirrored file keeps the time the upstream gives it.
+	info, err := root.Stat("docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modified) {
+		t.Errorf("got modification time %v, want %v", info.ModTime(), modified)
+	}
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// ListMissingHandler returns the files that vanished from the storage directory without the
+// server deleting them, with the size and checksum they last had. Admin only.
+func (h *Handlers) ListMissingHandler(w http.ResponseWriter, r *http.Request) {
+	h.render.JSON(w, http.StatusOK, h.fileMeta.Missing())
+}
+
+// ForgetMissingHandler drops the record of a vanished file once it has been dealt with.
+// Admin only.
+func (h *Handlers) ForgetMissingHandler(w http.ResponseWriter, r *http.Request) {
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if !h.fileMeta.Forget(name) {
+		h.render.Error(w, r, http.StatusNotFound, "file is not missing")
+		return
+	}
+	h.logger.Printf("%s forgot the missing file '%s'\n", principalName(principalFrom(r)), name)
+	w.WriteHeader(http.StatusNoContent)
+}
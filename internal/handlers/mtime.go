@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// errMalformedModified reports a modification time sent by the client that cannot be parsed.
+var errMalformedModified = errors.New("malformed modification time")
+
+// clientModified returns the modification time the client asked an uploaded file to be
+// given: the Last-Modified header of its part, or else the lastModified field of the form.
+// It is zero if the client sent neither.
+//
+// Why both? The header suits clients that mirror directory trees, each file with its own
+// time; the field suits a browser uploading a single file, with the File's lastModified.
+func clientModified(fh *multipart.FileHeader, form *multipart.Form) (time.Time, error) {
+	if v := fh.Header.Get("Last-Modified"); v != "" {
+		return parseClientTime(v)
+	}
+	if v := form.Value["lastModified"]; len(v) > 0 && v[0] != "" {
+		return parseClientTime(v[0])
+	}
+	return time.Time{}, nil
+}
+
+// parseClientTime parses a modification time sent by a client: Unix milliseconds, as
+// browsers give them, RFC 3339, or an HTTP date.
+func parseClientTime(s string) (time.Time, error) {
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.UnixMilli(ms), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, errMalformedModified
+}
+
+// setModified gives the file name, just stored with the checksum sum, the modification time
+// t, and records it with the new time. A zero t leaves the file as it is.
+func (h *Handlers) setModified(root storage.Root, name string, t time.Time, sum string) error {
+	if t.IsZero() {
+		return nil
+	}
+	if err := root.Chtimes(name, time.Time{}, t); err != nil {
+		return err
+	}
+	info, err := root.Stat(name)
+	if err != nil {
+		return err
+	}
+	h.fileMeta.Record(name, info, sum)
+	h.fileCache.Invalidate(name)
+	return nil
+}
+
+// setClientModified is setModified for a time the client, or the upstream of a mirrored file,
+// asked the file to be given. Files stored under write-once retention keep the time they were
+// stored.
+//
+// Why? Retention runs from the modification time, so a file dated in the past would be
+// released early, or at once.
+func (h *Handlers) setClientModified(root storage.Root, name string, t time.Time, sum string) error {
+	if !t.IsZero() && h.retention.retains(name) {
+		h.logger.Printf("warn: '%s' is write-once and keeps the time it was stored rather than %s\n", name, t.UTC().Format(time.RFC3339))
+		return nil
+	}
+	return h.setModified(root, name, t, sum)
+}
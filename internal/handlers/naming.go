@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"fmt"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// storedName applies uploader.nameTemplate to the file name of an upload, keeping the
+// folders the file was uploaded in.
+//
+// Why rename at all? Devices such as phones and cameras upload every photo as "image.jpg",
+// and without a unique part in the name each upload would replace the one before.
+func (h *Handlers) storedName(name string) string {
+	if h.uploader.NameTemplate == "" {
+		return name
+	}
+	return path.Join(path.Dir(name), h.uploader.StoredName(path.Base(name), time.Now(), newUUID()))
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// uploadedFile describes a file of an upload, stored or not, in the JSON answer to the upload.
+type uploadedFile struct {
+	// Field is the form field the file was sent in, and Filename the name it was sent with.
+	Field    string `json:"field"`
+	Filename string `json:"filename"`
+	// Name is the path the file was stored at, which differs from the one it was uploaded
+	// as if it was filed into a directory or renamed. It is empty if the name was refused.
+	Name string `json:"name,omitempty"`
+	// Status is "stored" or "failed".
+	Status string `json:"status"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+	URL    string `json:"url,omitempty"`
+	// Error says why a file failed, and Code is the status an upload of it alone would have
+	// been answered with.
+	Error string `json:"error,omitempty"`
+	Code  int    `json:"code,omitempty"`
+	// Transfer says how fast a stored file arrived and was written.
+	Transfer *transferStats `json:"transfer,omitempty"`
+}
+
+// transferStats times the two halves of storing an uploaded file: receiving it from the
+// client, and writing it to the storage directory.
+//
+// Why both? A slow upload is either the network's fault or the disk's, and a client cannot
+// tell which from the time the whole request took.
+type transferStats struct {
+	ReceiveSeconds        float64 `json:"receiveSeconds"`
+	ReceiveBytesPerSecond int64   `json:"receiveBytesPerSecond"`
+	StoreSeconds          float64 `json:"storeSeconds"`
+	StoreBytesPerSecond   int64   `json:"storeBytesPerSecond"`
+}
+
+// newTransferStats returns the statistics of a file of size bytes that took received to
+// arrive and stored to be written.
+func newTransferStats(size int64, received, stored time.Duration) *transferStats {
+	return &transferStats{
+		ReceiveSeconds:        received.Seconds(),
+		ReceiveBytesPerSecond: bytesPerSecond(size, received),
+		StoreSeconds:          stored.Seconds(),
+		StoreBytesPerSecond:   bytesPerSecond(size, stored),
+	}
+}
+
+// bytesPerSecond returns the rate of n bytes moved in d, or 0 if d is too short to measure.
+func bytesPerSecond(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) / d.Seconds())
+}
+
+// String summarises the statistics for the log, in MiB/s.
+func (ts *transferStats) String() string {
+	return fmt.Sprintf("received in %s (%.1f MiB/s), written in %s (%.1f MiB/s)",
+		roundDuration(ts.ReceiveSeconds), float64(ts.ReceiveBytesPerSecond)/(1<<20),
+		roundDuration(ts.StoreSeconds), float64(ts.StoreBytesPerSecond)/(1<<20))
+}
+
+// roundDuration returns secs as a duration rounded for display.
+func roundDuration(secs float64) time.Duration {
+	d := time.Duration(secs * float64(time.Second))
+	if d >= time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Microsecond)
+}
+
+// uploadResults is the JSON answer to an upload, for clients that ask for JSON. Whether
+// files failed or not, it has the fields of the error document, so that clients written
+// against either keep working.
+type uploadResults struct {
+	Status  int            `json:"status"`
+	Error   string         `json:"error,omitempty"`
+	Message string         `json:"message"`
+	Details []string       `json:"details,omitempty"`
+	Stored  int            `json:"stored"`
+	Failed  int            `json:"failed"`
+	Files   []uploadedFile `json:"files"`
+}
+
+// errorText returns the text of the status of an upload that failed in part or whole, or ""
+// for one that succeeded.
+func errorText(status int) string {
+	if status == http.StatusOK {
+		return ""
+	}
+	return http.StatusText(status)
+}
+
+// acceptsJSON reports whether the client asked for JSON in its Accept header.
+//
+// Why not go by the renderer's negotiation? That answers clients without a preference with
+// JSON, and the plain-text answer to uploads is what existing scripts expect.
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,257 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewUUID(t *testing.T) {
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	seen := make(map[string]bool)
+	for range 100 {
+		id := newUUID()
+		if !uuid.MatchString(id) {
+			t.Fatalf("got %s, want a version 4 UUID", id)
+		}
+		if seen[id] {
+			t.Fatalf("got %s twice", id)
+		}
+		seen[id] = true
+	}
+}
+
+// TestNameTemplate checks that uploads are renamed by the template, keeping their folders, so
+// that files uploaded under the same name do not replace each other, and that a client asking
+// for JSON learns the names they were stored under.
+func TestNameTemplate(t *testing.T) {
+	root := openTestTree(t)
+	h := newTestHandlers(t, root, nil)
+	h.uploader.NameTemplate = "{date}-{uuid}-{original}"
+	stored := regexp.MustCompile(`^camera/\d{4}-\d\d-\d\d-[0-9a-f-]{36}-image\.jpg$`)
+
+	var names []string
+	for _, content := range []string{"first", "second"} {
+		body, contentType := encodeForm(t, formPart{"file", "camera/image.jpg", content})
+		r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		h.UploadHandler(w, asAdmin(r))
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+		}
+		var res struct {
+			Files []uploadedFile `json:"files"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Files) != 1 || !stored.MatchString(res.Files[0].Name) {
+			t.Fatalf("got files %+v, want image.jpg renamed", res.Files)
+		}
+		if want := "/download/" + escapePath(res.Files[0].Name); res.Files[0].URL != want {
+			t.Errorf("got URL %s, want %s", res.Files[0].URL, want)
+		}
+		if b, err := root.ReadFile(res.Files[0].Name); err != nil || string(b) != content {
+			t.Errorf("%s holds %q, %v, want %q", res.Files[0].Name, b, err, content)
+		}
+		names = append(names, res.Files[0].Name)
+	}
+	if names[0] == names[1] {
+		t.Errorf("both uploads stored as %s", names[0])
+	}
+}
+
+// sha256Hex returns the SHA-256 checksum of s, in hex.
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// TestUploadResults checks that a client asking for JSON learns what became of every file
+// of an upload, whether it succeeded, failed in part or failed as a whole.
+func TestUploadResults(t *testing.T) {
+	stored := func(filename, name, content string) uploadedFile {
+		return uploadedFile{Field: "file", Filename: filename, Name: name, Status: "stored", Size: int64(len(content)),
+			SHA256: sha256Hex(content), URL: "/download/" + escapePath(name)}
+	}
+	failed := func(filename, name, content string, code int) uploadedFile {
+		return uploadedFile{Field: "file", Filename: filename, Name: name, Status: "failed", Size: int64(len(content)), Code: code}
+	}
+	tests := []struct {
+		desc        string
+		ifNoneMatch bool
+		parts       []formPart
+		wantStatus  int
+		wantError   string
+		wantStored  int
+		want        []uploadedFile
+	}{
+		{"every file stored", false, []formPart{{"file", "docs/a b.txt", "a"}, {"file", "b.txt", "bb"}}, http.StatusOK, "", 2,
+			[]uploadedFile{stored("docs/a b.txt", "docs/a b.txt", "a"), stored("b.txt", "b.txt", "bb")}},
+		{"a file refused", false, []formPart{{"file", "../c.txt", "c"}, {"file", "b.txt", "bb"}}, http.StatusMultiStatus, "Multi-Status", 1,
+			[]uploadedFile{failed("../c.txt", "", "c", http.StatusBadRequest), stored("b.txt", "b.txt", "bb")}},
+		// A file failing on a precondition, alone, fails the upload with its status.
+		{"every file failed", true, []formPart{{"file", "exists.txt", "new"}}, http.StatusPreconditionFailed, "Precondition Failed", 0,
+			[]uploadedFile{failed("exists.txt", "exists.txt", "new", http.StatusPreconditionFailed)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h := newTestHandlers(t, openTestTree(t, "exists.txt"), nil)
+			body, contentType := encodeForm(t, tt.parts...)
+			r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+			r.Header.Set("Content-Type", contentType)
+			r.Header.Set("Accept", "application/json")
+			if tt.ifNoneMatch {
+				r.Header.Set("If-None-Match", "*")
+			}
+			w := httptest.NewRecorder()
+			h.UploadHandler(w, asAdmin(r))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			var res uploadResults
+			if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+				t.Fatal(err)
+			}
+			failures := len(tt.want) - tt.wantStored
+			if res.Status != tt.wantStatus || res.Error != tt.wantError || res.Stored != tt.wantStored || res.Failed != failures || len(res.Details) != failures {
+				t.Errorf("got status %d %q, %d stored, %d failed, details %v", res.Status, res.Error, res.Stored, res.Failed, res.Details)
+			}
+			// Failed files say why, as the details do. How long stored ones took varies.
+			for i := range res.Files {
+				f := &res.Files[i]
+				if f.Status == "failed" && f.Error == "" {
+					t.Errorf("%s failed without an error", f.Filename)
+				}
+				f.Error, f.Transfer = "", nil
+			}
+			if !reflect.DeepEqual(res.Files, tt.want) {
+				t.Errorf("got files %+v, want %+v", res.Files, tt.want)
+			}
+		})
+	}
+
+	// Clients not asking for JSON are answered as before.
+	h := newTestHandlers(t, openTestTree(t), nil)
+	if w := upload(t, h, "/upload", formPart{"file", "a.txt", "a"}); w.Code != http.StatusOK || w.Body.String() != "All files uploaded successfully\n" {
+		t.Errorf("got status %d %q", w.Code, w.Body)
+	}
+}
+
+func TestAcceptsJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{"", false},
+		{"*/*", false},
+		{"text/plain", false},
+		{"application/json", true},
+		{"text/html, application/json;q=0.9", true},
+		{"application/jsonp", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+			r.Header.Set("Accept", tt.accept)
+			if got := acceptsJSON(r); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTransferStats(t *testing.T) {
+	ts := newTransferStats(3<<20, 2*time.Second, 500*time.Millisecond)
+	want := &transferStats{ReceiveSeconds: 2, ReceiveBytesPerSecond: 3 << 19, StoreSeconds: 0.5, StoreBytesPerSecond: 6 << 20}
+	if !reflect.DeepEqual(ts, want) {
+		t.Errorf("got %+v, want %+v", ts, want)
+	}
+	if got, want := ts.String(), "received in 2s (1.5 MiB/s), written in 500ms (6.0 MiB/s)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	// Too short to measure.
+	if ts := newTransferStats(10, 0, 0); ts.ReceiveBytesPerSecond != 0 || ts.StoreBytesPerSecond != 0 {
+		t.Errorf("got %+v for no time at all", ts)
+	}
+
+	tests := []struct {
+		secs float64
+		want time.Duration
+	}{
+		{1.23456789, 1235 * time.Millisecond},
+		{0.00123456, 1235 * time.Microsecond},
+		{0, 0},
+	}
+	for _, tt := range tests {
+		if got := roundDuration(tt.secs); got != tt.want {
+			t.Errorf("got %s for %g seconds, want %s", got, tt.secs, tt.want)
+		}
+	}
+}
+
+// pauseReader pauses once, before the first read of r.
+type pauseReader struct {
+	r      io.Reader
+	pause  time.Duration
+	paused bool
+}
+
+func (p *pauseReader) Read(b []byte) (int, error) {
+	if !p.paused {
+		time.Sleep(p.pause)
+		p.paused = true
+	}
+	return p.r.Read(b)
+}
+
+// TestUploadTransfer checks that a stored file is answered and logged with how long it took
+// to arrive, which counts a client stalling halfway through it.
+func TestUploadTransfer(t *testing.T) {
+	var logs strings.Builder
+	h := newTestHandlers(t, openTestTree(t), log.New(&logs, "", 0))
+	content := strings.Repeat("x", 1000)
+	body, contentType := encodeForm(t, formPart{"file", "a.txt", content}, formPart{"file", "../b.txt", "b"})
+	const pause = 50 * time.Millisecond
+	half := bytes.Index(body, []byte(content)) + len(content)/2
+	r := httptest.NewRequest(http.MethodPost, "/upload", io.MultiReader(bytes.NewReader(body[:half]), &pauseReader{r: bytes.NewReader(body[half:]), pause: pause}))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	h.UploadHandler(w, asAdmin(r))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusMultiStatus)
+	}
+	var res uploadResults
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Files) != 2 {
+		t.Fatalf("got files %+v", res.Files)
+	}
+	ts := res.Files[0].Transfer
+	if ts == nil || ts.ReceiveSeconds < pause.Seconds() || ts.StoreSeconds <= 0 {
+		t.Fatalf("got transfer %+v for a file that arrived in over %s", ts, pause)
+	}
+	if got, want := ts.ReceiveBytesPerSecond, int64(1000/ts.ReceiveSeconds); got != want {
+		t.Errorf("got %d bytes per second, want %d", got, want)
+	}
+	if res.Files[1].Transfer != nil {
+		t.Errorf("got transfer %+v for a file that was not stored", res.Files[1].Transfer)
+	}
+	if !strings.Contains(logs.String(), "file 'a.txt' from 192.0.2.1:1234 stored: 1000 bytes received in ") {
+		t.Errorf("the transfer of a.txt was not logged:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package handlers
+
+import "io/fs"
+
+// linkCount is only implemented on Unix; elsewhere copies are never hard links, as a shared
+// file could not be told apart before it is written.
+func linkCount(info fs.FileInfo) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/internal/notify"
+)
+
+// byteRange is a parsed Content-Range header of a partial write.
+type byteRange struct {
+	start, end int64 // inclusive, as in the header
+}
+
+// length returns the number of bytes the range covers.
+func (br byteRange) length() int64 {
+	return br.end - br.start + 1
+}
+
+// parseContentRange parses a "bytes <start>-<end>/<total>" header, where total may be "*".
+// The total is not needed to write the range, so it is only validated.
+func parseContentRange(header string) (byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes ")
+	if !ok {
+		return byteRange{}, errors.New(`Content-Range must use the "bytes" unit`)
+	}
+	rng, total, ok := strings.Cut(spec, "/")
+	startStr, endStr, ok2 := strings.Cut(rng, "-")
+	if !ok || !ok2 {
+		return byteRange{}, errors.New("Content-Range must look like bytes <start>-<end>/<total>")
+	}
+	start, err1 := strconv.ParseInt(startStr, 10, 64)
+	end, err2 := strconv.ParseInt(endStr, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return byteRange{}, errors.New("Content-Range has an invalid byte range")
+	}
+	if total != "*" {
+		n, err := strconv.ParseInt(total, 10, 64)
+		if err != nil || n <= end {
+			return byteRange{}, errors.New("Content-Range has an invalid total length")
+		}
+	}
+	return byteRange{start: start, end: end}, nil
+}
+
+// PatchFileHandler writes the request body into part of a stored file, creating the file if
+// needed. With "?append=true" the body is appended to the end, so log shippers can extend a
+// remote file continuously; with a Content-Range header it is written at the given offset,
+// so clients can re-send only the chunks that failed, in any order.
+//
+// Why not roll back failed writes? The bytes already written are valid data at their
+// offsets, and a client restarting a chunk overwrites them anyway.
+func (h *Handlers) PatchFileHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	oversized := false
+	defer func() {
+		if oversized {
+			r.Body.Close()
+			return
+		}
+		cleanupRequest(r)
+	}()
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Write, name) {
+		h.denyAccess(w, r)
+		return
+	}
+
+	if err := h.hidden.checkWrite(name); err != nil {
+		h.render.Error(w, r, http.StatusUnprocessableEntity, "file is refused", err.Error())
+		return
+	}
+
+	appendMode := r.URL.Query().Get("append") == "true"
+	contentRange := r.Header.Get("Content-Range")
+	var rng byteRange
+	switch {
+	case appendMode && contentRange != "":
+		h.render.Error(w, r, http.StatusBadRequest, "append and Content-Range cannot be combined")
+		return
+	case contentRange != "":
+		if rng, err = parseContentRange(contentRange); err != nil {
+			h.render.Error(w, r, http.StatusBadRequest, "invalid Content-Range", err.Error())
+			return
+		}
+		if r.ContentLength >= 0 && r.ContentLength != rng.length() {
+			h.render.Error(w, r, http.StatusBadRequest, "Content-Length does not match Content-Range")
+			return
+		}
+	case !appendMode:
+		h.render.Error(w, r, http.StatusBadRequest, "a Content-Range header or append=true is required")
+		return
+	}
+
+	limit := h.uploadLimit(w, r)
+	if limit.exceeds(r.ContentLength) {
+		oversized = true
+		h.rejectOverLimit(w, r, limit)
+		return
+	}
+	defer h.meterUpload(w, r, &limit)()
+	h.withStallTimeout(w, r)
+
+	if err := h.makeStorageDir(); err != nil {
+		h.logger.Printf("error creating file directory: %v\n", err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to prepare storage directory")
+		return
+	}
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	// If-Match lets a client extend only the version of the file it knows about.
+	if err := uploadConditionsFrom(r).check(root, name); err != nil {
+		if errors.Is(err, errPreconditionFailed) {
+			h.render.Error(w, r, http.StatusPreconditionFailed, "precondition failed")
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+
+	if err := h.checkProtected(root, principalFrom(r), name, "write to"); err != nil {
+		if errors.Is(err, errHeld) || errors.Is(err, errRetained) {
+			h.render.Error(w, r, protectedStatus(err), "protected files cannot be changed", err.Error())
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+
+	// Only what the write adds to the file counts against a directory quota. A chunked
+	// append, whose length is unknown, is only refused once the directory is full.
+	current := h.fileMeta.Usage(name)
+	size := max(current, rng.end+1)
+	if appendMode {
+		size = current + max(r.ContentLength, 1)
+	}
+	if err := h.checkDirQuotas(name, size, ""); err != nil {
+		h.logger.Printf("write to '%s' for %s refused: %v\n", name, r.RemoteAddr, err)
+		oversized = true
+		w.Header().Set("Connection", "close")
+		h.render.Error(w, r, http.StatusInsufficientStorage, "directory quota exceeded", err.Error())
+		return
+	}
+
+	if dir := path.Dir(name); dir != "." {
+		if err := h.makeDirs(root, dir); err != nil {
+			h.logger.Printf("error creating directory for file '%s': %v\n", name, err)
+			h.render.Error(w, r, storageErrorStatus(err), "unable to create directory")
+			return
+		}
+	}
+	if err := h.checkSymlinks(root, name, true); err != nil {
+		h.render.Error(w, r, http.StatusForbidden, "unable to open file", err.Error())
+		return
+	}
+	// Why guard the name? An upload replacing the file meanwhile would be interleaved with
+	// the write, and two writes to one file could not tell which of them the ETag is of.
+	if !h.writing.acquire(name) {
+		h.logger.Printf("write to '%s' for %s refused: the file is being written\n", name, r.RemoteAddr)
+		h.render.Error(w, r, http.StatusConflict, fmt.Sprintf("file '%s' is being written by another upload", name))
+		return
+	}
+	// Released only once indexed, as for uploads.
+	defer h.writing.release(name)
+	if err := unshare(root, name); err != nil {
+		h.logger.Printf("error copying hard-linked file '%s': %v\n", name, err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to open file")
+		return
+	}
+	// Why O_APPEND rather than seeking to the end? The kernel then positions every write
+	// at the current end, even if a process outside the server appends to the file too.
+	flags := os.O_WRONLY | os.O_CREATE
+	if appendMode {
+		flags |= os.O_APPEND
+	}
+	_, err = root.Lstat(name)
+	created := errors.Is(err, fs.ErrNotExist)
+	file, err := root.OpenFile(name, flags, 0666)
+	if err != nil {
+		status := openErrorStatus(err)
+		if status == http.StatusInternalServerError {
+			h.logger.Printf("error opening file '%s': %v\n", name, err)
+		}
+		h.render.Error(w, r, status, "unable to open file")
+		return
+	}
+	defer file.Close()
+	if created {
+		if err := h.setOwnership(root, name, false); err != nil {
+			h.logger.Printf("error setting permissions of file '%s': %v\n", name, err)
+			h.render.Error(w, r, storageErrorStatus(err), "unable to create file")
+			return
+		}
+	}
+
+	var dst io.Writer = file
+	var src io.Reader = newContextReader(r.Context(), r.Body)
+	if !appendMode {
+		// A body longer than the range (possible with chunked encoding) must not spill past it.
+		dst = io.NewOffsetWriter(file, rng.start)
+		src = io.LimitReader(src, rng.length())
+	}
+	dst = h.faults.Writer(name, dst)
+	buf := make([]byte, 1<<20) // 1 MB buffer
+	n, err := io.CopyBuffer(dst, src, buf)
+	// The file changed even if the copy failed part-way.
+	h.index.Add(name)
+	h.fileCache.Invalidate(name)
+	h.fileMeta.Update(name)
+	if n > 0 || created {
+		ev := notify.Event{Type: notify.Modify, Name: name, User: principalName(principalFrom(r))}
+		if created {
+			ev.Type = notify.Upload
+		}
+		if info, err := file.Stat(); err == nil {
+			ev.Size = info.Size()
+		}
+		h.notifier.Notify(ev)
+	}
+	if err != nil {
+		if r.Context().Err() != nil {
+			h.logger.Printf("client %s disconnected during write to %s\n", r.RemoteAddr, name)
+			return
+		}
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			oversized = true
+			h.rejectOverLimit(w, r, limit)
+			return
+		}
+		h.logger.Printf("error writing file '%s': %v\n", name, err)
+		h.render.Error(w, r, storageErrorStatus(err), fmt.Sprintf("error writing file '%s'", name))
+		return
+	}
+	if !appendMode && n != rng.length() {
+		h.render.Error(w, r, http.StatusBadRequest, "request body is shorter than Content-Range", fmt.Sprintf("received %d of %d bytes", n, rng.length()))
+		return
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	h.logger.Printf("wrote %d bytes to '%s' for %s\n", n, name, r.RemoteAddr)
+	etag := fileETag(stat.ModTime(), stat.Size())
+	w.Header().Set("ETag", etag)
+	h.render.JSON(w, http.StatusOK, fileInfo{
+		Name:     name,
+		Type:     "file",
+		Size:     stat.Size(),
+		Modified: stat.ModTime().UTC(),
+		ETag:     etag,
+		Links: fileLinks{
+			Self:     h.basePath + "/api/files/" + escapePath(name),
+			Download: h.basePath + "/download/" + escapePath(name),
+		},
+	})
+}
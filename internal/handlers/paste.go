@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// pasteNames encodes the random part of snippet names, in lower case as a URL is easier to
+// read out and type that way.
+var pasteNames = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// PasteHandler stores a snippet of text under a generated name and answers with its URL, for
+// sharing logs and configuration from a terminal:
+//
+//	dmesg | curl --data-binary @- http://localhost:8090/paste
+//
+// The text is the request body, or the "text" field of a form.
+func (h *Handlers) PasteHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	oversized := false
+	defer func() {
+		if oversized {
+			r.Body.Close()
+			return
+		}
+		cleanupRequest(r)
+	}()
+
+	body, oversized, ok := h.readBody(w, r, h.paste.GetMaxSize())
+	if !ok {
+		return
+	}
+	content, err := pasteText(r.Header.Get("Content-Type"), body)
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "unable to read form", err.Error())
+		return
+	}
+	if len(content) == 0 {
+		h.render.Error(w, r, http.StatusBadRequest, "text is required")
+		return
+	}
+	if !isText(content) {
+		h.render.Error(w, r, http.StatusUnsupportedMediaType, "content must be UTF-8 text")
+		return
+	}
+
+	if err := h.makeStorageDir(); err != nil {
+		h.logger.Printf("error creating file directory: %v\n", err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to prepare storage directory")
+		return
+	}
+	roots := storage.NewRoots(h.storage)
+	defer roots.Close()
+
+	name, err := h.pasteName(roots)
+	if err != nil {
+		h.logger.Printf("error naming snippet: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to name snippet")
+		return
+	}
+	root, err := roots.Open(name)
+	if err != nil {
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	principal := principalFrom(r)
+	if !h.acl.Allowed(principal, acl.Write, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	fh := &multipart.FileHeader{Filename: name, Size: int64(len(content))}
+	if fail := h.checkUpload("from "+r.RemoteAddr, principalName(principal), name, fh, memoryFile{bytes.NewReader(content)}); fail != nil {
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+	// Create-only, so that a snippet is never written over one that took the same name.
+	if _, fail := h.storeUpload(root, name, bytes.NewReader(content), true, principalName(principal), int64(len(content))); fail != nil {
+		h.render.Error(w, r, fail.httpStatus(), fail.msg)
+		return
+	}
+
+	link := h.publicBase(r) + "/download/" + escapePath(name)
+	h.logger.Printf("stored %d byte snippet as '%s' for %s\n", len(content), name, r.RemoteAddr)
+	w.Header().Set("Location", link)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, link+"\n")
+}
+
+// pasteText returns the snippet in a request body of the given content type: the "text"
+// field of a form, or the body itself.
+//
+// Why fall back to the body for URL-encoded forms? curl sends --data-binary as one, and
+// a log piped through it is not a form, so only a body with a "text" field is taken as one.
+func pasteText(contentType string, body []byte) ([]byte, error) {
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/x-www-form-urlencoded":
+		if form, err := url.ParseQuery(string(body)); err == nil && form.Has("text") {
+			return []byte(form.Get("text")), nil
+		}
+	case "multipart/form-data":
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New(`form has no "text" field`)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if part.FormName() == "text" {
+				return io.ReadAll(part)
+			}
+		}
+	}
+	return body, nil
+}
+
+// pasteName returns a name for a new snippet, in the paste directory, that no file has yet.
+func (h *Handlers) pasteName(roots *storage.Roots) (string, error) {
+	id := make([]byte, 5)
+	for range 5 {
+		rand.Read(id)
+		name := path.Join(h.paste.Dir, pasteNames.EncodeToString(id)+".txt")
+		root, err := roots.Open(name)
+		if err != nil {
+			return "", err
+		}
+		if _, err := root.Stat(name); errors.Is(err, fs.ErrNotExist) {
+			return name, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", errors.New("no unused name found")
+}
+
+// publicBase returns the URL the server is reached at, including its base path: the
+// configured public URL, or else the address the request was sent to.
+func (h *Handlers) publicBase(r *http.Request) string {
+	if h.publicURL != "" {
+		return strings.TrimSuffix(h.publicURL, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + h.basePath
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// makeDirs creates the directory dir within root, with any missing parents, giving the
+// directories it creates the configured permissions and owner.
+func (h *Handlers) makeDirs(root storage.Root, dir string) error {
+	mode, ok := h.uploader.GetDirMode()
+	if !ok {
+		mode = 0755
+	}
+	if !ok && !h.chowning() {
+		return root.MkdirAll(dir, mode)
+	}
+	var missing []string
+	p := ""
+	for elem := range strings.SplitSeq(path.Clean(dir), "/") {
+		p = path.Join(p, elem)
+		if _, err := root.Lstat(p); errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, p)
+		}
+	}
+	if err := root.MkdirAll(dir, mode); err != nil {
+		return err
+	}
+	for _, p := range missing {
+		if err := h.setOwnership(root, p, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setOwnership gives the file or directory name, just created within root, the configured
+// permissions and owner.
+//
+// Why set the permissions afterwards, rather than create with them? The umask applies to
+// the mode a file is created with, and would strip the group write bit a service sharing
+// the storage directory may need.
+func (h *Handlers) setOwnership(root storage.Root, name string, dir bool) error {
+	mode, ok := h.uploader.GetFileMode()
+	if dir {
+		mode, ok = h.uploader.GetDirMode()
+	}
+	if ok {
+		if err := root.Chmod(name, mode); err != nil {
+			return err
+		}
+	}
+	if h.chowning() {
+		return root.Lchown(name, h.uploader.UID, h.uploader.GID)
+	}
+	return nil
+}
+
+// chowning reports whether created files are given an owner other than the server's user.
+func (h *Handlers) chowning() bool {
+	return h.uploader.UID >= 0 || h.uploader.GID >= 0
+}
+
+// makeStorageDir creates the storage directory, with any missing parents, giving it the
+// configured permissions and owner if it has to be created. Storages kept elsewhere than on
+// disk have no directory to create.
+func (h *Handlers) makeStorageDir() error {
+	if _, ok := h.storage.(storage.Disk); !ok {
+		return nil
+	}
+	dir := h.uploader.StorageDir
+	mode, ok := h.uploader.GetDirMode()
+	if !ok {
+		mode = 0755
+	}
+	_, err := os.Stat(dir)
+	missing := errors.Is(err, fs.ErrNotExist)
+	if err := os.MkdirAll(dir, mode); err != nil || !missing {
+		return err
+	}
+	if ok {
+		if err := os.Chmod(dir, mode); err != nil {
+			return err
+		}
+	}
+	if h.chowning() {
+		return os.Lchown(dir, h.uploader.UID, h.uploader.GID)
+	}
+	return nil
+}
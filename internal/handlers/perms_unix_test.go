@@ -0,0 +1,64 @@
+//go:build unix
+
+package handlers
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/shard"
+)
+
+func TestMakeStorageDir(t *testing.T) {
+	old := syscall.Umask(0022)
+	defer syscall.Umask(old)
+
+	tests := []struct {
+		desc    string
+		dirMode string
+		want    fs.FileMode
+	}{
+		{"the default permissions", "", 0755},
+		{"configured permissions", "0750", 0750},
+		{"permissions the umask would strip", "0770", 0770},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "storage")
+			layout, err := shard.New(dir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := &Handlers{storage: layout, uploader: &config.UploaderConfig{StorageDir: dir, DirMode: tt.dirMode, UID: -1, GID: -1}}
+			if err := h.makeStorageDir(); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm(); got != tt.want {
+				t.Errorf("storage directory mode %o, want %o", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeStorageDirExisting(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	h := &Handlers{uploader: &config.UploaderConfig{StorageDir: dir, DirMode: "0750", UID: -1, GID: -1}}
+	if err := h.makeStorageDir(); err != nil {
+		t.Fatal(err)
+	}
+	// An existing directory keeps its permissions.
+	if info, err := os.Stat(dir); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("storage directory mode changed to %v (%v), want 0700", info.Mode().Perm(), err)
+	}
+}
@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+)
+
+// PreviewHandler serves a stored office document converted to PDF or HTML, for reading in the
+// browser. The first request for a document waits whilst it is converted.
+func (h *Handlers) PreviewHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	if !h.converter.Convertible(r.PathValue("name")) {
+		h.render.Error(w, r, http.StatusUnsupportedMediaType, "file cannot be previewed")
+		return
+	}
+	name, sum, ok := h.storedChecksum(w, r)
+	if !ok {
+		return
+	}
+	preview, err := h.converter.Get(r.Context(), name, sum)
+	if err != nil {
+		if r.Context().Err() != nil {
+			h.logger.Printf("client %s disconnected whilst '%s' was converted\n", r.RemoteAddr, name)
+			return
+		}
+		h.logger.Printf("error converting '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusBadGateway, "unable to convert document")
+		return
+	}
+
+	// Why sandbox HTML? It comes from a converter working on whatever was uploaded, and any
+	// script in it would otherwise run with access to everything the user can reach here.
+	if h.converter.Extension() == ".html" {
+		w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; style-src 'unsafe-inline'; img-src data:")
+	}
+	base := path.Base(name)
+	h.serveDerived(w, r, name, sum, preview, h.converter.MediaType(), strings.TrimSuffix(base, path.Ext(base))+h.converter.Extension())
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"bytes"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/internal/qrcode"
+)
+
+// defaultQRScale is the width in pixels of each module of a QR code, unless the request sets
+// one, which makes a code for a typical URL about 400 pixels wide.
+const defaultQRScale = 8
+
+// maxQRScale bounds the scale a request may set, and so the size of the image drawn.
+const maxQRScale = 32
+
+// QRHandler answers with a PNG QR code for a link to the file named in the request path, for
+// opening it on a phone. The "link" query parameter chooses the link: "download" (the
+// default) for the download URL, or "short" for the file's short link, which is created if
+// it has none and makes a smaller code that is easier to scan. "scale" sets the width of
+// each module in pixels.
+func (h *Handlers) QRHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	scale := defaultQRScale
+	if v := r.URL.Query().Get("scale"); v != "" {
+		scale, err = strconv.Atoi(v)
+		if err != nil || scale < 1 || scale > maxQRScale {
+			h.render.Error(w, r, http.StatusBadRequest, "invalid scale", "must be from 1 to "+strconv.Itoa(maxQRScale))
+			return
+		}
+	}
+	if h.hiddenFile(w, r, name) {
+		return
+	}
+	principal := principalFrom(r)
+	if !h.acl.Allowed(principal, acl.Read, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	if status, msg := h.statStoredFile(name); status != http.StatusOK {
+		h.render.Error(w, r, status, msg)
+		return
+	}
+
+	var link string
+	switch r.URL.Query().Get("link") {
+	case "", "download":
+		link = h.publicBase(r) + "/download/" + escapePath(name)
+	case "short":
+		id := h.fileMeta.ID(name)
+		if id == "" {
+			h.render.Error(w, r, http.StatusNotFound, "file is not found")
+			return
+		}
+		l, created, err := h.links.Shorten(id, principalName(principal))
+		if err != nil {
+			h.logger.Printf("error creating short link for '%s': %v\n", name, err)
+			h.render.Error(w, r, http.StatusInternalServerError, "unable to create short link")
+			return
+		}
+		if created {
+			h.logger.Printf("short link %s created for '%s' by %s\n", l.Code, name, r.RemoteAddr)
+		}
+		link = h.publicBase(r) + "/s/" + l.Code
+	default:
+		h.render.Error(w, r, http.StatusBadRequest, "invalid link", `must be "download" or "short"`)
+		return
+	}
+
+	code, err := qrcode.New([]byte(link))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "unable to encode link", err.Error())
+		return
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, code.Image(scale)); err != nil {
+		h.logger.Printf("error encoding QR code: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.Write(buf.Bytes())
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/qrcode"
+	"github.com/mascotmascot1/fileserver/internal/shortlinks"
+)
+
+func TestQRHandler(t *testing.T) {
+	root := openTestTree(t, ".secret.txt")
+	h := newTestHandlers(t, root, nil)
+	h.hidden = newHiddenPolicy(config.HiddenFilesConfig{Dotfiles: true}, root.Name(), "")
+	links, err := shortlinks.Open(filepath.Join(t.TempDir(), "shortlinks.json"), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.links = links
+	if w := upload(t, h, "/upload", formPart{"file", "reports/q3 (final).pdf", "report"}); w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+
+	tests := []struct {
+		desc       string
+		name       string
+		query      string
+		wantStatus int
+		wantLink   string // encoded in the code; a short link's code is filled in
+		wantScale  int
+	}{
+		{"the download link", "reports/q3 (final).pdf", "", http.StatusOK,
+			"http://files.example.com/download/reports/q3%20%28final%29.pdf", defaultQRScale},
+		{"the short link, scaled", "reports/q3 (final).pdf", "?link=short&scale=2", http.StatusOK,
+			"http://files.example.com/s/", 2},
+		{"an unknown link", "reports/q3 (final).pdf", "?link=long", http.StatusBadRequest, "", 0},
+		{"too large a scale", "reports/q3 (final).pdf", "?scale=33", http.StatusBadRequest, "", 0},
+		{"no scale", "reports/q3 (final).pdf", "?scale=0", http.StatusBadRequest, "", 0},
+		{"a missing file", "reports/q4.pdf", "", http.StatusNotFound, "", 0},
+		{"a hidden file", ".secret.txt", "", http.StatusNotFound, "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://files.example.com/api/qr/"+escapePath(tt.name)+tt.query, nil)
+			r.SetPathValue("name", tt.name)
+			w := httptest.NewRecorder()
+			h.QRHandler(w, asAdmin(r))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			if got := w.Header().Get("Content-Type"); got != "image/png" {
+				t.Errorf("got Content-Type %q, want image/png", got)
+			}
+			img, err := png.Decode(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			link := tt.wantLink
+			if strings.HasSuffix(link, "/s/") {
+				l, created, err := h.links.Shorten(h.fileMeta.ID(tt.name), "admin")
+				if err != nil || created {
+					t.Fatalf("got %+v, %v, %v, want the link the code was made for", l, created, err)
+				}
+				link += l.Code
+			}
+			code, err := qrcode.New([]byte(link))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameImage(img, code.Image(tt.wantScale)) {
+				t.Errorf("the code does not encode %s at scale %d", link, tt.wantScale)
+			}
+		})
+	}
+}
+
+// sameImage reports whether a and b have the same size and the same dark pixels.
+func sameImage(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			ra, _, _, _ := a.At(x, y).RGBA()
+			rb, _, _, _ := b.At(x, y).RGBA()
+			if (ra < 0x8000) != (rb < 0x8000) {
+				return false
+			}
+		}
+	}
+	return true
+}
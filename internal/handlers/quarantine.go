@@ -0,0 +1,191 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"path"
+
+	"github.com/mascotmascot1/fileserver/internal/notify"
+	"github.com/mascotmascot1/fileserver/internal/quarantine"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// rejectUpload handles an uploaded file that failed validation, quarantining it if so
+// configured, and returns the message for the client. from describes where the file came
+// from, for the log.
+func (h *Handlers) rejectUpload(from, user, name string, file multipart.File, rej *rejection) string {
+	msg := fmt.Sprintf("file '%s' was rejected: %s", name, rej.reason)
+	if !h.validator.quarantine {
+		h.logger.Printf("%s, %s\n", msg, from)
+		return msg
+	}
+	item, err := h.quarantine.Add(quarantine.Item{Name: name, Reason: rej.reason, User: user}, file)
+	if err != nil {
+		h.logger.Printf("%s, %s; error quarantining it: %v\n", msg, from, err)
+		return msg
+	}
+	h.logger.Printf("%s, %s; quarantined as %s\n", msg, from, item.ID)
+	return msg + " and quarantined"
+}
+
+// ListQuarantineHandler returns the quarantined files, oldest first. Admin only.
+func (h *Handlers) ListQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	h.render.JSON(w, http.StatusOK, h.quarantine.List())
+}
+
+// QuarantinedFileHandler downloads a quarantined file for inspection. Admin only.
+func (h *Handlers) QuarantinedFileHandler(w http.ResponseWriter, r *http.Request) {
+	item, ok := h.quarantine.Get(r.PathValue("id"))
+	if !ok {
+		h.render.Error(w, r, http.StatusNotFound, "quarantined file is not found")
+		return
+	}
+	file, err := h.quarantine.Open(item.ID)
+	if err != nil {
+		h.logger.Printf("error opening quarantined file %s: %v\n", item.ID, err)
+		h.render.Error(w, r, openErrorStatus(err), "unable to open file")
+		return
+	}
+	defer file.Close()
+
+	// Always an attachment, and never cached: the content is suspect.
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", contentDisposition("attachment", path.Base(item.Name)))
+	w.Header().Set("Cache-Control", "no-store")
+	dw := h.newDownloadWriter(w, r)
+	http.ServeContent(dw, r, "", item.Time, file)
+	if dw.err != nil && !clientGone(r, dw.err) {
+		h.logger.Printf("error transferring quarantined file %s: %v\n", item.ID, dw.err)
+	}
+}
+
+// ReleaseQuarantineHandler moves a quarantined file into storage at the path it was uploaded
+// to. An existing file there is only replaced with ?overwrite=true. Admin only.
+func (h *Handlers) ReleaseQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	item, ok := h.quarantine.Get(r.PathValue("id"))
+	if !ok {
+		h.render.Error(w, r, http.StatusNotFound, "quarantined file is not found")
+		return
+	}
+	name := item.Name
+	p := principalFrom(r)
+
+	if err := h.makeStorageDir(); err != nil {
+		h.logger.Printf("error creating file directory: %v\n", err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to prepare storage directory")
+		return
+	}
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	if r.URL.Query().Get("overwrite") != "true" {
+		if _, err := root.Lstat(name); err == nil {
+			h.render.Error(w, r, http.StatusConflict, "a file already exists at "+name)
+			return
+		}
+	}
+	if err := h.checkProtected(root, p, name, "overwrite"); err != nil {
+		if status := protectedStatus(err); status != http.StatusInternalServerError {
+			h.render.Error(w, r, status, err.Error())
+			return
+		}
+		h.logger.Printf("error checking file '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	if !h.writing.acquire(name) {
+		h.render.Error(w, r, http.StatusConflict, "file is being written by an upload")
+		return
+	}
+	defer h.writing.release(name)
+
+	src, err := h.quarantine.Open(item.ID)
+	if err != nil {
+		h.logger.Printf("error opening quarantined file %s: %v\n", item.ID, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to open file")
+		return
+	}
+	defer src.Close()
+	if dir := path.Dir(name); dir != "." {
+		if err := h.makeDirs(root, dir); err != nil {
+			h.logger.Printf("error creating directory for file '%s': %v\n", name, err)
+			h.render.Error(w, r, storageErrorStatus(err), "unable to create directory")
+			return
+		}
+	}
+	err = detach(root, name)
+	var dst storage.File
+	if err == nil {
+		dst, err = root.Create(name)
+	}
+	if err == nil {
+		if err = h.setOwnership(root, name, false); err != nil {
+			dst.Close()
+			root.Remove(name)
+		}
+	}
+	if err != nil {
+		h.logger.Printf("error creating file '%s': %v\n", name, err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to create file")
+		return
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(dst, hash), src)
+	var info fs.FileInfo
+	if err == nil {
+		info, err = dst.Stat()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		h.logger.Printf("error writing file '%s': %v\n", name, err)
+		if removeErr := root.Remove(name); removeErr == nil {
+			h.index.Remove(name)
+			h.fileCache.Invalidate(name)
+			h.fileMeta.Remove(name)
+		}
+		h.render.Error(w, r, storageErrorStatus(err), "unable to write file")
+		return
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	h.fileMeta.Record(name, info, sum)
+	h.videos.Extract(name, sum)
+	h.index.Add(name)
+	h.fileCache.Invalidate(name)
+
+	if err := h.quarantine.Remove(item.ID); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		h.logger.Printf("error removing quarantined file %s after releasing it: %v\n", item.ID, err)
+	}
+	h.logger.Printf("%s released quarantined file %s to '%s'\n", principalName(p), item.ID, name)
+	h.notifier.Notify(notify.Event{Type: notify.Upload, Name: name, Size: item.Size, User: item.User})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeQuarantineHandler deletes a quarantined file. Admin only.
+func (h *Handlers) PurgeQuarantineHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	err := h.quarantine.Remove(id)
+	if errors.Is(err, fs.ErrNotExist) {
+		h.render.Error(w, r, http.StatusNotFound, "quarantined file is not found")
+		return
+	}
+	if err != nil {
+		h.logger.Printf("error purging quarantined file %s: %v\n", id, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	h.logger.Printf("%s purged quarantined file %s\n", principalName(principalFrom(r)), id)
+	w.WriteHeader(http.StatusNoContent)
+}
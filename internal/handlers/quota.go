@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/clientip"
+)
+
+// uploadLimit is the most an upload's body may hold, and whether the client's upload quota
+// rather than the maximum upload size set it.
+type uploadLimit struct {
+	bytes int64
+	quota bool
+}
+
+// uploadLimit returns the limit for the body of r, setting the quota headers on the response
+// if an upload quota is configured.
+func (h *Handlers) uploadLimit(w http.ResponseWriter, r *http.Request) uploadLimit {
+	limit := uploadLimit{bytes: h.uploader.GetMaxUploadSize()}
+	if h.quota == nil {
+		return limit
+	}
+	remaining, reset := h.quota.Remaining(clientip.Addr(r))
+	w.Header().Set("X-Upload-Quota-Limit", strconv.FormatInt(h.quota.Limit(), 10))
+	w.Header().Set("X-Upload-Quota-Remaining", strconv.FormatInt(remaining, 10))
+	if !reset.IsZero() {
+		w.Header().Set("X-Upload-Quota-Reset", strconv.Itoa(secondsUntil(reset)))
+	}
+	if remaining < limit.bytes {
+		limit = uploadLimit{bytes: remaining, quota: true}
+	}
+	return limit
+}
+
+// exceeds reports whether a body of n bytes, as declared by Content-Length, is over the limit.
+// With the quota used up, any body is.
+func (l uploadLimit) exceeds(n int64) bool {
+	return n > l.bytes || (l.quota && l.bytes == 0)
+}
+
+// rejectOverLimit answers an upload over its limit: 413 for the maximum upload size, or 429
+// for the quota, with Retry-After saying when some of it frees up. The connection is closed
+// afterwards either way, as the rest of the body is never read.
+func (h *Handlers) rejectOverLimit(w http.ResponseWriter, r *http.Request, limit uploadLimit) {
+	if !limit.quota {
+		h.rejectTooLarge(w, r, limit.bytes)
+		return
+	}
+	h.logger.Printf("upload from %s exceeds the remaining quota of %d bytes\n", r.RemoteAddr, limit.bytes)
+	if reset := w.Header().Get("X-Upload-Quota-Reset"); reset != "" {
+		w.Header().Set("Retry-After", reset)
+	}
+	w.Header().Set("Connection", "close")
+	h.render.Error(w, r, http.StatusTooManyRequests, "upload quota exceeded",
+		fmt.Sprintf("the quota is %d bytes per %s", h.quota.Limit(), h.quota.Window()))
+}
+
+// meterUpload limits the body of r and returns a function that charges the bytes read from
+// it to the client's quota, to be deferred by the handler. The part of the quota the upload
+// may take is set aside first, and limit shrunk to it if other uploads have taken some of it
+// since the limit was worked out.
+//
+// Why charge what was read rather than what was stored? The quota protects bandwidth as well
+// as disk space, and uploads that fail or are rejected part-way cost both.
+func (h *Handlers) meterUpload(w http.ResponseWriter, r *http.Request, limit *uploadLimit) func() {
+	charge := h.reserveQuota(r, limit, r.ContentLength)
+	body := &countingReader{ReadCloser: http.MaxBytesReader(w, r.Body, limit.bytes)}
+	r.Body = body
+	return func() { charge(body.n) }
+}
+
+// reserveQuota sets aside the part of the client's quota an upload of size bytes may take,
+// or of up to limit if its size is unknown (-1), shrinking limit to what could be set aside.
+// It returns a function charging the n bytes the upload took in the end, which gives the
+// rest back.
+//
+// Why set the quota aside? Checking what remains before an upload and charging it after
+// would let concurrent uploads by one client each be given all of it.
+func (h *Handlers) reserveQuota(r *http.Request, limit *uploadLimit, size int64) func(n int64) {
+	if h.quota == nil {
+		return func(int64) {}
+	}
+	want := limit.bytes
+	if size >= 0 && size < want {
+		want = size
+	}
+	addr := clientip.Addr(r)
+	reserved := h.quota.Reserve(addr, want)
+	if reserved < want {
+		*limit = uploadLimit{bytes: reserved, quota: true}
+	}
+	return func(n int64) {
+		if err := h.quota.Settle(addr, reserved, n); err != nil {
+			h.logger.Printf("error recording upload quota usage: %v\n", err)
+		}
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// secondsUntil returns the whole seconds until t, rounded up so a client waiting that long
+// is never early.
+func secondsUntil(t time.Time) int {
+	return int((time.Until(t) + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/clientip"
+	"github.com/mascotmascot1/fileserver/internal/quota"
+	"github.com/mascotmascot1/fileserver/pkg/storage/memfs"
+)
+
+// TestMeterUploadConcurrent starts uploads by one client at once, each checking the quota
+// before any of them has been charged, which must not, together, go over it.
+func TestMeterUploadConcurrent(t *testing.T) {
+	h := newTestHandlers(t, openTestTree(t), nil)
+	var err error
+	h.quota, err = quota.Open(memfs.New().Dir("metadata"), "quota.json", 1000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const uploads, size = 10, 300
+	var ready, done sync.WaitGroup
+	ready.Add(uploads)
+	var stored atomic.Int64
+	for range uploads {
+		done.Go(func() {
+			r := httptest.NewRequest(http.MethodPut, "/api/files/a.txt", strings.NewReader(strings.Repeat("a", size)))
+			w := httptest.NewRecorder()
+			limit := h.uploadLimit(w, r)
+			ready.Done()
+			ready.Wait()
+			if limit.exceeds(r.ContentLength) {
+				t.Errorf("upload of %d bytes refused before any was charged, with a limit of %d", size, limit.bytes)
+				return
+			}
+			charge := h.meterUpload(w, r, &limit)
+			_, err := io.ReadAll(r.Body)
+			charge()
+			if err == nil {
+				stored.Add(size)
+			}
+		})
+	}
+	done.Wait()
+
+	if got := stored.Load(); got != 900 {
+		t.Errorf("%d bytes were uploaded, want the 900 that fit in the quota of 1000", got)
+	}
+	r := httptest.NewRequest(http.MethodPut, "/api/files/a.txt", nil)
+	if remaining, _ := h.quota.Remaining(clientip.Addr(r)); remaining != 0 {
+		t.Errorf("%d bytes of the quota remaining, want 0", remaining)
+	}
+}
@@ -0,0 +1,210 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// errRetained is reported for changes to files that are still under write-once retention.
+var errRetained = errors.New("file is write-once")
+
+// retentionPolicy decides which stored files are write-once (WORM) and for how long.
+//
+// Why measure retention from the modification time? Write-once files can no longer be
+// written through the API, so their modification time is the moment they were committed,
+// and it survives restarts without any extra bookkeeping.
+type retentionPolicy struct {
+	rules []config.WORMRule
+	// sweepInterval is how often expired files are deleted, zero unless a rule deletes them.
+	sweepInterval time.Duration
+}
+
+// newRetentionPolicy normalises the configured rules and orders them so that the most
+// specific prefix is found first, as with the ACL.
+func newRetentionPolicy(cfg config.WORMConfig) *retentionPolicy {
+	rp := &retentionPolicy{rules: make([]config.WORMRule, 0, len(cfg.Rules))}
+	for _, rule := range cfg.Rules {
+		rule.Path = path.Clean("/" + rule.Path)
+		rp.rules = append(rp.rules, rule)
+		if rule.DeleteExpired {
+			rp.sweepInterval = cfg.SweepInterval
+		}
+	}
+	sort.SliceStable(rp.rules, func(i, j int) bool { return len(rp.rules[i].Path) > len(rp.rules[j].Path) })
+	return rp
+}
+
+// rule returns the rule that applies to the storage-relative name, if any.
+func (rp *retentionPolicy) rule(name string) (config.WORMRule, bool) {
+	name = path.Clean("/" + name)
+	for _, rule := range rp.rules {
+		if rule.Path == "/" || name == rule.Path || strings.HasPrefix(name, rule.Path+"/") {
+			return rule, true
+		}
+	}
+	return config.WORMRule{}, false
+}
+
+// lockedUntil reports whether the file at the storage-relative name, last modified at
+// modTime, is still retained, and until when. A zero time means it is retained forever.
+func (rp *retentionPolicy) lockedUntil(name string, modTime time.Time) (time.Time, bool) {
+	rule, ok := rp.rule(name)
+	if !ok {
+		return time.Time{}, false
+	}
+	if rule.Retention <= 0 {
+		return time.Time{}, true
+	}
+	until := modTime.Add(rule.Retention)
+	return until, time.Now().Before(until)
+}
+
+// expired reports whether the file at the storage-relative name, last modified at modTime, is
+// past its retention and to be deleted for it.
+func (rp *retentionPolicy) expired(name string, modTime time.Time) bool {
+	rule, ok := rp.rule(name)
+	return ok && rule.DeleteExpired && rule.Retention > 0 && !time.Now().Before(modTime.Add(rule.Retention))
+}
+
+// retains reports whether a file stored now at the storage-relative name would be retained.
+func (rp *retentionPolicy) retains(name string) bool {
+	_, ok := rp.lockedUntil(name, time.Now())
+	return ok
+}
+
+// checkRetention returns an error wrapping errRetained if changing name, or any file below it
+// if it is a directory, would alter a retained file. action describes the attempted change
+// for the log, which records every refused attempt. Missing files are not retained.
+func (h *Handlers) checkRetention(root storage.Root, p *auth.Principal, name, action string) error {
+	if len(h.retention.rules) == 0 {
+		return nil
+	}
+	info, err := root.Lstat(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var retained error
+	check := func(name string, info fs.FileInfo) {
+		if !info.Mode().IsRegular() {
+			return
+		}
+		if until, ok := h.retention.lockedUntil(name, info.ModTime()); ok {
+			if until.IsZero() {
+				retained = fmt.Errorf("%w: '%s' is retained permanently", errRetained, name)
+			} else {
+				retained = fmt.Errorf("%w: '%s' is retained until %s", errRetained, name, until.UTC().Format(time.RFC3339))
+			}
+		}
+	}
+	if !info.IsDir() {
+		check(name, info)
+	} else {
+		err = fs.WalkDir(root.FS(), name, func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if check(file, info); retained != nil {
+				return fs.SkipAll
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if retained != nil {
+		h.logger.Printf("warn: refused to %s '%s' for %s: %v\n", action, name, principalName(p), retained)
+	}
+	return retained
+}
+
+// restartRetention gives the retained files moved or copied to name, or below it if it is a
+// directory, the time they arrived there, from which their retention runs.
+//
+// Why? A move keeps a file's modification time, so an old file moved into a retained path
+// would otherwise be past its retention, and deletable, the moment it arrived.
+func (h *Handlers) restartRetention(root storage.Root, name string) error {
+	if len(h.retention.rules) == 0 {
+		return nil
+	}
+	now := time.Now()
+	return walkTree(root, name, func(file string, d fs.DirEntry) error {
+		if !d.Type().IsRegular() || !h.retention.retains(file) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, _ := h.fileMeta.Checksum(file, info)
+		// Why unshare? A copy may be linked to its source, which keeps its own time.
+		if err := unshare(root, file); err != nil {
+			return err
+		}
+		return h.setModified(root, file, now, sum)
+	})
+}
+
+// retentionUser names the author of deletions by the retention sweep in file events.
+const retentionUser = "retention"
+
+// watchRetention deletes the files whose retention has passed, where their rule says so, every
+// sweep interval until the handlers are closed.
+//
+// Only the leader sweeps, as every instance sharing the storage directory would otherwise
+// delete the same files.
+func (h *Handlers) watchRetention() {
+	h.every(h.retention.sweepInterval, func() {
+		if h.leader.Leading() {
+			h.sweepRetention(h.ctx)
+		}
+	})
+}
+
+// sweepRetention deletes the files past their retention whose rule deletes them, passing over
+// those under a hold or being written. It stops once ctx is done.
+func (h *Handlers) sweepRetention(ctx context.Context) {
+	deleted, freed := 0, int64(0)
+	for _, e := range h.fileMeta.Present() {
+		if ctx.Err() != nil {
+			break
+		}
+		// Why check the entry's time first? It saves a stat of every file that is retained
+		// still; the file's own time is checked again before it is deleted.
+		if !h.retention.expired(e.Path, e.Modified) {
+			continue
+		}
+		if _, held := h.holds.Within(e.Path); held {
+			continue
+		}
+		info, ok := h.removeScheduled(e.Path, retentionUser)
+		if !ok {
+			continue
+		}
+		h.logger.Printf("deleted '%s' (%d bytes, stored %s) as its retention has passed\n", e.Path, info.Size(), info.ModTime().UTC().Format(time.RFC3339))
+		deleted++
+		freed += info.Size()
+	}
+	if deleted > 0 {
+		h.logger.Printf("deleted %d files past their retention, freeing %d bytes\n", deleted, freed)
+	}
+}
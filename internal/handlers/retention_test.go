@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/holds"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+func TestLockedUntil(t *testing.T) {
+	rp := newRetentionPolicy(config.WORMConfig{Rules: []config.WORMRule{
+		{Path: "compliance", Retention: 24 * time.Hour},
+		{Path: "/compliance/forever/", Retention: 0},
+	}})
+	now := time.Now()
+
+	tests := []struct {
+		desc      string
+		name      string
+		modTime   time.Time
+		wantUntil time.Time
+		want      bool
+	}{
+		{"outside every rule", "public/a.txt", now, time.Time{}, false},
+		{"a name sharing the prefix", "compliance2/a.txt", now, time.Time{}, false},
+		{"within the retention period", "compliance/a.txt", now.Add(-time.Hour), now.Add(23 * time.Hour), true},
+		{"past the retention period", "compliance/a.txt", now.Add(-25 * time.Hour), now.Add(-time.Hour), false},
+		{"retained forever by the longer rule", "compliance/forever/a.txt", now.Add(-365 * 24 * time.Hour), time.Time{}, true},
+		{"names are normalised", "./compliance//a.txt", now, now.Add(24 * time.Hour), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			until, ok := rp.lockedUntil(tt.name, tt.modTime)
+			if ok != tt.want || !until.Equal(tt.wantUntil) {
+				t.Errorf("lockedUntil = %v, %v, want %v, %v", until, ok, tt.wantUntil, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckRetention(t *testing.T) {
+	root := openTestTree(t, "compliance/new.txt", "compliance/old.txt", "compliance/dir/new.txt", "archive/old.txt", "public/a.txt")
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"compliance/old.txt", "archive/old.txt"} {
+		if err := root.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := &Handlers{
+		retention: newRetentionPolicy(config.WORMConfig{Rules: []config.WORMRule{{Path: "compliance", Retention: 24 * time.Hour}}}),
+		logger:    log.New(io.Discard, "", 0),
+	}
+
+	tests := []struct {
+		desc         string
+		name         string
+		wantRetained bool
+	}{
+		{"a retained file", "compliance/new.txt", true},
+		{"a file past its retention", "compliance/old.txt", false},
+		{"a directory holding a retained file", "compliance/dir", true},
+		{"a directory holding retained files at any depth", "compliance", true},
+		{"a file outside the rules", "public/a.txt", false},
+		{"an old file outside the rules", "archive/old.txt", false},
+		{"a missing file", "compliance/missing.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			err := h.checkRetention(root, nil, tt.name, "delete")
+			if retained := errors.Is(err, errRetained); retained != tt.wantRetained || (err != nil && !retained) {
+				t.Errorf("checkRetention = %v, want retained %v", err, tt.wantRetained)
+			}
+		})
+	}
+}
+
+func TestCheckRetentionWithoutRules(t *testing.T) {
+	root := openTestTree(t, "compliance/a.txt")
+	h := &Handlers{retention: newRetentionPolicy(config.WORMConfig{})}
+	if err := h.checkRetention(root, nil, "compliance/a.txt", "delete"); err != nil {
+		t.Errorf("checkRetention without rules = %v", err)
+	}
+}
+
+func TestSetClientModified(t *testing.T) {
+	root := openTestTree(t, "compliance/a.txt", "public/a.txt")
+	h := newTestHandlers(t, root, nil)
+	h.retention = newRetentionPolicy(config.WORMConfig{Rules: []config.WORMRule{{Path: "compliance", Retention: 24 * time.Hour}}})
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+
+	tests := []struct {
+		desc    string
+		name    string
+		wantOld bool
+	}{
+		{"a write-once file keeps the time it was stored", "compliance/a.txt", false},
+		{"other files are given the client's time", "public/a.txt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := h.setClientModified(root, tt.name, old, "checksum"); err != nil {
+				t.Fatal(err)
+			}
+			info, err := root.Stat(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.ModTime().Equal(old); got != tt.wantOld {
+				t.Errorf("modification time %v, want the client's %v: %v", info.ModTime(), old, tt.wantOld)
+			}
+		})
+	}
+	// The write-once file cannot be released early by backdating it.
+	if err := h.checkRetention(root, nil, "compliance/a.txt", "delete"); !errors.Is(err, errRetained) {
+		t.Errorf("checkRetention = %v after a backdated upload, want the file retained", err)
+	}
+}
+
+// TestMoveRestartsRetention moves and copies aged files into a write-once path, where they
+// must not be deletable at once.
+func TestMoveRestartsRetention(t *testing.T) {
+	files := []string{"public/a.txt", "public/b.txt", "public/dir/c.txt", "public/d.txt"}
+	root := openTestTree(t, files...)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range files {
+		if err := root.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestHandlers(t, root, nil)
+	h.retention = newRetentionPolicy(config.WORMConfig{Rules: []config.WORMRule{{Path: "compliance", Retention: 24 * time.Hour}}})
+	roots := storage.NewRoots(h.storage)
+	defer roots.Close()
+	admin := &auth.Principal{Username: "alice", Roles: []string{"admin"}}
+
+	tests := []struct {
+		desc         string
+		op           batchOperation
+		deleted      string
+		wantRetained bool
+	}{
+		{"a file moved in", batchOperation{Op: "move", Path: "public/a.txt", To: "compliance/a.txt"}, "compliance/a.txt", true},
+		{"a file copied in", batchOperation{Op: "copy", Path: "public/b.txt", To: "compliance/b.txt"}, "compliance/b.txt", true},
+		{"a directory moved in", batchOperation{Op: "move", Path: "public/dir", To: "compliance/dir"}, "compliance/dir/c.txt", true},
+		{"a file moved elsewhere", batchOperation{Op: "move", Path: "public/d.txt", To: "other/d.txt"}, "other/d.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := h.runBatchOperation(roots, admin, tt.op); err != nil {
+				t.Fatal(err)
+			}
+			err := h.runBatchOperation(roots, admin, batchOperation{Op: "delete", Path: tt.deleted})
+			if retained := errors.Is(err, errRetained); retained != tt.wantRetained || (err != nil && !retained) {
+				t.Errorf("deleting '%s' = %v, want retained %v", tt.deleted, err, tt.wantRetained)
+			}
+		})
+	}
+}
+
+func TestSweepRetention(t *testing.T) {
+	files := []string{"records/old.txt", "records/new.txt", "records/held.txt", "records/busy.txt", "kept/old.txt", "public/old.txt"}
+	root := openTestTree(t, files...)
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range files {
+		if name == "records/new.txt" {
+			continue
+		}
+		if err := root.Chtimes(name, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestHandlers(t, root, nil)
+	h.retention = newRetentionPolicy(config.WORMConfig{Rules: []config.WORMRule{
+		{Path: "records", Retention: 24 * time.Hour, DeleteExpired: true},
+		{Path: "kept", Retention: 24 * time.Hour},
+	}})
+	for _, name := range files {
+		info, err := root.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.fileMeta.Record(name, info, "checksum")
+	}
+	if err := h.holds.Set(holds.Hold{Path: "records/held.txt", LegalHold: true}); err != nil {
+		t.Fatal(err)
+	}
+	h.writing.acquire("records/busy.txt")
+	h.sweepRetention(t.Context())
+
+	tests := []struct {
+		name string
+		kept bool
+	}{
+		{"records/old.txt", false},
+		{"records/new.txt", true},  // retained still
+		{"records/held.txt", true}, // under a legal hold
+		{"records/busy.txt", true}, // being written
+		{"kept/old.txt", true},     // its rule keeps expired files
+		{"public/old.txt", true},   // outside every rule
+	}
+	for _, tt := range tests {
+		_, err := root.Stat(tt.name)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("'%s' kept %v, want %v", tt.name, kept, tt.kept)
+		}
+		if _, ok := h.fileMeta.ByID(h.fileMeta.ID(tt.name)); ok != tt.kept {
+			t.Errorf("'%s' recorded %v, want %v", tt.name, ok, tt.kept)
+		}
+	}
+}
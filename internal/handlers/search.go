@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+)
+
+// maxSearchResults caps the files one search answers with, however many match.
+const maxSearchResults = 1000
+
+// SearchHandler answers the files whose names match a query, with their details as in the
+// JSON listing. Every word of the query must appear in a file's path, in any case and in any
+// order, so "q3 report" finds reports/2024/Q3-final.pdf.
+//
+// Why search the index? It already holds every name in memory, so a search costs a pass over
+// a slice rather than a walk of the storage directory.
+func (h *Handlers) SearchHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	q := r.URL.Query()
+	words := strings.Fields(strings.ToLower(q.Get("q")))
+	if len(words) == 0 {
+		h.render.Error(w, r, http.StatusBadRequest, "query is not indicated")
+		return
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			h.render.Error(w, r, http.StatusBadRequest, "invalid limit")
+			return
+		}
+		limit = min(n, maxSearchResults)
+	}
+
+	principal := principalFrom(r)
+	var names []string
+	for _, name := range h.index.List() {
+		if !matchesWords(strings.ToLower(name), words) {
+			continue
+		}
+		// Files the caller may not read are left out, so protected names do not leak.
+		if h.hidden.hidden(name) || !h.acl.Allowed(principal, acl.Read, name) {
+			continue
+		}
+		names = append(names, name)
+		if len(names) == limit {
+			break
+		}
+	}
+	h.listFilesJSON(w, r, names)
+}
+
+// matchesWords reports whether name contains every one of words.
+func matchesWords(name string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(name, word) {
+			return false
+		}
+	}
+	return true
+}
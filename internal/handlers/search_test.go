@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestSearchHandler(t *testing.T) {
+	root := openTestTree(t, "reports/2024/Q3-final.pdf", "reports/2024/q3-draft.txt", "reports/2023/Q4.pdf",
+		"notes/q3 report.txt", ".trash/q3-report.pdf", "private/q3-report.pdf")
+	h := newTestHandlers(t, root, nil)
+	h.acl = acl.New([]config.ACLRule{{Path: "/private", Read: []string{"user:boss"}}})
+	if err := h.index.Rescan(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc   string
+		query  string
+		status int
+		want   []string
+	}{
+		{"one word in any case", "q=Q3", http.StatusOK, []string{"notes/q3 report.txt", "reports/2024/Q3-final.pdf", "reports/2024/q3-draft.txt"}},
+		{"every word in any order", "q=report+q3", http.StatusOK, []string{"notes/q3 report.txt", "reports/2024/Q3-final.pdf", "reports/2024/q3-draft.txt"}},
+		{"words in different directories", "q=2024+draft", http.StatusOK, []string{"reports/2024/q3-draft.txt"}},
+		{"a word no file holds", "q=q3+2023", http.StatusOK, []string{}},
+		{"a limit", "q=q3&limit=2", http.StatusOK, []string{"notes/q3 report.txt", "reports/2024/Q3-final.pdf"}},
+		{"no query", "q=+", http.StatusBadRequest, nil},
+		{"an invalid limit", "q=q3&limit=0", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/search?"+tt.query, nil)
+			w := httptest.NewRecorder()
+			h.SearchHandler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var got struct {
+				Files []struct {
+					Name string `json:"name"`
+					Size int64  `json:"size"`
+				} `json:"files"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			names := []string{}
+			for _, f := range got.Files {
+				names = append(names, f.Name)
+				// Each test file holds its own name.
+				if f.Size != int64(len(f.Name)) {
+					t.Errorf("'%s' listed with size %d, want %d", f.Name, f.Size, len(f.Name))
+				}
+			}
+			if !slices.Equal(names, tt.want) {
+				q, _ := url.ParseQuery(tt.query)
+				t.Errorf("search for %q found %q, want %q", q.Get("q"), names, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/internal/shortlinks"
+)
+
+// maxShortenBodySize bounds the JSON body of a request for a short link.
+const maxShortenBodySize = 16 << 10 // 16 KB
+
+// shortLink describes a short link in the answers of the API.
+type shortLink struct {
+	Code string `json:"code"`
+	URL  string `json:"url"`
+	// Name is the file the link currently leads to.
+	Name      string    `json:"name"`
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
+	Clicks    int64     `json:"clicks"`
+}
+
+// ShortenHandler returns a short link, like /s/aB3xYz, to the file named in the JSON body:
+//
+//	{"name": "reports/2024/quarterly figures (final).pdf"}
+//
+// The answer is 201 Created for a new link, or 200 OK with the link the file already has.
+func (h *Handlers) ShortenHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxShortenBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return
+	}
+	name, err := cleanStoragePath(req.Name)
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if h.hiddenFile(w, r, name) {
+		return
+	}
+	principal := principalFrom(r)
+	if !h.acl.Allowed(principal, acl.Read, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	if status, msg := h.statStoredFile(name); status != http.StatusOK {
+		h.render.Error(w, r, status, msg)
+		return
+	}
+	id := h.fileMeta.ID(name)
+	if id == "" {
+		h.render.Error(w, r, http.StatusNotFound, "file is not found")
+		return
+	}
+
+	link, created, err := h.links.Shorten(id, principalName(principal))
+	if err != nil {
+		h.logger.Printf("error creating short link for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to create short link")
+		return
+	}
+	status := http.StatusOK
+	if created {
+		h.logger.Printf("short link %s created for '%s' by %s\n", link.Code, name, r.RemoteAddr)
+		status = http.StatusCreated
+	}
+	h.render.JSON(w, status, h.describeLink(r, link, name))
+}
+
+// ShortLinkHandler returns the short link with the code in the request path, with the
+// number of times it has been followed.
+func (h *Handlers) ShortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	link, ok := h.links.Get(r.PathValue("code"))
+	if !ok {
+		h.render.Error(w, r, http.StatusNotFound, "short link is not found")
+		return
+	}
+	e, ok := h.fileMeta.ByID(link.FileID)
+	if ok && h.hiddenFile(w, r, e.Path) {
+		return
+	}
+	if ok && !h.acl.Allowed(principalFrom(r), acl.Read, e.Path) {
+		h.denyAccess(w, r)
+		return
+	}
+	h.render.JSON(w, http.StatusOK, h.describeLink(r, link, e.Path))
+}
+
+// FollowShortLinkHandler redirects a short link to the download of its file, counting the
+// click.
+//
+// Why redirect rather than serve the file? The download URL then shows the file's name, and
+// browsers save it under that name.
+func (h *Handlers) FollowShortLinkHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	link, ok := h.links.Get(r.PathValue("code"))
+	if !ok {
+		h.render.Error(w, r, http.StatusNotFound, "short link is not found")
+		return
+	}
+	e, ok := h.fileMeta.ByID(link.FileID)
+	if !ok || e.MissingSince != nil {
+		h.render.Error(w, r, http.StatusNotFound, "file is not found")
+		return
+	}
+	if h.hiddenFile(w, r, e.Path) {
+		return
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Read, e.Path) {
+		h.denyAccess(w, r)
+		return
+	}
+	h.links.Click(link.Code)
+	// Not cached, so that every visit reaches the server and is counted.
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, h.basePath+"/download/"+escapePath(e.Path), http.StatusFound)
+}
+
+// describeLink returns link as described by the API, leading to the file name.
+func (h *Handlers) describeLink(r *http.Request, link shortlinks.Link, name string) shortLink {
+	return shortLink{
+		Code:      link.Code,
+		URL:       h.publicBase(r) + "/s/" + link.Code,
+		Name:      name,
+		CreatedBy: link.CreatedBy,
+		Created:   link.Created,
+		Clicks:    link.Clicks,
+	}
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/shortlinks"
+)
+
+// shorten asks h for a short link to name, as an admin.
+func shorten(t *testing.T, h *Handlers, name string) (*httptest.ResponseRecorder, shortLink) {
+	t.Helper()
+	body, _ := json.Marshal(map[string]string{"name": name})
+	r := httptest.NewRequest(http.MethodPost, "http://files.example.com/api/shorten", bytes.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ShortenHandler(w, asAdmin(r))
+	var link shortLink
+	if w.Code == http.StatusOK || w.Code == http.StatusCreated {
+		if err := json.Unmarshal(w.Body.Bytes(), &link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w, link
+}
+
+// follow follows the short link with the given code, as an admin unless anonymous is set.
+func follow(h *Handlers, code string, anonymous bool) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/s/"+code, nil)
+	r.SetPathValue("code", code)
+	if !anonymous {
+		r = asAdmin(r)
+	}
+	w := httptest.NewRecorder()
+	h.FollowShortLinkHandler(w, r)
+	return w
+}
+
+func TestShortLinks(t *testing.T) {
+	root := openTestTree(t, "private/plans.txt", ".secret.txt")
+	h := newTestHandlers(t, root, nil)
+	h.acl = acl.New([]config.ACLRule{{Path: "/private", Read: []string{"role:admin"}}})
+	h.hidden = newHiddenPolicy(config.HiddenFilesConfig{Dotfiles: true}, root.Name(), "")
+	links, err := shortlinks.Open(filepath.Join(t.TempDir(), "shortlinks.json"), log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.links = links
+	if w := upload(t, h, "/upload", formPart{"file", "reports/q3 (final).pdf", "report"}); w.Code != http.StatusOK {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+
+	w, link := shorten(t, h, "reports/q3 (final).pdf")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	if link.URL != "http://files.example.com/s/"+link.Code || link.Name != "reports/q3 (final).pdf" || link.CreatedBy != "admin" {
+		t.Errorf("got %+v", link)
+	}
+	if w, again := shorten(t, h, "reports/q3 (final).pdf"); w.Code != http.StatusOK || again.Code != link.Code {
+		t.Errorf("got status %d and code %s shortening again, want %d and %s", w.Code, again.Code, http.StatusOK, link.Code)
+	}
+
+	tests := []struct {
+		desc       string
+		name       string
+		wantStatus int
+	}{
+		{"a missing file", "reports/q4.pdf", http.StatusNotFound},
+		{"a hidden file", ".secret.txt", http.StatusNotFound},
+		{"the storage directory", "..", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if w, _ := shorten(t, h, tt.name); w.Code != tt.wantStatus {
+				t.Errorf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+
+	// The link follows the file when it is moved, and counts each visit.
+	ops, _ := json.Marshal(map[string]any{"operations": []batchOperation{{Op: "move", Path: "reports", To: "archive"}}})
+	h.BatchHandler(httptest.NewRecorder(), asAdmin(httptest.NewRequest(http.MethodPost, "/api/batch", bytes.NewReader(ops))))
+	for range 2 {
+		w := follow(h, link.Code, false)
+		if w.Code != http.StatusFound || w.Header().Get("Location") != "/download/archive/q3%20%28final%29.pdf" {
+			t.Fatalf("got status %d to %q, want %d to the moved file", w.Code, w.Header().Get("Location"), http.StatusFound)
+		}
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("got Cache-Control %q, want no-store", got)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/api/shorten/"+link.Code, nil)
+	r.SetPathValue("code", link.Code)
+	w = httptest.NewRecorder()
+	h.ShortLinkHandler(w, asAdmin(r))
+	var got shortLink
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Clicks != 2 || got.Name != "archive/q3 (final).pdf" {
+		t.Errorf("got status %d %s, want 2 clicks on the moved file", w.Code, w.Body)
+	}
+
+	if w := follow(h, "unknown", false); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d for an unknown code, want %d", w.Code, http.StatusNotFound)
+	}
+	// Following a link needs the permission to read the file.
+	if err := h.fileMeta.Reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	w, private := shorten(t, h, "private/plans.txt")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusCreated)
+	}
+	if w := follow(h, private.Code, true); w.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d following a link to a private file, want %d", w.Code, http.StatusUnauthorized)
+	}
+	// A link to a file that vanished leads nowhere.
+	h.fileMeta.Vanished("archive")
+	if w := follow(h, link.Code, false); w.Code != http.StatusNotFound {
+		t.Errorf("got status %d following a link to a vanished file, want %d", w.Code, http.StatusNotFound)
+	}
+}
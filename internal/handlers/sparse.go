@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"net/http"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// sparseBlockSize is the size of the blocks an upload is checked for zeros in. It matches
+// the block size of common filesystems, which can only leave whole blocks unallocated.
+const sparseBlockSize = 4096
+
+// zeroBlock is compared with the blocks of uploads.
+var zeroBlock = make([]byte, sparseBlockSize)
+
+// sparseWriter writes a new file, seeking over blocks of zeros rather than writing them, so
+// that the filesystem leaves holes there instead of allocating space for them.
+type sparseWriter struct {
+	f   storage.File
+	off int64 // bytes written or skipped
+}
+
+func (sw *sparseWriter) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += sparseBlockSize {
+		block := p[i:min(i+sparseBlockSize, len(p))]
+		if !bytes.Equal(block, zeroBlock[:len(block)]) {
+			if _, err := sw.f.WriteAt(block, sw.off); err != nil {
+				return i, err
+			}
+		}
+		sw.off += int64(len(block))
+	}
+	return len(p), nil
+}
+
+// finish sets the length of the file, which falls short of its content if that ends in zeros.
+func (sw *sparseWriter) finish() error {
+	return sw.f.Truncate(sw.off)
+}
+
+// extent is a range of a file that holds data.
+type extent struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+// wholeExtent returns the extents of a file of the given size without holes.
+func wholeExtent(size int64) []extent {
+	if size == 0 {
+		return nil
+	}
+	return []extent{{Offset: 0, Length: size}}
+}
+
+// fileExtents describes the layout of a sparse file in the answers of the API.
+type fileExtents struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Allocated is the disk space the file takes up, where the platform tells.
+	Allocated *int64   `json:"allocated,omitempty"`
+	Data      []extent `json:"data"`
+}
+
+// ExtentsHandler returns the ranges of the file named in the request path that hold data,
+// for downloading a sparse file such as a disk image: a client fetches only those ranges,
+// with Range requests, and leaves holes for the rest, which read as zeros.
+func (h *Handlers) ExtentsHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if h.hiddenFile(w, r, name) {
+		return
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Read, name) {
+		h.denyAccess(w, r)
+		return
+	}
+
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			h.render.Error(w, r, http.StatusNotFound, "file is not found")
+			return
+		}
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	file, err := h.openStored(root, name)
+	if err != nil {
+		status := openErrorStatus(err)
+		if status == http.StatusNotFound {
+			h.render.Error(w, r, status, "file is not found")
+		} else {
+			h.logger.Printf("error opening file '%s': %v\n", name, err)
+			h.render.Error(w, r, status, "unable to open file")
+		}
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	if stat.IsDir() {
+		h.render.Error(w, r, http.StatusForbidden, "requested path is a directory")
+		return
+	}
+
+	data, err := dataExtents(file, stat.Size())
+	if err != nil {
+		h.logger.Printf("error reading extents of '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to read file")
+		return
+	}
+	resp := fileExtents{Name: name, Size: stat.Size(), Data: data}
+	if resp.Data == nil {
+		resp.Data = []extent{}
+	}
+	if allocated, ok := allocatedSize(stat); ok {
+		resp.Allocated = &allocated
+	}
+	w.Header().Set("ETag", fileETag(stat.ModTime(), stat.Size()))
+	h.render.JSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// dataExtents returns the ranges of f, of the given size, that hold data, found with
+// SEEK_DATA and SEEK_HOLE; everything between them is a hole that reads as zeros. A file
+// that is not on disk is reported as data throughout.
+func dataExtents(f storage.File, size int64) ([]extent, error) {
+	file, ok := f.(*os.File)
+	if !ok {
+		return wholeExtent(size), nil
+	}
+	var extents []extent
+	fd := int(file.Fd())
+	for off := int64(0); off < size; {
+		start, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if errors.Is(err, syscall.ENXIO) {
+			break // only a hole is left
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := unix.Seek(fd, start, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		extents = append(extents, extent{Offset: start, Length: end - start})
+		off = end
+	}
+	return extents, nil
+}
+
+// allocatedSize returns the disk space the file described by info takes up, and whether it
+// could tell.
+func allocatedSize(info fs.FileInfo) (int64, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+	return st.Blocks * 512, true
+}
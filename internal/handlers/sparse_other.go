@@ -0,0 +1,19 @@
+//go:build !linux
+
+package handlers
+
+import (
+	"io/fs"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// dataExtents is only implemented on Linux; elsewhere the whole file is reported as data.
+func dataExtents(f storage.File, size int64) ([]extent, error) {
+	return wholeExtent(size), nil
+}
+
+// allocatedSize is only implemented on Linux.
+func allocatedSize(info fs.FileInfo) (int64, bool) {
+	return 0, false
+}
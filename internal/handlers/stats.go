@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+)
+
+// storageStats is the answer of the stats API.
+type storageStats struct {
+	// Files and Size count the stored files the server knows of, and their bytes.
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+	// DirQuotas is the standing of every directory with a quota.
+	DirQuotas []dirQuotaUsage `json:"dirQuotas"`
+}
+
+// StatsHandler returns how much is stored, in all and in every directory with a quota, as
+// summed from the file metadata. Admin only.
+func (h *Handlers) StatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := storageStats{DirQuotas: h.dirQuotaUsage()}
+	for _, e := range h.fileMeta.Present() {
+		stats.Files++
+		stats.Size += e.Size
+	}
+	h.render.JSON(w, http.StatusOK, stats)
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestStatsHandler(t *testing.T) {
+	root := openTestTree(t, "incoming/a.txt", "incoming/sub/b.txt", "other/c.txt")
+	h := newTestHandlers(t, root, nil)
+	for _, name := range []string{"incoming/a.txt", "incoming/sub/b.txt", "other/c.txt"} {
+		info, err := root.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.fileMeta.Record(name, info, "checksum")
+	}
+
+	h.dirQuotas = newDirQuotas([]config.DirQuotaConfig{
+		{Path: "incoming", MaxSizeMB: 1},
+		{Path: "/empty", MaxSizeMB: 2},
+	})
+	w := httptest.NewRecorder()
+	h.StatsHandler(w, httptest.NewRequest(http.MethodGet, "/api/stats", nil))
+
+	var got storageStats
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	// Each test file holds its own name.
+	incoming := int64(len("incoming/a.txt") + len("incoming/sub/b.txt"))
+	want := storageStats{
+		Files: 3,
+		Size:  incoming + int64(len("other/c.txt")),
+		DirQuotas: []dirQuotaUsage{
+			{Path: "/incoming", Limit: 1 << 20, Used: incoming, Free: 1<<20 - incoming},
+			{Path: "/empty", Limit: 2 << 20, Used: 0, Free: 2 << 20},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("stats %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+)
+
+// streamTypes maps the extensions of the audio and video formats browsers can play to their
+// media types.
+//
+// Why not rely on mime.TypeByExtension alone? Its built-in table has no audio or video types,
+// and the system tables it adds vary between machines, and some are wrong (".ts" as Qt
+// translations, say).
+var streamTypes = map[string]string{
+	".aac":  "audio/aac",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".m4v":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".oga":  "audio/ogg",
+	".ogg":  "audio/ogg",
+	".ogv":  "video/ogg",
+	".opus": "audio/ogg",
+	".wav":  "audio/wav",
+	".weba": "audio/webm",
+	".webm": "video/webm",
+}
+
+// streamType returns the media type name is streamed as, or "" if it is not audio or video.
+func streamType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := streamTypes[ext]; ok {
+		return t
+	}
+	if t := mime.TypeByExtension(ext); strings.HasPrefix(t, "audio/") || strings.HasPrefix(t, "video/") {
+		return t
+	}
+	return ""
+}
+
+// StreamHandler serves an audio or video file for playback in the browser, e.g. as the source
+// of a <video> element: inline, with its media type, so the browser plays it rather than
+// saving it.
+//
+// Why does seeking work? Browsers fetch media with Range requests, which serveFile answers
+// with 206 and just the bytes asked for, so a jump to the middle of a video starts loading
+// there instead of waiting for everything before it.
+func (h *Handlers) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	fileName := r.PathValue("name")
+	if fileName == "" {
+		h.render.Error(w, r, http.StatusBadRequest, "file name is not indicated")
+		return
+	}
+	mediaType := streamType(fileName)
+	if mediaType == "" {
+		h.render.Error(w, r, http.StatusUnsupportedMediaType, "file is not audio or video")
+		return
+	}
+	// Why allow media from the server itself? Opened directly, the file is played by a page
+	// the browser makes up, which the policy applies to, and "default-src 'none'" would stop
+	// it from loading the very file it was made for. A media-src of the operator's own wins.
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "" {
+		w.Header().Set("Content-Security-Policy", csp+"; media-src 'self'")
+	}
+	h.sendFile(w, r, fileName, mediaType)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStreamType(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"holiday.mp4", "video/mp4"},
+		{"films/Holiday.MKV", "video/x-matroska"},
+		{"talk.opus", "audio/ogg"},
+		{"song.mp3", "audio/mpeg"},
+		{"notes.txt", ""},
+		{"photo.jpg", ""},
+		{"Makefile", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := streamType(tt.name); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	root := openTestTree(t, "films/holiday.mp4", "notes.txt")
+	h := newTestHandlers(t, root, nil)
+
+	tests := []struct {
+		desc       string
+		name       string
+		csp        string // the policy set by the security headers middleware
+		wantStatus int
+		wantCSP    string
+	}{
+		{"a video", "films/holiday.mp4", "", http.StatusPartialContent, ""},
+		{"a video under a security policy", "films/holiday.mp4", "default-src 'none'",
+			http.StatusPartialContent, "default-src 'none'; media-src 'self'"},
+		{"not audio or video", "notes.txt", "", http.StatusUnsupportedMediaType, ""},
+		{"a missing video", "films/missing.mp4", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/stream/"+tt.name, nil)
+			r.SetPathValue("name", tt.name)
+			// Browsers seek with Range requests.
+			r.Header.Set("Range", "bytes=6-")
+			w := httptest.NewRecorder()
+			if tt.csp != "" {
+				w.Header().Set("Content-Security-Policy", tt.csp)
+			}
+			h.StreamHandler(w, asAdmin(r))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if w.Code != http.StatusPartialContent {
+				return
+			}
+			if got := w.Body.String(); got != "holiday.mp4" {
+				t.Errorf("got %q, want the rest of the file", got)
+			}
+			if got := w.Header().Get("Content-Type"); got != "video/mp4" {
+				t.Errorf("got Content-Type %q, want video/mp4", got)
+			}
+			if got, want := w.Header().Get("Content-Disposition"), `inline; filename="holiday.mp4"; filename*=UTF-8''holiday.mp4`; got != want {
+				t.Errorf("got Content-Disposition %q, want %q", got, want)
+			}
+			if got := w.Header().Get("Content-Security-Policy"); got != tt.wantCSP {
+				t.Errorf("got Content-Security-Policy %q, want %q", got, tt.wantCSP)
+			}
+		})
+	}
+
+	// File info links to the stream of audio and video only.
+	if _, info := getFileInfo(t, h, "films/holiday.mp4"); info.Links.Stream != "/stream/films/holiday.mp4" {
+		t.Errorf("got stream link %q for a video", info.Links.Stream)
+	}
+	if _, info := getFileInfo(t, h, "notes.txt"); info.Links.Stream != "" {
+		t.Errorf("got stream link %q for a text file", info.Links.Stream)
+	}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// errSymlink is reported for paths through symbolic links the policy does not follow. It
+// wraps fs.ErrPermission, so that it is answered with 403 Forbidden like other refusals.
+var errSymlink = fmt.Errorf("symbolic links are not followed: %w", fs.ErrPermission)
+
+// checkSymlinks returns an error if name, or a directory it lies below, is a symbolic link
+// that uploader.symlinks keeps clients from: one wrapping fs.ErrNotExist for hidden links,
+// or errSymlink for refused ones. Writes through a link are refused either way, as a link
+// hidden from a client cannot be replaced by the file it uploads without losing its target.
+//
+// Why check each element with Lstat? os.Root follows links that stay within the storage
+// directory without saying so, and a link anywhere along the path redirects it.
+func (h *Handlers) checkSymlinks(root storage.Root, name string, write bool) error {
+	if h.uploader.Symlinks == "follow" {
+		return nil
+	}
+	p := ""
+	for elem := range strings.SplitSeq(path.Clean(name), "/") {
+		p = path.Join(p, elem)
+		info, err := root.Lstat(p)
+		if err != nil {
+			// Missing elements are for the caller to find, when it opens or creates the file.
+			return nil
+		}
+		if info.Mode()&fs.ModeSymlink == 0 {
+			continue
+		}
+		if h.uploader.Symlinks == "hide" && !write {
+			return &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		return &fs.PathError{Op: "open", Path: p, Err: errSymlink}
+	}
+	return nil
+}
+
+// openStored opens the stored file name for reading, unless the symlink policy keeps
+// clients from it.
+func (h *Handlers) openStored(root storage.Root, name string) (storage.File, error) {
+	if err := h.checkSymlinks(root, name, false); err != nil {
+		return nil, err
+	}
+	return root.Open(name)
+}
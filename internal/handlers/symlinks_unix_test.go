@@ -0,0 +1,183 @@
+//go:build unix
+
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/index"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// newSymlinkTestHandlers returns handlers with the given symlink policy for a tree holding
+// a.txt and real/b.txt, with the links link.txt to a.txt and linkdir to real.
+func newSymlinkTestHandlers(t *testing.T, policy string) (*Handlers, storage.Root) {
+	t.Helper()
+	root := openTestTree(t, "a.txt", "real/b.txt")
+	for link, target := range map[string]string{"link.txt": "a.txt", "linkdir": "real"} {
+		if err := os.Symlink(target, filepath.Join(root.Name(), link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestHandlers(t, root, nil)
+	h.uploader.Symlinks = policy
+	h.index = index.New(h.storage, policy == "hide", h.logger)
+	return h, root
+}
+
+func TestSymlinksDownload(t *testing.T) {
+	tests := []struct {
+		policy     string
+		name       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"follow", "a.txt", http.StatusOK, "a.txt"},
+		{"follow", "link.txt", http.StatusOK, "a.txt"},
+		{"follow", "linkdir/b.txt", http.StatusOK, "real/b.txt"},
+		{"refuse", "a.txt", http.StatusOK, "a.txt"},
+		{"refuse", "link.txt", http.StatusForbidden, ""},
+		{"refuse", "linkdir/b.txt", http.StatusForbidden, ""},
+		{"hide", "real/b.txt", http.StatusOK, "real/b.txt"},
+		{"hide", "link.txt", http.StatusNotFound, ""},
+		{"hide", "linkdir/b.txt", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.name, func(t *testing.T) {
+			h, _ := newSymlinkTestHandlers(t, tt.policy)
+			r := httptest.NewRequest(http.MethodGet, "/download/"+tt.name, nil)
+			r.SetPathValue("name", tt.name)
+			w := httptest.NewRecorder()
+			h.DownloadHandle(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("got %q, want %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestSymlinksList(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{"follow", []string{"a.txt", "link.txt", "real/b.txt"}},
+		{"refuse", []string{"a.txt", "link.txt", "real/b.txt"}},
+		{"hide", []string{"a.txt", "real/b.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			h, _ := newSymlinkTestHandlers(t, tt.policy)
+			if err := h.index.Rescan(); err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/download/list.txt", nil)
+			r.Header.Set("Accept", "application/json")
+			w := httptest.NewRecorder()
+			h.DownloadList(w, r)
+			var got struct {
+				Files []struct {
+					Name string `json:"name"`
+				} `json:"files"`
+			}
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range got.Files {
+				names = append(names, f.Name)
+			}
+			slices.Sort(names)
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("listed %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+// TestSymlinksWrite checks that files are never written through a link the policy does not
+// follow, whether it refuses or hides them.
+func TestSymlinksWrite(t *testing.T) {
+	tests := []struct {
+		policy     string
+		filename   string
+		wantStatus int
+	}{
+		{"follow", "linkdir/new.txt", http.StatusOK},
+		{"refuse", "link.txt", http.StatusForbidden},
+		{"refuse", "linkdir/new.txt", http.StatusForbidden},
+		{"hide", "link.txt", http.StatusForbidden},
+		{"hide", "linkdir/new.txt", http.StatusForbidden},
+		{"hide", "new.txt", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.filename, func(t *testing.T) {
+			h, root := newSymlinkTestHandlers(t, tt.policy)
+			body, contentType := encodeForm(t, formPart{"file", tt.filename, "uploaded"})
+			r := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+			r.Header.Set("Content-Type", contentType)
+			w := httptest.NewRecorder()
+			h.UploadHandler(w, asAdmin(r))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if b, _ := root.ReadFile("a.txt"); string(b) != "a.txt" {
+				t.Errorf("a.txt holds %q, want it unchanged", b)
+			}
+			if written := exists(t, root, "real/new.txt"); written != (tt.wantStatus == http.StatusOK && tt.filename == "linkdir/new.txt") {
+				t.Errorf("real/new.txt written %v", written)
+			}
+		})
+	}
+}
+
+func TestSymlinksBatch(t *testing.T) {
+	tests := []struct {
+		policy  string
+		op      string
+		path    string
+		to      string
+		wantErr string
+	}{
+		{"follow", "copy", "linkdir/b.txt", "b.txt", ""},
+		{"refuse", "copy", "linkdir/b.txt", "b.txt", errSymlink.Error()},
+		{"refuse", "copy", "a.txt", "linkdir/a.txt", errSymlink.Error()},
+		{"refuse", "delete", "linkdir/b.txt", "", errSymlink.Error()},
+		{"hide", "copy", "linkdir/b.txt", "b.txt", "not found"},
+		{"hide", "delete", "link.txt", "", "not found"},
+		{"hide", "move", "a.txt", "linkdir/a.txt", errSymlink.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+" "+tt.op+" "+tt.path, func(t *testing.T) {
+			h, root := newSymlinkTestHandlers(t, tt.policy)
+			ops, _ := json.Marshal(map[string]any{"operations": []batchOperation{{Op: tt.op, Path: tt.path, To: tt.to}}})
+			w := httptest.NewRecorder()
+			h.BatchHandler(w, asAdmin(httptest.NewRequest(http.MethodPost, "/api/batch", bytes.NewReader(ops))))
+			var resp batchResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || len(resp.Results) != 1 {
+				t.Fatalf("status %d %s: %v", w.Code, w.Body, err)
+			}
+			if got := resp.Results[0].Error; got != tt.wantErr {
+				t.Fatalf("got error %q, want %q", got, tt.wantErr)
+			}
+			if tt.wantErr == "" {
+				return
+			}
+			for _, name := range []string{"a.txt", "real/b.txt", "link.txt", "linkdir"} {
+				if _, err := root.Lstat(name); err != nil {
+					t.Errorf("'%s' is gone: %v", name, err)
+				}
+			}
+		})
+	}
+}
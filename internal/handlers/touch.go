@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+)
+
+// TouchHandler sets the modification time of the file named in the request path to now, or
+// to the time in the "time" query parameter, without rewriting its content. It answers with
+// the file's details and new ETag.
+//
+// Why a separate endpoint? Clients that keep files alive in temporary storage, or that
+// correct the time of a file they uploaded, would otherwise have to upload it all again.
+func (h *Handlers) TouchHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return
+	}
+	if h.hiddenFile(w, r, name) {
+		return
+	}
+	principal := principalFrom(r)
+	if !h.acl.Allowed(principal, acl.Write, name) {
+		h.denyAccess(w, r)
+		return
+	}
+	t := time.Now()
+	if v := r.URL.Query().Get("time"); v != "" {
+		if t, err = parseClientTime(v); err != nil {
+			h.render.Error(w, r, http.StatusBadRequest, "invalid time", err.Error())
+			return
+		}
+	}
+
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			h.render.Error(w, r, http.StatusNotFound, "file is not found")
+			return
+		}
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	defer root.Close()
+
+	if err := h.checkSymlinks(root, name, true); err != nil {
+		h.render.Error(w, r, http.StatusForbidden, "unable to open file", err.Error())
+		return
+	}
+	info, err := root.Stat(name)
+	if err != nil {
+		status := openErrorStatus(err)
+		if status == http.StatusNotFound {
+			h.render.Error(w, r, status, "file is not found")
+		} else {
+			h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+			h.render.Error(w, r, status, "unable to access file")
+		}
+		return
+	}
+	if !info.Mode().IsRegular() {
+		h.render.Error(w, r, http.StatusForbidden, "requested path is a directory")
+		return
+	}
+	if err := h.checkHold(principal, name, "touch"); err != nil {
+		h.render.Error(w, r, protectedStatus(err), "protected files cannot be changed", err.Error())
+		return
+	}
+	// Write-once retention runs from the modification time, so touching a retained file
+	// restarts its retention, as a keep-alive would reset a TTL. Dating it back would release it
+	// early instead.
+	if err := h.checkTouchRetention(principal, name, info, t); err != nil {
+		h.render.Error(w, r, protectedStatus(err), "protected files cannot be changed", err.Error())
+		return
+	}
+
+	// The content is unchanged, so its checksum, if known, still holds.
+	sum, _ := h.fileMeta.Checksum(name, info)
+	// Why unshare? Hard links share one modification time, so touching a copy would touch the
+	// file it was copied from as well, and release it from retention should it be dated back.
+	if err := unshare(root, name); err != nil {
+		h.logger.Printf("error unsharing '%s': %v\n", name, err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to touch file")
+		return
+	}
+	if err := h.setModified(root, name, t, sum); err != nil {
+		h.logger.Printf("error setting modification time of '%s': %v\n", name, err)
+		h.render.Error(w, r, storageErrorStatus(err), "unable to touch file")
+		return
+	}
+	if info, err = root.Stat(name); err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+	h.logger.Printf("touched '%s' for %s\n", name, r.RemoteAddr)
+	h.renderStored(w, name, info, false)
+}
+
+// checkTouchRetention returns an error wrapping errRetained if giving name, described by info,
+// the modification time t would shorten its write-once retention.
+func (h *Handlers) checkTouchRetention(p *auth.Principal, name string, info fs.FileInfo, t time.Time) error {
+	until, retained := h.retention.lockedUntil(name, info.ModTime())
+	if !retained || !t.Before(info.ModTime()) {
+		return nil
+	}
+	err := fmt.Errorf("%w: '%s' is retained permanently", errRetained, name)
+	if !until.IsZero() {
+		err = fmt.Errorf("%w: '%s' is retained until %s and cannot be dated back", errRetained, name, until.UTC().Format(time.RFC3339))
+	}
+	h.logger.Printf("warn: refused to touch '%s' for %s: %v\n", name, principalName(p), err)
+	return err
+}
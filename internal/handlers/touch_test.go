@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/holds"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// newTouchHandlers returns handlers touching the files in root, which retain the files below
+// compliance for a day.
+func newTouchHandlers(t *testing.T, root storage.Root) *Handlers {
+	t.Helper()
+	h := newTestHandlers(t, root, nil)
+	h.retention = newRetentionPolicy(config.WORMConfig{Rules: []config.WORMRule{{Path: "compliance", Retention: 24 * time.Hour}}})
+	return h
+}
+
+func TestTouchHandler(t *testing.T) {
+	root := openTestTree(t, "compliance/new.txt", "compliance/old.txt", "public/a.txt", "public/held.txt")
+	now := time.Now().Truncate(time.Second)
+	old := now.Add(-48 * time.Hour)
+	if err := root.Chtimes("compliance/old.txt", old, old); err != nil {
+		t.Fatal(err)
+	}
+	h := newTouchHandlers(t, root)
+	if err := h.holds.Set(holds.Hold{Path: "public/held.txt", LegalHold: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc   string
+		name   string
+		time   time.Time // zero for now
+		status int
+	}{
+		{"a file", "public/a.txt", old, http.StatusOK},
+		{"a held file", "public/held.txt", time.Time{}, http.StatusLocked},
+		{"restarting the retention of a retained file", "compliance/new.txt", now.Add(time.Hour), http.StatusOK},
+		{"dating back a retained file", "compliance/new.txt", old, http.StatusForbidden},
+		{"dating back a file past its retention", "compliance/old.txt", old.Add(-time.Hour), http.StatusOK},
+		{"a missing file", "public/missing.txt", time.Time{}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			target := "/api/touch/x"
+			if !tt.time.IsZero() {
+				target += "?time=" + url.QueryEscape(tt.time.Format(time.RFC3339))
+			}
+			r := httptest.NewRequest(http.MethodPost, target, nil)
+			r.SetPathValue("name", tt.name)
+			w := httptest.NewRecorder()
+			h.TouchHandler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			info, err := root.Stat(tt.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !info.ModTime().Equal(tt.time) {
+				t.Errorf("modification time %v, want %v", info.ModTime(), tt.time)
+			}
+		})
+	}
+}
+
+// TestTouchHardLink touches a hard-link copy of a retained file, which must not date back the
+// original along with it.
+func TestTouchHardLink(t *testing.T) {
+	root := openTestTree(t, "compliance/a.txt")
+	if err := root.MkdirAll("public", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Link("compliance/a.txt", "public/a.txt"); err != nil {
+		t.Skipf("hard links are not supported: %v", err)
+	}
+	info, err := root.Stat("public/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := linkCount(info); !ok {
+		t.Skip("link counts are not supported")
+	}
+	h := newTouchHandlers(t, root)
+
+	old := time.Now().Add(-48 * time.Hour).Truncate(time.Second)
+	r := httptest.NewRequest(http.MethodPost, "/api/touch/public/a.txt?time="+url.QueryEscape(old.Format(time.RFC3339)), nil)
+	r.SetPathValue("name", "public/a.txt")
+	w := httptest.NewRecorder()
+	h.TouchHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", w.Code, w.Body)
+	}
+	if err := h.checkRetention(root, nil, "compliance/a.txt", "delete"); err == nil {
+		t.Error("touching the copy released the original from retention")
+	}
+	if b, err := root.ReadFile("public/a.txt"); err != nil || string(b) != "compliance/a.txt" {
+		t.Errorf("the copy holds %q (%v) after it was touched", b, err)
+	}
+}
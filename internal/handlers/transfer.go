@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// contextReader is an io.Reader that stops as soon as its context is cancelled.
+//
+// Why is it needed? io.Copy has no notion of cancellation. When a client disconnects,
+// net/http cancels the request context, but a copy loop would carry on reading the
+// source until it hits EOF, wasting disk I/O and bandwidth on a transfer nobody receives.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+// newContextReader wraps r so that reads fail with the context's error once ctx is done.
+func newContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, r: r}
+}
+
+// Read checks the context before every read, so a copy stops within one buffer of cancellation.
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
+
+// clientGone reports whether a transfer error was caused by the client going away,
+// either noticed by net/http (cancelled context) or by a failed write to the socket.
+func clientGone(r *http.Request, err error) bool {
+	return r.Context().Err() != nil || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// deadlineReader extends the connection deadlines before every read of a request body.
+//
+// Why not just raise ReadTimeout? A timeout covering the whole request either kills large
+// uploads or lets a stalled client hold a connection for hours. Extending the deadline
+// per read bounds only the time between chunks, however long the transfer takes overall.
+// The write deadline is extended too, as it has been running since the request arrived
+// and the response is only written once the body has been consumed.
+type deadlineReader struct {
+	io.ReadCloser
+	rc    *http.ResponseController
+	stall time.Duration
+}
+
+// Read pushes both deadlines forward by the stall timeout, then reads.
+func (dr *deadlineReader) Read(p []byte) (int, error) {
+	deadline := time.Now().Add(dr.stall)
+	// Errors are ignored: writers that do not support deadlines simply keep the server-wide timeouts.
+	dr.rc.SetReadDeadline(deadline)
+	dr.rc.SetWriteDeadline(deadline)
+	return dr.ReadCloser.Read(p)
+}
+
+// sendfileChunk is how much of a file is handed to the kernel per sendfile call. Between
+// chunks the write deadline is extended and the request context checked, so this also bounds
+// how slowly a client may read: a chunk must be accepted within the stall timeout.
+const sendfileChunk = 1 << 20 // 1 MB
+
+// downloadWriter writes a response body, extending the write deadline whilst data is
+// flowing and stopping once the client has disconnected.
+//
+// Why not wrap the file instead, as uploads do? net/http only uses sendfile(2) when it can
+// see the *os.File being copied; a wrapping reader forces every byte through user space,
+// which is what made parallel large downloads CPU-bound. ReadFrom keeps the file visible.
+type downloadWriter struct {
+	http.ResponseWriter
+	rc    *http.ResponseController
+	ctx   context.Context
+	stall time.Duration
+	err   error // the first write error, as http.ServeContent does not report it
+}
+
+// newDownloadWriter wraps w for streaming the response to r.
+func (h *Handlers) newDownloadWriter(w http.ResponseWriter, r *http.Request) *downloadWriter {
+	return &downloadWriter{ResponseWriter: w, rc: http.NewResponseController(w), ctx: r.Context(), stall: h.stallTimeout}
+}
+
+// Write is used when the source cannot be sent with sendfile.
+func (dw *downloadWriter) Write(p []byte) (int, error) {
+	if err := dw.prepare(); err != nil {
+		return 0, err
+	}
+	n, err := dw.ResponseWriter.Write(p)
+	return n, dw.record(err)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (dw *downloadWriter) Unwrap() http.ResponseWriter {
+	return dw.ResponseWriter
+}
+
+// ReadFrom passes src on to the connection chunk by chunk, so each chunk can use sendfile.
+// io.Copy calls it with the file itself, or with a wrapper that still exposes the file
+// descriptor; a limit set with io.LimitReader is honoured.
+func (dw *downloadWriter) ReadFrom(src io.Reader) (int64, error) {
+	rf, ok := dw.ResponseWriter.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(struct{ io.Writer }{dw}, src)
+	}
+	remaining := int64(-1)
+	if lr, ok := src.(*io.LimitedReader); ok {
+		src, remaining = lr.R, lr.N
+	}
+
+	var written int64
+	for remaining != 0 {
+		if err := dw.prepare(); err != nil {
+			return written, err
+		}
+		chunk := int64(sendfileChunk)
+		if remaining > 0 && remaining < chunk {
+			chunk = remaining
+		}
+		n, err := rf.ReadFrom(&io.LimitedReader{R: src, N: chunk})
+		written += n
+		if remaining > 0 {
+			remaining -= n
+		}
+		if err != nil || n < chunk {
+			// A short chunk without an error means the source is exhausted.
+			return written, dw.record(err)
+		}
+	}
+	return written, nil
+}
+
+// prepare is called before each write: it fails once the client has gone and otherwise
+// pushes the write deadline forward by the stall timeout, if one is configured.
+func (dw *downloadWriter) prepare() error {
+	if err := dw.ctx.Err(); err != nil {
+		return dw.record(err)
+	}
+	if dw.stall > 0 {
+		// Errors are ignored: writers that do not support deadlines keep the server-wide timeout.
+		dw.rc.SetWriteDeadline(time.Now().Add(dw.stall))
+	}
+	return nil
+}
+
+// record remembers the first error, so it can be logged once the response is complete.
+func (dw *downloadWriter) record(err error) error {
+	if err != nil && dw.err == nil {
+		dw.err = err
+	}
+	return err
+}
+
+// withStallTimeout wraps the request body so that reading it keeps the connection alive
+// for as long as data arrives within h.stallTimeout. It is a no-op when the timeout is disabled.
+func (h *Handlers) withStallTimeout(w http.ResponseWriter, r *http.Request) {
+	if h.stallTimeout <= 0 {
+		return
+	}
+	r.Body = &deadlineReader{ReadCloser: r.Body, rc: http.NewResponseController(w), stall: h.stallTimeout}
+}
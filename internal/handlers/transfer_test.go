@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serveTestFile starts a server answering every request with the file at name, as
+// serveFile does, with the file hidden behind a reader unless sendfile is set.
+func serveTestFile(t testing.TB, name string, sendfile bool) *httptest.Server {
+	h := &Handlers{stallTimeout: time.Minute}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		var content io.ReadSeeker = f
+		if !sendfile {
+			content = struct{ io.ReadSeeker }{f}
+		}
+		http.ServeContent(h.newDownloadWriter(w, r), r, name, time.Time{}, content)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// writeTestFile writes size bytes of a repeating pattern to a temporary file.
+func writeTestFile(t testing.TB, size int) (string, []byte) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), size/16)
+	name := filepath.Join(t.TempDir(), "file.bin")
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name, data
+}
+
+func TestDownloadWriter(t *testing.T) {
+	// Larger than a sendfile chunk, so that the file is sent in several.
+	name, data := writeTestFile(t, 3*sendfileChunk+4096)
+	srv := serveTestFile(t, name, true)
+
+	tests := []struct {
+		desc   string
+		rng    string
+		want   []byte
+		status int
+	}{
+		{"whole file", "", data, http.StatusOK},
+		{"range within a chunk", "bytes=10-19", data[10:20], http.StatusPartialContent},
+		{"range across chunks", "bytes=1048000-2097999", data[1048000:2098000], http.StatusPartialContent},
+		{"suffix range", "bytes=-100", data[len(data)-100:], http.StatusPartialContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.rng != "" {
+				req.Header.Set("Range", tt.rng)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status || !bytes.Equal(got, tt.want) {
+				t.Errorf("got %d with %d bytes, want %d with %d bytes", resp.StatusCode, len(got), tt.status, len(tt.want))
+			}
+		})
+	}
+}
+
+// BenchmarkDownload downloads a large file in parallel, through sendfile and, for
+// comparison, through a reader that hides the file from net/http. Compare the CPU time
+// each takes, e.g. with -cpuprofile or "go test -bench Download -benchtime 20x" under time(1).
+func BenchmarkDownload(b *testing.B) {
+	name, _ := writeTestFile(b, 64<<20)
+	for _, bb := range []struct {
+		desc     string
+		sendfile bool
+	}{
+		{"sendfile", true},
+		{"wrapped", false},
+	} {
+		b.Run(bb.desc, func(b *testing.B) {
+			srv := serveTestFile(b, name, bb.sendfile)
+			client := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: 64}}
+			b.SetBytes(64 << 20)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					resp, err := client.Get(srv.URL)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.Copy(io.Discard, resp.Body)
+					resp.Body.Close()
+				}
+			})
+		})
+	}
+}
+
+func TestContextReader(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	r := newContextReader(ctx, strings.NewReader("0123456789"))
+	buf := make([]byte, 4)
+	if n, err := r.Read(buf); n != 4 || err != nil {
+		t.Fatalf("Read = %d, %v before cancelling, want 4, nil", n, err)
+	}
+	cancel()
+	if n, err := r.Read(buf); n != 0 || !errors.Is(err, context.Canceled) {
+		t.Errorf("Read = %d, %v after cancelling, want 0, %v", n, err, context.Canceled)
+	}
+}
+
+func TestClientGone(t *testing.T) {
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	tests := []struct {
+		desc string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"a cancelled request", ctx, context.Canceled, true},
+		{"a reset connection", t.Context(), &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, true},
+		{"a closed connection", t.Context(), &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"a failing disk", t.Context(), &os.PathError{Op: "read", Path: "a.txt", Err: syscall.EIO}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequestWithContext(tt.ctx, http.MethodGet, "/download/a.txt", nil)
+			if got := clientGone(r, tt.err); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestClientDisconnects checks that transfers to and from a client that has gone stop
+// without storing or sending anything, and without an answer nobody would receive.
+func TestClientDisconnects(t *testing.T) {
+	root := openTestTree(t, "a.txt")
+	h := newTestHandlers(t, root, nil)
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	body, contentType := encodeForm(t, formPart{"file", "b.txt", "uploaded"}, formPart{"file", "c.txt", "uploaded"})
+	r := httptest.NewRequestWithContext(ctx, http.MethodPost, "/upload", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	h.UploadHandler(w, asAdmin(r))
+	if w.Body.Len() != 0 {
+		t.Errorf("answered %d %s to a client that has gone", w.Code, w.Body)
+	}
+	for _, name := range []string{"b.txt", "c.txt"} {
+		if exists(t, root, name) {
+			t.Errorf("%s stored for a client that has gone", name)
+		}
+	}
+
+	r = httptest.NewRequestWithContext(ctx, http.MethodGet, "/download/a.txt", nil)
+	r.SetPathValue("name", "a.txt")
+	w = httptest.NewRecorder()
+	h.DownloadHandle(w, r)
+	if w.Body.Len() != 0 {
+		t.Errorf("sent %q to a client that has gone", w.Body)
+	}
+}
+
+// TestStallTimeout sends request bodies slowly to a server whose read timeout is shorter
+// than the whole transfer: it is cut off only if data stops arriving for longer than the
+// stall timeout.
+func TestStallTimeout(t *testing.T) {
+	tests := []struct {
+		desc         string
+		stallTimeout time.Duration
+		gaps         []time.Duration // between the chunks of the body
+		wantErr      bool
+	}{
+		{"data flowing", 300 * time.Millisecond, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond}, false},
+		{"data stalling", 300 * time.Millisecond, []time.Duration{100 * time.Millisecond, 600 * time.Millisecond}, true},
+		{"data flowing, without a stall timeout", 0, []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			h := &Handlers{stallTimeout: tt.stallTimeout}
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				h.withStallTimeout(w, r)
+				b, err := io.ReadAll(r.Body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				w.Write(b)
+			}))
+			srv.Config.ReadTimeout = 250 * time.Millisecond
+			srv.Config.WriteTimeout = 250 * time.Millisecond
+			srv.Start()
+			defer srv.Close()
+
+			pr, pw := io.Pipe()
+			go func() {
+				pw.Write([]byte("0"))
+				for i, gap := range tt.gaps {
+					time.Sleep(gap)
+					if _, err := fmt.Fprint(pw, i+1); err != nil {
+						return
+					}
+				}
+				pw.Close()
+			}()
+			resp, err := http.Post(srv.URL, "application/octet-stream", pr)
+			if err == nil {
+				var got []byte
+				got, err = io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err == nil && (resp.StatusCode != http.StatusOK || len(got) != len(tt.gaps)+1) {
+					err = fmt.Errorf("got %d %q", resp.StatusCode, got)
+				}
+			}
+			pr.CloseWithError(io.ErrClosedPipe)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
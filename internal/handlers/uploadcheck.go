@@ -0,0 +1,157 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// maxCheckFiles caps the files per preflight request, as each one may need to be hashed.
+const maxCheckFiles = 1000
+
+// Statuses reported by UploadCheckHandler.
+const (
+	checkPresent  = "present"  // stored with the same size and checksum: no need to upload
+	checkModified = "modified" // stored, but with different content
+	checkMissing  = "missing"  // not stored (or not visible to the caller)
+	checkError    = "error"    // the entry is invalid or could not be checked
+)
+
+// checkFile is one entry of a preflight request, describing a file the client may upload.
+type checkFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// checkResult reports whether the server already has one file.
+type checkResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// checkResponse is the document returned by UploadCheckHandler.
+type checkResponse struct {
+	Files []checkResult `json:"files"`
+}
+
+// UploadCheckHandler tells a client which of the files it is about to upload the server
+// already has with identical content, so sync clients can skip re-uploading them.
+//
+// Why compare sizes first? A different size settles the question without reading the
+// stored file; only files of the same size are hashed.
+func (h *Handlers) UploadCheckHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	var req struct {
+		Files []checkFile `json:"files"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBatchBodySize)
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			h.render.TooLarge(w, r, "check request body is too large", maxBatchBodySize)
+			return
+		}
+		h.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return
+	}
+	if len(req.Files) == 0 {
+		h.render.Error(w, r, http.StatusBadRequest, "no files given")
+		return
+	}
+	if len(req.Files) > maxCheckFiles {
+		h.render.Error(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d files are allowed per check", maxCheckFiles))
+		return
+	}
+
+	roots := storage.NewRoots(h.storage)
+	defer roots.Close()
+
+	principal := principalFrom(r)
+	resp := checkResponse{Files: make([]checkResult, 0, len(req.Files))}
+	for _, f := range req.Files {
+		status, err := h.checkFile(r, roots, principal, f)
+		res := checkResult{Name: f.Name, Status: status}
+		if err != nil {
+			if r.Context().Err() != nil {
+				h.logger.Printf("client %s disconnected during upload check\n", r.RemoteAddr)
+				return
+			}
+			res.Status = checkError
+			res.Error = err.Error()
+		}
+		resp.Files = append(resp.Files, res)
+	}
+	h.render.JSON(w, http.StatusOK, resp)
+}
+
+// checkFile compares one client file with the stored file of the same name.
+func (h *Handlers) checkFile(r *http.Request, roots *storage.Roots, p *auth.Principal, f checkFile) (string, error) {
+	name, err := cleanStoragePath(f.Name)
+	if err != nil {
+		return "", err
+	}
+	sum := strings.ToLower(f.SHA256)
+	if b, err := hex.DecodeString(sum); err != nil || len(b) != 32 {
+		return "", errors.New("sha256 must be 64 hexadecimal characters")
+	}
+	// Why report unreadable files as missing? Saying otherwise would reveal that a file
+	// exists to a caller the ACL, or the hidden file policy, hides it from.
+	if h.hidden.hidden(name) || !h.acl.Allowed(p, acl.Read, name) {
+		return checkMissing, nil
+	}
+	root, err := roots.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		// Nothing has been uploaded yet, so every file is missing.
+		return checkMissing, nil
+	}
+	if err != nil {
+		h.logger.Printf("error root opening: %v\n", err)
+		return "", errors.New("internal error")
+	}
+
+	file, err := h.openStored(root, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return checkMissing, nil
+		}
+		h.logger.Printf("error opening file '%s': %v\n", name, err)
+		return "", errors.New("unable to open file")
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		return "", errors.New("unable to access file")
+	}
+	if stat.IsDir() {
+		return "", errors.New("path is a directory")
+	}
+	if stat.Size() != f.Size {
+		return checkModified, nil
+	}
+
+	stored, err := h.checksum(r, name, file, stat)
+	if err != nil {
+		if r.Context().Err() == nil {
+			h.logger.Printf("error reading file '%s': %v\n", name, err)
+		}
+		return "", errors.New("unable to read file")
+	}
+	if stored != sum {
+		return checkModified, nil
+	}
+	return checkPresent, nil
+}
@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/clamav"
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// validator checks uploaded files before they are stored; see config.ValidationConfig.
+type validator struct {
+	allowedTypes []string
+	scanner      *clamav.Scanner // nil if scanning is disabled
+	quarantine   bool
+}
+
+func newValidator(cfg config.ValidationConfig) *validator {
+	v := &validator{allowedTypes: cfg.AllowedTypes, quarantine: cfg.Quarantine}
+	if cfg.ClamAV != "" {
+		v.scanner = clamav.New(cfg.ClamAV)
+	}
+	return v
+}
+
+// rejection is returned by validate for a file that failed a check, as opposed to one that
+// could not be checked.
+type rejection struct {
+	status int
+	reason string
+}
+
+func (r *rejection) Error() string {
+	return r.reason
+}
+
+// validate checks the uploaded file about to be stored at name, returning a *rejection if
+// it fails. The file offset is left at the start.
+func (v *validator) validate(name string, fh *multipart.FileHeader, file multipart.File) error {
+	if len(v.allowedTypes) > 0 {
+		detected, err := detectMIMEType(file, name)
+		if err != nil {
+			return err
+		}
+		mediaType, _, _ := mime.ParseMediaType(detected)
+		allowed := false
+		for _, pattern := range v.allowedTypes {
+			if matchMIMEType(pattern, mediaType) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return &rejection{http.StatusUnsupportedMediaType, fmt.Sprintf("type %s is not allowed", mediaType)}
+		}
+	}
+
+	want, err := partDigest(fh.Header)
+	if err != nil {
+		return err
+	}
+	if want == nil && v.scanner == nil {
+		return nil
+	}
+
+	// Why hash and scan in one pass? The scan has to read the whole file anyway.
+	hash := sha256.New()
+	content := io.TeeReader(file, hash)
+	var found string
+	if v.scanner != nil {
+		if found, err = v.scanner.Scan(content); err != nil {
+			return fmt.Errorf("scanning for malware: %w", err)
+		}
+	} else if _, err := io.Copy(io.Discard, content); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if found != "" {
+		return &rejection{http.StatusUnprocessableEntity, fmt.Sprintf("malware found (%s)", found)}
+	}
+	if want != nil && string(want) != string(hash.Sum(nil)) {
+		return &rejection{http.StatusUnprocessableEntity, "checksum does not match Content-Digest"}
+	}
+	return nil
+}
+
+// errMalformedDigest reports a Content-Digest header that cannot be verified. The file is
+// not quarantined, as the header rather than the file is at fault.
+var errMalformedDigest = errors.New("malformed sha-256 Content-Digest")
+
+// partDigest returns the SHA-256 digest a client sent with a part in a Content-Digest (or
+// Repr-Digest) header, as defined by RFC 9530: "sha-256=:<base64>:". It returns nil if the
+// header is absent or names only other algorithms.
+func partDigest(header textproto.MIMEHeader) ([]byte, error) {
+	value := ""
+	for _, key := range []string{"Content-Digest", "Repr-Digest"} {
+		if v := strings.Join(header.Values(key), ","); v != "" {
+			value = v
+			break
+		}
+	}
+	for _, member := range strings.Split(value, ",") {
+		alg, sum, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok || !strings.EqualFold(alg, "sha-256") {
+			continue
+		}
+		digest, err := base64.StdEncoding.DecodeString(strings.Trim(sum, ":"))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, errMalformedDigest
+		}
+		return digest, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"os"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+)
+
+// PosterHandler serves the poster frame of a stored video, as a JPEG image, to anyone who may
+// read the video.
+func (h *Handlers) PosterHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	name, sum, ok := h.storedChecksum(w, r)
+	if !ok {
+		return
+	}
+	preview, ok := h.videos.Get(sum)
+	if !ok || !preview.Poster {
+		h.render.Error(w, r, http.StatusNotFound, "file has no poster")
+		return
+	}
+	h.serveDerived(w, r, name, sum, h.videos.PosterPath(sum), "image/jpeg", "")
+}
+
+// storedChecksum returns the name and checksum of the stored file named in the request path,
+// for serving something derived from its content. It answers the request itself, and reports
+// false, if the file cannot be read by the client or does not exist.
+func (h *Handlers) storedChecksum(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	name, err := cleanStoragePath(r.PathValue("name"))
+	if err != nil {
+		h.render.Error(w, r, http.StatusBadRequest, "invalid file name", err.Error())
+		return "", "", false
+	}
+	if h.hiddenFile(w, r, name) {
+		return "", "", false
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Read, name) {
+		h.denyAccess(w, r)
+		return "", "", false
+	}
+
+	root, err := h.storage.OpenRoot(name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			h.render.Error(w, r, http.StatusNotFound, "file is not found")
+			return "", "", false
+		}
+		h.logger.Printf("error root opening: %v\n", err)
+		h.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return "", "", false
+	}
+	defer root.Close()
+
+	file, err := h.openStored(root, name)
+	if err != nil {
+		status := openErrorStatus(err)
+		if status == http.StatusNotFound {
+			h.render.Error(w, r, status, "file is not found")
+		} else {
+			h.logger.Printf("error opening file '%s': %v\n", name, err)
+			h.render.Error(w, r, status, "unable to open file")
+		}
+		return "", "", false
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		h.logger.Printf("error reading file info for '%s': %v\n", name, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return "", "", false
+	}
+	if stat.IsDir() {
+		h.render.Error(w, r, http.StatusForbidden, "requested path is a directory")
+		return "", "", false
+	}
+
+	// Why go by the checksum? Something derived from a file that has since been replaced then
+	// goes unused, rather than being served for content it does not describe.
+	sum, err := h.checksum(r, name, file, stat)
+	if err != nil {
+		if r.Context().Err() == nil {
+			h.logger.Printf("error reading file '%s': %v\n", name, err)
+			h.render.Error(w, r, http.StatusInternalServerError, "unable to read file")
+		}
+		return "", "", false
+	}
+	return name, sum, true
+}
+
+// serveDerived serves the file at p, derived from the content of the stored file name whose
+// checksum is sum, as mediaType. With a disposition name, it is offered inline under that name.
+func (h *Handlers) serveDerived(w http.ResponseWriter, r *http.Request, name, sum, p, mediaType, dispositionName string) {
+	file, err := os.Open(p)
+	if err != nil {
+		h.logger.Printf("error opening %s derived from '%s': %v\n", p, name, err)
+		h.render.Error(w, r, openErrorStatus(err), "unable to open file")
+		return
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		h.logger.Printf("error reading file info for %s: %v\n", p, err)
+		h.render.Error(w, r, http.StatusInternalServerError, "unable to access file")
+		return
+	}
+
+	w.Header().Set("Content-Type", mediaType)
+	if dispositionName != "" {
+		w.Header().Set("Content-Disposition", contentDisposition("inline", dispositionName))
+	}
+	// Derived from the content alone, so the content's checksum identifies it.
+	w.Header().Set("ETag", `"`+sum+`"`)
+	if cc := h.cache.header(name); cc != "" {
+		w.Header().Set("Cache-Control", cc)
+	}
+	http.ServeContent(w, r, "", stat.ModTime(), file)
+}
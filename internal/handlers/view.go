@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
+)
+
+// isPDF reports whether name is viewed as a PDF document, going by its extension.
+func isPDF(name string) bool {
+	return strings.EqualFold(path.Ext(name), ".pdf")
+}
+
+// ViewHandler serves a PDF document inline, so that the browser opens it in its PDF viewer
+// rather than saving it. Range requests are answered as for downloads, which lets viewers
+// show the first pages of a large document before the rest has arrived.
+//
+// Why PDFs only? Opened inline, a file is rendered by the browser on the server's origin.
+// A PDF is shown by the browser's sandboxed viewer, whereas an HTML or SVG file could run
+// scripts with access to everything the user can reach on the server.
+func (h *Handlers) ViewHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	fileName := r.PathValue("name")
+	if fileName == "" {
+		h.render.Error(w, r, http.StatusBadRequest, "file name is not indicated")
+		return
+	}
+	if !isPDF(fileName) {
+		h.render.Error(w, r, http.StatusUnsupportedMediaType, "file is not a PDF document")
+		return
+	}
+	h.sendFile(w, r, fileName, "application/pdf")
+}
+
+// pdfReader serves the reader page, which shows a PDF document with PDF.js.
+type pdfReader struct {
+	library string // URLs of the PDF.js module and its worker
+	worker  string
+	source  string // the origin PDF.js is loaded from, as a CSP source
+}
+
+// newPDFReader returns the reader for PDF.js at the configured URL, or nil if the reader
+// page is disabled.
+func newPDFReader(cfg config.ViewerConfig) *pdfReader {
+	if cfg.PDFJS == "" {
+		return nil
+	}
+	base := strings.TrimSuffix(cfg.PDFJS, "/") + "/"
+	rd := &pdfReader{library: base + "pdf.min.mjs", worker: base + "pdf.worker.min.mjs", source: "'self'"}
+	if u, err := url.Parse(base); err == nil && u.Host != "" {
+		rd.source = u.Scheme + "://" + u.Host
+	}
+	return rd
+}
+
+// readerPage shows a PDF document page by page. html/template escapes every value for where
+// it appears, the URLs in the script included.
+var readerPage = template.Must(template.New("reader").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}}</title>
+<style>
+body { margin: 0; background: #525659; font-family: system-ui, sans-serif; }
+header { position: sticky; top: 0; z-index: 1; display: flex; gap: 1rem; align-items: baseline; padding: .5rem 1rem; background: #323639; color: #eee; }
+header strong { overflow: hidden; text-overflow: ellipsis; white-space: nowrap; }
+header a { margin-left: auto; color: #8ab4f8; }
+main { display: flex; flex-direction: column; align-items: center; gap: .75rem; padding: .75rem; }
+canvas { background: #fff; box-shadow: 0 1px 4px rgba(0, 0, 0, .5); }
+</style>
+</head>
+<body>
+<header><strong>{{.Name}}</strong><span id="status">Loading…</span><a href="{{.Download}}">Download</a></header>
+<main id="pages"></main>
+<script type="module" nonce="{{.Nonce}}">
+const status = document.getElementById("status");
+const pages = document.getElementById("pages");
+try {
+	const pdfjs = await import({{.Library}});
+	pdfjs.GlobalWorkerOptions.workerSrc = {{.Worker}};
+	// PDF.js asks for the document in ranges, so the first pages show before the rest arrives.
+	const doc = await pdfjs.getDocument({url: {{.File}}, disableAutoFetch: true}).promise;
+	status.textContent = doc.numPages === 1 ? "1 page" : doc.numPages + " pages";
+
+	const first = await doc.getPage(1);
+	const width = Math.min(pages.clientWidth - 24, 1000);
+	const scale = width / first.getViewport({scale: 1}).width;
+	const ratio = window.devicePixelRatio || 1;
+	const draw = async canvas => {
+		const page = await doc.getPage(Number(canvas.dataset.page));
+		const viewport = page.getViewport({scale: scale});
+		canvas.width = Math.floor(viewport.width * ratio);
+		canvas.height = Math.floor(viewport.height * ratio);
+		canvas.style.width = Math.floor(viewport.width) + "px";
+		canvas.style.height = Math.floor(viewport.height) + "px";
+		await page.render({canvasContext: canvas.getContext("2d"), viewport: viewport, transform: [ratio, 0, 0, ratio, 0, 0]}).promise;
+	};
+	// Pages are drawn as they come near the screen, so a long document costs little until read.
+	const observer = new IntersectionObserver(entries => {
+		for (const entry of entries) {
+			if (entry.isIntersecting) {
+				observer.unobserve(entry.target);
+				draw(entry.target);
+			}
+		}
+	}, {rootMargin: "100% 0px"});
+	const size = first.getViewport({scale: scale});
+	for (let n = 1; n <= doc.numPages; n++) {
+		const canvas = document.createElement("canvas");
+		canvas.dataset.page = n;
+		canvas.style.width = Math.floor(size.width) + "px";
+		canvas.style.height = Math.floor(size.height) + "px";
+		pages.append(canvas);
+		observer.observe(canvas);
+	}
+} catch (err) {
+	status.textContent = "The document cannot be shown: " + err.message;
+}
+</script>
+</body>
+</html>
+`))
+
+// ReaderHandler serves a page that shows a PDF document with PDF.js, for browsers that have
+// no PDF viewer of their own, such as many mobile ones. The page fetches the document from
+// /view/, with the caller's own credentials.
+//
+// Why a nonce? The page's own script is inline, and the security headers allow no scripts at
+// all; the nonce lets that one script and PDF.js run, and nothing injected besides.
+func (h *Handlers) ReaderHandler(w http.ResponseWriter, r *http.Request) {
+	h.logger.Printf("received request from %s for %s\n", geoip.Client(r), r.URL.Path)
+	defer cleanupRequest(r)
+
+	fileName := r.PathValue("name")
+	if fileName == "" {
+		h.render.Error(w, r, http.StatusBadRequest, "file name is not indicated")
+		return
+	}
+	if !isPDF(fileName) {
+		h.render.Error(w, r, http.StatusUnsupportedMediaType, "file is not a PDF document")
+		return
+	}
+	if h.hiddenFile(w, r, fileName) {
+		return
+	}
+	if !h.acl.Allowed(principalFrom(r), acl.Read, fileName) {
+		h.denyAccess(w, r)
+		return
+	}
+
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	nonce := base64.RawURLEncoding.EncodeToString(buf)
+	src := h.reader.source
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; script-src 'nonce-"+nonce+"' "+src+"; worker-src blob: "+src+
+		"; connect-src 'self' "+src+"; img-src blob: data:; style-src 'unsafe-inline'; frame-ancestors 'none'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err := readerPage.Execute(w, struct {
+		Name, Download, File, Library, Worker, Nonce string
+	}{
+		Name:     path.Base(fileName),
+		Download: h.basePath + "/download/" + escapePath(fileName),
+		File:     h.basePath + "/view/" + escapePath(fileName),
+		Library:  h.reader.library,
+		Worker:   h.reader.worker,
+		Nonce:    nonce,
+	})
+	if err != nil {
+		h.logger.Printf("error writing reader page: %v\n", err)
+	}
+}
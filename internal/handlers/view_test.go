@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/acl"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+func TestNewPDFReader(t *testing.T) {
+	tests := []struct {
+		pdfjs   string
+		library string
+		source  string
+	}{
+		{"https://cdn.example.com/pdfjs/build/", "https://cdn.example.com/pdfjs/build/pdf.min.mjs", "https://cdn.example.com"},
+		{"https://cdn.example.com:8443/pdfjs/build", "https://cdn.example.com:8443/pdfjs/build/pdf.min.mjs", "https://cdn.example.com:8443"},
+		{"/static/pdfjs/build", "/static/pdfjs/build/pdf.min.mjs", "'self'"},
+	}
+	for _, tt := range tests {
+		rd := newPDFReader(config.ViewerConfig{PDFJS: tt.pdfjs})
+		if rd.library != tt.library || rd.source != tt.source {
+			t.Errorf("newPDFReader(%q) = %s from %s, want %s from %s", tt.pdfjs, rd.library, rd.source, tt.library, tt.source)
+		}
+	}
+	if newPDFReader(config.ViewerConfig{}) != nil {
+		t.Error("the reader page is enabled without PDF.js")
+	}
+}
+
+func TestReaderHandler(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	h := &Handlers{
+		logger:   logger,
+		render:   respond.NewRenderer(respond.FormatJSON, logger),
+		acl:      acl.New([]config.ACLRule{{Path: "/private", Read: []string{"user:boss"}}}),
+		hidden:   newHiddenPolicy(config.HiddenFilesConfig{Dotfiles: true}, "", ""),
+		reader:   newPDFReader(config.ViewerConfig{PDFJS: "https://cdn.example.com/pdfjs/build/"}),
+		basePath: "/files",
+	}
+	nonce := regexp.MustCompile(`<script type="module" nonce="([^"]+)">`)
+
+	tests := []struct {
+		desc   string
+		name   string
+		status int
+	}{
+		{"a PDF document", "reports/q3 <final>.pdf", http.StatusOK},
+		{"not a PDF document", "reports/q3.html", http.StatusUnsupportedMediaType},
+		{"a hidden document", ".trash/q3.pdf", http.StatusNotFound},
+		{"a document the caller cannot read", "private/q3.pdf", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/files/read/x", nil)
+			r.SetPathValue("name", tt.name)
+			w := httptest.NewRecorder()
+			h.ReaderHandler(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			page := w.Body.String()
+			m := nonce.FindStringSubmatch(page)
+			if m == nil {
+				t.Fatal("the page has no script with a nonce")
+			}
+			csp := w.Header().Get("Content-Security-Policy")
+			if !strings.Contains(csp, "script-src 'nonce-"+m[1]+"' https://cdn.example.com;") {
+				t.Errorf("Content-Security-Policy %q does not allow the page's script and PDF.js", csp)
+			}
+			for _, want := range []string{
+				`import("https://cdn.example.com/pdfjs/build/pdf.min.mjs")`,
+				`url: "/files/view/reports/q3%20%3Cfinal%3E.pdf"`,
+				`<title>q3 &lt;final&gt;.pdf</title>`,
+			} {
+				if !strings.Contains(page, want) {
+					t.Errorf("the page does not contain %s", want)
+				}
+			}
+		})
+	}
+}
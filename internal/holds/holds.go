@@ -0,0 +1,123 @@
+package holds
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// Hold records the flags set on one stored file.
+type Hold struct {
+	// Path is the file's path relative to the storage directory.
+	Path string `json:"path"`
+	// LegalHold preserves a file for litigation or an investigation.
+	LegalHold bool `json:"legalHold"`
+	// Locked protects a file for operational reasons (e.g. a release being published).
+	Locked    bool      `json:"locked"`
+	Reason    string    `json:"reason,omitempty"`
+	SetBy     string    `json:"setBy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Active reports whether any flag is set.
+func (h Hold) Active() bool {
+	return h.LegalHold || h.Locked
+}
+
+// Store persists the holds to a JSON file in the metadata directory.
+type Store struct {
+	mu      sync.RWMutex
+	storage storage.Storage // of the metadata directory
+	name    string
+	holds   map[string]Hold // keyed by path
+}
+
+// Open loads the hold store from the file name in st, the metadata directory.
+func Open(st storage.Storage, name string) (*Store, error) {
+	s := &Store{storage: st, name: name, holds: make(map[string]Hold)}
+	if err := jsonfile.LoadFrom(st, name, &s.holds); err != nil {
+		return nil, fmt.Errorf("loading holds from %s: %w", name, err)
+	}
+	if s.holds == nil {
+		s.holds = make(map[string]Hold)
+	}
+	return s, nil
+}
+
+// Get returns the hold on the file at name, if any flag is set.
+func (s *Store) Get(name string) (Hold, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	h, ok := s.holds[normalise(name)]
+	return h, ok
+}
+
+// Within returns a hold on name or on any file below it, so that operations on a whole
+// directory can be refused if they would affect a held file.
+func (s *Store) Within(name string) (Hold, bool) {
+	name = normalise(name)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if h, ok := s.holds[name]; ok {
+		return h, true
+	}
+	for p, h := range s.holds {
+		if strings.HasPrefix(p, name+"/") {
+			return h, true
+		}
+	}
+	return Hold{}, false
+}
+
+// Set stores h, replacing any previous flags on the same file. A hold with no flag set
+// removes the entry.
+func (s *Store) Set(h Hold) error {
+	h.Path = normalise(h.Path)
+	h.UpdatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, existed := s.holds[h.Path]
+	if h.Active() {
+		s.holds[h.Path] = h
+	} else {
+		delete(s.holds, h.Path)
+	}
+	if err := s.save(); err != nil {
+		if existed {
+			s.holds[h.Path] = old
+		} else {
+			delete(s.holds, h.Path)
+		}
+		return err
+	}
+	return nil
+}
+
+// List returns all holds, sorted by path.
+func (s *Store) List() []Hold {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Hold, 0, len(s.holds))
+	for _, h := range s.holds {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	return list
+}
+
+// save writes the holds to the metadata directory. The caller must hold the write lock.
+func (s *Store) save() error {
+	return jsonfile.SaveTo(s.storage, s.name, s.holds)
+}
+
+// normalise turns a storage-relative path into the store's key form, without a leading slash.
+func normalise(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,58 @@
+package holds
+
+import (
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage/memfs"
+)
+
+func TestStore(t *testing.T) {
+	meta := memfs.New().Dir("metadata")
+	s, err := Open(meta, "holds.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(Hold{Path: "/docs//report.pdf", LegalHold: true, Reason: "case 42", SetBy: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(Hold{Path: "releases/v1.zip", Locked: true, SetBy: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc       string
+		name       string
+		wantGet    bool
+		wantWithin string // the path of the hold found, or "" for none
+	}{
+		{"a held file, named as stored", "docs/report.pdf", true, "docs/report.pdf"},
+		{"a held file, named otherwise", "./docs/../docs/report.pdf", true, "docs/report.pdf"},
+		{"the directory holding it", "docs", false, "docs/report.pdf"},
+		{"a directory sharing its prefix", "doc", false, ""},
+		{"a file beside it", "docs/other.pdf", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if _, ok := s.Get(tt.name); ok != tt.wantGet {
+				t.Errorf("Get = %v, want %v", ok, tt.wantGet)
+			}
+			h, ok := s.Within(tt.name)
+			if ok != (tt.wantWithin != "") || h.Path != tt.wantWithin {
+				t.Errorf("Within = %q, %v, want %q", h.Path, ok, tt.wantWithin)
+			}
+		})
+	}
+
+	// Clearing every flag removes the hold; the rest outlasts a restart.
+	if err := s.Set(Hold{Path: "releases/v1.zip", SetBy: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open(meta, "holds.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := s.List()
+	if len(list) != 1 || list[0].Path != "docs/report.pdf" || !list[0].LegalHold || list[0].Reason != "case 42" || list[0].UpdatedAt.IsZero() {
+		t.Errorf("got %+v, want the legal hold on docs/report.pdf", list)
+	}
+}
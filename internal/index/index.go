@@ -0,0 +1,222 @@
+package index
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// Index is an in-memory list of the files in the storage directory.
+//
+// Why keep one? Walking a directory with 100k files on every listing request is slow and
+// hammers the disk. The index is built once at start-up, kept current by the handlers as
+// they add and remove files, and periodically rebuilt to pick up changes made behind the
+// server's back (e.g. files copied in by hand).
+type Index struct {
+	mu      sync.RWMutex
+	storage storage.Storage
+	files   map[string]struct{} // storage-relative, slash-separated paths
+	sorted  []string            // cached result of List; nil when stale
+	logger  *log.Logger
+
+	// scanning is set whilst a scan walks the directory; the names the server adds, removes
+	// or renames meanwhile are collected in touched, as the walk may not have seen the change.
+	scanning bool
+	touched  []string
+	// busy reports whether the server itself is still writing a file; see Watch.
+	busy func(name string) bool
+	// skipSymlinks leaves symbolic links out of the index.
+	skipSymlinks bool
+	// scanMu serialises scans, which may be asked for whilst a scheduled one runs.
+	scanMu sync.Mutex
+
+	// stop is closed by Close, to end the rescans and change notifications started by Watch.
+	stop     chan struct{}
+	watchers []io.Closer
+	wg       sync.WaitGroup
+}
+
+// New creates an index of the files stored in st and performs the initial scan, leaving symbolic links out if
+// skipSymlinks is set. A scan failure is logged rather than returned, so the server can still
+// start; the next rescan may succeed.
+//
+// Links to directories are indexed as entries of their own either way, never descended into,
+// so that a link pointing above itself cannot send a scan round in circles.
+func New(st storage.Storage, skipSymlinks bool, logger *log.Logger) *Index {
+	idx := &Index{storage: st, files: make(map[string]struct{}), logger: logger, skipSymlinks: skipSymlinks, stop: make(chan struct{})}
+	if err := idx.Rescan(); err != nil {
+		logger.Printf("error indexing storage directory: %v\n", err)
+	}
+	return idx
+}
+
+// Rescan rebuilds the index from disk. A storage directory that does not exist yet is
+// indexed as empty.
+func (idx *Index) Rescan() error {
+	_, _, err := idx.Reconcile()
+	return err
+}
+
+// Reconcile rebuilds the index from disk and reports the files that were added and removed
+// other than through the server, such as by rsync or a cron job.
+//
+// Why not block uploads during the walk? On a large directory it takes a while. Instead,
+// names the server changes whilst it runs keep their in-memory state, so the walk never
+// reports (or undoes) a change the server has just made.
+func (idx *Index) Reconcile() (added, removed []string, err error) {
+	idx.scanMu.Lock()
+	defer idx.scanMu.Unlock()
+	idx.mu.Lock()
+	idx.scanning = true
+	idx.mu.Unlock()
+	defer func() {
+		idx.mu.Lock()
+		idx.scanning, idx.touched = false, nil
+		idx.mu.Unlock()
+	}()
+
+	files := make(map[string]struct{})
+	err = idx.storage.Walk(func(name string, d fs.DirEntry) error {
+		if idx.skipSymlinks && d.Type()&fs.ModeSymlink != 0 {
+			return nil
+		}
+		files[name] = struct{}{}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for f := range files {
+		// Files the server is still writing are added by the server once they are complete.
+		if idx.touchedLocked(f) || (idx.busy != nil && idx.busy(f)) {
+			delete(files, f)
+		}
+	}
+	for f := range idx.files {
+		if idx.touchedLocked(f) {
+			files[f] = struct{}{}
+		} else if _, ok := files[f]; !ok {
+			removed = append(removed, f)
+		}
+	}
+	for f := range files {
+		if _, ok := idx.files[f]; !ok {
+			added = append(added, f)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	idx.files = files
+	idx.sorted = nil
+	return added, removed, nil
+}
+
+// touchLocked records that the server changed name (and anything below it) during a scan.
+// The caller must hold the write lock.
+func (idx *Index) touchLocked(name string) {
+	if idx.scanning {
+		idx.touched = append(idx.touched, name)
+	}
+}
+
+// touchedLocked reports whether name, or a directory above it, was changed by the server
+// during the current scan. The caller must hold the write lock.
+func (idx *Index) touchedLocked(name string) bool {
+	for _, t := range idx.touched {
+		if name == t || strings.HasPrefix(name, t+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Add records that the file name now exists.
+func (idx *Index) Add(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.touchLocked(name)
+	if _, ok := idx.files[name]; !ok {
+		idx.files[name] = struct{}{}
+		idx.sorted = nil
+	}
+}
+
+// Remove forgets name and, if it was a directory, everything below it.
+func (idx *Index) Remove(name string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.touchLocked(name)
+	idx.removeLocked(name)
+}
+
+// Rename moves name, or everything below it if it is a directory, to newName.
+func (idx *Index) Rename(name, newName string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.touchLocked(name)
+	idx.touchLocked(newName)
+	if _, ok := idx.files[name]; ok {
+		delete(idx.files, name)
+		idx.files[newName] = struct{}{}
+		idx.sorted = nil
+		return
+	}
+	// Collected first, as adding keys to a map whilst ranging over it may revisit them.
+	var moved []string
+	for f := range idx.files {
+		if strings.HasPrefix(f, name+"/") {
+			moved = append(moved, f)
+		}
+	}
+	for _, f := range moved {
+		delete(idx.files, f)
+		idx.files[newName+strings.TrimPrefix(f, name)] = struct{}{}
+		idx.sorted = nil
+	}
+}
+
+// List returns the indexed file names in lexical order. The caller must not modify the result.
+func (idx *Index) List() []string {
+	idx.mu.RLock()
+	sorted := idx.sorted
+	idx.mu.RUnlock()
+	if sorted != nil {
+		return sorted
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.sorted == nil {
+		idx.sorted = make([]string, 0, len(idx.files))
+		for f := range idx.files {
+			idx.sorted = append(idx.sorted, f)
+		}
+		sort.Strings(idx.sorted)
+	}
+	return idx.sorted
+}
+
+// removeLocked deletes name and its descendants. The caller must hold the write lock.
+func (idx *Index) removeLocked(name string) {
+	// Why check for an exact match first? Removing a single file is the common case, and
+	// it then costs a map lookup rather than a scan of the whole index.
+	if _, ok := idx.files[name]; ok {
+		delete(idx.files, name)
+		idx.sorted = nil
+		return
+	}
+	for f := range idx.files {
+		if strings.HasPrefix(f, name+"/") {
+			delete(idx.files, f)
+			idx.sorted = nil
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package index
+
+import (
+	"errors"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// Timing of rescans triggered by change notifications. Why wait for a quiet period? A tool
+// such as rsync copying a tree produces a burst of notifications, and one rescan after the
+// burst sees its result; the maximum delay keeps a file that is written continuously (e.g.
+// a log) from postponing the rescan forever.
+const (
+	settleDelay = 2 * time.Second
+	maxDelay    = 30 * time.Second
+)
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	// Interval is the time between full rescans; zero disables them.
+	Interval time.Duration
+	// Notify also rescans shortly after the operating system reports a change in the
+	// storage directory (Linux only).
+	Notify bool
+	// Busy reports whether the server itself is writing a file. Such files are left to the
+	// server to add once complete, so they are never reported as added from outside.
+	Busy func(name string) bool
+	// Changed, if not nil, receives the files added and removed outside the server.
+	Changed func(added, removed []string)
+}
+
+// Watch keeps the index in step with changes made outside the server, such as files copied
+// in by rsync or removed by a cron job, until the index is closed.
+func (idx *Index) Watch(opts WatchOptions) {
+	idx.mu.Lock()
+	idx.busy = opts.Busy
+	idx.mu.Unlock()
+
+	var notified chan struct{}
+	if opts.Notify {
+		notified = make(chan struct{}, 1)
+		changed := func() {
+			select {
+			case notified <- struct{}{}:
+			default:
+			}
+		}
+		// Files kept elsewhere than on disk change only through the server, which indexes
+		// them as it goes.
+		var dirs []string
+		if disk, ok := idx.storage.(storage.Disk); ok {
+			dirs = disk.Dirs()
+		}
+		for _, dir := range dirs {
+			w, err := watchDir(dir, changed, idx.logger)
+			if errors.Is(err, errors.ErrUnsupported) {
+				idx.logger.Printf("change notifications are not supported on this platform, relying on periodic rescans\n")
+				break
+			}
+			if err != nil {
+				idx.logger.Printf("error watching %s, relying on periodic rescans: %v\n", dir, err)
+				continue
+			}
+			idx.watchers = append(idx.watchers, w)
+		}
+	}
+	if opts.Interval <= 0 && notified == nil {
+		return
+	}
+
+	idx.wg.Go(func() {
+		var tick <-chan time.Time
+		if opts.Interval > 0 {
+			ticker := time.NewTicker(opts.Interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		settle := time.NewTimer(settleDelay)
+		settle.Stop()
+		var first time.Time // of the notifications not yet acted on; zero if none
+		for {
+			select {
+			case <-idx.stop:
+				return
+			case <-tick:
+			case <-notified:
+				now := time.Now()
+				if first.IsZero() {
+					first = now
+				}
+				settle.Reset(min(settleDelay, first.Add(maxDelay).Sub(now)))
+				continue
+			case <-settle.C:
+			}
+			first = time.Time{}
+
+			added, removed, err := idx.Reconcile()
+			if err != nil {
+				idx.logger.Printf("error rescanning storage directory: %v\n", err)
+				continue
+			}
+			if len(added) > 0 || len(removed) > 0 {
+				idx.logger.Printf("storage directory changed outside the server: %d files added, %d removed\n", len(added), len(removed))
+				if opts.Changed != nil {
+					opts.Changed(added, removed)
+				}
+			}
+		}
+	})
+}
+
+// Close stops the rescans and change notifications started by Watch, waiting for a rescan in
+// progress to finish. The index can still be used, but no longer follows outside changes.
+func (idx *Index) Close() {
+	close(idx.stop)
+	for _, w := range idx.watchers {
+		w.Close()
+	}
+	idx.wg.Wait()
+}
@@ -0,0 +1,158 @@
+//go:build linux
+
+package index
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// watchMask selects the inotify events that can change which files exist. Plain writes are
+// left out: they do not add or remove files, and a large copy would produce thousands.
+const watchMask = unix.IN_CREATE | unix.IN_CLOSE_WRITE | unix.IN_DELETE | unix.IN_MOVED_FROM |
+	unix.IN_MOVED_TO | unix.IN_ONLYDIR
+
+// watchDir calls changed whenever something is created, deleted or moved in dir or any
+// directory below it, using inotify, until the returned watcher is closed.
+//
+// Why not stop at the first directory that cannot be watched (e.g. the per-user watch limit
+// has been reached)? Changes elsewhere are still reported, and the periodic rescan catches
+// the rest.
+func watchDir(dir string, changed func(), logger *log.Logger) (io.Closer, error) {
+	// Why non-blocking? The file is then read through the runtime's poller, and closing it
+	// wakes the read that waits for events, which would otherwise block until the next one.
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), "inotify")
+	conn, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w := &inotifyWatcher{file: f, conn: conn, dirs: map[int]string{}, logger: logger, done: make(chan struct{})}
+	// The storage directory is otherwise created by the first upload, too late to watch it.
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := w.addTree(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	go w.run(changed)
+	return w, nil
+}
+
+type inotifyWatcher struct {
+	file   *os.File
+	conn   syscall.RawConn // of file, to add watches without racing Close
+	mu     sync.Mutex
+	dirs   map[int]string // watched directories by watch descriptor
+	logger *log.Logger
+	done   chan struct{} // closed once run returns
+}
+
+// Close stops watching, and waits for the events read already to be handled.
+func (w *inotifyWatcher) Close() error {
+	err := w.file.Close()
+	<-w.done
+	return err
+}
+
+// addWatch watches the directory path, returning its watch descriptor.
+func (w *inotifyWatcher) addWatch(path string) (int, error) {
+	var wd int
+	var err error
+	if ctrlErr := w.conn.Control(func(fd uintptr) {
+		wd, err = unix.InotifyAddWatch(int(fd), path, watchMask)
+	}); ctrlErr != nil {
+		return 0, ctrlErr
+	}
+	return wd, err
+}
+
+// addTree watches root and every directory below it. Only a failure to watch root is returned.
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		wd, err := w.addWatch(path)
+		if err != nil {
+			if path == root {
+				return err
+			}
+			w.logger.Printf("error watching directory '%s': %v\n", path, err)
+			return fs.SkipDir
+		}
+		w.mu.Lock()
+		w.dirs[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+// run reads events until the watcher is closed.
+func (w *inotifyWatcher) run(changed func()) {
+	defer close(w.done)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.logger.Printf("error reading change notifications, relying on periodic rescans: %v\n", err)
+			}
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameLen := int(ev.Len)
+			name := ""
+			if nameLen > 0 && off+unix.SizeofInotifyEvent+nameLen <= n {
+				raw := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+nameLen]
+				name = string(raw[:clen(raw)])
+			}
+			off += unix.SizeofInotifyEvent + nameLen
+
+			w.mu.Lock()
+			dir, known := w.dirs[int(ev.Wd)]
+			if ev.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(ev.Wd))
+			}
+			w.mu.Unlock()
+			// A directory created or moved in must be watched too, along with anything
+			// already inside it by the time the watch is added.
+			if known && ev.Mask&unix.IN_ISDIR != 0 && ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				w.addTree(filepath.Join(dir, name))
+			}
+		}
+		changed()
+	}
+}
+
+// clen returns the length of the NUL-padded name in b.
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+	return len(b)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package index
+
+import (
+	"errors"
+	"io"
+	"log"
+)
+
+// watchDir is only implemented on Linux; elsewhere the index relies on periodic rescans.
+func watchDir(dir string, changed func(), logger *log.Logger) (io.Closer, error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,397 @@
+// Package jobs processes uploaded files in the background, so that an upload can be answered
+// as soon as its files have been received, whilst scanning and storing them continues.
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+)
+
+// Job statuses.
+const (
+	Queued  = "queued"
+	Running = "running"
+	Done    = "done"
+)
+
+// File statuses.
+const (
+	Pending  = "pending"
+	Stored   = "stored"
+	Rejected = "rejected"
+	Failed   = "failed"
+)
+
+// keepFinished is how long a finished job can still be looked up.
+const keepFinished = 24 * time.Hour
+
+// File is one file of a job.
+type File struct {
+	// Name is the path the file is stored at, relative to the storage directory.
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// ContentDigest is the Content-Digest header the client sent with the file, if any.
+	ContentDigest string `json:"contentDigest,omitempty"`
+	// Modified is the modification time the client asked the file to be given, if any.
+	Modified time.Time `json:"modified,omitzero"`
+	Status   string    `json:"status"`
+	SHA256   string    `json:"sha256,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// Job is one upload whose files are processed in the background.
+type Job struct {
+	ID       string     `json:"id"`
+	Status   string     `json:"status"`
+	User     string     `json:"user"`
+	Created  time.Time  `json:"created"`
+	Started  *time.Time `json:"started,omitempty"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// CreateOnly stores files only if they do not exist yet, as with If-None-Match: *.
+	CreateOnly bool `json:"createOnly,omitempty"`
+	// Fields holds the form fields kept with the files, as set by uploader.metadataFields.
+	Fields map[string]string `json:"fields,omitempty"`
+	Files  []File            `json:"files"`
+	// Errors describes the files of the upload that were refused before the job was created,
+	// e.g. for lack of permission.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// clone returns a copy of j that shares nothing with it.
+func (j *Job) clone() Job {
+	c := *j
+	c.Fields = maps.Clone(j.Fields)
+	c.Files = append([]File(nil), j.Files...)
+	c.Errors = append([]string(nil), j.Errors...)
+	return c
+}
+
+// Processor processes one pending file of a job, whose content is staged in content, and
+// returns the file with its outcome filled in. It should give up once ctx is done, which it is
+// when the job runs out of time.
+type Processor func(ctx context.Context, job Job, file File, content *os.File) File
+
+// Observer is told about the queue, for metrics.
+type Observer interface {
+	// SetQueuedJobs reports the number of jobs waiting for a worker.
+	SetQueuedJobs(n int64)
+	// ObserveJob reports a finished job: how long it waited for a worker, and how long it then
+	// took to process.
+	ObserveJob(wait, duration time.Duration)
+}
+
+// ErrQueueFull is returned by Submit when as many jobs as the queue holds are waiting already.
+var ErrQueueFull = errors.New("job queue is full")
+
+// Queue runs jobs on a pool of workers. The jobs are kept in a JSON file, and the files they
+// process in a staging directory, so that a restart resumes the jobs it interrupted.
+//
+// Why a fixed pool of workers? Scanning and storing files competes with request handling for
+// CPU and disk, so however many uploads arrive, no more than that many jobs run at once.
+type Queue struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	path     string
+	dir      string
+	workers  int
+	depth    int
+	timeout  time.Duration
+	jobs     map[string]*Job
+	pending  []string // IDs of queued jobs, oldest first
+	process  Processor
+	observer Observer
+	logger   *log.Logger
+
+	// ctx is cancelled by Close, interrupting the jobs running; closed is set with it.
+	ctx    context.Context
+	cancel context.CancelFunc
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Open loads the jobs from path, for files staged in dir, to be run as configured by cfg.
+func Open(path, dir string, cfg config.ProcessingConfig, logger *log.Logger) (*Queue, error) {
+	if cfg.Workers <= 0 {
+		return nil, errors.New("processing.workers must be positive")
+	}
+	q := &Queue{
+		path:    path,
+		dir:     dir,
+		workers: cfg.Workers,
+		depth:   cfg.QueueDepth,
+		timeout: cfg.JobTimeout,
+		jobs:    make(map[string]*Job),
+		logger:  logger,
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+	q.cond = sync.NewCond(&q.mu)
+	if err := jsonfile.Load(path, &q.jobs); err != nil {
+		return nil, fmt.Errorf("loading jobs from %s: %w", path, err)
+	}
+	if q.jobs == nil {
+		q.jobs = make(map[string]*Job)
+	}
+	return q, nil
+}
+
+// Start starts the workers, which process each file with process. Jobs interrupted by a
+// restart are queued again, and carry on with the files they had not finished.
+func (q *Queue) Start(process Processor) {
+	q.mu.Lock()
+	q.process = process
+	var unfinished []*Job
+	for _, job := range q.jobs {
+		if job.Status != Done {
+			unfinished = append(unfinished, job)
+		}
+	}
+	sort.Slice(unfinished, func(i, j int) bool { return unfinished[i].Created.Before(unfinished[j].Created) })
+	for _, job := range unfinished {
+		job.Status = Queued
+		q.pending = append(q.pending, job.ID)
+	}
+	q.setQueued()
+	q.mu.Unlock()
+	for range q.workers {
+		q.wg.Go(q.work)
+	}
+}
+
+// Close stops the workers, interrupting the jobs they run, and waits for them to return.
+// The files of an interrupted job that were not processed stay staged, and the job carries on
+// with them when the queue is next started.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.cancel()
+	q.wg.Wait()
+}
+
+// Observe reports the queue length and finished jobs to obs from now on.
+func (q *Queue) Observe(obs Observer) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.observer = obs
+	q.setQueued()
+}
+
+// setQueued reports the queue length to the observer, if any. The caller must hold the lock.
+func (q *Queue) setQueued() {
+	if q.observer != nil {
+		q.observer.SetQueuedJobs(int64(len(q.pending)))
+	}
+}
+
+// New returns a new job for user, whose files can then be staged with Stage.
+func (q *Queue) New(user string, createOnly bool) *Job {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &Job{
+		ID:         hex.EncodeToString(id),
+		Status:     Queued,
+		User:       user,
+		Created:    time.Now().UTC(),
+		CreateOnly: createOnly,
+		Files:      []File{},
+	}
+}
+
+// Stage copies content into the staging directory as the next file of job, to be processed
+// once the job is submitted. A file that is not Pending is only reported, never processed.
+func (q *Queue) Stage(job *Job, file File, content io.Reader) error {
+	if file.Status == "" {
+		file.Status = Pending
+	}
+	if file.Status == Pending {
+		// Why 0700 and 0600? Staged files have not been checked yet, like quarantined ones.
+		if err := os.MkdirAll(q.jobDir(job.ID), 0700); err != nil {
+			return err
+		}
+		dst, err := os.OpenFile(q.file(job.ID, len(job.Files)), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		file.Size, err = io.Copy(dst, content)
+		if closeErr := dst.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(q.file(job.ID, len(job.Files)))
+			return err
+		}
+	}
+	job.Files = append(job.Files, file)
+	return nil
+}
+
+// Submit queues a copy of job for processing, unless the queue is full.
+//
+// Why a copy? The worker updates the queued job as it runs, whilst the caller still answers
+// the upload with job.
+func (q *Queue) Submit(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.depth > 0 && len(q.pending) >= q.depth {
+		return ErrQueueFull
+	}
+	queued := job.clone()
+	q.jobs[job.ID] = &queued
+	if err := q.save(); err != nil {
+		delete(q.jobs, job.ID)
+		return err
+	}
+	q.pending = append(q.pending, job.ID)
+	q.setQueued()
+	q.cond.Signal()
+	return nil
+}
+
+// Discard removes the staged files of a job that is not going to be submitted.
+func (q *Queue) Discard(job *Job) {
+	os.RemoveAll(q.jobDir(job.ID))
+}
+
+// Get returns a copy of the job with the given ID.
+func (q *Queue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return job.clone(), true
+}
+
+// work processes queued jobs, one at a time, until the queue is closed.
+func (q *Queue) work() {
+	for {
+		q.mu.Lock()
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		id := q.pending[0]
+		q.pending = q.pending[1:]
+		q.setQueued()
+		job, ok := q.jobs[id]
+		if !ok {
+			q.mu.Unlock()
+			continue
+		}
+		now := time.Now().UTC()
+		job.Status = Running
+		job.Started = &now
+		snapshot := job.clone()
+		q.saveLogged()
+		q.mu.Unlock()
+
+		ctx, cancel := q.ctx, context.CancelFunc(func() {})
+		if q.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, q.timeout)
+		}
+		q.run(ctx, snapshot)
+		cancel()
+	}
+}
+
+// run processes the pending files of job, recording the outcome of each as it goes. Once ctx
+// is done, the files left are failed rather than processed, unless the queue was closed: the
+// job is then left unfinished, to carry on after a restart.
+func (q *Queue) run(ctx context.Context, job Job) {
+	for i, file := range job.Files {
+		if file.Status != Pending {
+			continue
+		}
+		if q.ctx.Err() != nil {
+			return
+		}
+		if ctx.Err() != nil {
+			file.Status = Failed
+			file.Error = "job timed out"
+		} else if content, err := os.Open(q.file(job.ID, i)); err != nil {
+			file.Status = Failed
+			file.Error = "staged file is missing"
+			q.logger.Printf("error opening file %d of job %s: %v\n", i, job.ID, err)
+		} else {
+			file = q.process(ctx, job, file, content)
+			content.Close()
+			// Why not record the failure? It is the shutdown's, not the file's, and the file
+			// is processed again after the restart.
+			if q.ctx.Err() != nil && file.Status != Stored {
+				return
+			}
+		}
+		q.mu.Lock()
+		q.jobs[job.ID].Files[i] = file
+		q.saveLogged()
+		q.mu.Unlock()
+		// Removed only once the outcome is saved, so a restart in between processes the
+		// file again rather than losing it.
+		os.Remove(q.file(job.ID, i))
+	}
+	os.RemoveAll(q.jobDir(job.ID))
+
+	if ctx.Err() != nil {
+		q.logger.Printf("job %s timed out after %s\n", job.ID, q.timeout)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now().UTC()
+	q.jobs[job.ID].Status = Done
+	q.jobs[job.ID].Finished = &now
+	q.saveLogged()
+	if q.observer != nil {
+		q.observer.ObserveJob(job.Started.Sub(job.Created), now.Sub(*job.Started))
+	}
+}
+
+// jobDir returns the staging directory of the job with the given ID.
+func (q *Queue) jobDir(id string) string {
+	return filepath.Join(q.dir, id)
+}
+
+// file returns the path of the i-th staged file of the job with the given ID.
+func (q *Queue) file(id string, i int) string {
+	return filepath.Join(q.jobDir(id), strconv.Itoa(i))
+}
+
+// save drops the jobs finished more than keepFinished ago, and writes the rest to disk. The
+// caller must hold the lock.
+func (q *Queue) save() error {
+	cutoff := time.Now().Add(-keepFinished)
+	for id, job := range q.jobs {
+		if job.Finished != nil && job.Finished.Before(cutoff) {
+			delete(q.jobs, id)
+		}
+	}
+	return jsonfile.Save(q.path, q.jobs)
+}
+
+// saveLogged saves the jobs, logging rather than returning a failure, for the workers, which
+// carry on regardless. The caller must hold the lock.
+func (q *Queue) saveLogged() {
+	if err := q.save(); err != nil {
+		q.logger.Printf("error saving jobs: %v\n", err)
+	}
+}
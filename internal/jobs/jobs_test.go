@@ -0,0 +1,218 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// TestSubmitCopiesJob checks that the worker running a job leaves the submitted one, which
+// the caller still holds, untouched.
+func TestSubmitCopiesJob(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(filepath.Join(dir, "jobs.json"), filepath.Join(dir, "staging"), config.Default().Processing, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	q.Start(func(ctx context.Context, job Job, file File, content *os.File) File {
+		close(started)
+		<-release
+		file.Status = Stored
+		return file
+	})
+	defer q.Close()
+
+	job := q.New("alice", false)
+	if err := q.Stage(job, File{Name: "a.txt"}, strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Submit(job); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if running, _ := q.Get(job.ID); running.Status != Running {
+		t.Errorf("queued job is %s, want %s", running.Status, Running)
+	}
+	if job.Status != Queued || job.Started != nil {
+		t.Errorf("submitted job was changed to %s", job.Status)
+	}
+	close(release)
+}
+
+// openTestQueue opens a queue in a temporary directory, configured by cfg.
+func openTestQueue(t *testing.T, cfg config.ProcessingConfig) *Queue {
+	t.Helper()
+	dir := t.TempDir()
+	q, err := Open(filepath.Join(dir, "jobs.json"), filepath.Join(dir, "staging"), cfg, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+// submit stages a file of the given name as a new job for q, and submits it.
+func submit(t *testing.T, q *Queue, name string) (*Job, error) {
+	t.Helper()
+	job := q.New("alice", false)
+	if err := q.Stage(job, File{Name: name}, strings.NewReader(name)); err != nil {
+		t.Fatal(err)
+	}
+	return job, q.Submit(job)
+}
+
+// wait returns the job with the given ID once it is done.
+func wait(t *testing.T, q *Queue, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if job, _ := q.Get(id); job.Status == Done {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("job %s not done", id)
+	return Job{}
+}
+
+// observer records what a queue reports.
+type observer struct {
+	mu     sync.Mutex
+	queued []int64
+	jobs   int
+}
+
+func (o *observer) SetQueuedJobs(n int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.queued = append(o.queued, n)
+}
+
+func (o *observer) ObserveJob(wait, duration time.Duration) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.jobs++
+}
+
+// TestWorkers checks that no more jobs run at once than there are workers, and that the
+// queue length and finished jobs are reported.
+func TestWorkers(t *testing.T) {
+	cfg := config.Default().Processing
+	cfg.Workers = 2
+	q := openTestQueue(t, cfg)
+	obs := &observer{}
+	q.Observe(obs)
+	var mu sync.Mutex
+	running, most := 0, 0
+	q.Start(func(ctx context.Context, job Job, file File, content *os.File) File {
+		mu.Lock()
+		running++
+		most = max(most, running)
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		file.Status = Stored
+		return file
+	})
+	defer q.Close()
+
+	var ids []string
+	for _, name := range []string{"a.txt", "b.txt", "c.txt", "d.txt", "e.txt"} {
+		job, err := submit(t, q, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, job.ID)
+	}
+	for _, id := range ids {
+		if job := wait(t, q, id); job.Files[0].Status != Stored {
+			t.Errorf("job %s: file is %s, want %s", id, job.Files[0].Status, Stored)
+		}
+	}
+	if most != 2 {
+		t.Errorf("%d jobs ran at once, want 2", most)
+	}
+	obs.mu.Lock()
+	defer obs.mu.Unlock()
+	if obs.jobs != 5 || len(obs.queued) == 0 || obs.queued[len(obs.queued)-1] != 0 {
+		t.Errorf("observed %d jobs and queue lengths %v, want 5 jobs and an empty queue", obs.jobs, obs.queued)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	cfg := config.Default().Processing
+	cfg.Workers, cfg.QueueDepth = 1, 1
+	q := openTestQueue(t, cfg)
+	started, release := make(chan struct{}, 3), make(chan struct{})
+	q.Start(func(ctx context.Context, job Job, file File, content *os.File) File {
+		started <- struct{}{}
+		<-release
+		file.Status = Stored
+		return file
+	})
+	defer q.Close()
+
+	// One job runs, and one waits for the worker.
+	running, err := submit(t, q, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if _, err := submit(t, q, "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := submit(t, q, "c.txt"); !errors.Is(err, ErrQueueFull) {
+		t.Errorf("got %v, want ErrQueueFull", err)
+	}
+	close(release)
+	wait(t, q, running.ID)
+	if _, err := submit(t, q, "c.txt"); err != nil {
+		t.Errorf("once the queue has room: %v", err)
+	}
+}
+
+// TestJobTimeout checks that a job running out of time has its remaining files failed.
+func TestJobTimeout(t *testing.T) {
+	cfg := config.Default().Processing
+	cfg.JobTimeout = 50 * time.Millisecond
+	q := openTestQueue(t, cfg)
+	q.Start(func(ctx context.Context, job Job, file File, content *os.File) File {
+		<-ctx.Done()
+		file.Status, file.Error = Failed, ctx.Err().Error()
+		return file
+	})
+	defer q.Close()
+
+	job := q.New("alice", false)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		if err := q.Stage(job, File{Name: name}, strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Submit(job); err != nil {
+		t.Fatal(err)
+	}
+	done := wait(t, q, job.ID)
+	if done.Files[0].Status != Failed || done.Files[1].Status != Failed || done.Files[1].Error != "job timed out" {
+		t.Errorf("got files %+v, want both failed", done.Files)
+	}
+}
+
+func TestOpenWithoutWorkers(t *testing.T) {
+	cfg := config.Default().Processing
+	cfg.Workers = 0
+	if _, err := Open(filepath.Join(t.TempDir(), "jobs.json"), t.TempDir(), cfg, nil); err == nil {
+		t.Error("opened a queue without workers")
+	}
+}
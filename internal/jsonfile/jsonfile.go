@@ -0,0 +1,125 @@
+package jsonfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// Load decodes the JSON document stored at path into v.
+// A missing file is not an error: v is left untouched so callers can start from an empty state.
+func Load(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Save encodes v as JSON and writes it to path atomically.
+//
+// Why write to a temporary file first? A crash or full disk midway through a direct write
+// would leave a truncated, unparseable document. Renaming the completed temporary file over
+// the old one means readers only ever see the previous or the new version.
+func Save(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	// Remove is a no-op once the rename has succeeded.
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	// Why Sync? The rename must not become durable before the data it points to.
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// Files written here may hold secrets (password hashes, session tokens), so keep them private.
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFrom decodes the JSON document stored as name in st into v, as Load does for a path.
+// A missing document, or a missing directory to hold it, is not an error.
+func LoadFrom(st storage.Storage, name string, v any) error {
+	data, err := storage.ReadFile(st, name)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// SaveTo encodes v as JSON and writes it as name in st atomically, as Save does for a path,
+// so that a store can be kept wherever st keeps its files, such as in memory for tests.
+func SaveTo(st storage.Storage, name string, v any) error {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	root, err := st.OpenRoot(name)
+	if err != nil {
+		return err
+	}
+	defer root.Close()
+	if dir := path.Dir(name); dir != "." {
+		if err := root.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	tmpName := name + "." + hex.EncodeToString(suffix) + ".tmp"
+	// Created private from the start, as files written here may hold secrets.
+	tmp, err := root.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	// Remove is a no-op once the rename has succeeded.
+	defer root.Remove(tmpName)
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return root.Rename(tmpName, name)
+}
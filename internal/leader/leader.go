@@ -0,0 +1,131 @@
+// Package leader elects, among the instances that share one storage directory, the one that
+// runs the scheduled jobs about it, so that they run once rather than once per instance.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/coord"
+)
+
+// lockKey is the coordination lock held by the leader.
+const lockKey = "leader"
+
+// Elector tells whether this instance is the leader. A nil Elector, as without election,
+// always is.
+type Elector struct {
+	leading atomic.Bool
+	// campaign tries to become, or to remain, the leader.
+	campaign func() (bool, error)
+	// resign gives up what campaign took, if it outlives the elector; nil if it does not.
+	resign func() error
+	logger *log.Logger
+	stop   chan struct{} // closed by Close
+	done   chan struct{} // closed once campaigning stops
+}
+
+// New starts the election configured by cfg, in backend for the coordination election, or
+// returns nil if there is none.
+func New(cfg config.LeaderConfig, backend coord.Backend, logger *log.Logger) (*Elector, error) {
+	if cfg.Election == "" {
+		return nil, nil
+	}
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("invalid leader interval %s: must be positive", cfg.Interval)
+	}
+	e := &Elector{logger: logger, stop: make(chan struct{}), done: make(chan struct{})}
+	switch cfg.Election {
+	case "file":
+		if cfg.LockFile == "" {
+			return nil, fmt.Errorf("leader lock file is required for file election")
+		}
+		lock, err := openLockFile(cfg.LockFile)
+		if err != nil {
+			return nil, fmt.Errorf("opening leader lock file %s: %w", cfg.LockFile, err)
+		}
+		// Why keep trying once it is held? A lock on the file is released only when the
+		// file is closed, so the leader remains one until it exits or the elector is closed.
+		held := false
+		e.campaign = func() (bool, error) {
+			if !held {
+				ok, err := lock.tryLock()
+				if err != nil {
+					return false, err
+				}
+				held = ok
+			}
+			return held, nil
+		}
+		e.resign = lock.close
+	case "coordination":
+		if backend == nil {
+			return nil, fmt.Errorf("coordination election requires a coordination backend")
+		}
+		// Taken again each time, so that a leader whose session expired, e.g. whilst the
+		// service could not be reached, finds out it no longer is one.
+		e.campaign = func() (bool, error) {
+			ctx, cancel := context.WithTimeout(context.Background(), cfg.Interval)
+			defer cancel()
+			return backend.TryLock(ctx, lockKey)
+		}
+	default:
+		return nil, fmt.Errorf("invalid leader election %q: must be file or coordination", cfg.Election)
+	}
+	e.run()
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				e.run()
+			}
+		}
+	}()
+	return e, nil
+}
+
+// Close stops campaigning, and this instance stops acting as the leader. The lock file is
+// released; a lock held in the coordination service goes with the session, when the backend
+// is closed.
+func (e *Elector) Close() error {
+	if e == nil {
+		return nil
+	}
+	close(e.stop)
+	<-e.done
+	e.leading.Store(false)
+	if e.resign != nil {
+		return e.resign()
+	}
+	return nil
+}
+
+// Leading reports whether this instance is the leader.
+func (e *Elector) Leading() bool {
+	return e == nil || e.leading.Load()
+}
+
+// run campaigns once, logging changes of leadership. An instance that cannot tell whether
+// it is the leader stops acting as one, as another may have taken over meanwhile.
+func (e *Elector) run() {
+	ok, err := e.campaign()
+	if err != nil {
+		e.logger.Printf("error electing the leader: %v\n", err)
+	}
+	if e.leading.Swap(ok) != ok {
+		if ok {
+			e.logger.Printf("this instance is now the leader, running scheduled jobs\n")
+		} else {
+			e.logger.Printf("this instance is no longer the leader\n")
+		}
+	}
+}
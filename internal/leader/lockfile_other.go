@@ -0,0 +1,20 @@
+//go:build !unix
+
+package leader
+
+import "errors"
+
+// lockFile is only implemented on Unix; elsewhere use the coordination election.
+type lockFile struct{}
+
+func openLockFile(path string) (*lockFile, error) {
+	return nil, errors.New("file election is not supported on this platform")
+}
+
+func (l *lockFile) tryLock() (bool, error) {
+	return false, nil
+}
+
+func (l *lockFile) close() error {
+	return nil
+}
@@ -0,0 +1,41 @@
+//go:build unix
+
+package leader
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile is a file whose lock the leader holds.
+type lockFile struct {
+	f *os.File
+}
+
+func openLockFile(path string) (*lockFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &lockFile{f: f}, nil
+}
+
+// tryLock takes the lock, and reports false if another process holds it.
+//
+// Why a POSIX record lock rather than flock? NFS supports these, through its lock manager
+// or as part of NFSv4, which is where a storage directory shared by instances usually is.
+func (l *lockFile) tryLock() (bool, error) {
+	lk := unix.Flock_t{Type: unix.F_WRLCK, Whence: 0}
+	err := unix.FcntlFlock(l.f.Fd(), unix.F_SETLK, &lk)
+	if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EACCES) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// close closes the file, which releases the lock.
+func (l *lockFile) close() error {
+	return l.f.Close()
+}
@@ -0,0 +1,136 @@
+package locks
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Errors returned by the Manager.
+var (
+	// ErrLocked is returned when another client holds an unexpired lock on the path.
+	ErrLocked = errors.New("file is locked by another client")
+	// ErrNotLocked is returned when the path has no lock, or the given token does not hold it.
+	ErrNotLocked = errors.New("file is not locked with the given token")
+)
+
+// Lock is an advisory, exclusive lock on one stored file.
+type Lock struct {
+	Token    string    `json:"token,omitempty"`
+	Path     string    `json:"path"`
+	Owner    string    `json:"owner,omitempty"`
+	LockedBy string    `json:"lockedBy"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Manager keeps the advisory locks of cooperating clients.
+//
+// Why keep them only in memory? Every lock expires after its timeout anyway, and clients
+// refresh locks they still need, so a restart costs no more than an early expiry would.
+type Manager struct {
+	mu    sync.Mutex
+	locks map[string]Lock // keyed by path
+}
+
+// NewManager creates an empty lock table.
+func NewManager() *Manager {
+	return &Manager{locks: make(map[string]Lock)}
+}
+
+// Acquire locks name for timeout and returns the new lock with its token.
+func (m *Manager) Acquire(name, owner, lockedBy string, timeout time.Duration) (Lock, error) {
+	token, err := newToken()
+	if err != nil {
+		return Lock{}, err
+	}
+	name = normalise(name)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pruneExpired()
+	if _, ok := m.locks[name]; ok {
+		return Lock{}, ErrLocked
+	}
+	l := Lock{Token: token, Path: name, Owner: owner, LockedBy: lockedBy, Expires: time.Now().Add(timeout).UTC()}
+	m.locks[name] = l
+	return l, nil
+}
+
+// Refresh extends the lock on name held with token by timeout from now.
+func (m *Manager) Refresh(name, token string, timeout time.Duration) (Lock, error) {
+	name = normalise(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.active(name)
+	if !ok || l.Token != token {
+		return Lock{}, ErrNotLocked
+	}
+	l.Expires = time.Now().Add(timeout).UTC()
+	m.locks[name] = l
+	return l, nil
+}
+
+// Release removes the lock on name held with token.
+func (m *Manager) Release(name, token string) error {
+	name = normalise(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	l, ok := m.active(name)
+	if !ok || l.Token != token {
+		return ErrNotLocked
+	}
+	delete(m.locks, name)
+	return nil
+}
+
+// Get returns the unexpired lock on name, if any.
+func (m *Manager) Get(name string) (Lock, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.active(normalise(name))
+}
+
+// active returns the lock on name unless it has expired, in which case it is dropped.
+// The caller must hold the lock.
+func (m *Manager) active(name string) (Lock, bool) {
+	l, ok := m.locks[name]
+	if !ok {
+		return Lock{}, false
+	}
+	if !time.Now().Before(l.Expires) {
+		delete(m.locks, name)
+		return Lock{}, false
+	}
+	return l, true
+}
+
+// pruneExpired drops expired locks, so locks that are never released or looked at again do
+// not accumulate. The caller must hold the lock.
+func (m *Manager) pruneExpired() {
+	now := time.Now()
+	for name, l := range m.locks {
+		if !now.Before(l.Expires) {
+			delete(m.locks, name)
+		}
+	}
+}
+
+// newToken returns a WebDAV-style lock token: an "opaquelocktoken" URI holding a random UUID.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("opaquelocktoken:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// normalise turns a storage-relative path into the table's key form, without a leading slash.
+func normalise(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
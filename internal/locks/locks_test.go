@@ -0,0 +1,69 @@
+package locks
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	m := NewManager()
+	l, err := m.Acquire("/docs//a.txt", "Alice's laptop", "alice", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`^opaquelocktoken:[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(l.Token) {
+		t.Errorf("got token %s, want a random UUID", l.Token)
+	}
+	if l.Path != "docs/a.txt" || l.Owner != "Alice's laptop" || l.LockedBy != "alice" {
+		t.Errorf("got %+v", l)
+	}
+	if _, err := m.Acquire("docs/a.txt", "", "bob", time.Minute); !errors.Is(err, ErrLocked) {
+		t.Errorf("second lock: got %v, want ErrLocked", err)
+	}
+	if _, err := m.Refresh("docs/a.txt", "opaquelocktoken:other", time.Hour); !errors.Is(err, ErrNotLocked) {
+		t.Errorf("refresh with another token: got %v, want ErrNotLocked", err)
+	}
+	refreshed, err := m.Refresh("docs/a.txt", l.Token, time.Hour)
+	if err != nil || !refreshed.Expires.After(l.Expires) {
+		t.Errorf("refresh: got %v, %v, want the lock extended", refreshed.Expires, err)
+	}
+	if err := m.Release("docs/a.txt", "opaquelocktoken:other"); !errors.Is(err, ErrNotLocked) {
+		t.Errorf("release with another token: got %v, want ErrNotLocked", err)
+	}
+	if err := m.Release("docs/a.txt", l.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m.Get("docs/a.txt"); ok {
+		t.Error("lock kept after its release")
+	}
+	if err := m.Release("docs/a.txt", l.Token); !errors.Is(err, ErrNotLocked) {
+		t.Errorf("second release: got %v, want ErrNotLocked", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	m := NewManager()
+	l, err := m.Acquire("a.txt", "", "alice", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Acquire("b.txt", "", "alice", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := m.Get("a.txt"); ok {
+		t.Error("expired lock found")
+	}
+	if _, err := m.Refresh("a.txt", l.Token, time.Minute); !errors.Is(err, ErrNotLocked) {
+		t.Errorf("refreshing an expired lock: got %v, want ErrNotLocked", err)
+	}
+	if _, err := m.Acquire("a.txt", "", "bob", time.Minute); err != nil {
+		t.Errorf("locking a file whose lock expired: %v", err)
+	}
+	// Expired locks no one looks at again are dropped too.
+	if _, ok := m.locks["b.txt"]; ok {
+		t.Error("expired lock kept")
+	}
+}
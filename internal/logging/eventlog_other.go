@@ -0,0 +1,10 @@
+//go:build !windows
+
+package logging
+
+import "errors"
+
+// newEventLog fails, as the event log only exists on Windows.
+func newEventLog(source string) (sink, error) {
+	return nil, errors.New("the eventlog output is only available on Windows")
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+
+package logging
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// TestEventLog checks that the eventlog output is refused, rather than ignored, where
+// there is no event log.
+func TestEventLog(t *testing.T) {
+	_, _, err := New(&config.LoggingConfig{Outputs: []string{"eventlog"}, Syslog: config.SyslogConfig{Tag: "fileserver"}})
+	if err == nil || !strings.Contains(err.Error(), "only available on Windows") {
+		t.Errorf("got error %v, want the output refused", err)
+	}
+}
@@ -0,0 +1,45 @@
+//go:build windows
+
+package logging
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// eventID is the ID of every event the server logs. The source is registered with the
+// generic EventCreate message file, which accepts IDs 1 to 1000 and prints the message as is.
+const eventID = 1
+
+// eventLogSink writes messages to the Windows Application event log.
+type eventLogSink struct {
+	log *eventlog.Log
+}
+
+// newEventLog opens the event log under the given source, which "fileserver service install"
+// registers.
+func newEventLog(source string) (sink, error) {
+	l, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("opening event log: %w", err)
+	}
+	return &eventLogSink{log: l}, nil
+}
+
+// send writes one event, mapping the syslog severity onto the event log's three types.
+func (e *eventLogSink) send(severity int, msg string) error {
+	switch {
+	case severity <= sevErr:
+		return e.log.Error(eventID, msg)
+	case severity == sevWarning:
+		return e.log.Warning(eventID, msg)
+	default:
+		return e.log.Info(eventID, msg)
+	}
+}
+
+// Close closes the event log.
+func (e *eventLogSink) Close() error {
+	return e.log.Close()
+}
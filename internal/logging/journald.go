@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// journalSocket is where systemd-journald accepts messages in its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// journaldSink sends messages to systemd-journald using its native protocol, so that each
+// entry carries its priority and identifier as proper journal fields.
+type journaldSink struct {
+	identifier string
+	conn       *net.UnixConn
+}
+
+// newJournald connects to the journal socket.
+func newJournald(identifier string) (*journaldSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journalSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("connecting to journald: %w", err)
+	}
+	return &journaldSink{identifier: identifier, conn: conn}, nil
+}
+
+// send writes one journal entry. Entries must fit into a single datagram; journald's
+// default limit is far above the size of the server's log messages.
+func (j *journaldSink) send(severity int, msg string) error {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", msg)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(severity))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", j.identifier)
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
+
+// writeJournalField appends one field. Values containing newlines (e.g. stack traces) use
+// the binary form: the name, a newline, the value's length as a little-endian uint64, the value.
+func writeJournalField(buf *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		buf.WriteString(name + "=" + value + "\n")
+		return
+	}
+	buf.WriteString(name + "\n")
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.WriteString(value + "\n")
+}
+
+// Close closes the connection to the journal.
+func (j *journaldSink) Close() error {
+	return j.conn.Close()
+}
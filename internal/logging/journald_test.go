@@ -0,0 +1,55 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournald(t *testing.T) {
+	addr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "socket"), Net: "unixgram"}
+	journal, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Skipf("cannot listen on a datagram socket: %v", err)
+	}
+	defer journal.Close()
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := &journaldSink{identifier: "fileserver", conn: conn}
+	defer j.Close()
+
+	var trace bytes.Buffer
+	trace.WriteString("MESSAGE\n")
+	binary.Write(&trace, binary.LittleEndian, uint64(len("panic\nstack")))
+	trace.WriteString("panic\nstack\n")
+	tests := []struct {
+		desc     string
+		severity int
+		msg      string
+		want     string
+	}{
+		{"a single line", sevErr, "error creating file a.txt",
+			"MESSAGE=error creating file a.txt\nPRIORITY=3\nSYSLOG_IDENTIFIER=fileserver\n"},
+		{"several lines, in the binary form", sevCrit, "panic\nstack",
+			trace.String() + "PRIORITY=2\nSYSLOG_IDENTIFIER=fileserver\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if err := j.send(tt.severity, tt.msg); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 1024)
+			n, err := journal.Read(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf[:n]); got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
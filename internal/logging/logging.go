@@ -0,0 +1,147 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// Prefix is the text that starts every line written to the console and the log file.
+const Prefix = "[FILE SERVER] "
+
+// Syslog severities (RFC 5424), used by the structured sinks.
+const (
+	sevCrit    = 2
+	sevErr     = 3
+	sevWarning = 4
+	sevInfo    = 6
+)
+
+// sink receives log messages one at a time, with their severity, rather than as
+// preformatted text.
+type sink interface {
+	send(severity int, msg string) error
+	io.Closer
+}
+
+// writer fans every log message out to the configured outputs.
+//
+// Why not simply io.MultiWriter? Text outputs want the familiar "[FILE SERVER] date"
+// prefix, whereas syslog and journald add their own timestamps and need a severity per
+// message, so the logger writes bare messages and each kind of output formats them itself.
+type writer struct {
+	mu     sync.Mutex
+	text   []io.Writer
+	sinks  []sink
+	closer []io.Closer
+	failed map[sink]bool
+}
+
+// New creates the application logger from the logging configuration, together with a
+// Closer that releases its files and connections.
+func New(cfg *config.LoggingConfig) (*log.Logger, io.Closer, error) {
+	w := &writer{failed: make(map[sink]bool)}
+	for _, output := range cfg.Outputs {
+		switch output {
+		case "stdout":
+			w.text = append(w.text, os.Stdout)
+		case "file":
+			// Open the log file for appending. The flags ensure the file is created if it
+			// does not exist, and that new log entries are added to the end.
+			f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+			if err != nil {
+				w.Close()
+				return nil, nil, fmt.Errorf("opening log file: %w", err)
+			}
+			w.text = append(w.text, f)
+			w.closer = append(w.closer, f)
+		case "syslog":
+			s, err := newSyslog(&cfg.Syslog)
+			if err != nil {
+				w.Close()
+				return nil, nil, err
+			}
+			w.sinks = append(w.sinks, s)
+		case "journald":
+			s, err := newJournald(cfg.Syslog.Tag)
+			if err != nil {
+				w.Close()
+				return nil, nil, err
+			}
+			w.sinks = append(w.sinks, s)
+		case "eventlog":
+			s, err := newEventLog(cfg.Syslog.Tag)
+			if err != nil {
+				w.Close()
+				return nil, nil, err
+			}
+			w.sinks = append(w.sinks, s)
+		default:
+			w.Close()
+			return nil, nil, fmt.Errorf("unknown log output %q", output)
+		}
+	}
+	// The flags are zero: timestamps and the prefix are added per output by the writer.
+	return log.New(w, "", 0), w, nil
+}
+
+// Write formats one log message for every output.
+func (w *writer) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.text) > 0 {
+		line := Prefix + time.Now().Format("2006/01/02 15:04:05 ") + msg + "\n"
+		for _, out := range w.text {
+			out.Write([]byte(line))
+		}
+	}
+	severity := severityOf(msg)
+	for _, s := range w.sinks {
+		// Why report failures to stderr only once? A syslog daemon that is down would
+		// otherwise produce an error for every single log line.
+		err := s.send(severity, msg)
+		if err != nil && !w.failed[s] {
+			fmt.Fprintf(os.Stderr, "%serror writing log message: %v\n", Prefix, err)
+		}
+		w.failed[s] = err != nil
+	}
+	return len(p), nil
+}
+
+// Close closes the log file and the connections to syslog, journald or the event log.
+func (w *writer) Close() error {
+	var errs []error
+	for _, c := range w.closer {
+		errs = append(errs, c.Close())
+	}
+	for _, s := range w.sinks {
+		errs = append(errs, s.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// severityOf derives a syslog severity from a log message. The server's messages follow a
+// consistent wording ("error creating file ...", "warn: ...", "panic serving ..."), so the
+// leading word is a reliable indicator; anything else is informational.
+func severityOf(msg string) int {
+	lower := strings.ToLower(msg)
+	switch {
+	case strings.HasPrefix(lower, "panic"):
+		return sevCrit
+	case strings.HasPrefix(lower, "error"), strings.HasPrefix(lower, "failed"), strings.HasPrefix(lower, "fatal"):
+		return sevErr
+	case strings.HasPrefix(lower, "warn"):
+		return sevWarning
+	default:
+		return sevInfo
+	}
+}
@@ -0,0 +1,122 @@
+package logging
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestNew(t *testing.T) {
+	daemon, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer daemon.Close()
+	file := filepath.Join(t.TempDir(), "fileserver.log")
+	logger, closer, err := New(&config.LoggingConfig{
+		Outputs: []string{"file", "syslog"},
+		File:    file,
+		Syslog:  config.SyslogConfig{Network: "udp", Address: daemon.LocalAddr().String(), Facility: "local3", Tag: "file server"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Printf("error creating file %s\n", "a.txt")
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := regexp.MustCompile(`^\[FILE SERVER\] \d{4}/\d\d/\d\d \d\d:\d\d:\d\d error creating file a\.txt\n$`); !want.Match(data) {
+		t.Errorf("wrote %q to the log file", data)
+	}
+
+	buf := make([]byte, 1024)
+	daemon.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := daemon.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// local3 is facility 19, and an error has severity 3.
+	if want := regexp.MustCompile(`^<155>1 \S+ \S+ file_server \d+ - - error creating file a\.txt$`); !want.Match(buf[:n]) {
+		t.Errorf("sent %q to syslog", buf[:n])
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		desc string
+		cfg  config.LoggingConfig
+	}{
+		{"an unknown output", config.LoggingConfig{Outputs: []string{"stdout", "kafka"}}},
+		{"a log file that cannot be opened", config.LoggingConfig{Outputs: []string{"file"}, File: filepath.Join(t.TempDir(), "missing", "fileserver.log")}},
+		{"an unknown facility", config.LoggingConfig{Outputs: []string{"syslog"}, Syslog: config.SyslogConfig{Network: "udp", Address: "127.0.0.1:514", Facility: "local9"}}},
+		{"an unknown network", config.LoggingConfig{Outputs: []string{"syslog"}, Syslog: config.SyslogConfig{Network: "unix", Address: "/dev/log", Facility: "daemon"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if _, _, err := New(&tt.cfg); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	tests := []struct {
+		network string
+		msg     string
+		want    string
+	}{
+		{"", "started", `^<30>\w{3} [ \d]\d \d\d:\d\d:\d\d fileserver\[\d+\]: started\n$`},
+		{"udp", "started", `^<30>1 \S+ \S+ fileserver \d+ - - started$`},
+		// Octet counting frames a message spanning several lines.
+		{"tcp", "panic\nstack", `^(\d+) <30>1 \S+ \S+ fileserver \d+ - - panic\nstack$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.network, func(t *testing.T) {
+			s := &syslogSink{network: tt.network, facility: facilities["daemon"], tag: "fileserver", hostname: "host"}
+			got := string(s.format(sevInfo, tt.msg))
+			m := regexp.MustCompile(tt.want).FindStringSubmatch(got)
+			if m == nil {
+				t.Fatalf("got %q, want it to match %s", got, tt.want)
+			}
+			if tt.network == "tcp" {
+				if frame := strings.TrimPrefix(got, m[1]+" "); m[1] != strconv.Itoa(len(frame)) {
+					t.Errorf("got a length of %s for a message of %d bytes", m[1], len(frame))
+				}
+			}
+		})
+	}
+}
+
+func TestSeverityOf(t *testing.T) {
+	tests := []struct {
+		msg  string
+		want int
+	}{
+		{"panic serving GET /download/a.txt: nil map", sevCrit},
+		{"error creating file a.txt", sevErr},
+		{"Failed to remove a.txt", sevErr},
+		{"warn: dropping 3 error reports", sevWarning},
+		{"server started on :8080", sevInfo},
+		{"an error occurred", sevInfo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			if got := severityOf(tt.msg); got != tt.want {
+				t.Errorf("got severity %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// facilities maps syslog facility names to their codes (RFC 5424, section 6.2.1).
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// localSyslogSockets are the usual locations of the local syslog daemon's socket.
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// syslogSink sends messages to a local or remote syslog daemon.
+//
+// Why not log/syslog? It does not build on Windows and only speaks the older BSD format.
+// Remote messages use RFC 5424; messages for the local socket keep the traditional format,
+// which every local daemon (including journald's /dev/log) understands.
+type syslogSink struct {
+	network  string
+	address  string
+	facility int
+	tag      string
+	hostname string
+	conn     net.Conn
+}
+
+// newSyslog connects to the syslog daemon described by cfg. An empty network selects the
+// local daemon; otherwise network is "udp" or "tcp" and address is its "host:port".
+func newSyslog(cfg *config.SyslogConfig) (*syslogSink, error) {
+	facility, ok := facilities[cfg.Facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", cfg.Facility)
+	}
+	if cfg.Network != "" && cfg.Network != "udp" && cfg.Network != "tcp" {
+		return nil, fmt.Errorf("unknown syslog network %q (expected \"udp\", \"tcp\" or empty for local)", cfg.Network)
+	}
+	hostname, _ := os.Hostname()
+	s := &syslogSink{
+		network:  cfg.Network,
+		address:  cfg.Address,
+		facility: facility,
+		tag:      cfg.Tag,
+		hostname: hostname,
+	}
+	if err := s.connect(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connect (re)establishes the connection to the daemon.
+func (s *syslogSink) connect() error {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	if s.network != "" {
+		conn, err := net.DialTimeout(s.network, s.address, 5*time.Second)
+		if err != nil {
+			return fmt.Errorf("connecting to syslog at %s: %w", s.address, err)
+		}
+		s.conn = conn
+		return nil
+	}
+	for _, path := range localSyslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := net.Dial(network, path); err == nil {
+				s.conn = conn
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no local syslog daemon found")
+}
+
+// send writes one message, reconnecting once if the daemon has gone away (e.g. restarted).
+func (s *syslogSink) send(severity int, msg string) error {
+	line := s.format(severity, msg)
+	if s.conn != nil {
+		if _, err := s.conn.Write(line); err == nil {
+			return nil
+		}
+	}
+	if err := s.connect(); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(line)
+	return err
+}
+
+// format renders a message in the format expected on the configured connection.
+func (s *syslogSink) format(severity int, msg string) []byte {
+	pri := s.facility*8 + severity
+	pid := os.Getpid()
+	if s.network == "" {
+		return fmt.Appendf(nil, "<%d>%s %s[%d]: %s\n", pri, time.Now().Format(time.Stamp), s.tag, pid, msg)
+	}
+	// RFC 5424: <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+	line := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", pri, time.Now().Format(time.RFC3339Nano),
+		nilValue(s.hostname), nilValue(s.tag), pid, msg)
+	if s.network == "tcp" {
+		// RFC 6587 octet counting, as messages may contain newlines (e.g. stack traces).
+		return fmt.Appendf(nil, "%d %s", len(line), line)
+	}
+	return []byte(line)
+}
+
+// Close closes the connection to the daemon.
+func (s *syslogSink) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// nilValue returns v, or the RFC 5424 NILVALUE "-" if it is empty; spaces, which would
+// break the header, are replaced.
+func nilValue(v string) string {
+	if v == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(v, " ", "_")
+}
@@ -0,0 +1,401 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Histogram bucket upper bounds. Why these? Durations span quick API calls to multi-minute
+// uploads, and sizes span small JSON documents to multi-gigabyte files, so both grow roughly
+// geometrically to keep the bucket count small.
+var (
+	durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300, 900}
+	sizeBuckets     = []float64{1 << 10, 16 << 10, 256 << 10, 1 << 20, 16 << 20, 256 << 20, 1 << 30, 4 << 30, 16 << 30}
+)
+
+// unmatchedRoute labels requests that matched no route, so that scanners probing random
+// paths cannot create an unbounded number of label values.
+const unmatchedRoute = "unmatched"
+
+// histogram is a cumulative-on-export Prometheus histogram.
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative; the last entry is +Inf
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+// observe records v. The caller must hold the registry lock.
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i]++
+	h.sum += v
+	h.count++
+}
+
+// requestKey identifies a series of request metrics.
+type requestKey struct {
+	route   string
+	method  string
+	status  string
+	country string // empty unless requests are labelled by country
+}
+
+// requestStats holds the metrics for one requestKey.
+type requestStats struct {
+	duration     *histogram
+	requestSize  *histogram
+	responseSize *histogram
+}
+
+// Sink receives every observation made by a Registry, so that the same metric set can be
+// forwarded to systems other than Prometheus (e.g. StatsD).
+type Sink interface {
+	ObserveRequest(route, method, status, country string, duration time.Duration, requestBytes, responseBytes int64)
+	SetActiveTransfers(direction string, n int64)
+	SetQueuedJobs(n int64)
+	ObserveJob(wait, duration time.Duration)
+	SetFreeSpace(dir string, free int64, low bool)
+}
+
+// Registry collects request and transfer metrics and exposes them in the Prometheus text format.
+//
+// Why not the official client library? The server only needs a handful of metrics, and
+// the exposition format is simple enough that a few dozen lines avoid a large dependency tree.
+type Registry struct {
+	mu        sync.Mutex
+	requests  map[requestKey]*requestStats
+	uploads   atomic.Int64
+	downloads atomic.Int64
+	queued    atomic.Int64
+	jobWait   *histogram
+	jobRun    *histogram
+	freeSpace map[string]freeSpace // by storage directory; guarded by mu
+	routeOf   func(*http.Request) string
+	countryOf func(*http.Request) string
+	sinks     []Sink
+}
+
+// NewRegistry creates an empty Registry. routeOf returns the route pattern a request
+// matches, or an empty string if it matches none; it is used as the "route" label.
+func NewRegistry(routeOf func(*http.Request) string) *Registry {
+	return &Registry{
+		requests:  make(map[requestKey]*requestStats),
+		jobWait:   newHistogram(durationBuckets),
+		jobRun:    newHistogram(durationBuckets),
+		freeSpace: make(map[string]freeSpace),
+		routeOf:   routeOf,
+	}
+}
+
+// AddSink forwards all future observations to sink as well. It must be called before the
+// registry starts serving requests.
+func (reg *Registry) AddSink(sink Sink) {
+	reg.sinks = append(reg.sinks, sink)
+}
+
+// LabelCountries labels all future observations with the country countryOf returns for
+// each request. It must be called before the registry starts serving requests.
+//
+// Why opt in? A label multiplies the number of series, and without a GeoIP database every
+// request would be from the same unknown country anyway.
+func (reg *Registry) LabelCountries(countryOf func(*http.Request) string) {
+	reg.countryOf = countryOf
+}
+
+// Middleware records the duration, status and body sizes of every request.
+//
+// Why label by route pattern rather than URL path? Every file name would otherwise become a
+// separate series, and "/download/{name...}" is what an alert on download latency needs anyway.
+// It wraps the whole handler chain, so requests rejected by other middleware are counted too.
+func (reg *Registry) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := reg.routeOf(r)
+		if route == "" {
+			route = unmatchedRoute
+		}
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		key := requestKey{route: route, method: r.Method, status: strconv.Itoa(rec.status)}
+		if reg.countryOf != nil {
+			key.country = reg.countryOf(r)
+		}
+		reg.observe(key, time.Since(start), body.n, rec.written)
+	})
+}
+
+// Transfer wraps a handler so the active uploads or downloads gauge counts its requests
+// whilst they are in progress. direction is "upload" or "download".
+func (reg *Registry) Transfer(direction string, next http.HandlerFunc) http.HandlerFunc {
+	gauge := &reg.downloads
+	if direction == "upload" {
+		gauge = &reg.uploads
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		reg.setActive(direction, gauge.Add(1))
+		defer func() { reg.setActive(direction, gauge.Add(-1)) }()
+		next(w, r)
+	}
+}
+
+// setActive reports a new value of an active transfers gauge to the sinks.
+func (reg *Registry) setActive(direction string, n int64) {
+	for _, sink := range reg.sinks {
+		sink.SetActiveTransfers(direction, n)
+	}
+}
+
+// SetQueuedJobs records the number of background jobs waiting for a worker.
+func (reg *Registry) SetQueuedJobs(n int64) {
+	reg.queued.Store(n)
+	for _, sink := range reg.sinks {
+		sink.SetQueuedJobs(n)
+	}
+}
+
+// ObserveJob records a finished background job: how long it waited for a worker, and how
+// long it then took to process.
+func (reg *Registry) ObserveJob(wait, duration time.Duration) {
+	for _, sink := range reg.sinks {
+		sink.ObserveJob(wait, duration)
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.jobWait.observe(wait.Seconds())
+	reg.jobRun.observe(duration.Seconds())
+}
+
+// freeSpace is the free space last seen on the disk of a storage directory.
+type freeSpace struct {
+	bytes int64
+	low   bool
+}
+
+// SetFreeSpace records the bytes free on the disk of the storage directory dir, and whether
+// that is below uploader.minFreeSpaceMB.
+func (reg *Registry) SetFreeSpace(dir string, free int64, low bool) {
+	for _, sink := range reg.sinks {
+		sink.SetFreeSpace(dir, free, low)
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.freeSpace[dir] = freeSpace{bytes: free, low: low}
+}
+
+// observe records one completed request.
+func (reg *Registry) observe(key requestKey, duration time.Duration, requestBytes, responseBytes int64) {
+	for _, sink := range reg.sinks {
+		sink.ObserveRequest(key.route, key.method, key.status, key.country, duration, requestBytes, responseBytes)
+	}
+
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	stats, ok := reg.requests[key]
+	if !ok {
+		stats = &requestStats{
+			duration:     newHistogram(durationBuckets),
+			requestSize:  newHistogram(sizeBuckets),
+			responseSize: newHistogram(sizeBuckets),
+		}
+		reg.requests[key] = stats
+	}
+	stats.duration.observe(duration.Seconds())
+	stats.requestSize.observe(float64(requestBytes))
+	stats.responseSize.observe(float64(responseBytes))
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var sb strings.Builder
+
+	reg.mu.Lock()
+	keys := make([]requestKey, 0, len(reg.requests))
+	for key := range reg.requests {
+		keys = append(keys, key)
+	}
+	// Sorted so that scrapes are stable and easy to diff.
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		if a.status != b.status {
+			return a.status < b.status
+		}
+		return a.country < b.country
+	})
+
+	sb.WriteString("# HELP fileserver_http_requests_total Total number of HTTP requests.\n")
+	sb.WriteString("# TYPE fileserver_http_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "fileserver_http_requests_total{%s} %d\n", key.labels(), reg.requests[key].duration.count)
+	}
+	writeHistograms(&sb, "fileserver_http_request_duration_seconds", "HTTP request duration in seconds.",
+		keys, func(s *requestStats) *histogram { return s.duration }, reg.requests)
+	writeHistograms(&sb, "fileserver_http_request_size_bytes", "Size of HTTP request bodies in bytes.",
+		keys, func(s *requestStats) *histogram { return s.requestSize }, reg.requests)
+	writeHistograms(&sb, "fileserver_http_response_size_bytes", "Size of HTTP response bodies in bytes.",
+		keys, func(s *requestStats) *histogram { return s.responseSize }, reg.requests)
+	writeHistogram(&sb, "fileserver_job_wait_seconds", "Time background jobs waited for a worker, in seconds.", reg.jobWait)
+	writeHistogram(&sb, "fileserver_job_duration_seconds", "Time background jobs took to process, in seconds.", reg.jobRun)
+	if len(reg.freeSpace) > 0 {
+		dirs := make([]string, 0, len(reg.freeSpace))
+		for dir := range reg.freeSpace {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		sb.WriteString("# HELP fileserver_storage_free_bytes Free space on the disk of each storage directory, in bytes.\n")
+		sb.WriteString("# TYPE fileserver_storage_free_bytes gauge\n")
+		for _, dir := range dirs {
+			fmt.Fprintf(&sb, "fileserver_storage_free_bytes{dir=\"%s\"} %d\n", escape(dir), reg.freeSpace[dir].bytes)
+		}
+		sb.WriteString("# HELP fileserver_storage_low_space Whether uploads to a storage directory are refused for lack of free space.\n")
+		sb.WriteString("# TYPE fileserver_storage_low_space gauge\n")
+		for _, dir := range dirs {
+			low := 0
+			if reg.freeSpace[dir].low {
+				low = 1
+			}
+			fmt.Fprintf(&sb, "fileserver_storage_low_space{dir=\"%s\"} %d\n", escape(dir), low)
+		}
+	}
+	reg.mu.Unlock()
+
+	sb.WriteString("# HELP fileserver_active_transfers Number of uploads and downloads in progress.\n")
+	sb.WriteString("# TYPE fileserver_active_transfers gauge\n")
+	fmt.Fprintf(&sb, "fileserver_active_transfers{direction=\"download\"} %d\n", reg.downloads.Load())
+	fmt.Fprintf(&sb, "fileserver_active_transfers{direction=\"upload\"} %d\n", reg.uploads.Load())
+	sb.WriteString("# HELP fileserver_jobs_queued Number of background jobs waiting for a worker.\n")
+	sb.WriteString("# TYPE fileserver_jobs_queued gauge\n")
+	fmt.Fprintf(&sb, "fileserver_jobs_queued %d\n", reg.queued.Load())
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	io.WriteString(w, sb.String())
+}
+
+// writeHistograms writes one histogram family. The caller must hold the registry lock.
+func writeHistograms(sb *strings.Builder, name, help string, keys []requestKey,
+	pick func(*requestStats) *histogram, stats map[requestKey]*requestStats) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, key := range keys {
+		h := pick(stats[key])
+		labels := key.labels()
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(sb, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(sb, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(sb, "%s_sum{%s} %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(sb, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+// writeHistogram writes an unlabelled histogram. The caller must hold the registry lock.
+func writeHistogram(sb *strings.Builder, name, help string, h *histogram) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		fmt.Fprintf(sb, "%s_bucket{le=\"%s\"} %d\n", name, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(sb, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(sb, "%s_sum %s\n", name, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(sb, "%s_count %d\n", name, h.count)
+}
+
+// labels formats the key as Prometheus labels.
+func (k requestKey) labels() string {
+	labels := fmt.Sprintf(`route="%s",method="%s",status="%s"`, escape(k.route), escape(k.method), k.status)
+	if k.country != "" {
+		labels += fmt.Sprintf(`,country="%s"`, escape(k.country))
+	}
+	return labels
+}
+
+// escape escapes a label value as required by the text exposition format.
+func escape(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// recorder captures the status code and the number of body bytes written.
+type recorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	// Informational responses (e.g. 100 Continue) are not the final status.
+	if rec.status == 0 && status >= 200 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.written += int64(n)
+	return n, err
+}
+
+// ReadFrom passes the source straight to the underlying writer, so that downloads keep
+// using sendfile whilst their size is still counted.
+func (rec *recorder) ReadFrom(src io.Reader) (int64, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(struct{ io.Writer }{rec.ResponseWriter}, src)
+	}
+	rec.written += n
+	return n, err
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,151 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape returns the metrics of reg in the text exposition format.
+func scrape(t *testing.T, reg *Registry) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	reg.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/plain; version=0.0.4") {
+		t.Errorf("got Content-Type %s, want the text exposition format", got)
+	}
+	return w.Body.String()
+}
+
+// wantLines fails t unless each of lines is one of those of exposition.
+func wantLines(t *testing.T, exposition string, lines ...string) {
+	t.Helper()
+	have := make(map[string]bool)
+	for _, l := range strings.Split(exposition, "\n") {
+		have[l] = true
+	}
+	for _, l := range lines {
+		if !have[l] {
+			t.Errorf("missing %s in:\n%s", l, exposition)
+		}
+	}
+}
+
+// newTestRegistry returns a registry knowing the routes "/download/{name...}" and "/upload".
+func newTestRegistry() *Registry {
+	return NewRegistry(func(r *http.Request) string {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/download/"):
+			return "/download/{name...}"
+		case r.URL.Path == "/upload":
+			return "/upload"
+		}
+		return ""
+	})
+}
+
+func TestMiddleware(t *testing.T) {
+	reg := newTestRegistry()
+	handler := reg.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		switch r.URL.Path {
+		case "/download/a.txt":
+			w.Write([]byte(strings.Repeat("x", 2000)))
+		case "/upload":
+			w.WriteHeader(http.StatusCreated)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	requests := []struct {
+		method, target, body string
+	}{
+		{http.MethodGet, "/download/a.txt", ""},
+		{http.MethodGet, "/download/a.txt", ""},
+		{http.MethodPost, "/upload", strings.Repeat("x", 100)},
+		{http.MethodGet, "/wp-admin/" + strings.Repeat("x", 10), ""},
+		{http.MethodGet, "/.env", ""},
+	}
+	for _, req := range requests {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.target, strings.NewReader(req.body)))
+	}
+
+	wantLines(t, scrape(t, reg),
+		`fileserver_http_requests_total{route="/download/{name...}",method="GET",status="200"} 2`,
+		`fileserver_http_requests_total{route="/upload",method="POST",status="201"} 1`,
+		// Unknown paths share a single series, however many there are.
+		`fileserver_http_requests_total{route="unmatched",method="GET",status="404"} 2`,
+		`fileserver_http_request_size_bytes_bucket{route="/upload",method="POST",status="201",le="1024"} 1`,
+		`fileserver_http_request_size_bytes_sum{route="/upload",method="POST",status="201"} 100`,
+		`fileserver_http_response_size_bytes_bucket{route="/download/{name...}",method="GET",status="200",le="1024"} 0`,
+		`fileserver_http_response_size_bytes_bucket{route="/download/{name...}",method="GET",status="200",le="16384"} 2`,
+		`fileserver_http_response_size_bytes_bucket{route="/download/{name...}",method="GET",status="200",le="+Inf"} 2`,
+		`fileserver_http_response_size_bytes_sum{route="/download/{name...}",method="GET",status="200"} 4000`,
+		`fileserver_http_request_duration_seconds_count{route="/download/{name...}",method="GET",status="200"} 2`,
+	)
+}
+
+// TestTransfer checks that the active transfers gauges count the requests in progress.
+func TestTransfer(t *testing.T) {
+	reg := newTestRegistry()
+	var during string
+	download := reg.Transfer("download", func(w http.ResponseWriter, r *http.Request) {
+		during = scrape(t, reg)
+	})
+	upload := reg.Transfer("upload", func(w http.ResponseWriter, r *http.Request) {
+		download(w, r)
+	})
+	upload(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/download/a.txt", nil))
+
+	wantLines(t, during,
+		`fileserver_active_transfers{direction="download"} 1`,
+		`fileserver_active_transfers{direction="upload"} 1`,
+	)
+	wantLines(t, scrape(t, reg),
+		`fileserver_active_transfers{direction="download"} 0`,
+		`fileserver_active_transfers{direction="upload"} 0`,
+	)
+}
+
+func TestJobs(t *testing.T) {
+	reg := newTestRegistry()
+	reg.SetQueuedJobs(3)
+	reg.ObserveJob(2*time.Second, 500*time.Millisecond)
+	reg.ObserveJob(0, 30*time.Second)
+	wantLines(t, scrape(t, reg),
+		`fileserver_jobs_queued 3`,
+		`# TYPE fileserver_job_wait_seconds histogram`,
+		`fileserver_job_wait_seconds_bucket{le="+Inf"} 2`,
+		`fileserver_job_wait_seconds_sum 2`,
+		`fileserver_job_wait_seconds_count 2`,
+		`fileserver_job_duration_seconds_sum 30.5`,
+		`fileserver_job_duration_seconds_count 2`,
+	)
+}
+
+func TestFreeSpace(t *testing.T) {
+	reg := newTestRegistry()
+	if strings.Contains(scrape(t, reg), "fileserver_storage_free_bytes") {
+		t.Error("free space exported before any check")
+	}
+	reg.SetFreeSpace("/srv/files", 5<<30, false)
+	reg.SetFreeSpace(`/mnt/"photos"`, 1<<20, true)
+	reg.SetFreeSpace("/srv/files", 4<<30, false)
+	wantLines(t, scrape(t, reg),
+		`# TYPE fileserver_storage_free_bytes gauge`,
+		`fileserver_storage_free_bytes{dir="/srv/files"} 4294967296`,
+		`fileserver_storage_free_bytes{dir="/mnt/\"photos\""} 1048576`,
+		`# TYPE fileserver_storage_low_space gauge`,
+		`fileserver_storage_low_space{dir="/srv/files"} 0`,
+		`fileserver_storage_low_space{dir="/mnt/\"photos\""} 1`,
+	)
+}
+
+func TestEscape(t *testing.T) {
+	if got, want := escape("a\"b\\c\nd"), `a\"b\\c\nd`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
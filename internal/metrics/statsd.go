@@ -0,0 +1,222 @@
+package metrics
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Supported StatsD line formats.
+const (
+	// FormatDogStatsD sends labels as DogStatsD tags ("|#route:/upload,status:200").
+	FormatDogStatsD = "dogstatsd"
+	// FormatStatsD folds labels into the metric name, as plain StatsD has no tags.
+	FormatStatsD = "statsd"
+)
+
+// maxPacketSize keeps each datagram below the typical Ethernet MTU, so packets are not
+// fragmented and silently lost.
+const maxPacketSize = 1432
+
+// StatsD is a Sink that sends the registry's metric set to a StatsD or DogStatsD agent
+// over UDP.
+//
+// Why buffer? A packet per observation would cost a syscall per metric on every request.
+// Lines are batched into packets instead and flushed when full or after a short interval.
+type StatsD struct {
+	mu        sync.Mutex
+	conn      net.Conn
+	prefix    string
+	tags      string // pre-formatted global tags, without the leading "|#"
+	dogStatsD bool
+	buf       []byte
+	failing   bool
+	closed    bool
+	logger    *log.Logger
+	stop      chan struct{} // closed by Close
+	done      chan struct{} // closed once the flushing stops
+}
+
+// NewStatsD connects to the agent at addr and starts flushing buffered metrics every interval.
+// prefix is prepended to every metric name (e.g. "fileserver."), and tags, given as
+// "key:value" strings, are added to every metric in the DogStatsD format.
+func NewStatsD(addr, prefix, format string, tags []string, interval time.Duration, logger *log.Logger) (*StatsD, error) {
+	if format != FormatDogStatsD && format != FormatStatsD {
+		return nil, fmt.Errorf("unknown statsd format %q (expected %q or %q)", format, FormatDogStatsD, FormatStatsD)
+	}
+	// Why connect a UDP socket? It resolves the address once, rather than on every write.
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to statsd agent at %s: %w", addr, err)
+	}
+	s := &StatsD{
+		conn:      conn,
+		prefix:    prefix,
+		tags:      strings.Join(tags, ","),
+		dogStatsD: format == FormatDogStatsD,
+		buf:       make([]byte, 0, maxPacketSize),
+		logger:    logger,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if interval <= 0 {
+		interval = time.Second
+	}
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+			}
+			s.mu.Lock()
+			s.flush()
+			s.mu.Unlock()
+		}
+	}()
+	return s, nil
+}
+
+// Close stops flushing, sends the metrics still buffered, and closes the connection to the
+// agent. Metrics observed afterwards are not sent.
+func (s *StatsD) Close() error {
+	close(s.stop)
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+	s.closed = true
+	return s.conn.Close()
+}
+
+// ObserveRequest sends a request counter, a duration timer and body size histograms.
+func (s *StatsD) ObserveRequest(route, method, status, country string, duration time.Duration, requestBytes, responseBytes int64) {
+	labels := [][2]string{{"route", route}, {"method", method}, {"status", status}}
+	if country != "" {
+		labels = append(labels, [2]string{"country", country})
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add("http.requests", "1|c", labels)
+	s.add("http.request_duration", fmt.Sprintf("%g|ms", float64(duration.Microseconds())/1000), labels)
+	s.add("http.request_size", fmt.Sprintf("%d|h", requestBytes), labels)
+	s.add("http.response_size", fmt.Sprintf("%d|h", responseBytes), labels)
+}
+
+// SetActiveTransfers sends the active uploads or downloads gauge.
+func (s *StatsD) SetActiveTransfers(direction string, n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add("active_transfers", fmt.Sprintf("%d|g", n), [][2]string{{"direction", direction}})
+}
+
+// SetQueuedJobs sends the queued background jobs gauge.
+func (s *StatsD) SetQueuedJobs(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add("jobs.queued", fmt.Sprintf("%d|g", n), nil)
+}
+
+// SetFreeSpace sends the free space gauges of a storage directory's disk.
+func (s *StatsD) SetFreeSpace(dir string, free int64, low bool) {
+	lowValue := 0
+	if low {
+		lowValue = 1
+	}
+	labels := [][2]string{{"dir", dir}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add("storage.free_bytes", fmt.Sprintf("%d|g", free), labels)
+	s.add("storage.low_space", fmt.Sprintf("%d|g", lowValue), labels)
+}
+
+// ObserveJob sends timers for how long a background job waited and ran.
+func (s *StatsD) ObserveJob(wait, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.add("jobs.wait", fmt.Sprintf("%g|ms", float64(wait.Microseconds())/1000), nil)
+	s.add("jobs.duration", fmt.Sprintf("%g|ms", float64(duration.Microseconds())/1000), nil)
+}
+
+// add appends one metric line to the buffer. The caller must hold the lock.
+func (s *StatsD) add(name, value string, labels [][2]string) {
+	if s.closed {
+		return
+	}
+	var line strings.Builder
+	line.WriteString(s.prefix)
+	line.WriteString(name)
+	if !s.dogStatsD {
+		for _, l := range labels {
+			line.WriteByte('.')
+			line.WriteString(sanitise(l[1]))
+		}
+	}
+	line.WriteByte(':')
+	line.WriteString(value)
+	if s.dogStatsD {
+		tags := make([]string, 0, len(labels)+1)
+		for _, l := range labels {
+			tags = append(tags, l[0]+":"+l[1])
+		}
+		if s.tags != "" {
+			tags = append(tags, s.tags)
+		}
+		// Why check? Unlabelled metrics without global tags must not end in an empty "|#".
+		if len(tags) > 0 {
+			line.WriteString("|#")
+			line.WriteString(strings.Join(tags, ","))
+		}
+	}
+
+	if len(s.buf) > 0 && len(s.buf)+1+line.Len() > maxPacketSize {
+		s.flush()
+	}
+	if len(s.buf) > 0 {
+		s.buf = append(s.buf, '\n')
+	}
+	s.buf = append(s.buf, line.String()...)
+}
+
+// flush sends the buffered lines as one packet. The caller must hold the lock.
+// Failures are logged once per outage, as the agent being down must not flood the log.
+func (s *StatsD) flush() {
+	if len(s.buf) == 0 {
+		return
+	}
+	_, err := s.conn.Write(s.buf)
+	s.buf = s.buf[:0]
+	switch {
+	case err != nil && !s.failing:
+		s.logger.Printf("error sending metrics to statsd: %v\n", err)
+		s.failing = true
+	case err == nil && s.failing:
+		s.logger.Printf("sending metrics to statsd again\n")
+		s.failing = false
+	}
+}
+
+// sanitise turns a label value into a StatsD name component, replacing characters
+// that carry meaning in the line format or in metric hierarchies.
+func sanitise(v string) string {
+	// "/download/{name...}" becomes "download_name".
+	v = strings.Trim(strings.ReplaceAll(v, "...", ""), "/")
+	if v == "" {
+		return "root"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '{', '}':
+			return -1
+		case '.', ':', '|', '@', '#', '/', ',', ' ', '\n':
+			return '_'
+		}
+		return r
+	}, v)
+}
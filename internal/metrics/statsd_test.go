@@ -0,0 +1,174 @@
+package metrics
+
+import (
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestStatsD returns a sink sending to a UDP socket on the loopback interface, and that
+// socket. The sink flushes only when its packet is full or it is closed.
+func newTestStatsD(t *testing.T, format string, tags []string) (*StatsD, net.PacketConn) {
+	t.Helper()
+	agent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { agent.Close() })
+	s, err := NewStatsD(agent.LocalAddr().String(), "fileserver.", format, tags, time.Hour, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, agent
+}
+
+// receive returns the packets sent to agent, until none arrives for a while.
+func receive(t *testing.T, agent net.PacketConn) []string {
+	t.Helper()
+	var packets []string
+	buf := make([]byte, 64<<10)
+	for {
+		agent.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := agent.ReadFrom(buf)
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, string(buf[:n]))
+	}
+}
+
+func TestStatsD(t *testing.T) {
+	tests := []struct {
+		format string
+		tags   []string
+		want   []string
+	}{
+		{FormatDogStatsD, []string{"env:test"}, []string{
+			"fileserver.active_transfers:1|g|#direction:upload,env:test",
+			"fileserver.active_transfers:0|g|#direction:upload,env:test",
+			"fileserver.http.requests:1|c|#route:/upload,method:POST,status:201,env:test",
+			"fileserver.http.request_size:5|h|#route:/upload,method:POST,status:201,env:test",
+			"fileserver.http.response_size:2|h|#route:/upload,method:POST,status:201,env:test",
+		}},
+		{FormatStatsD, nil, []string{
+			"fileserver.active_transfers.upload:1|g",
+			"fileserver.active_transfers.upload:0|g",
+			"fileserver.http.requests.upload.POST.201:1|c",
+			"fileserver.http.request_size.upload.POST.201:5|h",
+			"fileserver.http.response_size.upload.POST.201:2|h",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			s, agent := newTestStatsD(t, tt.format, tt.tags)
+			reg := newTestRegistry()
+			reg.AddSink(s)
+			handler := reg.Middleware(reg.Transfer("upload", func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte("ok"))
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", strings.NewReader("hello")))
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			packets := receive(t, agent)
+			if len(packets) != 1 {
+				t.Fatalf("got %d packets, want the lines batched into one", len(packets))
+			}
+			lines := make(map[string]bool)
+			for _, l := range strings.Split(packets[0], "\n") {
+				lines[l] = true
+			}
+			for _, l := range tt.want {
+				if !lines[l] {
+					t.Errorf("missing %s in:\n%s", l, packets[0])
+				}
+			}
+			if !strings.Contains(packets[0], "http.request_duration") {
+				t.Errorf("no request duration in:\n%s", packets[0])
+			}
+
+			// Nothing is sent once closed.
+			s.SetActiveTransfers("upload", 1)
+			if packets := receive(t, agent); len(packets) != 0 {
+				t.Errorf("sent %q after closing", packets)
+			}
+		})
+	}
+}
+
+func TestStatsDJobs(t *testing.T) {
+	s, agent := newTestStatsD(t, FormatStatsD, nil)
+	s.SetQueuedJobs(3)
+	s.ObserveJob(2*time.Second, 1500*time.Microsecond)
+	s.Close()
+	packets := receive(t, agent)
+	if want := "fileserver.jobs.queued:3|g\nfileserver.jobs.wait:2000|ms\nfileserver.jobs.duration:1.5|ms"; len(packets) != 1 || packets[0] != want {
+		t.Errorf("sent %q, want %q", packets, want)
+	}
+}
+
+func TestStatsDFreeSpace(t *testing.T) {
+	s, agent := newTestStatsD(t, FormatDogStatsD, nil)
+	s.SetFreeSpace("/srv/files", 1<<20, true)
+	s.Close()
+	packets := receive(t, agent)
+	if want := "fileserver.storage.free_bytes:1048576|g|#dir:/srv/files\nfileserver.storage.low_space:1|g|#dir:/srv/files"; len(packets) != 1 || packets[0] != want {
+		t.Errorf("sent %q, want %q", packets, want)
+	}
+}
+
+// TestStatsDPackets checks that lines are split into packets that are never fragmented.
+func TestStatsDPackets(t *testing.T) {
+	s, agent := newTestStatsD(t, FormatDogStatsD, nil)
+	for range 200 {
+		s.SetActiveTransfers("download", 1)
+	}
+	s.Close()
+	packets := receive(t, agent)
+	if len(packets) < 2 {
+		t.Fatalf("got %d packets, want several", len(packets))
+	}
+	lines := 0
+	for _, p := range packets {
+		if len(p) > maxPacketSize {
+			t.Errorf("packet of %d bytes, over %d", len(p), maxPacketSize)
+		}
+		lines += strings.Count(p, "\n") + 1
+	}
+	if lines != 200 {
+		t.Errorf("got %d lines, want 200", lines)
+	}
+}
+
+func TestNewStatsD(t *testing.T) {
+	if _, err := NewStatsD("127.0.0.1:8125", "", "graphite", nil, time.Second, nil); err == nil {
+		t.Error("accepted an unknown format")
+	}
+}
+
+func TestSanitise(t *testing.T) {
+	tests := []struct {
+		v, want string
+	}{
+		{"/download/{name...}", "download_name"},
+		{"/api/files/by-id/{id}", "api_files_by-id_id"},
+		{"/", "root"},
+		{"unmatched", "unmatched"},
+		{"a.b:c|d@e#f,g h", "a_b_c_d_e_f_g_h"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			if got := sanitise(tt.v); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+// Package mirror fetches files from the upstream server that a mirroring instance caches, on
+// the first request for each.
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// ErrNotFound is returned for a file the upstream server does not have either.
+var ErrNotFound = errors.New("file is not found upstream")
+
+// StatusError is returned for an upstream server answering with anything but success.
+type StatusError struct {
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "upstream server answered " + e.Status
+}
+
+// Mirror fetches files from an upstream server, by appending their names to its base URL.
+type Mirror struct {
+	base   *url.URL
+	auth   string
+	client *http.Client
+
+	mu    sync.Mutex
+	pulls map[string]*pull
+}
+
+// pull is a fetch of one file in progress, which later requests for it wait for.
+type pull struct {
+	done chan struct{}
+	err  error
+}
+
+// New returns a mirror of the upstream configured by cfg, or nil if there is none.
+func New(cfg config.MirrorConfig) (*Mirror, error) {
+	if cfg.Upstream == "" {
+		return nil, nil
+	}
+	base, err := url.Parse(cfg.Upstream)
+	if err != nil {
+		return nil, fmt.Errorf("invalid mirror upstream: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" || base.Host == "" {
+		return nil, fmt.Errorf("invalid mirror upstream %q: must be an http or https URL", cfg.Upstream)
+	}
+	return &Mirror{
+		base:   base,
+		auth:   cfg.Authorization,
+		client: &http.Client{Timeout: cfg.Timeout},
+		pulls:  make(map[string]*pull),
+	}, nil
+}
+
+// URL returns the upstream URL of the file name.
+func (m *Mirror) URL(name string) string {
+	return m.base.JoinPath(strings.Split(name, "/")...).String()
+}
+
+// Get requests the file name from the upstream server, and returns the response if it
+// answered with success. The caller must close its body.
+func (m *Mirror) Get(ctx context.Context, name string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.URL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.auth != "" {
+		req.Header.Set("Authorization", m.auth)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		resp.Body.Close()
+		return nil, &StatusError{Status: resp.Status}
+	}
+}
+
+// Once calls fn to pull the file name, unless a pull of it is already in progress, in which
+// case it waits for that one instead. Either way, it returns the error of the pull.
+//
+// Why share pulls? A file that becomes popular is typically requested many times at once on
+// its first appearance, and each miss would otherwise download it from the upstream again.
+func (m *Mirror) Once(name string, fn func() error) error {
+	m.mu.Lock()
+	if p, ok := m.pulls[name]; ok {
+		m.mu.Unlock()
+		<-p.done
+		return p.err
+	}
+	p := &pull{done: make(chan struct{})}
+	m.pulls[name] = p
+	m.mu.Unlock()
+
+	p.err = fn()
+	m.mu.Lock()
+	delete(m.pulls, name)
+	m.mu.Unlock()
+	close(p.done)
+	return p.err
+}
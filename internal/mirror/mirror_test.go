@@ -0,0 +1,181 @@
+package mirror
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		upstream string
+		wantErr  bool
+	}{
+		{"https://files.example.com/download/", false},
+		{"http://10.0.0.1:8080", false},
+		{"ftp://files.example.com/", true},
+		{"files.example.com/download", true},
+		{"https://", true},
+		{"http://%zz", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.upstream, func(t *testing.T) {
+			m, err := New(config.MirrorConfig{Upstream: tt.upstream})
+			if (err != nil) != tt.wantErr || (m == nil) != tt.wantErr {
+				t.Errorf("got %v, %v, want an error: %v", m, err, tt.wantErr)
+			}
+		})
+	}
+	if m, err := New(config.MirrorConfig{}); m != nil || err != nil {
+		t.Errorf("got %v, %v with no upstream, want no mirror", m, err)
+	}
+}
+
+func TestURL(t *testing.T) {
+	m, err := New(config.MirrorConfig{Upstream: "https://files.example.com/download/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.txt", "https://files.example.com/download/a.txt"},
+		{"docs/2024/report final.pdf", "https://files.example.com/download/docs/2024/report%20final.pdf"},
+		{"q?a#b.txt", "https://files.example.com/download/q%3Fa%23b.txt"},
+	}
+	for _, tt := range tests {
+		if got := m.URL(tt.name); got != tt.want {
+			t.Errorf("got %s for %q, want %s", got, tt.name, tt.want)
+		}
+	}
+}
+
+func TestGet(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/download/a.txt":
+			io.WriteString(w, "a")
+		case "/download/gone.txt":
+			w.WriteHeader(http.StatusGone)
+		case "/download/broken.txt":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	tests := []struct {
+		name       string
+		auth       string
+		want       string
+		wantErr    error
+		wantStatus string // of a StatusError
+	}{
+		{"a.txt", "Bearer secret", "a", nil, ""},
+		{"missing.txt", "Bearer secret", "", ErrNotFound, ""},
+		{"gone.txt", "Bearer secret", "", ErrNotFound, ""},
+		{"broken.txt", "Bearer secret", "", nil, "500 Internal Server Error"},
+		{"a.txt", "", "", nil, "401 Unauthorized"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := New(config.MirrorConfig{Upstream: upstream.URL + "/download/", Authorization: tt.auth, Timeout: time.Minute})
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := m.Get(t.Context(), tt.name)
+			var statusErr *StatusError
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("got error %v, want %v", err, tt.wantErr)
+				}
+			case tt.wantStatus != "":
+				if !errors.As(err, &statusErr) || statusErr.Status != tt.wantStatus {
+					t.Errorf("got error %v, want the status %s", err, tt.wantStatus)
+				}
+			case err != nil:
+				t.Fatal(err)
+			default:
+				defer resp.Body.Close()
+				if b, _ := io.ReadAll(resp.Body); string(b) != tt.want {
+					t.Errorf("got %q, want %q", b, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestOnce(t *testing.T) {
+	m, err := New(config.MirrorConfig{Upstream: "https://files.example.com/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	errPull := errors.New("pull failed")
+	release := make(chan struct{})
+	var calls atomic.Int32
+	pull := func() error {
+		calls.Add(1)
+		<-release
+		return errPull
+	}
+
+	// Requests for a file being pulled wait for that pull, and share its outcome.
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	wg.Go(func() { errs <- m.Once("a.txt", pull) })
+	for range 100 {
+		m.mu.Lock()
+		_, started := m.pulls["a.txt"]
+		m.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	waiting := make(chan struct{}, 4)
+	for range 4 {
+		wg.Go(func() {
+			waiting <- struct{}{}
+			errs <- m.Once("a.txt", func() error { return errors.New("pulled twice") })
+		})
+	}
+	for range 4 {
+		<-waiting
+	}
+	// A different file does not wait.
+	if err := m.Once("b.txt", func() error { return nil }); err != nil {
+		t.Errorf("got %v pulling another file", err)
+	}
+	// Gives the waiting requests the time to reach Once.
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if !errors.Is(err, errPull) {
+			t.Errorf("got %v, want the error of the shared pull", err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("pulled %d times, want once", calls.Load())
+	}
+
+	// Once finished, the next request pulls again.
+	if err := m.Once("a.txt", func() error { return nil }); err != nil {
+		t.Errorf("got %v pulling again", err)
+	}
+}
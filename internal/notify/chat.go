@@ -0,0 +1,128 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// telegramAPI is the Telegram Bot API endpoint messages are sent through.
+const telegramAPI = "https://api.telegram.org"
+
+// chat posts a one-line message about each event to a Slack or Mattermost channel (through
+// an incoming webhook) or a Telegram chat (through a bot).
+type chat struct {
+	kind   string
+	url    string
+	chatID string
+	client *http.Client
+}
+
+// newChat validates the settings of one chat notifier.
+func newChat(cfg config.ChatConfig) (*chat, error) {
+	c := &chat{kind: cfg.Type, client: &http.Client{Timeout: 10 * time.Second}}
+	switch cfg.Type {
+	case "slack", "mattermost":
+		u, err := url.Parse(cfg.WebhookURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return nil, fmt.Errorf("%s needs an http(s) webhookURL", cfg.Type)
+		}
+		c.url = cfg.WebhookURL
+	case "telegram":
+		if cfg.BotToken == "" || cfg.ChatID == "" {
+			return nil, errors.New("telegram needs a botToken and a chatID")
+		}
+		c.url = telegramAPI + "/bot" + cfg.BotToken + "/sendMessage"
+		c.chatID = cfg.ChatID
+	default:
+		return nil, fmt.Errorf("chat type must be slack, mattermost or telegram, not %q", cfg.Type)
+	}
+	return c, nil
+}
+
+func (c *chat) name() string {
+	return c.kind
+}
+
+// send posts the message for ev.
+func (c *chat) send(ev Event) error {
+	var payload any
+	switch c.kind {
+	case "slack":
+		payload = map[string]string{"text": c.text(ev, slackLink, slackEscape)}
+	case "mattermost":
+		payload = map[string]string{"text": c.text(ev, markdownLink, markdownEscape)}
+	case "telegram":
+		payload = map[string]any{
+			"chat_id":                  c.chatID,
+			"text":                     c.text(ev, htmlLink, html.EscapeString),
+			"parse_mode":               "HTML",
+			"disable_web_page_preview": true,
+		}
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// Why unwrap? The error would otherwise quote the URL, and with it the webhook
+		// secret or bot token, in the log.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded with %s", c.kind, resp.Status)
+	}
+	return nil
+}
+
+// text renders the message for ev in the chat's markup, using link to format a link and
+// escape to quote text that must not be interpreted as markup.
+func (c *chat) text(ev Event, link func(text, url string) string, escape func(string) string) string {
+	name := escape(ev.Name)
+	if ev.Link != "" {
+		name = link(name, ev.Link)
+	}
+	switch ev.Type {
+	case Delete:
+		return fmt.Sprintf("%s deleted %s", escape(ev.User), name)
+	case Modify:
+		return fmt.Sprintf("%s wrote to %s (now %s)", escape(ev.User), name, formatSize(ev.Size))
+	case LowSpace:
+		return fmt.Sprintf("%s is low on space, with %s free: uploads to it are refused", name, formatSize(ev.Size))
+	}
+	return fmt.Sprintf("%s uploaded %s (%s)", escape(ev.User), name, formatSize(ev.Size))
+}
+
+// Slack's mrkdwn only needs these three characters escaped.
+var slackEscape = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace
+
+func slackLink(text, url string) string {
+	return "<" + url + "|" + text + ">"
+}
+
+// markdownEscape keeps file names such as "a_b_c.txt" from being rendered as emphasis.
+var markdownEscape = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`, "~", `\~`, "#", `\#`,
+).Replace
+
+func markdownLink(text, url string) string {
+	return "[" + text + "](" + url + ")"
+}
+
+func htmlLink(text, url string) string {
+	return `<a href="` + html.EscapeString(url) + `">` + text + "</a>"
+}
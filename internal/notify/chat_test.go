@@ -0,0 +1,129 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestChatMessages(t *testing.T) {
+	ev := Event{Type: Upload, Name: "docs/a_<b>*c.txt", Size: 3 << 20, User: "alice", Link: "https://files.example.com/download/docs/a_%3Cb%3E%2Ac.txt"}
+	tests := []struct {
+		cfg  config.ChatConfig
+		want map[string]any
+	}{
+		{config.ChatConfig{Type: "slack"}, map[string]any{
+			"text": "alice uploaded <https://files.example.com/download/docs/a_%3Cb%3E%2Ac.txt|docs/a_&lt;b&gt;*c.txt> (3.0 MB)",
+		}},
+		{config.ChatConfig{Type: "mattermost"}, map[string]any{
+			"text": `alice uploaded [docs/a\_<b>\*c.txt](https://files.example.com/download/docs/a_%3Cb%3E%2Ac.txt) (3.0 MB)`,
+		}},
+		{config.ChatConfig{Type: "telegram", BotToken: "123:secret", ChatID: "-100"}, map[string]any{
+			"chat_id":                  "-100",
+			"text":                     `alice uploaded <a href="https://files.example.com/download/docs/a_%3Cb%3E%2Ac.txt">docs/a_&lt;b&gt;*c.txt</a> (3.0 MB)`,
+			"parse_mode":               "HTML",
+			"disable_web_page_preview": true,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.cfg.Type, func(t *testing.T) {
+			var got map[string]any
+			var path string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				path = r.URL.Path
+				json.NewDecoder(r.Body).Decode(&got)
+			}))
+			defer srv.Close()
+
+			tt.cfg.WebhookURL = srv.URL + "/hooks/xyz"
+			c, err := newChat(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantPath := "/hooks/xyz"
+			if tt.cfg.Type == "telegram" {
+				c.url = strings.Replace(c.url, telegramAPI, srv.URL, 1)
+				wantPath = "/bot123:secret/sendMessage"
+			}
+			if err := c.send(ev); err != nil {
+				t.Fatal(err)
+			}
+			if path != wantPath {
+				t.Errorf("posted to %s, want %s", path, wantPath)
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("posted %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				if got[k] != v {
+					t.Errorf("posted %s %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+// TestChatErrors checks that failures are reported without the secret in the URL.
+func TestChatErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer srv.Close()
+	c, err := newChat(config.ChatConfig{Type: "slack", WebhookURL: srv.URL + "/services/secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.send(Event{Type: Delete, Name: "a.txt"}); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("got %v, want the status reported", err)
+	}
+
+	srv.Close()
+	if err := c.send(Event{Type: Delete, Name: "a.txt"}); err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("got %v, want an error without the webhook URL", err)
+	}
+}
+
+func TestNewChat(t *testing.T) {
+	tests := []struct {
+		desc    string
+		cfg     config.ChatConfig
+		wantErr bool
+	}{
+		{"slack", config.ChatConfig{Type: "slack", WebhookURL: "https://hooks.slack.com/services/T/B/X"}, false},
+		{"mattermost", config.ChatConfig{Type: "mattermost", WebhookURL: "http://chat.internal/hooks/x"}, false},
+		{"telegram", config.ChatConfig{Type: "telegram", BotToken: "123:secret", ChatID: "-100"}, false},
+		{"slack without a webhook", config.ChatConfig{Type: "slack"}, true},
+		{"a webhook that is not http", config.ChatConfig{Type: "mattermost", WebhookURL: "ftp://chat.internal/hooks/x"}, true},
+		{"telegram without a chat", config.ChatConfig{Type: "telegram", BotToken: "123:secret"}, true},
+		{"an unknown type", config.ChatConfig{Type: "discord", WebhookURL: "https://discord.com/api/webhooks/x"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if _, err := newChat(tt.cfg); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{5 << 30, "5.0 GB"},
+	}
+	for _, tt := range tests {
+		if got := formatSize(tt.n); got != tt.want {
+			t.Errorf("formatSize(%d) = %s, want %s", tt.n, got, tt.want)
+		}
+	}
+}
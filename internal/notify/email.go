@@ -0,0 +1,206 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// smtpTimeout bounds a whole delivery, so a mail server that stops responding cannot
+// stall the queue indefinitely.
+const smtpTimeout = 30 * time.Second
+
+// email sends a templated message to a fixed list of recipients through an SMTP server.
+type email struct {
+	host     string
+	addr     string
+	security string
+	auth     smtp.Auth
+	from     string
+	to       []string
+	// envelopeFrom and envelopeTo are the bare addresses of from and to, without any display
+	// names, as the SMTP commands take them.
+	envelopeFrom string
+	envelopeTo   []string
+	subject      *template.Template
+	body         *template.Template
+	hostname     string
+}
+
+// newEmail validates the email settings and parses the templates.
+func newEmail(cfg config.EmailConfig) (*email, error) {
+	switch cfg.Security {
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("email security must be starttls, tls or none, not %q", cfg.Security)
+	}
+	from, err := mail.ParseAddress(cfg.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid email sender %q: %w", cfg.From, err)
+	}
+	if len(cfg.To) == 0 {
+		return nil, errors.New("email notifications need at least one recipient")
+	}
+	var envelopeTo []string
+	for _, to := range cfg.To {
+		addr, err := mail.ParseAddress(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid email recipient %q: %w", to, err)
+		}
+		envelopeTo = append(envelopeTo, addr.Address)
+	}
+	subject, err := template.New("subject").Parse(cfg.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("parsing email subject template: %w", err)
+	}
+	body, err := template.New("body").Parse(cfg.Body)
+	if err != nil {
+		return nil, fmt.Errorf("parsing email body template: %w", err)
+	}
+	// Why render a sample event now? A template naming a field that does not exist only
+	// fails when executed, which would otherwise surface with the first upload.
+	sample := Event{Type: Upload, Name: "example.txt", User: "anonymous", Time: time.Now()}
+	for _, t := range []*template.Template{subject, body} {
+		if err := t.Execute(&bytes.Buffer{}, sample); err != nil {
+			return nil, fmt.Errorf("email %s template: %w", t.Name(), err)
+		}
+	}
+
+	e := &email{
+		host:         cfg.Host,
+		addr:         net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		security:     cfg.Security,
+		from:         cfg.From,
+		to:           cfg.To,
+		envelopeFrom: from.Address,
+		envelopeTo:   envelopeTo,
+		subject:      subject,
+		body:         body,
+	}
+	if cfg.Username != "" {
+		// smtp.PlainAuth refuses to send the password over an unencrypted connection
+		// to anything other than localhost.
+		e.auth = smtp.PlainAuth("", cfg.Username, cfg.Password, cfg.Host)
+	}
+	e.hostname, _ = os.Hostname()
+	if e.hostname == "" {
+		e.hostname = "localhost"
+	}
+	return e, nil
+}
+
+func (e *email) name() string {
+	return "email"
+}
+
+// send renders the message for ev and delivers it.
+func (e *email) send(ev Event) error {
+	msg, err := e.message(ev)
+	if err != nil {
+		return err
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	if e.security == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", e.addr, &tls.Config{ServerName: e.host})
+	} else {
+		conn, err = dialer.Dial("tcp", e.addr)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	c, err := smtp.NewClient(conn, e.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello(e.hostname); err != nil {
+		return err
+	}
+	if e.security == "starttls" {
+		// Why refuse rather than fall back to plain text? The downgrade would go unnoticed,
+		// and the message and credentials would cross the network unencrypted.
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("mail server %s does not support STARTTLS", e.addr)
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: e.host}); err != nil {
+			return err
+		}
+	}
+	if e.auth != nil {
+		if err := c.Auth(e.auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.envelopeFrom); err != nil {
+		return err
+	}
+	for _, to := range e.envelopeTo {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s: %w", to, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// message renders the complete RFC 5322 message for ev.
+func (e *email) message(ev Event) ([]byte, error) {
+	var subject, body bytes.Buffer
+	if err := e.subject.Execute(&subject, ev); err != nil {
+		return nil, err
+	}
+	if err := e.body.Execute(&body, ev); err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+
+	var msg bytes.Buffer
+	header := func(name, value string) {
+		fmt.Fprintf(&msg, "%s: %s\r\n", name, value)
+	}
+	header("From", e.from)
+	header("To", strings.Join(e.to, ", "))
+	// File names come from clients; folding the subject onto one line keeps a name
+	// containing line breaks from adding headers of its own.
+	header("Subject", mime.QEncoding.Encode("utf-8", strings.Join(strings.Fields(subject.String()), " ")))
+	header("Date", ev.Time.Format(time.RFC1123Z))
+	header("Message-ID", fmt.Sprintf("<%s@%s>", hex.EncodeToString(id), e.hostname))
+	header("MIME-Version", "1.0")
+	header("Content-Type", "text/plain; charset=utf-8")
+	header("Content-Transfer-Encoding", "quoted-printable")
+	msg.WriteString("\r\n")
+	qp := quotedprintable.NewWriter(&msg)
+	qp.Write(body.Bytes())
+	qp.Close()
+	return msg.Bytes(), nil
+}
@@ -0,0 +1,192 @@
+package notify
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// delivery is a message accepted by a fake mail server.
+type delivery struct {
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP starts a mail server that accepts every message without encryption or
+// authentication, and returns its port and the messages it accepts.
+func fakeSMTP(t *testing.T) (int, <-chan delivery) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	deliveries := make(chan delivery, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := textproto.NewConn(conn)
+				c.PrintfLine("220 localhost ESMTP")
+				var d delivery
+				for {
+					line, err := c.ReadLine()
+					if err != nil {
+						return
+					}
+					verb, arg, _ := strings.Cut(line, " ")
+					switch strings.ToUpper(verb) {
+					case "EHLO", "HELO":
+						c.PrintfLine("250 localhost")
+					case "MAIL":
+						d = delivery{from: arg}
+						c.PrintfLine("250 OK")
+					case "RCPT":
+						d.to = append(d.to, arg)
+						c.PrintfLine("250 OK")
+					case "DATA":
+						c.PrintfLine("354 go ahead")
+						data, err := c.ReadDotBytes()
+						if err != nil {
+							return
+						}
+						d.data = string(data)
+						deliveries <- d
+						c.PrintfLine("250 OK")
+					case "QUIT":
+						c.PrintfLine("221 bye")
+						return
+					default:
+						c.PrintfLine("502 not implemented")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port, deliveries
+}
+
+func TestEmail(t *testing.T) {
+	port, deliveries := fakeSMTP(t)
+	cfg := config.Default()
+	cfg.Notifications.Email.Host = "127.0.0.1"
+	cfg.Notifications.Email.Port = port
+	cfg.Notifications.Email.Security = "none"
+	cfg.Notifications.Email.From = "File Server <files@example.com>"
+	cfg.Notifications.Email.To = []string{"alice@example.com", "Bob <bob@example.com>"}
+	cfg.Notifications.Email.Paths = []string{"reports"}
+	n, err := New(cfg, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+
+	// Only uploads below the paths are emailed about.
+	n.Notify(Event{Type: Upload, Name: "public/a.txt", Size: 1, User: "alice"})
+	n.Notify(Event{Type: Delete, Name: "reports/old.pdf", User: "alice"})
+	n.Notify(Event{Type: Upload, Name: "reports/résumé\r\nBcc: eve@example.com.pdf", Size: 1024, User: "alice",
+		Time: time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)})
+
+	var d delivery
+	select {
+	case d = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email sent")
+	}
+	// The envelope takes bare addresses, without the display names of the headers.
+	if d.from != "FROM:<files@example.com>" || strings.Join(d.to, " ") != "TO:<alice@example.com> TO:<bob@example.com>" {
+		t.Errorf("sent from %s to %v", d.from, d.to)
+	}
+	msg, err := mail.ReadMessage(bufio.NewReader(strings.NewReader(d.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Bcc"); got != "" {
+		t.Errorf("file name added the header Bcc: %s", got)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if want := "New upload: reports/résumé Bcc: eve@example.com.pdf"; err != nil || subject != want {
+		t.Errorf("got subject %q, %v, want %q", subject, err, want)
+	}
+	if msg.Header.Get("To") != "alice@example.com, Bob <bob@example.com>" || msg.Header.Get("Message-ID") == "" {
+		t.Errorf("got headers %v", msg.Header)
+	}
+	body, err := io.ReadAll(quotedprintable.NewReader(msg.Body))
+	if want := "alice uploaded reports/résumé\nBcc: eve@example.com.pdf (1024 bytes) at 2026-01-02 15:04:05 UTC.\n"; err != nil || string(body) != want {
+		t.Errorf("got body %q, %v, want %q", body, err, want)
+	}
+
+	select {
+	case d := <-deliveries:
+		t.Errorf("sent another email: %s", d.data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// TestEmailStartTLS checks that a mail server unable to encrypt the connection is refused
+// rather than sent the message in plain text.
+func TestEmailStartTLS(t *testing.T) {
+	port, deliveries := fakeSMTP(t)
+	cfg := config.Default().Notifications.Email
+	cfg.Host = "127.0.0.1"
+	cfg.Port = port
+	cfg.From = "files@example.com"
+	cfg.To = []string{"alice@example.com"}
+	e, err := newEmail(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.send(Event{Type: Upload, Name: "a.txt", User: "alice", Time: time.Now()}); err == nil || !strings.Contains(err.Error(), "STARTTLS") {
+		t.Errorf("got %v, want STARTTLS refused", err)
+	}
+	select {
+	case <-deliveries:
+		t.Error("sent the email unencrypted")
+	default:
+	}
+}
+
+func TestNewEmail(t *testing.T) {
+	valid := config.Default().Notifications.Email
+	valid.Host, valid.From, valid.To = "smtp.example.com", "files@example.com", []string{"alice@example.com"}
+	tests := []struct {
+		desc      string
+		configure func(cfg *config.EmailConfig)
+		wantErr   bool
+	}{
+		{"the defaults", func(cfg *config.EmailConfig) {}, false},
+		{"an unknown security", func(cfg *config.EmailConfig) { cfg.Security = "ssl" }, true},
+		{"an invalid sender", func(cfg *config.EmailConfig) { cfg.From = "files" }, true},
+		{"no recipients", func(cfg *config.EmailConfig) { cfg.To = nil }, true},
+		{"an invalid recipient", func(cfg *config.EmailConfig) { cfg.To = []string{"alice@example.com", "bob"} }, true},
+		{"a malformed template", func(cfg *config.EmailConfig) { cfg.Subject = "{{.Name" }, true},
+		{"a template naming an unknown field", func(cfg *config.EmailConfig) { cfg.Body = "{{.Filename}}" }, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := valid
+			tt.configure(&cfg)
+			if e, err := newEmail(cfg); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			} else if err == nil && e.addr != "smtp.example.com:"+strconv.Itoa(cfg.Port) {
+				t.Errorf("got address %s", e.addr)
+			}
+		})
+	}
+}
@@ -0,0 +1,493 @@
+package notify
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// Kafka API keys and the versions used. Why these versions? They are supported by every
+// broker from Kafka 1.0 up to and including 4.x, which dropped many older ones.
+const (
+	kafkaProduce          = 0
+	kafkaMetadata         = 3
+	kafkaSaslHandshake    = 17
+	kafkaSaslAuthenticate = 36
+
+	kafkaProduceVersion  = 3
+	kafkaMetadataVersion = 4
+)
+
+// kafkaErrors names the error codes a producer is likely to meet.
+var kafkaErrors = map[int16]string{
+	3:  "unknown topic or partition",
+	5:  "leader not available",
+	6:  "not leader for partition",
+	7:  "request timed out",
+	10: "message too large",
+	19: "not enough replicas",
+	20: "not enough replicas after append",
+	29: "topic authorisation failed",
+	33: "unsupported SASL mechanism",
+	58: "SASL authentication failed",
+}
+
+func kafkaError(code int16) error {
+	if msg, ok := kafkaErrors[code]; ok {
+		return errors.New(msg)
+	}
+	return fmt.Errorf("error code %d", code)
+}
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaBroker produces to a Kafka topic using Kafka's binary protocol, waiting for every
+// in-sync replica to store each message (acks=all).
+//
+// Why pick the partition from the file name? Kafka only orders messages within a partition,
+// so this keeps the events about any one file in order.
+type kafkaBroker struct {
+	addrs []string
+	topic string
+	tls   bool
+	user  string
+	pass  string
+
+	nodes      map[int32]string // broker addresses by node ID
+	partitions []kafkaPartition // nil until metadata has been fetched
+	conns      map[int32]*kafkaConn
+}
+
+type kafkaPartition struct {
+	id, leader int32
+}
+
+func newKafka(cfg config.PublishConfig) *kafkaBroker {
+	addrs := cfg.Addresses
+	if len(addrs) == 0 {
+		addrs = []string{"127.0.0.1:9092"}
+	}
+	return &kafkaBroker{
+		addrs: addrs,
+		topic: cfg.Topic,
+		tls:   cfg.TLS,
+		user:  cfg.Username,
+		pass:  cfg.Password,
+		conns: map[int32]*kafkaConn{},
+	}
+}
+
+func (b *kafkaBroker) publish(key string, payload []byte) error {
+	err := b.produce(key, payload)
+	if err != nil {
+		// Leadership may have moved or a broker gone away, so the next attempt starts
+		// from fresh metadata and connections.
+		b.reset()
+	}
+	return err
+}
+
+func (b *kafkaBroker) produce(key string, payload []byte) error {
+	if b.partitions == nil {
+		if err := b.fetchMetadata(); err != nil {
+			return err
+		}
+	}
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	part := b.partitions[h.Sum32()%uint32(len(b.partitions))]
+	conn, err := b.connTo(part.leader)
+	if err != nil {
+		return err
+	}
+
+	var req kafkaWriter
+	req.int16(-1) // no transactional ID
+	req.int16(-1) // acks: all in-sync replicas
+	req.int32(int32(brokerTimeout / time.Millisecond))
+	req.int32(1)
+	req.string(b.topic)
+	req.int32(1)
+	req.int32(part.id)
+	req.bytes(recordBatch([]byte(key), payload, time.Now()))
+	resp, err := conn.request(kafkaProduce, kafkaProduceVersion, req.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	r := kafkaReader{b: resp}
+	for range r.count() {
+		r.string()
+		for range r.count() {
+			r.int32() // partition
+			if code := r.int16(); code != 0 && r.err == nil {
+				return kafkaError(code)
+			}
+			r.int64() // base offset
+			r.int64() // log append time
+		}
+	}
+	return r.err
+}
+
+// fetchMetadata finds the partitions of the topic and their leaders through the first
+// reachable bootstrap server, which creates the topic if the cluster allows it.
+func (b *kafkaBroker) fetchMetadata() error {
+	var conn *kafkaConn
+	var errs []error
+	for _, addr := range b.addrs {
+		c, err := b.dial(addr)
+		if err == nil {
+			conn = c
+			break
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	if conn == nil {
+		return errors.Join(errs...)
+	}
+	defer conn.close()
+
+	var req kafkaWriter
+	req.int32(1)
+	req.string(b.topic)
+	req.bool(true) // allow automatic topic creation
+	resp, err := conn.request(kafkaMetadata, kafkaMetadataVersion, req.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	r := kafkaReader{b: resp}
+	r.int32() // throttle time
+	nodes := map[int32]string{}
+	for range r.count() {
+		id := r.int32()
+		host := r.string()
+		port := r.int32()
+		r.string() // rack
+		nodes[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	r.string() // cluster ID
+	r.int32()  // controller ID
+	var partitions []kafkaPartition
+	for range r.count() {
+		code := r.int16()
+		r.string() // name
+		r.bool()   // internal
+		if code != 0 && r.err == nil {
+			return fmt.Errorf("topic %s: %w", b.topic, kafkaError(code))
+		}
+		for range r.count() {
+			r.int16() // partition error, e.g. an unavailable replica; the leader decides
+			p := kafkaPartition{id: r.int32(), leader: r.int32()}
+			for range r.count() {
+				r.int32() // replicas
+			}
+			for range r.count() {
+				r.int32() // in-sync replicas
+			}
+			if p.leader < 0 && r.err == nil {
+				return fmt.Errorf("topic %s: partition %d: %w", b.topic, p.id, kafkaError(5))
+			}
+			partitions = append(partitions, p)
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if len(partitions) == 0 {
+		return fmt.Errorf("topic %s has no partitions", b.topic)
+	}
+	// Partition indices must be stable, whatever order the broker lists them in.
+	ordered := make([]kafkaPartition, len(partitions))
+	for _, p := range partitions {
+		if p.id < 0 || int(p.id) >= len(ordered) {
+			return fmt.Errorf("topic %s: unexpected partition %d", b.topic, p.id)
+		}
+		ordered[p.id] = p
+	}
+	b.nodes, b.partitions = nodes, ordered
+	return nil
+}
+
+// connTo returns a connection to the broker with the given node ID.
+func (b *kafkaBroker) close() {
+	b.reset()
+}
+
+func (b *kafkaBroker) connTo(node int32) (*kafkaConn, error) {
+	if c, ok := b.conns[node]; ok {
+		return c, nil
+	}
+	addr, ok := b.nodes[node]
+	if !ok {
+		return nil, fmt.Errorf("unknown broker %d", node)
+	}
+	c, err := b.dial(addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", addr, err)
+	}
+	b.conns[node] = c
+	return c, nil
+}
+
+func (b *kafkaBroker) reset() {
+	for id, c := range b.conns {
+		c.close()
+		delete(b.conns, id)
+	}
+	b.partitions = nil
+}
+
+// dial connects to a broker and authenticates if a username is configured.
+func (b *kafkaBroker) dial(addr string) (*kafkaConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, brokerTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if b.tls {
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		conn.SetDeadline(time.Now().Add(brokerTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	c := &kafkaConn{conn: conn, r: bufio.NewReader(conn)}
+	if b.user != "" {
+		if err := c.saslPlain(b.user, b.pass); err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// kafkaConn is a connection to one broker.
+type kafkaConn struct {
+	conn        net.Conn
+	r           *bufio.Reader
+	correlation int32
+}
+
+// request sends a request and returns the body of the broker's response.
+func (c *kafkaConn) request(key, version int16, body []byte) ([]byte, error) {
+	c.correlation++
+	var req kafkaWriter
+	req.int32(0) // size, filled in below
+	req.int16(key)
+	req.int16(version)
+	req.int32(c.correlation)
+	req.string("fileserver")
+	req.buf.Write(body)
+	data := req.buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+
+	c.conn.SetDeadline(time.Now().Add(brokerTimeout))
+	if _, err := c.conn.Write(data); err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	if _, err := io.ReadFull(c.r, header[:]); err != nil {
+		return nil, err
+	}
+	size := int32(binary.BigEndian.Uint32(header[:4]))
+	if size < 4 || size > 64<<20 {
+		return nil, fmt.Errorf("invalid response size %d", size)
+	}
+	if id := int32(binary.BigEndian.Uint32(header[4:])); id != c.correlation {
+		return nil, fmt.Errorf("response to request %d received for request %d", id, c.correlation)
+	}
+	resp := make([]byte, size-4)
+	if _, err := io.ReadFull(c.r, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// saslPlain authenticates with the SASL PLAIN mechanism, which sends the password as is;
+// it should only be used over TLS or a trusted network.
+func (c *kafkaConn) saslPlain(user, pass string) error {
+	var req kafkaWriter
+	req.string("PLAIN")
+	resp, err := c.request(kafkaSaslHandshake, 1, req.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	r := kafkaReader{b: resp}
+	if code := r.int16(); code != 0 && r.err == nil {
+		return kafkaError(code)
+	}
+
+	req = kafkaWriter{}
+	req.bytes([]byte("\x00" + user + "\x00" + pass))
+	if resp, err = c.request(kafkaSaslAuthenticate, 0, req.buf.Bytes()); err != nil {
+		return err
+	}
+	r = kafkaReader{b: resp}
+	code := r.int16()
+	msg := r.string()
+	if r.err != nil {
+		return r.err
+	}
+	if code != 0 {
+		if msg != "" {
+			return errors.New(msg)
+		}
+		return kafkaError(code)
+	}
+	return nil
+}
+
+func (c *kafkaConn) close() {
+	c.conn.Close()
+}
+
+// recordBatch encodes a single record in the v2 record batch format.
+func recordBatch(key, value []byte, now time.Time) []byte {
+	var rec kafkaWriter
+	rec.int8(0)   // attributes
+	rec.varint(0) // timestamp delta
+	rec.varint(0) // offset delta
+	rec.varint(int64(len(key)))
+	rec.buf.Write(key)
+	rec.varint(int64(len(value)))
+	rec.buf.Write(value)
+	rec.varint(0) // headers
+
+	// The CRC covers everything from the attributes onwards.
+	var tail kafkaWriter
+	ms := now.UnixMilli()
+	tail.int16(0) // attributes: no compression, create time
+	tail.int32(0) // last offset delta
+	tail.int64(ms)
+	tail.int64(ms)
+	tail.int64(-1) // producer ID
+	tail.int16(-1) // producer epoch
+	tail.int32(-1) // base sequence
+	tail.int32(1)  // records
+	tail.varint(int64(rec.buf.Len()))
+	tail.buf.Write(rec.buf.Bytes())
+
+	var batch kafkaWriter
+	batch.int64(0)                                 // base offset
+	batch.int32(int32(4 + 1 + 4 + tail.buf.Len())) // length after this field
+	batch.int32(-1)                                // partition leader epoch
+	batch.int8(2)                                  // magic
+	batch.int32(int32(crc32.Checksum(tail.buf.Bytes(), castagnoli)))
+	batch.buf.Write(tail.buf.Bytes())
+	return batch.buf.Bytes()
+}
+
+// kafkaWriter encodes the primitive types of the Kafka protocol.
+type kafkaWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8) { w.buf.WriteByte(byte(v)) }
+
+func (w *kafkaWriter) int16(v int16) { w.buf.Write(binary.BigEndian.AppendUint16(nil, uint16(v))) }
+
+func (w *kafkaWriter) int32(v int32) { w.buf.Write(binary.BigEndian.AppendUint32(nil, uint32(v))) }
+
+func (w *kafkaWriter) int64(v int64) { w.buf.Write(binary.BigEndian.AppendUint64(nil, uint64(v))) }
+
+func (w *kafkaWriter) varint(v int64) { w.buf.Write(binary.AppendVarint(nil, v)) }
+
+func (w *kafkaWriter) bool(v bool) {
+	if v {
+		w.int8(1)
+	} else {
+		w.int8(0)
+	}
+}
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *kafkaWriter) bytes(b []byte) {
+	w.int32(int32(len(b)))
+	w.buf.Write(b)
+}
+
+// kafkaReader decodes the primitive types of the Kafka protocol. The first error is kept
+// in err, after which every read returns a zero value, so a response can be decoded in one
+// go and checked once.
+type kafkaReader struct {
+	b   []byte
+	err error
+}
+
+func (r *kafkaReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.b) < n {
+		r.err = errors.New("truncated response")
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *kafkaReader) int16() int16 {
+	if b := r.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int32() int32 {
+	if b := r.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *kafkaReader) int64() int64 {
+	if b := r.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+// count reads the length of an array. Why bound it by the bytes left? Every element takes
+// at least one byte, and a corrupt length must not turn into billions of empty iterations.
+func (r *kafkaReader) count() int {
+	n := int(r.int32())
+	if n > len(r.b) {
+		r.err = errors.New("truncated response")
+		return 0
+	}
+	return max(n, 0)
+}
+
+func (r *kafkaReader) bool() bool {
+	b := r.next(1)
+	return b != nil && b[0] != 0
+}
+
+// string reads a string, or a nullable string, returning "" for null.
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(r.next(int(n)))
+}
@@ -0,0 +1,118 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// capturedBroker is how the broker the captures were made with advertised itself in metadata.
+var capturedBroker = []byte("\x00\x09127.0.0.1\x00\x00\x4a\x94") // 127.0.0.1:19092
+
+// batchOffset returns where the record batch of a produce request frame starts, or -1 for
+// any other request.
+func batchOffset(frame []byte) int {
+	r := kafkaReader{b: frame[4:]}
+	if r.int16() != kafkaProduce {
+		return -1
+	}
+	r.int16() // version
+	r.int32() // correlation ID
+	r.string()
+	r.string() // transactional ID
+	r.int16()  // acks
+	r.int32()  // timeout
+	r.count()
+	r.string()
+	r.count()
+	r.int32() // partition
+	r.int32() // batch size
+	if r.err != nil {
+		return -1
+	}
+	return len(frame) - len(r.b)
+}
+
+// sameRequest compares two request frames, leaving out what depends on the time a record
+// batch was made: its timestamps and the CRC covering them.
+func sameRequest(want, got []byte) bool {
+	off := batchOffset(want)
+	if off < 0 || off+43 > len(want) || len(got) != len(want) {
+		return bytes.Equal(want, got)
+	}
+	mask := func(b []byte) []byte {
+		b = bytes.Clone(b)
+		clear(b[off+17 : off+21]) // CRC
+		clear(b[off+27 : off+43]) // first and max timestamps
+		return b
+	}
+	return bytes.Equal(mask(want), mask(got))
+}
+
+// The captures come from the fake broker of franz-go (pkg/kfake), with SASL/PLAIN and
+// without, holding fileserver.events with 3 partitions and creating no topics.
+func TestKafkaPublish(t *testing.T) {
+	tests := []struct {
+		desc    string
+		capture string
+		cfg     config.PublishConfig
+		wantErr string // empty if the publish should succeed
+	}{
+		{"produce", "kafka-produce.txt",
+			config.PublishConfig{Topic: "fileserver.events"}, ""},
+		{"produce with SASL/PLAIN", "kafka-sasl.txt",
+			config.PublishConfig{Topic: "fileserver.events", Username: "fileserver", Password: "secret"}, ""},
+		{"wrong password", "kafka-sasl-refused.txt",
+			config.PublishConfig{Topic: "fileserver.events", Username: "fileserver", Password: "wrong"}, "EOF"},
+		{"unknown topic", "kafka-unknown-topic.txt",
+			config.PublishConfig{Topic: "missing.topic"}, "topic missing.topic: unknown topic or partition"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// Metadata must send the client to the fake broker rather than the captured one.
+			l := listen(t)
+			port := l.Addr().(*net.TCPAddr).Port
+			advertised := binary.BigEndian.AppendUint32([]byte("\x00\x09127.0.0.1"), uint32(port))
+			answer := func(data []byte) []byte {
+				return bytes.ReplaceAll(data, capturedBroker, advertised)
+			}
+			replay(t, l, readCapture(t, tt.capture), sameRequest, answer)
+
+			cfg := tt.cfg
+			cfg.Addresses = []string{l.Addr().String()}
+			b := newKafka(cfg)
+			err := b.publish("reports/q3.pdf", []byte(payload))
+			b.reset()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("publish: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("publish: err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestRecordBatch checks a record batch, CRC included, against one the broker accepted.
+func TestRecordBatch(t *testing.T) {
+	conns := readCapture(t, "kafka-produce.txt")
+	frame := conns[1][0].data
+	off := batchOffset(frame)
+	if off < 0 {
+		t.Fatal("the capture holds no produce request")
+	}
+	captured := frame[off:]
+	created := time.UnixMilli(int64(binary.BigEndian.Uint64(captured[27:])))
+
+	if got := recordBatch([]byte("reports/q3.pdf"), []byte(payload), created); !bytes.Equal(got, captured) {
+		t.Errorf("recordBatch =\n%x\nwant\n%x", got, captured)
+	}
+}
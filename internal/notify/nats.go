@@ -0,0 +1,265 @@
+package notify
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// brokerTimeout bounds connecting to a broker and each publish, so that a broker which
+// stops responding is retried rather than waited on forever.
+const brokerTimeout = 10 * time.Second
+
+// natsBroker publishes to a NATS server using its text protocol.
+//
+// Why confirm every message? NATS itself acknowledges nothing: without JetStream, a PING
+// after the message is answered only once the server has processed everything before it;
+// with JetStream, the stream replies once it has stored the message.
+type natsBroker struct {
+	addrs     []string
+	subject   string
+	jetStream bool
+	tls       bool
+	user      string
+	pass      string
+	token     string
+
+	conn  net.Conn
+	r     *bufio.Reader
+	inbox string // JetStream acknowledgements arrive on subjects below this one
+	seq   int
+}
+
+// natsInfo is the part of the server's INFO message the client needs.
+type natsInfo struct {
+	TLSRequired bool `json:"tls_required"`
+	Headers     bool `json:"headers"`
+}
+
+func newNATS(cfg config.PublishConfig) *natsBroker {
+	addrs := cfg.Addresses
+	if len(addrs) == 0 {
+		addrs = []string{"127.0.0.1:4222"}
+	}
+	return &natsBroker{
+		addrs:     addrs,
+		subject:   cfg.Topic,
+		jetStream: cfg.JetStream,
+		tls:       cfg.TLS,
+		user:      cfg.Username,
+		pass:      cfg.Password,
+		token:     cfg.Token,
+	}
+}
+
+func (b *natsBroker) publish(key string, payload []byte) error {
+	if b.conn == nil {
+		if err := b.connect(); err != nil {
+			return err
+		}
+	}
+	err := b.pub(payload)
+	if err != nil {
+		// The connection is in an unknown state, so the next attempt starts afresh.
+		b.conn.Close()
+		b.conn = nil
+	}
+	return err
+}
+
+func (b *natsBroker) close() {
+	if b.conn != nil {
+		b.conn.Close()
+		b.conn = nil
+	}
+}
+
+// connect connects to the first reachable server and authenticates.
+func (b *natsBroker) connect() error {
+	var errs []error
+	for _, addr := range b.addrs {
+		err := b.dial(addr)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", addr, err))
+	}
+	return errors.Join(errs...)
+}
+
+func (b *natsBroker) dial(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, brokerTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(brokerTimeout))
+	b.conn, b.r = conn, bufio.NewReader(conn)
+
+	line, err := b.r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	op, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	var info natsInfo
+	if op != "INFO" || json.Unmarshal([]byte(args), &info) != nil {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	if b.tls || info.TLSRequired {
+		host, _, _ := net.SplitHostPort(addr)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return err
+		}
+		b.conn, b.r = tlsConn, bufio.NewReader(tlsConn)
+	}
+
+	opts := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "fileserver",
+		"lang":     "go",
+		"version":  "1.0",
+		"protocol": 1,
+	}
+	if b.user != "" {
+		opts["user"], opts["pass"] = b.user, b.pass
+	}
+	if b.token != "" {
+		opts["auth_token"] = b.token
+	}
+	// With headers enabled, a publish nobody is listening for is answered with a
+	// "no responders" status instead of silence, so a missing stream fails fast.
+	if b.jetStream && info.Headers {
+		opts["headers"], opts["no_responders"] = true, true
+	}
+	connect, _ := json.Marshal(opts)
+	cmd := "CONNECT " + string(connect) + "\r\n"
+	if b.jetStream {
+		id := make([]byte, 8)
+		rand.Read(id)
+		b.inbox = "_INBOX." + hex.EncodeToString(id)
+		cmd += "SUB " + b.inbox + ".* 1\r\n"
+	}
+	if _, err := io.WriteString(b.conn, cmd+"PING\r\n"); err != nil {
+		b.conn.Close()
+		return err
+	}
+	if err := b.awaitPong(); err != nil {
+		b.conn.Close()
+		return err
+	}
+	return nil
+}
+
+// pub publishes payload and waits for it to be confirmed.
+func (b *natsBroker) pub(payload []byte) error {
+	b.conn.SetDeadline(time.Now().Add(brokerTimeout))
+	if !b.jetStream {
+		cmd := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", b.subject, len(payload), payload)
+		if _, err := io.WriteString(b.conn, cmd); err != nil {
+			return err
+		}
+		return b.awaitPong()
+	}
+
+	b.seq++
+	reply := b.inbox + "." + strconv.Itoa(b.seq)
+	cmd := fmt.Sprintf("PUB %s %s %d\r\n%s\r\n", b.subject, reply, len(payload), payload)
+	if _, err := io.WriteString(b.conn, cmd); err != nil {
+		return err
+	}
+	for {
+		subject, headers, body, err := b.next()
+		if err != nil {
+			return err
+		}
+		// Acknowledgements of earlier messages that timed out may still arrive.
+		if subject != reply {
+			continue
+		}
+		if strings.HasPrefix(headers, "NATS/1.0 503") {
+			return fmt.Errorf("no JetStream stream stores subject %s", b.subject)
+		}
+		var ack struct {
+			Error *struct {
+				Description string `json:"description"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(body, &ack); err != nil {
+			return fmt.Errorf("malformed JetStream acknowledgement: %w", err)
+		}
+		if ack.Error != nil {
+			return fmt.Errorf("JetStream: %s", ack.Error.Description)
+		}
+		return nil
+	}
+}
+
+// awaitPong reads until the server answers a PING.
+func (b *natsBroker) awaitPong() error {
+	for {
+		subject, _, _, err := b.next()
+		if err != nil {
+			return err
+		}
+		if subject == "" {
+			return nil
+		}
+	}
+}
+
+// next reads the next PONG or message from the server, answering its PINGs and skipping
+// anything else on the way. For a PONG the subject is empty.
+func (b *natsBroker) next() (subject, headers string, body []byte, err error) {
+	for {
+		line, err := b.r.ReadString('\n')
+		if err != nil {
+			return "", "", nil, err
+		}
+		op, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+		switch strings.ToUpper(op) {
+		case "PONG":
+			return "", "", nil, nil
+		case "PING":
+			if _, err := io.WriteString(b.conn, "PONG\r\n"); err != nil {
+				return "", "", nil, err
+			}
+		case "-ERR":
+			return "", "", nil, fmt.Errorf("server error: %s", strings.Trim(args, "'"))
+		case "MSG", "HMSG":
+			// MSG <subject> <sid> [reply] <size>; HMSG <subject> <sid> [reply] <header size> <size>
+			fields := strings.Fields(args)
+			if len(fields) < 3 {
+				return "", "", nil, fmt.Errorf("malformed message %q", strings.TrimSpace(line))
+			}
+			hdrSize := 0
+			if op == "HMSG" && len(fields) >= 4 {
+				hdrSize, _ = strconv.Atoi(fields[len(fields)-2])
+			}
+			size, convErr := strconv.Atoi(fields[len(fields)-1])
+			if convErr != nil || hdrSize < 0 || hdrSize > size {
+				return "", "", nil, fmt.Errorf("malformed message %q", strings.TrimSpace(line))
+			}
+			data := make([]byte, size+2) // the payload is followed by CRLF
+			if _, err := io.ReadFull(b.r, data); err != nil {
+				return "", "", nil, err
+			}
+			return fields[0], string(data[:hdrSize]), data[hdrSize:size], nil
+		}
+		// +OK and INFO updates need no response.
+	}
+}
@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// inboxPattern matches the reply subject a JetStream publisher makes up at random.
+var inboxPattern = regexp.MustCompile(`_INBOX\.[0-9a-f]{16}`)
+
+// The captures come from nats-server 2.10.22, the stream EVENTS storing fileserver.events
+// and the stream FULL storing full.events with room for one message, which was taken.
+func TestNATSPublish(t *testing.T) {
+	tests := []struct {
+		desc    string
+		capture string
+		cfg     config.PublishConfig
+		wantErr string // empty if the publish should succeed
+	}{
+		{"core NATS", "nats-publish.txt",
+			config.PublishConfig{Topic: "fileserver.events"}, ""},
+		{"stored by a stream", "nats-jetstream.txt",
+			config.PublishConfig{Topic: "fileserver.events", JetStream: true}, ""},
+		{"no stream stores the subject", "nats-no-stream.txt",
+			config.PublishConfig{Topic: "nostream.events", JetStream: true}, "no JetStream stream stores subject nostream.events"},
+		{"the stream refuses the message", "nats-stream-full.txt",
+			config.PublishConfig{Topic: "full.events", JetStream: true, Username: "fileserver", Password: "secret"}, "JetStream: maximum messages exceeded"},
+		{"wrong password", "nats-auth.txt",
+			config.PublishConfig{Topic: "fileserver.events", Username: "fileserver", Password: "wrong"}, "Authorization Violation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			// The client's inbox differs from the captured one, so it is compared as any
+			// inbox and swapped into the server's replies.
+			var inbox []byte
+			same := func(want, got []byte) bool {
+				if m := inboxPattern.Find(got); m != nil {
+					inbox = m
+				}
+				return bytes.Equal(inboxPattern.ReplaceAll(want, nil), inboxPattern.ReplaceAll(got, nil))
+			}
+			answer := func(data []byte) []byte {
+				if inbox == nil {
+					return data
+				}
+				return inboxPattern.ReplaceAllLiteral(data, inbox)
+			}
+
+			l := listen(t)
+			replay(t, l, readCapture(t, tt.capture), same, answer)
+			cfg := tt.cfg
+			cfg.Addresses = []string{l.Addr().String()}
+			b := newNATS(cfg)
+			err := b.publish("reports/q3.pdf", []byte(payload))
+			if b.conn != nil {
+				b.conn.Close()
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("publish: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("publish: err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
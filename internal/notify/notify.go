@@ -0,0 +1,256 @@
+package notify
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// queueSize bounds the number of events waiting for each target. Why drop events beyond it?
+// A burst of uploads must not make the server buffer an unbounded number of messages, or
+// block requests on a slow mail server.
+const queueSize = 100
+
+// Event types.
+const (
+	Upload = "upload"
+	Delete = "delete"
+	// Modify is a partial write or append to a stored file.
+	Modify = "modify"
+	// LowSpace is about a disk of the server rather than a file: Name is the storage directory
+	// whose disk fell below uploader.minFreeSpaceMB, and Size the bytes left free.
+	LowSpace = "lowSpace"
+)
+
+// Event describes something that happened to a stored file.
+type Event struct {
+	Type string
+	Name string // storage-relative path
+	Size int64
+	User string // who uploaded or deleted the file
+	Time time.Time
+	// Link is the file's download URL, filled in by the Notifier for files that still exist
+	// when the server's public URL is configured.
+	Link string
+}
+
+// target delivers events to one destination, such as a list of email recipients.
+type target interface {
+	// name identifies the target in log messages.
+	name() string
+	send(Event) error
+}
+
+// closer is implemented by the targets that deliver events in the background themselves.
+type closer interface {
+	// close stops delivering, and returns once the target no longer does anything.
+	close()
+}
+
+// watcher is a target together with the events it is interested in.
+type watcher struct {
+	target target
+	types  []string // empty means all
+	paths  []string // normalised; empty means all
+	// queue buffers the events for the target. It is nil for targets that keep a persistent
+	// queue of their own, which are handed events directly so none can be dropped.
+	queue chan Event
+}
+
+// wants reports whether the event is of a type and at a path the target watches.
+func (w *watcher) wants(ev Event) bool {
+	if len(w.types) > 0 && !slices.Contains(w.types, ev.Type) {
+		return false
+	}
+	// Events about the server are not below any path, and go to every target that wants them.
+	if len(w.paths) == 0 || ev.Type == LowSpace {
+		return true
+	}
+	name := path.Clean("/" + ev.Name)
+	for _, p := range w.paths {
+		if p == "/" || name == p || strings.HasPrefix(name, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Notifier tells the configured targets about file events. A nil *Notifier is valid and
+// notifies no one, so callers need not check whether notifications are enabled.
+type Notifier struct {
+	watchers  []*watcher
+	publicURL string
+	logger    *log.Logger
+	stop      chan struct{} // closed by Close
+	wg        sync.WaitGroup
+}
+
+// New creates a Notifier for the configured targets. It returns nil if none are configured.
+func New(cfg *config.Config, logger *log.Logger) (*Notifier, error) {
+	nc := cfg.Notifications
+	n := &Notifier{publicURL: strings.TrimSuffix(cfg.Server.PublicURL, "/"), logger: logger, stop: make(chan struct{})}
+	if nc.Email.Host != "" {
+		t, err := newEmail(nc.Email)
+		if err != nil {
+			return nil, err
+		}
+		n.add(t, []string{Upload}, nc.Email.Paths, queueSize)
+	}
+	for i, cc := range nc.Chat {
+		t, err := newChat(cc)
+		if err != nil {
+			return nil, fmt.Errorf("chat notification %d: %w", i+1, err)
+		}
+		if err := checkEvents(cc.Events); err != nil {
+			return nil, fmt.Errorf("chat notification %d: %w", i+1, err)
+		}
+		// Why not modifications by default? A log shipper appending every few seconds would
+		// bury a channel in messages about the one file.
+		events := cc.Events
+		if len(events) == 0 {
+			events = []string{Upload, Delete, LowSpace}
+		}
+		n.add(t, events, cc.Paths, queueSize)
+	}
+	if nc.Publish.Broker != "" {
+		if err := checkEvents(nc.Publish.Events); err != nil {
+			return nil, fmt.Errorf("event publishing: %w", err)
+		}
+		t, err := newPublisher(nc.Publish, cfg.Metadata.Path("event-queue.json"), logger)
+		if err != nil {
+			return nil, err
+		}
+		// Why not every event by default? Consumers of the feed expect events about files,
+		// and alerts about the server are only published to those that ask for them.
+		events := nc.Publish.Events
+		if len(events) == 0 {
+			events = []string{Upload, Modify, Delete}
+		}
+		n.add(t, events, nc.Publish.Paths, 0)
+	}
+	if len(n.watchers) == 0 {
+		return nil, nil
+	}
+	for _, w := range n.watchers {
+		if w.queue != nil {
+			n.wg.Go(func() { n.run(w) })
+		}
+	}
+	return n, nil
+}
+
+// Close stops delivering events, waiting for those being sent. The events still queued for
+// targets without a persistent queue are dropped; nothing is to be notified afterwards.
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	close(n.stop)
+	n.wg.Wait()
+	for _, w := range n.watchers {
+		if c, ok := w.target.(closer); ok {
+			c.close()
+		}
+	}
+}
+
+// checkEvents reports an error if types names an unknown event type.
+func checkEvents(types []string) error {
+	for _, typ := range types {
+		if typ != Upload && typ != Modify && typ != Delete && typ != LowSpace {
+			return fmt.Errorf("unknown event %q", typ)
+		}
+	}
+	return nil
+}
+
+// add registers a target for the given event types below the given paths. A queue size of
+// zero hands events to the target directly.
+func (n *Notifier) add(t target, types, paths []string, size int) {
+	w := &watcher{target: t, types: types}
+	if size > 0 {
+		w.queue = make(chan Event, size)
+	}
+	for _, p := range paths {
+		w.paths = append(w.paths, path.Clean("/"+p))
+	}
+	n.watchers = append(n.watchers, w)
+}
+
+// Notify hands the event to every interested target. It never waits for delivery, only,
+// for targets with a persistent queue, for the event to be written to it.
+func (n *Notifier) Notify(ev Event) {
+	if n == nil {
+		return
+	}
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	if n.publicURL != "" && (ev.Type == Upload || ev.Type == Modify) {
+		ev.Link = n.publicURL + "/download/" + escapePath(ev.Name)
+	}
+	for _, w := range n.watchers {
+		if !w.wants(ev) {
+			continue
+		}
+		if w.queue == nil {
+			if err := w.target.send(ev); err != nil {
+				n.logger.Printf("error queueing %s event for '%s': %v\n", ev.Type, ev.Name, err)
+			}
+			continue
+		}
+		select {
+		case w.queue <- ev:
+		default:
+			n.logger.Printf("%s notification queue is full, dropping %s event for '%s'\n", w.target.name(), ev.Type, ev.Name)
+		}
+	}
+}
+
+// run delivers one target's events in order until the notifier is closed.
+// Why a goroutine per target? A mail server that is slow or down must not delay the others.
+func (n *Notifier) run(w *watcher) {
+	for {
+		select {
+		case <-n.stop:
+			if len(w.queue) > 0 {
+				n.logger.Printf("warn: dropping %d %s notifications not sent before the server stopped\n", len(w.queue), w.target.name())
+			}
+			return
+		case ev := <-w.queue:
+			if err := w.target.send(ev); err != nil {
+				n.logger.Printf("error sending %s notification for '%s': %v\n", w.target.name(), ev.Name, err)
+			}
+		}
+	}
+}
+
+// escapePath escapes each segment of a storage path for use in a URL, keeping the slashes.
+func escapePath(name string) string {
+	segments := strings.Split(name, "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// formatSize renders a byte count for people, e.g. "1.5 MB".
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
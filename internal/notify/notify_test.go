@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestChatEvents(t *testing.T) {
+	tests := []struct {
+		desc   string
+		events []string
+		ev     Event
+		want   string // empty if no message should be posted
+	}{
+		{"upload by default", nil, Event{Type: Upload, Name: "a.txt", Size: 2048, User: "alice"}, "alice uploaded a.txt (2.0 KB)"},
+		{"delete by default", nil, Event{Type: Delete, Name: "a.txt", User: "alice"}, "alice deleted a.txt"},
+		{"no modify by default", nil, Event{Type: Modify, Name: "app.log", Size: 10, User: "shipper"}, ""},
+		{"modify when listed", []string{"modify"}, Event{Type: Modify, Name: "app.log", Size: 10, User: "shipper"}, "shipper wrote to app.log (now 10 B)"},
+		{"only the events listed", []string{"modify"}, Event{Type: Upload, Name: "a.txt", User: "alice"}, ""},
+		{"low space by default", nil, Event{Type: LowSpace, Name: "/srv/files", Size: 512 << 20}, "/srv/files is low on space, with 512.0 MB free: uploads to it are refused"},
+		{"no low space unless listed", []string{"upload"}, Event{Type: LowSpace, Name: "/srv/files", Size: 512 << 20}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			posted := make(chan string, 1)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var msg struct{ Text string }
+				json.NewDecoder(r.Body).Decode(&msg)
+				posted <- msg.Text
+			}))
+			defer srv.Close()
+
+			cfg := config.Default()
+			cfg.Notifications.Chat = []config.ChatConfig{{Type: "slack", WebhookURL: srv.URL, Events: tt.events}}
+			n, err := New(cfg, log.New(io.Discard, "", 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.Notify(tt.ev)
+
+			select {
+			case got := <-posted:
+				if got != tt.want {
+					t.Errorf("posted %q, want %q", got, tt.want)
+				}
+			case <-time.After(200 * time.Millisecond):
+				if tt.want != "" {
+					t.Errorf("nothing posted, want %q", tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWants(t *testing.T) {
+	tests := []struct {
+		desc  string
+		types []string
+		paths []string
+		ev    Event
+		want  bool
+	}{
+		{"every event", nil, nil, Event{Type: Upload, Name: "a.txt"}, true},
+		{"a type watched", []string{Upload}, nil, Event{Type: Upload, Name: "a.txt"}, true},
+		{"a type not watched", []string{Upload}, nil, Event{Type: Delete, Name: "a.txt"}, false},
+		{"below a path watched", nil, []string{"/docs"}, Event{Type: Upload, Name: "docs/a.txt"}, true},
+		{"the path watched", nil, []string{"/docs"}, Event{Type: Delete, Name: "docs"}, true},
+		{"a name sharing a prefix", nil, []string{"/docs"}, Event{Type: Upload, Name: "docs2/a.txt"}, false},
+		{"elsewhere", nil, []string{"/docs"}, Event{Type: Upload, Name: "a.txt"}, false},
+		// Events about the server are below no path.
+		{"low space with paths", nil, []string{"/docs"}, Event{Type: LowSpace, Name: "/srv/files"}, true},
+		{"low space not watched", []string{Upload}, []string{"/docs"}, Event{Type: LowSpace, Name: "/srv/files"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w := &watcher{types: tt.types, paths: tt.paths}
+			if got := w.wants(tt.ev); got != tt.want {
+				t.Errorf("wants = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPublishEvents checks that alerts about the server are only published when asked for,
+// as consumers of the feed expect events about files.
+func TestPublishEvents(t *testing.T) {
+	tests := []struct {
+		events []string
+		want   map[string]bool
+	}{
+		{nil, map[string]bool{Upload: true, Modify: true, Delete: true, LowSpace: false}},
+		{[]string{"lowSpace"}, map[string]bool{Upload: false, LowSpace: true}},
+	}
+	for _, tt := range tests {
+		cfg := config.Default()
+		cfg.Metadata.Dir = t.TempDir()
+		cfg.Notifications.Publish = config.PublishConfig{Broker: "nats", Addresses: []string{"127.0.0.1:1"}, Topic: "fileserver.events", Events: tt.events}
+		n, err := New(cfg, log.New(io.Discard, "", 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for typ, want := range tt.want {
+			if got := n.watchers[0].wants(Event{Type: typ, Name: "a.txt"}); got != want {
+				t.Errorf("events %v: publishes %s %v, want %v", tt.events, typ, got, want)
+			}
+		}
+		n.Close()
+	}
+}
+
+func TestCheckEvents(t *testing.T) {
+	tests := []struct {
+		events  []string
+		wantErr bool
+	}{
+		{nil, false},
+		{[]string{"upload", "modify", "delete", "lowSpace"}, false},
+		{[]string{"rename"}, true},
+	}
+	for _, tt := range tests {
+		if err := checkEvents(tt.events); (err != nil) != tt.wantErr {
+			t.Errorf("checkEvents(%q) = %v, want error %v", tt.events, err, tt.wantErr)
+		}
+	}
+}
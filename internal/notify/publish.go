@@ -0,0 +1,215 @@
+package notify
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+)
+
+// Retry timing for an unreachable broker: the delay doubles after each failed attempt,
+// up to maxRetryDelay.
+const (
+	minRetryDelay = time.Second
+	maxRetryDelay = time.Minute
+)
+
+// saveEvery is the number of delivered events after which the queue file is rewritten.
+//
+// Why not after every event? Draining a large backlog would rewrite the whole file once per
+// event. A crash in between only means the events delivered since the last save are sent
+// again, which at-least-once delivery allows for anyway.
+const saveEvery = 100
+
+// message is the JSON document published for an event. ID is unique per event, so
+// consumers can discard the duplicates at-least-once delivery may produce.
+type message struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Name string    `json:"name"`
+	Size int64     `json:"size"`
+	User string    `json:"user"`
+	Time time.Time `json:"time"`
+	Link string    `json:"link,omitempty"`
+}
+
+// broker publishes messages to a message broker, reconnecting as needed.
+type broker interface {
+	// publish sends one message and returns once the broker has accepted it. key identifies
+	// what the message is about; brokers that partition use it to keep related messages in order.
+	publish(key string, payload []byte) error
+	// close drops the connections to the broker.
+	close()
+}
+
+// publisher delivers events to a broker with at-least-once semantics. Events are written to a
+// queue file before Notify returns, and removed from it only once the broker has accepted
+// them, so events survive both broker outages and server restarts.
+type publisher struct {
+	kind      string
+	broker    broker
+	path      string
+	maxQueued int
+	logger    *log.Logger
+
+	mu        sync.Mutex
+	queue     []message
+	delivered int // since the queue file was last saved
+	wake      chan struct{}
+	stop      chan struct{} // closed by close
+	done      chan struct{} // closed once run returns
+}
+
+// newPublisher creates a publisher for the configured broker, resumes the queue left by a
+// previous run, and starts delivering.
+func newPublisher(cfg config.PublishConfig, path string, logger *log.Logger) (*publisher, error) {
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("event publishing needs a topic")
+	}
+	var b broker
+	switch cfg.Broker {
+	case "nats":
+		b = newNATS(cfg)
+	case "kafka":
+		b = newKafka(cfg)
+	default:
+		return nil, fmt.Errorf("event broker must be nats or kafka, not %q", cfg.Broker)
+	}
+	p := &publisher{
+		kind:      cfg.Broker,
+		broker:    b,
+		path:      path,
+		maxQueued: cfg.MaxQueued,
+		logger:    logger,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if err := jsonfile.Load(path, &p.queue); err != nil {
+		return nil, fmt.Errorf("loading event queue: %w", err)
+	}
+	if len(p.queue) > 0 {
+		logger.Printf("resuming delivery of %d queued events to %s\n", len(p.queue), cfg.Broker)
+	}
+	go p.run()
+	return p, nil
+}
+
+func (p *publisher) name() string {
+	return p.kind
+}
+
+// send adds the event to the queue file and wakes the delivery loop.
+func (p *publisher) send(ev Event) error {
+	id := make([]byte, 16)
+	rand.Read(id)
+	m := message{
+		ID:   hex.EncodeToString(id),
+		Type: ev.Type,
+		Name: ev.Name,
+		Size: ev.Size,
+		User: ev.User,
+		Time: ev.Time.UTC(),
+		Link: ev.Link,
+	}
+
+	p.mu.Lock()
+	// Why drop new events rather than old ones? The oldest event may be being delivered at
+	// this very moment, and it has waited longest for the consumers that need it.
+	if p.maxQueued > 0 && len(p.queue) >= p.maxQueued {
+		p.mu.Unlock()
+		return fmt.Errorf("%s event queue is full (%d events), dropping event", p.kind, p.maxQueued)
+	}
+	p.queue = append(p.queue, m)
+	err := jsonfile.Save(p.path, p.queue)
+	p.mu.Unlock()
+
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return err
+}
+
+// run delivers queued events in order until the publisher is closed, retrying each one
+// until the broker accepts it.
+func (p *publisher) run() {
+	defer close(p.done)
+	delay := minRetryDelay
+	failing := false
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			p.mu.Unlock()
+			select {
+			case <-p.stop:
+				return
+			case <-p.wake:
+			}
+			continue
+		}
+		m := p.queue[0]
+		p.mu.Unlock()
+
+		payload, err := json.Marshal(m)
+		if err == nil {
+			err = p.broker.publish(m.Name, payload)
+		}
+		if err != nil {
+			p.logger.Printf("error publishing event %s to %s, retrying in %s: %v\n", m.ID, p.kind, delay, err)
+			failing = true
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(delay):
+			}
+			delay = min(delay*2, maxRetryDelay)
+			continue
+		}
+		if failing {
+			p.logger.Printf("publishing events to %s again\n", p.kind)
+			failing = false
+		}
+		delay = minRetryDelay
+
+		p.mu.Lock()
+		p.queue = p.queue[1:]
+		p.delivered++
+		if p.delivered >= saveEvery || len(p.queue) == 0 {
+			p.saveLocked()
+		}
+		p.mu.Unlock()
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+	}
+}
+
+// close stops delivering once the event being published, if any, is accepted or refused, and
+// saves the queue, whose events are delivered after the restart.
+func (p *publisher) close() {
+	close(p.stop)
+	<-p.done
+	p.mu.Lock()
+	if p.delivered > 0 {
+		p.saveLocked()
+	}
+	p.mu.Unlock()
+	p.broker.close()
+}
+
+// saveLocked writes the queue file. The caller must hold the lock.
+func (p *publisher) saveLocked() {
+	if err := jsonfile.Save(p.path, p.queue); err != nil {
+		p.logger.Printf("error saving event queue: %v\n", err)
+	}
+	p.delivered = 0
+}
@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// payload is the message published in the captured exchanges.
+const payload = `{"type":"upload","name":"reports/q3.pdf"}`
+
+// step is one write captured on the wire between a broker client and a real broker.
+type step struct {
+	client bool // sent by the client, else by the broker
+	data   []byte
+}
+
+// readCapture reads a capture file of testdata, which lists the writes of each connection
+// as "<connection> > <data>" for the client and "<connection> < <data>" for the broker, the
+// data either hex encoded or a Go-quoted string. It returns the steps of each connection.
+func readCapture(t *testing.T, name string) [][]step {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var conns [][]step
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) != 3 {
+			t.Fatalf("%s: malformed line %q", name, line)
+		}
+		conn, err := strconv.Atoi(fields[0])
+		if err != nil || conn < 1 || conn > len(conns)+1 {
+			t.Fatalf("%s: unexpected connection in %q", name, line)
+		}
+		var data []byte
+		if strings.HasPrefix(fields[2], `"`) {
+			var text string
+			text, err = strconv.Unquote(fields[2])
+			data = []byte(text)
+		} else {
+			data, err = hex.DecodeString(fields[2])
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if conn > len(conns) {
+			conns = append(conns, nil)
+		}
+		conns[conn-1] = append(conns[conn-1], step{client: fields[1] == ">", data: data})
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return conns
+}
+
+// listen returns a listener for a fake broker; replay closes it at the end of the test.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// replay runs a fake broker on l that plays the broker's part of the captured connections in
+// order: it reads what the client sent after each step and checks it with same, and sends
+// the broker's captured writes as rewritten by answer. Once a connection runs out of steps
+// it is closed, as the real broker closed it or the client was done with it.
+func replay(t *testing.T, l net.Listener, conns [][]step, same func(want, got []byte) bool, answer func([]byte) []byte) {
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		l.Close()
+		<-done
+	})
+
+	go func() {
+		defer close(done)
+		for i, steps := range conns {
+			conn, err := l.Accept()
+			if err != nil {
+				t.Errorf("connection %d was not made: %v", i+1, err)
+				return
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			for j, s := range steps {
+				if !s.client {
+					if _, err := conn.Write(answer(s.data)); err != nil {
+						t.Errorf("connection %d, step %d: %v", i+1, j+1, err)
+						break
+					}
+					continue
+				}
+				got := make([]byte, len(s.data))
+				if _, err := io.ReadFull(conn, got); err != nil {
+					t.Errorf("connection %d, step %d: %v", i+1, j+1, err)
+					break
+				}
+				if !same(s.data, got) {
+					t.Errorf("connection %d, step %d: client sent\n%q\nwant\n%q", i+1, j+1, got, s.data)
+					break
+				}
+			}
+			conn.Close()
+		}
+	}()
+}
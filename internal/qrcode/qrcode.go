@@ -0,0 +1,499 @@
+// Package qrcode encodes text, such as a URL, as a QR code (ISO/IEC 18004), and draws it as
+// an image.
+//
+// Only what links need is supported: byte mode, at error correction level M, which still
+// reads with 15% of the code damaged or covered, in whichever version the text fits.
+package qrcode
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// ErrTooLong is returned for text that does not fit in the largest QR code.
+var ErrTooLong = errors.New("text is too long for a QR code")
+
+// eccCodewordsPerBlock and numBlocks give, for each version (from 1, at index 1), the number
+// of error correction codewords in each block and the number of blocks, at level M.
+var (
+	eccCodewordsPerBlock = [41]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+	numBlocks            = [41]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+// formatLevelM is the error correction level M in the format information.
+const formatLevelM = 0
+
+// Code is a QR code: a square of dark and light modules.
+type Code struct {
+	version  int
+	size     int
+	modules  [][]bool // dark modules, indexed by y then x
+	function [][]bool // modules of the function patterns, which are never masked
+}
+
+// New encodes data as a QR code, in the smallest version it fits in.
+func New(data []byte) (*Code, error) {
+	version := 0
+	for v := 1; v <= 40; v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= numDataCodewords(v)*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, ErrTooLong
+	}
+
+	var bits bitBuffer
+	bits.append(0x4, 4) // byte mode
+	if version >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	capacity := numDataCodewords(version) * 8
+	bits.append(0, min(4, capacity-len(bits))) // terminator
+	bits.append(0, (8-len(bits)%8)%8)
+	for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+		bits.append(pad, 8)
+	}
+
+	c := &Code{version: version, size: version*4 + 17}
+	c.modules = make([][]bool, c.size)
+	c.function = make([][]bool, c.size)
+	for y := range c.size {
+		c.modules[y] = make([]bool, c.size)
+		c.function[y] = make([]bool, c.size)
+	}
+	c.drawFunctionPatterns()
+	c.drawCodewords(c.addErrorCorrection(bits.bytes()))
+
+	// Every mask is tried, and the one whose result is easiest to read is kept.
+	best, bestPenalty := 0, -1
+	for mask := range 8 {
+		c.applyMask(mask)
+		c.drawFormatBits(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // masking twice undoes it
+	}
+	c.applyMask(best)
+	c.drawFormatBits(best)
+	return c, nil
+}
+
+// Size returns the number of modules along each side of the code.
+func (c *Code) Size() int {
+	return c.size
+}
+
+// Dark reports whether the module at x, y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return x >= 0 && x < c.size && y >= 0 && y < c.size && c.modules[y][x]
+}
+
+// Image draws the code with each module scale pixels wide, within the quiet zone of four
+// light modules that readers need around it.
+func (c *Code) Image(scale int) image.Image {
+	const border = 4
+	side := (c.size + 2*border) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for y := range side {
+		for x := range side {
+			v := color.Gray{Y: 0xFF}
+			if c.Dark(x/scale-border, y/scale-border) {
+				v = color.Gray{Y: 0}
+			}
+			img.SetGray(x, y, v)
+		}
+	}
+	return img
+}
+
+// numRawDataModules returns the number of modules of a version that hold data and error
+// correction, rather than function patterns or format and version information.
+func numRawDataModules(version int) int {
+	n := (16*version+128)*version + 64
+	if version >= 2 {
+		align := version/7 + 2
+		n -= (25*align-10)*align - 55
+		if version >= 7 {
+			n -= 36
+		}
+	}
+	return n
+}
+
+// numDataCodewords returns the number of data codewords a version holds at level M.
+func numDataCodewords(version int) int {
+	return numRawDataModules(version)/8 - eccCodewordsPerBlock[version]*numBlocks[version]
+}
+
+// addErrorCorrection splits data into blocks, appends the error correction codewords of each,
+// and interleaves the blocks into the sequence of codewords that is drawn.
+func (c *Code) addErrorCorrection(data []byte) []byte {
+	blocks := numBlocks[c.version]
+	eccLen := eccCodewordsPerBlock[c.version]
+	raw := numRawDataModules(c.version) / 8
+	shortBlocks := blocks - raw%blocks
+	shortLen := raw / blocks
+
+	divisor := reedSolomonDivisor(eccLen)
+	all := make([][]byte, blocks)
+	k := 0
+	for i := range blocks {
+		n := shortLen - eccLen
+		if i >= shortBlocks {
+			n++
+		}
+		block := append([]byte(nil), data[k:k+n]...)
+		k += n
+		ecc := reedSolomonRemainder(block, divisor)
+		if i < shortBlocks {
+			block = append(block, 0) // a placeholder, skipped when interleaving
+		}
+		all[i] = append(block, ecc...)
+	}
+
+	result := make([]byte, 0, raw)
+	for i := range all[0] {
+		for j, block := range all {
+			if i != shortLen-eccLen || j >= shortBlocks {
+				result = append(result, block[i])
+			}
+		}
+	}
+	return result
+}
+
+// drawFunctionPatterns draws the finder, alignment and timing patterns, and reserves the
+// modules of the format and version information.
+func (c *Code) drawFunctionPatterns() {
+	for i := range c.size {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+	c.drawFinder(3, 3)
+	c.drawFinder(c.size-4, 3)
+	c.drawFinder(3, c.size-4)
+
+	positions := c.alignmentPositions()
+	n := len(positions)
+	for i := range n {
+		for j := range n {
+			// The corners with finder patterns have no alignment pattern.
+			if i == 0 && j == 0 || i == 0 && j == n-1 || i == n-1 && j == 0 {
+				continue
+			}
+			c.drawAlignment(positions[i], positions[j])
+		}
+	}
+	c.drawFormatBits(0)
+	c.drawVersion()
+}
+
+// drawFinder draws a finder pattern, with its separator, centred on x, y.
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx >= 0 && xx < c.size && yy >= 0 && yy < c.size {
+				dist := max(abs(dx), abs(dy))
+				c.setFunction(xx, yy, dist != 2 && dist != 4)
+			}
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern centred on x, y.
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// alignmentPositions returns the coordinates, along either axis, of the centres of the
+// alignment patterns.
+func (c *Code) alignmentPositions() []int {
+	if c.version == 1 {
+		return nil
+	}
+	n := c.version/7 + 2
+	step := (c.version*8 + n*3 + 5) / (n*4 - 4) * 2
+	positions := make([]int, n)
+	positions[0] = 6
+	for i, pos := n-1, c.size-7; i >= 1; i, pos = i-1, pos-step {
+		positions[i] = pos
+	}
+	return positions
+}
+
+// drawFormatBits draws both copies of the format information: the error correction level and
+// mask, protected by a BCH code.
+func (c *Code) drawFormatBits(mask int) {
+	data := formatLevelM<<3 | mask
+	rem := data
+	for range 10 {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(bits, i))
+	}
+	c.setFunction(8, 7, bit(bits, 6))
+	c.setFunction(8, 8, bit(bits, 7))
+	c.setFunction(7, 8, bit(bits, 8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(bits, i))
+	}
+
+	for i := range 8 {
+		c.setFunction(c.size-1-i, 8, bit(bits, i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.size-15+i, bit(bits, i))
+	}
+	c.setFunction(8, c.size-8, true) // always dark
+}
+
+// drawVersion draws both copies of the version information, which versions 7 and up carry.
+func (c *Code) drawVersion() {
+	if c.version < 7 {
+		return
+	}
+	rem := c.version
+	for range 12 {
+		rem = rem<<1 ^ (rem>>11)*0x1F25
+	}
+	bits := c.version<<12 | rem
+	for i := range 18 {
+		a, b := c.size-11+i%3, i/3
+		c.setFunction(a, b, bit(bits, i))
+		c.setFunction(b, a, bit(bits, i))
+	}
+}
+
+// drawCodewords draws the codewords into the modules left over by the function patterns, in
+// the zigzag of two-module columns from the bottom right that readers follow.
+func (c *Code) drawCodewords(data []byte) {
+	i := 0
+	for right := c.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // the vertical timing pattern is skipped
+		}
+		for vert := range c.size {
+			for j := range 2 {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = c.size - 1 - vert // upwards
+				}
+				if !c.function[y][x] && i < len(data)*8 {
+					c.modules[y][x] = bit(int(data[i>>3]), 7-i&7)
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by a mask pattern.
+func (c *Code) applyMask(mask int) {
+	for y := range c.size {
+		for x := range c.size {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !c.function[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to read, by the rules of the standard: long runs and
+// blocks of one colour, patterns that look like finders, and an imbalance of dark and light.
+func (c *Code) penalty() int {
+	p := 0
+	finder := []bool{true, false, true, true, true, false, true}
+	for i := range c.size {
+		rowRun, colRun := 1, 1
+		for j := range c.size {
+			if j > 0 {
+				if c.modules[i][j] == c.modules[i][j-1] {
+					rowRun++
+				} else {
+					rowRun = 1
+				}
+				if c.modules[j][i] == c.modules[j-1][i] {
+					colRun++
+				} else {
+					colRun = 1
+				}
+				if rowRun == 5 {
+					p += 3
+				} else if rowRun > 5 {
+					p++
+				}
+				if colRun == 5 {
+					p += 3
+				} else if colRun > 5 {
+					p++
+				}
+			}
+			if j+7 <= c.size {
+				rowMatch, colMatch := true, true
+				for k, dark := range finder {
+					rowMatch = rowMatch && c.modules[i][j+k] == dark
+					colMatch = colMatch && c.modules[j+k][i] == dark
+				}
+				if rowMatch && (c.light(i, j-4, j, true) || c.light(i, j+7, j+11, true)) {
+					p += 40
+				}
+				if colMatch && (c.light(i, j-4, j, false) || c.light(i, j+7, j+11, false)) {
+					p += 40
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := range c.size {
+		for x := range c.size {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x > 0 && y > 0 {
+				v := c.modules[y][x]
+				if v == c.modules[y][x-1] && v == c.modules[y-1][x] && v == c.modules[y-1][x-1] {
+					p += 3
+				}
+			}
+		}
+	}
+	total := c.size * c.size
+	k := (abs(dark*20-total*10)+total-1)/total - 1
+	return p + k*10
+}
+
+// light reports whether the modules from..to (exclusive) of row, or column, i are light,
+// counting those outside the code, which is surrounded by light modules.
+func (c *Code) light(i, from, to int, row bool) bool {
+	for j := from; j < to; j++ {
+		if j < 0 || j >= c.size {
+			continue
+		}
+		if row && c.modules[i][j] || !row && c.modules[j][i] {
+			return false
+		}
+	}
+	return true
+}
+
+// setFunction sets a module of a function pattern.
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+// reedSolomonDivisor returns the generator polynomial of the given degree, highest
+// coefficient first without the leading 1.
+func reedSolomonDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for range degree {
+		for j := range result {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// reedSolomonRemainder returns the error correction codewords of data.
+func reedSolomonRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, coef := range divisor {
+			result[i] ^= gfMultiply(coef, factor)
+		}
+	}
+	return result
+}
+
+// gfMultiply multiplies in GF(2^8), modulo the polynomial the standard uses.
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11D
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+// bitBuffer is a sequence of bits, one per element.
+type bitBuffer []bool
+
+// append appends the low n bits of v, most significant first.
+func (b *bitBuffer) append(v, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, v>>i&1 != 0)
+	}
+}
+
+// bytes packs the bits, whose number must be a multiple of eight, into bytes.
+func (b bitBuffer) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, v := range b {
+		if v {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// bit reports whether bit i of x is set.
+func bit(x, i int) bool {
+	return x>>i&1 != 0
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,275 @@
+package qrcode
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"strings"
+	"testing"
+)
+
+// readFormat reads both copies of the format information of c, checks that they agree and
+// have a valid BCH code, and returns the error correction level and mask.
+func readFormat(t *testing.T, c *Code) (level, mask int) {
+	t.Helper()
+	var first, second int
+	for i := 0; i <= 5; i++ {
+		first |= bitOf(c.Dark(8, i)) << i
+	}
+	first |= bitOf(c.Dark(8, 7))<<6 | bitOf(c.Dark(8, 8))<<7 | bitOf(c.Dark(7, 8))<<8
+	for i := 9; i < 15; i++ {
+		first |= bitOf(c.Dark(14-i, 8)) << i
+	}
+	for i := range 8 {
+		second |= bitOf(c.Dark(c.Size()-1-i, 8)) << i
+	}
+	for i := 8; i < 15; i++ {
+		second |= bitOf(c.Dark(8, c.Size()-15+i)) << i
+	}
+	if first != second {
+		t.Fatalf("format information %015b and %015b differ", first, second)
+	}
+	if !c.Dark(8, c.Size()-8) {
+		t.Error("the dark module is light")
+	}
+	bits := first ^ 0x5412
+	// The 15 bits are a codeword of the (15, 5) BCH code with generator 0x537.
+	rem := bits
+	for i := 14; i >= 10; i-- {
+		if rem>>i&1 == 1 {
+			rem ^= 0x537 << (i - 10)
+		}
+	}
+	if rem != 0 {
+		t.Fatalf("format information %015b has a BCH remainder of %b", bits, rem)
+	}
+	return bits >> 13, bits >> 10 & 7
+}
+
+// bitOf returns 1 for a dark module, and 0 for a light one.
+func bitOf(dark bool) int {
+	if dark {
+		return 1
+	}
+	return 0
+}
+
+// masked reports whether mask inverts the module at x, y, as ISO/IEC 18004 defines them.
+func masked(mask, x, y int) bool {
+	switch mask {
+	case 0:
+		return (y+x)%2 == 0
+	case 1:
+		return y%2 == 0
+	case 2:
+		return x%3 == 0
+	case 3:
+		return (y+x)%3 == 0
+	case 4:
+		return (y/2+x/3)%2 == 0
+	case 5:
+		return y*x%2+y*x%3 == 0
+	case 6:
+		return (y*x%2+y*x%3)%2 == 0
+	default:
+		return ((y+x)%2+y*x%3)%2 == 0
+	}
+}
+
+// decode reads c back as a reader would, checking the error correction of each block, and
+// returns the data it holds.
+func decode(t *testing.T, c *Code) []byte {
+	t.Helper()
+	level, mask := readFormat(t, c)
+	if level != formatLevelM {
+		t.Fatalf("got error correction level %d, want M", level)
+	}
+
+	// The codewords, in the order they are drawn: two-module columns from the right, going
+	// up and down in turn, around the vertical timing pattern.
+	var codewords []byte
+	var cur, n int
+	upwards := true
+	for right := c.Size() - 1; right >= 1; right, upwards = right-2, !upwards {
+		if right == 6 {
+			right = 5
+		}
+		for vert := range c.Size() {
+			y := vert
+			if upwards {
+				y = c.Size() - 1 - vert
+			}
+			for _, x := range []int{right, right - 1} {
+				if c.function[y][x] {
+					continue
+				}
+				cur = cur<<1 | bitOf(c.Dark(x, y) != masked(mask, x, y))
+				if n++; n%8 == 0 {
+					codewords = append(codewords, byte(cur))
+					cur = 0
+				}
+			}
+		}
+	}
+
+	// The blocks are interleaved: the data of all of them, then their error correction.
+	blocks, eccLen := numBlocks[c.version], eccCodewordsPerBlock[c.version]
+	total := len(codewords)
+	if total != numRawDataModules(c.version)/8 {
+		t.Fatalf("read %d codewords, want %d", total, numRawDataModules(c.version)/8)
+	}
+	shortBlocks, shortLen := blocks-total%blocks, total/blocks
+	data := make([][]byte, blocks)
+	k := 0
+	for i := range shortLen - eccLen + 1 {
+		for j := range blocks {
+			if i == shortLen-eccLen && j < shortBlocks {
+				continue
+			}
+			data[j] = append(data[j], codewords[k])
+			k++
+		}
+	}
+	for j := range blocks {
+		ecc := make([]byte, eccLen)
+		for i := range eccLen {
+			ecc[i] = codewords[k+i*blocks+j]
+		}
+		// Every root of the generator, α^0 to α^(eccLen-1), is a root of a valid block.
+		block := append(append([]byte(nil), data[j]...), ecc...)
+		root := byte(1)
+		for i := range eccLen {
+			var s byte
+			for _, b := range block {
+				s = gfMultiply(s, root) ^ b
+			}
+			if s != 0 {
+				t.Fatalf("block %d has syndrome %d of %#x", j, i, s)
+			}
+			root = gfMultiply(root, 2)
+		}
+	}
+
+	var stream []byte
+	for _, d := range data {
+		stream = append(stream, d...)
+	}
+	read := func(pos, n int) int {
+		v := 0
+		for i := pos; i < pos+n; i++ {
+			v = v<<1 | int(stream[i/8]>>(7-i%8)&1)
+		}
+		return v
+	}
+	if mode := read(0, 4); mode != 0x4 {
+		t.Fatalf("got mode %#x, want byte mode", mode)
+	}
+	countBits := 8
+	if c.version >= 10 {
+		countBits = 16
+	}
+	length := read(4, countBits)
+	if 4+countBits+8*length > len(stream)*8 {
+		t.Fatalf("got a length of %d bytes, more than the code holds", length)
+	}
+	out := make([]byte, length)
+	for i := range out {
+		out[i] = byte(read(4+countBits+8*i, 8))
+	}
+	return out
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		length      int
+		wantVersion int
+	}{
+		// The byte capacities of versions 1, 2, 9, 10, 21 and 40 at level M. From version 10,
+		// the length takes 16 bits rather than 8.
+		{1, 1},
+		{14, 1},
+		{15, 2},
+		{26, 2},
+		{27, 3},
+		{180, 9},
+		{181, 10},
+		{213, 10},
+		{214, 11},
+		{711, 21},
+		{2331, 40},
+	}
+	for _, tt := range tests {
+		data := []byte(strings.Repeat("https://files.example.com/s/aB3xYz", tt.length/34+1)[:tt.length])
+		c, err := New(data)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", tt.length, err)
+		}
+		if c.version != tt.wantVersion || c.Size() != 17+4*tt.wantVersion {
+			t.Errorf("%d bytes: got version %d of size %d, want version %d", tt.length, c.version, c.Size(), tt.wantVersion)
+		}
+		if got := decode(t, c); !bytes.Equal(got, data) {
+			t.Errorf("%d bytes: decoded %q", tt.length, got)
+		}
+	}
+	if _, err := New(make([]byte, 2332)); !errors.Is(err, ErrTooLong) {
+		t.Errorf("got error %v for 2332 bytes, want %v", err, ErrTooLong)
+	}
+}
+
+// TestPatterns checks the patterns readers find a code by: the finder patterns in three
+// corners, the timing patterns between them, and the version information of large codes.
+func TestPatterns(t *testing.T) {
+	for _, length := range []int{10, 200, 1000} {
+		c, err := New(bytes.Repeat([]byte("a"), length))
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := c.Size()
+		for _, corner := range []image.Point{{0, 0}, {size - 7, 0}, {0, size - 7}} {
+			for dy := range 7 {
+				for dx := range 7 {
+					ring := max(abs(dx-3), abs(dy-3))
+					if want := ring != 2; c.Dark(corner.X+dx, corner.Y+dy) != want {
+						t.Fatalf("version %d: finder pattern at %v has module %d,%d dark %v", c.version, corner, dx, dy, !want)
+					}
+				}
+			}
+		}
+		for i := 8; i < size-8; i++ {
+			if c.Dark(i, 6) != (i%2 == 0) || c.Dark(6, i) != (i%2 == 0) {
+				t.Fatalf("version %d: timing patterns broken at %d", c.version, i)
+			}
+		}
+		if c.version < 7 {
+			continue
+		}
+		var first, second int
+		for i := range 18 {
+			first |= bitOf(c.Dark(size-11+i%3, i/3)) << i
+			second |= bitOf(c.Dark(i/3, size-11+i%3)) << i
+		}
+		if first != second || first>>12 != c.version {
+			t.Errorf("version %d: got version information %018b and %018b", c.version, first, second)
+		}
+	}
+}
+
+func TestImage(t *testing.T) {
+	c, err := New([]byte("https://files.example.com/s/aB3xYz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const scale = 3
+	img := c.Image(scale).(*image.Gray)
+	if want := (c.Size() + 8) * scale; img.Bounds().Dx() != want || img.Bounds().Dy() != want {
+		t.Fatalf("got an image of %v, want %d pixels square", img.Bounds(), want)
+	}
+	for y := range img.Bounds().Dy() {
+		for x := range img.Bounds().Dx() {
+			mx, my := x/scale-4, y/scale-4
+			if want := c.Dark(mx, my); (img.GrayAt(x, y).Y == 0) != want {
+				t.Fatalf("pixel %d,%d does not match module %d,%d", x, y, mx, my)
+			}
+		}
+	}
+}
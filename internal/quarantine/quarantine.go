@@ -0,0 +1,152 @@
+// Package quarantine keeps uploaded files that failed validation, so that an administrator
+// can inspect them before they are released into storage or purged.
+package quarantine
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+)
+
+// Item records one quarantined file.
+type Item struct {
+	ID string `json:"id"`
+	// Name is the path the file was uploaded to, relative to the storage directory.
+	Name   string    `json:"name"`
+	Size   int64     `json:"size"`
+	SHA256 string    `json:"sha256"`
+	Reason string    `json:"reason"`
+	User   string    `json:"user"`
+	Time   time.Time `json:"time"`
+}
+
+// Store keeps the quarantined files in a directory, named by their ID, and the records
+// describing them in a JSON file.
+//
+// Why not keep the original names? Each rejected upload is kept, even when several were
+// meant for the same path, and the directory never mirrors a tree a client chose.
+type Store struct {
+	mu    sync.RWMutex
+	path  string
+	dir   string
+	items map[string]Item // keyed by ID
+}
+
+// Open loads the records from path, for the files kept in dir.
+func Open(path, dir string) (*Store, error) {
+	s := &Store{path: path, dir: dir, items: make(map[string]Item)}
+	if err := jsonfile.Load(path, &s.items); err != nil {
+		return nil, fmt.Errorf("loading quarantine from %s: %w", path, err)
+	}
+	if s.items == nil {
+		s.items = make(map[string]Item)
+	}
+	return s, nil
+}
+
+// Add copies content into quarantine and records it as item, returning the item with its
+// ID, size and checksum filled in.
+func (s *Store) Add(item Item, content io.Reader) (Item, error) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	item.ID = hex.EncodeToString(id)
+	item.Time = time.Now().UTC()
+
+	// Why 0700 and 0600? The files are suspect by definition, so nobody else on the host
+	// should be able to open them by accident.
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return Item{}, err
+	}
+	file, err := os.OpenFile(s.file(item.ID), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return Item{}, err
+	}
+	hash := sha256.New()
+	item.Size, err = io.Copy(io.MultiWriter(file, hash), content)
+	item.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(s.file(item.ID))
+		return Item{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[item.ID] = item
+	if err := s.save(); err != nil {
+		delete(s.items, item.ID)
+		os.Remove(s.file(item.ID))
+		return Item{}, err
+	}
+	return item, nil
+}
+
+// Get returns the item with the given ID.
+func (s *Store) Get(id string) (Item, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	item, ok := s.items[id]
+	return item, ok
+}
+
+// Open opens the quarantined file of the item with the given ID.
+func (s *Store) Open(id string) (*os.File, error) {
+	if _, ok := s.Get(id); !ok {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(s.file(id))
+}
+
+// List returns all items, oldest first.
+func (s *Store) List() []Item {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Item, 0, len(s.items))
+	for _, item := range s.items {
+		list = append(list, item)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list
+}
+
+// Remove deletes the item with the given ID and its file.
+func (s *Store) Remove(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	if !ok {
+		return os.ErrNotExist
+	}
+	delete(s.items, id)
+	if err := s.save(); err != nil {
+		s.items[id] = item
+		return err
+	}
+	// The record is gone, so a file left behind is merely orphaned.
+	if err := os.Remove(s.file(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// file returns the path of the quarantined file with the given ID.
+func (s *Store) file(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+// save writes the records to disk. The caller must hold the write lock.
+func (s *Store) save() error {
+	return jsonfile.Save(s.path, s.items)
+}
@@ -0,0 +1,155 @@
+// Package quota keeps count of the bytes each client address has uploaded within a rolling
+// window, so that a single address cannot fill the storage directory.
+package quota
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/clientip"
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// buckets is the number of parts the window is divided into. Usage is counted per part,
+// so bytes leave the window up to one part (an hour, for a day's window) early.
+const buckets = 24
+
+// bucket holds the bytes uploaded during one part of the window.
+type bucket struct {
+	Start time.Time `json:"start"`
+	Bytes int64     `json:"bytes"`
+}
+
+// Store keeps the usage of every client address in a JSON file.
+//
+// Why persist it? A quota that a restart resets is one an abuser can wait out, and the file
+// stays small, as addresses drop out of it once their uploads have left the window.
+type Store struct {
+	mu      sync.Mutex
+	storage storage.Storage // of the metadata directory
+	name    string
+	limit   int64
+	window  time.Duration
+	usage   map[string][]bucket // keyed by client, oldest bucket first
+	// reserved holds the bytes set aside for the uploads in progress, by client. Why not
+	// persist it? The uploads end with the process, and their reservations with them.
+	reserved map[string]int64
+}
+
+// Open loads the usage from the file name in st, the metadata directory, for a quota of
+// limit bytes per window.
+func Open(st storage.Storage, name string, limit int64, window time.Duration) (*Store, error) {
+	if window <= 0 {
+		return nil, fmt.Errorf("invalid upload quota window %s: must be positive", window)
+	}
+	s := &Store{storage: st, name: name, limit: limit, window: window, usage: make(map[string][]bucket), reserved: make(map[string]int64)}
+	if err := jsonfile.LoadFrom(st, name, &s.usage); err != nil {
+		return nil, fmt.Errorf("loading upload quota from %s: %w", name, err)
+	}
+	if s.usage == nil {
+		s.usage = make(map[string][]bucket)
+	}
+	return s, nil
+}
+
+// Limit returns the number of bytes a client may upload per window.
+func (s *Store) Limit() int64 {
+	return s.limit
+}
+
+// Window returns the period the quota applies to.
+func (s *Store) Window() time.Duration {
+	return s.window
+}
+
+// Remaining returns how many bytes the client at addr may still upload, less those set aside
+// for its uploads in progress, and when the oldest of its uploads leaves the window (the zero
+// time if it has uploaded nothing).
+func (s *Store) Remaining(addr netip.Addr) (int64, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := clientip.Key(addr)
+	list := s.current(key, time.Now())
+	var reset time.Time
+	if len(list) > 0 {
+		reset = list[0].Start.Add(s.window)
+	}
+	return s.remaining(key, list), reset
+}
+
+// Reserve sets aside up to n bytes of the quota of the client at addr for an upload in
+// progress, and returns how many it set aside: n, or what remains if that is less. Settle
+// ends the reservation.
+func (s *Store) Reserve(addr netip.Addr, n int64) int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := clientip.Key(addr)
+	n = min(n, s.remaining(key, s.current(key, time.Now())))
+	if n > 0 {
+		s.reserved[key] += n
+	}
+	return max(n, 0)
+}
+
+// Settle ends an upload by the client at addr for which reserved bytes were set aside,
+// charging the n bytes it took to its quota and giving the rest back.
+func (s *Store) Settle(addr netip.Addr, reserved, n int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := clientip.Key(addr)
+	if s.reserved[key] -= reserved; s.reserved[key] <= 0 {
+		delete(s.reserved, key)
+	}
+	return s.add(key, n)
+}
+
+// remaining returns how many bytes the client key may still upload, given the buckets list
+// still within the window. The caller must hold the lock.
+func (s *Store) remaining(key string, list []bucket) int64 {
+	used := s.reserved[key]
+	for _, b := range list {
+		used += b.Bytes
+	}
+	return max(s.limit-used, 0)
+}
+
+// add charges n bytes to the client key, and saves the usage. The caller must hold the lock.
+func (s *Store) add(key string, n int64) error {
+	if n <= 0 {
+		return nil
+	}
+	now := time.Now()
+	list := s.current(key, now)
+	start := now.Truncate(s.window / buckets)
+	if len(list) > 0 && list[len(list)-1].Start.Equal(start) {
+		list[len(list)-1].Bytes += n
+	} else {
+		list = append(list, bucket{Start: start, Bytes: n})
+	}
+	s.usage[key] = list
+	s.prune(now)
+	return jsonfile.SaveTo(s.storage, s.name, s.usage)
+}
+
+// current returns the buckets of key still within the window. The caller must hold the lock.
+func (s *Store) current(key string, now time.Time) []bucket {
+	list := s.usage[key]
+	for len(list) > 0 && !now.Before(list[0].Start.Add(s.window)) {
+		list = list[1:]
+	}
+	return list
+}
+
+// prune drops the clients with nothing left in the window. The caller must hold the lock.
+func (s *Store) prune(now time.Time) {
+	for key := range s.usage {
+		if list := s.current(key, now); len(list) == 0 {
+			delete(s.usage, key)
+		} else {
+			s.usage[key] = list
+		}
+	}
+}
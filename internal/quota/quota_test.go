@@ -0,0 +1,81 @@
+package quota
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage/memfs"
+)
+
+func TestReserve(t *testing.T) {
+	meta := memfs.New().Dir("metadata")
+	s, err := Open(meta, "quota.json", 1000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	wantRemaining := func(addr netip.Addr, want int64) {
+		t.Helper()
+		if got, _ := s.Remaining(addr); got != want {
+			t.Errorf("%s has %d bytes remaining, want %d", addr, got, want)
+		}
+	}
+
+	if got := s.Reserve(alice, 600); got != 600 {
+		t.Errorf("first reservation got %d bytes, want 600", got)
+	}
+	if got := s.Reserve(alice, 600); got != 400 {
+		t.Errorf("second reservation got %d bytes, want the 400 remaining", got)
+	}
+	wantRemaining(alice, 0)
+	wantRemaining(bob, 1000)
+
+	// The first upload took less than it set aside, and gives the rest back.
+	if err := s.Settle(alice, 600, 100); err != nil {
+		t.Fatal(err)
+	}
+	wantRemaining(alice, 500)
+	if err := s.Settle(alice, 400, 400); err != nil {
+		t.Fatal(err)
+	}
+	wantRemaining(alice, 500)
+
+	// What was charged outlasts a restart; reservations end with their uploads.
+	s.Reserve(alice, 100)
+	s, err = Open(meta, "quota.json", 1000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantRemaining(alice, 500)
+}
+
+// TestReserveConcurrent checks that uploads by one client running at once cannot, together,
+// go over its quota.
+func TestReserveConcurrent(t *testing.T) {
+	s, err := Open(memfs.New().Dir("metadata"), "quota.json", 1000, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddr("192.0.2.1")
+	var granted atomic.Int64
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Go(func() {
+			n := s.Reserve(addr, 100)
+			granted.Add(n)
+			if err := s.Settle(addr, n, n); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	wg.Wait()
+	if got := granted.Load(); got != 1000 {
+		t.Errorf("uploads were given %d bytes, want the quota of 1000", got)
+	}
+	if remaining, _ := s.Remaining(addr); remaining != 0 {
+		t.Errorf("%d bytes remaining, want 0", remaining)
+	}
+}
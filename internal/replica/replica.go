@@ -0,0 +1,97 @@
+// Package replica makes an instance a read replica of a primary: it serves downloads from its
+// own copy of the files, and forwards every request that changes them to the primary.
+package replica
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// primaryPaths are the paths, below the base path, whose reads are forwarded as well: those
+// about state that only the primary keeps, such as the jobs of the uploads it processes, and
+// the CSRF token, which must match the session of the primary that logins are forwarded to.
+var primaryPaths = []string{
+	"/api/csrf",
+	"/api/jobs/",
+	"/api/uploads/",
+}
+
+// Replica forwards writes to the primary.
+type Replica struct {
+	basePath string
+	proxy    *httputil.ReverseProxy
+}
+
+// New returns the replica configured by cfg, or nil if this instance is not one.
+func New(cfg config.ReplicaConfig, basePath string, render *respond.Renderer, logger *log.Logger) (*Replica, error) {
+	if cfg.Primary == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.Primary)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid replica primary %q: must be an http or https URL", cfg.Primary)
+	}
+	rp := &Replica{basePath: basePath}
+	rp.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(u)
+			pr.SetXForwarded()
+		},
+		// Flushed straight away, so that long-running answers, such as those of asynchronous
+		// uploads, are not held back here.
+		FlushInterval: -1,
+		ErrorLog:      logger,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.Printf("error forwarding %s %s to the primary: %v\n", r.Method, r.URL.Path, err)
+			render.Error(w, r, http.StatusBadGateway, "primary is unavailable")
+		},
+	}
+	return rp, nil
+}
+
+// Middleware forwards the requests that change files, and those about state only the primary
+// keeps, to the primary; the rest are served here.
+//
+// Why forward rather than refuse writes? Clients can then be pointed at any node, by a load
+// balancer or DNS, without having to know which one is the primary.
+func (rp *Replica) Middleware(next http.Handler) http.Handler {
+	if rp == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rp.forwards(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rp.proxy.ServeHTTP(w, r)
+	})
+}
+
+// forwards reports whether r is forwarded to the primary: anything but a read, or a read of
+// state only the primary keeps.
+func (rp *Replica) forwards(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodOptions:
+		return false
+	default:
+		return true
+	}
+	path, ok := strings.CutPrefix(r.URL.Path, rp.basePath)
+	if !ok {
+		return false
+	}
+	for _, p := range primaryPaths {
+		if path == p || strings.HasSuffix(p, "/") && strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
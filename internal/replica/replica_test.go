@@ -0,0 +1,103 @@
+package replica
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// newTestReplica returns a replica of primary, below basePath.
+func newTestReplica(t *testing.T, primary, basePath string) *Replica {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	rp, err := New(config.ReplicaConfig{Primary: primary}, basePath, respond.NewRenderer(respond.FormatJSON, logger), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+func TestNew(t *testing.T) {
+	for _, primary := range []string{"ftp://primary.example.com", "primary.example.com", "https://", "http://%zz"} {
+		if _, err := New(config.ReplicaConfig{Primary: primary}, "", nil, nil); err == nil {
+			t.Errorf("got no error for %q", primary)
+		}
+	}
+	rp, err := New(config.ReplicaConfig{}, "", nil, nil)
+	if rp != nil || err != nil {
+		t.Fatalf("got %v, %v with no primary, want no replica", rp, err)
+	}
+	// An instance that is not a replica serves every request itself.
+	served := false
+	h := rp.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served = true }))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/upload", nil))
+	if !served {
+		t.Error("an upload was not served")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Forwarded-For-Seen", r.Header.Get("X-Forwarded-For"))
+		io.WriteString(w, "primary")
+	}))
+	t.Cleanup(primary.Close)
+	rp := newTestReplica(t, primary.URL, "/files")
+	h := rp.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "replica")
+	}))
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{http.MethodGet, "/files/download/a.txt", "replica"},
+		{http.MethodHead, "/files/api/files/a.txt", "replica"},
+		{http.MethodOptions, "/files/upload", "replica"},
+		{http.MethodPost, "/files/upload", "primary"},
+		{http.MethodPut, "/files/api/files/a.txt", "primary"},
+		{http.MethodDelete, "/files/api/files/a.txt", "primary"},
+		{http.MethodPatch, "/files/api/files/a.txt", "primary"},
+		// Reads of state that only the primary keeps.
+		{http.MethodGet, "/files/api/csrf", "primary"},
+		{http.MethodGet, "/files/api/jobs/42", "primary"},
+		{http.MethodGet, "/files/api/uploads/abc", "primary"},
+		{http.MethodGet, "/files/api/csrf/other", "replica"},
+		{http.MethodGet, "/files/api/jobs", "replica"},
+		// Outside the base path.
+		{http.MethodGet, "/api/jobs/42", "replica"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+			}
+			if tt.method != http.MethodHead && w.Body.String() != tt.want {
+				t.Errorf("served by the %s, want the %s", w.Body, tt.want)
+			}
+			if tt.want == "primary" && w.Header().Get("X-Forwarded-For-Seen") != "192.0.2.1" {
+				t.Errorf("the primary got X-Forwarded-For %q, want the client", w.Header().Get("X-Forwarded-For-Seen"))
+			}
+		})
+	}
+}
+
+func TestPrimaryUnavailable(t *testing.T) {
+	primary := httptest.NewServer(http.NotFoundHandler())
+	primary.Close()
+	h := newTestReplica(t, primary.URL, "").Middleware(http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/upload", nil))
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("got status %d %s, want %d", w.Code, w.Body, http.StatusBadGateway)
+	}
+}
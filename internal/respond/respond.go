@@ -0,0 +1,167 @@
+package respond
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/errreport"
+)
+
+// Supported error response formats. FormatAuto selects one of the others per request,
+// based on the client's Accept header.
+const (
+	FormatAuto = "auto"
+	FormatJSON = "json"
+	FormatHTML = "html"
+	FormatText = "text"
+)
+
+// ErrorBody is the JSON document returned to API clients when a request fails.
+type ErrorBody struct {
+	Status  int      `json:"status"`
+	Error   string   `json:"error"`
+	Message string   `json:"message"`
+	Details []string `json:"details,omitempty"`
+	// LimitBytes is the limit that was exceeded, set on 413 Payload Too Large responses
+	// so clients can split or shrink the request without guessing.
+	LimitBytes int64 `json:"limitBytes,omitempty"`
+}
+
+// errorPage is the friendly page shown to browsers. html/template escapes every value,
+// so client-influenced messages (e.g. file names) cannot inject markup.
+var errorPage = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.Error}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 40rem; margin: 4rem auto; padding: 0 1rem; color: #222; }
+h1 { font-size: 1.5rem; }
+li { color: #555; }
+</style>
+</head>
+<body>
+<h1>{{.Status}} {{.Error}}</h1>
+<p>{{.Message}}</p>
+{{if .Details}}<ul>{{range .Details}}<li>{{.}}</li>{{end}}</ul>{{end}}
+</body>
+</html>
+`))
+
+// Renderer writes error responses in a consistent shape, negotiating the representation
+// with the client unless a fixed format has been configured.
+type Renderer struct {
+	format string
+	logger *log.Logger
+}
+
+// NewRenderer creates a Renderer for the given format. An empty or unknown format
+// falls back to FormatAuto.
+func NewRenderer(format string, logger *log.Logger) *Renderer {
+	switch format {
+	case FormatJSON, FormatHTML, FormatText:
+	default:
+		format = FormatAuto
+	}
+	return &Renderer{format: format, logger: logger}
+}
+
+// Error writes an error response with the given status code, message and optional details.
+func (rr *Renderer) Error(w http.ResponseWriter, r *http.Request, status int, msg string, details ...string) {
+	rr.write(w, r, ErrorBody{
+		Status:  status,
+		Error:   http.StatusText(status),
+		Message: msg,
+		Details: details,
+	})
+}
+
+// TooLarge writes a 413 Payload Too Large response that reports the exceeded limit,
+// both as a machine-readable field and as a human-readable detail.
+func (rr *Renderer) TooLarge(w http.ResponseWriter, r *http.Request, msg string, limit int64) {
+	rr.write(w, r, ErrorBody{
+		Status:     http.StatusRequestEntityTooLarge,
+		Error:      http.StatusText(http.StatusRequestEntityTooLarge),
+		Message:    msg,
+		Details:    []string{fmt.Sprintf("the limit is %d bytes", limit)},
+		LimitBytes: limit,
+	})
+}
+
+// write renders body in the negotiated format.
+func (rr *Renderer) write(w http.ResponseWriter, r *http.Request, body ErrorBody) {
+	// Server-side failures are worth an operator's attention, so they are passed on to the
+	// error reporter, if one is configured. Client errors (4xx) are expected and are not.
+	if body.Status >= 500 {
+		errreport.FromContext(r.Context()).CaptureMessage(r, body.Status, body.Message)
+	}
+
+	// Why delete Content-Length? A handler may have set it for a file it intended to
+	// serve; leaving it in place would corrupt the error response.
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Disposition")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	var err error
+	switch rr.negotiate(r) {
+	case FormatJSON:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(body.Status)
+		err = json.NewEncoder(w).Encode(body)
+	case FormatHTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(body.Status)
+		err = errorPage.Execute(w, body)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(body.Status)
+		var sb strings.Builder
+		sb.WriteString(body.Message)
+		sb.WriteByte('\n')
+		for _, d := range body.Details {
+			fmt.Fprintf(&sb, "- %s\n", d)
+		}
+		_, err = w.Write([]byte(sb.String()))
+	}
+	if err != nil {
+		rr.logger.Printf("error writing error response: %v\n", err)
+	}
+}
+
+// JSON writes v as a JSON response with the given status code.
+func (rr *Renderer) JSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		rr.logger.Printf("error writing response: %s\n", err)
+	}
+}
+
+// negotiate picks the response format for a request. Browsers announce text/html in
+// their Accept header and receive a friendly page; clients that explicitly prefer
+// text/plain receive plain text; everything else (API clients, curl) receives JSON.
+func (rr *Renderer) negotiate(r *http.Request) string {
+	if rr.format != FormatAuto {
+		return rr.format
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			return FormatHTML
+		case "application/json":
+			return FormatJSON
+		case "text/plain":
+			return FormatText
+		}
+	}
+	return FormatJSON
+}
@@ -0,0 +1,97 @@
+package respond
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	tests := []struct {
+		desc            string
+		format          string
+		accept          string
+		wantContentType string
+	}{
+		{"a browser", FormatAuto, "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"an API client", FormatAuto, "application/json", "application/json; charset=utf-8"},
+		{"a client asking for text", FormatAuto, "text/plain", "text/plain; charset=utf-8"},
+		{"a client asking for anything", FormatAuto, "*/*", "application/json; charset=utf-8"},
+		{"a client without preferences", FormatAuto, "", "application/json; charset=utf-8"},
+		{"a malformed Accept header", FormatAuto, ";;, text/plain", "text/plain; charset=utf-8"},
+		{"a browser, with JSON configured", FormatJSON, "text/html", "application/json; charset=utf-8"},
+		{"an API client, with HTML configured", FormatHTML, "application/json", "text/html; charset=utf-8"},
+		{"an API client, with text configured", FormatText, "application/json", "text/plain; charset=utf-8"},
+		{"an API client, with an unknown format configured", "xml", "application/json", "application/json; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/download/a.txt", nil)
+			r.Header.Set("Accept", tt.accept)
+			w := httptest.NewRecorder()
+			// Set by a handler that meant to serve a file.
+			w.Header().Set("Content-Length", "1000")
+			w.Header().Set("Content-Disposition", "attachment")
+			NewRenderer(tt.format, log.New(io.Discard, "", 0)).Error(w, r, http.StatusNotFound, "file not found", "a.txt")
+			if w.Code != http.StatusNotFound {
+				t.Errorf("got status %d, want %d", w.Code, http.StatusNotFound)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("got Content-Type %s, want %s", got, tt.wantContentType)
+			}
+			if w.Header().Get("Content-Length") != "" || w.Header().Get("Content-Disposition") != "" {
+				t.Error("headers of the file kept")
+			}
+			if got := w.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+				t.Errorf("got X-Content-Type-Options %q, want nosniff", got)
+			}
+			if !strings.Contains(w.Body.String(), "file not found") || !strings.Contains(w.Body.String(), "a.txt") {
+				t.Errorf("body %q lacks the message or its details", w.Body)
+			}
+		})
+	}
+}
+
+func TestErrorBodies(t *testing.T) {
+	render := func(format string) string {
+		w := httptest.NewRecorder()
+		NewRenderer(format, log.New(io.Discard, "", 0)).Error(w, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusBadRequest, `bad name "<script>"`, "first", "second")
+		return w.Body.String()
+	}
+
+	var body ErrorBody
+	if err := json.Unmarshal([]byte(render(FormatJSON)), &body); err != nil {
+		t.Fatal(err)
+	}
+	want := ErrorBody{Status: http.StatusBadRequest, Error: "Bad Request", Message: `bad name "<script>"`, Details: []string{"first", "second"}}
+	if body.Status != want.Status || body.Error != want.Error || body.Message != want.Message || strings.Join(body.Details, ",") != "first,second" {
+		t.Errorf("got %+v, want %+v", body, want)
+	}
+
+	if got := render(FormatHTML); strings.Contains(got, "<script>") || !strings.Contains(got, "&lt;script&gt;") {
+		t.Errorf("page does not escape the message:\n%s", got)
+	}
+
+	if got, want := render(FormatText), "bad name \"<script>\"\n- first\n- second\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	w := httptest.NewRecorder()
+	NewRenderer(FormatJSON, log.New(io.Discard, "", 0)).TooLarge(w, httptest.NewRequest(http.MethodPost, "/upload", nil), "request body exceeds the maximum upload size", 1<<20)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	var body ErrorBody
+	if err := json.NewDecoder(w.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.LimitBytes != 1<<20 || len(body.Details) != 1 || body.Details[0] != "the limit is 1048576 bytes" {
+		t.Errorf("got %+v, want the limit of 1048576 bytes", body)
+	}
+}
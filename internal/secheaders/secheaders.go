@@ -0,0 +1,97 @@
+package secheaders
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// header is a single response header and its configured value.
+type header struct {
+	name  string
+	value string
+}
+
+// pathHeaders are the headers configured for the requests for path and below.
+type pathHeaders struct {
+	path    string // without trailing slash, or "" for every path
+	headers []header
+}
+
+// Setter adds the configured security headers to every response, and the headers configured
+// for a path to the responses below it.
+//
+// Why a middleware? The headers must be present on every response, including errors
+// produced by other middleware (e.g. a rejected CSRF token), for security scanners and
+// browsers alike. Setting them in one outermost place means no handler can forget them.
+type Setter struct {
+	headers  []header
+	hsts     string
+	secure   bool
+	basePath string
+	paths    []pathHeaders // shortest path first
+}
+
+// New creates a Setter from the application configuration. Headers configured with an
+// empty value are not sent.
+func New(cfg *config.Config) *Setter {
+	sc := cfg.SecurityHeaders
+	s := &Setter{hsts: sc.StrictTransportSecurity, secure: cfg.Server.SecureCookies, basePath: cfg.Server.GetBasePath()}
+	for _, h := range []header{
+		{"X-Content-Type-Options", sc.ContentTypeOptions},
+		{"X-Frame-Options", sc.FrameOptions},
+		{"Referrer-Policy", sc.ReferrerPolicy},
+		{"Content-Security-Policy", sc.ContentSecurityPolicy},
+	} {
+		if h.value != "" {
+			s.headers = append(s.headers, h)
+		}
+	}
+	for _, rule := range cfg.ResponseHeaders {
+		ph := pathHeaders{path: strings.TrimSuffix(rule.Path, "/")}
+		for name, value := range rule.Headers {
+			ph.headers = append(ph.headers, header{http.CanonicalHeaderKey(name), value})
+		}
+		s.paths = append(s.paths, ph)
+	}
+	// Why shortest first? The headers of every matching path are set in turn, so those of
+	// the longest, most specific path are set last and win.
+	slices.SortStableFunc(s.paths, func(a, b pathHeaders) int { return len(a.path) - len(b.path) })
+	return s
+}
+
+// Middleware sets the headers before passing the request on, so handlers may still
+// override them for individual responses. Paths match whole segments: "/public" matches
+// "/public/a.txt" but not "/publicity".
+//
+// Strict-Transport-Security is only sent over HTTPS: on the request's own TLS connection,
+// or when secureCookies declares that a TLS-terminating proxy sits in front of the server.
+// Browsers ignore it on plain HTTP, and sending it there would only mislead scanners.
+func (s *Setter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, h := range s.headers {
+			w.Header().Set(h.name, h.value)
+		}
+		if s.hsts != "" && (r.TLS != nil || s.secure) {
+			w.Header().Set("Strict-Transport-Security", s.hsts)
+		}
+		if len(s.paths) > 0 {
+			p := strings.TrimPrefix(r.URL.Path, s.basePath)
+			for _, ph := range s.paths {
+				if p != ph.path && !strings.HasPrefix(p, ph.path+"/") {
+					continue
+				}
+				for _, h := range ph.headers {
+					if h.value == "" {
+						w.Header().Del(h.name)
+					} else {
+						w.Header().Set(h.name, h.value)
+					}
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
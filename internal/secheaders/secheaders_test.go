@@ -0,0 +1,133 @@
+package secheaders
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// serve passes r through the middleware of s to a handler that sets the headers in set,
+// and returns the headers of the response.
+func serve(s *Setter, r *http.Request, set map[string]string) http.Header {
+	w := httptest.NewRecorder()
+	s.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range set {
+			w.Header().Set(name, value)
+		}
+		w.WriteHeader(http.StatusNotFound)
+	})).ServeHTTP(w, r)
+	return w.Header()
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	defaults := config.Default().SecurityHeaders
+	tests := []struct {
+		desc      string
+		configure func(cfg *config.Config)
+		tls       bool
+		set       map[string]string // by the handler
+		want      map[string]string // "" for a header that must not be sent
+	}{
+		{"the defaults, over HTTP", nil, false, nil, map[string]string{
+			"X-Content-Type-Options":    "nosniff",
+			"X-Frame-Options":           "DENY",
+			"Referrer-Policy":           "no-referrer",
+			"Content-Security-Policy":   defaults.ContentSecurityPolicy,
+			"Strict-Transport-Security": "",
+		}},
+		{"the defaults, over HTTPS", nil, true, nil, map[string]string{
+			"Strict-Transport-Security": defaults.StrictTransportSecurity,
+		}},
+		{"behind a proxy terminating TLS", func(cfg *config.Config) { cfg.Server.SecureCookies = true }, false, nil, map[string]string{
+			"Strict-Transport-Security": defaults.StrictTransportSecurity,
+		}},
+		{"headers disabled", func(cfg *config.Config) {
+			cfg.SecurityHeaders.FrameOptions = ""
+			cfg.SecurityHeaders.StrictTransportSecurity = ""
+		}, true, nil, map[string]string{
+			"X-Content-Type-Options":    "nosniff",
+			"X-Frame-Options":           "",
+			"Strict-Transport-Security": "",
+		}},
+		{"a header set by the handler", nil, false, map[string]string{"Content-Security-Policy": "sandbox"}, map[string]string{
+			"Content-Security-Policy": "sandbox",
+			"X-Frame-Options":         "DENY",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := config.Default()
+			if tt.configure != nil {
+				tt.configure(cfg)
+			}
+			r := httptest.NewRequest(http.MethodGet, "/download/a.txt", nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			got := serve(New(cfg), r, tt.set)
+			for name, want := range tt.want {
+				if got.Get(name) != want {
+					t.Errorf("got %s %q, want %q", name, got.Get(name), want)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseHeaders(t *testing.T) {
+	cfg := config.Default()
+	cfg.Server.BasePath = "/files"
+	cfg.ResponseHeaders = []config.ResponseHeadersRule{
+		{Path: "/download/public/", Headers: map[string]string{
+			"cross-origin-resource-policy": "cross-origin",
+			"X-Robots-Tag":                 "",
+		}},
+		{Path: "/", Headers: map[string]string{"X-Robots-Tag": "noindex"}},
+		{Path: "/embed", Headers: map[string]string{"X-Frame-Options": ""}},
+	}
+	s := New(cfg)
+
+	tests := []struct {
+		desc string
+		path string
+		set  map[string]string // by the handler
+		want map[string]string // "" for a header that must not be sent
+	}{
+		{"any path", "/files/api/files", nil, map[string]string{
+			"X-Robots-Tag":                 "noindex",
+			"Cross-Origin-Resource-Policy": "",
+		}},
+		// The longer path wins.
+		{"below a longer path", "/files/download/public/a.txt", nil, map[string]string{
+			"X-Robots-Tag":                 "",
+			"Cross-Origin-Resource-Policy": "cross-origin",
+		}},
+		{"the longer path itself", "/files/download/public", nil, map[string]string{
+			"Cross-Origin-Resource-Policy": "cross-origin",
+		}},
+		{"a path sharing a prefix", "/files/download/publicity.txt", nil, map[string]string{
+			"X-Robots-Tag":                 "noindex",
+			"Cross-Origin-Resource-Policy": "",
+		}},
+		{"a security header removed", "/files/embed/a.pdf", nil, map[string]string{
+			"X-Frame-Options":        "",
+			"X-Content-Type-Options": "nosniff",
+		}},
+		{"a header set by the handler", "/files/download/public/a.txt", map[string]string{"Cross-Origin-Resource-Policy": "same-site"}, map[string]string{
+			"Cross-Origin-Resource-Policy": "same-site",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			got := serve(s, httptest.NewRequest(http.MethodGet, tt.path, nil), tt.set)
+			for name, want := range tt.want {
+				if got.Get(name) != want {
+					t.Errorf("got %s %q, want %q", name, got.Get(name), want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// certCheckInterval is how often the files of a certificate are checked for changes.
+const certCheckInterval = time.Minute
+
+// certificate is a TLS certificate loaded from files, and loaded again when they change.
+//
+// Why reload rather than restart? Certificates from ACME clients such as certbot are renewed
+// every few weeks, and restarting would interrupt the uploads in progress.
+type certificate struct {
+	cfg    config.TLSConfig
+	logger *log.Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time // the later of the files' modification times when loaded
+	checked time.Time
+}
+
+// loadCertificate loads the certificate of cfg.
+func loadCertificate(cfg config.TLSConfig, logger *log.Logger) (*certificate, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("tls needs both a certFile and a keyFile")
+	}
+	c := &certificate{cfg: cfg, logger: logger}
+	modTime, err := c.modified()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate %s: %w", cfg.CertFile, err)
+	}
+	c.cert, c.modTime, c.checked = &cert, modTime, time.Now()
+	return c, nil
+}
+
+// modified returns the later of the modification times of the certificate's files.
+func (c *certificate) modified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.cfg.CertFile, c.cfg.KeyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// get returns the certificate, having loaded it again if its files changed. A certificate
+// that fails to load is logged, and the one loaded before served on.
+func (c *certificate) get() *tls.Certificate {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < certCheckInterval {
+		return c.cert
+	}
+	c.checked = time.Now()
+	modTime, err := c.modified()
+	if err != nil || modTime.Equal(c.modTime) {
+		return c.cert
+	}
+	cert, err := tls.LoadX509KeyPair(c.cfg.CertFile, c.cfg.KeyFile)
+	if err != nil {
+		// Why keep the old one? The key and certificate are often written one after the
+		// other, and the next check finds them matching again.
+		c.logger.Printf("error reloading certificate %s: %v\n", c.cfg.CertFile, err)
+		return c.cert
+	}
+	c.logger.Printf("reloaded certificate %s\n", c.cfg.CertFile)
+	c.cert, c.modTime = &cert, modTime
+	return c.cert
+}
+
+// normaliseHost returns the host name of a Host header or TLS server name: lower-case,
+// without a port or the trailing dot of a fully qualified name.
+func normaliseHost(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		host = host[:i]
+	}
+	host = strings.TrimSuffix(strings.Trim(host, "[]"), ".")
+	return strings.ToLower(host)
+}
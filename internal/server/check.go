@@ -0,0 +1,205 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/capture"
+	"github.com/mascotmascot1/fileserver/internal/cdn"
+	"github.com/mascotmascot1/fileserver/internal/clientip"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/faults"
+	"github.com/mascotmascot1/fileserver/internal/fetch"
+	"github.com/mascotmascot1/fileserver/internal/mirror"
+	"github.com/mascotmascot1/fileserver/internal/shard"
+)
+
+// Check validates cfg as far as it can without starting the server: without creating its
+// directories, opening its stores or connecting to the services it uses. It returns every
+// problem found rather than only the first, for "fileserver check-config".
+//
+// Why not start a server and stop it again? Starting one takes locks, reconciles the file
+// metadata and talks to brokers and coordination services, none of which a check run on a
+// build machine should do to the production setup.
+func Check(cfg *config.Config) error {
+	discard := log.New(io.Discard, "", 0)
+	var errs []error
+	add := func(err error) {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	checkApp := func(cfg *config.Config) {
+		add(checkSettings(cfg))
+		_, err := clientip.New(cfg.Server.TrustedProxies)
+		add(err)
+		_, err = shard.New(cfg.Uploader.StorageDir, cfg.Shards)
+		add(err)
+		_, err = fetch.New(cfg.Fetch)
+		add(err)
+		_, err = mirror.New(cfg.Mirror)
+		add(err)
+		_, err = cdn.NewSigner(cfg.CDN)
+		add(err)
+		_, err = cdn.NewPurger(cfg.CDN, discard)
+		add(err)
+		_, err = capture.New(cfg.DebugCapture, nil, nil, discard)
+		add(err)
+		_, err = faults.New(cfg.Faults, discard)
+		add(err)
+	}
+	checkApp(cfg)
+	// Tenants inherit most settings, whose problems are reported once, for the main server.
+	inherited := make(map[string]bool)
+	for _, err := range errs {
+		inherited[err.Error()] = true
+	}
+
+	if cfg.Server.TLS.CertFile != "" || cfg.Server.TLS.KeyFile != "" {
+		if _, err := loadCertificate(cfg.Server.TLS, discard); err != nil {
+			add(fmt.Errorf("server.tls: %w", err))
+		}
+	}
+	names := make(map[string]bool)
+	hosts := make(map[string]string)
+	for _, tc := range cfg.Tenancy.Tenants {
+		if !tenantName.MatchString(tc.Name) {
+			add(fmt.Errorf("invalid tenant name %q: use up to 63 lower-case letters, digits and dashes", tc.Name))
+			continue
+		}
+		if names[tc.Name] {
+			add(fmt.Errorf("tenant %q is defined more than once", tc.Name))
+		}
+		names[tc.Name] = true
+		for _, h := range tc.Hosts {
+			host := normaliseHost(h)
+			if host == "" || strings.ContainsAny(host, "/ *") {
+				add(fmt.Errorf("invalid host %q for tenant %q", h, tc.Name))
+			} else if other, ok := hosts[host]; ok {
+				add(fmt.Errorf("host %s of tenant %q is tenant %q's already", host, tc.Name, other))
+			} else {
+				hosts[host] = tc.Name
+			}
+		}
+		if tc.TLS.CertFile != "" || tc.TLS.KeyFile != "" {
+			if cfg.Server.TLS.CertFile == "" || len(tc.Hosts) == 0 {
+				add(fmt.Errorf("the certificate of tenant %q needs hosts, and server.tls to be enabled", tc.Name))
+			} else if _, err := loadCertificate(tc.TLS, discard); err != nil {
+				add(fmt.Errorf("tenant %q: %w", tc.Name, err))
+			}
+		}
+		before := len(errs)
+		checkApp(tenantConfig(cfg, tc))
+		found := errs[before:]
+		errs = errs[:before:before]
+		for _, err := range found {
+			if !inherited[err.Error()] {
+				add(fmt.Errorf("tenant %q: %w", tc.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// checkSettings validates the settings of cfg that no component checks when it is created,
+// and returns every problem found.
+func checkSettings(cfg *config.Config) error {
+	var errs []error
+	switch cfg.Session.Store {
+	case "memory", "file", "sqlite":
+	default:
+		errs = append(errs, fmt.Errorf("invalid session.store %q: must be memory, file or sqlite", cfg.Session.Store))
+	}
+	switch cfg.Processing.Async {
+	case "off", "request", "always":
+	default:
+		errs = append(errs, fmt.Errorf("invalid processing.async %q: must be off, request or always", cfg.Processing.Async))
+	}
+	switch cfg.Uploader.Symlinks {
+	case "follow", "refuse", "hide":
+	default:
+		errs = append(errs, fmt.Errorf("invalid uploader.symlinks %q: must be follow, refuse or hide", cfg.Uploader.Symlinks))
+	}
+	if p := path.Clean(cfg.Paste.Dir); cfg.Paste.MaxSizeKB > 0 && (path.IsAbs(p) || p == "." || p == ".." || strings.HasPrefix(p, "../")) {
+		errs = append(errs, fmt.Errorf("invalid paste.dir %q: must be a directory within the storage directory", cfg.Paste.Dir))
+	}
+	if d := path.Clean(cfg.Uploader.DateDir(time.Now())); cfg.Uploader.DateDirs != "" && (path.IsAbs(d) || d == ".." || strings.HasPrefix(d, "../")) {
+		errs = append(errs, fmt.Errorf("invalid uploader.dateDirs %q: must be a directory within the storage directory", cfg.Uploader.DateDirs))
+	}
+	if n := path.Clean(cfg.Uploader.StoredName("file.txt", time.Now(), "uuid")); path.IsAbs(n) || n == "." || n == ".." || strings.HasPrefix(n, "../") {
+		errs = append(errs, fmt.Errorf("invalid uploader.nameTemplate %q: must name a file within the upload's directory", cfg.Uploader.NameTemplate))
+	}
+	if pdfjs := cfg.Viewer.PDFJS; pdfjs != "" {
+		u, err := url.Parse(pdfjs)
+		remote := err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+		local := err == nil && u.Scheme == "" && u.Host == "" && strings.HasPrefix(u.Path, "/")
+		if !remote && !local {
+			errs = append(errs, fmt.Errorf("invalid viewer.pdfjs %q: must be an http or https URL, or a path starting with /", pdfjs))
+		}
+	}
+	if _, ok := cfg.Uploader.GetFileMode(); cfg.Uploader.FileMode != "" && !ok {
+		errs = append(errs, fmt.Errorf("invalid uploader.fileMode %q: must be octal permissions such as 0640", cfg.Uploader.FileMode))
+	}
+	if _, ok := cfg.Uploader.GetDirMode(); cfg.Uploader.DirMode != "" && !ok {
+		errs = append(errs, fmt.Errorf("invalid uploader.dirMode %q: must be octal permissions such as 0750", cfg.Uploader.DirMode))
+	}
+	if runtime.GOOS == "windows" && (cfg.Uploader.UID >= 0 || cfg.Uploader.GID >= 0) {
+		errs = append(errs, fmt.Errorf("uploader.uid and uploader.gid are not supported on Windows"))
+	}
+	for _, q := range cfg.DirQuotas {
+		if q.MaxSizeMB <= 0 {
+			errs = append(errs, fmt.Errorf("invalid dirQuotas entry for %q: maxSizeMB must be positive", q.Path))
+		}
+	}
+	if ec := cfg.Eviction; ec.Policy != "" {
+		if ec.Policy != "lru" && ec.Policy != "oldest" {
+			errs = append(errs, fmt.Errorf("invalid eviction.policy %q: must be lru or oldest", ec.Policy))
+		}
+		if ec.MaxSizeMB <= 0 {
+			errs = append(errs, fmt.Errorf("invalid eviction.maxSizeMB %d: must be positive", ec.MaxSizeMB))
+		}
+		if ec.LowWatermark <= 0 || ec.LowWatermark > ec.HighWatermark || ec.HighWatermark > 100 {
+			errs = append(errs, fmt.Errorf("invalid eviction watermarks %d%% and %d%%: must satisfy 0 < lowWatermark <= highWatermark <= 100", ec.LowWatermark, ec.HighWatermark))
+		}
+		if ec.Interval <= 0 {
+			errs = append(errs, fmt.Errorf("invalid eviction.interval %s: must be positive", ec.Interval))
+		}
+	}
+	sweeping := false
+	for _, rule := range cfg.WORM.Rules {
+		if rule.Retention < 0 {
+			errs = append(errs, fmt.Errorf("invalid worm rule for %q: retention must not be negative", rule.Path))
+		}
+		if rule.DeleteExpired && rule.Retention == 0 {
+			errs = append(errs, fmt.Errorf("invalid worm rule for %q: deleteExpired needs a retention, as the files are kept forever", rule.Path))
+		}
+		sweeping = sweeping || rule.DeleteExpired
+	}
+	if sweeping && cfg.WORM.SweepInterval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid worm.sweepInterval %s: must be positive to delete expired files", cfg.WORM.SweepInterval))
+	}
+	if cfg.Integrity.Interval < 0 {
+		errs = append(errs, fmt.Errorf("invalid integrity.interval %s: must not be negative", cfg.Integrity.Interval))
+	}
+	for _, rule := range cfg.ResponseHeaders {
+		if !strings.HasPrefix(rule.Path, "/") {
+			errs = append(errs, fmt.Errorf("invalid responseHeaders path %q: must start with a slash", rule.Path))
+		}
+		for name, value := range rule.Headers {
+			if name == "" || strings.ContainsAny(name, " \t:\r\n") || strings.ContainsAny(value, "\r\n") {
+				errs = append(errs, fmt.Errorf("invalid responseHeaders header %q for %q", name, rule.Path))
+			}
+		}
+	}
+	if len(cfg.CDN.Purge) > 0 && cfg.CDN.PurgeInterval <= 0 {
+		errs = append(errs, fmt.Errorf("invalid cdn purgeInterval %s: must be positive", cfg.CDN.PurgeInterval))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/mascotmascot1/fileserver/internal/errreport"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// recoverer turns a panicking request into a 500 response, logs the panic with its stack
+// trace and passes it to the error reporter.
+//
+// Why recover at all? net/http already recovers handler panics, but only by logging them
+// and dropping the connection, so the client sees a reset rather than an error response.
+// It also places the reporter in the request context, so the renderer can report the
+// internal errors it is asked to render.
+func recoverer(next http.Handler, rep *errreport.Reporter, render *respond.Renderer, logger *log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(errreport.NewContext(r.Context(), rep))
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// ErrAbortHandler is how handlers deliberately abort a response; net/http
+			// expects to see it and suppresses its logging.
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			stack := debug.Stack()
+			logger.Printf("panic serving %s %s for %s: %v\n%s", r.Method, r.URL.Path, r.RemoteAddr, v, stack)
+			rep.CapturePanic(r, v, stack)
+			// The panic has been reported already; rendering must not report it a second time.
+			render.Error(w, r.WithContext(errreport.NewContext(r.Context(), nil)), http.StatusInternalServerError, "internal error")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/errreport"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+func TestRecoverer(t *testing.T) {
+	var mu sync.Mutex
+	var envelopes []string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		envelopes = append(envelopes, string(body))
+		mu.Unlock()
+	}))
+	defer tracker.Close()
+	rep, err := errreport.New(strings.Replace(tracker.URL, "://", "://key@", 1)+"/1", "", nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	render := respond.NewRenderer(respond.FormatJSON, log.New(io.Discard, "", 0))
+	handler := recoverer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/panic":
+			w.Header().Set("Content-Length", "100")
+			panic("nil map")
+		case "/abort":
+			panic(http.ErrAbortHandler)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}), rep, render, log.New(&logs, "", 0))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ok", nil))
+	if w.Code != http.StatusNoContent {
+		t.Errorf("got status %d, want %d", w.Code, http.StatusNoContent)
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	var body respond.ErrorBody
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || w.Code != http.StatusInternalServerError || body.Status != http.StatusInternalServerError {
+		t.Errorf("got status %d %s, want %d", w.Code, w.Body, http.StatusInternalServerError)
+	}
+	if !strings.Contains(logs.String(), "panic serving GET /panic") || !strings.Contains(logs.String(), "nil map") {
+		t.Errorf("logged %q, want the panic", logs.String())
+	}
+
+	// A deliberate abort is left to net/http.
+	func() {
+		defer func() {
+			if v := recover(); v != http.ErrAbortHandler {
+				t.Errorf("got panic %v, want ErrAbortHandler", v)
+			}
+		}()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/abort", nil))
+	}()
+
+	// Give the reporter time to send anything further before counting what it sent.
+	time.Sleep(100 * time.Millisecond)
+	rep.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(envelopes) != 1 {
+		t.Fatalf("reported %d events, want the panic reported once", len(envelopes))
+	}
+	if !strings.Contains(envelopes[0], `"level":"fatal"`) || !strings.Contains(envelopes[0], "nil map") {
+		t.Errorf("reported %s, want the panic", envelopes[0])
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/cluster"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+// probeMethods are the methods checked when working out which ones a path supports.
+// HEAD is implied by GET patterns, so it is probed as well.
+var probeMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	"LOCK",
+	"UNLOCK",
+}
+
+// router wraps the ServeMux to answer OPTIONS requests and to render 404 and 405
+// responses through the shared error renderer, always with an accurate Allow header.
+type router struct {
+	mux     *http.ServeMux
+	render  *respond.Renderer
+	cluster *cluster.Cluster // nil unless clustered
+}
+
+// ServeHTTP dispatches matched requests to the mux and handles everything else itself.
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rt.cluster.Admit(r)
+	if _, pattern := rt.mux.Handler(r); pattern != "" {
+		if name, ok := patternFile(pattern, r); ok && rt.cluster.Forward(w, r, name) {
+			return
+		}
+		rt.mux.ServeHTTP(w, r)
+		return
+	}
+
+	allowed := rt.allowedMethods(r)
+	if len(allowed) == 0 {
+		rt.render.Error(w, r, http.StatusNotFound, "resource not found")
+		return
+	}
+
+	// Why always list OPTIONS? The router answers it for every known path itself.
+	w.Header().Set("Allow", strings.Join(append(allowed, http.MethodOptions), ", "))
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	rt.render.Error(w, r, http.StatusMethodNotAllowed, fmt.Sprintf("method %s is not allowed", r.Method))
+}
+
+// allowedMethods returns the methods for which a pattern is registered on the request's path.
+// Why probe the mux rather than keep a separate table? The mux is the single source of truth
+// for routing, so the Allow header can never drift from the registered patterns.
+func (rt *router) allowedMethods(r *http.Request) []string {
+	var allowed []string
+	probe := new(http.Request)
+	for _, method := range probeMethods {
+		*probe = *r
+		probe.Method = method
+		if _, pattern := rt.mux.Handler(probe); pattern != "" {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+// patternFile returns the file a request matching pattern is about: the part of its path
+// that the "{name...}" wildcard matches. It reports false for patterns without one.
+//
+// Why work it out here rather than in the handlers? Every route about a single file ends in
+// that wildcard, so the router can send all of them to the node that owns the file at once,
+// before any handler reads the body.
+func patternFile(pattern string, r *http.Request) (string, bool) {
+	_, path, _ := strings.Cut(pattern, " ")
+	prefix, ok := strings.CutSuffix(path, "{name...}")
+	if !ok {
+		return "", false
+	}
+	return strings.TrimPrefix(r.URL.Path, prefix), true
+}
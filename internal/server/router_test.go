@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/cluster"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+)
+
+func TestRouter(t *testing.T) {
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	mux.HandleFunc("POST /upload", ok)
+	mux.HandleFunc("GET /download/{name...}", ok)
+	mux.HandleFunc("GET /api/files/{name...}", ok)
+	mux.HandleFunc("PATCH /api/files/{name...}", ok)
+	mux.HandleFunc("LOCK /api/files/{name...}", ok)
+	rt := &router{mux: mux, render: respond.NewRenderer(respond.FormatJSON, log.New(io.Discard, "", 0))}
+
+	tests := []struct {
+		desc       string
+		method     string
+		target     string
+		wantStatus int
+		wantAllow  string
+	}{
+		{"a registered method", http.MethodGet, "/download/a.txt", http.StatusOK, ""},
+		{"HEAD, implied by GET", http.MethodHead, "/download/a.txt", http.StatusOK, ""},
+		{"OPTIONS", http.MethodOptions, "/download/a.txt", http.StatusNoContent, "GET, HEAD, OPTIONS"},
+		{"OPTIONS on a path with several methods", http.MethodOptions, "/api/files/a.txt", http.StatusNoContent, "GET, HEAD, PATCH, LOCK, OPTIONS"},
+		{"OPTIONS on a POST-only path", http.MethodOptions, "/upload", http.StatusNoContent, "POST, OPTIONS"},
+		{"another method", http.MethodDelete, "/download/a.txt", http.StatusMethodNotAllowed, "GET, HEAD, OPTIONS"},
+		{"an unknown method", "PURGE", "/api/files/a.txt", http.StatusMethodNotAllowed, "GET, HEAD, PATCH, LOCK, OPTIONS"},
+		{"an unknown path", http.MethodGet, "/nowhere", http.StatusNotFound, ""},
+		{"OPTIONS on an unknown path", http.MethodOptions, "/nowhere", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("got Allow %q, want %q", got, tt.wantAllow)
+			}
+			// Refusals are rendered like every other error.
+			if w.Code >= 400 {
+				var body respond.ErrorBody
+				if err := json.NewDecoder(w.Body).Decode(&body); err != nil || body.Status != tt.wantStatus {
+					t.Errorf("got body %+v, %v, want an error of status %d", body, err, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
+
+// TestRouterForwards checks that requests about a single file are sent to the node owning
+// it, and the rest are served where they arrive.
+func TestRouterForwards(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	render := respond.NewRenderer(respond.FormatJSON, logger)
+	c, err := cluster.New(config.ClusterConfig{
+		Self:         "node-a",
+		Peers:        []config.ClusterPeer{{Name: "node-a", URL: "http://node-a:8090"}, {Name: "node-b", URL: "http://node-b:8090"}},
+		Mode:         "redirect",
+		VirtualNodes: 100,
+	}, render, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mine, theirs string
+	for i := 0; mine == "" || theirs == ""; i++ {
+		name := fmt.Sprintf("docs/file%d.txt", i)
+		if c.Owns(name) {
+			mine = name
+		} else {
+			theirs = name
+		}
+	}
+	mux := http.NewServeMux()
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	mux.HandleFunc("POST /upload", ok)
+	mux.HandleFunc("GET /download/{name...}", ok)
+	mux.HandleFunc("GET /api/files/{name...}", ok)
+	rt := &router{mux: mux, render: render, cluster: c}
+
+	tests := []struct {
+		desc         string
+		method       string
+		target       string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"a file this node owns", http.MethodGet, "/download/" + mine, http.StatusOK, ""},
+		{"a file another node owns", http.MethodGet, "/download/" + theirs, http.StatusTemporaryRedirect, "http://node-b:8090/download/" + theirs},
+		{"its details", http.MethodGet, "/api/files/" + theirs, http.StatusTemporaryRedirect, "http://node-b:8090/api/files/" + theirs},
+		{"a route about no single file", http.MethodPost, "/upload", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			rt.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("got Location %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
@@ -1,45 +1,574 @@
 package server
 
 import (
+	"crypto/tls"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
 
+	"github.com/mascotmascot1/fileserver/internal/abuse"
+	"github.com/mascotmascot1/fileserver/internal/assembly"
+	"github.com/mascotmascot1/fileserver/internal/audit"
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/authz"
+	"github.com/mascotmascot1/fileserver/internal/capture"
+	"github.com/mascotmascot1/fileserver/internal/cdn"
+	"github.com/mascotmascot1/fileserver/internal/clientip"
+	"github.com/mascotmascot1/fileserver/internal/cluster"
 	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/convert"
+	"github.com/mascotmascot1/fileserver/internal/coord"
+	"github.com/mascotmascot1/fileserver/internal/csrf"
+	"github.com/mascotmascot1/fileserver/internal/diskspace"
+	"github.com/mascotmascot1/fileserver/internal/errreport"
+	"github.com/mascotmascot1/fileserver/internal/faults"
+	"github.com/mascotmascot1/fileserver/internal/fetch"
+	"github.com/mascotmascot1/fileserver/internal/filemeta"
+	"github.com/mascotmascot1/fileserver/internal/geoip"
 	"github.com/mascotmascot1/fileserver/internal/handlers"
+	"github.com/mascotmascot1/fileserver/internal/holds"
+	"github.com/mascotmascot1/fileserver/internal/jobs"
+	"github.com/mascotmascot1/fileserver/internal/leader"
+	"github.com/mascotmascot1/fileserver/internal/metrics"
+	"github.com/mascotmascot1/fileserver/internal/mirror"
+	"github.com/mascotmascot1/fileserver/internal/notify"
+	"github.com/mascotmascot1/fileserver/internal/quarantine"
+	"github.com/mascotmascot1/fileserver/internal/quota"
+	"github.com/mascotmascot1/fileserver/internal/replica"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+	"github.com/mascotmascot1/fileserver/internal/secheaders"
+	"github.com/mascotmascot1/fileserver/internal/session"
+	"github.com/mascotmascot1/fileserver/internal/shard"
+	"github.com/mascotmascot1/fileserver/internal/shortlinks"
+	"github.com/mascotmascot1/fileserver/internal/tokens"
+	"github.com/mascotmascot1/fileserver/internal/users"
+	"github.com/mascotmascot1/fileserver/internal/video"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
 )
 
 // Server represents the application's HTTP server, encapsulating its
 // configuration and logger.
 type Server struct {
-	HTTP   *http.Server
-	Logger *log.Logger
+	HTTP    *http.Server
+	Logger  *log.Logger
+	uploads *uploadTracker
+	main    *app
+	tenants *tenantSet
+	closed  sync.Once
 }
 
-// NewServer creates and returns a new Server instance.
-//
-// It sets up the HTTP router, registers request handlers with their dependencies,
-// and configures server settings such as address and timeouts.
-func NewServer(cfg *config.Config, logger *log.Logger) *Server {
-	// Initialise the handlers with their required dependencies (config and logger).
-	h := handlers.NewHandlers(cfg, logger)
+// app is the handler serving one storage directory, the main one or a tenant's, together
+// with what must be stopped or saved when the server stops.
+type app struct {
+	handler  http.Handler
+	storage  storage.Storage
+	fileMeta *filemeta.Store
+	// closers stop the background work and save the stores of the app. They are run in the
+	// reverse of the order they were added in, so that nothing is stopped before the work
+	// that depends on it.
+	closers []closer
+}
 
-	// Initialise the handlers with their required dependencies (config and logger).
-	mux := http.NewServeMux()
-	mux.HandleFunc("/upload", h.UploadHandler)
-	mux.HandleFunc("/download/", h.DownloadHandle)
-	mux.HandleFunc("/download/list.txt", h.DownloadList)
+// closer stops or saves one part of an app; what describes it in the log, should it fail.
+type closer struct {
+	what  string
+	close func() error
+}
 
+// onClose adds fn, which does what, to the closers of a.
+func (a *app) onClose(what string, fn func() error) {
+	a.closers = append(a.closers, closer{what, fn})
+}
+
+// onStop adds fn, which stops background work, to the closers of a.
+func (a *app) onStop(fn func()) {
+	a.onClose("", func() error {
+		fn()
+		return nil
+	})
+}
+
+// close runs the closers of a, logging those that fail. It is called once the requests to a
+// have completed.
+func (a *app) close(logger *log.Logger) {
+	for _, c := range slices.Backward(a.closers) {
+		if err := c.close(); err != nil {
+			logger.Printf("error %s: %v\n", c.what, err)
+		}
+	}
+	a.closers = nil
+}
+
+// NewServer creates and returns a new Server instance.
+// It returns an error if a dependency, such as the session store, cannot be initialised.
+//
+// It sets up the main handler and those of the tenants, and configures server settings
+// such as address and timeouts. The files of each storage directory are kept where open
+// says; a nil open keeps them in the directories themselves, spread over cfg.Shards.
+func NewServer(cfg *config.Config, open storage.Opener, logger *log.Logger) (_ *Server, err error) {
+	uploads := &uploadTracker{}
+	tenants, err := openTenants(cfg, open, uploads, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			tenants.close()
+		}
+	}()
+	main, err := newApp(cfg, open, uploads, tenants, logger)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			main.close(logger)
+		}
+	}()
 	srv := &http.Server{
 		Addr:         cfg.Server.Addr,
 		ErrorLog:     logger,
-		Handler:      mux,
+		Handler:      tenants.route(main.handler),
 		ReadTimeout:  cfg.Server.ReadTimeout,
 		WriteTimeout: cfg.Server.WriteTimeout,
 		IdleTimeout:  cfg.Server.IdleTimeout,
 	}
-
+	if cfg.Server.TLS.CertFile != "" || cfg.Server.TLS.KeyFile != "" {
+		cert, err := loadCertificate(cfg.Server.TLS, logger)
+		if err != nil {
+			return nil, err
+		}
+		// Why choose the certificate per connection? Tenants served on hosts of their own
+		// may bring certificates of their own, picked by the name the client asks for.
+		srv.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if c := tenants.certificate(hello.ServerName); c != nil {
+					return c.get(), nil
+				}
+				return cert.get(), nil
+			},
+		}
+	}
 	return &Server{
-		HTTP:   srv,
-		Logger: logger,
+		HTTP:    srv,
+		Logger:  logger,
+		uploads: uploads,
+		main:    main,
+		tenants: tenants,
+	}, nil
+}
+
+// Storage returns where the files of the main storage directory are kept.
+func (s *Server) Storage() storage.Storage {
+	return s.main.storage
+}
+
+// openStorage opens the storage directory of cfg with open, or on disk if open is nil.
+//
+// Why refuse shards with open set? They name directories on disk, which a storage kept
+// elsewhere would silently leave unused.
+func openStorage(cfg *config.Config, open storage.Opener) (storage.Storage, error) {
+	if open == nil {
+		return shard.New(cfg.Uploader.StorageDir, cfg.Shards)
+	}
+	if len(cfg.Shards) > 0 {
+		return nil, fmt.Errorf("shards: %w", storage.ErrNotOnDisk)
+	}
+	return open(cfg.Uploader.StorageDir)
+}
+
+// openMetadata opens the metadata directory of cfg with open, or on disk if open is nil, for
+// the stores that keep their documents wherever the stored files are kept: file metadata,
+// holds and upload quotas.
+func openMetadata(cfg *config.Config, open storage.Opener) (storage.Storage, error) {
+	if open != nil {
+		return open(cfg.Metadata.Dir)
+	}
+	// Created now, as a root cannot be opened on a directory that does not exist.
+	if err := os.MkdirAll(cfg.Metadata.Dir, 0755); err != nil {
+		return nil, err
+	}
+	return shard.New(cfg.Metadata.Dir, nil)
+}
+
+// newApp sets up the HTTP router and registers request handlers with their dependencies,
+// for the storage directory of cfg, opened by open as NewServer does. Uploads are counted in
+// uploads; tenants is nil but for the main handler, which manages them.
+func newApp(cfg *config.Config, open storage.Opener, uploads *uploadTracker, tenants *tenantSet, logger *log.Logger) (_ *app, err error) {
+	// Why close the app on failure? The dependencies opened before the one that failed have
+	// started their background work already.
+	a := &app{}
+	defer func() {
+		if err != nil {
+			a.close(logger)
+		}
+	}()
+
+	// Initialise the handlers with their required dependencies (config and logger).
+	meta, err := openMetadata(cfg, open)
+	if err != nil {
+		return nil, err
+	}
+	holdStore, err := holds.Open(meta, "holds.json")
+	if err != nil {
+		return nil, err
+	}
+	files, err := openStorage(cfg, open)
+	if err != nil {
+		return nil, err
+	}
+	a.storage = files
+	// Why reconcile before serving? Files copied in or lost whilst the server was down would
+	// otherwise go without checksums, or keep entries for files that no longer exist. A scan
+	// failure is logged rather than returned, like the index's, so the server can still start.
+	fileMeta, err := filemeta.Open(meta, "files.json", files, cfg.Metadata.Xattrs, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.fileMeta = fileMeta
+	a.onClose("saving file metadata", fileMeta.Close)
+	if err := fileMeta.Reconcile(); err != nil {
+		logger.Printf("error reconciling file metadata: %v\n", err)
+	}
+	// Opened even with quarantining off, so files kept earlier can still be dealt with.
+	quarantined, err := quarantine.Open(cfg.Metadata.Path("quarantine.json"), cfg.Metadata.Path("quarantine"))
+	if err != nil {
+		return nil, err
+	}
+	var uploadQuota *quota.Store
+	if qc := cfg.UploadQuota; qc.PerIPMB > 0 {
+		uploadQuota, err = quota.Open(meta, "upload-quota.json", qc.GetPerIP(), qc.Window)
+		if err != nil {
+			return nil, err
+		}
+	}
+	clientIP, err := clientip.New(cfg.Server.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	notifier, err := notify.New(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.onStop(notifier.Close)
+	if err := checkSettings(cfg); err != nil {
+		return nil, err
+	}
+	// Opened even with asynchronous processing off, so jobs interrupted earlier still finish.
+	jobQueue, err := jobs.Open(cfg.Metadata.Path("jobs.json"), cfg.Metadata.Path("staging"), cfg.Processing, logger)
+	if err != nil {
+		return nil, err
+	}
+	videos, err := video.Open(cfg.Video, cfg.Metadata.Path("videos.json"), cfg.Metadata.Path("posters"), files, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.onStop(videos.Close)
+	converter, err := convert.New(cfg.Conversion, cfg.Metadata.Path("previews"), files, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.onStop(converter.Close)
+	fetcher, err := fetch.New(cfg.Fetch)
+	if err != nil {
+		return nil, err
+	}
+	links, err := shortlinks.Open(cfg.Metadata.Path("shortlinks.json"), logger)
+	if err != nil {
+		return nil, err
 	}
+	a.onClose("saving short links", links.Flush)
+	var assembled *assembly.Store
+	if cfg.ParallelUploads.Enabled {
+		assembled, err = assembly.Open(cfg.Metadata.Path("uploads.json"), cfg.Metadata.Path("parts"), cfg.ParallelUploads.Expiry, logger)
+		if err != nil {
+			return nil, err
+		}
+		a.onStop(assembled.Close)
+	}
+	upstream, err := mirror.New(cfg.Mirror)
+	if err != nil {
+		return nil, err
+	}
+	checksums := fileMeta.Checksums()
+	videos.Prune(checksums)
+	converter.Prune(checksums)
+	backend, err := coord.New(cfg.Coordination, logger)
+	if err != nil {
+		return nil, err
+	}
+	// Closed after everything started later, so that the locks of the uploads are released
+	// first, and so that the other nodes need not wait out its TTL to drop this one from the
+	// cluster.
+	if backend != nil {
+		a.onClose("leaving the coordination service", backend.Close)
+	}
+	cursors, err := coord.OpenCursors(backend, cfg.Metadata.Path("cursors.json"))
+	if err != nil {
+		return nil, err
+	}
+	render := respond.NewRenderer(cfg.Server.ErrorFormat, logger)
+	nodes, err := cluster.New(cfg.Cluster, render, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.onStop(nodes.Close)
+	if nodes != nil && backend != nil {
+		nodes.Follow(backend, cfg.Coordination.TTL)
+	}
+	elector, err := leader.New(cfg.Leader, backend, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.onClose("releasing the leadership", elector.Close)
+	signer, err := cdn.NewSigner(cfg.CDN)
+	if err != nil {
+		return nil, err
+	}
+	purger, err := cdn.NewPurger(cfg.CDN, logger)
+	if err != nil {
+		return nil, err
+	}
+	purger.Watch(fileMeta, cfg.CDN.PurgeInterval)
+	a.onStop(purger.Close)
+	injector, err := faults.New(cfg.Faults, logger)
+	if err != nil {
+		return nil, err
+	}
+	space, err := diskspace.New(cfg.Uploader.MinFreeSpaceMB, files, notifier, render, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.onStop(space.Close)
+	h := handlers.NewHandlers(cfg, holdStore, fileMeta, quarantined, uploadQuota, notifier, jobQueue, videos, converter, fetcher, links, assembled, upstream, nodes, backend, cursors, elector, files, signer, purger, injector, space, logger)
+	a.onStop(h.Close)
+	csrfProtector := csrf.NewProtector(cfg, render, logger)
+
+	sessionStore, err := session.NewStore(cfg.Session.Store, cfg.Session.File)
+	if err != nil {
+		return nil, err
+	}
+	a.onClose("closing the session store", sessionStore.Close)
+	userStore, err := users.Open(cfg.Metadata.Path("users.json"), cfg.Auth.Users)
+	if err != nil {
+		return nil, err
+	}
+	tokenStore, err := tokens.Open(cfg.Metadata.Path("tokens.json"))
+	if err != nil {
+		return nil, err
+	}
+	authn := auth.NewAuthenticator(cfg, session.NewManager(cfg, sessionStore), userStore, tokenStore, render, logger)
+	authorizer := authz.New(cfg, render, logger)
+	require := authorizer.Require
+
+	// Why a route helper? Every pattern must be mounted under the configured base path
+	// (e.g. "/files" when running behind a reverse proxy), so it is prepended in one place.
+	basePath := cfg.Server.GetBasePath()
+	route := func(method, path string) string {
+		return method + " " + basePath + path
+	}
+
+	// Register the routes using method-qualified patterns, so handlers no longer need
+	// to check r.Method themselves. The more specific "list.txt" pattern takes precedence
+	// over the "{name...}" wildcard.
+	mux := http.NewServeMux()
+	registry := metrics.NewRegistry(func(r *http.Request) string {
+		// Patterns look like "GET /files/download/{name...}"; the label drops the method,
+		// which has a label of its own, and the base path, which is the same everywhere.
+		_, pattern := mux.Handler(r)
+		if _, path, ok := strings.Cut(pattern, " "); ok {
+			return strings.TrimPrefix(path, basePath)
+		}
+		return pattern
+	})
+	transfer := registry.Transfer
+	jobQueue.Observe(registry)
+	space.Observe(registry)
+	space.Watch()
+	guard, err := abuse.New(cfg.Abuse, cfg.Metadata.Path("bans.json"), render, logger)
+	if err != nil {
+		return nil, err
+	}
+	recorder, err := capture.New(cfg.DebugCapture, []string{cfg.CSRF.HeaderName}, render, logger)
+	if err != nil {
+		return nil, err
+	}
+	var auditLog *audit.Log
+	if cfg.Audit.Enabled {
+		auditLog, err = audit.Open(cfg.Metadata.Path("audit.log"), cfg.Audit.GetMaxSize(), func(r *http.Request) string {
+			if p, ok := auth.FromContext(r.Context()); ok {
+				return p.Username
+			}
+			return ""
+		}, render, logger)
+		if err != nil {
+			return nil, err
+		}
+		a.onClose("closing the audit log", auditLog.Close)
+	}
+	geo, err := geoip.New(cfg.GeoIP, render, logger)
+	if err != nil {
+		return nil, err
+	}
+	if geo != nil {
+		registry.LabelCountries(geoip.MetricsLabel)
+	}
+	if sc := cfg.Metrics.StatsD; sc.Enabled {
+		statsd, err := metrics.NewStatsD(sc.Address, sc.Prefix, sc.Format, sc.Tags, sc.FlushInterval, logger)
+		if err != nil {
+			return nil, err
+		}
+		a.onClose("sending metrics to statsd", statsd.Close)
+		registry.AddSink(statsd)
+	}
+
+	mux.HandleFunc(route(http.MethodPost, "/upload"), uploads.track(transfer("upload", guard.WatchUploads(require(authz.PermUpload, space.Refuse(h.UploadHandler))))))
+	if cfg.Paste.MaxSizeKB > 0 {
+		mux.HandleFunc(route(http.MethodPost, "/paste"), uploads.track(transfer("upload", guard.WatchUploads(require(authz.PermUpload, space.Refuse(h.PasteHandler))))))
+	}
+	if fetcher != nil {
+		// Not metered as a transfer: the file comes from the remote server, not the client.
+		mux.HandleFunc(route(http.MethodPost, "/api/fetch"), uploads.track(guard.WatchUploads(require(authz.PermUpload, space.Refuse(h.FetchHandler)))))
+	}
+	mux.HandleFunc(route(http.MethodGet, "/download/{name...}"), transfer("download", require(authz.PermDownload, h.DownloadHandle)))
+	mux.HandleFunc(route(http.MethodGet, "/stream/{name...}"), transfer("download", require(authz.PermDownload, h.StreamHandler)))
+	mux.HandleFunc(route(http.MethodGet, "/view/{name...}"), transfer("download", require(authz.PermDownload, h.ViewHandler)))
+	if cfg.Viewer.PDFJS != "" {
+		mux.HandleFunc(route(http.MethodGet, "/read/{name...}"), require(authz.PermDownload, h.ReaderHandler))
+	}
+	mux.HandleFunc(route(http.MethodGet, "/download/list.txt"), require(authz.PermDownload, h.DownloadList))
+	mux.HandleFunc(route(http.MethodGet, "/api/files/{name...}"), require(authz.PermDownload, h.FileInfoHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/files/by-id/{id}"), require(authz.PermDownload, h.FileByIDHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/files/by-id/{id}/download"), transfer("download", require(authz.PermDownload, h.DownloadByIDHandler)))
+	mux.HandleFunc(route("LOCK", "/api/files/{name...}"), require(authz.PermUpload, h.LockHandler))
+	mux.HandleFunc(route("UNLOCK", "/api/files/{name...}"), require(authz.PermUpload, h.UnlockHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/signatures/{name...}"), require(authz.PermDownload, h.SignaturesHandler))
+	mux.HandleFunc(route(http.MethodPut, "/api/delta/{name...}"), uploads.track(transfer("upload", guard.WatchUploads(require(authz.PermUpload, space.Refuse(h.DeltaHandler))))))
+	mux.HandleFunc(route(http.MethodGet, "/api/changes"), require(authz.PermDownload, h.ChangesHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/search"), require(authz.PermDownload, h.SearchHandler))
+	mux.HandleFunc(route(http.MethodPost, "/api/touch/{name...}"), require(authz.PermUpload, h.TouchHandler))
+	mux.HandleFunc(route(http.MethodPatch, "/api/files/{name...}"), uploads.track(transfer("upload", guard.WatchUploads(require(authz.PermUpload, space.Refuse(h.PatchFileHandler))))))
+	if cfg.Editor.MaxSizeKB > 0 {
+		mux.HandleFunc(route(http.MethodPut, "/api/files/{name...}"), uploads.track(transfer("upload", guard.WatchUploads(require(authz.PermUpload, space.Refuse(h.PutFileHandler))))))
+		mux.HandleFunc(route(http.MethodGet, "/edit/{name...}"), require(authz.PermUpload, h.EditHandler))
+	}
+	mux.HandleFunc(route(http.MethodPost, "/api/shorten"), require(authz.PermDownload, h.ShortenHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/shorten/{code}"), require(authz.PermDownload, h.ShortLinkHandler))
+	mux.HandleFunc(route(http.MethodGet, "/s/{code}"), require(authz.PermDownload, h.FollowShortLinkHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/qr/{name...}"), require(authz.PermDownload, h.QRHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/extents/{name...}"), require(authz.PermDownload, h.ExtentsHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/holds"), require(authz.PermAdmin, h.ListHoldsHandler))
+	mux.HandleFunc(route(http.MethodPut, "/api/holds/{name...}"), require(authz.PermAdmin, h.SetHoldHandler))
+	mux.HandleFunc(route(http.MethodDelete, "/api/holds/{name...}"), require(authz.PermAdmin, h.ClearHoldHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/stats"), require(authz.PermAdmin, h.StatsHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/missing"), require(authz.PermAdmin, h.ListMissingHandler))
+	mux.HandleFunc(route(http.MethodPost, "/api/rescan"), require(authz.PermAdmin, h.RescanHandler))
+	mux.HandleFunc(route(http.MethodDelete, "/api/missing/{name...}"), require(authz.PermAdmin, h.ForgetMissingHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/quarantine"), require(authz.PermAdmin, h.ListQuarantineHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/quarantine/{id}"), require(authz.PermAdmin, h.QuarantinedFileHandler))
+	mux.HandleFunc(route(http.MethodPost, "/api/quarantine/{id}/release"), require(authz.PermAdmin, h.ReleaseQuarantineHandler))
+	mux.HandleFunc(route(http.MethodDelete, "/api/quarantine/{id}"), require(authz.PermAdmin, h.PurgeQuarantineHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/jobs/{id}"), require(authz.PermUpload, h.JobHandler))
+	mux.HandleFunc(route(http.MethodPost, "/api/uploads/check"), require(authz.PermUpload, h.UploadCheckHandler))
+	if cfg.ParallelUploads.Enabled {
+		mux.HandleFunc(route(http.MethodPost, "/api/uploads"), require(authz.PermUpload, h.CreateUploadHandler))
+		mux.HandleFunc(route(http.MethodGet, "/api/uploads/{id}"), require(authz.PermUpload, h.UploadStatusHandler))
+		mux.HandleFunc(route(http.MethodPut, "/api/uploads/{id}"), uploads.track(transfer("upload", guard.WatchUploads(require(authz.PermUpload, space.Refuse(h.UploadPartHandler))))))
+		mux.HandleFunc(route(http.MethodPost, "/api/uploads/{id}/complete"), require(authz.PermUpload, h.CompleteUploadHandler))
+		mux.HandleFunc(route(http.MethodDelete, "/api/uploads/{id}"), require(authz.PermUpload, h.AbortUploadHandler))
+	}
+	mux.HandleFunc(route(http.MethodPost, "/api/batch"), h.BatchHandler)
+	mux.HandleFunc(route(http.MethodGet, "/api/csrf"), csrfProtector.TokenHandler)
+	mux.HandleFunc(route(http.MethodPost, "/api/login"), authn.LoginHandler)
+	mux.HandleFunc(route(http.MethodPost, "/api/logout"), authn.LogoutHandler)
+	mux.HandleFunc(route(http.MethodGet, "/api/sessions"), authn.ListSessionsHandler)
+	mux.HandleFunc(route(http.MethodDelete, "/api/sessions/{id}"), authn.RevokeSessionHandler)
+	mux.HandleFunc(route(http.MethodPut, "/api/me/password"), authn.ChangePasswordHandler)
+	mux.HandleFunc(route(http.MethodGet, "/api/users"), require(authz.PermAdmin, authn.ListUsersHandler))
+	mux.HandleFunc(route(http.MethodPost, "/api/users"), require(authz.PermAdmin, authn.CreateUserHandler))
+	mux.HandleFunc(route(http.MethodPatch, "/api/users/{username}"), require(authz.PermAdmin, authn.UpdateUserHandler))
+	mux.HandleFunc(route(http.MethodDelete, "/api/users/{username}"), require(authz.PermAdmin, authn.DeleteUserHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/tokens"), require(authz.PermAdmin, authn.ListTokensHandler))
+	mux.HandleFunc(route(http.MethodPost, "/api/tokens"), require(authz.PermAdmin, authn.CreateTokenHandler))
+	mux.HandleFunc(route(http.MethodDelete, "/api/tokens/{id}"), require(authz.PermAdmin, authn.RevokeTokenHandler))
+	if converter != nil {
+		mux.HandleFunc(route(http.MethodGet, "/preview/{name...}"), transfer("download", require(authz.PermDownload, h.PreviewHandler)))
+	}
+	if videos != nil {
+		mux.HandleFunc(route(http.MethodGet, "/api/posters/{name...}"), require(authz.PermDownload, h.PosterHandler))
+	}
+	if guard != nil {
+		mux.HandleFunc(route(http.MethodGet, "/api/bans"), require(authz.PermAdmin, guard.ListHandler))
+		mux.HandleFunc(route(http.MethodDelete, "/api/bans/{client...}"), require(authz.PermAdmin, guard.LiftHandler))
+	}
+	if auditLog != nil {
+		mux.HandleFunc(route(http.MethodGet, "/api/audit"), require(authz.PermAdmin, auditLog.TailHandler))
+	}
+	mux.HandleFunc(route(http.MethodGet, "/api/debug/captures"), require(authz.PermAdmin, recorder.ListHandler))
+	mux.HandleFunc(route(http.MethodDelete, "/api/debug/captures"), require(authz.PermAdmin, recorder.ClearHandler))
+	mux.HandleFunc(route(http.MethodGet, "/api/debug/capture"), require(authz.PermAdmin, recorder.SettingsHandler))
+	mux.HandleFunc(route(http.MethodPut, "/api/debug/capture"), require(authz.PermAdmin, recorder.UpdateSettingsHandler))
+	if signer != nil {
+		mux.HandleFunc(route(http.MethodGet, "/api/cdn/cookies"), require(authz.PermDownload, h.CDNCookiesHandler))
+	}
+	if purger != nil {
+		mux.HandleFunc(route(http.MethodPost, "/admin/cache/purge"), require(authz.PermAdmin, h.PurgeCacheHandler))
+	}
+	if tenants != nil {
+		mux.HandleFunc(route(http.MethodGet, "/api/tenants"), require(authz.PermAdmin, tenants.ListHandler))
+		mux.HandleFunc(route(http.MethodPost, "/api/tenants"), require(authz.PermAdmin, tenants.CreateHandler))
+		mux.HandleFunc(route(http.MethodDelete, "/api/tenants/{name}"), require(authz.PermAdmin, tenants.DeleteHandler))
+	}
+	if cfg.Metrics.Enabled {
+		mux.Handle(route(http.MethodGet, "/metrics"), registry)
+	}
+
+	// Why wrap the mux? Requests that match no pattern are answered by the router:
+	// OPTIONS receives 204 with an Allow header, other methods on a known path receive
+	// 405 with the same header, and unknown paths receive 404, all rendered consistently.
+	rt := &router{
+		mux:     mux,
+		render:  render,
+		cluster: nodes,
+	}
+
+	reporter, err := errreport.New(cfg.ErrorReporting.DSN, cfg.ErrorReporting.Environment, func(r *http.Request) string {
+		if p, ok := auth.FromContext(r.Context()); ok {
+			return p.Username
+		}
+		return ""
+	}, logger)
+	if err != nil {
+		return nil, err
+	}
+	a.onStop(reporter.Close)
+
+	readReplica, err := replica.New(cfg.Replica, basePath, render, logger)
+	if err != nil {
+		return nil, err
+	}
+	// Writes are forwarded before authentication, so that the primary authenticates them, and
+	// logins, with their sessions and CSRF tokens, are the primary's too.
+	handler := secheaders.New(cfg).Middleware(geo.Restrict(guard.Middleware(readReplica.Middleware(csrfProtector.Middleware(authn.Middleware(auditLog.Middleware(rt)))))))
+	handler = recoverer(handler, reporter, render, logger)
+	// Why outermost? Requests rejected by the other middleware are then measured as well.
+	if cfg.Metrics.Enabled || cfg.Metrics.StatsD.Enabled {
+		handler = registry.Middleware(handler)
+	}
+	// Located outside the metrics, so that they can be labelled by country.
+	handler = geo.Locate(handler)
+	// Why outside the rest? A client's requests are then captured however they are answered,
+	// even when refused by the middleware before reaching a handler.
+	handler = recorder.Middleware(handler)
+	// Why outside even that? Everything, from the access log to quotas, should see the client
+	// behind a trusted proxy rather than the proxy itself.
+	handler = clientIP.Middleware(handler)
+
+	a.handler = handler
+	return a, nil
 }
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// newTestServer returns the handler of a server whose storage directory holds a.txt and
+// docs/b.txt, each holding its own name, configured further by configure unless it is nil.
+func newTestServer(t *testing.T, configure func(cfg *config.Config)) http.Handler {
+	t.Helper()
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Uploader.StorageDir = filepath.Join(dir, "files")
+	cfg.Metadata.Dir = filepath.Join(dir, "metadata")
+	for _, f := range []string{"a.txt", "docs/b.txt"} {
+		full := filepath.Join(cfg.Uploader.StorageDir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	srv, err := NewServer(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Shutdown(t.Context()) })
+	return srv.HTTP.Handler
+}
+
+// serve sends a request to h and returns the response.
+func serve(h http.Handler, method, target string, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		r.Header.Set("Content-Type", contentType)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// uploadForm returns a form uploading a file named filename, and its content type.
+func uploadForm(t *testing.T, filename, content string) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write([]byte(content))
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+// TestRoutes checks that requests reach the handler registered for their method and path.
+func TestRoutes(t *testing.T) {
+	h := newTestServer(t, nil)
+	tests := []struct {
+		desc       string
+		method     string
+		target     string
+		wantStatus int
+		wantBody   string // contained in the body
+	}{
+		{"download a file", http.MethodGet, "/download/a.txt", http.StatusOK, "a.txt"},
+		{"download a nested file", http.MethodGet, "/download/docs/b.txt", http.StatusOK, "docs/b.txt"},
+		{"download a file's headers", http.MethodHead, "/download/a.txt", http.StatusOK, ""},
+		{"list the files, rather than download list.txt", http.MethodGet, "/download/list.txt", http.StatusOK, "docs/b.txt"},
+		{"download with another method", http.MethodDelete, "/download/a.txt", http.StatusMethodNotAllowed, ""},
+		{"upload with another method", http.MethodGet, "/upload", http.StatusMethodNotAllowed, ""},
+		{"an unknown path", http.MethodGet, "/nowhere", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			w := serve(h, tt.method, tt.target, nil, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("got %q, want it to contain %q", w.Body, tt.wantBody)
+			}
+		})
+	}
+
+	body, contentType := uploadForm(t, "c.txt", "uploaded")
+	if w := serve(h, http.MethodPost, "/upload", body, contentType); w.Code != http.StatusOK {
+		t.Fatalf("upload: got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if w := serve(h, http.MethodGet, "/download/c.txt", nil, ""); w.Body.String() != "uploaded" {
+		t.Errorf("uploaded file holds %q, want %q", w.Body, "uploaded")
+	}
+}
+
+// TestBasePath checks that every route is mounted under the base path, and only there.
+func TestBasePath(t *testing.T) {
+	h := newTestServer(t, func(cfg *config.Config) { cfg.Server.BasePath = "files/" })
+	tests := []struct {
+		target     string
+		wantStatus int
+	}{
+		{"/files/download/a.txt", http.StatusOK},
+		{"/files/download/list.txt", http.StatusOK},
+		{"/download/a.txt", http.StatusNotFound},
+		{"/files", http.StatusNotFound},
+		{"/filesdownload/a.txt", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			if w := serve(h, http.MethodGet, tt.target, nil, ""); w.Code != tt.wantStatus {
+				t.Errorf("got status %d %s, want %d", w.Code, w.Body, tt.wantStatus)
+			}
+		})
+	}
+
+	body, contentType := uploadForm(t, "c.txt", "uploaded")
+	if w := serve(h, http.MethodPost, "/files/upload", body, contentType); w.Code != http.StatusOK {
+		t.Fatalf("upload: got status %d %s, want %d", w.Code, w.Body, http.StatusOK)
+	}
+	if w := serve(h, http.MethodGet, "/files/download/c.txt", nil, ""); w.Body.String() != "uploaded" {
+		t.Errorf("uploaded file holds %q, want %q", w.Body, "uploaded")
+	}
+}
+
+// TestInvalidConfig checks that the server refuses to start with settings that would store
+// files outside the storage directory.
+func TestInvalidConfig(t *testing.T) {
+	tests := []struct {
+		desc      string
+		setting   string // the setting the error names
+		configure func(cfg *config.Config)
+	}{
+		{"date directories climbing out", "dateDirs", func(cfg *config.Config) { cfg.Uploader.DateDirs = "../{year}" }},
+		{"absolute date directories", "dateDirs", func(cfg *config.Config) { cfg.Uploader.DateDirs = "/{year}/{month}" }},
+		{"names climbing out", "nameTemplate", func(cfg *config.Config) { cfg.Uploader.NameTemplate = "../{original}" }},
+		{"absolute names", "nameTemplate", func(cfg *config.Config) { cfg.Uploader.NameTemplate = "/tmp/{uuid}" }},
+		{"names of the directory itself", "nameTemplate", func(cfg *config.Config) { cfg.Uploader.NameTemplate = "." }},
+		{"response headers for a relative path", "responseHeaders", func(cfg *config.Config) {
+			cfg.ResponseHeaders = []config.ResponseHeadersRule{{Path: "download", Headers: map[string]string{"X-Robots-Tag": "noindex"}}}
+		}},
+		{"a response header with a colon", "responseHeaders", func(cfg *config.Config) {
+			cfg.ResponseHeaders = []config.ResponseHeadersRule{{Path: "/download", Headers: map[string]string{"X-Robots-Tag:": "noindex"}}}
+		}},
+		{"a response header spanning lines", "responseHeaders", func(cfg *config.Config) {
+			cfg.ResponseHeaders = []config.ResponseHeadersRule{{Path: "/download", Headers: map[string]string{"X-Robots-Tag": "noindex\r\nSet-Cookie: a=b"}}}
+		}},
+		{"an unknown eviction policy", "eviction.policy", func(cfg *config.Config) {
+			cfg.Eviction.Policy, cfg.Eviction.MaxSizeMB = "random", 100
+		}},
+		{"eviction without a size cap", "eviction.maxSizeMB", func(cfg *config.Config) { cfg.Eviction.Policy = "lru" }},
+		{"eviction watermarks the wrong way round", "eviction watermarks", func(cfg *config.Config) {
+			cfg.Eviction.Policy, cfg.Eviction.MaxSizeMB, cfg.Eviction.HighWatermark, cfg.Eviction.LowWatermark = "lru", 100, 50, 80
+		}},
+		{"an eviction watermark over the cap", "eviction watermarks", func(cfg *config.Config) {
+			cfg.Eviction.Policy, cfg.Eviction.MaxSizeMB, cfg.Eviction.HighWatermark = "oldest", 100, 120
+		}},
+		{"no eviction interval", "eviction.interval", func(cfg *config.Config) {
+			cfg.Eviction.Policy, cfg.Eviction.MaxSizeMB, cfg.Eviction.Interval = "lru", 100, 0
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := config.Default()
+			cfg.Uploader.StorageDir = filepath.Join(dir, "files")
+			cfg.Metadata.Dir = filepath.Join(dir, "metadata")
+			tt.configure(cfg)
+			srv, err := NewServer(cfg, nil, log.New(io.Discard, "", 0))
+			if err == nil {
+				srv.Shutdown(t.Context())
+				t.Fatal("no error")
+			}
+			if !strings.Contains(err.Error(), tt.setting) {
+				t.Errorf("got error %v, want it to name the setting", err)
+			}
+		})
+	}
+}
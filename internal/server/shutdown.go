@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// uploadTracker counts the uploads in progress, so that shutdown can wait for them.
+type uploadTracker struct {
+	wg     sync.WaitGroup
+	active atomic.Int64
+}
+
+// track wraps an upload handler so that it is counted whilst it runs.
+func (t *uploadTracker) track(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t.wg.Add(1)
+		t.active.Add(1)
+		defer func() {
+			t.active.Add(-1)
+			t.wg.Done()
+		}()
+		h(w, r)
+	}
+}
+
+// Shutdown stops accepting requests and waits for those in flight to complete, until ctx
+// expires. It then stops the background work of the server and saves its stores.
+//
+// Why not just http.Server.Shutdown? It leaves handlers still running when ctx expires, and
+// the process then exits underneath them, leaving the partial files of interrupted uploads
+// in the storage directory. Instead, the remaining connections are closed, which fails the
+// uploads' body reads, and Shutdown waits until the upload handlers have removed their files.
+func (s *Server) Shutdown(ctx context.Context) error {
+	// Deferred so that it runs once the handlers, which update the file metadata, are done.
+	// The tenants are closed before the main app, whose coordination backend holds the locks
+	// of their uploads too.
+	defer s.closed.Do(func() {
+		s.tenants.close()
+		s.main.close(s.Logger)
+	})
+	err := s.HTTP.Shutdown(ctx)
+	if err == nil {
+		return nil
+	}
+	if n := s.uploads.active.Load(); n > 0 {
+		s.Logger.Printf("warn: interrupting %d upload(s) still in progress\n", n)
+	}
+	s.HTTP.Close()
+	s.uploads.wg.Wait()
+	return err
+}
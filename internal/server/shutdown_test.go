@@ -0,0 +1,50 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// TestShutdownStopsBackgroundWork starts a server with a tenant and shuts it down, after
+// which none of the goroutines it started may remain.
+func TestShutdownStopsBackgroundWork(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Uploader.StorageDir = filepath.Join(dir, "files")
+	cfg.Metadata.Dir = filepath.Join(dir, "metadata")
+	cfg.Tenancy.Dir = filepath.Join(dir, "tenants")
+	cfg.Tenancy.Tenants = []config.TenantConfig{{Name: "team-a"}}
+	cfg.Processing.Async = "always"
+	cfg.Metrics.StatsD.Enabled = true
+	baseline := runtime.NumGoroutine()
+
+	srv, err := NewServer(cfg, nil, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+	// Why poll? A goroutine that has been told to stop, and waited for, may still be on its
+	// way out of the runtime when Shutdown returns.
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > baseline; {
+		if time.Now().After(deadline) {
+			var stacks bytes.Buffer
+			pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+			t.Fatalf("%d goroutine(s) left running after shutdown:\n%s", runtime.NumGoroutine()-baseline, &stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Shutting down again does nothing.
+	if err := srv.Shutdown(t.Context()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,551 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+	"github.com/mascotmascot1/fileserver/internal/respond"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// maxTenantBodySize bounds the JSON body of a request to create a tenant.
+const maxTenantBodySize = 64 << 10 // 64 KB
+
+// tenantName matches the names tenants may be given, which appear in URLs and directory names.
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// tenantSpec is a tenant created through the API, as it is saved.
+type tenantSpec struct {
+	Name            string    `json:"name"`
+	MaxSizeMB       int64     `json:"maxSizeMB,omitempty"`
+	MaxUploadSizeMB int64     `json:"maxUploadSizeMB,omitempty"`
+	UploadQuotaMB   int64     `json:"uploadQuotaMB,omitempty"`
+	AuthRequired    bool      `json:"authRequired,omitempty"`
+	Hosts           []string  `json:"hosts,omitempty"`
+	CertFile        string    `json:"certFile,omitempty"`
+	KeyFile         string    `json:"keyFile,omitempty"`
+	AdminKeySHA256  string    `json:"adminKeySHA256"`
+	CreatedBy       string    `json:"createdBy"`
+	Created         time.Time `json:"created"`
+}
+
+// config returns the tenant's settings; its directories are the defaults.
+func (s tenantSpec) config() config.TenantConfig {
+	return config.TenantConfig{
+		Name:            s.Name,
+		MaxSizeMB:       s.MaxSizeMB,
+		MaxUploadSizeMB: s.MaxUploadSizeMB,
+		UploadQuotaMB:   s.UploadQuotaMB,
+		AuthRequired:    s.AuthRequired,
+		Hosts:           s.Hosts,
+		TLS:             config.TLSConfig{CertFile: s.CertFile, KeyFile: s.KeyFile},
+		APIKeys:         []config.APIKey{{Name: "admin", SHA256: s.AdminKeySHA256, Roles: []string{"admin"}}},
+	}
+}
+
+// tenant is a tenant being served.
+type tenant struct {
+	cfg  config.TenantConfig
+	app  *app
+	cert *certificate // nil unless it has a certificate of its own
+	spec *tenantSpec  // nil for tenants defined in the configuration
+	// requests counts the requests being served, so that a deleted tenant is closed only
+	// once they are done.
+	requests sync.WaitGroup
+}
+
+// tenantSet routes the requests for a tenant's hosts, or below /t/<name> for a tenant
+// without hosts, to the tenant.
+//
+// Why a complete handler per tenant, rather than tenant checks in the handlers? Every store,
+// from the file metadata to the users, then belongs to one tenant by construction, and no
+// handler, present or future, can mix up one tenant's files or users with another's.
+type tenantSet struct {
+	base    *config.Config
+	open    storage.Opener // of the tenants' storage directories, as passed to NewServer
+	uploads *uploadTracker
+	render  *respond.Renderer
+	logger  *log.Logger
+	path    string // where the tenants created through the API are saved
+
+	mu      sync.RWMutex
+	tenants map[string]*tenant
+	hosts   map[string]*tenant
+	created []tenantSpec
+	// closing holds the names of the deleted tenants still being closed, which cannot be given
+	// to new tenants until they are.
+	closing map[string]bool
+}
+
+// openTenants starts the tenants defined in cfg and those created through the API earlier.
+func openTenants(cfg *config.Config, open storage.Opener, uploads *uploadTracker, logger *log.Logger) (*tenantSet, error) {
+	ts := &tenantSet{
+		base:    cfg,
+		open:    open,
+		uploads: uploads,
+		render:  respond.NewRenderer(cfg.Server.ErrorFormat, logger),
+		logger:  logger,
+		path:    filepath.Join(cfg.Tenancy.Dir, "tenants.json"),
+		tenants: make(map[string]*tenant),
+		hosts:   make(map[string]*tenant),
+		closing: make(map[string]bool),
+	}
+	for _, tc := range cfg.Tenancy.Tenants {
+		if err := ts.start(tc, nil); err != nil {
+			ts.close()
+			return nil, err
+		}
+	}
+	if err := jsonfile.Load(ts.path, &ts.created); err != nil {
+		ts.close()
+		return nil, fmt.Errorf("loading tenants from %s: %w", ts.path, err)
+	}
+	for i := range ts.created {
+		if err := ts.start(ts.created[i].config(), &ts.created[i]); err != nil {
+			ts.close()
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+// start sets up the handler of a tenant and begins serving it. The caller must not hold the lock.
+func (ts *tenantSet) start(tc config.TenantConfig, spec *tenantSpec) error {
+	if !tenantName.MatchString(tc.Name) {
+		return fmt.Errorf("invalid tenant name %q: use up to 63 lower-case letters, digits and dashes", tc.Name)
+	}
+	dir := filepath.Join(ts.base.Tenancy.Dir, tc.Name)
+	if tc.StorageDir == "" {
+		tc.StorageDir = filepath.Join(dir, "files")
+	}
+	if tc.MetadataDir == "" {
+		tc.MetadataDir = filepath.Join(dir, "metadata")
+	}
+	hosts := make([]string, 0, len(tc.Hosts))
+	for _, h := range tc.Hosts {
+		host := normaliseHost(h)
+		if host == "" || strings.ContainsAny(host, "/ *") {
+			return fmt.Errorf("invalid host %q for tenant %q", h, tc.Name)
+		}
+		hosts = append(hosts, host)
+	}
+	tc.Hosts = hosts
+	ts.mu.RLock()
+	_, exists := ts.tenants[tc.Name]
+	closing := ts.closing[tc.Name]
+	for _, host := range hosts {
+		if other, ok := ts.hosts[host]; ok {
+			ts.mu.RUnlock()
+			return fmt.Errorf("host %s of tenant %q is tenant %q's already", host, tc.Name, other.cfg.Name)
+		}
+	}
+	taken := []string{ts.base.Uploader.StorageDir, ts.base.Metadata.Dir}
+	for _, t := range ts.tenants {
+		taken = append(taken, t.cfg.StorageDir, t.cfg.MetadataDir)
+	}
+	ts.mu.RUnlock()
+	if exists {
+		return fmt.Errorf("tenant %q is defined more than once", tc.Name)
+	}
+	if closing {
+		return fmt.Errorf("tenant %q is being deleted", tc.Name)
+	}
+	// Why refuse overlapping directories? A tenant whose directory lay within another's, or
+	// the main one's, would see and change files that are not its own.
+	for _, d := range []string{tc.StorageDir, tc.MetadataDir} {
+		for _, other := range taken {
+			if nested, err := overlaps(d, other); err != nil || nested {
+				return fmt.Errorf("invalid directory %s for tenant %q: it overlaps %s", d, tc.Name, other)
+			}
+		}
+	}
+	dirs := []string{tc.MetadataDir}
+	if ts.open == nil {
+		dirs = append(dirs, tc.StorageDir)
+	}
+	for _, d := range dirs {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return fmt.Errorf("creating directory for tenant %q: %w", tc.Name, err)
+		}
+	}
+	var cert *certificate
+	if tc.TLS.CertFile != "" || tc.TLS.KeyFile != "" {
+		if ts.base.Server.TLS.CertFile == "" || len(hosts) == 0 {
+			return fmt.Errorf("the certificate of tenant %q needs hosts, and server.tls to be enabled", tc.Name)
+		}
+		var err error
+		if cert, err = loadCertificate(tc.TLS, ts.logger); err != nil {
+			return fmt.Errorf("tenant %q: %w", tc.Name, err)
+		}
+	}
+	logger := log.New(ts.logger.Writer(), strings.TrimSpace(ts.logger.Prefix())+"["+tc.Name+"] ", ts.logger.Flags())
+	a, err := newApp(tenantConfig(ts.base, tc), ts.open, ts.uploads, nil, logger)
+	if err != nil {
+		return fmt.Errorf("starting tenant %q: %w", tc.Name, err)
+	}
+	ts.mu.Lock()
+	if _, ok := ts.tenants[tc.Name]; ok {
+		err = fmt.Errorf("tenant %q is defined more than once", tc.Name)
+	}
+	for _, host := range hosts {
+		if _, ok := ts.hosts[host]; ok && err == nil {
+			err = fmt.Errorf("host %s of tenant %q is another tenant's already", host, tc.Name)
+		}
+	}
+	if err == nil {
+		t := &tenant{cfg: tc, app: a, cert: cert, spec: spec}
+		ts.tenants[tc.Name] = t
+		for _, host := range hosts {
+			ts.hosts[host] = t
+		}
+	}
+	ts.mu.Unlock()
+	if err != nil {
+		a.close(logger)
+	}
+	return err
+}
+
+// tenantConfig returns the configuration of the tenant tc: that of the main storage directory,
+// with the tenant's directories, users and limits, and without the services that belong to the
+// deployment as a whole.
+func tenantConfig(base *config.Config, tc config.TenantConfig) *config.Config {
+	c := *base
+	if len(tc.Hosts) > 0 {
+		// Its links are then made from the host each request was sent to.
+		c.Server.PublicURL = ""
+	} else {
+		c.Server.BasePath = base.Server.GetBasePath() + "/t/" + tc.Name
+		if base.Server.PublicURL != "" {
+			c.Server.PublicURL = strings.TrimSuffix(base.Server.PublicURL, "/") + "/t/" + tc.Name
+		}
+	}
+	c.Uploader.StorageDir = tc.StorageDir
+	c.Metadata.Dir = tc.MetadataDir
+	if tc.MaxUploadSizeMB > 0 {
+		c.Uploader.MaxUploadSizeMB = tc.MaxUploadSizeMB
+	}
+	if tc.UploadQuotaMB > 0 {
+		c.UploadQuota.PerIPMB = tc.UploadQuotaMB
+	}
+	c.DirQuotas = nil
+	if tc.MaxSizeMB > 0 {
+		c.DirQuotas = []config.DirQuotaConfig{{Path: "/", MaxSizeMB: tc.MaxSizeMB}}
+	}
+	// The cap on the main storage directory says nothing of the tenant's, which is its maxSizeMB.
+	c.Eviction = config.EvictionConfig{}
+	c.Shards = nil
+	c.Tenancy = config.TenancyConfig{}
+
+	// The tenant authenticates its own users, and the main ones' credentials and cookies
+	// mean nothing to it.
+	c.Auth = config.AuthConfig{
+		Required: base.Auth.Required || tc.AuthRequired,
+		Users:    tc.Users,
+		APIKeys:  tc.APIKeys,
+		SignedURLs: config.SignedURLConfig{
+			ExpiresParam:   base.Auth.SignedURLs.ExpiresParam,
+			SignatureParam: base.Auth.SignedURLs.SignatureParam,
+		},
+	}
+	c.ACL = tc.ACL
+	c.Session.CookieName = base.Session.CookieName + "_" + tc.Name
+	c.Session.File = filepath.Join(tc.MetadataDir, "sessions.json")
+	if c.Session.Store == "sqlite" {
+		c.Session.File = filepath.Join(tc.MetadataDir, "sessions.db")
+	}
+	c.CSRF.CookieName = base.CSRF.CookieName + "_" + tc.Name
+
+	// Membership, leadership, upstreams, CDNs and notification channels are the deployment's;
+	// a tenant joining them would act for the main storage directory.
+	c.Cluster = config.ClusterConfig{}
+	c.Replica = config.ReplicaConfig{}
+	c.Coordination = config.CoordinationConfig{}
+	c.Leader = config.LeaderConfig{}
+	c.Mirror = config.MirrorConfig{}
+	c.CDN = config.CDNConfig{}
+	c.Notifications = config.NotificationsConfig{}
+	c.Metrics.StatsD = config.StatsDConfig{}
+	return &c
+}
+
+// overlaps reports whether either of the directories a and b is, or lies within, the other.
+func overlaps(a, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	inside := func(dir, parent string) bool {
+		rel, err := filepath.Rel(parent, dir)
+		return err == nil && filepath.IsLocal(rel)
+	}
+	return absA == absB || inside(absA, absB) || inside(absB, absA), nil
+}
+
+// route sends the requests for a tenant's hosts, and those below /t/<name> for one without
+// hosts, to the tenant, and all others to main.
+//
+// Why can a tenant with hosts not be reached below /t/<name> as well? Its cookies are set for
+// the paths its hosts serve, and links to it are made from the host a request was sent to;
+// neither would work under the main host's paths.
+func (ts *tenantSet) route(main http.Handler) http.Handler {
+	prefix := ts.base.Server.GetBasePath() + "/t/"
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.RLock()
+		t := ts.hosts[normaliseHost(r.Host)]
+		if t == nil {
+			if rest, ok := strings.CutPrefix(r.URL.Path, prefix); ok {
+				name, _, _ := strings.Cut(rest, "/")
+				if t = ts.tenants[name]; t != nil && len(t.cfg.Hosts) > 0 {
+					t = nil
+				}
+			}
+		}
+		if t != nil {
+			t.requests.Add(1)
+		}
+		ts.mu.RUnlock()
+		if t != nil {
+			defer t.requests.Done()
+			t.app.handler.ServeHTTP(w, r)
+			return
+		}
+		main.ServeHTTP(w, r)
+	})
+}
+
+// certificate returns the certificate of the tenant serving host, or nil if it has none.
+func (ts *tenantSet) certificate(host string) *certificate {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	if t := ts.hosts[normaliseHost(host)]; t != nil {
+		return t.cert
+	}
+	return nil
+}
+
+// close closes the apps of the tenants being served. It is called once the requests to them
+// have completed.
+func (ts *tenantSet) close() {
+	for _, a := range ts.apps() {
+		a.close(ts.logger)
+	}
+}
+
+// apps returns the handlers of the tenants being served.
+func (ts *tenantSet) apps() []*app {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	apps := make([]*app, 0, len(ts.tenants))
+	for _, t := range ts.tenants {
+		apps = append(apps, t.app)
+	}
+	return apps
+}
+
+// tenantInfo describes a tenant in the answers of the API.
+type tenantInfo struct {
+	Name            string     `json:"name"`
+	StorageDir      string     `json:"storageDir"`
+	MetadataDir     string     `json:"metadataDir"`
+	Hosts           []string   `json:"hosts,omitempty"`
+	MaxSizeMB       int64      `json:"maxSizeMB,omitempty"`
+	MaxUploadSizeMB int64      `json:"maxUploadSizeMB,omitempty"`
+	UploadQuotaMB   int64      `json:"uploadQuotaMB,omitempty"`
+	AuthRequired    bool       `json:"authRequired"`
+	Used            int64      `json:"used"`
+	Source          string     `json:"source"` // "config" or "api"
+	CreatedBy       string     `json:"createdBy,omitempty"`
+	Created         *time.Time `json:"created,omitempty"`
+	// AdminKey is the tenant's admin API key, in the answer to its creation only.
+	AdminKey string `json:"adminKey,omitempty"`
+}
+
+// info describes t.
+func (t *tenant) info() tenantInfo {
+	info := tenantInfo{
+		Name:            t.cfg.Name,
+		StorageDir:      t.cfg.StorageDir,
+		MetadataDir:     t.cfg.MetadataDir,
+		Hosts:           t.cfg.Hosts,
+		MaxSizeMB:       t.cfg.MaxSizeMB,
+		MaxUploadSizeMB: t.cfg.MaxUploadSizeMB,
+		UploadQuotaMB:   t.cfg.UploadQuotaMB,
+		AuthRequired:    t.cfg.AuthRequired,
+		Used:            t.app.fileMeta.Usage(""),
+		Source:          "config",
+	}
+	if t.spec != nil {
+		info.Source = "api"
+		info.CreatedBy = t.spec.CreatedBy
+		info.Created = &t.spec.Created
+	}
+	return info
+}
+
+// ListHandler returns the tenants being served, by name. Admin only.
+func (ts *tenantSet) ListHandler(w http.ResponseWriter, r *http.Request) {
+	ts.mu.RLock()
+	list := make([]tenantInfo, 0, len(ts.tenants))
+	for _, t := range ts.tenants {
+		list = append(list, t.info())
+	}
+	ts.mu.RUnlock()
+	slices.SortFunc(list, func(a, b tenantInfo) int { return strings.Compare(a.Name, b.Name) })
+	ts.render.JSON(w, http.StatusOK, list)
+}
+
+// CreateHandler creates a tenant, in its own directory below tenancy.dir, and begins serving
+// it. The answer holds the API key of the tenant's admin, which is not kept and so cannot be
+// shown again; the admin creates the tenant's users through its own API. Admin only.
+func (ts *tenantSet) CreateHandler(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Name            string   `json:"name"`
+		MaxSizeMB       int64    `json:"maxSizeMB"`
+		MaxUploadSizeMB int64    `json:"maxUploadSizeMB"`
+		UploadQuotaMB   int64    `json:"uploadQuotaMB"`
+		AuthRequired    bool     `json:"authRequired"`
+		Hosts           []string `json:"hosts"`
+		CertFile        string   `json:"certFile"`
+		KeyFile         string   `json:"keyFile"`
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxTenantBodySize)
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		ts.render.Error(w, r, http.StatusBadRequest, "malformed JSON body", err.Error())
+		return
+	}
+	if !tenantName.MatchString(req.Name) {
+		ts.render.Error(w, r, http.StatusBadRequest, "invalid tenant name", "use up to 63 lower-case letters, digits and dashes")
+		return
+	}
+	if req.MaxSizeMB < 0 || req.MaxUploadSizeMB < 0 || req.UploadQuotaMB < 0 {
+		ts.render.Error(w, r, http.StatusBadRequest, "limits must not be negative")
+		return
+	}
+	ts.mu.RLock()
+	_, exists := ts.tenants[req.Name]
+	closing := ts.closing[req.Name]
+	ts.mu.RUnlock()
+	if exists {
+		ts.render.Error(w, r, http.StatusConflict, "tenant already exists")
+		return
+	}
+	if closing {
+		ts.render.Error(w, r, http.StatusConflict, "tenant is being deleted", "try again once its deletion has completed")
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		ts.logger.Printf("error generating tenant admin key: %v\n", err)
+		ts.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	key := base64.RawURLEncoding.EncodeToString(buf)
+	sum := sha256.Sum256([]byte(key))
+	p, _ := auth.FromContext(r.Context())
+	spec := &tenantSpec{
+		Name:            req.Name,
+		MaxSizeMB:       req.MaxSizeMB,
+		MaxUploadSizeMB: req.MaxUploadSizeMB,
+		UploadQuotaMB:   req.UploadQuotaMB,
+		AuthRequired:    req.AuthRequired,
+		Hosts:           req.Hosts,
+		CertFile:        req.CertFile,
+		KeyFile:         req.KeyFile,
+		AdminKeySHA256:  hex.EncodeToString(sum[:]),
+		CreatedBy:       p.Username,
+		Created:         time.Now().UTC(),
+	}
+	if err := ts.start(spec.config(), spec); err != nil {
+		ts.logger.Printf("error creating tenant '%s': %v\n", req.Name, err)
+		ts.render.Error(w, r, http.StatusConflict, "unable to create tenant", err.Error())
+		return
+	}
+	ts.mu.Lock()
+	ts.created = append(ts.created, *spec)
+	err := jsonfile.Save(ts.path, ts.created)
+	t := ts.tenants[req.Name]
+	ts.mu.Unlock()
+	if err != nil {
+		// It is served all the same, but only until the server restarts.
+		ts.logger.Printf("error saving tenants: %v\n", err)
+	}
+	ts.logger.Printf("user '%s' created tenant '%s'\n", p.Username, req.Name)
+
+	info := t.info()
+	info.AdminKey = key
+	w.Header().Set("Cache-Control", "no-store")
+	ts.render.JSON(w, http.StatusCreated, info)
+}
+
+// DeleteHandler stops serving a tenant created through the API. Its directory is kept, to be
+// archived or removed by hand; tenants defined in the configuration are removed from there.
+// Admin only.
+//
+// Once the requests it is serving are done, the tenant's background work is stopped and its
+// stores are saved.
+//
+// Why can its name not be used again until then? A tenant of the same name would open the same
+// directories, with a second set of stores and background work beside the first, each
+// overwriting what the other saves.
+func (ts *tenantSet) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	ts.mu.Lock()
+	t, ok := ts.tenants[name]
+	if !ok {
+		ts.mu.Unlock()
+		ts.render.Error(w, r, http.StatusNotFound, "tenant not found")
+		return
+	}
+	if t.spec == nil {
+		ts.mu.Unlock()
+		ts.render.Error(w, r, http.StatusConflict, "tenant is defined in the configuration", "remove it from there and restart the server")
+		return
+	}
+	delete(ts.tenants, name)
+	ts.closing[name] = true
+	for _, host := range t.cfg.Hosts {
+		delete(ts.hosts, host)
+	}
+	ts.created = slices.DeleteFunc(ts.created, func(s tenantSpec) bool { return s.Name == name })
+	err := jsonfile.Save(ts.path, ts.created)
+	ts.mu.Unlock()
+	// Why wait in the handler? So that the tenant is closed, and its uploads' locks released,
+	// by the time its deletion is reported.
+	t.requests.Wait()
+	t.app.close(ts.logger)
+	ts.mu.Lock()
+	delete(ts.closing, name)
+	ts.mu.Unlock()
+	if err != nil {
+		ts.logger.Printf("error saving tenants: %v\n", err)
+		ts.render.Error(w, r, http.StatusInternalServerError, "internal error")
+		return
+	}
+	p, _ := auth.FromContext(r.Context())
+	ts.logger.Printf("user '%s' deleted tenant '%s', keeping its files in %s\n", p.Username, name, t.cfg.StorageDir)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/auth"
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// TestDeletedTenantName deletes a tenant whilst it serves a request, and creates another of
+// the same name, which is refused until the first has been closed.
+func TestDeletedTenantName(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Uploader.StorageDir = filepath.Join(dir, "files")
+	cfg.Metadata.Dir = filepath.Join(dir, "metadata")
+	cfg.Tenancy.Dir = filepath.Join(dir, "tenants")
+	ts, err := openTenants(cfg, nil, &uploadTracker{}, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ts.close)
+	admin := &auth.Principal{Username: "admin"}
+	create := func() int {
+		r := httptest.NewRequest(http.MethodPost, "/api/tenants", strings.NewReader(`{"name":"team-b"}`))
+		r = r.WithContext(auth.NewContext(r.Context(), admin))
+		w := httptest.NewRecorder()
+		ts.CreateHandler(w, r)
+		return w.Code
+	}
+	if code := create(); code != http.StatusCreated {
+		t.Fatalf("create: status %d, want 201", code)
+	}
+
+	// A request the tenant is still serving.
+	first := ts.tenants["team-b"]
+	first.requests.Add(1)
+	deleted := make(chan int)
+	go func() {
+		r := httptest.NewRequest(http.MethodDelete, "/api/tenants/team-b", nil)
+		r = r.WithContext(auth.NewContext(r.Context(), admin))
+		r.SetPathValue("name", "team-b")
+		w := httptest.NewRecorder()
+		ts.DeleteHandler(w, r)
+		deleted <- w.Code
+	}()
+	for {
+		ts.mu.RLock()
+		closing := ts.closing["team-b"]
+		ts.mu.RUnlock()
+		if closing {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if code := create(); code != http.StatusConflict {
+		t.Errorf("create whilst the deleted tenant is closed: status %d, want 409", code)
+	}
+	if err := ts.start(first.cfg, first.spec); err == nil {
+		t.Error("a tenant of the name being deleted was started")
+	}
+
+	first.requests.Done()
+	if code := <-deleted; code != http.StatusNoContent {
+		t.Fatalf("delete: status %d, want 204", code)
+	}
+	if code := create(); code != http.StatusCreated {
+		t.Errorf("create once the deleted tenant is closed: status %d, want 201", code)
+	}
+}
+
+// TestTenantEviction checks that the eviction settings of the main storage directory are not
+// applied to a tenant's.
+func TestTenantEviction(t *testing.T) {
+	base := config.Default()
+	base.Eviction = config.EvictionConfig{Policy: "lru", MaxSizeMB: 100, HighWatermark: 90, LowWatermark: 80, Interval: time.Minute}
+	c := tenantConfig(base, config.TenantConfig{Name: "team-b", MaxSizeMB: 10})
+	if c.Eviction.Policy != "" {
+		t.Errorf("the tenant evicts with %+v", c.Eviction)
+	}
+	if base.Eviction.Policy != "lru" {
+		t.Error("the main storage directory no longer evicts")
+	}
+}
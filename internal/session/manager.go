@@ -0,0 +1,203 @@
+package session
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// touchInterval limits how often LastSeen is written back to the store. Why throttle?
+// Persisting on every request would turn each download into a store write.
+const touchInterval = time.Minute
+
+// Manager issues, validates and revokes session cookies backed by a Store.
+type Manager struct {
+	store       Store
+	cookieName  string
+	idleTimeout time.Duration
+	maxLifetime time.Duration
+	secure      bool
+	basePath    string
+}
+
+// NewManager creates a Manager from the application configuration.
+func NewManager(cfg *config.Config, store Store) *Manager {
+	return &Manager{
+		store:       store,
+		cookieName:  cfg.Session.CookieName,
+		idleTimeout: cfg.Session.IdleTimeout,
+		maxLifetime: cfg.Session.AbsoluteTimeout,
+		secure:      cfg.Server.SecureCookies,
+		basePath:    cfg.Server.GetBasePath(),
+	}
+}
+
+// CookieName returns the name of the session cookie.
+func (m *Manager) CookieName() string {
+	return m.cookieName
+}
+
+// Create starts a new session for username and sets its cookie on the response.
+func (m *Manager) Create(w http.ResponseWriter, r *http.Request, username string) (Session, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return Session{}, err
+	}
+	id, err := randomString(12)
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now()
+	s := Session{
+		ID:         id,
+		TokenHash:  hashToken(token),
+		Username:   username,
+		CreatedAt:  now,
+		LastSeen:   now,
+		RemoteAddr: r.RemoteAddr,
+		UserAgent:  r.UserAgent(),
+	}
+	if err := m.store.Save(s); err != nil {
+		return Session{}, err
+	}
+
+	// Why HttpOnly and SameSite=Lax? Scripts never need the session token, and Lax keeps
+	// the cookie off cross-site subrequests whilst still allowing top-level navigation.
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.cookieName,
+		Value:    token,
+		Path:     m.cookiePath(),
+		Expires:  now.Add(m.maxLifetime),
+		HttpOnly: true,
+		Secure:   m.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return s, nil
+}
+
+// Load returns the valid session referenced by the request's cookie, if any.
+// Sessions past their idle or absolute timeout are deleted and treated as absent.
+func (m *Manager) Load(r *http.Request) (Session, bool) {
+	cookie, err := r.Cookie(m.cookieName)
+	if err != nil || cookie.Value == "" {
+		return Session{}, false
+	}
+	s, err := m.store.GetByTokenHash(hashToken(cookie.Value))
+	if err != nil {
+		return Session{}, false
+	}
+
+	now := time.Now()
+	if m.Expired(s, now) {
+		m.store.Delete(s.ID)
+		return Session{}, false
+	}
+	if now.Sub(s.LastSeen) >= touchInterval {
+		s.LastSeen = now
+		m.store.Save(s)
+	}
+	return s, true
+}
+
+// Destroy revokes the request's session, if any, and clears its cookie.
+func (m *Manager) Destroy(w http.ResponseWriter, r *http.Request) error {
+	var err error
+	if s, ok := m.Load(r); ok {
+		err = m.store.Delete(s.ID)
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     m.cookieName,
+		Value:    "",
+		Path:     m.cookiePath(),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   m.secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return err
+}
+
+// List returns the active sessions belonging to username, or all active sessions if
+// username is empty. Expired sessions encountered along the way are purged.
+func (m *Manager) List(username string) ([]Session, error) {
+	all, err := m.store.List()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var active []Session
+	for _, s := range all {
+		if m.Expired(s, now) {
+			m.store.Delete(s.ID)
+			continue
+		}
+		if username == "" || s.Username == username {
+			active = append(active, s)
+		}
+	}
+	return active, nil
+}
+
+// Revoke deletes the session with the given ID. If username is not empty, the session
+// must belong to that user, so ordinary users can only revoke their own sessions.
+func (m *Manager) Revoke(id, username string) error {
+	sessions, err := m.List(username)
+	if err != nil {
+		return err
+	}
+	for _, s := range sessions {
+		if s.ID == id {
+			return m.store.Delete(id)
+		}
+	}
+	return ErrNotFound
+}
+
+// RevokeUser deletes every session belonging to username, e.g. after a password change.
+func (m *Manager) RevokeUser(username string) error {
+	sessions, err := m.List(username)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, s := range sessions {
+		errs = append(errs, m.store.Delete(s.ID))
+	}
+	return errors.Join(errs...)
+}
+
+// Expired reports whether a session has passed its idle or absolute timeout at now.
+func (m *Manager) Expired(s Session, now time.Time) bool {
+	return now.Sub(s.LastSeen) > m.idleTimeout || now.Sub(s.CreatedAt) > m.maxLifetime
+}
+
+// cookiePath scopes the cookie to the base path so it is not sent to other
+// applications behind the same reverse proxy.
+func (m *Manager) cookiePath() string {
+	if m.basePath == "" {
+		return "/"
+	}
+	return m.basePath + "/"
+}
+
+// hashToken returns the hex-encoded SHA-256 hash of a session token.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n cryptographically random bytes encoded as URL-safe base64.
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
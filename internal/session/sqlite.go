@@ -0,0 +1,112 @@
+package session
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	// Why modernc.org/sqlite? It is pure Go, so the server still builds without cgo and
+	// cross-compiles as before.
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore keeps sessions in an SQLite database, so they survive restarts without the
+// whole store being rewritten on every change, as the file store's is.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore opens, or creates, the SQLite database at path.
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	// Why a busy timeout and WAL? Logins and requests touching their sessions write
+	// concurrently, and would otherwise fail with SQLITE_BUSY rather than wait their turn.
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("opening sessions database %s: %w", path, err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS sessions (
+		id          TEXT NOT NULL UNIQUE,
+		token_hash  TEXT PRIMARY KEY,
+		username    TEXT NOT NULL,
+		created_at  INTEGER NOT NULL,
+		last_seen   INTEGER NOT NULL,
+		remote_addr TEXT NOT NULL,
+		user_agent  TEXT NOT NULL
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating sessions table in %s: %w", path, err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Save inserts or replaces a session.
+func (ss *SQLiteStore) Save(s Session) error {
+	_, err := ss.db.Exec(`INSERT OR REPLACE INTO sessions
+		(id, token_hash, username, created_at, last_seen, remote_addr, user_agent)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		s.ID, s.TokenHash, s.Username, s.CreatedAt.UnixNano(), s.LastSeen.UnixNano(), s.RemoteAddr, s.UserAgent)
+	return err
+}
+
+// GetByTokenHash returns the session whose cookie hashes to tokenHash.
+func (ss *SQLiteStore) GetByTokenHash(tokenHash string) (Session, error) {
+	row := ss.db.QueryRow(`SELECT id, token_hash, username, created_at, last_seen, remote_addr, user_agent
+		FROM sessions WHERE token_hash = ?`, tokenHash)
+	s, err := scanSession(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrNotFound
+	}
+	return s, err
+}
+
+// Delete removes the session with the given public ID.
+func (ss *SQLiteStore) Delete(id string) error {
+	res, err := ss.db.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List returns all stored sessions, oldest first.
+func (ss *SQLiteStore) List() ([]Session, error) {
+	rows, err := ss.db.Query(`SELECT id, token_hash, username, created_at, last_seen, remote_addr, user_agent
+		FROM sessions ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Session
+	for rows.Next() {
+		s, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+// Close closes the database.
+func (ss *SQLiteStore) Close() error {
+	return ss.db.Close()
+}
+
+// scanSession reads a session from a row of the columns selected above.
+func scanSession(row interface{ Scan(dest ...any) error }) (Session, error) {
+	var s Session
+	var created, seen int64
+	if err := row.Scan(&s.ID, &s.TokenHash, &s.Username, &created, &seen, &s.RemoteAddr, &s.UserAgent); err != nil {
+		return Session{}, err
+	}
+	s.CreatedAt = time.Unix(0, created)
+	s.LastSeen = time.Unix(0, seen)
+	return s, nil
+}
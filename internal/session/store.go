@@ -0,0 +1,159 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+)
+
+// ErrNotFound is returned when a session does not exist in the store.
+var ErrNotFound = errors.New("session not found")
+
+// Session is a single authenticated browser session.
+//
+// The secret cookie value is never stored; only its SHA-256 hash is, so a leaked
+// store cannot be used to hijack sessions. ID is a separate public identifier used
+// when listing and revoking sessions.
+type Session struct {
+	ID         string    `json:"id"`
+	TokenHash  string    `json:"tokenHash"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastSeen   time.Time `json:"lastSeen"`
+	RemoteAddr string    `json:"remoteAddr"`
+	UserAgent  string    `json:"userAgent"`
+}
+
+// Store persists sessions. Implementations must be safe for concurrent use.
+type Store interface {
+	// Save inserts or replaces a session.
+	Save(s Session) error
+	// GetByTokenHash returns the session whose cookie hashes to tokenHash.
+	GetByTokenHash(tokenHash string) (Session, error)
+	// Delete removes the session with the given public ID.
+	Delete(id string) error
+	// List returns all stored sessions, oldest first.
+	List() ([]Session, error)
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// NewStore creates the Store selected by driver: "memory" keeps sessions in RAM only,
+// "file" additionally persists them to the JSON document at path, and "sqlite" keeps them
+// in the SQLite database at path.
+func NewStore(driver, path string) (Store, error) {
+	switch driver {
+	case "", "memory":
+		return NewMemoryStore(), nil
+	case "file":
+		return NewFileStore(path)
+	case "sqlite":
+		return NewSQLiteStore(path)
+	default:
+		return nil, fmt.Errorf("unknown session store %q", driver)
+	}
+}
+
+// MemoryStore keeps sessions in memory. All sessions are lost on restart.
+type MemoryStore struct {
+	mu       sync.RWMutex
+	sessions map[string]Session // keyed by token hash
+}
+
+// NewMemoryStore creates an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]Session)}
+}
+
+// Save inserts or replaces a session.
+func (ms *MemoryStore) Save(s Session) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sessions[s.TokenHash] = s
+	return nil
+}
+
+// GetByTokenHash returns the session whose cookie hashes to tokenHash.
+func (ms *MemoryStore) GetByTokenHash(tokenHash string) (Session, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	s, ok := ms.sessions[tokenHash]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return s, nil
+}
+
+// Delete removes the session with the given public ID.
+func (ms *MemoryStore) Delete(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for hash, s := range ms.sessions {
+		if s.ID == id {
+			delete(ms.sessions, hash)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// List returns all stored sessions, oldest first.
+func (ms *MemoryStore) List() ([]Session, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	list := make([]Session, 0, len(ms.sessions))
+	for _, s := range ms.sessions {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+// Close does nothing; the sessions are simply dropped with the store.
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// FileStore is a MemoryStore that writes every change through to a JSON file.
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+// NewFileStore creates a FileStore backed by path, loading any sessions already saved there.
+func NewFileStore(path string) (*FileStore, error) {
+	fst := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+	if err := jsonfile.Load(path, &fst.sessions); err != nil {
+		return nil, fmt.Errorf("loading sessions from %s: %w", path, err)
+	}
+	// A file containing "null" decodes to a nil map.
+	if fst.sessions == nil {
+		fst.sessions = make(map[string]Session)
+	}
+	return fst, nil
+}
+
+// Save inserts or replaces a session and persists the store.
+func (fst *FileStore) Save(s Session) error {
+	fst.mu.Lock()
+	defer fst.mu.Unlock()
+	fst.sessions[s.TokenHash] = s
+	return jsonfile.Save(fst.path, fst.sessions)
+}
+
+// Delete removes the session with the given public ID and persists the store.
+func (fst *FileStore) Delete(id string) error {
+	fst.mu.Lock()
+	defer fst.mu.Unlock()
+	for hash, s := range fst.sessions {
+		if s.ID == id {
+			delete(fst.sessions, hash)
+			return jsonfile.Save(fst.path, fst.sessions)
+		}
+	}
+	return ErrNotFound
+}
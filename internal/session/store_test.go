@@ -0,0 +1,91 @@
+package session
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStores(t *testing.T) {
+	for _, driver := range []string{"memory", "file", "sqlite"} {
+		t.Run(driver, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "sessions")
+			store, err := NewStore(driver, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			created := time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC)
+			older := Session{ID: "b", TokenHash: "hash-b", Username: "bob", CreatedAt: created.Add(-time.Hour), LastSeen: created}
+			newer := Session{ID: "a", TokenHash: "hash-a", Username: "alice", CreatedAt: created, LastSeen: created, RemoteAddr: "192.0.2.1:1234", UserAgent: "test"}
+			for _, s := range []Session{newer, older} {
+				if err := store.Save(s); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := store.GetByTokenHash("hash-a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != newer.ID || got.Username != newer.Username || got.RemoteAddr != newer.RemoteAddr ||
+				got.UserAgent != newer.UserAgent || !got.CreatedAt.Equal(newer.CreatedAt) || !got.LastSeen.Equal(newer.LastSeen) {
+				t.Errorf("GetByTokenHash = %+v, want %+v", got, newer)
+			}
+			if _, err := store.GetByTokenHash("missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetByTokenHash of a missing session: err = %v, want ErrNotFound", err)
+			}
+
+			// Saving again replaces the session, as touching one does.
+			newer.LastSeen = created.Add(time.Minute)
+			if err := store.Save(newer); err != nil {
+				t.Fatal(err)
+			}
+			list, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 2 || list[0].ID != "b" || list[1].ID != "a" || !list[1].LastSeen.Equal(newer.LastSeen) {
+				t.Errorf("List = %+v, want b then the touched a", list)
+			}
+
+			if err := store.Delete("b"); err != nil {
+				t.Fatal(err)
+			}
+			if err := store.Delete("b"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Delete twice: err = %v, want ErrNotFound", err)
+			}
+			if _, err := store.GetByTokenHash("hash-b"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetByTokenHash after Delete: err = %v, want ErrNotFound", err)
+			}
+
+			if driver == "memory" {
+				return
+			}
+			// The persistent stores keep their sessions across a restart.
+			if err := store.Close(); err != nil {
+				t.Fatal(err)
+			}
+			reopened, err := NewStore(driver, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reopened.Close()
+			list, err = reopened.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != 1 || list[0].ID != "a" {
+				t.Errorf("List after reopening = %+v, want only a", list)
+			}
+		})
+	}
+}
+
+func TestNewStoreUnknownDriver(t *testing.T) {
+	if _, err := NewStore("redis", ""); err == nil {
+		t.Error("NewStore accepted an unknown driver")
+	}
+}
@@ -0,0 +1,150 @@
+package shard
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Move is a file that Rebalance moves, or would move, to the directory it belongs in.
+type Move struct {
+	Name string
+	From string // directory
+	To   string // directory
+	Size int64
+	// Err, if not nil, is why the file was left where it is.
+	Err error
+}
+
+// errExists reports that a file is in the directory it belongs in already, as well as in another.
+var errExists = errors.New("a file of the same name is stored where it belongs already")
+
+// Rebalance moves the files stored in another directory than the one they belong in, as after
+// a prefix was given a disk of its own, to that directory, and calls report for each. With
+// dryRun set, nothing is moved. Files that cannot be moved are reported with the reason and
+// left in place; only a failure to walk a directory stops it.
+//
+// It must not run whilst a server uses the storage directory, as the files it moves are
+// neither found where they were nor yet where they go.
+func (l *Layout) Rebalance(dryRun bool, report func(Move)) error {
+	for _, dir := range l.Dirs() {
+		var moves []Move
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if p == dir && errors.Is(err, fs.ErrNotExist) {
+					return fs.SkipAll
+				}
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			if to := l.Dir(name); to != dir {
+				info, err := d.Info()
+				if err != nil {
+					return err
+				}
+				moves = append(moves, Move{Name: name, From: dir, To: to, Size: info.Size()})
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("walking %s: %w", dir, err)
+		}
+		// Why collect before moving? Moving files out of a directory whilst walking it would
+		// change what the walk sees.
+		for _, m := range moves {
+			if !dryRun {
+				m.Err = moveFile(m.From, m.To, m.Name)
+			}
+			report(m)
+		}
+	}
+	return nil
+}
+
+// moveFile moves the file name from the directory from to the directory to, and removes the
+// directories it leaves empty.
+//
+// Why not just rename? Disks are separate filesystems, across which a rename fails; the file
+// is then copied, and removed only once the copy is safely on disk.
+func moveFile(from, to, name string) error {
+	src := filepath.Join(from, filepath.FromSlash(name))
+	dst := filepath.Join(to, filepath.FromSlash(name))
+	if _, err := os.Lstat(dst); err == nil {
+		return errExists
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		var linkErr *os.LinkError
+		if !errors.As(err, &linkErr) {
+			return err
+		}
+		if err := copyFile(src, dst); err != nil {
+			return err
+		}
+		if err := os.Remove(src); err != nil {
+			return err
+		}
+	}
+	// Emptied directories are removed up to, but not including, the directory itself;
+	// removing one that still holds files fails, which ends the climb.
+	for d := filepath.Dir(src); d != from && len(d) > len(from); d = filepath.Dir(d) {
+		if os.Remove(d) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// copyFile copies the file src to dst, with its permissions and modification time, through
+// a temporary file beside dst so that dst never holds a partial copy.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	tmp := filepath.Join(filepath.Dir(dst), ".rebalance-"+hex.EncodeToString(b))
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
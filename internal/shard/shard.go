@@ -0,0 +1,195 @@
+// Package shard spreads the storage directory over several disks: the files below each
+// configured path prefix are stored on a disk of their own, behind the one namespace that
+// clients see.
+//
+// Why keep a file's full name on its disk, rather than its name below the prefix? A disk then
+// describes itself, so that files can be moved between disks, by hand or by Rebalance, and
+// the prefixes remapped, without renaming anything.
+package shard
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// disk is a prefix and the directory the files below it are stored in.
+type disk struct {
+	prefix string // slash-separated, without leading or trailing slashes
+	dir    string
+}
+
+// Layout maps storage names to the directories they are stored in. It is the storage.Disk
+// of a server that stores files on disk.
+type Layout struct {
+	base  string
+	disks []disk // longest prefix first
+}
+
+// New returns the layout of the storage directory base with the shards of cfg. Without
+// shards, every file is stored in base.
+//
+// Why must the directories of shards exist already? They are usually mount points, and
+// creating one for a disk that is not mounted would fill the disk below it instead.
+func New(base string, cfg []config.ShardConfig) (*Layout, error) {
+	l := &Layout{base: base}
+	seen := make(map[string]bool)
+	for _, s := range cfg {
+		prefix := strings.Trim(path.Clean("/"+s.Prefix), "/")
+		if prefix == "" || seen[prefix] {
+			return nil, fmt.Errorf("invalid shard prefix %q: prefixes must be unique and not the whole storage directory", s.Prefix)
+		}
+		seen[prefix] = true
+		if s.Dir == "" {
+			return nil, fmt.Errorf("shard %q has no directory", s.Prefix)
+		}
+		if info, err := os.Stat(s.Dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("invalid directory %s for shard %q: must be an existing directory", s.Dir, s.Prefix)
+		}
+		l.disks = append(l.disks, disk{prefix: prefix, dir: s.Dir})
+	}
+	slices.SortFunc(l.disks, func(a, b disk) int { return len(b.prefix) - len(a.prefix) })
+	// Why must no directory lie within another? Walking the outer one would find the files
+	// of the inner one, under names that belong elsewhere.
+	dirs := l.Dirs()
+	for i, a := range dirs {
+		for _, b := range dirs[i+1:] {
+			if nested, err := within(a, b); err != nil || nested {
+				return nil, fmt.Errorf("invalid shard directories %s and %s: neither may be within the other, nor within the storage directory", a, b)
+			}
+		}
+	}
+	return l, nil
+}
+
+// within reports whether either of the directories a and b is, or lies within, the other.
+func within(a, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+	inside := func(dir, parent string) bool {
+		rel, err := filepath.Rel(parent, dir)
+		return err == nil && filepath.IsLocal(rel)
+	}
+	return inside(absA, absB) || inside(absB, absA), nil
+}
+
+// Sharded reports whether any prefix is stored elsewhere than the storage directory.
+func (l *Layout) Sharded() bool {
+	return len(l.disks) > 0
+}
+
+// Dir returns the directory that the file or directory name is stored in.
+func (l *Layout) Dir(name string) string {
+	for _, d := range l.disks {
+		if below(name, d.prefix) {
+			return d.dir
+		}
+	}
+	return l.base
+}
+
+// Path returns the path on disk of the file or directory name.
+func (l *Layout) Path(name string) string {
+	return filepath.Join(l.Dir(name), filepath.FromSlash(name))
+}
+
+// OpenRoot opens the directory that name is stored in.
+func (l *Layout) OpenRoot(name string) (storage.Root, error) {
+	return storage.OpenRoot(l.Dir(name))
+}
+
+// Dirs returns every directory files are stored in, the storage directory first.
+func (l *Layout) Dirs() []string {
+	dirs := []string{l.base}
+	for _, d := range l.disks {
+		if !slices.Contains(dirs, d.dir) {
+			dirs = append(dirs, d.dir)
+		}
+	}
+	return dirs
+}
+
+// Spans reports whether the directory name holds files stored in more than one directory,
+// as one above a prefix stored elsewhere does.
+func (l *Layout) Spans(name string) bool {
+	dir := l.Dir(name)
+	for _, d := range l.disks {
+		if below(d.prefix, name) && d.prefix != name && d.dir != dir {
+			return true
+		}
+	}
+	return false
+}
+
+// Walk calls fn for every file stored where the layout says it belongs, with its storage
+// name; directories are descended into rather than passed to fn. A directory that does not
+// exist yet holds no files.
+//
+// Files found on another disk than their own, as after prefixes were remapped, are left out:
+// they are not found where they are looked for until Rebalance has moved them.
+func (l *Layout) Walk(fn func(name string, d fs.DirEntry) error) error {
+	for _, dir := range l.Dirs() {
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if p == dir && errors.Is(err, fs.ErrNotExist) {
+					return fs.SkipAll
+				}
+				return err
+			}
+			if p == dir {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			name := filepath.ToSlash(rel)
+			if d.IsDir() {
+				if !l.mayHold(dir, name) {
+					return fs.SkipDir
+				}
+				return nil
+			}
+			if l.Dir(name) != dir {
+				return nil
+			}
+			return fn(name, d)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mayHold reports whether the directory name may hold files that belong in dir.
+func (l *Layout) mayHold(dir, name string) bool {
+	if l.Dir(name+"/") == dir {
+		return true
+	}
+	for _, d := range l.disks {
+		if d.dir == dir && below(d.prefix, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// below reports whether name is prefix or lies below it.
+func below(name, prefix string) bool {
+	return name == prefix || strings.HasPrefix(name, prefix+"/")
+}
@@ -0,0 +1,261 @@
+package shard
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// writeFiles creates files below dir, each holding its own name.
+func writeFiles(t *testing.T, dir string, files ...string) {
+	t.Helper()
+	for _, f := range files {
+		full := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(full), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(full, []byte(f), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestLayout returns a layout of a storage directory with the prefixes "photos" and
+// "photos/raw" on disks of their own, and "videos" sharing the disk of "photos/raw".
+func newTestLayout(t *testing.T) (l *Layout, base, photos, raw string) {
+	t.Helper()
+	base, photos, raw = t.TempDir(), t.TempDir(), t.TempDir()
+	l, err := New(base, []config.ShardConfig{
+		{Prefix: "/photos/", Dir: photos},
+		{Prefix: "photos/raw", Dir: raw},
+		{Prefix: "videos", Dir: raw},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, base, photos, raw
+}
+
+func TestNew(t *testing.T) {
+	base, disk, file := t.TempDir(), t.TempDir(), filepath.Join(t.TempDir(), "file")
+	writeFiles(t, filepath.Dir(file), "file")
+	inside := filepath.Join(base, "inside")
+	if err := os.Mkdir(inside, 0755); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		desc    string
+		base    string
+		shards  []config.ShardConfig
+		wantErr bool
+	}{
+		{"no shards", base, nil, false},
+		{"a shard", base, []config.ShardConfig{{Prefix: "photos", Dir: disk}}, false},
+		{"two prefixes on one disk", base, []config.ShardConfig{{Prefix: "photos", Dir: disk}, {Prefix: "videos", Dir: disk}}, false},
+		{"the whole storage directory", base, []config.ShardConfig{{Prefix: "/", Dir: disk}}, true},
+		{"a prefix given twice", base, []config.ShardConfig{{Prefix: "photos", Dir: disk}, {Prefix: "/photos/", Dir: disk}}, true},
+		{"no directory", base, []config.ShardConfig{{Prefix: "photos"}}, true},
+		{"a missing directory", base, []config.ShardConfig{{Prefix: "photos", Dir: filepath.Join(disk, "missing")}}, true},
+		{"a file as directory", base, []config.ShardConfig{{Prefix: "photos", Dir: file}}, true},
+		{"a directory within the storage directory", base, []config.ShardConfig{{Prefix: "photos", Dir: inside}}, true},
+		{"a storage directory within a shard's", filepath.Join(disk, "storage"), []config.ShardConfig{{Prefix: "photos", Dir: disk}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			if _, err := New(tt.base, tt.shards); (err != nil) != tt.wantErr {
+				t.Errorf("New = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLayout(t *testing.T) {
+	l, base, photos, raw := newTestLayout(t)
+	if !l.Sharded() {
+		t.Error("layout with shards is not sharded")
+	}
+	if want := []string{base, raw, photos}; !slices.Equal(l.Dirs(), want) {
+		t.Errorf("Dirs = %v, want %v", l.Dirs(), want)
+	}
+	tests := []struct {
+		name      string
+		wantDir   string
+		wantSpans bool
+	}{
+		{"a.txt", base, false},
+		{"docs", base, false},
+		{"photos", photos, true},
+		{"photos/a.jpg", photos, false},
+		{"photos/raw", raw, false},
+		{"photos/raw/a.cr2", raw, false},
+		{"photos/rawfile.jpg", photos, false},
+		{"photosets/a.jpg", base, false},
+		{"videos/a.mp4", raw, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := l.Dir(tt.name); got != tt.wantDir {
+				t.Errorf("Dir = %s, want %s", got, tt.wantDir)
+			}
+			if got, want := l.Path(tt.name), filepath.Join(tt.wantDir, filepath.FromSlash(tt.name)); got != want {
+				t.Errorf("Path = %s, want %s", got, want)
+			}
+			if got := l.Spans(tt.name); got != tt.wantSpans {
+				t.Errorf("Spans = %v, want %v", got, tt.wantSpans)
+			}
+		})
+	}
+
+	plain, err := New(base, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plain.Sharded() || plain.Dir("photos/a.jpg") != base || plain.Spans("photos") {
+		t.Error("layout without shards stores files elsewhere than the storage directory")
+	}
+}
+
+// TestWalk checks that each file is found once, under its storage name, on its own disk only.
+func TestWalk(t *testing.T) {
+	l, base, photos, raw := newTestLayout(t)
+	writeFiles(t, base, "a.txt", "docs/b.txt", "photosets/c.jpg", "photos/misplaced.jpg")
+	writeFiles(t, photos, "photos/d.jpg", "photos/2024/e.jpg", "stray.txt")
+	writeFiles(t, raw, "photos/raw/f.cr2", "videos/g.mp4", "photos/misplaced.jpg")
+	var names []string
+	err := l.Walk(func(name string, d fs.DirEntry) error {
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(names)
+	want := []string{"a.txt", "docs/b.txt", "photos/2024/e.jpg", "photos/d.jpg", "photos/raw/f.cr2", "photosets/c.jpg", "videos/g.mp4"}
+	if !slices.Equal(names, want) {
+		t.Errorf("walked %v, want %v", names, want)
+	}
+
+	// A storage directory that does not exist yet holds no files.
+	empty, err := New(filepath.Join(t.TempDir(), "missing"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := empty.Walk(func(name string, d fs.DirEntry) error {
+		t.Errorf("walked %s in a missing directory", name)
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	l, base, photos, raw := newTestLayout(t)
+	writeFiles(t, base, "a.txt", "photos/2024/b.jpg", "photos/raw/c.cr2", "photos/dup.jpg")
+	writeFiles(t, photos, "photos/d.jpg", "photos/dup.jpg", "videos/e.mp4")
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(base, "photos", "2024", "b.jpg"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	rebalance := func(dryRun bool) map[string]Move {
+		t.Helper()
+		moves := make(map[string]Move)
+		if err := l.Rebalance(dryRun, func(m Move) { moves[m.Name] = m }); err != nil {
+			t.Fatal(err)
+		}
+		return moves
+	}
+	want := map[string]Move{
+		"photos/2024/b.jpg": {Name: "photos/2024/b.jpg", From: base, To: photos, Size: 17},
+		"photos/raw/c.cr2":  {Name: "photos/raw/c.cr2", From: base, To: raw, Size: 16},
+		"photos/dup.jpg":    {Name: "photos/dup.jpg", From: base, To: photos, Size: 14},
+		"videos/e.mp4":      {Name: "videos/e.mp4", From: photos, To: raw, Size: 12},
+	}
+
+	if got := rebalance(true); !equalMoves(got, want) {
+		t.Errorf("dry run reported %v, want %v", got, want)
+	}
+	if _, err := os.Stat(filepath.Join(base, "photos", "2024", "b.jpg")); err != nil {
+		t.Errorf("dry run moved a file: %v", err)
+	}
+
+	want["photos/dup.jpg"] = Move{Name: "photos/dup.jpg", From: base, To: photos, Size: 14, Err: errExists}
+	if got := rebalance(false); !equalMoves(got, want) {
+		t.Errorf("rebalance reported %v, want %v", got, want)
+	}
+	for _, f := range []string{"photos/2024/b.jpg", "photos/raw/c.cr2", "videos/e.mp4"} {
+		b, err := os.ReadFile(l.Path(f))
+		if err != nil || string(b) != f {
+			t.Errorf("%s holds %q, %v after rebalancing", f, b, err)
+		}
+	}
+	if info, err := os.Stat(l.Path("photos/2024/b.jpg")); err != nil || !info.ModTime().Equal(old) {
+		t.Errorf("moved file lost its modification time: %v", err)
+	}
+	// The emptied directories are removed; the one still holding the duplicate is not.
+	if _, err := os.Stat(filepath.Join(base, "photos", "2024")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("emptied directory left behind: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(base, "photos", "dup.jpg")); err != nil {
+		t.Errorf("file that could not be moved is gone: %v", err)
+	}
+	if _, err := os.Stat(base); err != nil {
+		t.Errorf("storage directory removed: %v", err)
+	}
+
+	// Only the duplicate is left to move.
+	if got := rebalance(false); len(got) != 1 || got["photos/dup.jpg"].Err == nil {
+		t.Errorf("second rebalance reported %v, want only the duplicate", got)
+	}
+}
+
+// equalMoves reports whether the moves a and b are the same, with the same errors.
+func equalMoves(a, b map[string]Move) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, m := range a {
+		n, ok := b[name]
+		if !ok || m.Name != n.Name || m.From != n.From || m.To != n.To || m.Size != n.Size || !errors.Is(m.Err, n.Err) {
+			return false
+		}
+	}
+	return true
+}
+
+// TestCopyFile checks the copy made when a file cannot be renamed onto another disk.
+func TestCopyFile(t *testing.T) {
+	src, dst := filepath.Join(t.TempDir(), "a.txt"), filepath.Join(t.TempDir(), "a.txt")
+	writeFiles(t, filepath.Dir(src), "a.txt")
+	if err := os.Chmod(src, 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(src, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(dst); string(b) != "a.txt" || info.Mode().Perm() != 0600 || !info.ModTime().Equal(old) {
+		t.Errorf("copy holds %q with mode %v and time %v, want the original's", b, info.Mode().Perm(), info.ModTime())
+	}
+	entries, err := os.ReadDir(filepath.Dir(dst))
+	if err != nil || len(entries) != 1 {
+		t.Errorf("copying left %v, %v beside the copy", entries, err)
+	}
+
+	if err := copyFile(filepath.Join(t.TempDir(), "missing"), filepath.Join(filepath.Dir(dst), "b.txt")); err == nil {
+		t.Error("copied a missing file")
+	}
+}
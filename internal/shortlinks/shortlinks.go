@@ -0,0 +1,164 @@
+// Package shortlinks keeps short codes standing for stored files, for links that are easy to
+// paste into a chat or encode in a QR code, and counts how often each is followed.
+package shortlinks
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+)
+
+// saveDelay is how long a click may wait before the store is written to disk, so that a
+// popular link does not rewrite the file on every click. Anything lost in a crash is a few
+// clicks, which is not worth more.
+const saveDelay = 5 * time.Second
+
+// codeAlphabet holds the characters of codes, which are safe in URLs as they are.
+const codeAlphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+// codeLength is the length of codes: 62^6 is over 56 billion, so they do not run out.
+const codeLength = 6
+
+// Link is a short code standing for a stored file.
+type Link struct {
+	Code string `json:"code"`
+	// FileID is the file's ID in the file metadata, so that the link follows the file when it
+	// is renamed or moved.
+	FileID    string    `json:"fileId"`
+	CreatedBy string    `json:"createdBy"`
+	Created   time.Time `json:"created"`
+	// Clicks counts the times the link has been followed.
+	Clicks int64 `json:"clicks"`
+}
+
+// Store persists the links to a JSON file in the metadata directory.
+type Store struct {
+	path   string
+	logger *log.Logger
+
+	mu        sync.Mutex
+	links     map[string]Link   // keyed by code
+	byFile    map[string]string // codes keyed by file ID
+	saving    bool              // a save is scheduled
+	saveTimer *time.Timer       // of the scheduled save
+}
+
+// Open loads the links from path.
+func Open(path string, logger *log.Logger) (*Store, error) {
+	s := &Store{path: path, logger: logger, links: make(map[string]Link)}
+	if err := jsonfile.Load(path, &s.links); err != nil {
+		return nil, fmt.Errorf("loading short links from %s: %w", path, err)
+	}
+	if s.links == nil {
+		s.links = make(map[string]Link)
+	}
+	s.byFile = make(map[string]string, len(s.links))
+	for code, l := range s.links {
+		s.byFile[l.FileID] = code
+	}
+	return s, nil
+}
+
+// Shorten returns the link to the file with the given ID, creating it for user unless the
+// file has one already. created reports whether it was created.
+//
+// Why one link per file? Shortening the same file twice then gives the same link, and its
+// clicks are counted in one place.
+func (s *Store) Shorten(fileID, user string) (l Link, created bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if code, ok := s.byFile[fileID]; ok {
+		return s.links[code], false, nil
+	}
+	code, err := s.newCode()
+	if err != nil {
+		return Link{}, false, err
+	}
+	l = Link{Code: code, FileID: fileID, CreatedBy: user, Created: time.Now().UTC()}
+	s.links[code] = l
+	s.byFile[fileID] = code
+	if err := jsonfile.Save(s.path, s.links); err != nil {
+		delete(s.links, code)
+		delete(s.byFile, fileID)
+		return Link{}, false, err
+	}
+	return l, true, nil
+}
+
+// Get returns the link with the given code.
+func (s *Store) Get(code string) (Link, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[code]
+	return l, ok
+}
+
+// Click counts a visit to the link with the given code, and returns the link.
+func (s *Store) Click(code string) (Link, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[code]
+	if !ok {
+		return Link{}, false
+	}
+	l.Clicks++
+	s.links[code] = l
+	s.saveLocked()
+	return l, true
+}
+
+// Flush writes a scheduled save to disk immediately, for use when the server stops.
+func (s *Store) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.saving {
+		return nil
+	}
+	s.saving = false
+	s.saveTimer.Stop()
+	return jsonfile.Save(s.path, s.links)
+}
+
+// newCode returns a random code that no link has yet. The caller must hold the lock.
+func (s *Store) newCode() (string, error) {
+	b := make([]byte, codeLength)
+	for range 5 {
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		for i := range b {
+			// The slight bias of the modulo makes no difference to codes that are looked up,
+			// not used as secrets.
+			b[i] = codeAlphabet[int(b[i])%len(codeAlphabet)]
+		}
+		if _, ok := s.links[string(b)]; !ok {
+			return string(b), nil
+		}
+	}
+	return "", errors.New("no unused code found")
+}
+
+// saveLocked schedules a save, unless one is already scheduled. The caller must hold the lock.
+func (s *Store) saveLocked() {
+	if s.saving {
+		return
+	}
+	s.saving = true
+	s.saveTimer = time.AfterFunc(saveDelay, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// Flushed meanwhile.
+		if !s.saving {
+			return
+		}
+		s.saving = false
+		if err := jsonfile.Save(s.path, s.links); err != nil {
+			s.logger.Printf("error saving short links: %v\n", err)
+		}
+	})
+}
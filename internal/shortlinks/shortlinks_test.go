@@ -0,0 +1,62 @@
+package shortlinks
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shortlinks.json")
+	s, err := Open(path, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, created, err := s.Shorten("file-1", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || !regexp.MustCompile(`^[A-Za-z0-9]{6}$`).MatchString(l.Code) || l.FileID != "file-1" || l.CreatedBy != "alice" || l.Created.IsZero() {
+		t.Fatalf("got %+v, %v, want a new link to file-1", l, created)
+	}
+
+	// A file has one link, whoever shortens it.
+	again, created, err := s.Shorten("file-1", "bob")
+	if err != nil || created || again != l {
+		t.Errorf("got %+v, %v, %v shortening again, want %+v", again, created, err, l)
+	}
+	other, _, err := s.Shorten("file-2", "bob")
+	if err != nil || other.Code == l.Code {
+		t.Errorf("got %+v, %v for another file, want another code", other, err)
+	}
+
+	for range 3 {
+		s.Click(l.Code)
+	}
+	if got, ok := s.Get(l.Code); !ok || got.Clicks != 3 {
+		t.Errorf("got %+v, %v, want 3 clicks", got, ok)
+	}
+	if _, ok := s.Click("unknown"); ok {
+		t.Error("clicked an unknown link")
+	}
+	if _, ok := s.Get("unknown"); ok {
+		t.Error("found an unknown link")
+	}
+
+	// Clicks are saved when the store is flushed, and links outlast a restart.
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	s, err = Open(path, log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := s.Get(l.Code); !ok || got.Clicks != 3 || got.FileID != "file-1" {
+		t.Errorf("got %+v, %v after reopening, want 3 clicks on file-1", got, ok)
+	}
+	if again, created, _ := s.Shorten("file-1", "bob"); created || again.Code != l.Code {
+		t.Errorf("got %s, %v shortening after reopening, want %s", again.Code, created, l.Code)
+	}
+}
@@ -0,0 +1,187 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+)
+
+// secretPrefix marks token secrets so they are easy to recognise in logs and secret scanners.
+const secretPrefix = "fst_"
+
+// ErrNotFound is returned when a token does not exist.
+var ErrNotFound = errors.New("token not found")
+
+// Token is a scoped, expiring access token. Only the SHA-256 hash of its secret is stored.
+type Token struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	SecretHash  string    `json:"secretHash"`
+	Prefixes    []string  `json:"prefixes"`
+	Permissions []string  `json:"permissions"`
+	CreatedBy   string    `json:"createdBy"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+// Expired reports whether the token is no longer valid at now.
+func (t Token) Expired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+// Store persists tokens to a JSON file in the metadata directory.
+type Store struct {
+	mu     sync.RWMutex
+	path   string
+	tokens map[string]Token // keyed by ID
+}
+
+// Open loads the token store from path.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, tokens: make(map[string]Token)}
+	if err := jsonfile.Load(path, &s.tokens); err != nil {
+		return nil, fmt.Errorf("loading tokens from %s: %w", path, err)
+	}
+	if s.tokens == nil {
+		s.tokens = make(map[string]Token)
+	}
+	return s, nil
+}
+
+// Create mints a new token and returns it together with its secret. The secret is
+// not stored and cannot be retrieved again.
+func (s *Store) Create(t Token) (Token, string, error) {
+	id, err := randomString(9)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret, err := randomString(32)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret = secretPrefix + secret
+
+	t.ID = id
+	t.SecretHash = hashSecret(secret)
+	t.CreatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneExpired(t.CreatedAt)
+	s.tokens[t.ID] = t
+	if err := s.save(); err != nil {
+		delete(s.tokens, t.ID)
+		return Token{}, "", err
+	}
+	return t, secret, nil
+}
+
+// Lookup returns the unexpired token matching secret.
+func (s *Store) Lookup(secret string) (Token, bool) {
+	hash := hashSecret(secret)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tokens {
+		if t.SecretHash == hash {
+			return t, !t.Expired(time.Now())
+		}
+	}
+	return Token{}, false
+}
+
+// List returns all unexpired tokens, newest first.
+func (s *Store) List() []Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	list := make([]Token, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		if !t.Expired(now) {
+			list = append(list, t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list
+}
+
+// Revoke deletes the token with the given ID.
+func (s *Store) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, ok := s.tokens[id]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.tokens, id)
+	if err := s.save(); err != nil {
+		s.tokens[id] = old
+		return err
+	}
+	return nil
+}
+
+// RevokeCreatedBy deletes the tokens the user username minted, and returns how many.
+func (s *Store) RevokeCreatedBy(username string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	revoked := make(map[string]Token)
+	for id, t := range s.tokens {
+		if t.CreatedBy == username {
+			revoked[id] = t
+			delete(s.tokens, id)
+		}
+	}
+	if len(revoked) == 0 {
+		return 0, nil
+	}
+	if err := s.save(); err != nil {
+		maps.Copy(s.tokens, revoked)
+		return 0, err
+	}
+	return len(revoked), nil
+}
+
+// pruneExpired drops expired tokens so the file does not grow forever.
+// The caller must hold the write lock; the change is persisted by the next save.
+func (s *Store) pruneExpired(now time.Time) {
+	for id, t := range s.tokens {
+		if t.Expired(now) {
+			delete(s.tokens, id)
+		}
+	}
+}
+
+// save writes the tokens to disk. The caller must hold the write lock.
+func (s *Store) save() error {
+	return jsonfile.Save(s.path, s.tokens)
+}
+
+// IsSecret reports whether a presented credential looks like a token secret rather than an API key.
+func IsSecret(credential string) bool {
+	return strings.HasPrefix(credential, secretPrefix)
+}
+
+// hashSecret returns the hex-encoded SHA-256 hash of a token secret.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// randomString returns n cryptographically random bytes encoded as URL-safe base64.
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
@@ -0,0 +1,238 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+)
+
+// Password length bounds for new or changed passwords. bcrypt ignores input beyond 72 bytes,
+// so longer passwords are rejected rather than silently truncated.
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 72
+)
+
+var (
+	// ErrNotFound is returned when a user does not exist.
+	ErrNotFound = errors.New("user not found")
+	// ErrExists is returned when creating a user whose name is already taken.
+	ErrExists = errors.New("user already exists")
+	// ErrStatic is returned when trying to modify a user defined in the configuration file.
+	ErrStatic = errors.New("user is defined in the configuration file and cannot be modified")
+	// ErrInvalidUsername is returned for usernames outside the permitted character set.
+	ErrInvalidUsername = errors.New("username must be 1-64 characters of letters, digits, '.', '_', '-' or '@'")
+	// ErrInvalidPassword is returned for passwords outside the permitted length bounds.
+	ErrInvalidPassword = fmt.Errorf("password must be between %d and %d bytes long", MinPasswordLength, MaxPasswordLength)
+)
+
+// usernamePattern restricts usernames to characters that are safe in logs, URLs and paths.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]{1,64}$`)
+
+// dummyHash is compared against when a username is unknown. Why? Returning early would
+// make failed logins for unknown users measurably faster, revealing which usernames exist.
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("fileserver-dummy-password"), bcrypt.DefaultCost)
+
+// User is a local user account.
+type User struct {
+	Username     string    `json:"username"`
+	PasswordHash string    `json:"passwordHash"`
+	Roles        []string  `json:"roles"`
+	Disabled     bool      `json:"disabled"`
+	CreatedAt    time.Time `json:"createdAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+	// Static marks users defined in the configuration file. They are never persisted.
+	Static bool `json:"-"`
+}
+
+// HasRole reports whether the user has been assigned the given role.
+func (u User) HasRole(role string) bool {
+	return slices.Contains(u.Roles, role)
+}
+
+// Store holds user accounts. Users created at runtime are persisted to a JSON file in the
+// metadata directory; users from the configuration file are merged in read-only.
+type Store struct {
+	mu     sync.RWMutex
+	path   string
+	users  map[string]User
+	static map[string]User
+}
+
+// Open loads the user store from path and merges in the static users from the configuration.
+func Open(path string, staticUsers []config.StaticUser) (*Store, error) {
+	s := &Store{
+		path:   path,
+		users:  make(map[string]User),
+		static: make(map[string]User, len(staticUsers)),
+	}
+	if err := jsonfile.Load(path, &s.users); err != nil {
+		return nil, fmt.Errorf("loading users from %s: %w", path, err)
+	}
+	if s.users == nil {
+		s.users = make(map[string]User)
+	}
+	for _, su := range staticUsers {
+		// Why check names from the configuration? Names outside the pattern are kept for
+		// principals that are not users, such as "signed-url:", which a user could pose as.
+		if !usernamePattern.MatchString(su.Username) {
+			return nil, fmt.Errorf("static user %q: %w", su.Username, ErrInvalidUsername)
+		}
+		s.static[su.Username] = User{
+			Username:     su.Username,
+			PasswordHash: su.PasswordHash,
+			Roles:        su.Roles,
+			Static:       true,
+		}
+	}
+	return s, nil
+}
+
+// Get returns the user with the given name. Static users take precedence.
+func (s *Store) Get(username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if u, ok := s.static[username]; ok {
+		return u, nil
+	}
+	if u, ok := s.users[username]; ok {
+		return u, nil
+	}
+	return User{}, ErrNotFound
+}
+
+// List returns all users, sorted by name.
+func (s *Store) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]User, 0, len(s.users)+len(s.static))
+	for _, u := range s.static {
+		list = append(list, u)
+	}
+	for name, u := range s.users {
+		if _, shadowed := s.static[name]; !shadowed {
+			list = append(list, u)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+// Create adds a new user with the given password and roles.
+func (s *Store) Create(username, password string, roles []string) (User, error) {
+	if !usernamePattern.MatchString(username) {
+		return User{}, ErrInvalidUsername
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.static[username]; ok {
+		return User{}, ErrExists
+	}
+	if _, ok := s.users[username]; ok {
+		return User{}, ErrExists
+	}
+
+	now := time.Now().UTC()
+	u := User{
+		Username:     username,
+		PasswordHash: hash,
+		Roles:        roles,
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}
+	s.users[username] = u
+	if err := s.save(); err != nil {
+		delete(s.users, username)
+		return User{}, err
+	}
+	return u, nil
+}
+
+// Update applies fn to a copy of the named user and persists the result if fn succeeds.
+func (s *Store) Update(username string, fn func(u *User) error) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.static[username]; ok {
+		return User{}, ErrStatic
+	}
+	old, ok := s.users[username]
+	if !ok {
+		return User{}, ErrNotFound
+	}
+
+	u := old
+	u.Roles = slices.Clone(old.Roles)
+	if err := fn(&u); err != nil {
+		return User{}, err
+	}
+	u.UpdatedAt = time.Now().UTC()
+	s.users[username] = u
+	if err := s.save(); err != nil {
+		s.users[username] = old
+		return User{}, err
+	}
+	return u, nil
+}
+
+// Delete removes a user.
+func (s *Store) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.static[username]; ok {
+		return ErrStatic
+	}
+	old, ok := s.users[username]
+	if !ok {
+		return ErrNotFound
+	}
+	delete(s.users, username)
+	if err := s.save(); err != nil {
+		s.users[username] = old
+		return err
+	}
+	return nil
+}
+
+// Authenticate returns the user if the password is correct and the account is enabled.
+func (s *Store) Authenticate(username, password string) (User, bool) {
+	u, err := s.Get(username)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, false
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return User{}, false
+	}
+	return u, !u.Disabled
+}
+
+// save writes the runtime users to disk. The caller must hold the write lock.
+func (s *Store) save() error {
+	return jsonfile.Save(s.path, s.users)
+}
+
+// HashPassword validates a new password and returns its bcrypt hash.
+func HashPassword(password string) (string, error) {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return "", ErrInvalidPassword
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
@@ -0,0 +1,290 @@
+// Package video extracts a poster frame and the duration of uploaded videos with ffmpeg, so
+// that clients can preview videos without downloading them.
+package video
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/jsonfile"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// extensions are those of the files treated as videos.
+var extensions = map[string]bool{
+	".3gp": true, ".avi": true, ".flv": true, ".m4v": true, ".mkv": true, ".mov": true,
+	".mp4": true, ".mpeg": true, ".mpg": true, ".ogv": true, ".ts": true, ".webm": true,
+	".wmv": true,
+}
+
+// IsVideo reports whether name is treated as a video, going by its extension.
+func IsVideo(name string) bool {
+	return extensions[strings.ToLower(path.Ext(name))]
+}
+
+// Info describes one video.
+type Info struct {
+	// Duration is the length of the video in seconds.
+	Duration float64 `json:"duration"`
+	// Poster reports whether a poster frame could be extracted.
+	Poster bool `json:"poster"`
+}
+
+// pending is a video waiting for extraction.
+type pending struct {
+	name string
+	sum  string
+}
+
+// Previews runs ffmpeg on uploaded videos in the background, and keeps what it finds. A nil
+// *Previews, for a server without ffmpeg, finds nothing.
+//
+// Why key by checksum rather than name? A preview then follows its video when it is moved or
+// copied, and can never describe content that has since been replaced.
+type Previews struct {
+	ffmpeg  string
+	timeout time.Duration
+	path    string
+	dir     string // where posters are kept
+	storage storage.Disk
+	logger  *log.Logger
+
+	mu      sync.Mutex
+	infos   map[string]Info // keyed by SHA-256 of the video
+	pending []pending
+	wake    chan struct{}
+
+	// ctx is cancelled by Close, to stop extracting.
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{} // closed once extraction stops
+}
+
+// Open loads the previews from path, with their posters in dir, for the videos stored in st,
+// and starts extracting. It returns nil if no ffmpeg is configured. As ffmpeg reads the
+// videos itself, they must be stored on disk.
+func Open(cfg config.VideoConfig, path, dir string, st storage.Storage, logger *log.Logger) (*Previews, error) {
+	if cfg.FFmpeg == "" {
+		return nil, nil
+	}
+	disk, ok := st.(storage.Disk)
+	if !ok {
+		return nil, fmt.Errorf("video previews: %w", storage.ErrNotOnDisk)
+	}
+	ffmpeg, err := exec.LookPath(cfg.FFmpeg)
+	if err != nil {
+		return nil, fmt.Errorf("finding ffmpeg: %w", err)
+	}
+	p := &Previews{
+		ffmpeg:  ffmpeg,
+		timeout: cfg.Timeout,
+		path:    path,
+		dir:     dir,
+		storage: disk,
+		logger:  logger,
+		infos:   make(map[string]Info),
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	if err := jsonfile.Load(path, &p.infos); err != nil {
+		return nil, fmt.Errorf("loading video previews from %s: %w", path, err)
+	}
+	if p.infos == nil {
+		p.infos = make(map[string]Info)
+	}
+	go p.extractPending()
+	return p, nil
+}
+
+// Close stops extracting, killing the ffmpeg running, and waits for it to exit. The videos
+// still waiting get no preview, as after a restart, until they are stored again.
+func (p *Previews) Close() {
+	if p == nil {
+		return
+	}
+	p.cancel()
+	<-p.done
+}
+
+// Extract queues the file stored at name, whose checksum is sum, for extraction if it is a
+// video without a preview yet.
+func (p *Previews) Extract(name, sum string) {
+	if p == nil || sum == "" || !IsVideo(name) {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.infos[sum]; ok {
+		return
+	}
+	p.pending = append(p.pending, pending{name: name, sum: sum})
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Get returns the preview of the video whose checksum is sum.
+func (p *Previews) Get(sum string) (Info, bool) {
+	if p == nil {
+		return Info{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	info, ok := p.infos[sum]
+	return info, ok
+}
+
+// PosterPath returns the path of the poster frame of the video whose checksum is sum.
+func (p *Previews) PosterPath(sum string) string {
+	return filepath.Join(p.dir, sum+".jpg")
+}
+
+// Prune drops the previews of videos whose checksum is not in keep, such as those deleted
+// whilst the server was down.
+func (p *Previews) Prune(keep map[string]bool) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pruned := 0
+	for sum := range p.infos {
+		if !keep[sum] {
+			delete(p.infos, sum)
+			os.Remove(p.PosterPath(sum))
+			pruned++
+		}
+	}
+	if pruned == 0 {
+		return
+	}
+	p.logger.Printf("pruned %d video previews\n", pruned)
+	if err := jsonfile.Save(p.path, p.infos); err != nil {
+		p.logger.Printf("error saving video previews: %v\n", err)
+	}
+}
+
+// extractPending runs ffmpeg on the queued videos, one at a time, until the previews are closed.
+//
+// Why one at a time? Decoding video is heavy, and previews can wait, whereas requests cannot.
+func (p *Previews) extractPending() {
+	defer close(p.done)
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-p.wake:
+		}
+		for p.ctx.Err() == nil {
+			p.mu.Lock()
+			if len(p.pending) == 0 {
+				p.mu.Unlock()
+				break
+			}
+			next := p.pending[0]
+			p.pending = p.pending[1:]
+			_, done := p.infos[next.sum]
+			p.mu.Unlock()
+			if done {
+				continue
+			}
+
+			info, err := p.extract(next.name, next.sum)
+			if p.ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				p.logger.Printf("error extracting preview of '%s': %v\n", next.name, err)
+				continue
+			}
+			p.mu.Lock()
+			p.infos[next.sum] = info
+			if err := jsonfile.Save(p.path, p.infos); err != nil {
+				p.logger.Printf("error saving video previews: %v\n", err)
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// durationPattern matches the duration ffmpeg reports for its input.
+var durationPattern = regexp.MustCompile(`Duration: (\d+):(\d{2}):(\d{2}(?:\.\d+)?)`)
+
+// extract runs ffmpeg on the video stored at name, writing its poster frame to the poster
+// path of sum.
+//
+// Why the thumbnail filter? The first frame is often black, or a title card; the filter picks
+// the most representative of the first hundred instead.
+func (p *Previews) extract(name, sum string) (Info, error) {
+	src, err := filepath.Abs(p.storage.Path(name))
+	if err != nil {
+		return Info{}, err
+	}
+	if err := os.MkdirAll(p.dir, 0755); err != nil {
+		return Info{}, err
+	}
+	tmp := p.PosterPath(sum) + ".tmp"
+	defer os.Remove(tmp)
+
+	ctx := p.ctx
+	if p.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.timeout)
+		defer cancel()
+	}
+	// The "file:" prefixes stop ffmpeg from reading a name such as "concat:a|b" as a protocol.
+	cmd := exec.CommandContext(ctx, p.ffmpeg, "-hide_banner", "-nostdin", "-loglevel", "info",
+		"-i", "file:"+src,
+		"-vf", "thumbnail,scale='min(640,iw)':-2", "-frames:v", "1",
+		"-f", "image2", "-c:v", "mjpeg", "-y", "file:"+tmp)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	runErr := cmd.Run()
+
+	var info Info
+	if m := durationPattern.FindSubmatch(stderr.Bytes()); m != nil {
+		h, _ := strconv.ParseFloat(string(m[1]), 64)
+		min, _ := strconv.ParseFloat(string(m[2]), 64)
+		s, _ := strconv.ParseFloat(string(m[3]), 64)
+		info.Duration = h*3600 + min*60 + s
+	}
+	if runErr == nil {
+		if err := os.Rename(tmp, p.PosterPath(sum)); err != nil {
+			return Info{}, err
+		}
+		info.Poster = true
+	}
+	// A video without a readable frame, e.g. one with only audio, still has a duration.
+	if runErr != nil && info.Duration == 0 {
+		if ctx.Err() != nil {
+			return Info{}, fmt.Errorf("ffmpeg timed out after %s", p.timeout)
+		}
+		return Info{}, errors.New(lastLine(stderr.String(), runErr))
+	}
+	return info, nil
+}
+
+// lastLine returns the last line ffmpeg wrote, which holds the reason it failed, or err if it
+// wrote nothing.
+func lastLine(stderr string, err error) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if last := strings.TrimSpace(lines[len(lines)-1]); last != "" {
+		return "ffmpeg: " + last
+	}
+	return err.Error()
+}
@@ -0,0 +1,28 @@
+package video
+
+import (
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+func TestDisabled(t *testing.T) {
+	p, err := Open(config.VideoConfig{}, "videos.json", "posters", nil, nil)
+	if p != nil || err != nil {
+		t.Fatalf("got %v, %v without ffmpeg, want previews disabled", p, err)
+	}
+	p.Extract("a.mp4", "sum")
+	if _, ok := p.Get("sum"); ok {
+		t.Error("disabled previews found one")
+	}
+	p.Prune(nil)
+	p.Close()
+}
+
+func TestIsVideo(t *testing.T) {
+	for name, want := range map[string]bool{"a.mp4": true, "dir/B.MKV": true, "a.mp4.txt": false, "mp4": false, "a.mp3": false} {
+		if got := IsVideo(name); got != want {
+			t.Errorf("IsVideo(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
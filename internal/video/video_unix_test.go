@@ -0,0 +1,128 @@
+//go:build unix
+
+package video
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+	"github.com/mascotmascot1/fileserver/internal/shard"
+)
+
+// fakeFFmpeg stands in for ffmpeg. It reports a duration and writes a poster, except for
+// inputs whose names ask it to fail, to have only audio or to hang.
+const fakeFFmpeg = `#!/bin/sh
+while [ $# -gt 1 ]; do
+	if [ "$1" = "-i" ]; then input="$2"; fi
+	shift
+done
+case "$input" in
+*slow*) exec sleep 10 ;;
+*broken*) echo "$input: Invalid data found when processing input" >&2; exit 1 ;;
+*audio*) echo "  Duration: 00:03:05.25, start: 0.000000, bitrate: 128 kb/s" >&2; echo "Output file does not contain any stream" >&2; exit 1 ;;
+esac
+echo "  Duration: 01:02:03.50, start: 0.000000, bitrate: 1000 kb/s" >&2
+printf jpeg > "${1#file:}"
+`
+
+// syncBuffer is a log that can be read whilst previews are extracted.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestPreviews(t *testing.T) {
+	dir := t.TempDir()
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte(fakeFFmpeg), 0755); err != nil {
+		t.Fatal(err)
+	}
+	st, err := shard.New(filepath.Join(dir, "files"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := config.VideoConfig{FFmpeg: ffmpeg, Timeout: time.Second}
+	meta, posters := filepath.Join(dir, "videos.json"), filepath.Join(dir, "posters")
+	var logs syncBuffer
+	p, err := Open(cfg, meta, posters, st, log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { p.Close() }()
+
+	// Videos are extracted one at a time, in order, so once the last is done so are the others.
+	for _, name := range []string{"broken.mp4", "slow.mkv", "notes.txt", "audio.webm", "holiday.MOV"} {
+		p.Extract(name, "sum-"+name)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for _, ok := p.Get("sum-holiday.MOV"); !ok; _, ok = p.Get("sum-holiday.MOV") {
+		if time.Now().After(deadline) {
+			t.Fatalf("no preview extracted; log:\n%s", logs.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		sum        string
+		want       Info
+		wantPoster bool
+	}{
+		{"sum-holiday.MOV", Info{Duration: 3723.5, Poster: true}, true},
+		{"sum-audio.webm", Info{Duration: 185.25}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sum, func(t *testing.T) {
+			if got, ok := p.Get(tt.sum); !ok || got != tt.want {
+				t.Errorf("got %+v, %v, want %+v", got, ok, tt.want)
+			}
+			if _, err := os.Stat(p.PosterPath(tt.sum)); (err == nil) != tt.wantPoster {
+				t.Errorf("poster: %v, want one %v", err, tt.wantPoster)
+			}
+		})
+	}
+	for _, sum := range []string{"sum-broken.mp4", "sum-slow.mkv", "sum-notes.txt"} {
+		if info, ok := p.Get(sum); ok {
+			t.Errorf("got preview %+v for %s", info, sum)
+		}
+	}
+	for _, want := range []string{"'broken.mp4': ffmpeg: file:", "Invalid data found", "'slow.mkv': ffmpeg timed out after 1s"} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("log lacks %q:\n%s", want, logs.String())
+		}
+	}
+
+	// The previews outlast a restart, until their videos are gone.
+	p.Close()
+	if p, err = Open(cfg, meta, posters, st, log.New(&logs, "", 0)); err != nil {
+		t.Fatal(err)
+	}
+	p.Prune(map[string]bool{"sum-audio.webm": true})
+	if _, ok := p.Get("sum-holiday.MOV"); ok {
+		t.Error("preview of a deleted video kept")
+	}
+	if _, err := os.Stat(p.PosterPath("sum-holiday.MOV")); !os.IsNotExist(err) {
+		t.Errorf("poster of a deleted video kept: %v", err)
+	}
+	if _, ok := p.Get("sum-audio.webm"); !ok {
+		t.Error("preview lost in the restart")
+	}
+}
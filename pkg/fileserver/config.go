@@ -0,0 +1,93 @@
+package fileserver
+
+import (
+	"log"
+
+	"github.com/mascotmascot1/fileserver/internal/config"
+)
+
+// Config is the configuration of a server, laid out as in fileserver.yaml.
+type Config = config.Config
+
+// The sections of a Config, and the entries of its lists, so that callers can build them:
+//
+//	cfg.Auth.APIKeys = append(cfg.Auth.APIKeys, fileserver.APIKey{Name: "ci", SHA256: sum, Roles: []string{"admin"}})
+//
+// Each is commented with where it appears in fileserver.yaml, which documents its settings.
+type (
+	ACLRule               = config.ACLRule               // acl[]
+	APIKey                = config.APIKey                // auth.apiKeys[]
+	AbuseConfig           = config.AbuseConfig           // abuse
+	AuditConfig           = config.AuditConfig           // audit
+	AuthConfig            = config.AuthConfig            // auth
+	CDNConfig             = config.CDNConfig             // cdn
+	CDNPurgeConfig        = config.CDNPurgeConfig        // cdn.purge[]
+	CDNSigningConfig      = config.CDNSigningConfig      // cdn.signedCookies
+	CSRFConfig            = config.CSRFConfig            // csrf
+	CacheConfig           = config.CacheConfig           // cache
+	CacheRule             = config.CacheRule             // cache.rules[]
+	ChatConfig            = config.ChatConfig            // notifications.chat[]
+	ClusterConfig         = config.ClusterConfig         // cluster
+	ClusterPeer           = config.ClusterPeer           // cluster.peers[]
+	ConversionConfig      = config.ConversionConfig      // conversion
+	CoordinationConfig    = config.CoordinationConfig    // coordination
+	DebugCaptureConfig    = config.DebugCaptureConfig    // debugCapture
+	DirQuotaConfig        = config.DirQuotaConfig        // dirQuotas[]
+	EditorConfig          = config.EditorConfig          // editor
+	EmailConfig           = config.EmailConfig           // notifications.email
+	ErrorReportingConfig  = config.ErrorReportingConfig  // errorReporting
+	EvictionConfig        = config.EvictionConfig        // eviction
+	FaultRule             = config.FaultRule             // faults.rules[]
+	FaultsConfig          = config.FaultsConfig          // faults
+	FetchConfig           = config.FetchConfig           // fetch
+	FileCacheConfig       = config.FileCacheConfig       // fileCache
+	GeoIPConfig           = config.GeoIPConfig           // geoIP
+	HiddenFilesConfig     = config.HiddenFilesConfig     // hiddenFiles
+	IndexConfig           = config.IndexConfig           // index
+	IntegrityConfig       = config.IntegrityConfig       // integrity
+	LeaderConfig          = config.LeaderConfig          // leader
+	LoggingConfig         = config.LoggingConfig         // logging
+	MetadataConfig        = config.MetadataConfig        // metadata
+	MetricsConfig         = config.MetricsConfig         // metrics
+	MirrorConfig          = config.MirrorConfig          // mirror
+	NotificationsConfig   = config.NotificationsConfig   // notifications
+	ParallelUploadsConfig = config.ParallelUploadsConfig // parallelUploads
+	PasteConfig           = config.PasteConfig           // paste
+	ProcessConfig         = config.ProcessConfig         // process
+	ProcessingConfig      = config.ProcessingConfig      // processing
+	PublishConfig         = config.PublishConfig         // notifications.publish
+	RBACConfig            = config.RBACConfig            // rbac
+	ReplicaConfig         = config.ReplicaConfig         // replica
+	ResponseHeadersRule   = config.ResponseHeadersRule   // responseHeaders[]
+	SecurityHeadersConfig = config.SecurityHeadersConfig // securityHeaders
+	ServerConfig          = config.ServerConfig          // server
+	SessionConfig         = config.SessionConfig         // session
+	ShardConfig           = config.ShardConfig           // shards[]
+	SigV4Key              = config.SigV4Key              // auth.sigV4Keys[]
+	SignedURLConfig       = config.SignedURLConfig       // auth.signedURLs
+	StaticUser            = config.StaticUser            // auth.users[]
+	StatsDConfig          = config.StatsDConfig          // metrics.statsd
+	SyslogConfig          = config.SyslogConfig          // logging.syslog
+	TLSConfig             = config.TLSConfig             // server.tls
+	TenancyConfig         = config.TenancyConfig         // tenancy
+	TenantConfig          = config.TenantConfig          // tenancy.tenants[]
+	UploadQuotaConfig     = config.UploadQuotaConfig     // uploadQuota
+	UploaderConfig        = config.UploaderConfig        // uploader
+	ValidationConfig      = config.ValidationConfig      // validation
+	VideoConfig           = config.VideoConfig           // video
+	ViewerConfig          = config.ViewerConfig          // viewer
+	WORMConfig            = config.WORMConfig            // worm
+	WORMRule              = config.WORMRule              // worm.rules[]
+)
+
+// DefaultConfig returns the configuration of a server without a configuration file. Its
+// directories are relative to the working directory.
+func DefaultConfig() *Config {
+	return config.Default()
+}
+
+// LoadConfig reads the configuration file at path over the defaults. A missing file is
+// logged to logger and leaves the defaults.
+func LoadConfig(path string, logger *log.Logger) (*Config, error) {
+	return config.NewConfig(path, orDiscard(logger))
+}
@@ -0,0 +1,55 @@
+package fileserver_test
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/pkg/fileserver"
+)
+
+// TestConfigTypes checks that every type a Config is built of can be named through this
+// package, so that callers can fill in any of its sections and lists.
+func TestConfigTypes(t *testing.T) {
+	f, err := parser.ParseFile(token.NewFileSet(), "config.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := map[string]bool{}
+	for _, decl := range f.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.TYPE {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			ts := spec.(*ast.TypeSpec)
+			if sel, ok := ts.Type.(*ast.SelectorExpr); ok && ts.Assign.IsValid() && sel.Sel.Name == ts.Name.Name {
+				public[ts.Name.Name] = true
+			}
+		}
+	}
+
+	configPkg := reflect.TypeFor[fileserver.Config]().PkgPath()
+	seen := map[reflect.Type]bool{}
+	var walk func(ty reflect.Type, at string)
+	walk = func(ty reflect.Type, at string) {
+		for ty.Kind() == reflect.Pointer || ty.Kind() == reflect.Slice || ty.Kind() == reflect.Array || ty.Kind() == reflect.Map {
+			ty = ty.Elem()
+		}
+		if ty.PkgPath() != configPkg || seen[ty] {
+			return
+		}
+		seen[ty] = true
+		if !public[ty.Name()] {
+			t.Errorf("%s, the type of %s, cannot be named outside the module", ty.Name(), at)
+		}
+		if ty.Kind() == reflect.Struct {
+			for i := range ty.NumField() {
+				walk(ty.Field(i).Type, at+"."+ty.Field(i).Name)
+			}
+		}
+	}
+	walk(reflect.TypeFor[fileserver.Config](), "Config")
+}
@@ -0,0 +1,121 @@
+// Package fileserver runs the file server inside another program, such as the tests of an
+// application that integrates with it, instead of as a process of its own.
+//
+// The server stores files in directories, as it does when run on its own; tests point them
+// at temporary ones:
+//
+//	cfg := fileserver.DefaultConfig()
+//	cfg.Uploader.StorageDir = t.TempDir()
+//	cfg.Metadata.Dir = t.TempDir()
+//	ts, err := fileserver.NewTestServer(cfg, nil)
+//	if err != nil {
+//		t.Fatal(err)
+//	}
+//	defer ts.Close()
+//	resp, err := ts.Client().Get(ts.URL + "/download/list.txt")
+//
+// Tests that need not touch the disk for stored files keep them in memory instead, with
+// package memfs, along with their metadata, holds and upload quotas. The server's other
+// stores, such as users, tokens and jobs, are still kept in the metadata directory on disk:
+//
+//	ts, err := fileserver.NewTestServerWithStorage(cfg, memfs.New().Open, nil)
+package fileserver
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/mascotmascot1/fileserver/internal/server"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// Handler serves the API of a server, for mounting in an http.Server of the caller's.
+type Handler struct {
+	http.Handler
+	srv *server.Server
+}
+
+// NewHandler returns the handler of a server configured by cfg, creating its directories and
+// opening its stores. The listening address and TLS settings of cfg are for the caller to
+// apply, as the caller does the listening. A nil logger discards the server's log.
+func NewHandler(cfg *Config, logger *log.Logger) (*Handler, error) {
+	return NewHandlerWithStorage(cfg, nil, logger)
+}
+
+// NewHandlerWithStorage is NewHandler, with the files stored in the storages that open
+// returns for the storage directories of cfg, and of its tenants, rather than in those
+// directories on disk. A nil open stores them on disk. Sharding, free space checks, video
+// and document previews and extended attributes need the files on disk, so cannot be
+// configured otherwise.
+func NewHandlerWithStorage(cfg *Config, open storage.Opener, logger *log.Logger) (*Handler, error) {
+	srv, err := server.NewServer(cfg, open, orDiscard(logger))
+	if err != nil {
+		return nil, err
+	}
+	return &Handler{Handler: srv.HTTP.Handler, srv: srv}, nil
+}
+
+// Storage returns where the server's files are stored, those of its tenants aside.
+func (h *Handler) Storage() storage.Storage {
+	return h.srv.Storage()
+}
+
+// Close stops the background work of the server, such as rescanning its files, saves its
+// stores and leaves the coordination service, if any. It is called once the requests to the
+// handler have completed; calling it again does nothing.
+func (h *Handler) Close() error {
+	return h.srv.Shutdown(context.Background())
+}
+
+// TestServer is a server listening on a local port, as started by httptest.
+type TestServer struct {
+	*httptest.Server
+	handler *Handler
+}
+
+// NewTestServer starts a server configured by cfg on a local port, served over plain HTTP
+// whatever cfg's TLS settings. Its URL and Client are those of httptest.Server.
+func NewTestServer(cfg *Config, logger *log.Logger) (*TestServer, error) {
+	return NewTestServerWithStorage(cfg, nil, logger)
+}
+
+// NewTestServerWithStorage is NewTestServer, with the files stored as NewHandlerWithStorage
+// stores them.
+func NewTestServerWithStorage(cfg *Config, open storage.Opener, logger *log.Logger) (*TestServer, error) {
+	h, err := NewHandlerWithStorage(cfg, open, logger)
+	if err != nil {
+		return nil, err
+	}
+	ts := httptest.NewUnstartedServer(h)
+	// The server's timeouts apply, so that tests see what clients of the real one would.
+	ts.Config.ReadTimeout = h.srv.HTTP.ReadTimeout
+	ts.Config.WriteTimeout = h.srv.HTTP.WriteTimeout
+	ts.Config.IdleTimeout = h.srv.HTTP.IdleTimeout
+	ts.Config.ErrorLog = h.srv.Logger
+	ts.Start()
+	return &TestServer{Server: ts, handler: h}, nil
+}
+
+// Storage returns where the server's files are stored, as Handler.Storage does.
+func (ts *TestServer) Storage() storage.Storage {
+	return ts.handler.Storage()
+}
+
+// Close stops the server, waiting for the requests in flight, and closes its handler.
+func (ts *TestServer) Close() {
+	ts.Server.Close()
+	if err := ts.handler.Close(); err != nil {
+		ts.handler.srv.Logger.Printf("error closing server: %v\n", err)
+	}
+}
+
+// orDiscard returns logger, or one that discards messages if it is nil.
+func orDiscard(logger *log.Logger) *log.Logger {
+	if logger == nil {
+		return log.New(io.Discard, "", 0)
+	}
+	return logger
+}
@@ -0,0 +1,144 @@
+package fileserver_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/pkg/fileserver"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+	"github.com/mascotmascot1/fileserver/pkg/storage/memfs"
+)
+
+// TestMemoryStorage uploads, downloads, moves and holds a file on a server that keeps its
+// files in memory, none of which may reach the storage directory on disk, nor their
+// metadata, holds and upload quotas the metadata directory.
+func TestMemoryStorage(t *testing.T) {
+	dir := t.TempDir()
+	cfg := fileserver.DefaultConfig()
+	cfg.Uploader.StorageDir = filepath.Join(dir, "files")
+	cfg.Metadata.Dir = filepath.Join(dir, "metadata")
+	// Moving files takes the admin role, which anonymous clients lack.
+	sum := sha256.Sum256([]byte("secret"))
+	cfg.Auth.APIKeys = []fileserver.APIKey{{Name: "test", SHA256: hex.EncodeToString(sum[:]), Roles: []string{"admin"}}}
+	cfg.UploadQuota.PerIPMB = 1
+	files := memfs.New()
+	ts, err := fileserver.NewTestServerWithStorage(cfg, files.Open, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ts.Close)
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", "docs/a.txt")
+	part.Write([]byte("hello"))
+	mw.Close()
+	resp, err := ts.Client().Post(ts.URL+"/upload", mw.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("upload: got %s %s, want %d", resp.Status, got, http.StatusOK)
+	}
+
+	resp, err = ts.Client().Get(ts.URL + "/download/docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(got) != "hello" {
+		t.Errorf("download: got %s %q, want %d %q", resp.Status, got, http.StatusOK, "hello")
+	}
+
+	batch := `{"operations": [{"op": "move", "path": "docs/a.txt", "to": "b.txt"}]}`
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/api/batch", strings.NewReader(batch))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "secret")
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("move: got %s %s, want %d", resp.Status, got, http.StatusOK)
+	}
+	if content, err := storage.ReadFile(ts.Storage(), "b.txt"); err != nil || string(content) != "hello" {
+		t.Errorf("moved file holds %q, %v, want %q", content, err, "hello")
+	}
+	if _, err := storage.ReadFile(ts.Storage(), "docs/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("file is still stored where it was moved from: %v", err)
+	}
+
+	req, _ = http.NewRequest(http.MethodPut, ts.URL+"/api/holds/b.txt", strings.NewReader(`{"legalHold": true, "reason": "audit"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", "secret")
+	resp, err = ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		t.Fatalf("hold: got %s %s", resp.Status, got)
+	}
+
+	// Closing saves the file metadata, which is otherwise saved a moment after it changes.
+	ts.Close()
+	if _, err := os.Stat(cfg.Uploader.StorageDir); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("storage directory exists on disk: %v", err)
+	}
+	for _, name := range []string{"files.json", "changes.json", "holds.json", "upload-quota.json"} {
+		if _, err := storage.ReadFile(files.Dir(cfg.Metadata.Dir), name); err != nil {
+			t.Errorf("%s is not kept in memory: %v", name, err)
+		}
+		if _, err := os.Stat(filepath.Join(cfg.Metadata.Dir, name)); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("%s exists in the metadata directory on disk: %v", name, err)
+		}
+	}
+}
+
+// TestMemoryStorageDiskFeatures checks that the features which need files on disk cannot be
+// configured with a storage in memory.
+func TestMemoryStorageDiskFeatures(t *testing.T) {
+	tests := []struct {
+		desc      string
+		configure func(cfg *fileserver.Config)
+	}{
+		{"shards", func(cfg *fileserver.Config) {
+			cfg.Shards = []fileserver.ShardConfig{{Prefix: "/videos", Dir: t.TempDir()}}
+		}},
+		{"free space", func(cfg *fileserver.Config) { cfg.Uploader.MinFreeSpaceMB = 1 }},
+		{"video previews", func(cfg *fileserver.Config) { cfg.Video.FFmpeg = "ffmpeg" }},
+		{"document previews", func(cfg *fileserver.Config) { cfg.Conversion.URL = "http://localhost:3000/convert" }},
+		{"extended attributes", func(cfg *fileserver.Config) { cfg.Metadata.Xattrs = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			cfg := fileserver.DefaultConfig()
+			cfg.Uploader.StorageDir = "files"
+			cfg.Metadata.Dir = t.TempDir()
+			tt.configure(cfg)
+			h, err := fileserver.NewHandlerWithStorage(cfg, memfs.New().Open, nil)
+			if err == nil {
+				h.Close()
+			}
+			if !errors.Is(err, storage.ErrNotOnDisk) {
+				t.Errorf("got error %v, want %v", err, storage.ErrNotOnDisk)
+			}
+		})
+	}
+}
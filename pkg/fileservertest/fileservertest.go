@@ -0,0 +1,238 @@
+// Package fileservertest starts file servers for tests, seeds them with files and checks what
+// they store, so that each test does not set up the same scaffolding:
+//
+//	func TestUpload(t *testing.T) {
+//		srv := fileservertest.StartTestServer(t, fileservertest.Options{APIKey: "secret"})
+//		srv.SeedFile("docs/a.txt", []byte("hello"))
+//		resp, err := srv.Client.Get(srv.URL + "/download/docs/a.txt")
+//		...
+//		srv.AssertStored("docs/a.txt", []byte("hello"))
+//	}
+package fileservertest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mascotmascot1/fileserver/pkg/fileserver"
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+	"github.com/mascotmascot1/fileserver/pkg/storage/memfs"
+)
+
+// Options configure a test server. The zero value starts one with the default settings, which
+// admit anonymous clients to upload and download.
+type Options struct {
+	// Configure, if set, changes the configuration before the server starts. Its storage,
+	// metadata and tenant directories point at temporary ones by then.
+	Configure func(cfg *fileserver.Config)
+	// APIKey, if set, is added to the configuration as an API key with the admin role, and
+	// the server's Client sends it with every request.
+	APIKey string
+	// Log sends the server's log to the test's, where it is shown if the test fails.
+	Log bool
+	// Memory keeps the stored files in memory, with package memfs, rather than in a
+	// temporary storage directory, along with their metadata, holds and upload quotas. The
+	// features that need them on disk cannot be configured.
+	Memory bool
+}
+
+// Server is a server started for a test, which stops it when the test ends.
+type Server struct {
+	// URL is the base URL of the API, including the configured base path.
+	URL string
+	// Client sends requests to the server, with the API key of Options, if any.
+	Client *http.Client
+	// StorageDir and MetadataDir are the temporary directories of the stored files and their
+	// metadata, removed when the test ends. With Options.Memory, StorageDir only names the
+	// storage in memory, and MetadataDir holds only the stores not kept there too.
+	StorageDir  string
+	MetadataDir string
+	t           testing.TB
+	storage     storage.Storage
+}
+
+// StartTestServer starts a server configured by opts on a local port, and stops it when the
+// test ends, along with all its background work, before its temporary directories are
+// removed. It fails the test if the server cannot be started.
+func StartTestServer(t testing.TB, opts Options) *Server {
+	t.Helper()
+	cfg := fileserver.DefaultConfig()
+	cfg.Uploader.StorageDir = t.TempDir()
+	cfg.Metadata.Dir = t.TempDir()
+	cfg.Tenancy.Dir = t.TempDir()
+	var open storage.Opener
+	if opts.Memory {
+		open = memfs.New().Open
+		cfg.Uploader.StorageDir = "files"
+	}
+	if opts.APIKey != "" {
+		sum := sha256.Sum256([]byte(opts.APIKey))
+		cfg.Auth.APIKeys = append(cfg.Auth.APIKeys, fileserver.APIKey{
+			Name:   "fileservertest",
+			SHA256: hex.EncodeToString(sum[:]),
+			Roles:  []string{"admin"},
+		})
+	}
+	if opts.Configure != nil {
+		opts.Configure(cfg)
+	}
+
+	var logger *log.Logger
+	if opts.Log {
+		tl := &testLog{t: t}
+		// Registered first, so that it runs last: the server may log whilst it stops, but
+		// the test must not be logged to once it has ended.
+		t.Cleanup(tl.stop)
+		logger = log.New(tl, "", log.Lmicroseconds)
+	}
+	ts, err := fileserver.NewTestServerWithStorage(cfg, open, logger)
+	if err != nil {
+		t.Fatalf("fileservertest: starting server: %v", err)
+	}
+	// Why does this suffice? Cleanups run last registered first, so the server stops, and
+	// with it everything that writes to its directories, before t.TempDir removes them.
+	t.Cleanup(ts.Close)
+
+	client := ts.Client()
+	if opts.APIKey != "" {
+		client.Transport = &keyTransport{key: opts.APIKey, next: client.Transport}
+	}
+	return &Server{
+		URL:         ts.URL + cfg.Server.GetBasePath(),
+		Client:      client,
+		StorageDir:  cfg.Uploader.StorageDir,
+		MetadataDir: cfg.Metadata.Dir,
+		t:           t,
+		storage:     ts.Storage(),
+	}
+}
+
+// SeedFile stores content as the file name, a slash-separated path below the storage
+// directory, through the upload API, so that the server indexes it and records its checksum
+// as it would any upload. It fails the test if the upload is refused.
+func (s *Server) SeedFile(name string, content []byte) {
+	s.t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreateFormFile("file", name)
+	if err == nil {
+		_, err = part.Write(content)
+	}
+	if err == nil {
+		err = mw.Close()
+	}
+	if err != nil {
+		s.t.Fatalf("fileservertest: seeding %s: %v", name, err)
+	}
+	resp, err := s.Client.Post(s.URL+"/upload", mw.FormDataContentType(), &body)
+	if err != nil {
+		s.t.Fatalf("fileservertest: seeding %s: %v", name, err)
+	}
+	defer resp.Body.Close()
+	// A multi-status response reports a file that was not stored, despite its 2xx status.
+	if resp.StatusCode/100 != 2 || resp.StatusCode == http.StatusMultiStatus {
+		msg, _ := io.ReadAll(resp.Body)
+		s.t.Fatalf("fileservertest: seeding %s: %s: %s", name, resp.Status, strings.TrimSpace(string(msg)))
+	}
+}
+
+// SeedFiles stores each of files, keyed by name, as SeedFile does.
+func (s *Server) SeedFiles(files map[string]string) {
+	s.t.Helper()
+	for name, content := range files {
+		s.SeedFile(name, []byte(content))
+	}
+}
+
+// Stored returns the content of the stored file name, read from the storage rather than
+// through the API, and whether it exists.
+func (s *Server) Stored(name string) ([]byte, bool) {
+	s.t.Helper()
+	content, err := storage.ReadFile(s.storage, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false
+	}
+	if err != nil {
+		s.t.Fatalf("fileservertest: reading %s: %v", name, err)
+	}
+	return content, true
+}
+
+// AssertStored fails the test unless the file name is stored with the content want.
+func (s *Server) AssertStored(name string, want []byte) {
+	s.t.Helper()
+	got, ok := s.Stored(name)
+	switch {
+	case !ok:
+		s.t.Errorf("file %s is not stored", name)
+	case !bytes.Equal(got, want):
+		s.t.Errorf("file %s holds %s, want %s", name, describe(got), describe(want))
+	}
+}
+
+// AssertNotStored fails the test if the file name is stored.
+func (s *Server) AssertNotStored(name string) {
+	s.t.Helper()
+	if _, ok := s.Stored(name); ok {
+		s.t.Errorf("file %s is stored, want none", name)
+	}
+}
+
+// describe quotes short content, and summarises long content by size and checksum, so that a
+// failure with large files does not flood the test's output.
+func describe(content []byte) string {
+	const maxQuoted = 64
+	if len(content) <= maxQuoted {
+		return strconv.Quote(string(content))
+	}
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf("%q... (%d bytes, SHA-256 %x...)", content[:maxQuoted], len(content), sum[:8])
+}
+
+// keyTransport sends an API key with every request.
+type keyTransport struct {
+	key  string
+	next http.RoundTripper
+}
+
+func (kt *keyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.Header.Get("X-API-Key") == "" && r.Header.Get("Authorization") == "" {
+		r = r.Clone(r.Context())
+		r.Header.Set("X-API-Key", kt.key)
+	}
+	return kt.next.RoundTrip(r)
+}
+
+// testLog writes the server's log to the test's until the test ends.
+type testLog struct {
+	mu      sync.Mutex
+	t       testing.TB
+	stopped bool
+}
+
+func (tl *testLog) Write(p []byte) (int, error) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+	if !tl.stopped {
+		tl.t.Log(strings.TrimSuffix(string(p), "\n"))
+	}
+	return len(p), nil
+}
+
+func (tl *testLog) stop() {
+	tl.mu.Lock()
+	tl.stopped = true
+	tl.mu.Unlock()
+}
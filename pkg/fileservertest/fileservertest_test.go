@@ -0,0 +1,93 @@
+package fileservertest
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/pkg/fileserver"
+)
+
+func TestStartTestServer(t *testing.T) {
+	for _, memory := range []bool{false, true} {
+		name := "disk"
+		if memory {
+			name = "memory"
+		}
+		t.Run(name, func(t *testing.T) {
+			srv := StartTestServer(t, Options{APIKey: "secret", Memory: memory})
+			srv.SeedFiles(map[string]string{"docs/a.txt": "hello", "b.txt": "world"})
+
+			resp, err := srv.Client.Get(srv.URL + "/download/docs/a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(got) != "hello" {
+				t.Errorf("download: got %s %q, want %d %q", resp.Status, got, http.StatusOK, "hello")
+			}
+			srv.AssertStored("docs/a.txt", []byte("hello"))
+			srv.AssertStored("b.txt", []byte("world"))
+			srv.AssertNotStored("docs/b.txt")
+
+			_, err = os.Stat(srv.StorageDir)
+			if onDisk := err == nil; onDisk == memory {
+				t.Errorf("storage directory on disk: %t, want %t", onDisk, !memory)
+			}
+		})
+	}
+}
+
+// TestServerStops starts servers with background work to do, and checks that, once their
+// tests have ended and their directories been removed, they leave nothing running or open.
+func TestServerStops(t *testing.T) {
+	run := func(name string) {
+		t.Run(name, func(t *testing.T) {
+			srv := StartTestServer(t, Options{
+				APIKey: "secret",
+				Log:    true,
+				Configure: func(cfg *fileserver.Config) {
+					cfg.Processing.Async = "always"
+					cfg.Tenancy.Tenants = append(cfg.Tenancy.Tenants, fileserver.TenantConfig{Name: "team-a"})
+				},
+			})
+			// Stored by a job, which may still be running when the test ends.
+			srv.SeedFile("a.txt", bytes.Repeat([]byte("a"), 1<<20))
+		})
+	}
+	// Why a first server before counting? The runtime opens what it needs for networking
+	// once, and keeps it.
+	run("first")
+	goroutines, fds := runtime.NumGoroutine(), openFiles(t)
+	run("second")
+
+	// Why poll? A goroutine that has been told to stop, and waited for, may still be on its
+	// way out of the runtime when Close returns.
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > goroutines; {
+		if time.Now().After(deadline) {
+			var stacks bytes.Buffer
+			pprof.Lookup("goroutine").WriteTo(&stacks, 1)
+			t.Fatalf("%d goroutine(s) left running:\n%s", runtime.NumGoroutine()-goroutines, &stacks)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := openFiles(t); n > fds {
+		t.Errorf("%d file descriptor(s) left open", n-fds)
+	}
+}
+
+// openFiles returns the number of file descriptors the process has open, where the system
+// lists them.
+func openFiles(t *testing.T) int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skipf("cannot count open files: %v", err)
+	}
+	return len(fds)
+}
@@ -0,0 +1,713 @@
+// Package memfs keeps the files a server stores in memory, for the tests of applications that
+// run it in-process: nothing is written to disk for them, and they are gone when the test
+// ends.
+//
+//	files := memfs.New()
+//	ts, err := fileserver.NewTestServerWithStorage(cfg, files.Open, nil)
+//
+// It behaves as a directory on disk does, as far as the server can tell, with two exceptions:
+// it has neither hard nor symbolic links, and files have no owners. The features that need
+// files on disk, such as free space checks and video previews, cannot be enabled with it.
+package memfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// errEscapes is returned for names that lie outside the storage directory, as os.Root does.
+var errEscapes = errors.New("path escapes from parent")
+
+// FS holds storage directories in memory.
+type FS struct {
+	mu   sync.Mutex
+	dirs map[string]*Storage
+}
+
+// New returns an FS without storage directories.
+func New() *FS {
+	return &FS{dirs: make(map[string]*Storage)}
+}
+
+// Open returns the storage directory dir, which is empty when first opened, and holds the
+// same files each time after. It is a storage.Opener, so that the main storage directory of a
+// server and each of its tenants' are kept apart.
+func (f *FS) Open(dir string) (storage.Storage, error) {
+	return f.Dir(dir), nil
+}
+
+// Dir returns the storage directory dir, as Open does.
+func (f *FS) Dir(dir string) *Storage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, ok := f.dirs[dir]
+	if !ok {
+		s = &Storage{dir: dir, root: newDir(fs.ModeDir | 0755)}
+		f.dirs[dir] = s
+	}
+	return s
+}
+
+// Storage is a storage directory in memory. Its files are all reached through one root.
+type Storage struct {
+	dir string
+
+	// mu guards the tree below root, and the content of its files.
+	mu   sync.Mutex
+	root *node
+}
+
+// node is a file or a directory.
+type node struct {
+	mode     fs.FileMode
+	modTime  time.Time
+	data     []byte           // of a file
+	children map[string]*node // of a directory
+}
+
+func newDir(mode fs.FileMode) *node {
+	return &node{mode: mode, modTime: time.Now(), children: make(map[string]*node)}
+}
+
+func (n *node) isDir() bool {
+	return n.mode.IsDir()
+}
+
+// info returns the attributes of n, which is named name.
+func (n *node) info(name string) fileInfo {
+	return fileInfo{name: name, size: int64(len(n.data)), mode: n.mode, modTime: n.modTime}
+}
+
+// Dir returns the name of the storage directory, whatever name is.
+func (s *Storage) Dir(name string) string {
+	return s.dir
+}
+
+// OpenRoot returns the root of the storage directory, whatever name is.
+func (s *Storage) OpenRoot(name string) (storage.Root, error) {
+	return &root{s: s}, nil
+}
+
+// Spans reports false, as every file is kept in the one directory.
+func (s *Storage) Spans(name string) bool {
+	return false
+}
+
+// Walk calls fn for every file, in lexical order within each directory, as filepath.WalkDir
+// does. fn may return fs.SkipDir to skip the rest of the directory of the file, or fs.SkipAll
+// to stop. The files are listed before fn is first called, so that fn may change them.
+func (s *Storage) Walk(fn func(name string, d fs.DirEntry) error) error {
+	s.mu.Lock()
+	tree := snapshot(s.root, ".")
+	s.mu.Unlock()
+	if err := walk(tree, "", fn); err != nil && err != fs.SkipAll {
+		return err
+	}
+	return nil
+}
+
+// entry is a file or directory listed by Walk.
+type entry struct {
+	info     fileInfo
+	children []entry // of a directory, by name
+}
+
+// snapshot lists n, which is named name, and everything below it. The caller holds the lock.
+func snapshot(n *node, name string) entry {
+	e := entry{info: n.info(name)}
+	for _, child := range sortedNames(n) {
+		e.children = append(e.children, snapshot(n.children[child], child))
+	}
+	return e
+}
+
+// walk calls fn for every file below the directory e, which is named dir.
+func walk(e entry, dir string, fn func(name string, d fs.DirEntry) error) error {
+	for _, child := range e.children {
+		name := path.Join(dir, child.info.name)
+		var err error
+		if child.info.IsDir() {
+			err = walk(child, name, fn)
+		} else {
+			err = fn(name, child.info)
+		}
+		if err == fs.SkipDir {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sortedNames returns the names of the entries of the directory n, in lexical order.
+func sortedNames(n *node) []string {
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// root is the storage directory opened as a storage.Root.
+type root struct {
+	s      *Storage
+	closed bool // guarded by s.mu
+}
+
+// split returns the elements of name, which are none for the root itself. Names that lie
+// outside the root are refused, as are absolute ones.
+func split(op, name string) ([]string, error) {
+	if name == "" {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	clean := path.Clean(name)
+	if path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return nil, &fs.PathError{Op: op, Path: name, Err: errEscapes}
+	}
+	if clean == "." {
+		return nil, nil
+	}
+	return strings.Split(clean, "/"), nil
+}
+
+// lookup returns the node name. The caller holds the lock.
+func (r *root) lookup(op, name string) (*node, error) {
+	elems, err := r.check(op, name)
+	if err != nil {
+		return nil, err
+	}
+	n := r.s.root
+	for _, elem := range elems {
+		if !n.isDir() {
+			return nil, &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		if n = n.children[elem]; n == nil {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return n, nil
+}
+
+// parent returns the directory that name is in and the last element of name, which must not
+// be the root itself. The caller holds the lock.
+func (r *root) parent(op, name string) (*node, string, error) {
+	elems, err := r.check(op, name)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(elems) == 0 {
+		return nil, "", &fs.PathError{Op: op, Path: name, Err: syscall.EBUSY}
+	}
+	dir := r.s.root
+	for _, elem := range elems[:len(elems)-1] {
+		next := dir.children[elem]
+		if next == nil {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if !next.isDir() {
+			return nil, "", &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+		}
+		dir = next
+	}
+	return dir, elems[len(elems)-1], nil
+}
+
+// check returns the elements of name, or an error if the root is closed. The caller holds the
+// lock.
+func (r *root) check(op, name string) ([]string, error) {
+	if r.closed {
+		return nil, &fs.PathError{Op: op, Path: name, Err: os.ErrClosed}
+	}
+	return split(op, name)
+}
+
+func (r *root) Name() string {
+	return r.s.dir
+}
+
+func (r *root) Open(name string) (storage.File, error) {
+	return r.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (r *root) Create(name string) (storage.File, error) {
+	return r.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (r *root) OpenFile(name string, flag int, perm fs.FileMode) (storage.File, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	write := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	elems, err := r.check("open", name)
+	if err != nil {
+		return nil, err
+	}
+	var n *node
+	if len(elems) == 0 {
+		n = r.s.root
+	} else {
+		dir, base, err := r.parent("open", name)
+		if err != nil {
+			return nil, err
+		}
+		n = dir.children[base]
+		switch {
+		case n == nil && flag&os.O_CREATE == 0:
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		case n == nil:
+			n = &node{mode: perm & fs.ModePerm, modTime: time.Now()}
+			dir.children[base] = n
+			dir.modTime = n.modTime
+		case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+	}
+	if n.isDir() && write {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+	}
+	if flag&os.O_TRUNC != 0 && write && len(n.data) > 0 {
+		n.data = nil
+		n.modTime = time.Now()
+	}
+	return &file{s: r.s, n: n, name: name, flag: flag}, nil
+}
+
+func (r *root) ReadFile(name string) ([]byte, error) {
+	f, err := r.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+func (r *root) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := r.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (r *root) Stat(name string) (fs.FileInfo, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	n, err := r.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return n.info(path.Base(name)), nil
+}
+
+// Lstat is Stat, as there are no symbolic links.
+func (r *root) Lstat(name string) (fs.FileInfo, error) {
+	return r.Stat(name)
+}
+
+func (r *root) MkdirAll(name string, perm fs.FileMode) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	elems, err := r.check("mkdir", name)
+	if err != nil {
+		return err
+	}
+	dir := r.s.root
+	for _, elem := range elems {
+		next := dir.children[elem]
+		if next == nil {
+			next = newDir(fs.ModeDir | perm&fs.ModePerm)
+			dir.children[elem] = next
+			dir.modTime = next.modTime
+		} else if !next.isDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		dir = next
+	}
+	return nil
+}
+
+func (r *root) Remove(name string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	dir, base, err := r.parent("remove", name)
+	if err != nil {
+		return err
+	}
+	n := dir.children[base]
+	if n == nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if n.isDir() && len(n.children) > 0 {
+		return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+	}
+	delete(dir.children, base)
+	dir.modTime = time.Now()
+	return nil
+}
+
+func (r *root) RemoveAll(name string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	dir, base, err := r.parent("removeall", name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := dir.children[base]; ok {
+		delete(dir.children, base)
+		dir.modTime = time.Now()
+	}
+	return nil
+}
+
+func (r *root) Rename(oldname, newname string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	linkErr := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	oldDir, oldBase, err := r.parent("rename", oldname)
+	if err != nil {
+		return linkErr(errors.Unwrap(err))
+	}
+	n := oldDir.children[oldBase]
+	if n == nil {
+		return linkErr(fs.ErrNotExist)
+	}
+	newDir, newBase, err := r.parent("rename", newname)
+	if err != nil {
+		return linkErr(errors.Unwrap(err))
+	}
+	if oldDir == newDir && oldBase == newBase {
+		return nil
+	}
+	// A directory cannot be moved below itself.
+	if n.isDir() && strings.HasPrefix(path.Clean(newname), path.Clean(oldname)+"/") {
+		return linkErr(syscall.EINVAL)
+	}
+	if target := newDir.children[newBase]; target != nil {
+		switch {
+		case n.isDir() && !target.isDir():
+			return linkErr(syscall.ENOTDIR)
+		case !n.isDir() && target.isDir():
+			return linkErr(syscall.EISDIR)
+		case target.isDir() && len(target.children) > 0:
+			return linkErr(syscall.ENOTEMPTY)
+		}
+	}
+	delete(oldDir.children, oldBase)
+	newDir.children[newBase] = n
+	now := time.Now()
+	oldDir.modTime, newDir.modTime = now, now
+	return nil
+}
+
+// Link fails, as there are no hard links; the server copies files instead.
+func (r *root) Link(oldname, newname string) error {
+	return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: errors.ErrUnsupported}
+}
+
+func (r *root) Chmod(name string, mode fs.FileMode) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	n, err := r.lookup("chmod", name)
+	if err != nil {
+		return err
+	}
+	n.mode = n.mode&fs.ModeType | mode&fs.ModePerm
+	return nil
+}
+
+// Lchown does nothing but check that name exists, as files have no owners.
+func (r *root) Lchown(name string, uid, gid int) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	_, err := r.lookup("lchown", name)
+	return err
+}
+
+// Chtimes sets the modification time of name; there are no access times. A zero mtime
+// leaves it unchanged, as os.Chtimes does.
+func (r *root) Chtimes(name string, atime, mtime time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	n, err := r.lookup("chtimes", name)
+	if err != nil {
+		return err
+	}
+	if !mtime.IsZero() {
+		n.modTime = mtime
+	}
+	return nil
+}
+
+func (r *root) FS() fs.FS {
+	return rootFS{r}
+}
+
+func (r *root) Close() error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.closed = true
+	return nil
+}
+
+// rootFS is a root as an fs.FS, which only takes the names that fs.ValidPath allows.
+type rootFS struct {
+	r *root
+}
+
+func (rfs rootFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return rfs.r.Open(name)
+}
+
+func (rfs rootFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return rfs.r.Stat(name)
+}
+
+// file is an open file or directory.
+type file struct {
+	s    *Storage
+	n    *node
+	name string
+	flag int
+
+	// Guarded by s.mu.
+	off    int64
+	listed int // entries of a directory returned by ReadDir
+	closed bool
+}
+
+// check returns an error if the file is closed, or if it was not opened for writing and
+// write is set, or for reading and it is not. The caller holds the lock.
+func (f *file) check(op string, write bool) error {
+	if f.closed {
+		return &fs.PathError{Op: op, Path: f.name, Err: os.ErrClosed}
+	}
+	writable := f.flag&(os.O_WRONLY|os.O_RDWR) != 0
+	readable := f.flag&os.O_WRONLY == 0
+	if write && !writable || !write && !readable {
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EBADF}
+	}
+	if f.n.isDir() && op != "seek" && op != "stat" && op != "readdir" {
+		return &fs.PathError{Op: op, Path: f.name, Err: syscall.EISDIR}
+	}
+	return nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if err := f.check("read", false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "readat", Path: f.name, Err: syscall.EINVAL}
+	}
+	return f.readAt(p, off)
+}
+
+// readAt reads p from off, returning io.EOF if it reaches the end. The caller holds the lock.
+func (f *file) readAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.n.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *file) Write(p []byte) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.off = int64(len(f.n.data))
+	}
+	f.writeAt(p, f.off)
+	f.off += int64(len(p))
+	return len(p), nil
+}
+
+func (f *file) WriteAt(p []byte, off int64) (int, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if err := f.check("write", true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		return 0, errors.New("memfs: invalid use of WriteAt on file opened with O_APPEND")
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "writeat", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.writeAt(p, off)
+	return len(p), nil
+}
+
+// writeAt writes p at off, filling any gap before it with zeros. The caller holds the lock.
+func (f *file) writeAt(p []byte, off int64) {
+	if end := off + int64(len(p)); end > int64(len(f.n.data)) {
+		f.n.data = slices.Grow(f.n.data, int(end)-len(f.n.data))[:end]
+	}
+	copy(f.n.data[off:], p)
+	f.n.modTime = time.Now()
+}
+
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: os.ErrClosed}
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.n.data))
+	case io.SeekStart:
+	default:
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.name, Err: syscall.EINVAL}
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "stat", Path: f.name, Err: os.ErrClosed}
+	}
+	return f.n.info(path.Base(f.name)), nil
+}
+
+// ReadDir returns the entries of a directory in lexical order, n at a time as os.File's
+// ReadDir does.
+func (f *file) ReadDir(n int) ([]fs.DirEntry, error) {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: os.ErrClosed}
+	}
+	if !f.n.isDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	names := sortedNames(f.n)[min(f.listed, len(f.n.children)):]
+	if n > 0 {
+		if len(names) == 0 {
+			return nil, io.EOF
+		}
+		names = names[:min(n, len(names))]
+	}
+	entries := make([]fs.DirEntry, len(names))
+	for i, name := range names {
+		entries[i] = f.n.children[name].info(name)
+	}
+	f.listed += len(names)
+	return entries, nil
+}
+
+func (f *file) Truncate(size int64) error {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if err := f.check("truncate", true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &fs.PathError{Op: "truncate", Path: f.name, Err: syscall.EINVAL}
+	}
+	if size > int64(len(f.n.data)) {
+		f.n.data = append(f.n.data, make([]byte, size-int64(len(f.n.data)))...)
+	} else {
+		f.n.data = f.n.data[:size]
+	}
+	f.n.modTime = time.Now()
+	return nil
+}
+
+// Sync does nothing, as there is nowhere to write the file to.
+func (f *file) Sync() error {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "sync", Path: f.name, Err: os.ErrClosed}
+	}
+	return nil
+}
+
+func (f *file) Close() error {
+	f.s.mu.Lock()
+	defer f.s.mu.Unlock()
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.name, Err: os.ErrClosed}
+	}
+	f.closed = true
+	return nil
+}
+
+// fileInfo describes a file or directory, as both fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi fileInfo) Name() string               { return fi.name }
+func (fi fileInfo) Size() int64                { return fi.size }
+func (fi fileInfo) Mode() fs.FileMode          { return fi.mode }
+func (fi fileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi fileInfo) IsDir() bool                { return fi.mode.IsDir() }
+func (fi fileInfo) Sys() any                   { return nil }
+func (fi fileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
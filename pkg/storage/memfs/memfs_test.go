@@ -0,0 +1,254 @@
+package memfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mascotmascot1/fileserver/pkg/storage"
+)
+
+// TestRoot runs the same operations on a directory on disk and on one in memory, which must
+// agree on their outcomes.
+func TestRoot(t *testing.T) {
+	roots := map[string]func(t *testing.T) storage.Root{
+		"disk": func(t *testing.T) storage.Root {
+			root, err := storage.OpenRoot(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			return root
+		},
+		"memory": func(t *testing.T) storage.Root {
+			root, err := New().Dir("files").OpenRoot("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return root
+		},
+	}
+	for desc, open := range roots {
+		t.Run(desc, func(t *testing.T) {
+			root := open(t)
+			defer root.Close()
+			testRoot(t, root)
+		})
+	}
+}
+
+func testRoot(t *testing.T, root storage.Root) {
+	want := func(what string, err, target error) {
+		t.Helper()
+		if !errors.Is(err, target) {
+			t.Errorf("%s: got error %v, want %v", what, err, target)
+		}
+	}
+	wantContent := func(name, content string) {
+		t.Helper()
+		got, err := root.ReadFile(name)
+		if err != nil {
+			t.Fatalf("reading %s: %v", name, err)
+		}
+		if string(got) != content {
+			t.Errorf("%s holds %q, want %q", name, got, content)
+		}
+	}
+
+	_, err := root.Create("a/b/c.txt")
+	want("creating a file in a missing directory", err, fs.ErrNotExist)
+	for _, name := range []string{"../x", "./../x", "/etc/passwd"} {
+		if _, err := root.Open(name); err == nil || errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("opening %s: got error %v, want it refused", name, err)
+		}
+	}
+
+	if err := root.MkdirAll("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.WriteFile("a/b/c.txt", []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wantContent("a/b/c.txt", "hello")
+	_, err = root.OpenFile("a/b/c.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	want("creating an existing file exclusively", err, fs.ErrExist)
+	want("making a directory below a file", root.MkdirAll("a/b/c.txt/d", 0755), syscall.ENOTDIR)
+	want("removing a directory that is not empty", root.Remove("a"), syscall.ENOTEMPTY)
+
+	info, err := root.Stat("a/b/c.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Name() != "c.txt" || info.Size() != 5 || info.IsDir() {
+		t.Errorf("file stats as %s of %d bytes (directory %t), want c.txt of 5 bytes", info.Name(), info.Size(), info.IsDir())
+	}
+	if info, err := root.Stat("a"); err != nil || !info.IsDir() {
+		t.Errorf("directory stats as %v, %v", info, err)
+	}
+
+	if err := root.Rename("a/b/c.txt", "a/d.txt"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = root.Stat("a/b/c.txt")
+	want("stating a renamed file", err, fs.ErrNotExist)
+	wantContent("a/d.txt", "hello")
+	if err := root.Rename("a", "a/b/e"); err == nil {
+		t.Error("moving a directory below itself succeeded")
+	}
+
+	f, err := root.OpenFile("a/d.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte(" world")); err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Read(make([]byte, 1))
+	want("reading a file opened for writing", err, syscall.EBADF)
+	f.Close()
+	wantContent("a/d.txt", "hello world")
+
+	f, err = root.OpenFile("a/d.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("!"), 12); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if n, err := f.ReadAt(buf, 11); n != 2 || err != nil || !bytes.Equal(buf, []byte{0, '!'}) {
+		t.Errorf("reading across a gap got %q, %v, want %q", buf[:n], err, "\x00!")
+	}
+	if n, err := f.ReadAt(buf, 12); n != 1 || err != io.EOF {
+		t.Errorf("reading past the end got %d bytes, %v, want 1 byte and EOF", n, err)
+	}
+	if err := f.Truncate(5); err != nil {
+		t.Fatal(err)
+	}
+	if pos, err := f.Seek(-2, io.SeekEnd); pos != 3 || err != nil {
+		t.Errorf("seeking from the end got %d, %v, want 3", pos, err)
+	}
+	if rest, err := io.ReadAll(f); string(rest) != "lo" || err != nil {
+		t.Errorf("reading from 3 got %q, %v, want %q", rest, err, "lo")
+	}
+	f.Close()
+	want("closing a file again", f.Close(), os.ErrClosed)
+	wantContent("a/d.txt", "hello")
+
+	dir, err := root.Open("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for {
+		entries, err := dir.ReadDir(1)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, entries[0].Name())
+	}
+	dir.Close()
+	if !slices.Equal(names, []string{"b", "d.txt"}) {
+		t.Errorf("directory lists %q, want %q", names, []string{"b", "d.txt"})
+	}
+	names = nil
+	err = fs.WalkDir(root.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		names = append(names, name)
+		return err
+	})
+	if err != nil || !slices.Equal(names, []string{".", "a", "a/b", "a/d.txt"}) {
+		t.Errorf("walking the root lists %q, %v, want %q", names, err, []string{".", "a", "a/b", "a/d.txt"})
+	}
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := root.Chtimes("a/d.txt", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := root.Chmod("a/d.txt", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := root.Stat("a/d.txt"); err != nil || !info.ModTime().Equal(mtime) || info.Mode() != 0600 {
+		t.Errorf("file stats as %v, %v, want mode 0600 and modified at %v", info, err, mtime)
+	}
+
+	if err := root.RemoveAll("a"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = root.Stat("a")
+	want("stating a removed directory", err, fs.ErrNotExist)
+	if err := root.RemoveAll("missing"); err != nil {
+		t.Errorf("removing a missing directory: %v", err)
+	}
+}
+
+func TestOpen(t *testing.T) {
+	files := New()
+	st, err := files.Open("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := st.OpenRoot("x.txt")
+	if err := root.WriteFile("x.txt", []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	again, _ := files.Open("files")
+	if content, err := storage.ReadFile(again, "x.txt"); string(content) != "x" || err != nil {
+		t.Errorf("reopened storage holds %q, %v, want %q", content, err, "x")
+	}
+	other, _ := files.Open("tenants/a/files")
+	if _, err := storage.ReadFile(other, "x.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("another storage directory holds x.txt: %v", err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	st := New().Dir("files")
+	root, _ := st.OpenRoot("")
+	for _, name := range []string{"b/2.txt", "a/y/1.txt", "c.txt", "a/x.txt", "b/1.txt"} {
+		if err := root.MkdirAll(path.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := root.WriteFile(name, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		desc string
+		stop string // the file at which fn returns err
+		err  error
+		want []string
+	}{
+		{"every file", "", nil, []string{"a/x.txt", "a/y/1.txt", "b/1.txt", "b/2.txt", "c.txt"}},
+		{"skipping a directory", "b/1.txt", fs.SkipDir, []string{"a/x.txt", "a/y/1.txt", "b/1.txt", "c.txt"}},
+		{"skipping the rest", "b/1.txt", fs.SkipAll, []string{"a/x.txt", "a/y/1.txt", "b/1.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.desc, func(t *testing.T) {
+			var got []string
+			err := st.Walk(func(name string, d fs.DirEntry) error {
+				got = append(got, name)
+				if name == tt.stop {
+					return tt.err
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("walked %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Package storage defines where a server keeps the files it stores: in directories on disk,
+// as it does when run on its own, or elsewhere, such as in memory with package memfs for
+// the tests of an application that integrates with it.
+//
+// The files are reached through a Root, which confines names to the directory it was opened
+// on, as os.Root does; a Storage spread over several disks opens a root for each.
+package storage
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// Storage holds the stored files, below the one namespace that clients see. Names are
+// slash-separated and relative to the storage directory.
+type Storage interface {
+	// Dir returns the directory that the file or directory name is stored in. Names stored
+	// in the same directory are reached through the same root.
+	Dir(name string) string
+	// OpenRoot opens the directory that name is stored in.
+	OpenRoot(name string) (Root, error)
+	// Spans reports whether the directory name holds files stored in more than one
+	// directory, which cannot be moved with a rename.
+	Spans(name string) bool
+	// Walk calls fn for every stored file, with its name; directories are descended into
+	// rather than passed to fn. A storage directory that does not exist yet holds no files.
+	Walk(fn func(name string, d fs.DirEntry) error) error
+}
+
+// Disk is implemented by storages that keep their files in directories on disk, for the
+// features that need them there: free space checks, change notifications, extended
+// attributes, and the programs that make previews.
+type Disk interface {
+	Storage
+	// Dirs returns every directory files are stored in.
+	Dirs() []string
+	// Path returns the path on disk of the file or directory name.
+	Path(name string) string
+}
+
+// Opener opens the storage of the storage directory dir: the main one, or a tenant's.
+type Opener func(dir string) (Storage, error)
+
+// Root is a directory that files are stored in, with the methods of os.Root that the
+// server uses. Names that escape it are refused.
+type Root interface {
+	Name() string
+	Open(name string) (File, error)
+	Create(name string) (File, error)
+	OpenFile(name string, flag int, perm fs.FileMode) (File, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	MkdirAll(name string, perm fs.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+	Link(oldname, newname string) error
+	Chmod(name string, mode fs.FileMode) error
+	Lchown(name string, uid, gid int) error
+	Chtimes(name string, atime, mtime time.Time) error
+	FS() fs.FS
+	Close() error
+}
+
+// File is an open file of a Root, with the methods of os.File that the server uses. Files
+// on disk are *os.File, which the server copies with sendfile and clones where it can.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Stat() (fs.FileInfo, error)
+	ReadDir(n int) ([]fs.DirEntry, error)
+	Truncate(size int64) error
+	Sync() error
+}
+
+// OpenRoot opens the directory dir on disk as a Root.
+func OpenRoot(dir string) (Root, error) {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return nil, err
+	}
+	return osRoot{root}, nil
+}
+
+// osRoot is a directory on disk. Only the methods that open files differ from os.Root's, to
+// return them as File.
+type osRoot struct {
+	*os.Root
+}
+
+func (r osRoot) Open(name string) (File, error) {
+	return fileOrNil(r.Root.Open(name))
+}
+
+func (r osRoot) Create(name string) (File, error) {
+	return fileOrNil(r.Root.Create(name))
+}
+
+func (r osRoot) OpenFile(name string, flag int, perm fs.FileMode) (File, error) {
+	return fileOrNil(r.Root.OpenFile(name, flag, perm))
+}
+
+// fileOrNil returns f as a File, or a nil File rather than one holding a nil *os.File.
+func fileOrNil(f *os.File, err error) (File, error) {
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// ReadFile returns the content of the stored file name.
+func ReadFile(s Storage, name string) ([]byte, error) {
+	root, err := s.OpenRoot(name)
+	if err != nil {
+		return nil, err
+	}
+	defer root.Close()
+	return root.ReadFile(name)
+}
+
+// ErrNotOnDisk is returned for features that need the files of a storage on disk, by
+// storages that keep them elsewhere.
+var ErrNotOnDisk = errors.New("the storage directory is not on disk")
+
+// Roots opens the directories that files are stored in as they are first needed, for work
+// on several files at once.
+type Roots struct {
+	storage Storage
+	open    map[string]Root
+}
+
+// NewRoots returns an empty set of the open directories of s, which must be closed.
+func NewRoots(s Storage) *Roots {
+	return &Roots{storage: s, open: make(map[string]Root)}
+}
+
+// Open returns the opened directory that name is stored in.
+func (rs *Roots) Open(name string) (Root, error) {
+	dir := rs.storage.Dir(name)
+	if root, ok := rs.open[dir]; ok {
+		return root, nil
+	}
+	root, err := rs.storage.OpenRoot(name)
+	if err != nil {
+		return nil, err
+	}
+	rs.open[dir] = root
+	return root, nil
+}
+
+// Close closes the opened directories.
+func (rs *Roots) Close() {
+	for _, root := range rs.open {
+		root.Close()
+	}
+}